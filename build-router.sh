@@ -0,0 +1,36 @@
+#!/bin/bash
+# InterMesh router build script
+# Cross-compiles the intermesh daemon for common OpenWrt/embedded targets.
+# Gateway mode (netlink routes, iptables NAT) is only linked into linux builds;
+# gomobile builds (android/ios) never include it.
+
+set -e
+
+OUT=build/router
+mkdir -p "$OUT"
+
+# GOOS/GOARCH[/variant] targets
+TARGETS=(
+    "linux/amd64"
+    "linux/arm64"
+    "linux/arm/7"
+    "linux/arm/5"
+    "linux/mips/softfloat"
+    "linux/mipsle/softfloat"
+)
+
+for target in "${TARGETS[@]}"; do
+    IFS=/ read -r goos goarch variant <<< "$target"
+    name="intermesh-${goos}-${goarch}${variant:+-$variant}"
+
+    env=(CGO_ENABLED=0 GOOS="$goos" GOARCH="$goarch")
+    case "$goarch" in
+        arm) env+=(GOARM="$variant") ;;
+        mips|mipsle) env+=(GOMIPS="$variant") ;;
+    esac
+
+    echo "Building $name..."
+    env "${env[@]}" go build -trimpath -ldflags="-s -w" -o "$OUT/$name" ./cmd/intermesh
+done
+
+echo "Binaries written to $OUT"
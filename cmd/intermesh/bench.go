@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
+)
+
+// runBench runs a local stress test and prints the report as JSON.
+// Runs with the same flags and seed drive the same topology and traffic.
+func runBench(args []string) {
+	d := mesh.DefaultBenchConfig()
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	nodes := fs.Int("nodes", d.Nodes, "Number of virtual nodes")
+	topology := fs.String("topology", d.Topology, "Topology: full, ring, line or star")
+	rate := fs.Int("rate", d.BroadcastRate, "Broadcasts per second across the mesh")
+	size := fs.Int("size", d.MessageSize, "Broadcast payload size in bytes")
+	duration := fs.Duration("duration", d.Duration, "How long to drive broadcast traffic")
+	tunnel := fs.Int("tunnel", d.TunnelRequests, "Tunnel requests to proxy through node 0 (0 to skip)")
+	concurrency := fs.Int("concurrency", d.TunnelConcurrency, "Concurrent tunnel requests")
+	body := fs.Int("body", d.TunnelBodySize, "Tunnel response body size in bytes")
+	seed := fs.Int64("seed", d.Seed, "Seed for the traffic pattern")
+	fs.Parse(args)
+
+	report, err := mesh.RunBench(mesh.BenchConfig{
+		Nodes:             *nodes,
+		Topology:          *topology,
+		BroadcastRate:     *rate,
+		MessageSize:       *size,
+		Duration:          *duration,
+		TunnelRequests:    *tunnel,
+		TunnelConcurrency: *concurrency,
+		TunnelBodySize:    *body,
+		Seed:              *seed,
+	})
+	if err != nil {
+		log.Fatalf("Benchmark failed: %v", err)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode report: %v", err)
+	}
+	fmt.Println(string(data))
+}
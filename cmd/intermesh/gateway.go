@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/gateway"
+)
+
+// runGateway configures this host as a router for mesh clients (Linux only):
+// NAT from the LAN side to the uplink, plus an optional route to the mesh subnet.
+func runGateway(args []string) {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	lan := fs.String("lan", "br-lan", "Interface mesh clients are reached through")
+	wan := fs.String("wan", "", "Uplink interface to share")
+	meshSubnet := fs.String("mesh-subnet", "", "Optional CIDR of the mesh, routed via the LAN interface")
+	disable := fs.Bool("disable", false, "Remove the gateway configuration instead of applying it")
+	fs.Parse(args)
+
+	cfg := gateway.NATConfig{LANInterface: *lan, WANInterface: *wan}
+
+	var route *gateway.Route
+	if *meshSubnet != "" {
+		_, subnet, err := net.ParseCIDR(*meshSubnet)
+		if err != nil {
+			log.Fatalf("Invalid mesh subnet: %v", err)
+		}
+		route = &gateway.Route{Dst: subnet, Interface: *lan}
+	}
+
+	if *disable {
+		if route != nil {
+			if err := gateway.DeleteRoute(*route); err != nil {
+				log.Printf("Failed to remove mesh route: %v", err)
+			}
+		}
+		if err := gateway.DisableNAT(cfg); err != nil {
+			log.Fatalf("Failed to disable NAT: %v", err)
+		}
+		log.Println("Gateway mode disabled")
+		return
+	}
+
+	if err := gateway.EnableNAT(cfg); err != nil {
+		log.Fatalf("Failed to enable NAT: %v", err)
+	}
+	if route != nil {
+		if err := gateway.AddRoute(*route); err != nil {
+			log.Fatalf("Failed to add mesh route: %v", err)
+		}
+	}
+	log.Printf("Gateway mode enabled: %s -> %s", *lan, *wan)
+}
@@ -1,27 +1,73 @@
 package main
 
 import (
-	"context"
+	"encoding/json"
 	"flag"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
 )
 
+// keystorePassphraseEnv names the variable holding the keystore passphrase, kept off the command line
+const keystorePassphraseEnv = "INTERMESH_KEYSTORE_PASSPHRASE"
+
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		runStatus(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gateway" {
+		runGateway(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+
 	// Command-line flags
 	nodeID := flag.String("id", "node-1", "Unique identifier for this node")
+	identityPath := flag.String("identity", "", "Derive the node ID from the key in this file, creating it if missing (overrides -id)")
+	keystorePath := flag.String("keystore", "", "Keep the identity, pinned peer keys and tokens in this encrypted file, sealed with $"+keystorePassphraseEnv+" (overrides -id and -identity)")
 	nodeName := flag.String("name", "InterMesh Node", "Human-readable name for this node")
 	ip := flag.String("ip", "", "IP address of this node (auto-detected if empty)")
 	mac := flag.String("mac", "", "MAC address of this node (auto-detected if empty)")
 	hasInternet := flag.Bool("internet", false, "Force internet status (auto-detected if not set)")
 	autoDetect := flag.Bool("auto", true, "Auto-detect network configuration")
+	lowMemory := flag.Bool("low-memory", false, "Use the constrained-resources profile for small gateways")
+	logPath := flag.String("log", "", "Write logs to this file instead of stderr")
+	statePath := flag.String("state", "", "Save state here on shutdown and restore it on start, for restarts by a supervisor")
+	recordPath := flag.String("record", "", "Record anonymized control-plane traffic and write it here on shutdown, for bug reports")
+	wsAddr := flag.String("ws", "", "Also accept peers over WebSocket on this address (e.g. :8080), for browsers and HTTP-only networks")
+	wsPeers := flag.String("ws-peers", "", "Comma-separated id=ws://host:port peers to link to over WebSocket")
+	statusSocket := flag.String("status-socket", mesh.DefaultStatusSocket, "Answer 'intermesh status' on this socket; empty disables it")
 
 	flag.Parse()
 
+	cfg := mesh.DefaultConfig()
+	if *lowMemory {
+		cfg = mesh.LowMemoryConfig()
+	}
+	if *logPath != "" {
+		logFile, err := mesh.OpenLogFile(*logPath, cfg.CompressLogs)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+
 	// Auto-detect network info if enabled
 	var nodeIP, nodeMAC string
 	var internetStatus bool
@@ -48,33 +94,79 @@ func main() {
 		internetStatus = true
 	}
 
-	// Create the node
-	node := mesh.NewNode(*nodeID, *nodeName, nodeIP, nodeMAC)
+	// Create the mesh app
+	app := mesh.NewMeshApp(*nodeID, *nodeName, nodeIP, nodeMAC)
+	if *identityPath != "" {
+		identity, err := mesh.LoadOrCreateIdentity(*identityPath)
+		if err != nil {
+			log.Fatalf("Failed to load identity: %v", err)
+		}
+		app = mesh.NewMeshAppWithIdentity(identity, *nodeName, nodeIP, nodeMAC)
+		*nodeID = app.Node.ID
+	}
+	if *keystorePath != "" {
+		passphrase := os.Getenv(keystorePassphraseEnv)
+		if passphrase == "" {
+			log.Printf("Warning: %s is not set; the keystore is sealed with an empty passphrase", keystorePassphraseEnv)
+		}
+		ks, err := mesh.OpenKeystore(*keystorePath, passphrase)
+		if err != nil {
+			log.Fatalf("Failed to open keystore: %v", err)
+		}
+		if app, err = mesh.NewMeshAppWithKeystore(ks, *nodeName, nodeIP, nodeMAC); err != nil {
+			log.Fatalf("Failed to load identity from keystore: %v", err)
+		}
+		*nodeID = app.Node.ID
+	}
+	app.ApplyConfig(cfg)
+	node := app.Node
 	node.SetInternetStatus(internetStatus)
 
 	log.Printf("Starting InterMesh node: %s (%s)", node.Name, node.ID)
 	log.Printf("IP: %s, MAC: %s", node.IP, node.MAC)
 	log.Printf("Internet connectivity: %v", node.GetInternetStatus())
 
-	// Create the mesh manager
-	manager := mesh.NewManager(node)
+	// Serve on the sockets of the daemon we replace, or of a supervisor, if we were given any
+	listeners, err := mesh.InheritedListeners()
+	if err != nil {
+		log.Printf("Failed to inherit listeners: %v", err)
+	}
+	app.AdoptListeners(listeners)
 
 	// Create the personal network manager
 	pnManager := mesh.NewPersonalNetworkManager()
 
-	// Setup signal handling for graceful shutdown
+	// Setup signal handling for graceful shutdown and in-place upgrades
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	upgradeChan := make(chan os.Signal, 1)
+	notifyUpgrade(upgradeChan)
 
-	// Start the mesh manager
-	go func() {
-		if err := manager.Start(context.Background()); err != nil {
-			log.Printf("Error starting mesh manager: %v", err)
+	// Start the mesh and take up where the daemon we replace left off
+	if *recordPath != "" {
+		if err := app.StartRecording(); err != nil {
+			log.Fatalf("Failed to start recording: %v", err)
+		}
+	}
+	if err := app.Start(); err != nil {
+		log.Fatalf("Error starting mesh: %v", err)
+	}
+	restoreState(app, *statePath)
+	if *wsAddr != "" {
+		if err := app.Transport.ListenWebSocket(*wsAddr); err != nil {
+			log.Printf("Failed to accept WebSocket peers: %v", err)
+		} else {
+			log.Printf("Accepting WebSocket peers at %s%s", app.Transport.WebSocketAddr(), mesh.WebSocketPath)
 		}
-	}()
+	}
+	connectWebSocketPeers(app, *wsPeers)
+	status := serveStatus(app, *statusSocket)
+	if err := mesh.SignalHandoffReady(); err != nil {
+		log.Printf("Failed to report the handover: %v", err)
+	}
 
 	// Example: Create a personal network
-	personalNet := pnManager.CreateNetwork("pnet-1", "My Home Network", *nodeID)
+	personalNet := pnManager.CreateNetwork("", "My Home Network", *nodeID)
 	log.Printf("Created personal network: %s (%s)", personalNet.Name, personalNet.ID)
 
 	// Add the current node as a member
@@ -87,11 +179,120 @@ func main() {
 
 	log.Println("InterMesh node is running. Press Ctrl+C to stop.")
 
-	// Wait for shutdown signal
-	<-sigChan
+	// Wait for shutdown signal, handing over to an upgraded binary when asked
+wait:
+	for {
+		select {
+		case <-upgradeChan:
+			log.Println("Upgrading InterMesh node in place...")
+			// The upgraded node takes over the status socket
+			if status != nil {
+				status.Close()
+			}
+			if err := upgrade(app); err != nil {
+				log.Printf("Upgrade failed, still running: %v", err)
+				status = serveStatus(app, *statusSocket)
+				continue
+			}
+			app.StopForHandoff()
+			log.Println("Handed over to the upgraded node.")
+			return
+		case <-sigChan:
+			break wait
+		}
+	}
 	log.Println("Shutting down InterMesh node...")
+	if status != nil {
+		status.Close()
+	}
 
 	// Cleanup
-	manager.Stop()
+	if *statePath != "" {
+		if err := mesh.SaveHandoffState(*statePath, app.HandoffSnapshot()); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
+	}
+	app.Stop()
+	if *recordPath != "" {
+		saveRecording(app, *recordPath)
+	}
 	log.Println("InterMesh node stopped.")
 }
+
+// serveStatus answers status queries on the socket at path, returning its listener, or
+// nil if there is none
+func serveStatus(app *mesh.MeshApp, path string) net.Listener {
+	if path == "" {
+		return nil
+	}
+	listener, err := mesh.ListenStatus(path)
+	if err != nil {
+		log.Printf("Failed to open the status socket: %v", err)
+		return nil
+	}
+	go app.ServeStatus(listener)
+	return listener
+}
+
+// connectWebSocketPeers links to the peers listed as id=url, comma-separated
+func connectWebSocketPeers(app *mesh.MeshApp, peers string) {
+	for _, entry := range strings.Split(peers, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		peerID, url, ok := strings.Cut(entry, "=")
+		if !ok {
+			log.Printf("Ignoring WebSocket peer %q: expected id=url", entry)
+			continue
+		}
+		if err := app.Transport.ConnectWebSocket(peerID, url); err != nil {
+			log.Printf("Failed to link to %s over WebSocket: %v", peerID, err)
+		}
+	}
+}
+
+// saveRecording writes the traffic recorded since start, for attaching to a bug report
+func saveRecording(app *mesh.MeshApp, path string) {
+	rec, err := app.StopRecording()
+	if err != nil {
+		log.Printf("Failed to stop recording: %v", err)
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Failed to save recording: %v", err)
+		return
+	}
+	log.Printf("Saved %d recorded events to %s; replay them with: intermesh replay %s", len(rec.Events), path, path)
+}
+
+// restoreState restores the snapshot our predecessor handed over, or else the one saved
+// at statePath on the last shutdown. Snapshots are removed once read so a stale one is
+// never restored twice.
+func restoreState(app *mesh.MeshApp, statePath string) {
+	path := os.Getenv(mesh.HandoffStateEnv)
+	os.Unsetenv(mesh.HandoffStateEnv)
+	if path == "" {
+		path = statePath
+	}
+	if path == "" {
+		return
+	}
+	state, err := mesh.LoadHandoffState(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to load state: %v", err)
+		}
+		return
+	}
+	os.Remove(path)
+	if err := app.RestoreHandoff(state); err != nil {
+		log.Printf("Failed to restore state: %v", err)
+		return
+	}
+	log.Printf("Restored state from %s: %d peers, %d clients", state.SavedAt.Format(time.RFC3339), len(state.Peers), len(state.Clients))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
+)
+
+// runStatus asks the running node for its health report and prints it as JSON.
+// The exit code is non-zero when any component is down, so it can be used in scripts.
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	socket := fs.String("socket", mesh.DefaultStatusSocket, "Status socket of the running node")
+	timeout := fs.Duration("timeout", 2*time.Second, "How long to wait for the node to answer")
+	fs.Parse(args)
+
+	report, err := mesh.QueryStatus(*socket, *timeout)
+	if err != nil {
+		log.Fatalf("No running node answered at %s: %v", *socket, err)
+	}
+
+	data, err := report.JSON()
+	if err != nil {
+		log.Fatalf("Failed to encode health report: %v", err)
+	}
+	fmt.Println(string(data))
+
+	if report.Status == mesh.HealthDown {
+		os.Exit(1)
+	}
+}
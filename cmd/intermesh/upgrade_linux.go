@@ -0,0 +1,98 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
+)
+
+// upgradeReadyTimeout bounds how long the successor may take to start serving
+const upgradeReadyTimeout = 30 * time.Second
+
+// notifyUpgrade delivers SIGUSR2, which asks the daemon to hand over to the binary now
+// installed at its path
+func notifyUpgrade(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGUSR2)
+}
+
+// upgrade starts the binary at our path with our arguments, handing it our listening
+// sockets and a state snapshot, and returns once it has taken over. If it doesn't, it is
+// killed and we keep running.
+func upgrade(app *mesh.MeshApp) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	names, files, err := app.HandoffListeners()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	stateFile, err := os.CreateTemp("", "intermesh-handoff-*.json")
+	if err != nil {
+		return err
+	}
+	statePath := stateFile.Name()
+	stateFile.Close()
+	if err := mesh.SaveHandoffState(statePath, app.HandoffSnapshot()); err != nil {
+		os.Remove(statePath)
+		return err
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		os.Remove(statePath)
+		return err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(), mesh.HandoffEnv(names)...)
+	cmd.Env = append(cmd.Env,
+		mesh.HandoffStateEnv+"="+statePath,
+		fmt.Sprintf("%s=%d", mesh.HandoffReadyEnv, 3+len(files)))
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		os.Remove(statePath)
+		return fmt.Errorf("failed to start %s: %w", exe, err)
+	}
+
+	// The successor writes to the pipe once it serves; a read ending without that means it exited
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 16)
+		if n, err := ready.Read(buf); n == 0 {
+			done <- fmt.Errorf("successor exited before taking over: %v", err)
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("successor not ready after %s", upgradeReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.Remove(statePath)
+		return err
+	}
+	cmd.Process.Release()
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
+)
+
+// notifyUpgrade does nothing; in-place upgrades are only supported on Linux
+func notifyUpgrade(ch chan<- os.Signal) {}
+
+// upgrade is not supported on this platform
+func upgrade(app *mesh.MeshApp) error {
+	return errors.New("in-place upgrade is not supported on this platform")
+}
@@ -20,7 +20,7 @@ func main() {
 		"aa:bb:cc:dd:ee:01",
 	)
 
-	fmt.Println("\n=== InterMesh Mobile App Demo ===\n")
+	fmt.Print("\n=== InterMesh Mobile App Demo ===\n\n")
 
 	log.Println("Starting InterMesh Mobile App Demo...")
 
@@ -39,7 +39,7 @@ func main() {
 func simulateUserInteractions(app *mesh.MeshApp) {
 	time.Sleep(500 * time.Millisecond)
 
-	fmt.Println("\n[Demo] Simulating user actions...\n")
+	fmt.Print("\n[Demo] Simulating user actions...\n\n")
 
 	// Action 1: Connect to network
 	fmt.Println("→ Connecting to mesh network...")
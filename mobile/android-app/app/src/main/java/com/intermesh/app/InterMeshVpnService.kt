@@ -1,10 +1,13 @@
 package com.intermesh.app
 
 import android.content.Intent
+import android.content.pm.PackageManager
 import android.net.ProxyInfo
 import android.net.VpnService
 import android.os.ParcelFileDescriptor
 import android.util.Log
+import org.json.JSONArray
+import org.json.JSONObject
 
 class InterMeshVpnService : VpnService() {
 
@@ -17,11 +20,11 @@ class InterMeshVpnService : VpnService() {
             return START_NOT_STICKY
         }
 
-        startVpn()
+        startVpn(intent?.getStringExtra(EXTRA_APP_ROUTING))
         return START_STICKY
     }
 
-    private fun startVpn() {
+    private fun startVpn(appRoutingJSON: String?) {
         if (vpnInterface != null) return
 
         try {
@@ -38,6 +41,8 @@ class InterMeshVpnService : VpnService() {
                 builder.setHttpProxy(ProxyInfo.buildDirectProxy("127.0.0.1", 8080))
             }
 
+            applyAppRouting(builder, appRoutingJSON)
+
             vpnInterface = builder.establish()
             Log.d(TAG, "VPN Interface established")
         } catch (e: Exception) {
@@ -45,6 +50,32 @@ class InterMeshVpnService : VpnService() {
         }
     }
 
+    // Limits the VPN to the apps chosen with MobileApp.setAppRouting. Throws if none of the
+    // apps to include are installed, as the VPN would otherwise capture every app.
+    private fun applyAppRouting(builder: Builder, appRoutingJSON: String?) {
+        if (appRoutingJSON.isNullOrEmpty()) return
+
+        val routing = JSONObject(appRoutingJSON)
+        val mode = routing.optString("mode", "all")
+        val apps = routing.optJSONArray("apps") ?: JSONArray()
+        var applied = 0
+        for (i in 0 until apps.length()) {
+            val app = apps.getString(i)
+            try {
+                when (mode) {
+                    "include" -> builder.addAllowedApplication(app)
+                    "exclude" -> builder.addDisallowedApplication(app)
+                }
+                applied++
+            } catch (e: PackageManager.NameNotFoundException) {
+                Log.w(TAG, "App not installed, skipping routing override: $app")
+            }
+        }
+        if (mode == "include" && applied == 0) {
+            throw IllegalStateException("None of the apps to route through the mesh are installed")
+        }
+    }
+
     private fun stopVpn() {
         try {
             vpnInterface?.close()
@@ -64,5 +95,6 @@ class InterMeshVpnService : VpnService() {
     companion object {
         private const val TAG = "InterMeshVpnService"
         const val ACTION_STOP = "com.intermesh.app.STOP_VPN"
+        const val EXTRA_APP_ROUTING = "com.intermesh.app.APP_ROUTING"
     }
 }
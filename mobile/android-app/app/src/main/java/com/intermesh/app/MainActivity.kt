@@ -6,8 +6,11 @@ import android.content.Context
 import android.content.Intent
 import android.content.pm.PackageManager
 import android.net.ConnectivityManager
+import android.net.LinkProperties
+import android.net.Network
 import android.net.NetworkCapabilities
 import android.net.VpnService
+import android.net.wifi.WifiManager
 import android.os.Build
 import android.os.Bundle
 import android.os.Handler
@@ -26,7 +29,9 @@ import com.google.android.material.switchmaterial.SwitchMaterial
 import intermesh.BLEMessageCallback
 import intermesh.Intermesh
 import intermesh.MobileApp
+import java.net.Inet4Address
 import java.util.UUID
+import org.json.JSONObject
 
 class MainActivity : AppCompatActivity() {
 
@@ -50,6 +55,9 @@ class MainActivity : AppCompatActivity() {
     private lateinit var wifiDirectManager: WifiDirectManager
     private var isWifiDirectEnabled = false
 
+    // Wi-Fi Aware manager for direct links without an access point (Android 10+)
+    private var wifiAwareManager: WifiAwareManager? = null
+
     // BLE manager for cross-platform connectivity (iOS <-> Android)
     private lateinit var bleManager: BLEManager
     private var isBleEnabled = false
@@ -93,6 +101,7 @@ class MainActivity : AppCompatActivity() {
         if (checkPermissions()) {
             initializeMesh()
             initializeWifiDirect()
+            initializeWifiAware()
             initializeBLE()
         } else {
             requestPermissions()
@@ -233,6 +242,7 @@ class MainActivity : AppCompatActivity() {
             if (grantResults.all { it == PackageManager.PERMISSION_GRANTED }) {
                 initializeMesh()
                 initializeWifiDirect()
+                initializeWifiAware()
                 initializeBLE()
             } else {
                 Toast.makeText(this, "Permissions required for mesh networking", Toast.LENGTH_LONG)
@@ -327,6 +337,45 @@ class MainActivity : AppCompatActivity() {
         }
     }
 
+    private fun initializeWifiAware() {
+        if (Build.VERSION.SDK_INT < Build.VERSION_CODES.Q || !WifiAwareManager.isSupported(this)) {
+            Log.d(TAG, "Wi-Fi Aware not supported on this device")
+            return
+        }
+        try {
+            val manager = WifiAwareManager(this)
+            if (!manager.initialize()) return
+
+            manager.serviceName = Intermesh.WifiAwareServiceName
+            manager.serviceInfo = { mobileApp.wifiAwareServiceInfo() }
+            manager.peerIdOf = { info -> mobileApp.wifiAwarePeerID(info) }
+            manager.shouldInitiate = { info -> mobileApp.wifiAwareShouldInitiate(info) }
+
+            manager.onLinkUp = { info, address, iface ->
+                try {
+                    mobileApp.wifiAwareLinkUp(info, address, iface)
+                    mainHandler.post { showMessage("Wi-Fi Aware link up") }
+                } catch (e: Exception) {
+                    Log.e(TAG, "Failed to use Wi-Fi Aware link: ${e.message}")
+                }
+            }
+
+            manager.onLinkDown = { peerId ->
+                mobileApp.wifiAwareLinkDown(peerId)
+                mainHandler.post { updatePeerCount() }
+            }
+
+            manager.onError = { error ->
+                mainHandler.post { Log.e(TAG, "Wi-Fi Aware error: $error") }
+            }
+
+            wifiAwareManager = manager
+            Log.d(TAG, "Wi-Fi Aware initialized")
+        } catch (e: Exception) {
+            Log.e(TAG, "Failed to initialize Wi-Fi Aware: ${e.message}", e)
+        }
+    }
+
     private fun initializeBLE() {
         try {
             bleManager = BLEManager(this)
@@ -539,6 +588,7 @@ class MainActivity : AppCompatActivity() {
             // Start traditional mesh networking
             mobileApp.start()
             mobileApp.connectToNetwork()
+            registerNetworkCallback()
 
             // Also start WiFi Direct peer discovery
             if (isWifiDirectEnabled) {
@@ -546,6 +596,11 @@ class MainActivity : AppCompatActivity() {
                 Log.d(TAG, "WiFi Direct discovery started")
             }
 
+            // Wi-Fi Aware links are preferred over BLE where both devices support it
+            if (Build.VERSION.SDK_INT >= Build.VERSION_CODES.Q) {
+                wifiAwareManager?.start()
+            }
+
             // Start BLE for cross-platform connectivity (iOS <-> Android)
             if (isBleEnabled) {
                 bleManager.start()
@@ -575,6 +630,7 @@ class MainActivity : AppCompatActivity() {
 
             val modes = mutableListOf("Mesh")
             if (isWifiDirectEnabled) modes.add("WiFi Direct")
+            if (wifiAwareManager != null) modes.add("Wi-Fi Aware")
             if (isBleEnabled) modes.add("BLE")
             showMessage("Connected! (${modes.joinToString(" + ")}) Searching for peers...")
 
@@ -601,8 +657,15 @@ class MainActivity : AppCompatActivity() {
                 wifiDirectManager.disconnect()
             }
 
+            // Stop Wi-Fi Aware
+            if (Build.VERSION.SDK_INT >= Build.VERSION_CODES.Q) {
+                wifiAwareManager?.stop()
+            }
+
             // Stop mesh
+            unregisterNetworkCallback()
             mobileApp.stop()
+            updateMulticastLock()
 
             isConnected = false
             p2pPeers.clear()
@@ -617,6 +680,96 @@ class MainActivity : AppCompatActivity() {
         }
     }
 
+    // Tells the Go core which network the device is on, so it can update its address,
+    // re-join discovery on the right interface and know whether multicast gets through
+    private val networkCallback =
+            object : ConnectivityManager.NetworkCallback() {
+                override fun onCapabilitiesChanged(network: Network, capabilities: NetworkCapabilities) {
+                    currentCapabilities = capabilities
+                    reportPlatformNetwork()
+                }
+
+                override fun onLinkPropertiesChanged(network: Network, linkProperties: LinkProperties) {
+                    currentLinkProperties = linkProperties
+                    reportPlatformNetwork()
+                }
+
+                override fun onLost(network: Network) {
+                    currentCapabilities = null
+                    currentLinkProperties = null
+                    reportPlatformNetwork()
+                }
+            }
+    @Volatile private var currentCapabilities: NetworkCapabilities? = null
+    @Volatile private var currentLinkProperties: LinkProperties? = null
+    private var multicastLock: WifiManager.MulticastLock? = null
+
+    private fun reportPlatformNetwork() {
+        if (!::mobileApp.isInitialized) return
+        val capabilities = currentCapabilities
+        val linkProperties = currentLinkProperties
+        val type =
+                when {
+                    capabilities == null -> "none"
+                    capabilities.hasTransport(NetworkCapabilities.TRANSPORT_WIFI) -> "wifi"
+                    capabilities.hasTransport(NetworkCapabilities.TRANSPORT_ETHERNET) -> "ethernet"
+                    capabilities.hasTransport(NetworkCapabilities.TRANSPORT_CELLULAR) -> "cellular"
+                    else -> ""
+                }
+        val ip =
+                linkProperties?.linkAddresses
+                        ?.map { it.address }
+                        ?.firstOrNull { it is Inet4Address && !it.isLoopbackAddress }
+                        ?.hostAddress
+        val info =
+                JSONObject()
+                        .put("type", type)
+                        .put("interface", linkProperties?.interfaceName.orEmpty())
+                        .put("ip", ip.orEmpty())
+                        .put("multicast_lock", multicastLock?.isHeld == true)
+        runCatching { mobileApp.onPlatformNetworkChanged(info.toString()) }
+        if (updateMulticastLock()) {
+            info.put("multicast_lock", multicastLock?.isHeld == true)
+            runCatching { mobileApp.onPlatformNetworkChanged(info.toString()) }
+        }
+    }
+
+    // Holds a Wi-Fi multicast lock while the Go core asks for one; Android drops incoming
+    // discovery announcements without it. Returns whether the lock changed.
+    @Synchronized
+    private fun updateMulticastLock(): Boolean {
+        if (!::mobileApp.isInitialized) return false
+        val wanted = mobileApp.acquireMulticastLockHint()
+        val lock =
+                multicastLock
+                        ?: (applicationContext.getSystemService(Context.WIFI_SERVICE) as WifiManager)
+                                .createMulticastLock("intermesh-discovery")
+                                .apply { setReferenceCounted(false) }
+                                .also { multicastLock = it }
+        if (wanted == lock.isHeld) return false
+        if (wanted) lock.acquire() else lock.release()
+        Log.d(TAG, if (wanted) "Multicast lock acquired" else "Multicast lock released")
+        return true
+    }
+
+    private var networkCallbackRegistered = false
+
+    private fun registerNetworkCallback() {
+        if (networkCallbackRegistered) return
+        val connectivityManager =
+                getSystemService(Context.CONNECTIVITY_SERVICE) as ConnectivityManager
+        connectivityManager.registerDefaultNetworkCallback(networkCallback)
+        networkCallbackRegistered = true
+    }
+
+    private fun unregisterNetworkCallback() {
+        if (!networkCallbackRegistered) return
+        val connectivityManager =
+                getSystemService(Context.CONNECTIVITY_SERVICE) as ConnectivityManager
+        connectivityManager.unregisterNetworkCallback(networkCallback)
+        networkCallbackRegistered = false
+    }
+
     private var statsUpdateRunnable: Runnable? = null
 
     private fun startStatsUpdate() {
@@ -773,6 +926,7 @@ class MainActivity : AppCompatActivity() {
         }
 
         val intent = Intent(this, InterMeshVpnService::class.java)
+        intent.putExtra(InterMeshVpnService.EXTRA_APP_ROUTING, mobileApp.getAppRoutingJSON())
         startService(intent)
         showMessage("VPN Enabled")
     }
@@ -964,9 +1118,16 @@ class MainActivity : AppCompatActivity() {
             wifiDirectManager.cleanup()
         }
 
+        // Clean up Wi-Fi Aware
+        if (Build.VERSION.SDK_INT >= Build.VERSION_CODES.Q) {
+            wifiAwareManager?.cleanup()
+        }
+
         // Clean up mesh
+        unregisterNetworkCallback()
         if (::mobileApp.isInitialized && isConnected) {
             mobileApp.stop()
         }
+        multicastLock?.takeIf { it.isHeld }?.release()
     }
 }
@@ -0,0 +1,272 @@
+package com.intermesh.app
+
+import android.annotation.SuppressLint
+import android.content.BroadcastReceiver
+import android.content.Context
+import android.content.Intent
+import android.content.IntentFilter
+import android.content.pm.PackageManager
+import android.net.ConnectivityManager
+import android.net.LinkProperties
+import android.net.Network
+import android.net.NetworkCapabilities
+import android.net.NetworkRequest
+import android.net.wifi.aware.AttachCallback
+import android.net.wifi.aware.DiscoverySessionCallback
+import android.net.wifi.aware.PeerHandle
+import android.net.wifi.aware.PublishConfig
+import android.net.wifi.aware.PublishDiscoverySession
+import android.net.wifi.aware.SubscribeConfig
+import android.net.wifi.aware.SubscribeDiscoverySession
+import android.net.wifi.aware.WifiAwareManager as AwareService
+import android.net.wifi.aware.WifiAwareNetworkInfo
+import android.net.wifi.aware.WifiAwareNetworkSpecifier
+import android.net.wifi.aware.WifiAwareSession
+import android.os.Build
+import android.util.Log
+import androidx.annotation.RequiresApi
+import java.util.concurrent.ConcurrentHashMap
+
+/**
+ * Wi-Fi Aware (NAN) manager for direct, access point free links between Android devices.
+ * Every node publishes and subscribes to the InterMesh service; for each match one side
+ * requests a data path, and once the link has an address the mesh is told about it so
+ * it can run over the link like over the LAN. Much faster than BLE where supported.
+ */
+@RequiresApi(Build.VERSION_CODES.Q)
+class WifiAwareManager(private val context: Context) {
+
+    companion object {
+        private const val TAG = "WifiAwareManager"
+
+        /** Whether the device supports Wi-Fi Aware data paths with peer addresses */
+        fun isSupported(context: Context): Boolean =
+                Build.VERSION.SDK_INT >= Build.VERSION_CODES.Q &&
+                        context.packageManager.hasSystemFeature(PackageManager.FEATURE_WIFI_AWARE)
+    }
+
+    private var awareService: AwareService? = null
+    private var session: WifiAwareSession? = null
+    private var publishSession: PublishDiscoverySession? = null
+    private var subscribeSession: SubscribeDiscoverySession? = null
+    private var stateReceiver: BroadcastReceiver? = null
+    private val connectivityManager =
+            context.getSystemService(Context.CONNECTIVITY_SERVICE) as ConnectivityManager
+
+    // Data paths by peer node ID
+    private val links = ConcurrentHashMap<String, PeerLink>()
+
+    // Provided by the mesh: our service info, and what a peer's service info says
+    var serviceName: String = "intermesh"
+    var serviceInfo: (() -> ByteArray)? = null
+    var peerIdOf: ((ByteArray) -> String)? = null
+    var shouldInitiate: ((ByteArray) -> Boolean)? = null
+
+    // Callbacks
+    var onLinkUp: ((serviceInfo: ByteArray, peerIpv6: String, iface: String) -> Unit)? = null
+    var onLinkDown: ((peerId: String) -> Unit)? = null
+    var onError: ((String) -> Unit)? = null
+
+    private class PeerLink(val serviceInfo: ByteArray) {
+        var callback: ConnectivityManager.NetworkCallback? = null
+        var peerIpv6: String? = null
+        var iface: String? = null
+        var reported = false
+    }
+
+    /**
+     * Initialize the Wi-Fi Aware manager
+     */
+    fun initialize(): Boolean {
+        if (!isSupported(context)) {
+            Log.w(TAG, "Wi-Fi Aware is not supported on this device")
+            return false
+        }
+        awareService = context.getSystemService(Context.WIFI_AWARE_SERVICE) as? AwareService
+        if (awareService == null) {
+            Log.e(TAG, "Wi-Fi Aware service unavailable")
+            return false
+        }
+
+        // Aware turns off with Wi-Fi or location; start over when it comes back
+        stateReceiver = object : BroadcastReceiver() {
+            override fun onReceive(context: Context, intent: Intent) {
+                if (awareService?.isAvailable == true) {
+                    if (session == null) start()
+                } else {
+                    Log.w(TAG, "Wi-Fi Aware became unavailable")
+                    stop()
+                }
+            }
+        }
+        val filter = IntentFilter(AwareService.ACTION_WIFI_AWARE_STATE_CHANGED)
+        if (Build.VERSION.SDK_INT >= Build.VERSION_CODES.TIRAMISU) {
+            context.registerReceiver(stateReceiver, filter, Context.RECEIVER_NOT_EXPORTED)
+        } else {
+            context.registerReceiver(stateReceiver, filter)
+        }
+
+        Log.d(TAG, "Wi-Fi Aware manager initialized")
+        return true
+    }
+
+    /**
+     * Attach to Wi-Fi Aware and start publishing and subscribing
+     */
+    @SuppressLint("MissingPermission")
+    fun start() {
+        val service = awareService ?: return
+        if (!service.isAvailable) {
+            onError?.invoke("Wi-Fi Aware is not available")
+            return
+        }
+        if (session != null) return
+
+        service.attach(object : AttachCallback() {
+            override fun onAttached(attached: WifiAwareSession) {
+                session = attached
+                Log.d(TAG, "Attached to Wi-Fi Aware")
+                publish(attached)
+                subscribe(attached)
+            }
+
+            override fun onAttachFailed() {
+                Log.e(TAG, "Wi-Fi Aware attach failed")
+                onError?.invoke("Wi-Fi Aware attach failed")
+            }
+        }, null)
+    }
+
+    /**
+     * Stop discovery and tear down all data paths
+     */
+    fun stop() {
+        for ((peerId, link) in links) {
+            link.callback?.let { runCatching { connectivityManager.unregisterNetworkCallback(it) } }
+            if (link.reported) onLinkDown?.invoke(peerId)
+        }
+        links.clear()
+        publishSession?.close()
+        subscribeSession?.close()
+        session?.close()
+        publishSession = null
+        subscribeSession = null
+        session = null
+    }
+
+    /**
+     * Release the manager
+     */
+    fun cleanup() {
+        stop()
+        stateReceiver?.let { runCatching { context.unregisterReceiver(it) } }
+        stateReceiver = null
+    }
+
+    @SuppressLint("MissingPermission")
+    private fun publish(attached: WifiAwareSession) {
+        val config = PublishConfig.Builder()
+                .setServiceName(serviceName)
+                .setServiceSpecificInfo(serviceInfo?.invoke() ?: ByteArray(0))
+                .build()
+        attached.publish(config, object : DiscoverySessionCallback() {
+            override fun onPublishStarted(started: PublishDiscoverySession) {
+                publishSession = started
+                Log.d(TAG, "Publishing $serviceName")
+            }
+
+            // The initiator sends its service info before requesting the data path
+            override fun onMessageReceived(peerHandle: PeerHandle, message: ByteArray) {
+                val session = publishSession ?: return
+                requestDataPath(message) {
+                    WifiAwareNetworkSpecifier.Builder(session, peerHandle).build()
+                }
+            }
+
+            override fun onSessionTerminated() {
+                publishSession = null
+            }
+        }, null)
+    }
+
+    @SuppressLint("MissingPermission")
+    private fun subscribe(attached: WifiAwareSession) {
+        val config = SubscribeConfig.Builder()
+                .setServiceName(serviceName)
+                .build()
+        attached.subscribe(config, object : DiscoverySessionCallback() {
+            override fun onSubscribeStarted(started: SubscribeDiscoverySession) {
+                subscribeSession = started
+                Log.d(TAG, "Subscribed to $serviceName")
+            }
+
+            override fun onServiceDiscovered(
+                    peerHandle: PeerHandle,
+                    serviceSpecificInfo: ByteArray,
+                    matchFilter: List<ByteArray>
+            ) {
+                val session = subscribeSession ?: return
+                if (shouldInitiate?.invoke(serviceSpecificInfo) != true) return
+                val ours = serviceInfo?.invoke() ?: return
+                session.sendMessage(peerHandle, 0, ours)
+                requestDataPath(serviceSpecificInfo) {
+                    WifiAwareNetworkSpecifier.Builder(session, peerHandle).build()
+                }
+            }
+
+            override fun onSessionTerminated() {
+                subscribeSession = null
+            }
+        }, null)
+    }
+
+    /**
+     * Request a data path to a peer and report it once it has an address
+     */
+    private fun requestDataPath(peerInfo: ByteArray, specifier: () -> WifiAwareNetworkSpecifier) {
+        val peerId = peerIdOf?.invoke(peerInfo).orEmpty()
+        if (peerId.isEmpty() || links.containsKey(peerId)) return
+
+        val link = PeerLink(peerInfo)
+        links[peerId] = link
+        val request = NetworkRequest.Builder()
+                .addTransportType(NetworkCapabilities.TRANSPORT_WIFI_AWARE)
+                .setNetworkSpecifier(specifier())
+                .build()
+        val callback = object : ConnectivityManager.NetworkCallback() {
+            override fun onCapabilitiesChanged(network: Network, capabilities: NetworkCapabilities) {
+                val info = capabilities.transportInfo as? WifiAwareNetworkInfo ?: return
+                link.peerIpv6 = info.peerIpv6Addr?.hostAddress?.substringBefore('%')
+                reportIfReady(link)
+            }
+
+            override fun onLinkPropertiesChanged(network: Network, properties: LinkProperties) {
+                link.iface = properties.interfaceName
+                reportIfReady(link)
+            }
+
+            override fun onLost(network: Network) {
+                Log.d(TAG, "Wi-Fi Aware link to $peerId lost")
+                links.remove(peerId)
+                runCatching { connectivityManager.unregisterNetworkCallback(this) }
+                if (link.reported) onLinkDown?.invoke(peerId)
+            }
+
+            override fun onUnavailable() {
+                Log.w(TAG, "Wi-Fi Aware data path to $peerId unavailable")
+                links.remove(peerId)
+            }
+        }
+        link.callback = callback
+        connectivityManager.requestNetwork(request, callback)
+    }
+
+    private fun reportIfReady(link: PeerLink) {
+        val address = link.peerIpv6 ?: return
+        val iface = link.iface ?: return
+        if (link.reported) return
+        link.reported = true
+        Log.d(TAG, "Wi-Fi Aware link up to $address on $iface")
+        onLinkUp?.invoke(link.serviceInfo, address, iface)
+    }
+}
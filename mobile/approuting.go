@@ -0,0 +1,102 @@
+package intermesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// App routing modes choose which apps' traffic goes through the mesh
+const (
+	AppRoutingAll     = "all"     // Every app uses the mesh
+	AppRoutingInclude = "include" // Only the listed apps use the mesh
+	AppRoutingExclude = "exclude" // Every app except the listed ones uses the mesh
+)
+
+// appRouting is the per-app override list the platform VPN glue applies, such as
+// Android's VpnService.Builder addAllowedApplication and addDisallowedApplication
+type appRouting struct {
+	mode string
+	apps map[string]bool
+	mu   sync.Mutex
+}
+
+func newAppRouting() *appRouting {
+	return &appRouting{mode: AppRoutingAll, apps: make(map[string]bool)}
+}
+
+// appRoutingState is the JSON form of the override list
+type appRoutingState struct {
+	Mode string   `json:"mode"`
+	Apps []string `json:"apps"`
+}
+
+func (r *appRouting) set(mode string, apps []string) error {
+	switch mode {
+	case AppRoutingAll, AppRoutingInclude, AppRoutingExclude:
+	default:
+		return fmt.Errorf("unknown app routing mode %q", mode)
+	}
+	set := make(map[string]bool, len(apps))
+	for _, app := range apps {
+		if app = strings.TrimSpace(app); app != "" {
+			set[app] = true
+		}
+	}
+	if mode == AppRoutingInclude && len(set) == 0 {
+		return fmt.Errorf("include mode needs at least one app")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mode = mode
+	r.apps = set
+	return nil
+}
+
+func (r *appRouting) routes(app string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.mode {
+	case AppRoutingInclude:
+		return r.apps[app]
+	case AppRoutingExclude:
+		return !r.apps[app]
+	}
+	return true
+}
+
+func (r *appRouting) state() appRoutingState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	apps := make([]string, 0, len(r.apps))
+	for app := range r.apps {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	return appRoutingState{Mode: r.mode, Apps: apps}
+}
+
+// SetAppRouting chooses which apps' traffic goes through the mesh when the VPN is on:
+// mode is "all", "include" (only the listed apps, e.g. just a browser) or "exclude" (all
+// but the listed apps); apps is a comma-separated list of package names or bundle IDs.
+// Takes effect the next time the VPN is started.
+func (ma *MobileApp) SetAppRouting(mode, apps string) error {
+	return ma.appRouting.set(mode, strings.Split(apps, ","))
+}
+
+// GetAppRoutingJSON returns the app routing mode and list as JSON, for the VPN glue to apply
+func (ma *MobileApp) GetAppRoutingJSON() string {
+	data, err := json.Marshal(ma.appRouting.state())
+	if err != nil {
+		return `{"mode":"all","apps":[]}`
+	}
+	return string(data)
+}
+
+// ShouldRouteApp returns whether an app's traffic goes through the mesh
+func (ma *MobileApp) ShouldRouteApp(app string) bool {
+	return ma.appRouting.routes(app)
+}
@@ -0,0 +1,56 @@
+package intermesh
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAppRouting(t *testing.T) {
+	app := NewMobileApp("node-A", "Device A", "127.0.0.1", "00:00:00:00:00:01")
+	if !app.ShouldRouteApp("com.example.browser") || !app.ShouldRouteApp("com.example.bank") {
+		t.Error("Expected every app to be routed by default")
+	}
+
+	if err := app.SetAppRouting("include", " com.example.browser, ,com.example.chat"); err != nil {
+		t.Fatalf("SetAppRouting failed: %v", err)
+	}
+	if !app.ShouldRouteApp("com.example.browser") || !app.ShouldRouteApp("com.example.chat") || app.ShouldRouteApp("com.example.bank") {
+		t.Error("Expected only the listed apps to be routed in include mode")
+	}
+	var state appRoutingState
+	if err := json.Unmarshal([]byte(app.GetAppRoutingJSON()), &state); err != nil {
+		t.Fatalf("Expected valid JSON, got %v", err)
+	}
+	if want := (appRoutingState{Mode: AppRoutingInclude, Apps: []string{"com.example.browser", "com.example.chat"}}); !reflect.DeepEqual(state, want) {
+		t.Errorf("Expected %+v, got %+v", want, state)
+	}
+
+	if err := app.SetAppRouting("exclude", "com.example.bank"); err != nil {
+		t.Fatalf("SetAppRouting failed: %v", err)
+	}
+	if app.ShouldRouteApp("com.example.bank") || !app.ShouldRouteApp("com.example.browser") {
+		t.Error("Expected every app but the listed ones to be routed in exclude mode")
+	}
+
+	// Bad settings are refused and leave the current ones in place
+	if err := app.SetAppRouting("some", "com.example.browser"); err == nil {
+		t.Error("Expected an unknown mode to be refused")
+	}
+	if err := app.SetAppRouting("include", " , "); err == nil {
+		t.Error("Expected include mode without apps to be refused")
+	}
+	if app.ShouldRouteApp("com.example.bank") {
+		t.Error("Expected refused settings not to change the routing")
+	}
+
+	if err := app.SetAppRouting("all", ""); err != nil {
+		t.Fatalf("SetAppRouting failed: %v", err)
+	}
+	if got := app.GetAppRoutingJSON(); got != `{"mode":"all","apps":[]}` {
+		t.Errorf("Expected all mode with no apps, got %s", got)
+	}
+	if !app.ShouldRouteApp("com.example.bank") {
+		t.Error("Expected every app to be routed in all mode")
+	}
+}
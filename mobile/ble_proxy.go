@@ -2,12 +2,15 @@ package intermesh
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
 )
 
 // BLEProxyHandler handles internet proxy requests through BLE connections
@@ -17,8 +20,10 @@ type BLEProxyHandler struct {
 	requestsMu       sync.RWMutex
 	onBLEMessage     func(peerID string, messageType string, data []byte) error
 	mobileApp        *MobileApp
-	pendingResponses map[string]chan *ProxyResponse
-	responsesMu      sync.RWMutex
+	pendingResponses *pendingTable[*ProxyResponse]
+	inflight         *cancelRegistry
+	spans            map[string]*mesh.TraceSpan    // Request ID -> this hop's open trace span
+	circuits         map[string]*mesh.OnionCircuit // Request ID -> layer keys of an onion request we sent
 }
 
 // ProxyRequest represents an ongoing internet request
@@ -30,6 +35,7 @@ type ProxyRequest struct {
 	Headers   map[string]string `json:"headers"`
 	Body      []byte            `json:"body"`
 	CreatedAt time.Time         `json:"created_at"`
+	TraceID   string            `json:"trace_id,omitempty"`
 }
 
 // ProxyResponse represents a response to a proxy request
@@ -43,7 +49,7 @@ type ProxyResponse struct {
 
 // BLEProxyMessage represents messages sent over BLE for proxy functionality
 type BLEProxyMessage struct {
-	Type      string      `json:"type"` // "request", "response"
+	Type      string      `json:"type"` // "request", "response", "cancel", "onion", "onion_response", "onion_error", "hotspot_candidate", "hotspot_credentials", "hotspot_revoked"
 	RequestID string      `json:"request_id"`
 	Data      interface{} `json:"data"`
 }
@@ -54,7 +60,10 @@ func NewBLEProxyHandler(nodeID string, mobileApp *MobileApp) *BLEProxyHandler {
 		nodeID:           nodeID,
 		activeRequests:   make(map[string]*ProxyRequest),
 		mobileApp:        mobileApp,
-		pendingResponses: make(map[string]chan *ProxyResponse),
+		pendingResponses: newPendingTable[*ProxyResponse](maxPendingRequests, pendingRequestTTL),
+		inflight:         newCancelRegistry(),
+		spans:            make(map[string]*mesh.TraceSpan),
+		circuits:         make(map[string]*mesh.OnionCircuit),
 	}
 }
 
@@ -67,46 +76,90 @@ func (h *BLEProxyHandler) SetBLEMessageSender(sender func(peerID string, message
 func (h *BLEProxyHandler) HandleProxyRequest(clientID string, request *ProxyRequest) error {
 	// 1. Try local internet first
 	if h.mobileApp.HasInternet() {
-		// Store the request
+		// Store the request, refusing floods of requests from peers
 		h.requestsMu.Lock()
+		if len(h.activeRequests) >= maxPendingRequests {
+			h.requestsMu.Unlock()
+			return ErrTooManyPending
+		}
 		h.activeRequests[request.RequestID] = request
 		h.requestsMu.Unlock()
 
 		// Make the HTTP request
-		go h.executeProxyRequest(clientID, request)
+		ctx, done := h.inflight.register(request.RequestID)
+		h.startTrace(request, mesh.TraceHopExit)
+		go func() {
+			defer done()
+			defer h.endTrace(request.RequestID, 0, "cancelled by client")
+			h.executeProxyRequest(ctx, clientID, request)
+		}()
 		return nil
 	}
 
 	// 2. If no local internet, try to relay through the mesh internet client
 	if h.mobileApp.app.InternetClient.IsConnected() {
-		go h.relayToMesh(clientID, request)
+		ctx, done := h.inflight.register(request.RequestID)
+		h.startTrace(request, mesh.TraceHopBLERelay)
+		go func() {
+			defer done()
+			defer h.endTrace(request.RequestID, 0, "cancelled by client")
+			h.relayToMesh(ctx, clientID, request)
+		}()
 		return nil
 	}
 
 	return fmt.Errorf("no internet access or mesh proxy available")
 }
 
+// startTrace opens this hop's span of a request, continuing the client's trace if it sent one
+func (h *BLEProxyHandler) startTrace(request *ProxyRequest, hop string) {
+	if request.TraceID == "" {
+		request.TraceID = mesh.NewTraceID()
+	}
+	span := h.mobileApp.app.Traces.Start(request.TraceID, hop, request.URL)
+	h.requestsMu.Lock()
+	h.spans[request.RequestID] = span
+	h.requestsMu.Unlock()
+}
+
+// endTrace records the outcome of a request's span, if it is still open
+func (h *BLEProxyHandler) endTrace(requestID string, status int, errMsg string) {
+	h.requestsMu.Lock()
+	span, ok := h.spans[requestID]
+	delete(h.spans, requestID)
+	h.requestsMu.Unlock()
+	if ok {
+		span.End(status, errMsg)
+	}
+}
+
 // relayToMesh forwards a BLE proxy request to the Mesh's internet proxy
-func (h *BLEProxyHandler) relayToMesh(clientID string, request *ProxyRequest) {
+func (h *BLEProxyHandler) relayToMesh(ctx context.Context, clientID string, request *ProxyRequest) {
 	// Create HTTP request for the mesh internet client
 	var bodyReader io.Reader
 	if len(request.Body) > 0 {
 		bodyReader = bytes.NewReader(request.Body)
 	}
 
-	httpReq, err := http.NewRequest(request.Method, request.URL, bodyReader)
+	httpReq, err := http.NewRequestWithContext(ctx, request.Method, request.URL, bodyReader)
 	if err != nil {
 		h.sendErrorResponse(clientID, request.RequestID, fmt.Sprintf("Invalid bridged request: %v", err))
 		return
 	}
 
-	// Add headers
+	// Add headers, passing the trace on to the exit
 	for key, value := range request.Headers {
 		httpReq.Header.Set(key, value)
 	}
+	if request.TraceID != "" {
+		httpReq.Header.Set(mesh.TraceHeader, request.TraceID)
+	}
 
 	// Send through Mesh InternetClient
 	resp, err := h.mobileApp.app.InternetClient.DoRequest(httpReq)
+	if ctx.Err() != nil {
+		return // Cancelled by the client, nobody is waiting for a response
+	}
 	if err != nil {
 		h.sendErrorResponse(clientID, request.RequestID, fmt.Sprintf("Mesh relay failed: %v", err))
 		return
@@ -114,7 +167,10 @@ func (h *BLEProxyHandler) relayToMesh(clientID string, request *ProxyRequest) {
 	defer resp.Body.Close()
 
 	// Handle response similar to executeProxyRequest
-	body, err := io.ReadAll(resp.Body)
+	body, err := readBodyWithResume(ctx, h.mobileApp.app.InternetClient.DoRequest, httpReq, resp)
+	if ctx.Err() != nil {
+		return
+	}
 	if err != nil {
 		h.sendErrorResponse(clientID, request.RequestID, fmt.Sprintf("Failed to read mesh response: %v", err))
 		return
@@ -137,16 +193,32 @@ func (h *BLEProxyHandler) relayToMesh(clientID string, request *ProxyRequest) {
 }
 
 // executeProxyRequest executes an HTTP request and sends response back through BLE
-func (h *BLEProxyHandler) executeProxyRequest(clientID string, request *ProxyRequest) {
+func (h *BLEProxyHandler) executeProxyRequest(ctx context.Context, clientID string, request *ProxyRequest) {
 	defer func() {
 		h.requestsMu.Lock()
 		delete(h.activeRequests, request.RequestID)
 		h.requestsMu.Unlock()
 	}()
 
-	// Create HTTP client
+	response, err := h.fetch(ctx, request)
+	if ctx.Err() != nil {
+		return // Cancelled by the client, nobody is waiting for a response
+	}
+	if err != nil {
+		h.sendErrorResponse(clientID, request.RequestID, err.Error())
+		return
+	}
+
+	// Send response back through BLE
+	h.sendProxyResponse(clientID, response)
+}
+
+// fetch makes a request on this device's own internet
+func (h *BLEProxyHandler) fetch(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error) {
+	// Create HTTP client, never connecting to this device's own networks
 	client := &http.Client{
-		Timeout: 30 * time.Second,
+		Transport: h.mobileApp.app.ExitGuard.RoundTripper(),
+		Timeout:   30 * time.Second,
 	}
 
 	// Create HTTP request
@@ -155,30 +227,29 @@ func (h *BLEProxyHandler) executeProxyRequest(clientID string, request *ProxyReq
 		bodyReader = bytes.NewReader(request.Body)
 	}
 
-	httpReq, err := http.NewRequest(request.Method, request.URL, bodyReader)
+	httpReq, err := http.NewRequestWithContext(ctx, request.Method, request.URL, bodyReader)
 	if err != nil {
-		h.sendErrorResponse(clientID, request.RequestID, fmt.Sprintf("Invalid request: %v", err))
-		return
+		return nil, fmt.Errorf("Invalid request: %v", err)
 	}
 
-	// Add headers
+	// Add headers; the trace ID stays inside the mesh, and the client's identity too if we protect it
 	for key, value := range request.Headers {
 		httpReq.Header.Set(key, value)
 	}
+	httpReq.Header.Del(mesh.TraceHeader)
+	mesh.ApplyPrivacy(httpReq.Header, h.mobileApp.app.InternetProxy.PrivacyMode())
 
 	// Execute request
 	resp, err := client.Do(httpReq)
 	if err != nil {
-		h.sendErrorResponse(clientID, request.RequestID, fmt.Sprintf("Request failed: %v", err))
-		return
+		return nil, fmt.Errorf("Request failed: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	// Read response body, resuming with a Range request if the transfer breaks
+	body, err := readBodyWithResume(ctx, client.Do, httpReq, resp)
 	if err != nil {
-		h.sendErrorResponse(clientID, request.RequestID, fmt.Sprintf("Failed to read response: %v", err))
-		return
+		return nil, fmt.Errorf("Failed to read response: %v", err)
 	}
 
 	// Create response
@@ -195,13 +266,12 @@ func (h *BLEProxyHandler) executeProxyRequest(clientID string, request *ProxyReq
 			response.Headers[key] = values[0]
 		}
 	}
-
-	// Send response back through BLE
-	h.sendProxyResponse(clientID, response)
+	return response, nil
 }
 
 // sendProxyResponse sends a proxy response through BLE
 func (h *BLEProxyHandler) sendProxyResponse(clientID string, response *ProxyResponse) {
+	h.endTrace(response.RequestID, response.StatusCode, response.Error)
 	if h.onBLEMessage == nil {
 		return
 	}
@@ -217,19 +287,32 @@ func (h *BLEProxyHandler) sendProxyResponse(clientID string, response *ProxyResp
 		return
 	}
 
-	h.onBLEMessage(clientID, "internet_proxy", data)
+	h.send(clientID, data)
+}
+
+// send passes a proxy message to the BLE sender, sealed for the peer if we paired with it
+func (h *BLEProxyHandler) send(peerID string, data []byte) error {
+	sealed, err := h.mobileApp.sealForPeer(peerID, data)
+	if err != nil {
+		return err
+	}
+	return h.onBLEMessage(peerID, "internet_proxy", sealed)
 }
 
 // sendErrorResponse sends an error response through BLE
 func (h *BLEProxyHandler) sendErrorResponse(clientID, requestID, errorMsg string) {
-	response := &ProxyResponse{
+	h.endTrace(requestID, 500, errorMsg)
+	h.sendProxyResponse(clientID, errorResponse(requestID, errorMsg))
+}
+
+// errorResponse is the response to a request that failed before the destination answered
+func errorResponse(requestID, errorMsg string) *ProxyResponse {
+	return &ProxyResponse{
 		RequestID:  requestID,
 		StatusCode: 500,
 		Headers:    map[string]string{"Content-Type": "text/plain"},
 		Body:       []byte(errorMsg),
 	}
-
-	h.sendProxyResponse(clientID, response)
 }
 
 // SendProxyRequest sends a proxy request to a BLE peer with internet
@@ -239,7 +322,7 @@ func (h *BLEProxyHandler) SendProxyRequest(proxyPeerID, url, method string, head
 	}
 
 	// Generate request ID
-	requestID := fmt.Sprintf("%s-%d", h.nodeID, time.Now().UnixNano())
+	requestID := h.nodeID + "-" + mesh.NewSortableID()
 
 	request := &ProxyRequest{
 		RequestID: requestID,
@@ -249,6 +332,7 @@ func (h *BLEProxyHandler) SendProxyRequest(proxyPeerID, url, method string, head
 		Headers:   headers,
 		Body:      body,
 		CreatedAt: time.Now(),
+		TraceID:   mesh.NewTraceID(),
 	}
 
 	message := &BLEProxyMessage{
@@ -262,19 +346,78 @@ func (h *BLEProxyHandler) SendProxyRequest(proxyPeerID, url, method string, head
 		return "", fmt.Errorf("failed to marshal request: %w", err)
 	}
 
+	// Register before sending so a fast response isn't lost; unclaimed entries expire
+	if _, err := h.pendingResponses.add(requestID); err != nil {
+		return "", err
+	}
+
 	// Send request through BLE
-	err = h.onBLEMessage(proxyPeerID, "internet_proxy", data)
+	err = h.send(proxyPeerID, data)
 	if err != nil {
+		h.pendingResponses.remove(requestID)
 		return "", fmt.Errorf("failed to send BLE message: %w", err)
 	}
 
 	return requestID, nil
 }
 
+// AwaitProxyResponse waits for the response to a request sent with SendProxyRequest
+// and returns it as JSON. The request is forgotten afterwards, whether or not it arrived.
+func (h *BLEProxyHandler) AwaitProxyResponse(requestID string, timeoutMs int64) (string, error) {
+	ch, ok := h.pendingResponses.channel(requestID)
+	if !ok {
+		return "", fmt.Errorf("unknown or expired request: %s", requestID)
+	}
+	defer h.pendingResponses.remove(requestID)
+	defer h.takeCircuit(requestID)
+
+	select {
+	case resp := <-ch:
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal response: %w", err)
+		}
+		return string(data), nil
+	case <-time.After(time.Duration(timeoutMs) * time.Millisecond):
+		return "", fmt.Errorf("request timeout")
+	}
+}
+
+// CancelProxyRequest abandons a request sent with SendProxyRequest and asks the proxy
+// peer to abort it, so neither side keeps spending bandwidth on it
+func (h *BLEProxyHandler) CancelProxyRequest(proxyPeerID, requestID string) error {
+	h.pendingResponses.remove(requestID)
+	if h.onBLEMessage == nil {
+		return fmt.Errorf("BLE message sender not configured")
+	}
+
+	data, err := json.Marshal(&BLEProxyMessage{Type: "cancel", RequestID: requestID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal cancel: %w", err)
+	}
+	if err := h.send(proxyPeerID, data); err != nil {
+		return fmt.Errorf("failed to send BLE message: %w", err)
+	}
+	return nil
+}
+
+// PendingStats returns statistics about proxy requests awaiting a response
+func (h *BLEProxyHandler) PendingStats() PendingStats {
+	return h.pendingResponses.snapshot()
+}
+
 // HandleBLEProxyMessage handles incoming BLE proxy messages
 func (h *BLEProxyHandler) HandleBLEProxyMessage(senderID string, data []byte) error {
+	data, from, err := h.mobileApp.openPayload(data)
+	if err != nil {
+		return err
+	}
+	if from != "" && from != senderID {
+		return fmt.Errorf("proxy message from %s was sealed by %s", senderID, from)
+	}
+
 	var message BLEProxyMessage
-	err := json.Unmarshal(data, &message)
+	err = json.Unmarshal(data, &message)
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal proxy message: %w", err)
 	}
@@ -309,14 +452,40 @@ func (h *BLEProxyHandler) HandleBLEProxyMessage(senderID string, data []byte) er
 		}
 
 		// Send to waiting goroutine
-		h.responsesMu.RLock()
-		if ch, ok := h.pendingResponses[message.RequestID]; ok {
-			select {
-			case ch <- &response:
-			default:
-			}
+		h.pendingResponses.deliver(message.RequestID, &response)
+
+	case "cancel":
+		// The client gave up; abort the upstream request if it is still running
+		h.inflight.cancel(message.RequestID)
+
+	case "onion", "onion_response":
+		// Onions and their replies are opaque bytes
+		var sealed struct {
+			Data []byte `json:"data"`
+		}
+		if err := json.Unmarshal(data, &sealed); err != nil {
+			return fmt.Errorf("failed to unmarshal onion: %w", err)
+		}
+		if message.Type == "onion" {
+			go h.relayOnion(senderID, message.RequestID, sealed.Data)
+			return nil
+		}
+		return h.handleOnionResponse(message.RequestID, sealed.Data)
+
+	case "hotspot_candidate", "hotspot_credentials", "hotspot_revoked":
+		var election struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(data, &election); err != nil {
+			return fmt.Errorf("failed to unmarshal hotspot message: %w", err)
+		}
+		return h.mobileApp.handleHotspotMessage(senderID, from, message.Type, election.Data)
+
+	case "onion_error":
+		errorMsg, _ := message.Data.(string)
+		if h.takeCircuit(message.RequestID) != nil {
+			h.pendingResponses.deliver(message.RequestID, errorResponse(message.RequestID, errorMsg))
 		}
-		h.responsesMu.RUnlock()
 
 	default:
 		return fmt.Errorf("unknown proxy message type: %s", message.Type)
@@ -334,69 +503,13 @@ func (h *BLEProxyHandler) ExecuteProxyRequestSync(requestJSON string) (string, e
 		return "", fmt.Errorf("failed to unmarshal request: %w", err)
 	}
 
-	// Execute the HTTP request
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	var bodyReader io.Reader
-	if len(request.Body) > 0 {
-		bodyReader = bytes.NewReader(request.Body)
-	}
-
-	httpReq, err := http.NewRequest(request.Method, request.URL, bodyReader)
+	// Fetch it the way BLE requests are, through the exit guard and with our privacy mode
+	response, err := h.fetch(context.Background(), &request)
 	if err != nil {
-		response := &ProxyResponse{
+		response = &ProxyResponse{
 			RequestID:  request.RequestID,
 			StatusCode: 500,
-			Error:      fmt.Sprintf("Invalid request: %v", err),
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
-	}
-
-	// Add headers
-	for key, value := range request.Headers {
-		httpReq.Header.Set(key, value)
-	}
-
-	// Execute request
-	resp, err := client.Do(httpReq)
-	if err != nil {
-		response := &ProxyResponse{
-			RequestID:  request.RequestID,
-			StatusCode: 500,
-			Error:      fmt.Sprintf("Request failed: %v", err),
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
-	}
-	defer resp.Body.Close()
-
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		response := &ProxyResponse{
-			RequestID:  request.RequestID,
-			StatusCode: 500,
-			Error:      fmt.Sprintf("Failed to read response: %v", err),
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
-	}
-
-	// Create response
-	response := &ProxyResponse{
-		RequestID:  request.RequestID,
-		StatusCode: resp.StatusCode,
-		Headers:    make(map[string]string),
-		Body:       body,
-	}
-
-	// Copy headers
-	for key, values := range resp.Header {
-		if len(values) > 0 {
-			response.Headers[key] = values[0]
+			Error:      err.Error(),
 		}
 	}
 
@@ -410,7 +523,7 @@ func (h *BLEProxyHandler) ExecuteProxyRequestSync(requestJSON string) (string, e
 
 // CreateProxyRequest creates a JSON proxy request for sending via BLE
 func (h *BLEProxyHandler) CreateProxyRequest(url, method string) (string, error) {
-	requestID := fmt.Sprintf("%s-%d", h.nodeID, time.Now().UnixNano())
+	requestID := h.nodeID + "-" + mesh.NewSortableID()
 
 	request := &ProxyRequest{
 		RequestID: requestID,
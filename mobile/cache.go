@@ -0,0 +1,311 @@
+package intermesh
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHTTPCacheBytes is the default size of the local proxy's response cache
+	defaultHTTPCacheBytes = 4 << 20
+	// maxCachedResponse is the largest response body cached, base64 encoded
+	maxCachedResponse = 512 << 10
+	// maxHeuristicFreshness caps how long a response with only Last-Modified stays fresh
+	maxHeuristicFreshness = 24 * time.Hour
+)
+
+// HTTPCacheStats describes the local proxy's response cache and how it was used
+type HTTPCacheStats struct {
+	Entries     int   `json:"entries"`
+	Bytes       int64 `json:"bytes"`
+	MaxBytes    int64 `json:"max_bytes"`
+	Hits        int64 `json:"hits"`        // Answered without crossing the mesh
+	Revalidated int64 `json:"revalidated"` // Confirmed unchanged by a 304, so only headers crossed the mesh
+	Misses      int64 `json:"misses"`
+}
+
+// cachedResponse is a stored response; it is never modified once stored
+type cachedResponse struct {
+	url            string
+	resp           *TunnelResponse
+	vary           map[string]string // Request headers the response varies on, and their values
+	expires        time.Time
+	mustRevalidate bool // no-cache: only served after the exit confirms it is unchanged
+}
+
+// responseCache keeps GET responses the local proxy received, so repeat visits are
+// answered locally or revalidated with ETag and Last-Modified instead of fetching the
+// body over the mesh again. It is a private cache evicting least recently used entries.
+type responseCache struct {
+	maxBytes int64
+	bytes    int64
+	entries  map[string]*list.Element
+	order    *list.List // Most recently used first
+	stats    HTTPCacheStats
+	mu       sync.Mutex
+}
+
+func newResponseCache(maxBytes int64) *responseCache {
+	return &responseCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// headerValue looks up a header in a tunnel header map, whatever case its key is in
+func headerValue(headers map[string]string, key string) string {
+	if value, ok := headers[http.CanonicalHeaderKey(key)]; ok {
+		return value
+	}
+	for k, value := range headers {
+		if strings.EqualFold(k, key) {
+			return value
+		}
+	}
+	return ""
+}
+
+// cacheDirectives parses a Cache-Control header into its lower-cased directives
+func cacheDirectives(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// freshness returns how long a response stays fresh from now, and whether it must be
+// revalidated before every use
+func freshness(headers map[string]string, now time.Time) (time.Duration, bool) {
+	directives := cacheDirectives(headerValue(headers, "Cache-Control"))
+	if _, ok := directives["no-cache"]; ok {
+		return 0, true
+	}
+	age := time.Duration(0)
+	if seconds, err := strconv.Atoi(headerValue(headers, "Age")); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	if maxAge, ok := directives["max-age"]; ok {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return 0, false
+		}
+		return time.Duration(seconds)*time.Second - age, false
+	}
+
+	date, err := http.ParseTime(headerValue(headers, "Date"))
+	if err != nil {
+		date = now
+	}
+	if expires := headerValue(headers, "Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, false // An invalid Expires means already expired
+		}
+		return at.Sub(date) - age, false
+	}
+	// Without explicit freshness, a tenth of the time since the last change
+	if modified, err := http.ParseTime(headerValue(headers, "Last-Modified")); err == nil && modified.Before(date) {
+		return min(date.Sub(modified)/10, maxHeuristicFreshness) - age, false
+	}
+	return 0, false
+}
+
+// SetMaxBytes resizes the cache, evicting entries that no longer fit; 0 disables it
+func (c *responseCache) SetMaxBytes(maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes = max(maxBytes, 0)
+	c.evictLocked()
+}
+
+// evictLocked drops least recently used entries until the cache fits; c.mu must be held
+func (c *responseCache) evictLocked() {
+	for c.bytes > c.maxBytes {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+// removeLocked drops an entry; c.mu must be held
+func (c *responseCache) removeLocked(elem *list.Element) {
+	entry := elem.Value.(*cachedResponse)
+	c.order.Remove(elem)
+	delete(c.entries, entry.url)
+	c.bytes -= int64(len(entry.resp.Body))
+}
+
+// lookup returns the cached response for a GET request to url, and whether it may be
+// served without asking the exit. A stale response is returned for revalidation.
+func (c *responseCache) lookup(req *http.Request, url string, now time.Time) (*cachedResponse, bool) {
+	directives := cacheDirectives(req.Header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[url]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	entry := elem.Value.(*cachedResponse)
+	for name, value := range entry.vary {
+		if req.Header.Get(name) != value {
+			c.stats.Misses++
+			return nil, false
+		}
+	}
+	c.order.MoveToFront(elem)
+
+	_, reload := directives["no-cache"]
+	if !reload && !entry.mustRevalidate && now.Before(entry.expires) {
+		c.stats.Hits++
+		return entry, true
+	}
+	if headerValue(entry.resp.Headers, "ETag") == "" && headerValue(entry.resp.Headers, "Last-Modified") == "" {
+		c.stats.Misses++
+		return nil, false
+	}
+	return entry, false
+}
+
+// store caches a response to a GET request to url, if it may be and is worth reusing
+func (c *responseCache) store(req *http.Request, url string, resp *TunnelResponse, now time.Time) {
+	if resp.StatusCode != http.StatusOK || len(resp.Body) > maxCachedResponse {
+		return
+	}
+	if _, ok := cacheDirectives(req.Header.Get("Cache-Control"))["no-store"]; ok {
+		return
+	}
+	if _, ok := cacheDirectives(headerValue(resp.Headers, "Cache-Control"))["no-store"]; ok {
+		return
+	}
+	vary := make(map[string]string)
+	for _, name := range strings.Split(headerValue(resp.Headers, "Vary"), ",") {
+		if name = strings.TrimSpace(name); name == "*" {
+			return
+		} else if name != "" {
+			vary[name] = req.Header.Get(name)
+		}
+	}
+	fresh, mustRevalidate := freshness(resp.Headers, now)
+	hasValidator := headerValue(resp.Headers, "ETag") != "" || headerValue(resp.Headers, "Last-Modified") != ""
+	if fresh <= 0 && !hasValidator {
+		return // Could never be reused
+	}
+	c.put(&cachedResponse{url: url, resp: resp, vary: vary, expires: now.Add(fresh), mustRevalidate: mustRevalidate})
+}
+
+// put adds or replaces an entry
+func (c *responseCache) put(entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if int64(len(entry.resp.Body)) > c.maxBytes {
+		return
+	}
+	if elem, ok := c.entries[entry.url]; ok {
+		c.removeLocked(elem)
+	}
+	c.entries[entry.url] = c.order.PushFront(entry)
+	c.bytes += int64(len(entry.resp.Body))
+	c.evictLocked()
+}
+
+// revalidated refreshes an entry with the headers of the 304 that confirmed it and
+// returns the response to serve
+func (c *responseCache) revalidated(entry *cachedResponse, notModified *TunnelResponse, now time.Time) *TunnelResponse {
+	resp := *entry.resp
+	resp.Headers = make(map[string]string, len(entry.resp.Headers))
+	for key, value := range entry.resp.Headers {
+		resp.Headers[key] = value
+	}
+	for key, value := range notModified.Headers {
+		if !strings.EqualFold(key, "Content-Length") {
+			resp.Headers[key] = value
+		}
+	}
+	fresh, mustRevalidate := freshness(resp.Headers, now)
+	c.put(&cachedResponse{url: entry.url, resp: &resp, vary: entry.vary, expires: now.Add(fresh), mustRevalidate: mustRevalidate})
+
+	c.mu.Lock()
+	c.stats.Revalidated++
+	c.mu.Unlock()
+	return &resp
+}
+
+// miss counts a request a stale entry couldn't answer
+func (c *responseCache) miss() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Misses++
+}
+
+// Invalidate drops the cached response for url
+func (c *responseCache) Invalidate(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[url]; ok {
+		c.removeLocked(elem)
+	}
+}
+
+// Clear drops every cached response
+func (c *responseCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.bytes = 0
+}
+
+// Stats returns the cache's size and counters
+func (c *responseCache) Stats() HTTPCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.bytes
+	stats.MaxBytes = c.maxBytes
+	return stats
+}
+
+// conditionals adds the entry's validators to a tunnel request, unless the browser
+// sent its own; it returns whether it did
+func (entry *cachedResponse) conditionals(req *TunnelRequest) bool {
+	if headerValue(req.Headers, "If-None-Match") != "" || headerValue(req.Headers, "If-Modified-Since") != "" {
+		return false
+	}
+	if etag := headerValue(entry.resp.Headers, "ETag"); etag != "" {
+		req.Headers["If-None-Match"] = etag
+	}
+	if modified := headerValue(entry.resp.Headers, "Last-Modified"); modified != "" {
+		req.Headers["If-Modified-Since"] = modified
+	}
+	return true
+}
+
+// served returns the cached response to send for a request, with its age, or a 304 if
+// the browser already holds the same version
+func (entry *cachedResponse) served(req *http.Request, now time.Time) *TunnelResponse {
+	resp := *entry.resp
+	resp.Headers = make(map[string]string, len(entry.resp.Headers)+1)
+	for key, value := range entry.resp.Headers {
+		resp.Headers[key] = value
+	}
+	if date, err := http.ParseTime(headerValue(resp.Headers, "Date")); err == nil && now.After(date) {
+		resp.Headers["Age"] = strconv.Itoa(int(now.Sub(date) / time.Second))
+	}
+	if etag := headerValue(resp.Headers, "ETag"); etag != "" && req.Header.Get("If-None-Match") == etag {
+		resp.StatusCode, resp.Status, resp.Body = http.StatusNotModified, "Not Modified", ""
+		delete(resp.Headers, "Content-Length")
+	}
+	return &resp
+}
@@ -0,0 +1,63 @@
+package intermesh
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// tunnelCancelMessageType is the BLE message type used to abort an in-flight tunnel request
+const tunnelCancelMessageType = "http_tunnel_cancel"
+
+// TunnelCancel asks the exit node to abort a tunnel request
+type TunnelCancel struct {
+	ID string `json:"id"`
+}
+
+// cancelRegistry tracks in-flight upstream requests so they can be aborted by request ID
+type cancelRegistry struct {
+	cancels map[string]context.CancelFunc
+	mu      sync.Mutex
+}
+
+func newCancelRegistry() *cancelRegistry {
+	return &cancelRegistry{cancels: make(map[string]context.CancelFunc)}
+}
+
+// register returns a context that is cancelled when cancel(id) is called.
+// The returned done func must be called once the request finishes.
+func (r *cancelRegistry) register(id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	r.cancels[id] = cancel
+	r.mu.Unlock()
+
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.cancels, id)
+		r.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel aborts the request with the given ID and reports whether it was in flight
+func (r *cancelRegistry) cancel(id string) bool {
+	r.mu.Lock()
+	cancel, ok := r.cancels[id]
+	delete(r.cancels, id)
+	r.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// parseTunnelCancel decodes a cancel message
+func parseTunnelCancel(data string) (string, error) {
+	var msg TunnelCancel
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return "", err
+	}
+	return msg.ID, nil
+}
@@ -0,0 +1,91 @@
+package intermesh
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	minChunkSize     = 4 * 1024
+	maxChunkSize     = 64 * 1024
+	initialChunkSize = 16 * 1024
+
+	// targetChunkLatency is how long one chunk should take to cross the link; fast
+	// links get bigger chunks, slow ones smaller chunks that still arrive promptly
+	targetChunkLatency = 500 * time.Millisecond
+
+	chunkEWMAWeight = 0.3
+	// chunkErrorRateLimit stops growth while the link is dropping exchanges
+	chunkErrorRateLimit = 0.2
+)
+
+// chunkSizer picks the tunnel chunk size for one link from its measured throughput and
+// error rate. Failures halve the size; successes move it towards what the link can carry
+// within targetChunkLatency, at most doubling per exchange.
+type chunkSizer struct {
+	size       int
+	throughput float64 // Bytes per second, EWMA
+	errorRate  float64 // Fraction of failed exchanges, EWMA
+	mu         sync.Mutex
+}
+
+func newChunkSizer() *chunkSizer {
+	return &chunkSizer{size: initialChunkSize}
+}
+
+// Size returns the current chunk size in bytes
+func (c *chunkSizer) Size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Record feeds the outcome of one exchange of n bytes over the link
+func (c *chunkSizer) Record(n int, elapsed time.Duration, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if failed {
+		c.errorRate = ewma(c.errorRate, 1)
+		c.size = clampChunkSize(c.size / 2)
+		return
+	}
+	c.errorRate = ewma(c.errorRate, 0)
+	if n <= 0 || elapsed <= 0 {
+		return
+	}
+
+	sample := float64(n) / elapsed.Seconds()
+	if c.throughput == 0 {
+		c.throughput = sample
+	} else {
+		c.throughput = ewma(c.throughput, sample)
+	}
+
+	target := int(c.throughput * targetChunkLatency.Seconds())
+	if target > c.size*2 {
+		target = c.size * 2
+	}
+	if target < c.size/2 {
+		target = c.size / 2
+	}
+	if c.errorRate > chunkErrorRateLimit && target > c.size {
+		target = c.size
+	}
+	c.size = clampChunkSize(target)
+}
+
+func ewma(current, sample float64) float64 {
+	return current*(1-chunkEWMAWeight) + sample*chunkEWMAWeight
+}
+
+// clampChunkSize bounds a chunk size and rounds it down to whole kilobytes
+func clampChunkSize(size int) int {
+	if size < minChunkSize {
+		return minChunkSize
+	}
+	if size > maxChunkSize {
+		return maxChunkSize
+	}
+	return size &^ 1023
+}
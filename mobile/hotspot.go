@@ -0,0 +1,448 @@
+package intermesh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
+)
+
+// When nearby devices share no Wi-Fi network, the app starts a hotspot election with the
+// BLE peers around it: each device sends the others the candidacies it knows of
+// ("hotspot_candidate": whether a device can host, its battery, charging and carrier
+// limits), its own first, and peers that receive them join in. A device passes the set
+// on whenever it learns a new candidacy, so devices out of each other's range still see
+// the same candidates; a device's own word about itself is never overridden by what
+// others relay. Once no new candidacy has arrived for HotspotElectionWindow, every
+// device elects the same host with mesh.ElectHotspot. The host's platform starts the
+// hotspot and reports it with HotspotStarted, which sends its SSID and passphrase to the
+// others ("hotspot_credentials") and they pass them on the way candidacies are; their
+// platforms then join it. Devices arriving later get the credentials of the hotspot
+// already up. Like mesh Wi-Fi credential shares, credentials only go to peers that
+// MeshApp.CheckWiFiCredentialPeer allows, always sealed with the pairing key, and last
+// until HotspotCredentialTTL passes or the host reports HotspotStopped, which revokes
+// them ("hotspot_revoked").
+
+// HotspotElectionWindow is how long an election waits for more candidates before deciding
+const HotspotElectionWindow = 3 * time.Second
+
+// HotspotCredentialTTL is how long hotspot credentials last unless revoked earlier
+const HotspotCredentialTTL = 12 * time.Hour
+
+// HotspotCallback tells the platform how a hotspot election turned out
+type HotspotCallback interface {
+	// OnHotspotElected names the elected host; when it is us, the platform starts a
+	// hotspot and reports it with HotspotStarted
+	OnHotspotElected(hostID string, self bool)
+	// OnHotspotCredentials gives the network the host started, for the platform to join
+	OnHotspotCredentials(hostID, ssid, passphrase string)
+	// OnHotspotRevoked says the credentials from the host expired or its hotspot went
+	// down, for the platform to forget them
+	OnHotspotRevoked(hostID string)
+}
+
+// HotspotCredentials is the network a hotspot host started
+type HotspotCredentials struct {
+	Host       string    `json:"host"`
+	SSID       string    `json:"ssid"`
+	Passphrase string    `json:"passphrase"`
+	Expires    time.Time `json:"expires"`
+}
+
+// hotspotElection is our side of the current hotspot election
+type hotspotElection struct {
+	status      mesh.HotspotCandidate            // Ours, as the platform last reported it
+	candidates  map[string]mesh.HotspotCandidate // Everyone's in the current election, ours included; nil when none runs
+	direct      map[string]bool                  // Candidates that told us themselves rather than through others
+	peers       map[string]bool                  // BLE peers in the election, whom we tell of new candidates
+	host        string                           // Elected host, "" while undecided
+	credentials *HotspotCredentials              // Our hotspot's, while we host
+	joined      *HotspotCredentials              // The host's we were told of and passed on
+	joinedFrom  string                           // The peer that told us of them
+	expiry      *time.Timer                      // Revokes the joined credentials once they expire
+	callback    HotspotCallback
+	timer       *time.Timer
+	window      time.Duration
+	mu          sync.Mutex
+}
+
+func newHotspotElection(nodeID string) *hotspotElection {
+	return &hotspotElection{
+		status: mesh.HotspotCandidate{NodeID: nodeID, Battery: -1},
+		window: HotspotElectionWindow,
+	}
+}
+
+// SetHotspotCallback registers the callback told how hotspot elections turn out
+func (ma *MobileApp) SetHotspotCallback(callback HotspotCallback) {
+	ma.hotspot.mu.Lock()
+	defer ma.hotspot.mu.Unlock()
+	ma.hotspot.callback = callback
+}
+
+// SetHotspotStatus reports what this device offers as a hotspot host, as JSON such as
+// {"can_host":true,"battery":80,"charging":false,"data_limited":true}; battery is in
+// percent, -1 if unknown. Call it before elections and whenever it changes.
+func (ma *MobileApp) SetHotspotStatus(statusJSON string) error {
+	var status mesh.HotspotCandidate
+	if err := json.Unmarshal([]byte(statusJSON), &status); err != nil {
+		return fmt.Errorf("invalid hotspot status: %w", err)
+	}
+	e := ma.hotspot
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	status.NodeID = ma.app.Node.ID
+	status.Hosting = e.credentials != nil
+	e.status = status
+	if e.candidates != nil {
+		e.candidates[status.NodeID] = status
+	}
+	return nil
+}
+
+// StartHotspotElection elects which device hosts a hotspot among this one and the BLE
+// peers given, comma-separated; the callback is told the outcome
+func (ma *MobileApp) StartHotspotElection(peerIDs string) error {
+	if ma.bleProxyHandler.onBLEMessage == nil {
+		return fmt.Errorf("BLE message sender not configured")
+	}
+	peers := splitList(peerIDs)
+	e := ma.hotspot
+	e.mu.Lock()
+	e.resetLocked()
+	e.host = ""
+	e.joined = nil
+	for _, peerID := range peers {
+		e.peers[peerID] = true
+	}
+	candidates := e.candidacyLocked()
+	ma.armHotspotElectionLocked()
+	e.mu.Unlock()
+
+	for _, peerID := range peers {
+		if err := ma.sendHotspotMessage(peerID, "hotspot_candidate", candidates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetLocked starts a new election with only us as a candidate; e.mu must be held
+func (e *hotspotElection) resetLocked() {
+	e.candidates = map[string]mesh.HotspotCandidate{e.status.NodeID: e.status}
+	e.direct = make(map[string]bool)
+	e.peers = make(map[string]bool)
+}
+
+// candidacyLocked returns the candidacies we know of, ours first; e.mu must be held
+func (e *hotspotElection) candidacyLocked() []mesh.HotspotCandidate {
+	candidates := []mesh.HotspotCandidate{e.status}
+	for nodeID, candidate := range e.candidates {
+		if nodeID != e.status.NodeID {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// HotspotStarted reports that the hotspot we were elected to host is up, and sends its
+// credentials to the other devices in the election
+func (ma *MobileApp) HotspotStarted(ssid, passphrase string) error {
+	e := ma.hotspot
+	e.mu.Lock()
+	if e.host != e.status.NodeID {
+		e.mu.Unlock()
+		return fmt.Errorf("not elected to host the hotspot")
+	}
+	credentials := &HotspotCredentials{Host: e.status.NodeID, SSID: ssid, Passphrase: passphrase,
+		Expires: time.Now().Add(HotspotCredentialTTL)}
+	e.credentials = credentials
+	e.status.Hosting = true
+	e.candidates[e.status.NodeID] = e.status
+	var peers []string
+	for peerID := range e.peers {
+		peers = append(peers, peerID)
+	}
+	e.mu.Unlock()
+
+	return ma.sendHotspotCredentials(peers, credentials)
+}
+
+// HotspotStopped reports that our hotspot went down, revoking its credentials; the next
+// election starts afresh
+func (ma *MobileApp) HotspotStopped() error {
+	e := ma.hotspot
+	e.mu.Lock()
+	hosting := e.credentials != nil
+	e.credentials = nil
+	e.status.Hosting = false
+	e.candidates = nil
+	e.host = ""
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	var peers []string
+	for peerID := range e.peers {
+		peers = append(peers, peerID)
+	}
+	nodeID := e.status.NodeID
+	e.mu.Unlock()
+
+	if !hosting {
+		return nil
+	}
+	return ma.sendHotspotRevoked(peers, nodeID)
+}
+
+// sendHotspotCredentials sends credentials to the peers allowed to receive them
+func (ma *MobileApp) sendHotspotCredentials(peers []string, credentials *HotspotCredentials) error {
+	for _, peerID := range peers {
+		if err := ma.app.CheckWiFiCredentialPeer(peerID, ""); err != nil {
+			continue
+		}
+		if err := ma.sendHotspotMessage(peerID, "hotspot_credentials", credentials); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendHotspotRevoked tells peers to forget the credentials of a host's hotspot
+func (ma *MobileApp) sendHotspotRevoked(peers []string, hostID string) error {
+	var errs []error
+	for _, peerID := range peers {
+		if err := ma.sendHotspotMessage(peerID, "hotspot_revoked", hostID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// revokeJoined forgets the credentials we joined with, telling the platform and the
+// peers we passed them on to; e.mu must not be held
+func (ma *MobileApp) revokeJoined(credentials *HotspotCredentials) error {
+	e := ma.hotspot
+	e.mu.Lock()
+	if e.joined != credentials {
+		e.mu.Unlock()
+		return nil
+	}
+	e.joined, e.joinedFrom = nil, ""
+	if e.expiry != nil {
+		e.expiry.Stop()
+	}
+	if e.host == credentials.Host {
+		e.host = ""
+	}
+	var peers []string
+	for peerID := range e.peers {
+		if peerID != credentials.Host {
+			peers = append(peers, peerID)
+		}
+	}
+	callback := e.callback
+	e.mu.Unlock()
+
+	if callback != nil {
+		callback.OnHotspotRevoked(credentials.Host)
+	}
+	return ma.sendHotspotRevoked(peers, credentials.Host)
+}
+
+// GetHotspotHost returns the node ID of the elected hotspot host, or "" while undecided
+func (ma *MobileApp) GetHotspotHost() string {
+	ma.hotspot.mu.Lock()
+	defer ma.hotspot.mu.Unlock()
+	return ma.hotspot.host
+}
+
+// armHotspotElectionLocked decides the election once the window passes without new
+// candidates; the election's lock must be held
+func (ma *MobileApp) armHotspotElectionLocked() {
+	e := ma.hotspot
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.timer = time.AfterFunc(e.window, ma.decideHotspot)
+}
+
+// decideHotspot elects the host among the candidates seen and tells the platform
+func (ma *MobileApp) decideHotspot() {
+	e := ma.hotspot
+	e.mu.Lock()
+	if e.candidates == nil {
+		e.mu.Unlock()
+		return
+	}
+	candidates := make([]mesh.HotspotCandidate, 0, len(e.candidates))
+	for _, candidate := range e.candidates {
+		candidates = append(candidates, candidate)
+	}
+	host := mesh.ElectHotspot(candidates)
+	changed := host != e.host
+	e.host = host
+	callback := e.callback
+	self := host == e.status.NodeID
+	e.mu.Unlock()
+
+	if host != "" && changed && callback != nil {
+		callback.OnHotspotElected(host, self)
+	}
+}
+
+// handleHotspotMessage takes part in the election a peer's message belongs to; sealedBy
+// is the paired peer that sealed it, "" if it came in the clear
+func (ma *MobileApp) handleHotspotMessage(senderID, sealedBy, messageType string, data []byte) error {
+	e := ma.hotspot
+	switch messageType {
+	case "hotspot_candidate":
+		var received []mesh.HotspotCandidate
+		if err := json.Unmarshal(data, &received); err != nil || len(received) == 0 {
+			return fmt.Errorf("invalid hotspot candidacy: %v", err)
+		}
+		received[0].NodeID = senderID
+
+		e.mu.Lock()
+		if e.candidates == nil {
+			e.resetLocked()
+		}
+		grew := false
+		for i, candidate := range received {
+			own := i == 0
+			if candidate.NodeID == "" || candidate.NodeID == e.status.NodeID || (!own && e.direct[candidate.NodeID]) {
+				continue
+			}
+			if known, ok := e.candidates[candidate.NodeID]; !ok || known != candidate {
+				e.candidates[candidate.NodeID] = candidate
+				grew = true
+			}
+			if own {
+				e.direct[candidate.NodeID] = true
+			}
+		}
+		newPeer := !e.peers[senderID]
+		e.peers[senderID] = true
+		var tell []string
+		if grew {
+			for peerID := range e.peers {
+				tell = append(tell, peerID)
+			}
+		} else if newPeer {
+			tell = []string{senderID}
+		}
+		candidates, credentials := e.candidacyLocked(), e.credentials
+		if grew {
+			ma.armHotspotElectionLocked()
+		}
+		e.mu.Unlock()
+
+		for _, peerID := range tell {
+			if err := ma.sendHotspotMessage(peerID, "hotspot_candidate", candidates); err != nil {
+				return err
+			}
+		}
+		if credentials != nil && newPeer {
+			return ma.sendHotspotCredentials([]string{senderID}, credentials)
+		}
+		return nil
+
+	case "hotspot_credentials":
+		if sealedBy != senderID {
+			return fmt.Errorf("hotspot credentials from %s weren't sealed", senderID)
+		}
+		if err := ma.app.CheckWiFiCredentialPeer(senderID, ""); err != nil {
+			return err
+		}
+		var credentials HotspotCredentials
+		if err := json.Unmarshal(data, &credentials); err != nil || credentials.SSID == "" {
+			return fmt.Errorf("invalid hotspot credentials: %v", err)
+		}
+		if credentials.Host == "" {
+			credentials.Host = senderID
+		}
+		host := credentials.Host
+		now := time.Now()
+		if limit := now.Add(HotspotCredentialTTL); credentials.Expires.IsZero() || credentials.Expires.After(limit) {
+			credentials.Expires = limit
+		}
+		if !now.Before(credentials.Expires) {
+			return fmt.Errorf("hotspot credentials from %s expired", senderID)
+		}
+
+		e.mu.Lock()
+		if host == e.status.NodeID || (e.joined != nil && e.joined.Host == host && e.joined.SSID == credentials.SSID &&
+			e.joined.Passphrase == credentials.Passphrase) {
+			e.mu.Unlock()
+			return nil
+		}
+		if e.host != "" && e.host != host {
+			elected := e.host
+			e.mu.Unlock()
+			return fmt.Errorf("hotspot credentials for %s, but %s was elected", host, elected)
+		}
+		// Credentials settle an election still running: the host's hotspot is up
+		decided := e.host == ""
+		e.host = host
+		e.joined, e.joinedFrom = &credentials, senderID
+		if e.expiry != nil {
+			e.expiry.Stop()
+		}
+		e.expiry = time.AfterFunc(credentials.Expires.Sub(now), func() { ma.revokeJoined(&credentials) })
+		if candidate, ok := e.candidates[host]; ok {
+			candidate.Hosting = true
+			e.candidates[host] = candidate
+		}
+		var peers []string
+		for peerID := range e.peers {
+			if peerID != senderID && peerID != host {
+				peers = append(peers, peerID)
+			}
+		}
+		callback := e.callback
+		e.mu.Unlock()
+
+		if callback != nil {
+			if decided {
+				callback.OnHotspotElected(host, false)
+			}
+			callback.OnHotspotCredentials(host, credentials.SSID, credentials.Passphrase)
+		}
+		return ma.sendHotspotCredentials(peers, &credentials)
+
+	case "hotspot_revoked":
+		var host string
+		if err := json.Unmarshal(data, &host); err != nil {
+			return fmt.Errorf("invalid hotspot revocation: %w", err)
+		}
+		e.mu.Lock()
+		joined := e.joined
+		// Only the host or whoever passed its credentials to us may revoke them
+		ours := joined != nil && joined.Host == host && (senderID == host || senderID == e.joinedFrom)
+		e.mu.Unlock()
+		if !ours {
+			return nil
+		}
+		return ma.revokeJoined(joined)
+	}
+	return fmt.Errorf("unknown hotspot message type: %s", messageType)
+}
+
+// sendHotspotMessage sends an election message to a BLE peer, sealed if we paired with it
+func (ma *MobileApp) sendHotspotMessage(peerID, messageType string, data interface{}) error {
+	sender := ma.bleProxyHandler.onBLEMessage
+	if sender == nil {
+		return fmt.Errorf("BLE message sender not configured")
+	}
+	payload, err := json.Marshal(&BLEProxyMessage{Type: messageType, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", messageType, err)
+	}
+	sealed, err := ma.sealForPeer(peerID, payload)
+	if err != nil {
+		return err
+	}
+	return sender(peerID, "hotspot", sealed)
+}
@@ -2,6 +2,7 @@ package intermesh
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
 )
 
 // HTTPProxyServer runs a local HTTP proxy that tunnels through BLE
@@ -22,8 +25,12 @@ type HTTPProxyServer struct {
 	mobileApp      *MobileApp
 	activeConns    map[string]net.Conn
 	connMu         sync.RWMutex
-	pendingReqs    map[string]chan *TunnelResponse
-	pendingMu      sync.RWMutex
+	pending        *pendingTable[*TunnelResponse]
+	retries        *retryBudget
+	chunkSizers    map[string]*chunkSizer // Per proxy link
+	chunkMu        sync.Mutex
+	cache          *responseCache
+	tunnels        *mesh.TunnelTable
 	onStatusChange func(running bool, port int)
 }
 
@@ -34,6 +41,12 @@ type TunnelRequest struct {
 	URL     string            `json:"url"`
 	Headers map[string]string `json:"headers"`
 	Body    string            `json:"body"` // Base64 encoded
+	// ChunkSize is the largest response chunk the client wants for TUNNEL data
+	ChunkSize int `json:"chunk_size,omitempty"`
+	// TraceID follows the request through every relay; see mesh.TraceHeader
+	TraceID string `json:"trace_id,omitempty"`
+	// Traceparent is the W3C context of the OpenTelemetry span that sent the request
+	Traceparent string `json:"traceparent,omitempty"`
 }
 
 // TunnelResponse represents a response from the tunnel
@@ -51,7 +64,11 @@ func NewHTTPProxyServer(mobileApp *MobileApp) *HTTPProxyServer {
 	return &HTTPProxyServer{
 		mobileApp:   mobileApp,
 		activeConns: make(map[string]net.Conn),
-		pendingReqs: make(map[string]chan *TunnelResponse),
+		pending:     newPendingTable[*TunnelResponse](maxPendingRequests, pendingRequestTTL),
+		retries:     newRetryBudget(retryBudgetMax, retryBudgetWindow),
+		chunkSizers: make(map[string]*chunkSizer),
+		cache:       newResponseCache(defaultHTTPCacheBytes),
+		tunnels:     mesh.NewTunnelTable(),
 	}
 }
 
@@ -153,7 +170,7 @@ func (p *HTTPProxyServer) acceptConnections() {
 func (p *HTTPProxyServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	connID := fmt.Sprintf("%d", time.Now().UnixNano())
+	connID := mesh.NewSortableID()
 	p.connMu.Lock()
 	p.activeConns[connID] = conn
 	p.connMu.Unlock()
@@ -191,18 +208,27 @@ func (p *HTTPProxyServer) handleHTTPRequest(conn net.Conn, req *http.Request, co
 	}
 
 	// Build full URL
-	url := req.URL.String()
-	if !strings.HasPrefix(url, "http") {
-		url = "http://" + req.Host + url
+	url, err := mesh.RequestURL(req)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("HTTP/1.1 400 Bad Request\r\nContent-Type: text/plain\r\n\r\nProxy Error: %s", err.Error())))
+		return
 	}
 
-	// Create tunnel request
+	// Create tunnel request; the trace starts here
 	tunnelReq := &TunnelRequest{
-		ID:      fmt.Sprintf("%s-%d", connID, time.Now().UnixNano()),
+		ID:      connID + "-" + mesh.NewID(),
 		Method:  req.Method,
 		URL:     url,
 		Headers: make(map[string]string),
 		Body:    base64.StdEncoding.EncodeToString(body),
+		TraceID: mesh.NewTraceID(),
+	}
+	span := p.mobileApp.app.Traces.Start(tunnelReq.TraceID, mesh.TraceHopLocalProxy, url)
+	otelSpan := p.mobileApp.app.Tracer.Start(mesh.SpanContext{}, "local_proxy "+req.Method, mesh.SpanKindClient)
+	otelSpan.SetAttribute("url.full", url)
+	defer otelSpan.End()
+	if otelSpan != nil {
+		tunnelReq.Traceparent = otelSpan.Context().Traceparent()
 	}
 
 	// Copy headers
@@ -212,54 +238,113 @@ func (p *HTTPProxyServer) handleHTTPRequest(conn net.Conn, req *http.Request, co
 		}
 	}
 
+	// Repeat visits are answered from the cache, or revalidated so an unchanged body
+	// doesn't cross the mesh again; other methods may change what the URL returns
+	var cached *cachedResponse
+	revalidating := false
+	if req.Method == http.MethodGet {
+		var fresh bool
+		if cached, fresh = p.cache.lookup(req, url, time.Now()); fresh {
+			span.End(http.StatusOK, "cached")
+			p.writeHTTPResponse(conn, cached.served(req, time.Now()))
+			return
+		}
+		if cached != nil {
+			revalidating = cached.conditionals(tunnelReq)
+		}
+	} else {
+		p.cache.Invalidate(url)
+	}
+
+	// Abort the tunnel request if the browser goes away while we wait
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchClientClose(conn, cancel)
+
 	// Send through BLE and wait for response
-	resp, err := p.sendThroughBLE(tunnelReq)
+	resp, err := p.sendThroughBLE(ctx, tunnelReq)
+	if ctx.Err() != nil {
+		span.End(0, "cancelled by client")
+		return
+	}
 	if err != nil {
+		span.End(http.StatusBadGateway, err.Error())
+		otelSpan.SetError(err)
+
 		// Send error response
 		errorResp := fmt.Sprintf("HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain\r\n\r\nProxy Error: %s", err.Error())
 		conn.Write([]byte(errorResp))
 		return
 	}
 
+	span.End(resp.StatusCode, resp.Error)
+
+	if req.Method == http.MethodGet {
+		switch {
+		case revalidating && resp.StatusCode == http.StatusNotModified:
+			resp = p.cache.revalidated(cached, resp, time.Now())
+		case resp.StatusCode != http.StatusNotModified:
+			if cached != nil {
+				p.cache.miss()
+			}
+			p.cache.store(req, url, resp, time.Now())
+		}
+	}
+
 	// Write response
 	p.writeHTTPResponse(conn, resp)
 }
 
 func (p *HTTPProxyServer) handleConnect(conn net.Conn, req *http.Request, connID string) {
 	// For HTTPS CONNECT, we need to establish a tunnel
+	target, err := mesh.ConnectTarget(req.Host, "443")
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("HTTP/1.1 400 Bad Request\r\nContent-Type: text/plain\r\n\r\nProxy Error: %s", err.Error())))
+		return
+	}
 	// Send 200 OK to client
 	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
 	// Now we need to tunnel all data through BLE
 	// This is more complex - we'll use a simple chunked approach
-	p.tunnelHTTPS(conn, req.Host, connID)
+	p.tunnelHTTPS(conn, target, connID)
 }
 
 func (p *HTTPProxyServer) tunnelHTTPS(clientConn net.Conn, host string, connID string) {
 	// For HTTPS tunneling, we create a persistent connection through BLE
 	// This is challenging due to BLE's packet-based nature
 
-	// Read data from client in chunks and forward through BLE
-	buffer := make([]byte, 32*1024) // 32KB chunks
+	// Read data from client in chunks sized for the current link and forward through BLE.
+	// The whole session is one trace; its chunks aren't traced individually.
+	buffer := make([]byte, maxChunkSize)
+	tunnel := p.tunnels.Open(clientConn.RemoteAddr().String(), host)
+	defer p.tunnels.Close(tunnel)
+	traceID := mesh.NewTraceID()
+	span := p.mobileApp.app.Traces.Start(traceID, mesh.TraceHopLocalProxy, host)
+	defer span.End(http.StatusOK, "")
 
 	for {
 		clientConn.SetReadDeadline(time.Now().Add(30 * time.Second))
-		n, err := clientConn.Read(buffer)
+		n, err := clientConn.Read(buffer[:p.preferredChunkSize()])
 		if err != nil {
 			return
 		}
 
 		if n > 0 {
+			tunnel.AddSent(int64(n))
+
 			// Create tunnel request for raw data
 			tunnelReq := &TunnelRequest{
-				ID:     fmt.Sprintf("%s-%d", connID, time.Now().UnixNano()),
-				Method: "TUNNEL",
-				URL:    host,
-				Body:   base64.StdEncoding.EncodeToString(buffer[:n]),
+				ID:      connID + "-" + mesh.NewID(),
+				Method:  "TUNNEL",
+				URL:     host,
+				Body:    base64.StdEncoding.EncodeToString(buffer[:n]),
+				TraceID: traceID,
 			}
 
-			resp, err := p.sendThroughBLE(tunnelReq)
+			resp, err := p.sendThroughBLE(context.Background(), tunnelReq)
 			if err != nil {
+				span.End(http.StatusBadGateway, err.Error())
 				return
 			}
 
@@ -268,33 +353,24 @@ func (p *HTTPProxyServer) tunnelHTTPS(clientConn net.Conn, host string, connID s
 				data, err := base64.StdEncoding.DecodeString(resp.Body)
 				if err == nil && len(data) > 0 {
 					clientConn.Write(data)
+					tunnel.AddReceived(int64(len(data)))
 				}
 			}
 		}
 	}
 }
 
-func (p *HTTPProxyServer) sendThroughBLE(req *TunnelRequest) (*TunnelResponse, error) {
-	// Create response channel
-	respChan := make(chan *TunnelResponse, 1)
-
-	p.pendingMu.Lock()
-	p.pendingReqs[req.ID] = respChan
-	p.pendingMu.Unlock()
-
-	defer func() {
-		p.pendingMu.Lock()
-		delete(p.pendingReqs, req.ID)
-		p.pendingMu.Unlock()
-	}()
-
-	// Serialize request
-	reqData, err := json.Marshal(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+// watchClientClose calls cancel once the client closes its side of the connection.
+// The connection carries a single request, so any read error means the client is gone.
+func watchClientClose(conn net.Conn, cancel context.CancelFunc) {
+	conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil {
+		cancel()
 	}
+}
 
-	// Send through BLE
+func (p *HTTPProxyServer) sendThroughBLE(ctx context.Context, req *TunnelRequest) (*TunnelResponse, error) {
 	if p.mobileApp.bleProxyHandler.onBLEMessage == nil {
 		return nil, fmt.Errorf("BLE not connected")
 	}
@@ -305,9 +381,74 @@ func (p *HTTPProxyServer) sendThroughBLE(req *TunnelRequest) (*TunnelResponse, e
 		return nil, fmt.Errorf("no proxy available")
 	}
 
-	proxyPeer := proxies[0]
-	err = p.mobileApp.bleProxyHandler.onBLEMessage(proxyPeer.NodeID, "http_tunnel", reqData)
+	// Idempotent requests may be retried through the next proxy on failure
+	attempts := 1
+	if isIdempotentMethod(req.Method) {
+		attempts = len(proxies)
+		if attempts > maxProxyAttempts {
+			attempts = maxProxyAttempts
+		}
+	}
+
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if i > 0 && !p.retries.tryAcquire() {
+			break
+		}
+
+		attemptReq := req
+		if i > 0 {
+			// Fresh ID so a late reply from the previous proxy isn't mistaken for this one
+			retryReq := *req
+			retryReq.ID = fmt.Sprintf("%s-r%d", req.ID, i)
+			attemptReq = &retryReq
+		}
+
+		resp, err := p.sendToProxy(ctx, proxies[i].NodeID, attemptReq)
+		if err == nil {
+			resp.ID = req.ID
+			return resp, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// sendToProxy sends a tunnel request to a specific proxy and waits for its response
+func (p *HTTPProxyServer) sendToProxy(ctx context.Context, proxyID string, req *TunnelRequest) (*TunnelResponse, error) {
+	// Create response channel
+	respChan, err := p.pending.add(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer p.pending.remove(req.ID)
+
+	// Ask for response chunks the link can carry, and measure how this exchange goes
+	sizer := p.linkChunkSizer(proxyID)
+	if req.Method == "TUNNEL" {
+		sized := *req
+		sized.ChunkSize = sizer.Size()
+		req = &sized
+	}
+	start := time.Now()
+
+	// Serialize request
+	reqData, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	reqData, err = p.mobileApp.sealForPeer(proxyID, reqData)
+	if err != nil {
+		return nil, err
+	}
+	err = p.mobileApp.bleProxyHandler.onBLEMessage(proxyID, "http_tunnel", reqData)
 	if err != nil {
+		sizer.Record(0, 0, true)
 		return nil, fmt.Errorf("failed to send BLE message: %w", err)
 	}
 
@@ -315,14 +456,66 @@ func (p *HTTPProxyServer) sendThroughBLE(req *TunnelRequest) (*TunnelResponse, e
 	select {
 	case resp := <-respChan:
 		if resp.Error != "" {
+			sizer.Record(0, 0, true)
 			return nil, fmt.Errorf("%s", resp.Error)
 		}
+		// Empty TUNNEL replies only mean the exit waited for data; they say nothing about the link
+		if resp.Body != "" {
+			sizer.Record(len(req.Body)+len(resp.Body), time.Since(start), false)
+		}
 		return resp, nil
+	case <-ctx.Done():
+		p.sendCancel(proxyID, req.ID)
+		return nil, ctx.Err()
 	case <-time.After(60 * time.Second):
+		sizer.Record(0, 0, true)
+		p.sendCancel(proxyID, req.ID)
 		return nil, fmt.Errorf("request timeout")
 	}
 }
 
+// linkChunkSizer returns the chunk sizer for the link to a proxy
+func (p *HTTPProxyServer) linkChunkSizer(proxyID string) *chunkSizer {
+	p.chunkMu.Lock()
+	defer p.chunkMu.Unlock()
+	sizer, ok := p.chunkSizers[proxyID]
+	if !ok {
+		sizer = newChunkSizer()
+		p.chunkSizers[proxyID] = sizer
+	}
+	return sizer
+}
+
+// preferredChunkSize returns the chunk size for the proxy that would carry the next request
+func (p *HTTPProxyServer) preferredChunkSize() int {
+	proxies := p.mobileApp.app.ProxyManager.GetAvailableProxies()
+	if len(proxies) == 0 {
+		return initialChunkSize
+	}
+	return p.linkChunkSizer(proxies[0].NodeID).Size()
+}
+
+// ChunkSize returns the current tunnel chunk size for the link to a proxy
+func (p *HTTPProxyServer) ChunkSize(proxyID string) int {
+	return p.linkChunkSizer(proxyID).Size()
+}
+
+// sendCancel tells the exit node to abort a tunnel request nobody is waiting for anymore
+func (p *HTTPProxyServer) sendCancel(proxyID, requestID string) {
+	sender := p.mobileApp.bleProxyHandler.onBLEMessage
+	if sender == nil {
+		return
+	}
+	data, err := json.Marshal(&TunnelCancel{ID: requestID})
+	if err != nil {
+		return
+	}
+	if data, err = p.mobileApp.sealForPeer(proxyID, data); err != nil {
+		return
+	}
+	sender(proxyID, tunnelCancelMessageType, data)
+}
+
 // HandleTunnelResponse handles a tunnel response from BLE
 func (p *HTTPProxyServer) HandleTunnelResponse(respJSON string) error {
 	var resp TunnelResponse
@@ -331,18 +524,18 @@ func (p *HTTPProxyServer) HandleTunnelResponse(respJSON string) error {
 		return fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 
-	p.pendingMu.RLock()
-	respChan, ok := p.pendingReqs[resp.ID]
-	p.pendingMu.RUnlock()
+	p.pending.deliver(resp.ID, &resp)
+	return nil
+}
 
-	if ok {
-		select {
-		case respChan <- &resp:
-		default:
-		}
-	}
+// ActiveTunnels returns the HTTPS tunnels local apps have open through the proxy
+func (p *HTTPProxyServer) ActiveTunnels() mesh.TunnelStats {
+	return p.tunnels.Stats(time.Now())
+}
 
-	return nil
+// PendingStats returns statistics about tunnel requests awaiting a response
+func (p *HTTPProxyServer) PendingStats() PendingStats {
+	return p.pending.snapshot()
 }
 
 func (p *HTTPProxyServer) writeHTTPResponse(conn net.Conn, resp *TunnelResponse) {
@@ -366,6 +559,9 @@ func (p *HTTPProxyServer) writeHTTPResponse(conn net.Conn, resp *TunnelResponse)
 	}
 }
 
+// standaloneExitGuard protects tunnels executed without a MobileApp; it has no allowlist
+var standaloneExitGuard = mesh.NewExitGuard()
+
 // ExecuteTunnelRequest executes a tunnel request (for the device with internet)
 func ExecuteTunnelRequest(reqJSON string) (string, error) {
 	var req TunnelRequest
@@ -376,14 +572,16 @@ func ExecuteTunnelRequest(reqJSON string) (string, error) {
 
 	// Handle TUNNEL method for HTTPS
 	if req.Method == "TUNNEL" {
-		return executeTunnelData(&req)
+		return executeTunnelData(&req, standaloneExitGuard)
 	}
 
 	// Execute regular HTTP request
-	return executeHTTPTunnel(&req)
+	return executeHTTPTunnel(context.Background(), &req, standaloneExitGuard, mesh.PrivacyOff)
 }
 
-func executeHTTPTunnel(req *TunnelRequest) (string, error) {
+// executeHTTPTunnel makes a tunneled request on this device's own internet, rewriting its
+// headers for the privacy mode
+func executeHTTPTunnel(ctx context.Context, req *TunnelRequest, guard *mesh.ExitGuard, privacy string) (string, error) {
 	// Decode body
 	var body io.Reader
 	if req.Body != "" {
@@ -394,32 +592,42 @@ func executeHTTPTunnel(req *TunnelRequest) (string, error) {
 	}
 
 	// Create HTTP request
-	httpReq, err := http.NewRequest(req.Method, req.URL, body)
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL, body)
 	if err != nil {
 		return createErrorResponse(req.ID, fmt.Sprintf("Invalid request: %v", err))
 	}
 
-	// Set headers
+	// Set headers; the trace ID stays inside the mesh
 	for key, value := range req.Headers {
 		httpReq.Header.Set(key, value)
 	}
+	httpReq.Header.Del(mesh.TraceHeader)
+	httpReq.Header.Del(mesh.TraceparentKey)
+	mesh.ApplyPrivacy(httpReq.Header, privacy)
 
-	// Execute request
+	// Execute request, never connecting to this device's own networks
 	client := &http.Client{
-		Timeout: 60 * time.Second,
+		Transport: guard.RoundTripper(),
+		Timeout:   60 * time.Second,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse // Don't follow redirects
 		},
 	}
 
 	httpResp, err := client.Do(httpReq)
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("request cancelled: %w", ctx.Err())
+	}
 	if err != nil {
 		return createErrorResponse(req.ID, fmt.Sprintf("Request failed: %v", err))
 	}
 	defer httpResp.Body.Close()
 
-	// Read response body
-	respBody, err := io.ReadAll(httpResp.Body)
+	// Read response body, resuming with a Range request if the transfer breaks
+	respBody, err := readBodyWithResume(ctx, client.Do, httpReq, httpResp)
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("request cancelled: %w", ctx.Err())
+	}
 	if err != nil {
 		return createErrorResponse(req.ID, fmt.Sprintf("Failed to read response: %v", err))
 	}
@@ -452,13 +660,17 @@ func executeHTTPTunnel(req *TunnelRequest) (string, error) {
 var httpsConnections = make(map[string]net.Conn)
 var httpsConnMu sync.RWMutex
 
-func executeTunnelData(req *TunnelRequest) (string, error) {
+func executeTunnelData(req *TunnelRequest, guard *mesh.ExitGuard) (string, error) {
+	if err := guard.CheckHost(req.URL); err != nil {
+		return createErrorResponse(req.ID, fmt.Sprintf("Failed to connect: %v", err))
+	}
+
 	// Get or create connection to target host
 	httpsConnMu.Lock()
 	conn, exists := httpsConnections[req.URL]
 	if !exists || conn == nil {
 		var err error
-		conn, err = net.DialTimeout("tcp", req.URL, 30*time.Second)
+		conn, err = guard.DialContext(context.Background(), "tcp", req.URL)
 		if err != nil {
 			httpsConnMu.Unlock()
 			return createErrorResponse(req.ID, fmt.Sprintf("Failed to connect: %v", err))
@@ -482,9 +694,13 @@ func executeTunnelData(req *TunnelRequest) (string, error) {
 		return createErrorResponse(req.ID, fmt.Sprintf("Failed to send data: %v", err))
 	}
 
-	// Read response with timeout
+	// Read response with timeout, in chunks no bigger than the client's link can carry
 	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-	respBuffer := make([]byte, 64*1024)
+	chunkSize := maxChunkSize
+	if req.ChunkSize > 0 {
+		chunkSize = clampChunkSize(req.ChunkSize)
+	}
+	respBuffer := make([]byte, chunkSize)
 	n, err := conn.Read(respBuffer)
 	if err != nil && err != io.EOF {
 		// May be timeout, which is ok for keep-alive connections
@@ -0,0 +1,340 @@
+package intermesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
+)
+
+func TestSendThroughBLERetriesAlternateProxy(t *testing.T) {
+	app := NewMobileApp("node-C", "Device C", "127.0.0.1", "00:00:00:00:00:03")
+	app.RegisterBLEProxy("proxy-bad", "", "", true)
+	app.RegisterBLEProxy("proxy-good", "", "", true)
+
+	app.SetBLEMessageSender(func(peerID string, messageType string, data []byte) error {
+		if peerID == "proxy-bad" {
+			return fmt.Errorf("link down")
+		}
+		var req TunnelRequest
+		json.Unmarshal(data, &req)
+		go func() {
+			resp, _ := json.Marshal(&TunnelResponse{ID: req.ID, StatusCode: 200, Status: "200 OK"})
+			time.Sleep(10 * time.Millisecond)
+			app.HandleTunnelResponse(string(resp))
+		}()
+		return nil
+	})
+
+	resp, err := app.httpProxy.sendThroughBLE(context.Background(), &TunnelRequest{ID: "req-1", Method: "GET", URL: "http://example.com/"})
+	if err != nil {
+		t.Fatalf("Expected GET to succeed through the alternate proxy, got %v", err)
+	}
+	if resp.ID != "req-1" || resp.StatusCode != 200 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := newRetryBudget(2, time.Minute)
+	if !budget.tryAcquire() || !budget.tryAcquire() {
+		t.Fatal("Expected the first two retries to be allowed")
+	}
+	if budget.tryAcquire() {
+		t.Error("Expected the budget to be exhausted")
+	}
+	if isIdempotentMethod("POST") {
+		t.Error("Expected POST to be non-idempotent")
+	}
+}
+
+func TestPendingTableSweepsOrphans(t *testing.T) {
+	table := newPendingTable[int](2, time.Minute)
+	if _, err := table.add("a"); err != nil {
+		t.Fatalf("Expected add to succeed, got %v", err)
+	}
+	table.add("b")
+	if _, err := table.add("c"); err != ErrTooManyPending {
+		t.Errorf("Expected ErrTooManyPending, got %v", err)
+	}
+
+	if swept := table.sweep(time.Now().Add(2 * time.Minute)); swept != 2 {
+		t.Errorf("Expected 2 orphaned entries to be swept, got %d", swept)
+	}
+	if table.deliver("a", 1) {
+		t.Error("Expected delivery to a swept entry to fail")
+	}
+
+	stats := table.snapshot()
+	if stats.Pending != 0 || stats.Peak != 2 || stats.Orphaned != 2 || stats.Rejected != 1 || stats.LateResponses != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestExecuteProxyRequestRefusesPrivate(t *testing.T) {
+	hits := 0
+	lan := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer lan.Close()
+
+	exit := NewMobileApp("node-A", "Device A", "127.0.0.1", "00:00:00:00:00:01")
+	exit.app.Node.SetInternetStatus(true)
+
+	for _, target := range []string{lan.URL, "http://192.168.1.1/admin"} {
+		reqJSON, _ := json.Marshal(ProxyRequest{RequestID: "req-1", URL: target, Method: "GET"})
+		respJSON, err := exit.bleProxyHandler.ExecuteProxyRequestSync(string(reqJSON))
+		if err != nil {
+			t.Fatalf("Expected a proxy response for %s, got %v", target, err)
+		}
+		var resp ProxyResponse
+		json.Unmarshal([]byte(respJSON), &resp)
+		if resp.Error == "" {
+			t.Errorf("Expected %s to be refused, got status %d", target, resp.StatusCode)
+		}
+	}
+	if hits != 0 {
+		t.Errorf("Expected the local server to never be reached, got %d hits", hits)
+	}
+}
+
+func TestTunnelCancelAbortsUpstream(t *testing.T) {
+	aborted := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer upstream.Close()
+
+	exit := NewMobileApp("node-A", "Device A", "127.0.0.1", "00:00:00:00:00:01")
+	exit.app.Node.SetInternetStatus(true)
+	exit.SetExitAllowlist("127.0.0.1") // The upstream is a local server
+
+	client := NewMobileApp("node-C", "Device C", "127.0.0.1", "00:00:00:00:00:03")
+	client.RegisterBLEProxy("node-A", "", "", true)
+	client.SetBLEMessageSender(func(peerID string, messageType string, data []byte) error {
+		switch messageType {
+		case "http_tunnel":
+			go exit.ExecuteTunnelRequest(string(data))
+		case tunnelCancelMessageType:
+			go exit.HandleTunnelCancel(string(data))
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := client.httpProxy.sendThroughBLE(ctx, &TunnelRequest{ID: "req-1", Method: "GET", URL: upstream.URL})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the exit to abort the upstream request")
+	}
+	if client.httpProxy.PendingStats().Pending != 0 {
+		t.Error("Expected no pending tunnel requests after cancellation")
+	}
+}
+
+func TestTunnelResumesBrokenDownload(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	modTime := time.Unix(1700000000, 0)
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		if requests == 1 {
+			// Send half the body, then drop the connection
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "file", modTime, bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	respJSON, err := executeHTTPTunnel(context.Background(), &TunnelRequest{ID: "req-1", Method: "GET", URL: upstream.URL}, nil, mesh.PrivacyOff)
+	if err != nil {
+		t.Fatalf("Expected tunnel request to succeed, got %v", err)
+	}
+	var resp TunnelResponse
+	json.Unmarshal([]byte(respJSON), &resp)
+	body, _ := base64.StdEncoding.DecodeString(resp.Body)
+	if resp.StatusCode != 200 || !bytes.Equal(body, content) {
+		t.Errorf("Expected the full body to be stitched together, got status %d and %d bytes (%s)", resp.StatusCode, len(body), resp.Error)
+	}
+	if requests != 2 {
+		t.Errorf("Expected one resume request, got %d requests", requests)
+	}
+}
+
+func TestChunkSizerAdapts(t *testing.T) {
+	sizer := newChunkSizer()
+
+	// A fast link grows chunks up to the maximum
+	for i := 0; i < 10; i++ {
+		sizer.Record(sizer.Size(), 10*time.Millisecond, false)
+	}
+	if sizer.Size() != maxChunkSize {
+		t.Errorf("Expected fast link to reach %d byte chunks, got %d", maxChunkSize, sizer.Size())
+	}
+
+	// Failures shrink them down to the minimum
+	for i := 0; i < 10; i++ {
+		sizer.Record(0, 0, true)
+	}
+	if sizer.Size() != minChunkSize {
+		t.Errorf("Expected failing link to drop to %d byte chunks, got %d", minChunkSize, sizer.Size())
+	}
+
+	// A slow link settles on what it can carry within the target latency (~4KB/s here)
+	slow := newChunkSizer()
+	for i := 0; i < 20; i++ {
+		slow.Record(slow.Size(), time.Duration(slow.Size())*time.Second/4096, false)
+	}
+	if slow.Size() > 4*1024 {
+		t.Errorf("Expected slow link to use small chunks, got %d", slow.Size())
+	}
+}
+
+func TestHTTPProxyCachesResponses(t *testing.T) {
+	var mu sync.Mutex
+	fetches, notModified := 0, 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Path == "/fresh" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetches++
+		w.Write([]byte("page " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	exit := NewMobileApp("node-A", "Device A", "127.0.0.1", "00:00:00:00:00:01")
+	exit.app.Node.SetInternetStatus(true)
+	exit.SetExitAllowlist("127.0.0.1") // The upstream is a local server
+
+	client := NewMobileApp("node-C", "Device C", "127.0.0.1", "00:00:00:00:00:03")
+	client.RegisterBLEProxy("node-A", "", "", true)
+	client.SetBLEMessageSender(func(peerID string, messageType string, data []byte) error {
+		go func() {
+			resp, _ := exit.ExecuteTunnelRequest(string(data))
+			client.HandleTunnelResponse(resp)
+		}()
+		return nil
+	})
+	if err := client.StartHTTPProxy(0); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer client.StopHTTPProxy()
+	proxyURL, _ := url.Parse("http://" + client.httpProxy.listener.Addr().String())
+	browser := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+
+	get := func(path string) string {
+		resp, err := browser.Get(upstream.URL + path)
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d", path, resp.StatusCode)
+		}
+		return string(body)
+	}
+
+	// A fresh response is served locally; one that must be revalidated only costs a 304
+	for i := 0; i < 3; i++ {
+		if body := get("/fresh"); body != "page /fresh" {
+			t.Errorf("Unexpected body %q", body)
+		}
+		if body := get("/revalidate"); body != "page /revalidate" {
+			t.Errorf("Unexpected body %q", body)
+		}
+	}
+	mu.Lock()
+	if fetches != 2 || notModified != 2 {
+		t.Errorf("Expected 2 fetches and 2 revalidations upstream, got %d and %d", fetches, notModified)
+	}
+	mu.Unlock()
+
+	var stats HTTPCacheStats
+	json.Unmarshal([]byte(client.GetHTTPCacheStatsJSON()), &stats)
+	if stats.Entries != 2 || stats.Hits != 2 || stats.Revalidated != 2 || stats.Misses != 2 {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+
+	// Clearing the cache, or disabling it, sends visits over the mesh again
+	client.ClearHTTPCache()
+	client.SetHTTPCacheSize(0)
+	get("/fresh")
+	get("/fresh")
+	mu.Lock()
+	if fetches != 4 {
+		t.Errorf("Expected uncached visits to be fetched, got %d fetches", fetches)
+	}
+	mu.Unlock()
+}
+
+func TestRequireEncryptedBLE(t *testing.T) {
+	app := NewMobileApp("node-A", "Device A", "127.0.0.1", "00:00:00:00:00:01")
+	sent := 0
+	app.SetBLEMessageSender(func(peerID string, messageType string, data []byte) error {
+		sent++
+		return nil
+	})
+	request, _ := json.Marshal(&BLEProxyMessage{Type: "cancel", RequestID: "req-1"})
+
+	// Unpaired peers are served in the clear by default
+	if err := app.HandleBLEProxyMessage("node-C", request); err != nil {
+		t.Errorf("Expected a payload in the clear to be accepted, got %v", err)
+	}
+	if _, err := app.RequestInternetThroughBLE("node-C", "http://example.com/", "GET", nil, ""); err != nil || sent != 1 {
+		t.Errorf("Expected the request to go out in the clear, got %v", err)
+	}
+
+	app.SetRequireEncryptedBLE(true)
+	if err := app.HandleBLEProxyMessage("node-C", request); !errors.Is(err, ErrUnsealedPayload) {
+		t.Errorf("Expected a payload in the clear to be refused, got %v", err)
+	}
+	if _, err := app.ExecuteTunnelRequest(`{"id":"req-2","method":"GET","url":"http://example.com/"}`); !errors.Is(err, ErrUnsealedPayload) {
+		t.Errorf("Expected a tunnel request in the clear to be refused, got %v", err)
+	}
+	if _, err := app.RequestInternetThroughBLE("node-C", "http://example.com/", "GET", nil, ""); !errors.Is(err, mesh.ErrNotPaired) || sent != 1 {
+		t.Errorf("Expected nothing to be sent to an unpaired peer, got %v", err)
+	}
+	forged := []byte(`{"sealed_from":"node-C","sealed_to":"node-A","sealed":"AAAA"}`)
+	if err := app.HandleBLEProxyMessage("node-C", forged); !errors.Is(err, mesh.ErrNotPaired) {
+		t.Errorf("Expected a payload from an unpaired peer to be refused, got %v", err)
+	}
+}
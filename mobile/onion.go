@@ -0,0 +1,161 @@
+package intermesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
+)
+
+// Onion requests hide a proxy request from the relays carrying it: the client wraps it in
+// a layer per hop, each peels its own and passes the rest on, and only the exit reads
+// the request and the response. Over BLE the client sends an "onion" message to the first
+// hop, which answers with "onion_response", or "onion_error" when the path broke.
+
+// onionKeyTimeout bounds asking our mesh proxy for its onion key
+const onionKeyTimeout = 5 * time.Second
+
+// GetOnionKey returns our onion key as JSON, for clients building paths through us
+func (ma *MobileApp) GetOnionKey() (string, error) {
+	data, err := json.Marshal(ma.app.OnionKey())
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// GetOnionPath returns the onion path through us to our mesh proxy, as the JSON array of
+// both onion keys that RequestInternetThroughOnion takes
+func (ma *MobileApp) GetOnionPath() (string, error) {
+	proxyPeerID := ma.app.InternetClient.ProxyPeerID()
+	if proxyPeerID == "" {
+		return "", fmt.Errorf("not connected to a mesh proxy")
+	}
+	exit, err := ma.app.FetchOnionKey(proxyPeerID, onionKeyTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the onion key of %s: %w", proxyPeerID, err)
+	}
+	data, err := json.Marshal([]*mesh.OnionKey{ma.app.OnionKey(), exit})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// RequestInternetThroughOnion sends a request through the hops of an onion path, the exit
+// last, so that none of the relays can read it; AwaitProxyResponse returns the response
+func (ma *MobileApp) RequestInternetThroughOnion(pathJSON, url, method string, headers map[string]string, body string) (string, error) {
+	return ma.bleProxyHandler.SendOnionRequest(pathJSON, url, method, headers, []byte(body))
+}
+
+// SendOnionRequest wraps a proxy request for an onion path and sends it to the first hop
+func (h *BLEProxyHandler) SendOnionRequest(pathJSON, url, method string, headers map[string]string, body []byte) (string, error) {
+	if h.onBLEMessage == nil {
+		return "", fmt.Errorf("BLE message sender not configured")
+	}
+	var path []*mesh.OnionKey
+	if err := json.Unmarshal([]byte(pathJSON), &path); err != nil || len(path) == 0 {
+		return "", fmt.Errorf("invalid onion path: %v", err)
+	}
+
+	requestID := h.nodeID + "-" + mesh.NewSortableID()
+	payload, err := json.Marshal(&ProxyRequest{
+		RequestID: requestID,
+		ClientID:  h.nodeID,
+		URL:       url,
+		Method:    method,
+		Headers:   headers,
+		Body:      body,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+	onion, circuit, err := mesh.BuildOnion(path, payload)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&BLEProxyMessage{Type: "onion", RequestID: requestID, Data: onion})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal onion: %w", err)
+	}
+
+	// Register before sending so a fast response isn't lost; unclaimed entries expire
+	if _, err := h.pendingResponses.add(requestID); err != nil {
+		return "", err
+	}
+	h.requestsMu.Lock()
+	h.circuits[requestID] = circuit
+	h.requestsMu.Unlock()
+	if err := h.send(path[0].NodeID, data); err != nil {
+		h.takeCircuit(requestID)
+		h.pendingResponses.remove(requestID)
+		return "", fmt.Errorf("failed to send BLE message: %w", err)
+	}
+	return requestID, nil
+}
+
+// takeCircuit returns and forgets the circuit of an onion request we sent, or nil
+func (h *BLEProxyHandler) takeCircuit(requestID string) *mesh.OnionCircuit {
+	h.requestsMu.Lock()
+	defer h.requestsMu.Unlock()
+	circuit := h.circuits[requestID]
+	delete(h.circuits, requestID)
+	return circuit
+}
+
+// handleOnionResponse opens the reply to an onion request we sent
+func (h *BLEProxyHandler) handleOnionResponse(requestID string, reply []byte) error {
+	circuit := h.takeCircuit(requestID)
+	if circuit == nil {
+		return fmt.Errorf("unknown onion request: %s", requestID)
+	}
+	data, err := circuit.OpenReply(reply)
+	if err != nil {
+		return fmt.Errorf("failed to open onion response: %w", err)
+	}
+	var response ProxyResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return fmt.Errorf("failed to unmarshal proxy response: %w", err)
+	}
+	h.pendingResponses.deliver(requestID, &response)
+	return nil
+}
+
+// relayOnion carries an onion a BLE client sent us along its path and sends back the reply
+func (h *BLEProxyHandler) relayOnion(clientID, requestID string, onion []byte) {
+	message := &BLEProxyMessage{Type: "onion_response", RequestID: requestID}
+	reply, err := h.mobileApp.app.RelayOnion(clientID, onion)
+	if err != nil {
+		message.Type, message.Data = "onion_error", err.Error()
+	} else {
+		message.Data = reply
+	}
+	if h.onBLEMessage == nil {
+		return
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	h.send(clientID, data)
+}
+
+// serveOnion serves an onion request that ends with us on our own internet
+func (h *BLEProxyHandler) serveOnion(fromPeer string, payload []byte) ([]byte, error) {
+	if !h.mobileApp.HasInternet() {
+		return nil, fmt.Errorf("no internet access")
+	}
+	var request ProxyRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, fmt.Errorf("invalid onion request: %w", err)
+	}
+	ctx, done := h.inflight.register(request.RequestID)
+	defer done()
+	response, err := h.fetch(ctx, &request)
+	if err != nil {
+		response = errorResponse(request.RequestID, err.Error())
+	}
+	return json.Marshal(response)
+}
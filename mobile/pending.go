@@ -0,0 +1,131 @@
+package intermesh
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPendingRequests caps each table of requests awaiting a response
+	maxPendingRequests = 256
+	// pendingRequestTTL is how long an entry may wait before it is swept as orphaned
+	pendingRequestTTL = 2 * time.Minute
+)
+
+// ErrTooManyPending is returned when a pending table is full even after sweeping
+var ErrTooManyPending = errors.New("too many pending requests")
+
+// PendingStats reports the state of a pending request table
+type PendingStats struct {
+	Pending       int    `json:"pending"`        // Entries currently waiting
+	Peak          int    `json:"peak"`           // Highest number of entries seen at once
+	Orphaned      uint64 `json:"orphaned"`       // Entries swept after their TTL expired
+	Rejected      uint64 `json:"rejected"`       // Adds refused because the table was full
+	LateResponses uint64 `json:"late_responses"` // Responses that arrived with nobody waiting
+}
+
+type pendingEntry[T any] struct {
+	ch      chan T
+	created time.Time
+}
+
+// pendingTable tracks requests awaiting a response. It is bounded and sweeps
+// entries older than its TTL, so lost responses can't grow it without limit.
+type pendingTable[T any] struct {
+	entries map[string]*pendingEntry[T]
+	max     int
+	ttl     time.Duration
+	stats   PendingStats
+	mu      sync.Mutex
+}
+
+func newPendingTable[T any](max int, ttl time.Duration) *pendingTable[T] {
+	return &pendingTable[T]{
+		entries: make(map[string]*pendingEntry[T]),
+		max:     max,
+		ttl:     ttl,
+	}
+}
+
+// add registers a request and returns the channel its response will be delivered on
+func (t *pendingTable[T]) add(id string) (chan T, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweepLocked(time.Now())
+	if len(t.entries) >= t.max {
+		t.stats.Rejected++
+		return nil, ErrTooManyPending
+	}
+
+	ch := make(chan T, 1)
+	t.entries[id] = &pendingEntry[T]{ch: ch, created: time.Now()}
+	if len(t.entries) > t.stats.Peak {
+		t.stats.Peak = len(t.entries)
+	}
+	return ch, nil
+}
+
+// deliver hands a response to its waiter without blocking
+func (t *pendingTable[T]) deliver(id string, value T) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[id]
+	if !ok {
+		t.stats.LateResponses++
+		return false
+	}
+	select {
+	case entry.ch <- value:
+	default:
+	}
+	return true
+}
+
+// channel returns the response channel of a registered request
+func (t *pendingTable[T]) channel(id string) (chan T, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[id]
+	if !ok {
+		return nil, false
+	}
+	return entry.ch, true
+}
+
+// remove drops a request once its waiter is done with it
+func (t *pendingTable[T]) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, id)
+}
+
+// sweep drops expired entries and returns how many were removed
+func (t *pendingTable[T]) sweep(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sweepLocked(now)
+}
+
+func (t *pendingTable[T]) sweepLocked(now time.Time) int {
+	swept := 0
+	for id, entry := range t.entries {
+		if now.Sub(entry.created) > t.ttl {
+			delete(t.entries, id)
+			swept++
+		}
+	}
+	t.stats.Orphaned += uint64(swept)
+	return swept
+}
+
+// snapshot returns the table's current statistics
+func (t *pendingTable[T]) snapshot() PendingStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := t.stats
+	stats.Pending = len(t.entries)
+	return stats
+}
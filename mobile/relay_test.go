@@ -6,6 +6,9 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -28,6 +31,9 @@ func TestBLERelayIntegration(t *testing.T) {
 
 	// 3. Setup Node B (The Relay)
 	appB := NewMobileApp("node-B", "Device B", "127.0.0.1", "00:00:00:00:00:02")
+	// The test's internet is a local server, which exits refuse unless allowlisted
+	appA.SetExitAllowlist("127.0.0.1")
+	appB.SetExitAllowlist("127.0.0.1")
 	appB.app.Start()
 	defer appB.Stop()
 
@@ -123,3 +129,301 @@ func TestBLERelayIntegration(t *testing.T) {
 		t.Errorf("Expected status 200, got %d", proxyResp.StatusCode)
 	}
 }
+
+// TestBLEOnionRelay tests a request from BLE client C through relay B to exit A that B
+// carries without being able to read it or the response
+func TestBLEOnionRelay(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello from Internet "+r.URL.Path)
+	}))
+	defer ts.Close()
+
+	// A and B link over the mesh on ports of their own
+	appA := NewMobileApp("node-A", "Device A", "127.0.0.1", "00:00:00:00:00:01")
+	appA.app.Node.SetInternetStatus(true)
+	appA.SetExitAllowlist("127.0.0.1")
+	appA.app.Transport = mesh.NewTransport("node-A", 0)
+	appA.app.Start()
+	defer appA.Stop()
+	appB := NewMobileApp("node-B", "Device B", "127.0.0.1", "00:00:00:00:00:02")
+	appB.app.Transport = mesh.NewTransport("node-B", 0)
+	appB.app.Start()
+	defer appB.Stop()
+	_, port, _ := net.SplitHostPort(appA.app.Transport.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := appB.app.Transport.ConnectToPeer("node-A", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect relay to exit: %v", err)
+	}
+	appB.app.InternetClient.ConnectToProxy("node-A", "127.0.0.1", 9997)
+	appA.app.InternetProxy.AuthorizeClient("node-B")
+	appC := NewMobileApp("node-C", "Device C", "127.0.0.1", "00:00:00:00:00:03")
+
+	path, err := appB.GetOnionPath()
+	if err != nil {
+		t.Fatalf("GetOnionPath failed: %v", err)
+	}
+
+	// C and B talk over simulated BLE; everything B sees is recorded
+	var seen [][]byte
+	var seenMu sync.Mutex
+	record := func(data []byte) {
+		seenMu.Lock()
+		seen = append(seen, data)
+		seenMu.Unlock()
+	}
+	appC.SetBLEMessageSender(func(peerID, messageType string, data []byte) error {
+		record(data)
+		return appB.HandleBLEProxyMessage("node-C", data)
+	})
+	appB.SetBLEMessageSender(func(peerID, messageType string, data []byte) error {
+		record(data)
+		go appC.HandleBLEProxyMessage("node-B", data)
+		return nil
+	})
+
+	requestID, err := appC.RequestInternetThroughOnion(path, ts.URL+"/secret-path", "GET", nil, "")
+	if err != nil {
+		t.Fatalf("RequestInternetThroughOnion failed: %v", err)
+	}
+	responseJSON, err := appC.AwaitProxyResponse(requestID, 5000)
+	if err != nil {
+		t.Fatalf("AwaitProxyResponse failed: %v", err)
+	}
+	var response ProxyResponse
+	json.Unmarshal([]byte(responseJSON), &response)
+	if response.StatusCode != 200 || string(response.Body) != "Hello from Internet /secret-path" {
+		t.Errorf("Expected the exit's response, got %d %q", response.StatusCode, response.Body)
+	}
+	seenMu.Lock()
+	defer seenMu.Unlock()
+	for _, data := range seen {
+		if strings.Contains(string(data), "secret-path") || strings.Contains(string(data), "Hello") {
+			t.Errorf("Expected the relay to see neither request nor response, got %s", data)
+		}
+	}
+}
+
+type hotspotRecorder struct {
+	app         *MobileApp
+	elected     chan string
+	credentials chan string
+	revoked     chan string
+}
+
+func newHotspotRecorder(app *MobileApp) *hotspotRecorder {
+	return &hotspotRecorder{app: app, elected: make(chan string, 4), credentials: make(chan string, 4), revoked: make(chan string, 4)}
+}
+
+func (r *hotspotRecorder) OnHotspotElected(hostID string, self bool) {
+	r.elected <- hostID
+	if self {
+		r.app.HotspotStarted("InterMesh-"+hostID, "passphrase")
+	}
+}
+
+func (r *hotspotRecorder) OnHotspotCredentials(hostID, ssid, passphrase string) {
+	r.credentials <- ssid
+}
+
+func (r *hotspotRecorder) OnHotspotRevoked(hostID string) {
+	r.revoked <- hostID
+}
+
+// joinHomeMesh starts a device on a mesh port of its own, in the "home" network, so the
+// hotspot credentials it is paired for can reach it
+func joinHomeMesh(t *testing.T, app *MobileApp) {
+	app.app.Transport = mesh.NewTransport(app.app.Node.ID, 0)
+	app.app.Start()
+	t.Cleanup(app.Stop)
+	home := app.app.PersonalNetworkMgr.CreateNetwork("home", "Home", "node-a")
+	for _, member := range []string{"node-a", "node-b", "node-c", "node-d"} {
+		home.AddMember(&mesh.NetworkMember{NodeID: member})
+	}
+}
+
+// newHotspotApp creates a device in the home mesh with the given hotspot status
+func newHotspotApp(t *testing.T, id, status string) *MobileApp {
+	app := NewMobileApp(id, id, "127.0.0.1", "")
+	joinHomeMesh(t, app)
+	app.hotspot.window = 50 * time.Millisecond
+	if err := app.SetHotspotStatus(status); err != nil {
+		t.Fatalf("SetHotspotStatus failed: %v", err)
+	}
+	return app
+}
+
+// pairHotspotApps pairs two devices over the mesh, as if both users confirmed the code
+func pairHotspotApps(t *testing.T, a, b *MobileApp) {
+	_, port, _ := net.SplitHostPort(a.app.Transport.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := b.app.Transport.ConnectToPeer(a.app.Node.ID, "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect %s to %s: %v", b.app.Node.ID, a.app.Node.ID, err)
+	}
+	if err := b.StartPairing(a.app.Node.ID); err != nil {
+		t.Fatalf("StartPairing failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, aReady := a.app.Pairing.Code(b.app.Node.ID)
+		_, bReady := b.app.Pairing.Code(a.app.Node.ID)
+		if aReady && bReady {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s and %s to agree on a pairing code", a.app.Node.ID, b.app.Node.ID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := a.ConfirmPairing(b.app.Node.ID, true); err != nil {
+		t.Fatalf("ConfirmPairing failed: %v", err)
+	}
+	if err := b.ConfirmPairing(a.app.Node.ID, true); err != nil {
+		t.Fatalf("ConfirmPairing failed: %v", err)
+	}
+}
+
+func TestHotspotElection(t *testing.T) {
+	apps := make(map[string]*MobileApp)
+	recorders := make(map[string]*hotspotRecorder)
+	statuses := map[string]string{
+		"node-a": `{"can_host":true,"battery":90}`,
+		"node-b": `{"can_host":true,"battery":40,"charging":true}`,
+		"node-c": `{"can_host":false,"battery":100,"charging":true}`,
+	}
+	for id, status := range statuses {
+		app := NewMobileApp(id, id, "127.0.0.1", "")
+		joinHomeMesh(t, app)
+		app.hotspot.window = 50 * time.Millisecond
+		if err := app.SetHotspotStatus(status); err != nil {
+			t.Fatalf("SetHotspotStatus failed: %v", err)
+		}
+		recorder := &hotspotRecorder{app: app, elected: make(chan string, 4), credentials: make(chan string, 4)}
+		app.SetHotspotCallback(recorder)
+		apps[id], recorders[id] = app, recorder
+	}
+	pairHotspotApps(t, apps["node-a"], apps["node-b"])
+	pairHotspotApps(t, apps["node-a"], apps["node-c"])
+	for id, app := range apps {
+		from := id
+		app.SetBLEMessageSender(func(peerID, messageType string, data []byte) error {
+			if messageType != "hotspot" {
+				t.Errorf("Expected hotspot messages, got %s", messageType)
+			}
+			return apps[peerID].HandleBLEProxyMessage(from, data)
+		})
+	}
+
+	// node-a starts the election; the others join in when its candidacy arrives
+	if err := apps["node-a"].StartHotspotElection("node-b, node-c"); err != nil {
+		t.Fatalf("StartHotspotElection failed: %v", err)
+	}
+	for id, recorder := range recorders {
+		select {
+		case host := <-recorder.elected:
+			if host != "node-b" {
+				t.Errorf("Expected %s to elect the plugged-in node-b, got %s", id, host)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %s to decide the election", id)
+		}
+	}
+	for _, id := range []string{"node-a", "node-c"} {
+		select {
+		case ssid := <-recorders[id].credentials:
+			if ssid != "InterMesh-node-b" {
+				t.Errorf("Expected %s to get node-b's hotspot, got %s", id, ssid)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %s to get the hotspot credentials", id)
+		}
+	}
+
+	// A device arriving later joins the hotspot already up instead of electing again
+	late := NewMobileApp("node-d", "node-d", "127.0.0.1", "")
+	joinHomeMesh(t, late)
+	pairHotspotApps(t, apps["node-b"], late)
+	late.hotspot.window = 50 * time.Millisecond
+	late.SetHotspotStatus(`{"can_host":true,"battery":100,"charging":true}`)
+	lateRecorder := &hotspotRecorder{app: late, elected: make(chan string, 4), credentials: make(chan string, 4)}
+	late.SetHotspotCallback(lateRecorder)
+	apps["node-d"] = late
+	late.SetBLEMessageSender(func(peerID, messageType string, data []byte) error {
+		return apps[peerID].HandleBLEProxyMessage("node-d", data)
+	})
+	apps["node-b"].SetBLEMessageSender(func(peerID, messageType string, data []byte) error {
+		return apps[peerID].HandleBLEProxyMessage("node-b", data)
+	})
+	if err := late.StartHotspotElection("node-b"); err != nil {
+		t.Fatalf("StartHotspotElection failed: %v", err)
+	}
+	select {
+	case ssid := <-lateRecorder.credentials:
+		if ssid != "InterMesh-node-b" {
+			t.Errorf("Expected the late device to join node-b's hotspot, got %s", ssid)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the late device to get the hotspot credentials")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if host := late.GetHotspotHost(); host != "node-b" {
+		t.Errorf("Expected the hotspot to stay with node-b, got %s", host)
+	}
+	select {
+	case host := <-recorders["node-b"].elected:
+		t.Errorf("Expected no new election on node-b, got %s", host)
+	default:
+	}
+}
+
+// TestHotspotCredentials tests that hotspot credentials only reach paired members of a
+// shared network, and are revoked when the hotspot stops
+func TestHotspotCredentials(t *testing.T) {
+	apps := map[string]*MobileApp{
+		"node-a": newHotspotApp(t, "node-a", `{"can_host":true,"battery":90}`),
+		"node-b": newHotspotApp(t, "node-b", `{"can_host":true,"battery":40,"charging":true}`),
+		"node-e": newHotspotApp(t, "node-e", `{"can_host":false,"battery":100,"charging":true}`),
+	}
+	recorders := make(map[string]*hotspotRecorder)
+	for id, app := range apps {
+		from := id
+		recorders[id] = newHotspotRecorder(app)
+		app.SetHotspotCallback(recorders[id])
+		app.SetBLEMessageSender(func(peerID, messageType string, data []byte) error {
+			return apps[peerID].HandleBLEProxyMessage(from, data)
+		})
+	}
+	pairHotspotApps(t, apps["node-a"], apps["node-b"])
+
+	if err := apps["node-a"].StartHotspotElection("node-b, node-e"); err != nil {
+		t.Fatalf("StartHotspotElection failed: %v", err)
+	}
+	select {
+	case ssid := <-recorders["node-a"].credentials:
+		if ssid != "InterMesh-node-b" {
+			t.Errorf("Expected node-a to get node-b's hotspot, got %s", ssid)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected node-a to get the hotspot credentials")
+	}
+
+	// A device nobody paired with learns of the election but not the passphrase
+	time.Sleep(150 * time.Millisecond)
+	select {
+	case ssid := <-recorders["node-e"].credentials:
+		t.Errorf("Expected no credentials for an unpaired device, got %s", ssid)
+	default:
+	}
+
+	// Once the hotspot goes down, everyone who got its credentials forgets them
+	if err := apps["node-b"].HotspotStopped(); err != nil {
+		t.Fatalf("HotspotStopped failed: %v", err)
+	}
+	select {
+	case host := <-recorders["node-a"].revoked:
+		if host != "node-b" {
+			t.Errorf("Expected node-a to forget node-b's hotspot, got %s", host)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected node-a to forget the hotspot credentials")
+	}
+}
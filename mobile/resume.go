@@ -0,0 +1,77 @@
+package intermesh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxResumeAttempts limits how often a broken download is resumed before giving up
+const maxResumeAttempts = 3
+
+// readBodyWithResume reads the body of resp. If the transfer dies mid-body and the server
+// advertised byte ranges, the remainder is re-requested from the last received byte with
+// do and appended, so the caller sees one complete body.
+func readBodyWithResume(ctx context.Context, do func(*http.Request) (*http.Response, error), req *http.Request, resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err == nil || !canResume(req, resp) {
+		return body, err
+	}
+
+	for attempt := 0; attempt < maxResumeAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return body, ctx.Err()
+		}
+		var rest []byte
+		rest, err = fetchRemainder(ctx, do, req, resp, int64(len(body)))
+		body = append(body, rest...)
+		if err == nil {
+			return body, nil
+		}
+	}
+	return body, err
+}
+
+// canResume reports whether a broken response may be completed with a Range request.
+// A validator is required so the pieces are known to come from the same representation.
+func canResume(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return false
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return false
+	}
+	return resumeValidator(resp) != ""
+}
+
+// resumeValidator returns the value for an If-Range header, preferring a strong ETag
+func resumeValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// fetchRemainder requests the body from offset onwards and returns whatever it received
+func fetchRemainder(ctx context.Context, do func(*http.Request) (*http.Response, error), req *http.Request, orig *http.Response, offset int64) ([]byte, error) {
+	rangeReq := req.Clone(ctx)
+	rangeReq.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	rangeReq.Header.Set("If-Range", resumeValidator(orig))
+
+	resp, err := do(rangeReq)
+	if err != nil {
+		return nil, fmt.Errorf("resume failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// A 200 means the resource changed (If-Range mismatch) or ranges were ignored
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("resume refused: %s", resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+		return nil, fmt.Errorf("resume returned unexpected range %q", resp.Header.Get("Content-Range"))
+	}
+	return io.ReadAll(resp.Body)
+}
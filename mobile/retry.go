@@ -0,0 +1,57 @@
+package intermesh
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxProxyAttempts caps how many proxies a single request is tried against
+	maxProxyAttempts = 3
+	// Retry budget shared by all requests of the local proxy
+	retryBudgetMax    = 10
+	retryBudgetWindow = 30 * time.Second
+)
+
+// retryBudget limits how many retries may be spent within a time window,
+// so a failing mesh doesn't turn every request into a burst of retries
+type retryBudget struct {
+	max    int
+	window time.Duration
+	spent  []time.Time
+	mu     sync.Mutex
+}
+
+func newRetryBudget(max int, window time.Duration) *retryBudget {
+	return &retryBudget{
+		max:    max,
+		window: window,
+	}
+}
+
+// tryAcquire spends one retry if the budget allows it
+func (b *retryBudget) tryAcquire() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	kept := b.spent[:0]
+	for _, t := range b.spent {
+		if now.Sub(t) < b.window {
+			kept = append(kept, t)
+		}
+	}
+	b.spent = kept
+
+	if len(b.spent) >= b.max {
+		return false
+	}
+	b.spent = append(b.spent, now)
+	return true
+}
+
+// isIdempotentMethod returns whether a request can safely be replayed on another proxy
+func isIdempotentMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
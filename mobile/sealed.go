@@ -0,0 +1,64 @@
+package intermesh
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
+)
+
+// Proxy requests and responses the platform carries over BLE ("internet_proxy",
+// "http_tunnel" and their cancels and replies) are sealed for the peer at the other end
+// when we have paired with it, so BLE sniffers can't read URLs, headers or bodies.
+// Payloads for unpaired peers go in the clear unless encryption is required.
+
+// ErrUnsealedPayload is returned for BLE proxy payloads in the clear once encryption is required
+var ErrUnsealedPayload = errors.New("BLE proxy payload is not encrypted")
+
+// SetRequireEncryptedBLE refuses to send BLE proxy payloads to peers we haven't paired
+// with, and to accept payloads that weren't sealed by a paired peer
+func (ma *MobileApp) SetRequireEncryptedBLE(require bool) {
+	ma.requireSealed.Store(require)
+}
+
+// sealForPeer seals a BLE proxy payload for a peer, leaving it in the clear for unpaired
+// peers unless encryption is required
+func (ma *MobileApp) sealForPeer(peerID string, data []byte) ([]byte, error) {
+	sealed, err := ma.app.SealForPeer(peerID, data)
+	if errors.Is(err, mesh.ErrNotPaired) && !ma.requireSealed.Load() {
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal payload for %s: %w", peerID, err)
+	}
+	return sealed, nil
+}
+
+// openPayload returns a BLE proxy payload's content and the paired peer that sealed it,
+// or "" for a payload that came in the clear
+func (ma *MobileApp) openPayload(data []byte) ([]byte, string, error) {
+	if !mesh.IsSealedPayload(data) {
+		if ma.requireSealed.Load() {
+			return nil, "", ErrUnsealedPayload
+		}
+		return data, "", nil
+	}
+	from, plaintext, err := ma.app.OpenFromPeer(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open payload: %w", err)
+	}
+	return plaintext, from, nil
+}
+
+// sealReply seals the reply to a payload for the peer that sealed it; replies to
+// payloads in the clear stay in the clear
+func (ma *MobileApp) sealReply(from, reply string) (string, error) {
+	if from == "" {
+		return reply, nil
+	}
+	sealed, err := ma.app.SealForPeer(from, []byte(reply))
+	if err != nil {
+		return "", fmt.Errorf("failed to seal reply for %s: %w", from, err)
+	}
+	return string(sealed), nil
+}
@@ -0,0 +1,87 @@
+package intermesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/kiyotaka-koji-0/intermesh/pkg/mesh"
+)
+
+// Wi-Fi Aware (NAN) gives supported Android devices direct Wi-Fi links without an access
+// point, much faster than BLE. The app publishes and subscribes to WifiAwareServiceName
+// with WifiAwareServiceInfo as the service specific info. When it matches a peer, the
+// side WifiAwareShouldInitiate picks requests the data path; once the link is up, both
+// sides report the peer's IPv6 address with WifiAwareLinkUp and the mesh runs over it.
+
+// WifiAwareServiceName is the service InterMesh nodes publish and subscribe to
+const WifiAwareServiceName = "intermesh"
+
+// wifiAwareServiceInfo is exchanged at discovery; it has to fit the 255 bytes of
+// service specific info every Wi-Fi Aware device supports
+type wifiAwareServiceInfo struct {
+	ID   string `json:"id"`
+	Port int    `json:"port"`
+}
+
+func parseWifiAwareServiceInfo(serviceInfo []byte) (*wifiAwareServiceInfo, error) {
+	var info wifiAwareServiceInfo
+	if err := json.Unmarshal(serviceInfo, &info); err != nil {
+		return nil, fmt.Errorf("invalid Wi-Fi Aware service info: %w", err)
+	}
+	if info.ID == "" || info.Port <= 0 || info.Port > 65535 {
+		return nil, fmt.Errorf("invalid Wi-Fi Aware service info: missing node ID or port")
+	}
+	return &info, nil
+}
+
+// WifiAwareServiceInfo returns the service specific info to publish and subscribe with
+func (ma *MobileApp) WifiAwareServiceInfo() []byte {
+	port := mesh.DefaultPort
+	if _, p, err := net.SplitHostPort(ma.app.Transport.ListenAddr()); err == nil {
+		port, _ = strconv.Atoi(p)
+	}
+	data, _ := json.Marshal(&wifiAwareServiceInfo{ID: ma.app.Node.ID, Port: port})
+	return data
+}
+
+// WifiAwarePeerID returns the node ID in a peer's service specific info, or "" if it
+// isn't an InterMesh node
+func (ma *MobileApp) WifiAwarePeerID(serviceInfo []byte) string {
+	info, err := parseWifiAwareServiceInfo(serviceInfo)
+	if err != nil {
+		return ""
+	}
+	return info.ID
+}
+
+// WifiAwareShouldInitiate reports whether we request the data path to a matched peer.
+// Both sides publish and subscribe, so only the one with the lower node ID initiates.
+func (ma *MobileApp) WifiAwareShouldInitiate(serviceInfo []byte) bool {
+	info, err := parseWifiAwareServiceInfo(serviceInfo)
+	return err == nil && ma.app.Node.ID < info.ID
+}
+
+// WifiAwareLinkUp reports a data path to a peer, with the peer's service specific info,
+// its IPv6 address and the name of the Aware network interface
+func (ma *MobileApp) WifiAwareLinkUp(serviceInfo []byte, peerIPv6, iface string) error {
+	info, err := parseWifiAwareServiceInfo(serviceInfo)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(peerIPv6)
+	if ip == nil {
+		return fmt.Errorf("invalid peer address %q", peerIPv6)
+	}
+	addr := ip.String()
+	if iface != "" && ip.IsLinkLocalUnicast() {
+		addr += "%" + iface
+	}
+	return ma.app.AddLinkPeer(mesh.LinkWifiAware, info.ID, addr, info.Port)
+}
+
+// WifiAwareLinkDown reports that the data path to a peer was lost
+func (ma *MobileApp) WifiAwareLinkDown(peerID string) {
+	ma.app.RemoveLinkPeer(peerID)
+}
@@ -0,0 +1,38 @@
+// Package gateway provides router-side integration for running an InterMesh node
+// as a network gateway (e.g. on OpenWrt): kernel route manipulation and NAT setup.
+//
+// The implementation is Linux-only and excluded from Android builds, so gomobile
+// binaries never link it; on other platforms every operation returns ErrUnsupported.
+package gateway
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrUnsupported is returned on platforms without gateway support
+var ErrUnsupported = errors.New("gateway mode is not supported on this platform")
+
+// Route is a kernel routing table entry
+type Route struct {
+	Dst       *net.IPNet // nil means the default route
+	Gateway   net.IP     // nil for directly connected routes
+	Interface string
+	Metric    int
+}
+
+// NATConfig describes how mesh clients on the LAN side are masqueraded to the WAN uplink
+type NATConfig struct {
+	LANInterface string // interface mesh clients are reached through, e.g. "br-lan"
+	WANInterface string // uplink interface, e.g. "eth0.2" or "wwan0"
+}
+
+func (c NATConfig) validate() error {
+	if c.LANInterface == "" || c.WANInterface == "" {
+		return errors.New("both LAN and WAN interfaces are required")
+	}
+	if c.LANInterface == c.WANInterface {
+		return errors.New("LAN and WAN interfaces must differ")
+	}
+	return nil
+}
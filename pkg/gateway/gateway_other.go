@@ -0,0 +1,23 @@
+//go:build !linux || android
+
+package gateway
+
+// AddRoute is not supported on this platform
+func AddRoute(route Route) error {
+	return ErrUnsupported
+}
+
+// DeleteRoute is not supported on this platform
+func DeleteRoute(route Route) error {
+	return ErrUnsupported
+}
+
+// EnableNAT is not supported on this platform
+func EnableNAT(cfg NATConfig) error {
+	return ErrUnsupported
+}
+
+// DisableNAT is not supported on this platform
+func DisableNAT(cfg NATConfig) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,77 @@
+//go:build linux && !android
+
+package gateway
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// EnableNAT turns on IPv4 forwarding and masquerades traffic from the LAN out of the WAN.
+// Rules are checked before insertion, so calling it repeatedly is safe.
+func EnableNAT(cfg NATConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if err := os.WriteFile(ipForwardPath, []byte("1\n"), 0644); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding: %w", err)
+	}
+	for _, rule := range natRules(cfg) {
+		if rule.run("-C") == nil {
+			continue // already present
+		}
+		if err := rule.run("-A"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DisableNAT removes the rules added by EnableNAT; IP forwarding is left as is
+// because other services on a router may depend on it
+func DisableNAT(cfg NATConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	var firstErr error
+	for _, rule := range natRules(cfg) {
+		if rule.run("-C") != nil {
+			continue // not present
+		}
+		if err := rule.run("-D"); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// iptablesRule is a single rule in a table's chain
+type iptablesRule struct {
+	table string
+	chain string
+	spec  []string
+}
+
+// natRules returns the iptables rules for gateway mode
+func natRules(cfg NATConfig) []iptablesRule {
+	return []iptablesRule{
+		{"nat", "POSTROUTING", []string{"-o", cfg.WANInterface, "-j", "MASQUERADE"}},
+		{"filter", "FORWARD", []string{"-i", cfg.LANInterface, "-o", cfg.WANInterface, "-j", "ACCEPT"}},
+		{"filter", "FORWARD", []string{"-i", cfg.WANInterface, "-o", cfg.LANInterface,
+			"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	}
+}
+
+// run applies the rule with the given action: -C to check, -A to append, -D to delete
+func (r iptablesRule) run(action string) error {
+	args := append([]string{"-w", "-t", r.table, action, r.chain}, r.spec...)
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+//go:build linux && !android
+
+package gateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+var netlinkSeq uint32
+
+// AddRoute installs a route in the main table, replacing any existing route to the same destination
+func AddRoute(route Route) error {
+	return routeRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, route)
+}
+
+// DeleteRoute removes a route from the main table
+func DeleteRoute(route Route) error {
+	return routeRequest(syscall.RTM_DELROUTE, 0, route)
+}
+
+// routeRequest sends a single route message over rtnetlink and waits for the kernel's ack
+func routeRequest(msgType uint16, flags uint16, route Route) error {
+	msg, err := buildRouteMessage(msgType, flags, route)
+	if err != nil {
+		return err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to send route request: %w", err)
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read netlink reply: %w", err)
+	}
+	replies, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return fmt.Errorf("invalid netlink reply: %w", err)
+	}
+	for _, reply := range replies {
+		if reply.Header.Type != syscall.NLMSG_ERROR || len(reply.Data) < 4 {
+			continue
+		}
+		// An error message with errno 0 is the ack
+		if errno := int32(binary.NativeEndian.Uint32(reply.Data[:4])); errno != 0 {
+			return fmt.Errorf("kernel rejected route: %w", syscall.Errno(-errno))
+		}
+		return nil
+	}
+	return fmt.Errorf("no ack from kernel")
+}
+
+// buildRouteMessage encodes an nlmsghdr + rtmsg + route attributes
+func buildRouteMessage(msgType uint16, flags uint16, route Route) ([]byte, error) {
+	family := uint8(syscall.AF_INET)
+	var dst net.IP
+	dstLen := 0
+	if route.Dst != nil {
+		dstLen, _ = route.Dst.Mask.Size()
+		dst = route.Dst.IP
+	}
+	if ipFamily(dst, route.Gateway) == syscall.AF_INET6 {
+		family = syscall.AF_INET6
+	}
+
+	scope := uint8(syscall.RT_SCOPE_UNIVERSE)
+	if route.Gateway == nil {
+		scope = syscall.RT_SCOPE_LINK
+	}
+
+	body := []byte{
+		family,
+		uint8(dstLen),
+		0, // src_len
+		0, // tos
+		syscall.RT_TABLE_MAIN,
+		syscall.RTPROT_STATIC,
+		scope,
+		syscall.RTN_UNICAST,
+		0, 0, 0, 0, // flags
+	}
+
+	if dst != nil {
+		body = appendAttr(body, syscall.RTA_DST, ipBytes(dst, family))
+	}
+	if route.Gateway != nil {
+		body = appendAttr(body, syscall.RTA_GATEWAY, ipBytes(route.Gateway, family))
+	}
+	if route.Interface != "" {
+		iface, err := net.InterfaceByName(route.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("unknown interface %q: %w", route.Interface, err)
+		}
+		body = appendAttr(body, syscall.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(iface.Index)))
+	}
+	if route.Metric > 0 {
+		body = appendAttr(body, syscall.RTA_PRIORITY, binary.NativeEndian.AppendUint32(nil, uint32(route.Metric)))
+	}
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(syscall.NLMSG_HDRLEN+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], atomic.AddUint32(&netlinkSeq, 1))
+	return append(msg, body...), nil
+}
+
+// appendAttr appends a 4-byte aligned rtattr
+func appendAttr(b []byte, attrType uint16, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+	b = binary.NativeEndian.AppendUint16(b, uint16(length))
+	b = binary.NativeEndian.AppendUint16(b, attrType)
+	b = append(b, data...)
+	for i := length; i%syscall.RTA_ALIGNTO != 0; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func ipFamily(ips ...net.IP) int {
+	for _, ip := range ips {
+		if ip != nil && ip.To4() == nil {
+			return syscall.AF_INET6
+		}
+	}
+	return syscall.AF_INET
+}
+
+func ipBytes(ip net.IP, family uint8) []byte {
+	if family == syscall.AF_INET {
+		return ip.To4()
+	}
+	return ip.To16()
+}
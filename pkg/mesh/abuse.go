@@ -0,0 +1,468 @@
+package mesh
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client standings on the exit proxy
+const (
+	StandingGood    = "good"    // Full request rate
+	StandingDemoted = "demoted" // Served at a reduced request rate
+	StandingBanned  = "banned"  // Refused until the ban expires
+)
+
+// Offenses that count against a proxy client, with how much each adds to its score
+const (
+	OffenseUpstreamError      = "upstream_error"      // Destination couldn't be reached
+	OffenseBlockedDestination = "blocked_destination" // Refused by a blocklist, content filter or the exit guard
+	OffenseRateLimited        = "rate_limited"        // Request over the client's rate limit
+	OffenseBandwidth          = "bandwidth"           // Transfer over AbuseBandwidthLimit within a window
+	OffenseAuthFailure        = "auth_failure"        // Proxy token that isn't, or is no longer, valid
+	OffenseMeshWarning        = "mesh_warning"        // Another exit warned the mesh it banned the client
+)
+
+var offenseWeights = map[string]float64{
+	OffenseUpstreamError:      1,
+	OffenseBlockedDestination: 2,
+	OffenseRateLimited:        0.5,
+	OffenseBandwidth:          10,
+	OffenseAuthFailure:        5,
+	OffenseMeshWarning:        10,
+}
+
+const (
+	// AbuseScoreHalfLife is how quickly offenses are forgiven
+	AbuseScoreHalfLife = 10 * time.Minute
+	// AbuseDemoteScore and AbuseBanScore are the scores at which a client is demoted or banned
+	AbuseDemoteScore = 20
+	AbuseBanScore    = 50
+	// AbuseBanDuration is how long an automatic ban lasts
+	AbuseBanDuration = 30 * time.Minute
+	// AbuseAuthFailureInterval is how often at most a client's failed authentication counts,
+	// so a burst of requests with a token the exit forgot counts once while the client
+	// asks for a new one
+	AbuseAuthFailureInterval = 10 * time.Second
+
+	// AbuseBandwidthWindow and AbuseBandwidthLimit bound the transfer of one client
+	AbuseBandwidthWindow = 10 * time.Minute
+	AbuseBandwidthLimit  = 500 * 1024 * 1024
+
+	// Requests per second and burst allowed for good and demoted clients
+	abuseRequestRate        = 50
+	abuseRequestBurst       = 100
+	abuseDemotedRequestRate = 5
+	abuseDemotedBurst       = 10
+)
+
+// AbusePolicy tunes abuse scoring and what happens to banned clients. Zero fields use
+// the defaults; the flags are off by default.
+type AbusePolicy struct {
+	Weights             map[string]float64 // Score each offense adds, e.g. OffenseAuthFailure; others keep their default
+	HalfLife            time.Duration      // How quickly offenses are forgiven
+	DemoteScore         float64            // Score at which a client is served at the demoted rate
+	BanScore            float64            // Score at which a client is banned
+	BanDuration         time.Duration      // How long an automatic ban lasts
+	AuthFailureInterval time.Duration      // How often at most failed authentication counts against a client
+	BandwidthWindow     time.Duration
+	BandwidthLimit      int64   // Bytes one client may transfer within BandwidthWindow
+	RequestRate         float64 // Requests per second for clients in good standing
+	RequestBurst        float64
+	DemotedRate         float64 // Requests per second for demoted clients
+	DemotedBurst        float64
+	KeepAuthorized      bool // Don't revoke a banned client's authorization and token
+	Quiet               bool // Don't warn the mesh about clients we ban
+	HonorWarnings       bool // Count warnings from trusted exits against the clients they name
+}
+
+// DefaultAbusePolicy returns the policy used unless configured otherwise
+func DefaultAbusePolicy() AbusePolicy {
+	return AbusePolicy{
+		Weights:             maps.Clone(offenseWeights),
+		HalfLife:            AbuseScoreHalfLife,
+		DemoteScore:         AbuseDemoteScore,
+		BanScore:            AbuseBanScore,
+		BanDuration:         AbuseBanDuration,
+		AuthFailureInterval: AbuseAuthFailureInterval,
+		BandwidthWindow:     AbuseBandwidthWindow,
+		BandwidthLimit:      AbuseBandwidthLimit,
+		RequestRate:         abuseRequestRate,
+		RequestBurst:        abuseRequestBurst,
+		DemotedRate:         abuseDemotedRequestRate,
+		DemotedBurst:        abuseDemotedBurst,
+	}
+}
+
+// withDefaults fills zero fields from d
+func (p AbusePolicy) withDefaults(d AbusePolicy) AbusePolicy {
+	weights := maps.Clone(d.Weights)
+	for offense, weight := range p.Weights {
+		weights[offense] = weight
+	}
+	p.Weights = weights
+	if p.HalfLife <= 0 {
+		p.HalfLife = d.HalfLife
+	}
+	if p.DemoteScore <= 0 {
+		p.DemoteScore = d.DemoteScore
+	}
+	if p.BanScore <= 0 {
+		p.BanScore = d.BanScore
+	}
+	if p.BanDuration <= 0 {
+		p.BanDuration = d.BanDuration
+	}
+	if p.AuthFailureInterval <= 0 {
+		p.AuthFailureInterval = d.AuthFailureInterval
+	}
+	if p.BandwidthWindow <= 0 {
+		p.BandwidthWindow = d.BandwidthWindow
+	}
+	if p.BandwidthLimit <= 0 {
+		p.BandwidthLimit = d.BandwidthLimit
+	}
+	if p.RequestRate <= 0 {
+		p.RequestRate = d.RequestRate
+	}
+	if p.RequestBurst <= 0 {
+		p.RequestBurst = d.RequestBurst
+	}
+	if p.DemotedRate <= 0 {
+		p.DemotedRate = d.DemotedRate
+	}
+	if p.DemotedBurst <= 0 {
+		p.DemotedBurst = d.DemotedBurst
+	}
+	return p
+}
+
+// ClientScore is a proxy client's standing and the offenses behind it
+type ClientScore struct {
+	PeerID      string         `json:"peer_id"`
+	Score       float64        `json:"score"`
+	Standing    string         `json:"standing"`
+	Override    string         `json:"override,omitempty"` // Standing set manually, which automatic scoring doesn't change
+	BannedUntil time.Time      `json:"banned_until,omitempty"`
+	Offenses    map[string]int `json:"offenses,omitempty"`
+}
+
+type clientScore struct {
+	ClientScore
+	updated     time.Time
+	tokens      float64
+	lastRequest time.Time
+	windowStart time.Time
+	windowBytes int64
+	windowOver  bool      // Bandwidth offense already counted for this window
+	lastAuth    time.Time // When failed authentication last counted
+}
+
+// AbuseScorer scores proxy clients by their upstream errors, blocked destination attempts,
+// request rate, bandwidth and failed authentication. Offenses decay over time; clients
+// whose score climbs are demoted to a lower request rate and then temporarily banned.
+type AbuseScorer struct {
+	clients  map[string]*clientScore
+	policy   AbusePolicy
+	onChange func(peerID, standing, reason string)
+	mu       sync.Mutex
+}
+
+// NewAbuseScorer creates a scorer with every client in good standing
+func NewAbuseScorer() *AbuseScorer {
+	return &AbuseScorer{clients: make(map[string]*clientScore), policy: DefaultAbusePolicy()}
+}
+
+// SetPolicy changes how clients are scored from now on; zero fields use the defaults
+func (s *AbuseScorer) SetPolicy(policy AbusePolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = policy.withDefaults(DefaultAbusePolicy())
+}
+
+// Policy returns the scoring policy
+func (s *AbuseScorer) Policy() AbusePolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policy := s.policy
+	policy.Weights = maps.Clone(policy.Weights)
+	return policy
+}
+
+// SetChangeHandler sets a callback for when a client's standing changes
+func (s *AbuseScorer) SetChangeHandler(handler func(peerID, standing, reason string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = handler
+}
+
+// clientLocked returns a client's record with its score decayed to now; s.mu must be held
+func (s *AbuseScorer) clientLocked(peerID string, now time.Time) *clientScore {
+	c, ok := s.clients[peerID]
+	if !ok {
+		c = &clientScore{
+			ClientScore: ClientScore{PeerID: peerID, Standing: StandingGood, Offenses: make(map[string]int)},
+			updated:     now,
+			tokens:      s.policy.RequestBurst,
+			lastRequest: now,
+			windowStart: now,
+		}
+		s.clients[peerID] = c
+		return c
+	}
+	if elapsed := now.Sub(c.updated); elapsed > 0 {
+		c.Score *= math.Pow(0.5, float64(elapsed)/float64(s.policy.HalfLife))
+		c.updated = now
+	}
+	return c
+}
+
+// restandLocked recomputes a client's standing, returning it if it changed; s.mu must be held
+func (s *AbuseScorer) restandLocked(c *clientScore, now time.Time) (string, bool) {
+	standing := StandingGood
+	switch {
+	case c.Override != "":
+		standing = c.Override
+	case now.Before(c.BannedUntil):
+		standing = StandingBanned
+	case c.Score >= s.policy.BanScore:
+		standing = StandingBanned
+		c.BannedUntil = now.Add(s.policy.BanDuration)
+	case c.Score >= s.policy.DemoteScore:
+		standing = StandingDemoted
+	}
+	if standing == c.Standing {
+		return standing, false
+	}
+	c.Standing = standing
+	return standing, true
+}
+
+func (s *AbuseScorer) notify(peerID, standing, reason string) {
+	s.mu.Lock()
+	handler := s.onChange
+	s.mu.Unlock()
+	if handler != nil {
+		handler(peerID, standing, reason)
+	}
+}
+
+// Record counts an offense against a client
+func (s *AbuseScorer) Record(peerID, offense string, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	c := s.clientLocked(peerID, now)
+	if offense == OffenseAuthFailure {
+		if now.Sub(c.lastAuth) < s.policy.AuthFailureInterval {
+			s.mu.Unlock()
+			return
+		}
+		c.lastAuth = now
+	}
+	c.Score += s.policy.Weights[offense]
+	c.Offenses[offense]++
+	standing, changed := s.restandLocked(c, now)
+	s.mu.Unlock()
+
+	if changed {
+		s.notify(peerID, standing, offense)
+	}
+}
+
+// RecordBytes adds to a client's transfer, counting an offense the first time it goes
+// over the policy's bandwidth limit within a window
+func (s *AbuseScorer) RecordBytes(peerID string, n int64, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	c := s.clientLocked(peerID, now)
+	if now.Sub(c.windowStart) >= s.policy.BandwidthWindow {
+		c.windowStart, c.windowBytes, c.windowOver = now, 0, false
+	}
+	c.windowBytes += n
+	over := c.windowBytes > s.policy.BandwidthLimit && !c.windowOver
+	if over {
+		c.windowOver = true
+	}
+	s.mu.Unlock()
+
+	if over {
+		s.Record(peerID, OffenseBandwidth, now)
+	}
+}
+
+// Allow admits a request from a client, refusing banned clients and requests over the
+// client's rate limit; refusals by rate limit count as offenses. A nil scorer allows everything.
+func (s *AbuseScorer) Allow(peerID string, now time.Time) (bool, string) {
+	if s == nil {
+		return true, StandingGood
+	}
+	s.mu.Lock()
+	c := s.clientLocked(peerID, now)
+	standing, changed := s.restandLocked(c, now)
+
+	rate, burst := s.policy.RequestRate, s.policy.RequestBurst
+	if standing == StandingDemoted {
+		rate, burst = s.policy.DemotedRate, s.policy.DemotedBurst
+	}
+	c.tokens = math.Min(burst, c.tokens+rate*now.Sub(c.lastRequest).Seconds())
+	c.lastRequest = now
+	limited := c.tokens < 1
+	if !limited && standing != StandingBanned {
+		c.tokens--
+	}
+	s.mu.Unlock()
+
+	if changed {
+		s.notify(peerID, standing, "score decayed")
+	}
+	if standing == StandingBanned {
+		return false, standing
+	}
+	if limited {
+		s.Record(peerID, OffenseRateLimited, now)
+		return false, standing
+	}
+	return true, standing
+}
+
+// Standing returns a client's current standing
+func (s *AbuseScorer) Standing(peerID string, now time.Time) string {
+	s.mu.Lock()
+	if _, ok := s.clients[peerID]; !ok {
+		s.mu.Unlock()
+		return StandingGood
+	}
+	standing, changed := s.restandLocked(s.clientLocked(peerID, now), now)
+	s.mu.Unlock()
+
+	if changed {
+		s.notify(peerID, standing, "score decayed")
+	}
+	return standing
+}
+
+// SetOverride pins a client's standing regardless of its score; "" returns it to
+// automatic scoring with a clean record
+func (s *AbuseScorer) SetOverride(peerID, standing string, now time.Time) {
+	s.mu.Lock()
+	c := s.clientLocked(peerID, now)
+	c.Override = standing
+	if standing == "" {
+		c.Score = 0
+		c.BannedUntil = time.Time{}
+		c.Offenses = make(map[string]int)
+		c.tokens = s.policy.RequestBurst
+	}
+	newStanding, changed := s.restandLocked(c, now)
+	s.mu.Unlock()
+
+	if changed {
+		s.notify(peerID, newStanding, "manual override")
+	}
+}
+
+// Scores returns every scored client, worst first
+func (s *AbuseScorer) Scores(now time.Time) []ClientScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scores := make([]ClientScore, 0, len(s.clients))
+	for peerID := range s.clients {
+		c := s.clientLocked(peerID, now)
+		score := c.ClientScore
+		score.Offenses = make(map[string]int, len(c.Offenses))
+		for offense, n := range c.Offenses {
+			score.Offenses[offense] = n
+		}
+		scores = append(scores, score)
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+	return scores
+}
+
+// SetClientStanding pins a proxy client's standing (StandingGood trusts it, StandingBanned
+// bans it indefinitely); "" returns it to automatic scoring with a clean record
+func (ma *MeshApp) SetClientStanding(peerID, standing string) error {
+	switch standing {
+	case "", StandingGood, StandingDemoted, StandingBanned:
+	default:
+		return fmt.Errorf("unknown standing %q", standing)
+	}
+	ma.Abuse.SetOverride(peerID, standing, time.Now())
+	return nil
+}
+
+// handleStandingChange reports clients demoted, banned or restored by abuse scoring
+func (ma *MeshApp) handleStandingChange(peerID, standing, reason string) {
+	eventType := EventClientRestored
+	switch standing {
+	case StandingDemoted:
+		eventType = EventClientDemoted
+	case StandingBanned:
+		eventType = EventClientBanned
+	}
+	detail := fmt.Sprintf("%s (%s)", standing, reason)
+	ma.Audit.Record(AuditClientStanding, peerID, detail)
+	ma.emitEvent(&Event{Type: eventType, PeerID: peerID, Detail: detail})
+	if standing == StandingDemoted || standing == StandingBanned {
+		ma.Trust.Record(peerID, TrustAbuse, time.Now())
+	}
+	if standing != StandingBanned || reason == "manual override" {
+		return
+	}
+	policy := ma.Abuse.Policy()
+	if !policy.KeepAuthorized {
+		// A banned client asks again once the ban expires
+		ma.InternetProxy.RevokeClient(peerID)
+	}
+	// Addresses of plain devices on our own LAN mean nothing to other exits
+	if !policy.Quiet && net.ParseIP(peerID) == nil {
+		ma.warnAbuse(peerID, reason, policy.BanDuration)
+	}
+}
+
+// abuseWarningMessageType warns neighbors that we banned a client for abuse
+const abuseWarningMessageType = "abuse_warning"
+
+// warnAbuse tells our connected peers we banned a client
+func (ma *MeshApp) warnAbuse(peerID, reason string, duration time.Duration) {
+	for _, neighbor := range ma.Transport.GetConnectedPeers() {
+		if neighbor == peerID {
+			continue
+		}
+		ma.Transport.SendMessage(neighbor, &Message{
+			Type:      abuseWarningMessageType,
+			Source:    ma.Node.ID,
+			Dest:      neighbor,
+			Timestamp: time.Now(),
+			Metadata: map[string]string{
+				"client":  peerID,
+				"reason":  reason,
+				"seconds": strconv.Itoa(int(duration.Seconds())),
+			},
+		})
+	}
+}
+
+// handleAbuseWarning reports a neighbor's ban of a client and, if the policy honors
+// warnings from peers we trust, counts it against the client here too
+func (ma *MeshApp) handleAbuseWarning(peerID string, msg *Message) {
+	client := msg.Metadata["client"]
+	if client == "" || client == peerID {
+		return
+	}
+	reason := msg.Metadata["reason"]
+	ma.Audit.Record(AuditAbuseWarning, client, fmt.Sprintf("from %s (%s)", peerID, reason))
+	ma.emitEvent(&Event{Type: EventAbuseWarning, PeerID: client, Detail: fmt.Sprintf("banned by %s (%s)", peerID, reason)})
+	if client != ma.Node.ID && ma.Abuse.Policy().HonorWarnings && ma.Trust.Trusted(peerID, time.Now()) {
+		ma.Abuse.Record(client, OffenseMeshWarning, time.Now())
+	}
+}
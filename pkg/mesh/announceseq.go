@@ -0,0 +1,119 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Announcements carry a sequence number that grows with every one a node sends, so a
+// stale announcement arriving late or replayed can't overwrite fresher peer state. The
+// counter starts from the clock in milliseconds, so it keeps growing across restarts;
+// with a sequence file it also survives the clock being set back. Peers that send no
+// sequence number are accepted as before.
+
+// peerSequence is the latest sequence number accepted from a peer
+type peerSequence struct {
+	seq uint64
+	at  time.Time
+}
+
+// SequenceReserve is how many sequence numbers are reserved per write to the sequence
+// file, so it isn't rewritten on every announcement
+const SequenceReserve = 1024
+
+// SetSequenceFile persists our announcement sequence number at path, continuing from
+// the number saved there if it is ahead of ours; a missing file is not an error
+func (d *Discovery) SetSequenceFile(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seqPath = path
+	d.seqReserved = 0
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("sequence file %s: %w", path, err)
+	}
+	if saved > d.seq {
+		d.seq = saved
+	}
+	return nil
+}
+
+// Sequence returns the sequence number of the last announcement we sent
+func (d *Discovery) Sequence() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seq
+}
+
+// PeerSequence returns the sequence number of the latest announcement accepted from a
+// peer, and false if it sent none
+func (d *Discovery) PeerSequence(peerID string) (uint64, bool) {
+	d.peersMu.RLock()
+	defer d.peersMu.RUnlock()
+	last, ok := d.peerSeqs[peerID]
+	return last.seq, ok
+}
+
+// StaleAnnouncements returns how many announcements were ignored as older than one
+// already accepted from the same peer
+func (d *Discovery) StaleAnnouncements() uint64 {
+	return d.stale.Load()
+}
+
+// nextSequence numbers an outgoing announcement. Called with d.mu held.
+func (d *Discovery) nextSequence() uint64 {
+	d.seq++
+	if d.seqPath != "" && d.seq > d.seqReserved {
+		reserved := d.seq + SequenceReserve
+		// Write then rename so a crash never leaves a truncated file behind
+		tmp := d.seqPath + ".tmp"
+		if err := os.WriteFile(tmp, []byte(strconv.FormatUint(reserved, 10)), 0600); err == nil {
+			if os.Rename(tmp, d.seqPath) == nil {
+				d.seqReserved = reserved
+			}
+		}
+	}
+	return d.seq
+}
+
+// acceptSequence records an announcement's sequence number, and returns false if one
+// at least as new was already accepted from the peer. Called with d.peersMu held.
+func (d *Discovery) acceptSequence(msg *AnnounceMessage) bool {
+	if msg.Seq == 0 {
+		return true
+	}
+	if last, ok := d.peerSeqs[msg.ID]; ok && msg.Seq <= last.seq {
+		d.stale.Add(1)
+		return false
+	}
+	d.peerSeqs[msg.ID] = peerSequence{seq: msg.Seq, at: time.Now()}
+	return true
+}
+
+// pruneSequences forgets the sequence numbers of peers that are gone and haven't
+// announced for longer than a signed announcement stays valid, after which a replay is
+// rejected by age anyway. Called with d.peersMu held.
+func (d *Discovery) pruneSequences(now time.Time) {
+	for id, last := range d.peerSeqs {
+		if _, present := d.peers[id]; !present && now.Sub(last.at) > AnnouncementMaxAge {
+			delete(d.peerSeqs, id)
+		}
+	}
+}
+
+// initialSequence is where the announcement counter starts without a sequence file
+func initialSequence() uint64 {
+	return uint64(time.Now().UnixMilli())
+}
@@ -0,0 +1,99 @@
+package mesh
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AnnouncementMaxAge is how far a signed announcement's send time may be from our clock
+// before it is ignored as a replay; generous, since device clocks drift
+const AnnouncementMaxAge = 10 * time.Minute
+
+// ErrAnnouncement is returned for announcements that are ignored as spoofed
+var ErrAnnouncement = errors.New("announcement rejected")
+
+// SetIdentity signs our announcements with identity, whose node ID must be ours
+func (d *Discovery) SetIdentity(identity *Identity) error {
+	if identity.NodeID() != d.nodeID {
+		return fmt.Errorf("identity is for %s, not %s", identity.NodeID(), d.nodeID)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.identity = identity
+	return nil
+}
+
+// SetRequireSigned makes discovery ignore unsigned announcements, so nobody can advertise
+// a proxy under an ID they don't hold the key of. Invalid signatures are always ignored.
+func (d *Discovery) SetRequireSigned(require bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requireSigned = require
+}
+
+// RejectedAnnouncements returns how many announcements were ignored as spoofed
+func (d *Discovery) RejectedAnnouncements() uint64 {
+	return d.rejected.Load()
+}
+
+// signAnnouncement stamps and signs an announcement
+func (id *Identity) signAnnouncement(msg *AnnounceMessage) {
+	msg.SentAt = time.Now().Unix()
+	msg.Key = id.PublicKey()
+	msg.Signature = ed25519.Sign(id.PrivateKey, announcementSigningBytes(msg))
+}
+
+// announcementSigningBytes is what an announcement's signature covers: all of it but the
+// signature, the protocol versions, the network hints and the battery, which version 1
+// verifiers don't know
+func announcementSigningBytes(msg *AnnounceMessage) []byte {
+	unsigned := *msg
+	unsigned.Signature = nil
+	unsigned.Protocol, unsigned.MinProtocol = 0, 0
+	unsigned.NetworkHints = nil
+	unsigned.Power = nil
+	data, _ := json.Marshal(&unsigned)
+	return append([]byte(identityContext+" announcement\x00"), data...)
+}
+
+// checkAnnouncement decides whether an announcement is trusted. Once a peer has signed,
+// its unsigned announcements are ignored too, so it can't be downgraded.
+func (d *Discovery) checkAnnouncement(msg *AnnounceMessage) error {
+	err := d.verifyAnnouncement(msg)
+	if err != nil {
+		d.rejected.Add(1)
+	}
+	return err
+}
+
+func (d *Discovery) verifyAnnouncement(msg *AnnounceMessage) error {
+	if len(msg.Signature) == 0 {
+		d.mu.Lock()
+		require := d.requireSigned
+		d.mu.Unlock()
+		if require {
+			return fmt.Errorf("%w: unsigned", ErrAnnouncement)
+		}
+		d.peersMu.RLock()
+		known, ok := d.peers[msg.ID]
+		d.peersMu.RUnlock()
+		if ok && known.Signed {
+			return fmt.Errorf("%w: unsigned, but %s signs its announcements", ErrAnnouncement, msg.ID)
+		}
+		return nil
+	}
+
+	if len(msg.Key) != ed25519.PublicKeySize || NodeIDFromKey(msg.Key) != msg.ID {
+		return fmt.Errorf("%w: key doesn't match %s", ErrAnnouncement, msg.ID)
+	}
+	if !ed25519.Verify(msg.Key, announcementSigningBytes(msg), msg.Signature) {
+		return fmt.Errorf("%w: bad signature", ErrAnnouncement)
+	}
+	if age := time.Since(time.Unix(msg.SentAt, 0)); age > AnnouncementMaxAge || age < -AnnouncementMaxAge {
+		return fmt.Errorf("%w: sent %v ago", ErrAnnouncement, age.Round(time.Second))
+	}
+	return nil
+}
@@ -2,8 +2,13 @@ package mesh
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,14 +23,68 @@ type MeshApp struct {
 	Transport              *Transport
 	InternetProxy          *InternetProxy
 	InternetClient         *InternetClient
+	ExitConsent            *ExitConsent
+	UplinkMonitor          *UplinkMonitor
+	PolicyEngine           *PolicyEngine
+	MACFilter              *MACFilter
+	ProxyACL               *ProxyACL
+	Pairing                *Pairing
+	Keystore               *Keystore // Persists keys and tokens across restarts; nil keeps them in memory
+	Audit                  *Auditor
+	Logs                   *LogRing
+	Traces                 *TraceLog
+	Tracer                 *Tracer
+	ExitGuard              *ExitGuard
+	Abuse                  *AbuseScorer
+	Trust                  *TrustTracker
+	Revocations            *RevocationList
 	IsConnected            bool
 	IsInternetSharing      bool
 	DiscoveredPeers        map[string]*Peer
+	lastInternetCheck      time.Time
+	lastInternetOK         time.Time
+	tetheredToMesh         bool
+	suspended              bool
+	resumeSharing          bool
+	upstreamTier           int
+	lastGrade              string
+	maxProxyTier           int
+	power                  *PowerStatus // Our battery as the platform last reported it, nil if unknown
+	minRelayBattery        int          // Charge below which we stop relaying on battery
+	powerResumeSharing     bool         // Sharing stopped for low battery and resumes once charged
+	requirePairing         bool
+	mgmt                   *mgmtState
+	joins                  map[string]chan *Message // Network joins waiting on the owner's answer, by owner
+	joinsMu                sync.Mutex
+	pings                  map[string]pingWaiter // Pings waiting on an answer, by ID
+	pingsMu                sync.Mutex
+	onionKey               *ecdh.PrivateKey                                      // Agrees the keys of onion layers meant for us
+	onionExit              func(fromPeer string, payload []byte) ([]byte, error) // Serves onion requests that end with us
+	onionCalls             map[string]onionWaiter                                // Onion and onion key requests waiting on an answer, by ID
+	onionMu                sync.Mutex
+	recorder               atomic.Pointer[trafficRecorder] // Control-plane capture for a bug report, while one runs
+	wifiCreds              *wifiCredentials
+	dials                  *dialBackoff
+	sharing                *sharingLog // When internet sharing was on, for network stats
+	routeProbes            *routeProber
+	hibernated             map[string]*hibernatedPeer
+	staticPeers            map[string]*DiscoveredPeer
+	linkPeers              map[string]*DiscoveredPeer // Peers on platform data links, e.g. Wi-Fi Aware
+	platformNet            PlatformNetwork            // Network the host platform last reported
+	scanning               bool                       // Discovery listens passively, without the mesh
+	fetching               bool                       // FetchOnce runs discovery and the transport
+	componentErrs          map[string]error
+	discoveredLRU          *peerLRU
+	maxDiscoveredPeers     int
+	config                 Config
 	ctx                    context.Context
 	cancel                 context.CancelFunc
 	mu                     sync.RWMutex
 	connectionListeners    []ConnectionListener
 	peerDiscoveryListeners []PeerDiscoveryListener
+	exitConsentListeners   []ExitConsentListener
+	eventListeners         []EventListener
+	dataListeners          []DataListener
 }
 
 // ConnectionListener is called when connection state changes
@@ -40,6 +99,17 @@ type PeerDiscoveryListener interface {
 	OnPeerLost(peerID string)
 }
 
+// ExitConsentListener is called when traffic would exit through a peer the user has not approved
+type ExitConsentListener interface {
+	OnExitConsentRequired(peerID, region, networkType string)
+}
+
+// DataListener is called with the payload of each data message addressed to us,
+// already decrypted if it was sealed with a personal network's group key
+type DataListener interface {
+	OnData(sourceID string, payload []byte)
+}
+
 // NetworkStats holds current network statistics
 type NetworkStats struct {
 	NodeID                 string
@@ -63,35 +133,107 @@ func NewMeshApp(nodeID, nodeName, ip, mac string) *MeshApp {
 	transport := NewTransport(nodeID, DefaultPort)
 	internetProxy := NewInternetProxy(nodeID, transport)
 	internetClient := NewInternetClient(nodeID)
-
-	return &MeshApp{
+	policyEngine := NewPolicyEngine()
+	internetProxy.SetPolicyEngine(policyEngine)
+	audit := NewAuditor(nodeID)
+	internetProxy.SetAuditor(audit)
+	traces := NewTraceLog(nodeID, DefaultTraceRecords)
+	internetProxy.SetTraceLog(traces)
+	tracer := NewTracer(nodeID)
+	transport.SetTracer(tracer)
+	internetProxy.SetTracer(tracer)
+	exitGuard := NewExitGuard()
+	internetProxy.SetExitGuard(exitGuard)
+	abuse := NewAbuseScorer()
+	internetProxy.SetAbuseScorer(abuse)
+	trust := NewTrustTracker()
+	internetClient.SetTrustTracker(trust)
+	proxyManager := NewProxyManager(node)
+	onionKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	proxyManager.SetTrustTracker(trust)
+
+	ma := &MeshApp{
 		Node:                   node,
 		Manager:                NewManager(node),
 		Router:                 NewRouter(nodeID),
-		ProxyManager:           NewProxyManager(node),
+		ProxyManager:           proxyManager,
 		PersonalNetworkMgr:     NewPersonalNetworkManager(),
 		Discovery:              discovery,
 		Transport:              transport,
 		InternetProxy:          internetProxy,
 		InternetClient:         internetClient,
+		ExitConsent:            NewExitConsent(),
+		UplinkMonitor:          NewUplinkMonitor(DefaultUplinkThresholds()),
+		PolicyEngine:           policyEngine,
+		MACFilter:              NewMACFilter(),
+		Pairing:                NewPairing(),
+		Audit:                  audit,
+		Logs:                   NewLogRing(DefaultLogRingLines),
+		Traces:                 traces,
+		Tracer:                 tracer,
+		ExitGuard:              exitGuard,
+		Abuse:                  abuse,
+		Trust:                  trust,
+		Revocations:            NewRevocationList(),
+		mgmt:                   newMgmtState(),
+		joins:                  make(map[string]chan *Message),
+		pings:                  make(map[string]pingWaiter),
+		onionKey:               onionKey,
+		onionCalls:             make(map[string]onionWaiter),
+		dials:                  newDialBackoff(),
+		wifiCreds:              newWiFiCredentials(),
+		sharing:                &sharingLog{},
+		routeProbes:            newRouteProber(),
+		hibernated:             make(map[string]*hibernatedPeer),
 		IsConnected:            false,
 		IsInternetSharing:      false,
 		DiscoveredPeers:        make(map[string]*Peer),
+		staticPeers:            make(map[string]*DiscoveredPeer),
+		linkPeers:              make(map[string]*DiscoveredPeer),
+		componentErrs:          make(map[string]error),
+		discoveredLRU:          newPeerLRU(),
+		maxDiscoveredPeers:     DefaultMaxDiscoveredPeers,
+		minRelayBattery:        DefaultMinRelayBattery,
+		config:                 DefaultConfig(),
 		ctx:                    ctx,
 		cancel:                 cancel,
 		connectionListeners:    make([]ConnectionListener, 0),
 		peerDiscoveryListeners: make([]PeerDiscoveryListener, 0),
+		exitConsentListeners:   make([]ExitConsentListener, 0),
+		eventListeners:         make([]EventListener, 0),
 	}
+	ma.ProxyACL = NewProxyACL(ma.PersonalNetworkMgr.NetworksOf)
+	internetProxy.SetACL(ma.ProxyACL)
+	proxyManager.SetSessionSecrets(ma.Pairing.key)
+	internetProxy.SetSessionSecrets(ma.Pairing.key)
+	internetClient.SetProxySessions(ma.proxySession)
+	abuse.SetChangeHandler(ma.handleStandingChange)
+	internetClient.SetAuthRequiredHandler(func(proxyPeerID string) { ma.requestProxyAccess(proxyPeerID) })
+	internetProxy.SetAccessRequestHandler(ma.handleAccessRequest)
+	internetProxy.SetQuotaHandler(ma.handleQuotaExceeded)
+	trust.SetChangeHandler(ma.handleTrustChange)
+	transport.SetHandshakeFailureHandler(ma.handleHandshakeFailure)
+	ma.PersonalNetworkMgr.SetKeyRotationHandler(ma.distributeGroupKey)
+	discovery.SetNetworks(func() []string { return ma.PersonalNetworkMgr.NetworksOf(ma.Node.ID) })
+	return ma
 }
 
-// Start initializes and starts the mesh application
+// Start initializes and starts the mesh application.
+// Transport and discovery may each fail independently: the app then runs in
+// degraded mode, reports the missing capability via Health and emits an event.
+// Start only fails when neither component could be started.
 func (ma *MeshApp) Start() error {
 	ma.mu.Lock()
-	defer ma.mu.Unlock()
+	if ma.fetching {
+		ma.mu.Unlock()
+		return ErrFetchInProgress
+	}
+	ma.stopScanLocked()
 
 	// Check for internet connectivity
 	hasInternet := CheckInternetConnectivity()
 	ma.Node.HasInternet = hasInternet
+	ma.recordInternetCheckLocked(hasInternet)
 
 	// Setup discovery callbacks
 	ma.Discovery.SetCallbacks(
@@ -107,18 +249,31 @@ func (ma *MeshApp) Start() error {
 	ma.Transport.SetMessageHandler(func(peerID string, msg *Message) {
 		ma.handleMessage(peerID, msg)
 	})
+	ma.Transport.SetMessageFilter(ma.checkMessagePolicy)
+	ma.Transport.SetReconnectHandler(ma.connectOnDemand)
+	ma.Transport.SetConnectionVerifier(ma.verifyIncomingPeer)
+	ma.Transport.SetSignatureFailureHandler(ma.handleForgedMessage)
+
+	ma.componentErrs = make(map[string]error)
+	ma.loadKeystore()
 
 	// Start transport layer
-	if err := ma.Transport.Start(); err != nil {
-		ma.notifyConnectionError(err)
-		return fmt.Errorf("failed to start transport: %w", err)
+	transportErr := ma.Transport.Start()
+	if transportErr != nil {
+		ma.componentErrs["transport"] = transportErr
+		ma.notifyConnectionError(transportErr)
 	}
 
-	// Start discovery
-	if err := ma.Discovery.Start(); err != nil {
-		ma.Transport.Stop()
-		ma.notifyConnectionError(err)
-		return fmt.Errorf("failed to start discovery: %w", err)
+	// Start discovery (static peers still work over transport without it)
+	discoveryErr := ma.Discovery.Start()
+	if discoveryErr != nil {
+		ma.componentErrs["discovery"] = discoveryErr
+		ma.notifyConnectionError(discoveryErr)
+	}
+
+	if transportErr != nil && discoveryErr != nil {
+		ma.mu.Unlock()
+		return fmt.Errorf("failed to start transport: %w", transportErr)
 	}
 
 	// Start manager
@@ -126,26 +281,68 @@ func (ma *MeshApp) Start() error {
 		ma.Discovery.Stop()
 		ma.Transport.Stop()
 		ma.notifyConnectionError(err)
+		ma.mu.Unlock()
 		return err
 	}
 
 	ma.IsConnected = true
 	ma.notifyConnectionChanged(true)
 
-	// Start background tasks
-	go ma.internetCheckLoop()
-	go ma.routingUpdateLoop()
+	ma.startBackgroundLoopsLocked()
+
+	degraded := make(map[string]error, len(ma.componentErrs))
+	for name, err := range ma.componentErrs {
+		degraded[name] = err
+	}
+	ma.mu.Unlock()
+
+	for name, err := range degraded {
+		ma.emitEvent(&Event{Type: EventComponentDegraded, Component: name, Detail: err.Error()})
+	}
 
+	ma.connectStaticPeers()
+	ma.announceToLinkPeers()
 	return nil
 }
 
+// AddStaticPeer adds a peer at a fixed address that is dialed without relying on discovery
+func (ma *MeshApp) AddStaticPeer(peerID, ip string, port int) error {
+	ma.mu.Lock()
+	ma.staticPeers[peerID] = &DiscoveredPeer{ID: peerID, IP: ip, Port: port}
+	connected := ma.IsConnected
+	ma.mu.Unlock()
+	ma.dials.forget(peerID) // The address may be new; dial it right away
+
+	if !connected || !ma.Transport.IsRunning() {
+		return nil // Dialed once the transport is up
+	}
+	return ma.connectStaticPeer(peerID, ip, port)
+}
+
+// RemoveStaticPeer removes a static peer and closes its connection
+func (ma *MeshApp) RemoveStaticPeer(peerID string) {
+	ma.mu.Lock()
+	delete(ma.staticPeers, peerID)
+	ma.mu.Unlock()
+	ma.Transport.DisconnectPeer(peerID)
+}
+
 // Stop gracefully stops the mesh application
 func (ma *MeshApp) Stop() {
+	ma.stop(true)
+}
+
+// stop stops the app, telling discovered peers we are leaving if goodbye is set
+func (ma *MeshApp) stop(goodbye bool) {
+	ma.saveRouteMetrics()
+	ma.saveKeystore()
+
 	ma.mu.Lock()
 	defer ma.mu.Unlock()
+	ma.stopScanLocked()
 
 	// Stop all networking components
-	ma.Discovery.Stop()
+	ma.Discovery.stop(goodbye)
 	ma.Transport.Stop()
 	ma.InternetProxy.Disable()
 	ma.InternetClient.Disconnect()
@@ -153,6 +350,8 @@ func (ma *MeshApp) Stop() {
 
 	ma.IsConnected = false
 	ma.IsInternetSharing = false
+	ma.suspended = false
+	ma.hibernated = make(map[string]*hibernatedPeer)
 	ma.cancel()
 	// Reset context for restart
 	ma.ctx, ma.cancel = context.WithCancel(context.Background())
@@ -160,6 +359,22 @@ func (ma *MeshApp) Stop() {
 	ma.notifyConnectionChanged(false)
 }
 
+// startBackgroundLoopsLocked starts the periodic tasks bound to the current context; ma.mu must be held.
+// Loops receive the context explicitly so a later context reset can't keep them alive.
+func (ma *MeshApp) startBackgroundLoopsLocked() {
+	ctx := ma.ctx
+	go ma.internetCheckLoop(ctx)
+	go ma.routingUpdateLoop(ctx)
+	go ma.uplinkMonitorLoop(ctx)
+	go ma.componentRetryLoop(ctx)
+	go ma.sleepWatchLoop(ctx)
+	go ma.hibernateLoop(ctx)
+	go ma.telemetryExportLoop(ctx)
+	go ma.qualityLoop(ctx)
+	go ma.interfaceWatchLoop(ctx)
+	go ma.linkAnnounceLoop(ctx)
+}
+
 // ConnectToNetwork attempts to connect to the mesh network
 func (ma *MeshApp) ConnectToNetwork() error {
 	return ma.Start()
@@ -180,27 +395,49 @@ func (ma *MeshApp) EnableInternetSharing() bool {
 		return false
 	}
 
+	// Relaying drains the battery; sharing waits until we are charged or plugged in
+	ma.mu.Lock()
+	low := ma.lowPowerLocked()
+	if low {
+		ma.powerResumeSharing = true
+	}
+	ma.mu.Unlock()
+	if low {
+		ma.emitEvent(&Event{Type: EventSharingRefused, Component: "proxy", Detail: "battery low"})
+		return false
+	}
+
+	// Re-sharing internet that itself comes from the mesh creates fragile chains and
+	// forwarding loops, so it is only allowed up to the configured relay tier
+	if meshDerived, reason := ma.InternetMeshDerived(); meshDerived && !ma.relayAllowed() {
+		ma.emitEvent(&Event{Type: EventSharingRefused, Component: "proxy", Detail: reason})
+		return false
+	}
+
 	// Enable proxy server
 	if err := ma.InternetProxy.Enable(); err != nil {
 		return false
 	}
 
 	// Register as proxy in proxy manager
+	ip, mac := ma.Node.Address()
 	proxyPeer := &Peer{
 		NodeID:      ma.Node.ID,
-		IP:          ma.Node.IP,
-		MAC:         ma.Node.MAC,
+		IP:          ip,
+		MAC:         mac,
 		HasInternet: true,
 		LastSeen:    time.Now().Unix(),
+		ProxyTier:   ma.ProxyTier(),
 	}
 	ma.ProxyManager.RegisterProxy(proxyPeer)
 
 	// Update discovery to announce internet availability
-	ma.Discovery.UpdateInternetStatus(true)
+	ma.updateProxyAdvertisement()
 
 	ma.mu.Lock()
 	ma.IsInternetSharing = true
 	ma.mu.Unlock()
+	ma.sharing.setSharing(true, time.Now())
 
 	return true
 }
@@ -214,6 +451,12 @@ func (ma *MeshApp) DisableInternetSharing() {
 	ma.mu.Lock()
 	ma.IsInternetSharing = false
 	ma.mu.Unlock()
+	ma.sharing.setSharing(false, time.Now())
+
+	// The uplink isn't measured while we don't share, so a pause for a weak one would
+	// outlive it; measure afresh when sharing again
+	ma.UplinkMonitor.Reset()
+	ma.InternetProxy.PauseAuthorizations(false)
 }
 
 // RequestInternetAccess requests internet access from the mesh network
@@ -226,20 +469,39 @@ func (ma *MeshApp) RequestInternetAccess() bool {
 		return true // Already have internet
 	}
 
-	// Find available proxy from discovered peers
+	// Find the best available proxy the user has approved, and the best of all
 	peers := ma.Discovery.GetPeers()
-	var proxyPeer *DiscoveredPeer
+	var proxyPeer, best *DiscoveredPeer
 	for _, peer := range peers {
-		if peer.HasInternet {
+		if !ma.usableExit(peer) {
+			continue
+		}
+		if betterExit(peer, best) {
+			best = peer
+		}
+		if ma.ExitConsent.HasConsent(peer) && betterExit(peer, proxyPeer) {
 			proxyPeer = peer
-			break
 		}
 	}
 
-	if proxyPeer == nil {
+	if best == nil {
 		return false // No proxy available
 	}
 
+	// The user must approve the first exit through a new peer or region
+	if proxyPeer == nil {
+		ma.notifyExitConsentRequired(best)
+		return false
+	}
+
+	// With pairing required, first use of a proxy waits for the users to compare codes
+	if ma.pairingRequired(proxyPeer.ID) {
+		if err := ma.StartPairing(proxyPeer.ID); err != nil {
+			ma.emitEvent(&Event{Type: EventPairingFailed, PeerID: proxyPeer.ID, Detail: err.Error()})
+		}
+		return false
+	}
+
 	// Connect to peer first
 	if err := ma.Transport.ConnectToPeer(proxyPeer.ID, proxyPeer.IP, proxyPeer.Port); err != nil {
 		return false
@@ -250,14 +512,20 @@ func (ma *MeshApp) RequestInternetAccess() bool {
 		return false
 	}
 
-	// Send proxy request message
-	msg := &Message{
-		Type:      "proxy_request",
-		Source:    ma.Node.ID,
-		Dest:      proxyPeer.ID,
-		Timestamp: time.Now(),
-	}
-	ma.Transport.SendMessage(proxyPeer.ID, msg)
+	// Ask for access; the proxy answers with the token our requests carry
+	ma.requestProxyAccess(proxyPeer.ID)
+
+	ma.mu.Lock()
+	ma.upstreamTier = proxyPeer.Tier
+	ma.mu.Unlock()
+
+	// Spread requests over other approved proxies too, when bonding is enabled, and keep
+	// one more ready to take over
+	ma.bondProxies()
+	ma.prepareStandby()
+
+	// Our internet is now mesh-derived; stop offering it back to the mesh
+	ma.updateProxyAdvertisement()
 
 	return true
 }
@@ -286,6 +554,81 @@ func (ma *MeshApp) GetNetworkStats() *NetworkStats {
 	}
 }
 
+// Health returns the state of every component with the reason for any problem
+func (ma *MeshApp) Health() *HealthReport {
+	ma.mu.RLock()
+	report := &HealthReport{
+		NodeID:            ma.Node.ID,
+		Status:            HealthOK,
+		LastInternetCheck: ma.lastInternetCheck,
+		LastInternetOK:    ma.lastInternetOK,
+		GeneratedAt:       time.Now(),
+	}
+	connected := ma.IsConnected
+	suspended := ma.suspended
+	sharing := ma.IsInternetSharing
+	hasInternet := ma.Node.HasInternet
+	discoveryErr := ma.componentErrs["discovery"]
+	transportErr := ma.componentErrs["transport"]
+	ma.mu.RUnlock()
+
+	if ma.Discovery.IsRunning() {
+		report.add("discovery", HealthOK, "")
+	} else if suspended {
+		report.add("discovery", HealthDisabled, "suspended for host sleep")
+	} else if connected && discoveryErr != nil {
+		report.add("discovery", HealthDown, discoveryErr.Error())
+	} else if connected {
+		report.add("discovery", HealthDown, "discovery is not running")
+	} else {
+		report.add("discovery", HealthDisabled, "not connected to the mesh")
+	}
+
+	if addr := ma.Transport.ListenAddr(); addr != "" {
+		report.add("transport", HealthOK, "listening on "+addr)
+	} else if suspended {
+		report.add("transport", HealthDisabled, "suspended for host sleep")
+	} else if connected && transportErr != nil {
+		report.add("transport", HealthDown, transportErr.Error())
+	} else if connected {
+		report.add("transport", HealthDown, "transport listener is not bound")
+	} else {
+		report.add("transport", HealthDisabled, "not connected to the mesh")
+	}
+
+	switch {
+	case !sharing:
+		report.add("proxy", HealthDisabled, "internet sharing is off")
+	case suspended:
+		report.add("proxy", HealthDisabled, "suspended for host sleep")
+	case !ma.InternetProxy.IsEnabled():
+		report.add("proxy", HealthDown, "sharing is on but the proxy server is not running")
+	case ma.InternetProxy.AuthorizationsPaused():
+		report.add("proxy", HealthDegraded, "uplink degraded, new clients are paused")
+	default:
+		report.add("proxy", HealthOK, "")
+	}
+
+	if ma.InternetClient.IsConnected() {
+		report.add("client", HealthOK, "connected to a mesh proxy")
+	} else {
+		report.add("client", HealthDisabled, "not using a mesh proxy")
+	}
+
+	switch {
+	case report.LastInternetCheck.IsZero():
+		report.add("internet", HealthDisabled, "connectivity has not been checked yet")
+	case hasInternet:
+		report.add("internet", HealthOK, "")
+	case ma.InternetClient.IsConnected():
+		report.add("internet", HealthDegraded, "no direct internet, using the mesh")
+	default:
+		report.add("internet", HealthDown, "no internet connectivity")
+	}
+
+	return report
+}
+
 // GetConnectedPeers returns list of currently connected peers
 func (ma *MeshApp) GetConnectedPeers() []string {
 	return ma.Transport.GetConnectedPeers()
@@ -327,12 +670,91 @@ func (ma *MeshApp) SetInternetStatus(hasInternet bool) {
 	ma.Discovery.UpdateInternetStatus(hasInternet)
 }
 
+// SetExitInfo sets the region and uplink type disclosed to clients when sharing
+func (ma *MeshApp) SetExitInfo(region, networkType string) {
+	ma.Discovery.SetExitInfo(region, networkType)
+}
+
+// SetSharingTerms sets the terms advertised with our proxy offer (nil clears them)
+func (ma *MeshApp) SetSharingTerms(terms *SharingTerms) error {
+	if terms != nil {
+		if err := terms.Validate(); err != nil {
+			return err
+		}
+	}
+	ma.Discovery.SetSharingTerms(terms)
+	ma.InternetProxy.SetScope(terms)
+	return nil
+}
+
+// GetProxyTerms returns the sharing terms advertised by a discovered proxy
+func (ma *MeshApp) GetProxyTerms(peerID string) (*SharingTerms, bool) {
+	peer, exists := ma.Discovery.GetPeer(peerID)
+	if !exists || peer.Terms == nil {
+		return nil, false
+	}
+	return peer.Terms, true
+}
+
 // ReleaseInternetAccess disconnects from the proxy
 func (ma *MeshApp) ReleaseInternetAccess() error {
 	ma.InternetClient.Disconnect()
+	ma.updateProxyAdvertisement()
 	return nil
 }
 
+// SetTetheredToMesh tells the node its uplink is a hotspot or tether provided by a mesh peer.
+// Platforms that can see the upstream network (e.g. the hotspot SSID) should report it here.
+func (ma *MeshApp) SetTetheredToMesh(tethered bool) {
+	ma.mu.Lock()
+	ma.tetheredToMesh = tethered
+	ma.upstreamTier = 0 // The tethering peer's tier is unknown; assume a direct uplink
+	ma.mu.Unlock()
+	ma.updateProxyAdvertisement()
+}
+
+// SetMaxProxyTier sets the highest tier we may share at. The default of 0 only shares
+// a direct uplink; n allows relaying internet obtained up to n mesh proxies away.
+func (ma *MeshApp) SetMaxProxyTier(tier int) {
+	ma.mu.Lock()
+	ma.maxProxyTier = tier
+	ma.mu.Unlock()
+	ma.updateProxyAdvertisement()
+}
+
+// ProxyTier returns the tier we would advertise as a proxy
+func (ma *MeshApp) ProxyTier() int {
+	if meshDerived, _ := ma.InternetMeshDerived(); !meshDerived {
+		return 0
+	}
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	return ma.upstreamTier + 1
+}
+
+// relayAllowed returns whether our tier is within the configured relay limit
+func (ma *MeshApp) relayAllowed() bool {
+	tier := ma.ProxyTier()
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	return tier <= ma.maxProxyTier
+}
+
+// InternetMeshDerived reports whether our internet access is itself provided by the mesh,
+// in which case we must not act as a proxy
+func (ma *MeshApp) InternetMeshDerived() (bool, string) {
+	if proxyID := ma.InternetClient.ProxyPeerID(); proxyID != "" {
+		return true, fmt.Sprintf("internet is provided by mesh proxy %s", proxyID)
+	}
+	ma.mu.RLock()
+	tethered := ma.tetheredToMesh
+	ma.mu.RUnlock()
+	if tethered {
+		return true, "uplink is tethered to a mesh peer"
+	}
+	return false, ""
+}
+
 // AddConnectionListener adds a connection state listener (deprecated, use RegisterConnectionListener)
 func (ma *MeshApp) AddConnectionListener(listener ConnectionListener) {
 	ma.RegisterConnectionListener(listener)
@@ -352,9 +774,241 @@ func (ma *MeshApp) RegisterPeerDiscoveryListener(listener PeerDiscoveryListener)
 	ma.peerDiscoveryListeners = append(ma.peerDiscoveryListeners, listener)
 }
 
+// RegisterExitConsentListener registers a listener for exit consent prompts
+func (ma *MeshApp) RegisterExitConsentListener(listener ExitConsentListener) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.exitConsentListeners = append(ma.exitConsentListeners, listener)
+}
+
+// RegisterDataListener registers a listener for data messages addressed to us
+func (ma *MeshApp) RegisterDataListener(listener DataListener) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.dataListeners = append(ma.dataListeners, listener)
+}
+
+// ReportPeerSignal feeds a Wi-Fi/BLE radio measurement for a peer from the host platform.
+// rssi is in dBm and linkQuality in 0..1 (0 if unknown). Measurements are smoothed and
+// used for proxy selection and route costs. Returns false if the peer is unknown.
+func (ma *MeshApp) ReportPeerSignal(peerID string, rssi int, linkQuality float64) bool {
+	if linkQuality < 0 {
+		linkQuality = 0
+	} else if linkQuality > 1 {
+		linkQuality = 1
+	}
+
+	now := time.Now().Unix()
+	ma.mu.Lock()
+	peer, known := ma.DiscoveredPeers[peerID]
+	var snapshot Peer
+	if known {
+		peer.applySignal(rssi, linkQuality, now)
+		snapshot = *peer
+	}
+	ma.mu.Unlock()
+
+	if updated, ok := ma.Node.UpdatePeerSignal(peerID, rssi, linkQuality); ok {
+		if !known {
+			snapshot = updated
+		}
+		known = true
+	}
+	if ma.ProxyManager.UpdateProxySignal(peerID, rssi, linkQuality) {
+		known = true
+	}
+	if !known {
+		return false
+	}
+
+	if snapshot.NodeID == "" {
+		snapshot = Peer{NodeID: peerID, RSSI: rssi, LinkQuality: linkQuality}
+	}
+	ma.Router.UpdateLinkSignal(&snapshot)
+	return true
+}
+
+// SetPeerLimits caps the connected and discovered peer tables (0 means unlimited)
+func (ma *MeshApp) SetPeerLimits(maxPeers, maxDiscoveredPeers int) {
+	ma.Node.SetPeerLimit(maxPeers)
+
+	ma.mu.Lock()
+	ma.maxDiscoveredPeers = maxDiscoveredPeers
+	evicted := ma.evictDiscoveredLocked()
+	ma.mu.Unlock()
+	ma.archivePeers(evicted)
+}
+
+// PinPeer protects a peer from eviction in all peer tables
+func (ma *MeshApp) PinPeer(peerID string) {
+	ma.Node.PinPeer(peerID)
+	ma.mu.Lock()
+	ma.discoveredLRU.pin(peerID)
+	ma.mu.Unlock()
+}
+
+// UnpinPeer allows a peer to be evicted again
+func (ma *MeshApp) UnpinPeer(peerID string) {
+	ma.Node.UnpinPeer(peerID)
+	ma.mu.Lock()
+	ma.discoveredLRU.unpin(peerID)
+	ma.mu.Unlock()
+}
+
+// SetPeerArchive enables on-disk spillover of evicted peers
+func (ma *MeshApp) SetPeerArchive(archive PeerArchive) {
+	ma.Node.SetPeerArchive(archive)
+}
+
+// ApplyPolicy verifies a signed policy bundle for a personal network and enforces it
+func (ma *MeshApp) ApplyPolicy(networkID string, signed *SignedPolicyBundle) error {
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(networkID)
+	if !ok {
+		return fmt.Errorf("unknown personal network %q", networkID)
+	}
+
+	previous, _ := ma.PolicyEngine.Active(networkID)
+	bundle, err := ma.PolicyEngine.Apply(network, signed)
+	if err != nil {
+		return err
+	}
+	// A new version replaces the old one, so what it no longer sets is lifted
+	ma.ExitConsent.SetAllowedExits(ma.PolicyEngine.AllowedExits())
+	if bundle.ContentFilter != nil || (previous != nil && previous.ContentFilter != nil) {
+		ma.SetContentFilter(ma.PolicyEngine.ContentFilter())
+	}
+	ma.applyMessagePolicy(network, bundle)
+
+	detail := fmt.Sprintf("%s v%d", bundle.NetworkID, bundle.Version)
+	ma.Audit.Record(AuditPolicyChanged, "", detail)
+	ma.emitEvent(&Event{Type: EventPolicyApplied, Detail: detail})
+	return nil
+}
+
+// applyMessagePolicy copies a bundle's message limits onto the network's policies
+func (ma *MeshApp) applyMessagePolicy(network *PersonalNetwork, bundle *PolicyBundle) {
+	var policy NetworkPolicy
+	network.mu.RLock()
+	if network.Policies != nil {
+		policy = *network.Policies
+	}
+	network.mu.RUnlock()
+	policy.MaxMessageSize = bundle.MaxMessageSize
+	policy.MaxMetadataSize = bundle.MaxMetadataSize
+	policy.BlockedMessageTypes = append([]string(nil), bundle.BlockedMessageTypes...)
+	network.SetPolicies(&policy)
+}
+
+// SetContentFilter requires the given content filter for clients of our proxy; nil disables it
+func (ma *MeshApp) SetContentFilter(policy *ContentFilterPolicy) error {
+	if policy == nil {
+		ma.InternetProxy.SetContentFilter(nil)
+		ma.Audit.Record(AuditPolicyChanged, "", "content filter disabled")
+		return nil
+	}
+	if err := policy.validate(); err != nil {
+		return fmt.Errorf("invalid content filter: %w", err)
+	}
+	ma.InternetProxy.SetContentFilter(NewContentFilter(*policy, ma.PersonalNetworkMgr.NetworksOf))
+	ma.Audit.Record(AuditPolicyChanged, "", fmt.Sprintf("content filter %v, %d hosts, %d network overrides",
+		policy.Categories, len(policy.BlockedHosts), len(policy.Networks)))
+	return nil
+}
+
+// PublishPolicy signs a policy bundle as the network owner, applies it locally and
+// sends it to every connected member of the network
+func (ma *MeshApp) PublishPolicy(bundle *PolicyBundle, ownerKey ed25519.PrivateKey) error {
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(bundle.NetworkID)
+	if !ok {
+		return fmt.Errorf("unknown personal network %q", bundle.NetworkID)
+	}
+	if network.Owner != ma.Node.ID {
+		return fmt.Errorf("only the owner of network %q can publish policies", network.ID)
+	}
+
+	if bundle.IssuedAt.IsZero() {
+		bundle.IssuedAt = time.Now()
+	}
+	signed, err := SignPolicyBundle(bundle, ownerKey)
+	if err != nil {
+		return err
+	}
+	if err := ma.ApplyPolicy(network.ID, signed); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(signed)
+	if err != nil {
+		return fmt.Errorf("failed to encode policy bundle: %w", err)
+	}
+	for _, member := range network.GetAllMembers() {
+		if member.NodeID == ma.Node.ID {
+			continue
+		}
+		ma.Transport.SendMessage(member.NodeID, &Message{
+			Type:      "policy_bundle",
+			Source:    ma.Node.ID,
+			Dest:      member.NodeID,
+			Payload:   payload,
+			Timestamp: time.Now(),
+			Metadata:  map[string]string{"network_id": network.ID},
+		})
+	}
+	return nil
+}
+
 // Internal methods
 
+// evictDiscoveredLocked trims DiscoveredPeers to its limit; ma.mu must be held.
+// Static peers and personal network members are never evicted.
+func (ma *MeshApp) evictDiscoveredLocked() []*Peer {
+	keep := func(peerID string) bool {
+		_, static := ma.staticPeers[peerID]
+		return static || ma.PersonalNetworkMgr.IsMemberOfAny(peerID)
+	}
+
+	var evicted []*Peer
+	for ma.maxDiscoveredPeers > 0 && len(ma.DiscoveredPeers) > ma.maxDiscoveredPeers {
+		victim, ok := ma.discoveredLRU.victim(keep)
+		if !ok {
+			break
+		}
+		evicted = append(evicted, ma.DiscoveredPeers[victim])
+		delete(ma.DiscoveredPeers, victim)
+		ma.discoveredLRU.remove(victim)
+	}
+	return evicted
+}
+
+// archivePeers spills evicted peers to the node's archive, if one is configured
+func (ma *MeshApp) archivePeers(peers []*Peer) {
+	if len(peers) == 0 {
+		return
+	}
+	ma.Node.mu.RLock()
+	archive := ma.Node.archive
+	ma.Node.mu.RUnlock()
+	if archive == nil {
+		return
+	}
+	for _, peer := range peers {
+		archive.Store(peer)
+	}
+}
+
 func (ma *MeshApp) handlePeerDiscovered(peer *DiscoveredPeer) {
+	span := ma.Tracer.Start(SpanContext{}, "discovery.peer_discovered", SpanKindInternal)
+	span.SetAttribute("peer.id", peer.ID)
+	defer span.End()
+	ma.recorder.Load().peerDiscovered(peer)
+
+	// Peers rejected by MAC policy are ignored; they may have been admitted before their MAC resolved
+	if !ma.MACFilter.Allowed(peer.MAC) || ma.Revocations.Revoked(peer.ID) {
+		ma.Transport.DisconnectPeer(peer.ID)
+		ma.ProxyManager.UnregisterProxy(peer.ID)
+		return
+	}
+
 	// Create Peer object
 	meshPeer := &Peer{
 		NodeID:      peer.ID,
@@ -362,14 +1016,22 @@ func (ma *MeshApp) handlePeerDiscovered(peer *DiscoveredPeer) {
 		MAC:         peer.MAC,
 		HasInternet: peer.HasInternet,
 		LastSeen:    time.Now().Unix(),
+		Power:       peer.Power,
 	}
 
 	ma.mu.Lock()
 	ma.DiscoveredPeers[peer.ID] = meshPeer
+	ma.discoveredLRU.touch(peer.ID)
+	evicted := ma.evictDiscoveredLocked()
 	ma.mu.Unlock()
+	ma.archivePeers(evicted)
+
+	// Try to connect to the peer, unless the connection policy leaves it for on demand
+	if !ma.shouldDial(peer) {
+		ma.notifyPeerDiscovered(meshPeer)
+	} else if err := ma.dialPeer(peer.ID, peer.IP, peer.Port); err == nil {
+		ma.forgetHibernated(peer.ID)
 
-	// Try to connect to the peer
-	if err := ma.Transport.ConnectToPeer(peer.ID, peer.IP, peer.Port); err == nil {
 		// Add to router
 		ma.Router.UpdateRoute(peer.ID, peer.ID, 1, 10*time.Millisecond)
 
@@ -385,14 +1047,23 @@ func (ma *MeshApp) handlePeerDiscovered(peer *DiscoveredPeer) {
 			MAC:         peer.MAC,
 			HasInternet: true,
 			LastSeen:    time.Now().Unix(),
+			ProxyTier:   peer.Tier,
+			Link:        peer.Link,
+			Power:       peer.Power,
 		}
 		ma.ProxyManager.RegisterProxy(proxyPeer)
 	}
 }
 
 func (ma *MeshApp) handlePeerLost(peerID string) {
+	span := ma.Tracer.Start(SpanContext{}, "discovery.peer_lost", SpanKindInternal)
+	span.SetAttribute("peer.id", peerID)
+	defer span.End()
+	ma.recorder.Load().peerLost(peerID)
+
 	ma.mu.Lock()
 	delete(ma.DiscoveredPeers, peerID)
+	ma.discoveredLRU.remove(peerID)
 	ma.mu.Unlock()
 
 	// Disconnect from peer
@@ -400,15 +1071,27 @@ func (ma *MeshApp) handlePeerLost(peerID string) {
 
 	// Remove from router
 	ma.Router.RemoveRoute(peerID)
+	ma.routeProbes.forget(peerID)
+	ma.forgetHibernated(peerID)
+	ma.dials.forget(peerID)
 
 	// Unregister proxy if applicable
 	ma.ProxyManager.UnregisterProxy(peerID)
+	ma.InternetClient.RemoveBondedProxy(peerID)
+	ma.handleProxyLost(peerID)
 
 	// Notify listeners
 	ma.notifyPeerLost(peerID)
 }
 
 func (ma *MeshApp) handleMessage(peerID string, msg *Message) {
+	ma.recorder.Load().message(peerID, msg)
+	if !backgroundMessageTypes[msg.Type] {
+		span := ma.Tracer.Start(MessageSpanContext(msg), "transport.receive "+msg.Type, SpanKindConsumer)
+		span.SetAttribute("peer.id", peerID)
+		defer span.End()
+	}
+
 	switch msg.Type {
 	case "proxy_request":
 		ma.handleProxyRequest(peerID, msg)
@@ -416,18 +1099,138 @@ func (ma *MeshApp) handleMessage(peerID string, msg *Message) {
 		ma.handleProxyResponse(peerID, msg)
 	case "data":
 		ma.handleDataMessage(peerID, msg)
+	case "hop_limit_exceeded":
+		ma.handleHopLimitExceeded(peerID, msg)
+	case "source_route_failed":
+		ma.handleSourceRouteFailed(peerID, msg)
 	case "route_update":
 		ma.handleRouteUpdate(peerID, msg)
+	case "policy_bundle":
+		ma.handlePolicyBundle(peerID, msg)
+	case "pairing":
+		ma.handlePairing(peerID, msg)
+	case "mgmt_request":
+		ma.handleMgmtRequest(peerID, msg)
+	case "mgmt_response":
+		ma.handleMgmtResponse(peerID, msg)
+	case "hibernate":
+		ma.handleHibernate(peerID, msg)
+	case "presence":
+		ma.handlePresence(peerID, msg)
+	case "network_join":
+		ma.handleNetworkJoin(peerID, msg)
+	case "network_join_response":
+		ma.handleNetworkJoinResponse(peerID, msg)
+	case "link_announce":
+		ma.handleLinkAnnounce(peerID, msg)
+	case "network_key":
+		ma.handleNetworkKey(peerID, msg)
+	case revocationMessageType:
+		ma.handleRevocations(peerID, msg)
+	case memberCertMessageType:
+		ma.handleCerts(peerID, msg)
+	case wifiCredentialMessageType:
+		ma.handleWiFiCredential(peerID, msg)
+	case wifiRevokeMessageType:
+		ma.handleWiFiRevoke(peerID, msg)
+	case abuseWarningMessageType:
+		ma.handleAbuseWarning(peerID, msg)
+	case pingMessageType:
+		ma.handlePing(peerID, msg)
+	case pongMessageType:
+		ma.handlePong(peerID, msg)
+	case onionMessageType, onionKeyRequestType:
+		ma.handleOnion(peerID, msg)
+	case onionReplyMessageType:
+		ma.handleOnionReply(peerID, msg)
+	}
+}
+
+// handleForgedMessage reports a message the transport dropped for a bad signature
+func (ma *MeshApp) handleForgedMessage(peerID string, msg *Message, err error) {
+	ma.Audit.Record(AuditForgedMessage, peerID, err.Error())
+	ma.emitEvent(&Event{Type: EventForgedMessage, PeerID: peerID, Detail: err.Error()})
+	ma.Trust.Record(peerID, TrustForgedMessage, time.Now())
+}
+
+// checkMessagePolicy enforces the message policies of the personal networks a peer belongs to
+func (ma *MeshApp) checkMessagePolicy(peerID string, msg *Message, outbound bool) error {
+	// Nothing from revoked identities but revocations, which carry their own signatures
+	if !outbound && msg.Type != revocationMessageType &&
+		(ma.Revocations.Revoked(peerID) || ma.Revocations.Revoked(msg.Source)) {
+		return ErrRevoked
+	}
+	err := ma.PersonalNetworkMgr.CheckMessage(peerID, msg)
+	if err != nil {
+		direction := "received"
+		if outbound {
+			direction = "sent"
+		}
+		ma.emitEvent(&Event{
+			Type:   EventPolicyViolation,
+			PeerID: peerID,
+			Detail: fmt.Sprintf("%s %s: %v", direction, msg.Type, err),
+		})
 	}
+	return err
 }
 
 func (ma *MeshApp) handleProxyRequest(peerID string, msg *Message) {
 	if !ma.InternetProxy.IsEnabled() {
 		return
 	}
+	if ma.InternetProxy.AuthorizationsPaused() {
+		// Our uplink is too weak to take new clients; say so, so they look elsewhere
+		ma.Transport.SendMessage(peerID, &Message{
+			Type:      "proxy_response",
+			Source:    ma.Node.ID,
+			Dest:      peerID,
+			Timestamp: time.Now(),
+			Metadata:  map[string]string{"status": "paused"},
+		})
+		return
+	}
+	if !ma.PolicyEngine.SharingAllowedAt(time.Now()) {
+		return
+	}
+	if quota := ma.PolicyEngine.QuotaBytes(peerID); quota > 0 && ma.InternetProxy.ClientUsage(peerID) >= uint64(quota) {
+		ma.Audit.Record(AuditQuotaExceeded, peerID, fmt.Sprintf("quota %d bytes", quota))
+		return
+	}
+	if limit := ma.InternetProxy.OverQuota(peerID); limit != "" && ma.InternetProxy.Quota().Action != QuotaThrottle {
+		ma.Audit.Record(AuditQuotaExceeded, peerID, limit+" quota")
+		return
+	}
+	if peer, ok := ma.Discovery.GetPeer(peerID); ok && !ma.MACFilter.Allowed(peer.MAC) {
+		ma.Audit.Record(AuditMACFilterBlocked, peerID, peer.MAC)
+		return
+	}
+	if !ma.ProxyACL.Permitted(peerID) {
+		ma.Audit.Record(AuditProxyACLDenied, peerID, "")
+		return
+	}
+	if ma.pairingRequired(peerID) {
+		return
+	}
+	if ma.Abuse.Standing(peerID, time.Now()) == StandingBanned {
+		return
+	}
+	if !ma.Trust.Trusted(peerID, time.Now()) {
+		ma.Audit.Record(AuditTrustRefused, peerID, "")
+		return
+	}
+	// Never relay for our own upstream, and only relay at all within the tier limit
+	// and while we have the battery for it
+	if ma.LowPower() {
+		return
+	}
+	if meshDerived, _ := ma.InternetMeshDerived(); meshDerived &&
+		(!ma.relayAllowed() || ma.InternetClient.UsesProxy(peerID)) {
+		return
+	}
 
-	// Authorize the client
-	ma.InternetProxy.AuthorizeClient(peerID)
+	// Authorize the client and hand it the token its requests must carry
+	token := ma.InternetProxy.AuthorizeClient(peerID)
 
 	// Send response
 	response := &Message{
@@ -435,38 +1238,163 @@ func (ma *MeshApp) handleProxyRequest(peerID string, msg *Message) {
 		Source:    ma.Node.ID,
 		Dest:      peerID,
 		Timestamp: time.Now(),
-		Metadata:  map[string]string{"status": "authorized"},
+		Metadata:  map[string]string{"status": "authorized", "token": token},
 	}
 	ma.Transport.SendMessage(peerID, response)
 }
 
+// requestProxyAccess asks a proxy for access, which it answers with our token
+func (ma *MeshApp) requestProxyAccess(proxyPeerID string) error {
+	return ma.Transport.SendMessage(proxyPeerID, &Message{
+		Type:      "proxy_request",
+		Source:    ma.Node.ID,
+		Dest:      proxyPeerID,
+		Timestamp: time.Now(),
+	})
+}
+
 func (ma *MeshApp) handleProxyResponse(peerID string, msg *Message) {
 	if status, ok := msg.Metadata["status"]; ok && status == "authorized" {
-		// Successfully authorized to use proxy
+		ma.InternetClient.SetProxyToken(peerID, msg.Metadata["token"])
 	}
 }
 
 func (ma *MeshApp) handleDataMessage(peerID string, msg *Message) {
 	// Route the message if not for us
-	if msg.Dest != ma.Node.ID {
-		route := ma.Router.GetRoute(msg.Dest)
-		if route != nil && route.NextHop != ma.Node.ID {
-			ma.Transport.SendMessage(route.NextHop, msg)
+	if msg.Dest == ma.Node.ID {
+		payload, err := ma.openData(msg)
+		if err != nil {
+			ma.emitEvent(&Event{Type: EventDataUndecryptable, PeerID: msg.Source, Detail: err.Error()})
+			return
 		}
+		ma.notifyData(msg.Source, payload)
+		return
+	}
+	if len(msg.Route) > 0 {
+		ma.relaySourceRouted(peerID, msg)
+		return
+	}
+	if ma.LowPower() {
+		return // Relaying would drain a battery that is already low
+	}
+	if !ma.forward(msg) {
+		ma.reportHopLimitExceeded(peerID, msg)
+	}
+}
+
+// remainingHops returns the hop limit a relayed message leaves with, false if it has none left
+func remainingHops(msg *Message) (int, bool) {
+	hops := msg.HopLimit
+	if hops <= 0 {
+		hops = DefaultHopLimit
+	}
+	hops--
+	return hops, hops > 0
+}
+
+// forward sends a message on towards its destination with one hop less, reporting false
+// if it ran out of hops and was dropped so routing loops can't circulate it forever
+func (ma *MeshApp) forward(msg *Message) bool {
+	hops, ok := remainingHops(msg)
+	if !ok {
+		return false
+	}
+	route := ma.Router.GetRoute(msg.Dest)
+	if route != nil && route.NextHop != ma.Node.ID {
+		forwarded := *msg
+		forwarded.HopLimit = hops
+		ma.Transport.SendMessage(route.NextHop, &forwarded)
+	}
+	return true
+}
+
+// reportHopLimitExceeded tells a dropped message's source, like ICMP time exceeded, so
+// it can spot the loop; the report goes back through the peer it came from if the
+// source has no route
+func (ma *MeshApp) reportHopLimitExceeded(peerID string, msg *Message) {
+	if msg.Source == "" || msg.Source == ma.Node.ID {
+		return
+	}
+	report := &Message{
+		Type:      "hop_limit_exceeded",
+		Source:    ma.Node.ID,
+		Dest:      msg.Source,
+		Timestamp: time.Now(),
+		Metadata:  map[string]string{"dest": msg.Dest, "type": msg.Type},
+	}
+	nextHop := peerID
+	if route := ma.Router.GetRoute(msg.Source); route != nil && route.NextHop != ma.Node.ID {
+		nextHop = route.NextHop
+	}
+	ma.Transport.SendMessage(nextHop, report)
+}
+
+// handleHopLimitExceeded surfaces a report that one of our messages was dropped, and
+// forwards reports for others; reports that run out of hops are dropped silently
+func (ma *MeshApp) handleHopLimitExceeded(peerID string, msg *Message) {
+	if msg.Dest != ma.Node.ID {
+		ma.forward(msg)
+		return
+	}
+	ma.emitEvent(&Event{
+		Type:   EventHopLimitExceeded,
+		PeerID: msg.Source,
+		Detail: fmt.Sprintf("%s message to %s ran out of hops", msg.Metadata["type"], msg.Metadata["dest"]),
+	})
+}
+
+func (ma *MeshApp) handlePolicyBundle(peerID string, msg *Message) {
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(msg.Metadata["network_id"])
+	if !ok || network.Owner != msg.Source {
+		return
+	}
+
+	var signed SignedPolicyBundle
+	if err := json.Unmarshal(msg.Payload, &signed); err != nil {
+		return
+	}
+	if err := ma.ApplyPolicy(network.ID, &signed); err != nil {
+		ma.emitEvent(&Event{Type: EventPolicyRejected, PeerID: peerID, Detail: err.Error()})
 	}
 }
 
 func (ma *MeshApp) handleRouteUpdate(peerID string, msg *Message) {
-	// Update routing table based on received information
+	// Echo latency probes so the sender can measure the link
+	if probe := msg.Metadata["probe"]; probe != "" {
+		ma.Transport.SendMessage(peerID, &Message{
+			Type:      "route_update",
+			Source:    ma.Node.ID,
+			Dest:      peerID,
+			Timestamp: time.Now(),
+			Metadata:  map[string]string{"probe_ack": probe},
+			Datagram:  true,
+		})
+	}
+	if ack := msg.Metadata["probe_ack"]; ack != "" {
+		if rtt, ok := ma.routeProbes.answer(peerID, ack, time.Now()); ok {
+			ma.Router.ObserveLink(peerID, rtt, false)
+		}
+	}
 }
 
-func (ma *MeshApp) internetCheckLoop() {
+// saveRouteMetrics persists learned route metrics when a path is configured; ma.mu must not be held
+func (ma *MeshApp) saveRouteMetrics() {
+	path := ma.Config().RouteMetricsPath
+	if path == "" {
+		return
+	}
+	if err := ma.Router.RoutingTable.Metrics.Save(path); err != nil {
+		ma.emitEvent(&Event{Type: EventRouteMetricsError, Detail: err.Error()})
+	}
+}
+
+func (ma *MeshApp) internetCheckLoop(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ma.ctx.Done():
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
 			hasInternet := CheckInternetConnectivity()
@@ -474,10 +1402,11 @@ func (ma *MeshApp) internetCheckLoop() {
 			ma.mu.Lock()
 			changed := ma.Node.HasInternet != hasInternet
 			ma.Node.HasInternet = hasInternet
+			ma.recordInternetCheckLocked(hasInternet)
 			ma.mu.Unlock()
 
 			if changed {
-				ma.Discovery.UpdateInternetStatus(hasInternet)
+				ma.updateProxyAdvertisement()
 
 				if hasInternet && ma.IsInternetSharing {
 					// Re-enable sharing if it was enabled
@@ -491,26 +1420,150 @@ func (ma *MeshApp) internetCheckLoop() {
 	}
 }
 
-func (ma *MeshApp) routingUpdateLoop() {
+// recordInternetCheckLocked records the outcome of a connectivity check; ma.mu must be held
+func (ma *MeshApp) recordInternetCheckLocked(hasInternet bool) {
+	now := time.Now()
+	ma.lastInternetCheck = now
+	if hasInternet {
+		ma.lastInternetOK = now
+	}
+}
+
+// updateProxyAdvertisement announces internet, with our tier, only while the uplink is
+// healthy, any mesh-derived internet is within the relay limit and the battery allows
+func (ma *MeshApp) updateProxyAdvertisement() {
+	ma.Discovery.SetTier(ma.ProxyTier())
+	ma.Discovery.UpdateInternetStatus(ma.Node.GetInternetStatus() && !ma.UplinkMonitor.IsDegraded() &&
+		ma.relayAllowed() && !ma.LowPower())
+}
+
+// uplinkMonitorLoop stops advertising as a proxy while our own uplink is too weak to share
+func (ma *MeshApp) uplinkMonitorLoop(ctx context.Context) {
+	ticker := time.NewTicker(UplinkProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !ma.GetInternetSharingStatus() {
+				continue
+			}
+			changed, degraded := ma.UplinkMonitor.Measure()
+			if !changed {
+				continue
+			}
+			// Existing clients keep working; only new authorizations are paused
+			ma.InternetProxy.PauseAuthorizations(degraded)
+			ma.updateProxyAdvertisement()
+		}
+	}
+}
+
+// componentRetryLoop periodically restarts components that failed to start
+func (ma *MeshApp) componentRetryLoop(ctx context.Context) {
+	ticker := time.NewTicker(ComponentRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ma.retryFailedComponents()
+			ma.connectStaticPeers()
+			ma.retryUnreachablePeers()
+		}
+	}
+}
+
+// retryFailedComponents tries to start components recorded as failed
+func (ma *MeshApp) retryFailedComponents() {
+	ma.mu.Lock()
+	failed := make([]string, 0, len(ma.componentErrs))
+	for name := range ma.componentErrs {
+		failed = append(failed, name)
+	}
+	ma.mu.Unlock()
+
+	for _, name := range failed {
+		var err error
+		switch name {
+		case "transport":
+			err = ma.Transport.Start()
+		case "discovery":
+			err = ma.Discovery.Start()
+		}
+
+		ma.mu.Lock()
+		if err != nil {
+			ma.componentErrs[name] = err
+		} else {
+			delete(ma.componentErrs, name)
+		}
+		ma.mu.Unlock()
+
+		if err == nil {
+			ma.emitEvent(&Event{Type: EventComponentRecovered, Component: name})
+		}
+	}
+}
+
+// connectStaticPeers dials static peers that are not currently connected
+func (ma *MeshApp) connectStaticPeers() {
+	if !ma.Transport.IsRunning() {
+		return
+	}
+
+	ma.mu.RLock()
+	peers := make([]*DiscoveredPeer, 0, len(ma.staticPeers))
+	for _, peer := range ma.staticPeers {
+		peers = append(peers, peer)
+	}
+	ma.mu.RUnlock()
+
+	for _, peer := range peers {
+		ma.connectStaticPeer(peer.ID, peer.IP, peer.Port)
+	}
+}
+
+func (ma *MeshApp) connectStaticPeer(peerID, ip string, port int) error {
+	if err := ma.dialPeer(peerID, ip, port); err != nil {
+		return err
+	}
+	ma.Router.UpdateRoute(peerID, peerID, 1, 10*time.Millisecond)
+	return nil
+}
+
+func (ma *MeshApp) routingUpdateLoop(ctx context.Context) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ma.ctx.Done():
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			// Broadcast routing information to peers
+			// Broadcast routing information to peers, probing each link's latency.
+			// A probe still unanswered from the previous round counts as lost.
 			peers := ma.Transport.GetConnectedPeers()
 			for _, peerID := range peers {
+				probe, lost := ma.routeProbes.next(peerID, time.Now())
+				if lost {
+					ma.Router.ObserveLink(peerID, 0, true)
+				}
 				msg := &Message{
 					Type:      "route_update",
 					Source:    ma.Node.ID,
 					Dest:      peerID,
 					Timestamp: time.Now(),
+					Metadata:  map[string]string{"probe": probe},
+					Datagram:  true,
 				}
 				ma.Transport.SendMessage(peerID, msg)
 			}
+			ma.saveRouteMetrics()
 		}
 	}
 }
@@ -538,3 +1591,21 @@ func (ma *MeshApp) notifyPeerLost(peerID string) {
 		listener.OnPeerLost(peerID)
 	}
 }
+
+func (ma *MeshApp) notifyData(sourceID string, payload []byte) {
+	ma.mu.RLock()
+	listeners := ma.dataListeners
+	ma.mu.RUnlock()
+	for _, listener := range listeners {
+		listener.OnData(sourceID, payload)
+	}
+}
+
+func (ma *MeshApp) notifyExitConsentRequired(peer *DiscoveredPeer) {
+	ma.mu.RLock()
+	listeners := ma.exitConsentListeners
+	ma.mu.RUnlock()
+	for _, listener := range listeners {
+		listener.OnExitConsentRequired(peer.ID, peer.Region, peer.NetworkType)
+	}
+}
@@ -1,6 +1,29 @@
 package mesh
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -224,3 +247,3921 @@ func (tcl *TestConnectionListener) OnConnectionError(err error) {
 		tcl.onError(err)
 	}
 }
+
+// TestExitConsent tests exit consent and exit restrictions
+func TestExitConsent(t *testing.T) {
+	consent := NewExitConsent()
+	peer := &DiscoveredPeer{ID: "proxy-1", Region: "de", HasInternet: true}
+
+	if consent.HasConsent(peer) {
+		t.Error("Expected no consent for a new peer")
+	}
+
+	consent.GrantRegion("DE")
+	if !consent.HasConsent(peer) {
+		t.Error("Expected consent after granting the peer's region")
+	}
+
+	other := &DiscoveredPeer{ID: "proxy-2", Region: "US"}
+	if consent.HasConsent(other) {
+		t.Error("Expected no consent for a peer in another region")
+	}
+	consent.GrantPeer("proxy-2")
+	if !consent.HasConsent(other) {
+		t.Error("Expected consent after granting the peer")
+	}
+
+	if !consent.IsAllowedExit("proxy-1") {
+		t.Error("Expected all exits to be allowed without restrictions")
+	}
+	consent.SetAllowedExits([]string{"proxy-2"})
+	if consent.IsAllowedExit("proxy-1") {
+		t.Error("Expected proxy-1 to be excluded by the exit restriction")
+	}
+	if !consent.IsAllowedExit("proxy-2") {
+		t.Error("Expected proxy-2 to be allowed by the exit restriction")
+	}
+}
+
+type testConsentListener struct {
+	prompted []string
+}
+
+func (l *testConsentListener) OnExitConsentRequired(peerID, region, networkType string) {
+	l.prompted = append(l.prompted, peerID)
+}
+
+// TestExitConsentPrompt tests that an approved exit is used before prompting for a better one
+func TestExitConsentPrompt(t *testing.T) {
+	app := NewMeshApp("client", "Client", "127.0.0.1", "aa:bb:cc:dd:ee:01")
+	app.Transport = NewTransport("client", 0)
+	app.Discovery.macResolver = nil
+	prompts := &testConsentListener{}
+	app.RegisterExitConsentListener(prompts)
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "exit-1", Port: 1, HasInternet: true, MessageType: "announce"}, "127.0.0.1")
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "exit-2", Port: 1, HasInternet: true, Tier: 1, MessageType: "announce"}, "127.0.0.1")
+
+	// Nothing approved: the best exit is offered for approval
+	app.RequestInternetAccess()
+	if !slices.Equal(prompts.prompted, []string{"exit-1"}) {
+		t.Errorf("Expected a prompt for the best exit, got %v", prompts.prompted)
+	}
+
+	// An approved exit is used, even though a better one isn't approved
+	app.ExitConsent.GrantPeer("exit-2")
+	prompts.prompted = nil
+	app.RequestInternetAccess()
+	if len(prompts.prompted) != 0 {
+		t.Errorf("Expected no prompt with an approved exit, got %v", prompts.prompted)
+	}
+}
+
+// TestPausedAuthorizations tests that a proxy with a weak uplink tells new clients it is
+// paused, and that the pause ends with sharing
+func TestPausedAuthorizations(t *testing.T) {
+	proxy := NewMeshApp("proxy", "Proxy", "127.0.0.1", "aa:bb:cc:dd:ee:01")
+	proxy.Transport = NewTransport("proxy", 0)
+	proxy.Transport.SetMessageHandler(proxy.handleMessage)
+	proxy.InternetProxy.port = 0
+	if err := proxy.Transport.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer proxy.Transport.Stop()
+	if err := proxy.InternetProxy.Enable(); err != nil {
+		t.Fatalf("Failed to enable the proxy: %v", err)
+	}
+	defer proxy.InternetProxy.Disable()
+
+	client := NewTransport("client", 0)
+	responses := make(chan *Message, 1)
+	client.SetMessageHandler(func(peerID string, msg *Message) {
+		if msg.Type == "proxy_response" {
+			responses <- msg
+		}
+	})
+	if err := client.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer client.Stop()
+	_, port, _ := net.SplitHostPort(proxy.Transport.ListenAddr())
+	proxyPort, _ := strconv.Atoi(port)
+	if err := client.ConnectToPeer("proxy", "127.0.0.1", proxyPort); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	proxy.InternetProxy.PauseAuthorizations(true)
+	client.SendMessage("proxy", &Message{Type: "proxy_request", Source: "client", Dest: "proxy", Timestamp: time.Now()})
+	select {
+	case msg := <-responses:
+		if msg.Metadata["status"] != "paused" || msg.Metadata["token"] != "" {
+			t.Errorf("Expected a paused answer without a token, got %v", msg.Metadata)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected an answer from a paused proxy")
+	}
+
+	// Sharing off ends the pause and the measurements behind it
+	proxy.UplinkMonitor.SetWindow(3)
+	for i := 0; i < 3; i++ {
+		proxy.UplinkMonitor.Record(0, errors.New("unreachable"))
+	}
+	proxy.DisableInternetSharing()
+	if proxy.InternetProxy.AuthorizationsPaused() || proxy.UplinkMonitor.IsDegraded() {
+		t.Error("Expected the pause to end with sharing")
+	}
+}
+
+// TestSharingTerms tests validation and availability windows of sharing terms
+func TestSharingTerms(t *testing.T) {
+	terms := &SharingTerms{MaxMBPerClient: 100, HoursAvailable: "22:00-06:00"}
+	if err := terms.Validate(); err != nil {
+		t.Fatalf("Expected valid terms, got %v", err)
+	}
+
+	night := time.Date(2024, 1, 1, 23, 30, 0, 0, time.Local)
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	if !terms.IsAvailableAt(night) {
+		t.Error("Expected terms to be available at 23:30")
+	}
+	if terms.IsAvailableAt(noon) {
+		t.Error("Expected terms to be unavailable at 12:00")
+	}
+
+	bad := &SharingTerms{HoursAvailable: "all day"}
+	if err := bad.Validate(); err == nil {
+		t.Error("Expected malformed hours to fail validation")
+	}
+	for _, hours := range []string{"24:59-06:00", "22:00-24:30", "22:00-06:00 and more", "9:00-17:00", "+1:00-06:00", "08:00-08:00"} {
+		if err := (&SharingTerms{HoursAvailable: hours}).Validate(); err == nil {
+			t.Errorf("Expected hours %q to fail validation", hours)
+		}
+	}
+	allDay := &SharingTerms{HoursAvailable: "00:00-24:00"}
+	if allDay.Validate() != nil || !allDay.IsAvailableAt(noon) || !allDay.IsAvailableAt(night) {
+		t.Error("Expected 00:00-24:00 to be available all day")
+	}
+
+	// Hours are read on the sharer's clock once it announces its offset
+	announced := terms.announced(time.Date(2024, 1, 1, 0, 0, 0, 0, time.FixedZone("", 2*3600)))
+	if announced.UTCOffset == nil || *announced.UTCOffset != 120 || terms.UTCOffset != nil {
+		t.Fatalf("Expected the announced terms to carry a +120 minute offset, got %+v", announced)
+	}
+	if !announced.IsAvailableAt(time.Date(2024, 1, 1, 21, 30, 0, 0, time.UTC)) {
+		t.Error("Expected 21:30 UTC, 23:30 for the sharer, to be available")
+	}
+	if announced.IsAvailableAt(time.Date(2024, 1, 1, 4, 30, 0, 0, time.UTC)) {
+		t.Error("Expected 04:30 UTC, 06:30 for the sharer, to be unavailable")
+	}
+
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	if err := app.SetSharingTerms(bad); err == nil {
+		t.Error("Expected SetSharingTerms to reject malformed terms")
+	}
+}
+
+// TestScopedSharing tests an offer limited to some destinations, enforced by the proxy
+// and weighed by clients choosing an exit
+func TestScopedSharing(t *testing.T) {
+	app := NewMeshApp("exit-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	if err := app.SetSharingTerms(&SharingTerms{Destinations: []string{"https://wikipedia.org"}}); err == nil {
+		t.Error("Expected a URL as destination to be rejected")
+	}
+	scoped := &SharingTerms{Destinations: []string{"wikipedia.org", "signal.org"}}
+	if err := app.SetSharingTerms(scoped); err != nil {
+		t.Fatalf("SetSharingTerms failed: %v", err)
+	}
+	token := app.InternetProxy.AuthorizeClient("peer-1")
+	connect := func(host string) int {
+		req := httptest.NewRequest(http.MethodConnect, host, nil)
+		req.Header.Set("Proxy-Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		app.InternetProxy.handleProxy(rec, req)
+		return rec.Code
+	}
+	if code := connect("www.youtube.com:443"); code != http.StatusForbidden {
+		t.Errorf("Expected a destination outside the scope to be refused, got %d", code)
+	}
+	if code := connect("en.wikipedia.org:443"); code == http.StatusForbidden {
+		t.Error("Expected a subdomain of an offered destination to be served")
+	}
+	if standing := app.Abuse.Standing("peer-1", time.Now()); standing != StandingGood {
+		t.Errorf("Expected out-of-scope requests not to count against the client, got %s", standing)
+	}
+
+	// Clients prefer exits that serve anything, and only fetch through scoped ones in scope
+	full := &DiscoveredPeer{ID: "exit-2", Tier: 1}
+	limited := &DiscoveredPeer{ID: "exit-1", Terms: scoped}
+	if betterExit(limited, full) || !betterExit(full, limited) {
+		t.Error("Expected a full exit to win over a scoped one despite its tier")
+	}
+	if !scoped.Serves("signal.org:443") || scoped.Serves("notsignal.org") {
+		t.Error("Expected Serves to match the listed hosts and their subdomains only")
+	}
+	if !scoped.Equal(&SharingTerms{Destinations: []string{"wikipedia.org", "signal.org"}}) || scoped.Equal(&SharingTerms{}) {
+		t.Error("Expected Equal to compare destinations")
+	}
+}
+
+// TestMeshAppHealth tests the health report of a stopped app
+func TestMeshAppHealth(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+
+	report := app.Health()
+	if report.NodeID != "node-1" {
+		t.Errorf("Expected NodeID 'node-1', got '%s'", report.NodeID)
+	}
+
+	for _, name := range []string{"discovery", "transport", "proxy", "client", "internet"} {
+		component, ok := report.Component(name)
+		if !ok {
+			t.Errorf("Expected component %s in report", name)
+			continue
+		}
+		if component.State != HealthDisabled {
+			t.Errorf("Expected %s to be disabled before start, got %s", name, component.State)
+		}
+	}
+
+	if report.Status != HealthOK {
+		t.Errorf("Expected overall status ok when all components are disabled, got %s", report.Status)
+	}
+
+	if _, err := report.JSON(); err != nil {
+		t.Errorf("Expected report to encode as JSON, got %v", err)
+	}
+
+	// A running node answers status queries on its local socket
+	path := filepath.Join(t.TempDir(), "status.sock")
+	if _, err := QueryStatus(path, time.Second); err == nil {
+		t.Error("Expected a query without a running node to fail")
+	}
+	listener, err := ListenStatus(path)
+	if err != nil {
+		t.Fatalf("Failed to open the status socket: %v", err)
+	}
+	defer listener.Close()
+	go app.ServeStatus(listener)
+	remote, err := QueryStatus(path, time.Second)
+	if err != nil || remote.NodeID != "node-1" || remote.Status != HealthOK || len(remote.Components) != len(report.Components) {
+		t.Errorf("Expected the node's report over the socket, got %+v (%v)", remote, err)
+	}
+	if _, err := ListenStatus(path); !errors.Is(err, ErrStatusSocketInUse) {
+		t.Errorf("Expected a second node to be refused the socket, got %v", err)
+	}
+}
+
+// TestMeshAppDegradedStart tests that a discovery failure doesn't abort startup
+func TestMeshAppDegradedStart(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+	app.Transport = NewTransport("node-1", 0)
+	app.Discovery.multicastAddr = "invalid-address"
+
+	var events []*Event
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		events = append(events, e)
+	}})
+
+	if err := app.Start(); err != nil {
+		t.Fatalf("Expected degraded start to succeed, got %v", err)
+	}
+	defer app.Stop()
+
+	if !app.GetConnectionStatus() {
+		t.Error("Expected app to be connected in degraded mode")
+	}
+
+	discovery, _ := app.Health().Component("discovery")
+	if discovery.State != HealthDown || discovery.Reason == "" {
+		t.Errorf("Expected discovery to be down with a reason, got %+v", discovery)
+	}
+
+	if len(events) != 1 || events[0].Type != EventComponentDegraded || events[0].Component != "discovery" {
+		t.Errorf("Expected one component_degraded event for discovery, got %+v", events)
+	}
+}
+
+type testEventListener struct {
+	onEvent func(*Event)
+}
+
+func (l *testEventListener) OnEvent(event *Event) {
+	l.onEvent(event)
+}
+
+// TestPolicyBundle tests signing, validation and enforcement of network policies
+func TestPolicyBundle(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	app := NewMeshApp("member-1", "Member", "192.168.1.2", "aa:bb:cc:dd:ee:01")
+	network := app.PersonalNetworkMgr.CreateNetwork("family", "Family", "owner-1")
+	network.OwnerKey = pub
+
+	bundle := &PolicyBundle{
+		NetworkID:      "family",
+		Version:        1,
+		DefaultQuotaMB: 100,
+		MemberQuotaMB:  map[string]int64{"kid-1": 10},
+		Blocklist:      []string{"example.com"},
+		AllowedExits:   []string{"owner-1"},
+		ContentFilter:  &ContentFilterPolicy{BlockedHosts: []string{"games.example"}},
+	}
+	signed, err := SignPolicyBundle(bundle, priv)
+	if err != nil {
+		t.Fatalf("Failed to sign bundle: %v", err)
+	}
+	if err := app.ApplyPolicy("family", signed); err != nil {
+		t.Fatalf("Expected bundle to apply, got %v", err)
+	}
+
+	if !app.PolicyEngine.IsBlocked("ads.example.com:443") {
+		t.Error("Expected subdomain of blocked host to be blocked")
+	}
+	if app.PolicyEngine.IsBlocked("example.org") {
+		t.Error("Expected unrelated host not to be blocked")
+	}
+	if quota := app.PolicyEngine.QuotaBytes("kid-1"); quota != 10*1024*1024 {
+		t.Errorf("Expected member quota of 10MB, got %d", quota)
+	}
+	if app.ExitConsent.IsAllowedExit("other-exit") {
+		t.Error("Expected exit filter to be applied")
+	}
+	if app.InternetProxy.ContentFilter() == nil {
+		t.Error("Expected the content filter to be applied")
+	}
+
+	// Replaying the same version is rejected
+	if err := app.ApplyPolicy("family", signed); err != ErrPolicyStale {
+		t.Errorf("Expected ErrPolicyStale, got %v", err)
+	}
+
+	// Tampering invalidates the signature
+	bundle.Version = 2
+	tampered, _ := SignPolicyBundle(bundle, priv)
+	tampered.Bundle = []byte(strings.Replace(string(tampered.Bundle), "example.com", "example.net", 1))
+	if err := app.ApplyPolicy("family", tampered); err != ErrPolicySignature {
+		t.Errorf("Expected ErrPolicySignature, got %v", err)
+	}
+
+	// A new version without an exit filter or content filter lifts them
+	signed, _ = SignPolicyBundle(&PolicyBundle{NetworkID: "family", Version: 2}, priv)
+	if err := app.ApplyPolicy("family", signed); err != nil {
+		t.Fatalf("Expected bundle to apply, got %v", err)
+	}
+	if !app.ExitConsent.IsAllowedExit("other-exit") {
+		t.Error("Expected the exit filter to be lifted")
+	}
+	if app.InternetProxy.ContentFilter() != nil {
+		t.Error("Expected the content filter to be lifted")
+	}
+
+	// Unknown fields fail schema validation
+	if _, err := ParsePolicyBundle([]byte(`{"network_id":"family","version":3,"bogus":1}`)); err == nil {
+		t.Error("Expected unknown field to be rejected")
+	}
+}
+
+// TestMessagePolicy tests per-network message type and size limits at send and receive time
+func TestMessagePolicy(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	network := app.PersonalNetworkMgr.CreateNetwork("guest", "Guest", "owner-1")
+	network.OwnerKey = pub
+	network.AddMember(&NetworkMember{NodeID: "guest-1"})
+
+	var violations []*Event
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventPolicyViolation {
+			violations = append(violations, e)
+		}
+	}})
+
+	signed, err := SignPolicyBundle(&PolicyBundle{
+		NetworkID:           "guest",
+		Version:             1,
+		MaxMessageSize:      512,
+		MaxMetadataSize:     64,
+		BlockedMessageTypes: []string{"file_transfer"},
+	}, priv)
+	if err != nil {
+		t.Fatalf("Failed to sign bundle: %v", err)
+	}
+	if err := app.ApplyPolicy("guest", signed); err != nil {
+		t.Fatalf("Expected bundle to apply, got %v", err)
+	}
+
+	small := &Message{Type: "data", Payload: []byte("hello")}
+	if err := app.checkMessagePolicy("guest-1", small, true); err != nil {
+		t.Errorf("Expected small data message to be allowed, got %v", err)
+	}
+	if err := app.checkMessagePolicy("guest-1", &Message{Type: "file_transfer"}, false); !errors.Is(err, ErrMessagePolicy) {
+		t.Errorf("Expected blocked message type to be rejected, got %v", err)
+	}
+	if err := app.checkMessagePolicy("guest-1", &Message{Type: "data", Payload: make([]byte, 1024)}, true); !errors.Is(err, ErrMessagePolicy) {
+		t.Errorf("Expected oversized message to be rejected, got %v", err)
+	}
+	bigMeta := &Message{Type: "data", Metadata: map[string]string{"note": strings.Repeat("x", 100)}}
+	if err := app.checkMessagePolicy("guest-1", bigMeta, true); !errors.Is(err, ErrMessagePolicy) {
+		t.Errorf("Expected oversized metadata to be rejected, got %v", err)
+	}
+	if err := app.checkMessagePolicy("stranger", &Message{Type: "file_transfer"}, true); err != nil {
+		t.Errorf("Expected peers outside the network to be unaffected, got %v", err)
+	}
+	if len(violations) != 3 || violations[0].PeerID != "guest-1" {
+		t.Errorf("Expected three policy_violation events for guest-1, got %d", len(violations))
+	}
+
+	// The transport drops violating messages before they reach the wire
+	receiver := NewTransport("guest-1", 0)
+	received := make(chan *Message, 1)
+	receiver.SetMessageHandler(func(peerID string, msg *Message) { received <- msg })
+	if err := receiver.Start(); err != nil {
+		t.Fatalf("Failed to start receiver: %v", err)
+	}
+	defer receiver.Stop()
+	app.Transport = NewTransport("node-1", 0)
+	app.Transport.SetMessageFilter(app.checkMessagePolicy)
+	_, port, _ := net.SplitHostPort(receiver.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := app.Transport.ConnectToPeer("guest-1", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer app.Transport.Stop()
+	if err := app.Transport.SendMessage("guest-1", &Message{Type: "file_transfer"}); !errors.Is(err, ErrMessagePolicy) {
+		t.Errorf("Expected send of blocked type to fail, got %v", err)
+	}
+	if err := app.Transport.SendMessage("guest-1", small); err != nil {
+		t.Fatalf("Expected allowed message to send, got %v", err)
+	}
+	select {
+	case msg := <-received:
+		if msg.Type != "data" {
+			t.Errorf("Expected only the allowed message to arrive, got %q", msg.Type)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected allowed message to arrive")
+	}
+}
+
+// TestPeerHibernation tests that idle peers go dormant, check in rarely and wake on demand
+func TestPeerHibernation(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ApplyConfig(Config{HibernateAfter: time.Nanosecond})
+	app.Transport = NewTransport("node-1", 0)
+	app.Transport.SetReconnectHandler(app.wakePeer)
+	if err := app.Transport.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer app.Transport.Stop()
+
+	received := make(chan string, 10)
+	peer := NewTransport("peer-1", 0)
+	peer.SetMessageHandler(func(peerID string, msg *Message) { received <- msg.Type })
+	if err := peer.Start(); err != nil {
+		t.Fatalf("Failed to start peer: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(peer.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	app.AddStaticPeer("peer-1", "127.0.0.1", portNum)
+	if err := app.Transport.ConnectToPeer("peer-1", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	expect := func(msgType string) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if got != msgType {
+				t.Errorf("Expected %q message, got %q", msgType, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Expected %q message", msgType)
+		}
+	}
+
+	now := time.Now()
+	app.checkHibernation(now)
+	expect("hibernate")
+	if !app.IsPeerHibernated("peer-1") || len(app.Transport.GetConnectedPeers()) != 0 {
+		t.Fatal("Expected idle peer to be dormant with its connection closed")
+	}
+
+	// Sending to a dormant peer reconnects on demand
+	if err := app.Transport.SendMessage("peer-1", &Message{Type: "data"}); err != nil {
+		t.Fatalf("Expected send to wake the peer, got %v", err)
+	}
+	expect("data")
+	if app.IsPeerHibernated("peer-1") {
+		t.Error("Expected peer to be awake after sending to it")
+	}
+
+	app.checkHibernation(now)
+	expect("hibernate")
+	app.checkHibernation(now.Add(HibernatePresenceInterval + time.Minute))
+	expect("presence")
+
+	// A dormant peer that stops answering presence is eventually lost
+	peer.Stop()
+	for i := 2; i <= hibernateMaxMissedPresence+1; i++ {
+		app.checkHibernation(now.Add(time.Duration(i)*HibernatePresenceInterval + time.Minute))
+	}
+	if app.IsPeerHibernated("peer-1") {
+		t.Error("Expected unreachable dormant peer to be forgotten")
+	}
+}
+
+// TestConnectionPolicy tests that on-demand mode only dials priority peers eagerly
+func TestConnectionPolicy(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ApplyConfig(Config{ConnectPolicy: ConnectOnDemand})
+	app.Transport = NewTransport("node-1", 0)
+	app.Transport.SetReconnectHandler(app.connectOnDemand)
+	if err := app.Transport.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer app.Transport.Stop()
+
+	discover := func(peerID string, hasInternet bool) {
+		peer := NewTransport(peerID, 0)
+		if err := peer.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", peerID, err)
+		}
+		t.Cleanup(peer.Stop)
+		_, port, _ := net.SplitHostPort(peer.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: peerID, Port: portNum, HasInternet: hasInternet}, "127.0.0.1")
+		discovered, _ := app.Discovery.GetPeer(peerID)
+		app.handlePeerDiscovered(discovered)
+	}
+	connected := func(peerID string) bool {
+		for _, id := range app.Transport.GetConnectedPeers() {
+			if id == peerID {
+				return true
+			}
+		}
+		return false
+	}
+
+	discover("bystander", false)
+	if connected("bystander") {
+		t.Error("Expected ordinary peer not to be dialed in on-demand mode")
+	}
+	if _, known := app.DiscoveredPeers["bystander"]; !known {
+		t.Error("Expected undialed peer to still be known")
+	}
+
+	discover("proxy", true)
+	if !connected("proxy") {
+		t.Error("Expected internet-sharing peer to be dialed eagerly")
+	}
+
+	if err := app.Transport.SendMessage("bystander", &Message{Type: "data"}); err != nil {
+		t.Errorf("Expected send to dial the peer on demand, got %v", err)
+	}
+	if !connected("bystander") {
+		t.Error("Expected peer to be connected after sending to it")
+	}
+}
+
+// TestContentFilter tests category blocking and SafeSearch enforcement at the exit
+func TestContentFilter(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	network := app.PersonalNetworkMgr.CreateNetwork("family", "Family", "node-1")
+	network.AddMember(&NetworkMember{NodeID: "member-1"})
+
+	app.SetContentFilter(&ContentFilterPolicy{
+		Categories: []string{CategoryGambling},
+		SafeSearch: true,
+		GuestsOnly: true,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://www.bet365.com/", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+app.InternetProxy.AuthorizeClient("guest-1"))
+	rec := httptest.NewRecorder()
+	app.InternetProxy.handleProxy(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected guest request to blocked category to be forbidden, got %d", rec.Code)
+	}
+
+	filter := app.InternetProxy.ContentFilter()
+	if filter.AppliesTo("member-1") {
+		t.Error("Expected guests-only filter to exempt network members")
+	}
+
+	u, _ := url.Parse("http://www.google.com/search?q=cats")
+	filter.EnforceSafeSearch(u)
+	if u.Query().Get("safe") != "active" {
+		t.Errorf("Expected SafeSearch parameter, got %q", u.RawQuery)
+	}
+	if safe, ok := filter.SafeSearchHost("www.youtube.com:443"); !ok || safe != "restrict.youtube.com" {
+		t.Errorf("Expected restricted YouTube host, got %q", safe)
+	}
+
+	// Listed hosts are blocked for tunnels too, and a network's override replaces the rules
+	// for its members
+	kids := app.PersonalNetworkMgr.CreateNetwork("kids", "Kids", "node-1")
+	kids.AddMember(&NetworkMember{NodeID: "kid-1"})
+	err := app.SetContentFilter(&ContentFilterPolicy{
+		Categories:   []string{CategoryStreaming},
+		BlockedHosts: []string{"Example.org"},
+		Networks: map[string]*ContentFilterPolicy{
+			"kids": {Categories: []string{CategoryGambling}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SetContentFilter failed: %v", err)
+	}
+	connect := func(client, host string) int {
+		req := httptest.NewRequest(http.MethodConnect, host, nil)
+		req.Header.Set("Proxy-Authorization", "Bearer "+app.InternetProxy.AuthorizeClient(client))
+		rec := httptest.NewRecorder()
+		app.InternetProxy.handleProxy(rec, req)
+		return rec.Code
+	}
+	if code := connect("guest-1", "www.netflix.com:443"); code != http.StatusForbidden {
+		t.Errorf("Expected a tunnel to a streaming host to be forbidden, got %d", code)
+	}
+	if code := connect("member-1", "cdn.example.org:443"); code != http.StatusForbidden {
+		t.Errorf("Expected a tunnel to a listed host's subdomain to be forbidden, got %d", code)
+	}
+	if code := connect("kid-1", "www.bet365.com:443"); code != http.StatusForbidden {
+		t.Errorf("Expected the kids network override to block gambling, got %d", code)
+	}
+	filter = app.InternetProxy.ContentFilter()
+	if category := filter.ForClient("kid-1").BlockedCategory("www.netflix.com"); category != "" {
+		t.Errorf("Expected the override to replace the streaming block, got %q", category)
+	}
+	if category := filter.ForClient("member-1").BlockedCategory("example.org"); category != CategoryCustom {
+		t.Errorf("Expected members without an override to get the default rules, got %q", category)
+	}
+	if err := app.SetContentFilter(&ContentFilterPolicy{Categories: []string{"cooking"}}); err == nil {
+		t.Error("Expected an unknown category to be rejected")
+	}
+}
+
+// TestMeshDerivedInternetNotShared tests that internet obtained from the mesh is not re-shared
+func TestMeshDerivedInternetNotShared(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.SetInternetStatus(true)
+
+	if derived, _ := app.InternetMeshDerived(); derived {
+		t.Error("Expected own uplink not to be mesh-derived")
+	}
+
+	app.SetTetheredToMesh(true)
+	if derived, reason := app.InternetMeshDerived(); !derived || reason == "" {
+		t.Error("Expected tethered uplink to be mesh-derived")
+	}
+	if app.EnableInternetSharing() {
+		t.Error("Expected sharing of mesh-derived internet to be refused")
+	}
+	if app.GetInternetSharingStatus() {
+		t.Error("Expected internet sharing to remain disabled")
+	}
+}
+
+// TestRelayTier tests that mesh-derived internet is advertised one tier up when relaying is allowed
+func TestRelayTier(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.SetInternetStatus(true)
+
+	if tier := app.ProxyTier(); tier != 0 {
+		t.Errorf("Expected tier 0 for a direct uplink, got %d", tier)
+	}
+
+	app.SetTetheredToMesh(true)
+	if tier := app.ProxyTier(); tier != 1 {
+		t.Errorf("Expected tier 1 when tethered to a mesh peer, got %d", tier)
+	}
+	if app.relayAllowed() {
+		t.Error("Expected relaying to be disabled by default")
+	}
+
+	app.SetMaxProxyTier(1)
+	if !app.relayAllowed() {
+		t.Error("Expected relaying within the tier limit to be allowed")
+	}
+}
+
+// TestLowPowerRelay tests that sharing stops below the relay threshold on battery and
+// resumes once charging
+func TestLowPowerRelay(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.SetInternetStatus(true)
+	var events []string
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		events = append(events, e.Type)
+	}})
+	advertised := func() bool {
+		app.Discovery.mu.Lock()
+		defer app.Discovery.mu.Unlock()
+		return app.Discovery.hasInternet
+	}
+
+	app.SetPowerStatus(50, false)
+	if app.LowPower() || !app.EnableInternetSharing() {
+		t.Fatal("Expected sharing with half a battery")
+	}
+
+	app.SetPowerStatus(12, false)
+	if !app.LowPower() || app.GetInternetSharingStatus() || advertised() {
+		t.Error("Expected sharing and its advertisement to stop on a low battery")
+	}
+	if app.EnableInternetSharing() {
+		t.Error("Expected sharing to be refused on a low battery")
+	}
+	app.updateProxyAdvertisement()
+	if advertised() {
+		t.Error("Expected internet not to be advertised on a low battery")
+	}
+
+	app.SetPowerStatus(12, true)
+	if app.LowPower() || !app.GetInternetSharingStatus() || !advertised() {
+		t.Error("Expected sharing to resume once plugged in")
+	}
+
+	app.SetPowerStatus(5, false)
+	app.SetMinRelayBattery(0)
+	if app.LowPower() || !app.GetInternetSharingStatus() {
+		t.Error("Expected a zero threshold to relay whatever the charge")
+	}
+	want := []string{EventRelayPaused, EventSharingRefused, EventRelayResumed, EventRelayPaused, EventRelayResumed}
+	if !slices.Equal(events, want) {
+		t.Errorf("Expected events %v, got %v", want, events)
+	}
+}
+
+// TestSuspendResume tests that sockets are released on suspend and restored on resume
+func TestSuspendResume(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+	app.Transport = NewTransport("node-1", 0)
+	app.Discovery.multicastAddr = "invalid-address"
+
+	if err := app.Start(); err != nil {
+		t.Fatalf("Failed to start app: %v", err)
+	}
+	defer app.Stop()
+
+	var events []string
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		events = append(events, e.Type)
+	}})
+
+	app.Suspend()
+	if !app.IsSuspended() {
+		t.Error("Expected app to be suspended")
+	}
+	if app.Transport.IsRunning() {
+		t.Error("Expected transport to be stopped while suspended")
+	}
+	if transport, _ := app.Health().Component("transport"); transport.State != HealthDisabled {
+		t.Errorf("Expected transport to be disabled while suspended, got %+v", transport)
+	}
+
+	app.Resume()
+	if app.IsSuspended() {
+		t.Error("Expected app to be resumed")
+	}
+	if !app.Transport.IsRunning() {
+		t.Error("Expected transport to be restarted on resume")
+	}
+
+	if len(events) == 0 || events[0] != EventSuspended || events[len(events)-1] != EventResumed {
+		t.Errorf("Expected suspended ... resumed events, got %v", events)
+	}
+}
+
+// TestReportPeerSignal tests that radio measurements update peers, proxy choice and route cost
+func TestReportPeerSignal(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ProxyManager.RegisterProxy(&Peer{NodeID: "near", HasInternet: true, RSSI: -80})
+	app.ProxyManager.RegisterProxy(&Peer{NodeID: "far", HasInternet: true, RSSI: -60})
+
+	if app.ReportPeerSignal("unknown", -40, 1) {
+		t.Error("Expected report for an unknown peer to be ignored")
+	}
+	if !app.ReportPeerSignal("near", -40, 0.9) {
+		t.Fatal("Expected report for a registered proxy to be accepted")
+	}
+
+	best, err := app.ProxyManager.SelectBestProxy()
+	if err != nil || best.NodeID != "near" {
+		t.Errorf("Expected 'near' to be selected after its signal improved, got %+v", best)
+	}
+
+	route := app.Router.GetRoute("near")
+	if route == nil || route.Cost != 45 {
+		t.Errorf("Expected direct route with cost 45, got %+v", route)
+	}
+
+	// Later measurements are smoothed rather than replacing the estimate
+	app.ReportPeerSignal("near", -90, 0.9)
+	if best, _ := app.ProxyManager.SelectBestProxy(); best.RSSI <= -90 {
+		t.Errorf("Expected smoothed RSSI above -90, got %d", best.RSSI)
+	}
+}
+
+// TestAuditEvents tests that security-relevant actions reach the audit sinks
+func TestAuditEvents(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatalf("Expected audit log to open, got %v", err)
+	}
+	app.Audit.AddSink(sink)
+
+	app.SetContentFilter(&ContentFilterPolicy{Categories: []string{CategoryGambling}})
+	token := app.InternetProxy.AuthorizeClient("peer-1")
+	req := httptest.NewRequest(http.MethodGet, "http://www.bet365.com/", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+token)
+	app.InternetProxy.handleProxy(httptest.NewRecorder(), req)
+	app.Audit.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected audit log to be readable, got %v", err)
+	}
+	var actions []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var event AuditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Expected JSON audit line, got %q", line)
+		}
+		if event.NodeID != "node-1" {
+			t.Errorf("Expected events from node-1, got %q", event.NodeID)
+		}
+		actions = append(actions, event.Action)
+	}
+	expected := []string{AuditPolicyChanged, AuditPeerAuthorized, AuditBlocklistHit}
+	if strings.Join(actions, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected audit actions %v, got %v", expected, actions)
+	}
+}
+
+// TestRequestTracing tests that the exit records the relay chain's trace and keeps it off the internet
+func TestRequestTracing(t *testing.T) {
+	app := NewMeshApp("exit-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ApplyConfig(Config{ExitAllowlist: []string{"127.0.0.1"}})
+
+	var upstreamTrace string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTrace = r.Header.Get(TraceHeader)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+app.InternetProxy.AuthorizeClient("peer-1"))
+	req.Header.Set(TraceHeader, "trace-1")
+	rec := httptest.NewRecorder()
+	app.InternetProxy.handleProxy(rec, req)
+
+	if upstreamTrace != "" {
+		t.Errorf("Expected trace header to be stripped before the internet, got %q", upstreamTrace)
+	}
+	if got := rec.Header().Get(TraceHeader); got != "trace-1" {
+		t.Errorf("Expected trace ID in the response, got %q", got)
+	}
+	records := app.Traces.Records("trace-1")
+	if len(records) != 1 || records[0].Hop != TraceHopExit || records[0].NodeID != "exit-1" {
+		t.Fatalf("Expected one exit record for the trace, got %+v", records)
+	}
+	if records[0].Status != http.StatusTeapot {
+		t.Errorf("Expected upstream status in the record, got %d", records[0].Status)
+	}
+
+	// The log keeps only the newest records, and a span is recorded once
+	traces := NewTraceLog("node-1", 2)
+	for _, id := range []string{"a", "b", "c"} {
+		span := traces.Start(id, TraceHopLocalProxy, "example.com")
+		span.End(http.StatusOK, "")
+		span.End(http.StatusBadGateway, "late")
+	}
+	all := traces.Records("")
+	if len(all) != 2 || all[0].TraceID != "b" || all[1].TraceID != "c" {
+		t.Errorf("Expected the two newest records, oldest first, got %+v", all)
+	}
+}
+
+// TestOTelTracing tests span context propagation through messages and OTLP export
+func TestOTelTracing(t *testing.T) {
+	var exported otlpExport
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&exported)
+	}))
+	defer collector.Close()
+
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.Tracer.Start(SpanContext{}, "disabled", SpanKindInternal).End()
+	app.ApplyConfig(Config{OTelEndpoint: collector.URL})
+	if app.Tracer.Pending() != 0 {
+		t.Errorf("Expected no spans recorded while tracing was disabled, got %d", app.Tracer.Pending())
+	}
+
+	received := make(chan *Message, 1)
+	peer := NewTransport("peer-1", 0)
+	peer.SetMessageHandler(func(peerID string, msg *Message) { received <- msg })
+	if err := peer.Start(); err != nil {
+		t.Fatalf("Failed to start peer: %v", err)
+	}
+	defer peer.Stop()
+	_, port, _ := net.SplitHostPort(peer.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := app.Transport.ConnectToPeer("peer-1", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer app.Transport.DisconnectPeer("peer-1")
+
+	parent := app.Tracer.Start(SpanContext{}, "request", SpanKindInternal)
+	msg := &Message{Type: "data", Source: "node-1", Dest: "peer-1", Timestamp: time.Now()}
+	parent.Inject(msg)
+	if err := app.Transport.SendMessage("peer-1", msg); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	parent.End()
+
+	select {
+	case got := <-received:
+		sc := MessageSpanContext(got)
+		if sc.TraceID != parent.Context().TraceID || sc.SpanID == parent.Context().SpanID {
+			t.Errorf("Expected the send span's context in the message, got %+v", sc)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected message to arrive")
+	}
+
+	if err := app.Tracer.Export(context.Background(), http.DefaultClient.Do); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	if len(exported.ResourceSpans) != 1 || len(exported.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Expected one resource with one scope, got %+v", exported)
+	}
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Name != "transport.send data" || spans[0].ParentSpanID != parent.Context().SpanID {
+		t.Errorf("Expected send span as child of the request span, got %+v", spans)
+	}
+	if app.Tracer.Pending() != 0 {
+		t.Errorf("Expected exported spans to be cleared, got %d", app.Tracer.Pending())
+	}
+}
+
+// TestExitGuard tests that clients can't reach the sharer's LAN through the exit
+func TestExitGuard(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	guard := app.ExitGuard
+
+	for _, addr := range []string{"192.168.1.1", "10.0.0.1", "172.16.5.4", "127.0.0.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:192.168.1.1"} {
+		if guard.Permitted(net.ParseIP(addr)) {
+			t.Errorf("Expected %s to be refused", addr)
+		}
+	}
+	if !guard.Permitted(net.ParseIP("8.8.8.8")) || !guard.Permitted(net.ParseIP("2001:4860:4860::8888")) {
+		t.Error("Expected public addresses to be permitted")
+	}
+	for _, host := range []string{"localhost:80", "[::1]:443", "192.168.1.1"} {
+		if err := guard.CheckHost(host); !errors.Is(err, ErrDestinationBlocked) {
+			t.Errorf("Expected %s to be refused, got %v", host, err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://192.168.1.1/admin", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+app.InternetProxy.AuthorizeClient("peer-1"))
+	rec := httptest.NewRecorder()
+	app.InternetProxy.handleProxy(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected request into the LAN to be forbidden, got %d", rec.Code)
+	}
+	if _, err := guard.DialContext(context.Background(), "tcp", "127.0.0.1:9"); !errors.Is(err, ErrDestinationBlocked) {
+		t.Errorf("Expected dial to loopback to be refused, got %v", err)
+	}
+
+	app.ApplyConfig(Config{ExitAllowlist: []string{"192.168.1.0/24"}})
+	if !guard.Permitted(net.ParseIP("192.168.1.1")) || guard.Permitted(net.ParseIP("192.168.2.1")) {
+		t.Error("Expected only the allowlisted network to be permitted")
+	}
+	if err := guard.SetAllowlist([]string{"not-an-ip"}); err == nil {
+		t.Error("Expected invalid allowlist entry to be rejected")
+	}
+}
+
+// TestAbuseBlocking tests that banned clients are revoked and the mesh warned about them
+func TestAbuseBlocking(t *testing.T) {
+	app := NewMeshApp("node-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	var banned []string
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventClientBanned {
+			banned = append(banned, e.PeerID)
+		}
+	}})
+
+	neighbor := NewMeshApp("node-2", "Neighbor", "192.168.1.101", "aa:bb:cc:dd:ee:01")
+	neighbor.Transport = NewTransport("node-2", 0)
+	neighbor.Transport.SetMessageHandler(neighbor.handleMessage)
+	if err := neighbor.Transport.Start(); err != nil {
+		t.Fatalf("Failed to start neighbor: %v", err)
+	}
+	defer neighbor.Transport.Stop()
+	neighbor.ApplyConfig(Config{AbusePolicy: AbusePolicy{HonorWarnings: true}})
+	warnings := make(chan *Event, 4)
+	neighbor.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventAbuseWarning {
+			warnings <- e
+		}
+	}})
+	_, port, _ := net.SplitHostPort(neighbor.Transport.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := app.Transport.ConnectToPeer("node-2", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer app.Transport.DisconnectPeer("node-2")
+
+	// Presenting tokens that aren't valid counts against a device, once per interval so a
+	// burst of requests with a forgotten token counts once; persisting gets it banned
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "192.168.1.50:40000"
+		req.Header.Set("Proxy-Authorization", "Bearer guessed-"+strconv.Itoa(i))
+		app.InternetProxy.handleProxy(httptest.NewRecorder(), req)
+	}
+	if scores := app.Abuse.Scores(time.Now()); len(scores) != 1 || scores[0].Offenses[OffenseAuthFailure] != 1 {
+		t.Fatalf("Expected one counted auth failure, got %+v", scores)
+	}
+	for i := 1; i <= 11; i++ {
+		app.Abuse.Record("192.168.1.50", OffenseAuthFailure, time.Now().Add(time.Duration(i)*AbuseAuthFailureInterval))
+	}
+	if got := app.Abuse.Standing("192.168.1.50", time.Now().Add(12*AbuseAuthFailureInterval)); got != StandingBanned {
+		t.Fatalf("Expected the token guesser banned, got %s", got)
+	}
+
+	// A banned peer loses its authorization and the neighbors hear of it
+	app.InternetProxy.AuthorizeClient("peer-x")
+	for i := 0; i < 26; i++ {
+		app.Abuse.Record("peer-x", OffenseBlockedDestination, time.Now())
+	}
+	if app.InternetProxy.IsAuthorized("peer-x") {
+		t.Error("Expected the banned client revoked")
+	}
+	if len(banned) != 2 || banned[0] != "192.168.1.50" || banned[1] != "peer-x" {
+		t.Errorf("Expected both clients banned, got %v", banned)
+	}
+	select {
+	case e := <-warnings:
+		if e.PeerID != "peer-x" || !strings.Contains(e.Detail, "node-1") {
+			t.Errorf("Unexpected warning %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the neighbor to be warned about the banned peer")
+	}
+	scores := neighbor.Abuse.Scores(time.Now())
+	if len(scores) != 1 || scores[0].PeerID != "peer-x" || scores[0].Offenses[OffenseMeshWarning] != 1 {
+		t.Errorf("Expected the honored warning to count against the peer, got %+v", scores)
+	}
+
+	// The policy sets the thresholds and can leave banned clients authorized
+	app.ApplyConfig(Config{AbusePolicy: AbusePolicy{BanScore: 10, KeepAuthorized: true, Quiet: true}})
+	app.InternetProxy.AuthorizeClient("peer-y")
+	for i := 0; i < 6; i++ {
+		app.Abuse.Record("peer-y", OffenseBlockedDestination, time.Now())
+	}
+	if app.Abuse.Standing("peer-y", time.Now()) != StandingBanned || !app.InternetProxy.IsAuthorized("peer-y") {
+		t.Error("Expected the client banned at the configured score and kept authorized")
+	}
+}
+
+// TestUsageLog tests that proxied requests are recorded only once the sharer opts in
+func TestUsageLog(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer site.Close()
+	app.ApplyConfig(Config{ExitAllowlist: []string{"127.0.0.0/8"}})
+	token := app.InternetProxy.AuthorizeClient("peer-1")
+	get := func(target string) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Proxy-Authorization", "Bearer "+token)
+		app.InternetProxy.handleProxy(httptest.NewRecorder(), req)
+	}
+
+	get(site.URL)
+	if app.InternetProxy.UsageLog() != nil {
+		t.Fatal("Expected no usage log until the sharer opts in")
+	}
+
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	sink, err := NewFileUsageSink(path)
+	if err != nil {
+		t.Fatalf("NewFileUsageSink failed: %v", err)
+	}
+	usage := NewUsageLog(UsageRetention{MaxRecords: 3})
+	usage.AddSink(sink)
+	app.InternetProxy.SetUsageLog(usage)
+
+	get(site.URL + "/page")
+	get("http://192.168.1.1/admin")
+	records := usage.Query(UsageQuery{Client: "peer-1"})
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %+v", records)
+	}
+	if r := records[0]; r.Host != "127.0.0.1" || r.Method != http.MethodGet || r.Status != http.StatusOK || r.BytesReceived != 5 || r.Refused != "" {
+		t.Errorf("Unexpected record for the served request: %+v", r)
+	}
+	if r := records[1]; r.Host != "192.168.1.1" || r.Refused != RefusedExitGuard || r.Status != http.StatusForbidden {
+		t.Errorf("Unexpected record for the refused request: %+v", r)
+	}
+	if got := usage.Query(UsageQuery{Host: "192.168.1.1"}); len(got) != 1 {
+		t.Errorf("Expected 1 record for the host, got %d", len(got))
+	}
+	if got := usage.Query(UsageQuery{Client: "peer-2"}); len(got) != 0 {
+		t.Errorf("Expected no records for another client, got %d", len(got))
+	}
+
+	summary := usage.Summary(time.Time{})
+	if len(summary) != 1 || summary[0].Requests != 2 || summary[0].Refused != 1 || summary[0].TopHosts[0] != "127.0.0.1" {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+
+	// Retention keeps the newest records and drops old ones
+	get(site.URL)
+	get(site.URL)
+	if got := usage.Query(UsageQuery{}); len(got) != 3 || got[0].Refused != RefusedExitGuard {
+		t.Errorf("Expected the 3 newest records kept, got %+v", got)
+	}
+	aged := NewUsageLog(UsageRetention{MaxAge: time.Hour})
+	aged.Record(UsageRecord{Time: time.Now().Add(-2 * time.Hour), Client: "peer-2"})
+	aged.Record(UsageRecord{Time: time.Now(), Client: "peer-2"})
+	if got := aged.Query(UsageQuery{}); len(got) != 1 {
+		t.Errorf("Expected records past their age dropped, got %+v", got)
+	}
+
+	usage.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read usage log: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 4 {
+		t.Errorf("Expected 4 records written to the sink, got %d", lines)
+	}
+}
+
+// TestAbuseScoring tests that abusive proxy clients are demoted, banned and can be restored
+func TestAbuseScoring(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	var events []string
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.PeerID == "peer-1" && e.Type != EventTrustChanged {
+			events = append(events, e.Type)
+		}
+	}})
+
+	// Repeated attempts to reach the sharer's LAN demote, then ban the client; once
+	// demoted, its extra requests are rate limited and count against it too
+	token := app.InternetProxy.AuthorizeClient("peer-1")
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://192.168.1.1/admin", nil)
+		req.Header.Set("Proxy-Authorization", "Bearer "+token)
+		app.InternetProxy.handleProxy(httptest.NewRecorder(), req)
+	}
+	if got := app.Abuse.Standing("peer-1", time.Now()); got != StandingBanned {
+		t.Fatalf("Expected client to be banned, got %s", got)
+	}
+	if len(events) != 2 || events[0] != EventClientDemoted || events[1] != EventClientBanned {
+		t.Errorf("Expected demoted then banned events, got %v", events)
+	}
+
+	// The ban revoked the client's token
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	app.InternetProxy.handleProxy(rec, req)
+	if rec.Code != http.StatusProxyAuthRequired || app.InternetProxy.IsAuthorized("peer-1") {
+		t.Errorf("Expected banned client to be refused, got %d", rec.Code)
+	}
+
+	// The ban expires and the score decays
+	later := time.Now().Add(AbuseBanDuration + 4*AbuseScoreHalfLife)
+	if got := app.Abuse.Standing("peer-1", later); got != StandingGood {
+		t.Errorf("Expected client to be forgiven after the ban, got %s", got)
+	}
+
+	// Demoted clients get a lower request rate
+	now := time.Now()
+	app.Abuse.SetOverride("peer-2", StandingDemoted, now)
+	allowed := 0
+	for i := 0; i < 2*abuseDemotedBurst; i++ {
+		if ok, _ := app.Abuse.Allow("peer-2", now); ok {
+			allowed++
+		}
+	}
+	if allowed != abuseDemotedBurst {
+		t.Errorf("Expected %d requests allowed in a burst, got %d", abuseDemotedBurst, allowed)
+	}
+
+	if err := app.SetClientStanding("peer-1", ""); err != nil {
+		t.Fatalf("Failed to clear standing: %v", err)
+	}
+	if ok, standing := app.Abuse.Allow("peer-1", time.Now()); !ok || standing != StandingGood {
+		t.Errorf("Expected manual override to restore the client, got %s", standing)
+	}
+	if err := app.SetClientStanding("peer-1", "vip"); err == nil {
+		t.Error("Expected unknown standing to be rejected")
+	}
+}
+
+// TestPeerTrust tests that a peer's history sets its trust level, which proxy choice follows
+func TestPeerTrust(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	var levels []string
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventTrustChanged && e.PeerID == "bad" {
+			levels = append(levels, e.Detail)
+		}
+	}})
+	app.ProxyManager.RegisterProxy(&Peer{NodeID: "bad", HasInternet: true, RSSI: -40})
+	app.ProxyManager.RegisterProxy(&Peer{NodeID: "plain", HasInternet: true, RSSI: -50})
+	app.ProxyManager.RegisterProxy(&Peer{NodeID: "good", HasInternet: true, RSSI: -80})
+
+	now := time.Now()
+	if got := app.Trust.Level("bad", now); got != TrustNeutral {
+		t.Errorf("Expected unknown peer to be neutral, got %s", got)
+	}
+	app.handleForgedMessage("bad", &Message{}, errors.New("bad signature"))
+	app.handleForgedMessage("bad", &Message{}, errors.New("bad signature"))
+	app.Trust.Record("bad", TrustHandshakeFailed, now)
+	if got := app.Trust.Level("bad", now); got != TrustUntrusted {
+		t.Fatalf("Expected peer with forged messages to be untrusted, got %s", got)
+	}
+	if len(levels) != 2 || !strings.HasPrefix(levels[0], TrustLow) || !strings.HasPrefix(levels[1], TrustUntrusted) {
+		t.Errorf("Expected low then untrusted events, got %v", levels)
+	}
+	trust := app.Trust.Trust("bad", now)
+	if trust.Events[TrustForgedMessage] != 2 || trust.Events[TrustHandshakeFailed] != 1 {
+		t.Errorf("Expected history to be kept, got %v", trust.Events)
+	}
+
+	// Untrusted proxies are skipped, and more trusted ones win over a stronger signal
+	for i := 0; i < 25; i++ {
+		app.Trust.Record("good", TrustRelaySucceeded, now)
+	}
+	if got := app.Trust.Level("good", now); got != TrustHigh {
+		t.Fatalf("Expected peer relaying for us to be highly trusted, got %s", got)
+	}
+	if best, err := app.ProxyManager.SelectBestProxy(); err != nil || best.NodeID != "good" {
+		t.Errorf("Expected the trusted proxy to be selected, got %+v", best)
+	}
+	if app.usableExit(&DiscoveredPeer{ID: "bad", HasInternet: true}) {
+		t.Error("Expected untrusted peer not to be usable as an exit")
+	}
+
+	// Scores drift back to neutral
+	if got := app.Trust.Level("bad", now.Add(4*TrustHalfLife)); got != TrustNeutral {
+		t.Errorf("Expected old history to be forgiven, got %s", got)
+	}
+	if scores := app.Trust.Scores(now); len(scores) != 2 || scores[0].PeerID != "bad" {
+		t.Errorf("Expected least trusted peer first, got %+v", scores)
+	}
+}
+
+// TestProxyBonding tests that a client spreads concurrent requests over its bonded proxies
+func TestProxyBonding(t *testing.T) {
+	newProxy := func(name string, hits *int64, mu *sync.Mutex) (*httptest.Server, string, int) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			*hits++
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte(name))
+		}))
+		u, _ := url.Parse(server.URL)
+		port, _ := strconv.Atoi(u.Port())
+		return server, u.Hostname(), port
+	}
+
+	var mu sync.Mutex
+	var hitsA, hitsB int64
+	proxyA, ipA, portA := newProxy("a", &hitsA, &mu)
+	defer proxyA.Close()
+	proxyB, ipB, portB := newProxy("b", &hitsB, &mu)
+
+	client := NewInternetClient("client")
+	if err := client.AddBondedProxy("proxy-b", ipB, portB); err == nil {
+		t.Error("Expected bonding to require a primary proxy")
+	}
+	if err := client.ConnectToProxy("proxy-a", ipA, portA); err != nil {
+		t.Fatalf("ConnectToProxy failed: %v", err)
+	}
+	if err := client.AddBondedProxy("proxy-b", ipB, portB); err != nil {
+		t.Fatalf("AddBondedProxy failed: %v", err)
+	}
+	if !client.UsesProxy("proxy-a") || !client.UsesProxy("proxy-b") {
+		t.Error("Expected both proxies in use")
+	}
+
+	fetch := func() error {
+		resp, err := client.MakeRequest("http://example.invalid/")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fetch(); err != nil {
+				t.Errorf("Request failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	if hitsA == 0 || hitsB == 0 {
+		t.Errorf("Expected requests on both proxies, got %d and %d", hitsA, hitsB)
+	}
+	mu.Unlock()
+	for _, up := range client.Upstreams() {
+		if up.InFlight != 0 {
+			t.Errorf("Expected no requests in flight on %s, got %d", up.PeerID, up.InFlight)
+		}
+	}
+
+	// A proxy that fails is avoided while the others still work
+	proxyB.Close()
+	var failures atomic.Int64
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if fetch() != nil {
+				failures.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if fetch() != nil {
+		t.Error("Expected requests to avoid the failed proxy")
+	}
+	if failures.Load() == 0 || failures.Load() > 2 {
+		t.Errorf("Expected only requests already scheduled to hit the failed proxy, got %d failures", failures.Load())
+	}
+	for _, up := range client.Upstreams() {
+		if up.PeerID == "proxy-b" && !up.Failing {
+			t.Error("Expected failed proxy to be marked failing")
+		}
+	}
+
+	// The primary proxy can't be removed on its own
+	client.RemoveBondedProxy("proxy-a")
+	client.RemoveBondedProxy("proxy-b")
+	if !client.UsesProxy("proxy-a") || client.UsesProxy("proxy-b") {
+		t.Error("Expected only the bonded proxy to be removed")
+	}
+	client.Disconnect()
+	if client.UsesProxy("proxy-a") {
+		t.Error("Expected no proxies after disconnecting")
+	}
+}
+
+// TestAccessPortal tests that unapproved clients are sent to the access page and can ask for access
+func TestAccessPortal(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	cfg := app.Config()
+	cfg.RequireApproval = true
+	app.ApplyConfig(cfg)
+	var requested []*Event
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventAccessRequested {
+			requested = append(requested, e)
+		}
+	}})
+
+	proxy := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		req.RemoteAddr = "192.168.1.50:50000"
+		rec := httptest.NewRecorder()
+		app.InternetProxy.handleProxy(rec, req)
+		return rec
+	}
+
+	// Plain HTTP is redirected to the access page, which returns to the original page later
+	rec := proxy(http.MethodGet, "http://example.com/news", "")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != portalURL("http://example.com/news") {
+		t.Fatalf("Expected redirect to the access page, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := proxy(http.MethodConnect, "example.com:443", ""); rec.Code != http.StatusForbidden ||
+		!strings.Contains(rec.Body.String(), PortalHost) {
+		t.Errorf("Expected CONNECT to be refused with the access page address, got %d", rec.Code)
+	}
+
+	rec = proxy(http.MethodGet, rec.Header().Get("Location"), "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Request access") {
+		t.Fatalf("Expected the access form, got %d", rec.Code)
+	}
+
+	// Asking for access notifies the user once and shows the request as pending
+	form := url.Values{"name": {"Guest laptop"}, "continue": {"http://example.com/news"}}.Encode()
+	for i := 0; i < 2; i++ {
+		if rec := proxy(http.MethodPost, portalURL(""), form); rec.Code != http.StatusSeeOther {
+			t.Fatalf("Expected redirect after requesting access, got %d", rec.Code)
+		}
+	}
+	if len(requested) != 1 || requested[0].PeerID != "192.168.1.50" || requested[0].Detail != "Guest laptop" {
+		t.Fatalf("Expected one access request event, got %v", requested)
+	}
+	if reqs := app.InternetProxy.AccessRequests(); len(reqs) != 1 || reqs[0].ClientID != "192.168.1.50" {
+		t.Errorf("Expected pending request from the laptop, got %v", reqs)
+	}
+	if rec := proxy(http.MethodGet, portalURL(""), ""); !strings.Contains(rec.Body.String(), "request was sent") {
+		t.Error("Expected the page to show the request as pending")
+	}
+
+	// Once approved the client is proxied and its request is no longer pending
+	app.ApproveAccessRequest("192.168.1.50")
+	if len(app.InternetProxy.AccessRequests()) != 0 {
+		t.Error("Expected no pending requests after approval")
+	}
+	rec = proxy(http.MethodGet, portalURL("http://example.com/news"), "")
+	if !strings.Contains(rec.Body.String(), `href="http://example.com/news"`) {
+		t.Error("Expected a link back to the original page")
+	}
+	if rec := proxy(http.MethodGet, "http://192.168.1.1/", ""); rec.Code == http.StatusFound {
+		t.Error("Expected approved client not to be redirected")
+	}
+
+	// Denied requests are discarded; the client may ask again
+	app.InternetProxy.RevokeClient("192.168.1.50")
+	proxy(http.MethodPost, portalURL(""), form)
+	app.DenyAccessRequest("192.168.1.50")
+	if len(app.InternetProxy.AccessRequests()) != 0 || len(requested) != 2 {
+		t.Errorf("Expected the second request to be denied, got %v", app.InternetProxy.AccessRequests())
+	}
+}
+
+// TestConnectionQuality tests grading of the active proxy path and grade change events
+func TestConnectionQuality(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	var grades []string
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventQualityChanged {
+			grades = append(grades, e.Detail)
+		}
+	}})
+
+	if q := app.ConnectionQuality(); q.Grade != GradeNone {
+		t.Errorf("Expected no grade without a proxy, got %q", q.Grade)
+	}
+
+	payload := strings.Repeat("x", 256*1024)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(payload))
+	}))
+	defer proxy.Close()
+	u, _ := url.Parse(proxy.URL)
+	port, _ := strconv.Atoi(u.Port())
+	if err := app.InternetClient.ConnectToProxy("proxy-1", u.Hostname(), port); err != nil {
+		t.Fatalf("ConnectToProxy failed: %v", err)
+	}
+
+	// A fast, clean path grades A
+	for i := 0; i < 3; i++ {
+		app.Router.ObserveLink("proxy-1", 20*time.Millisecond, false)
+	}
+	resp, err := app.InternetClient.MakeRequest("http://example.invalid/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	q := app.ConnectionQuality()
+	if q.Grade != GradeA || q.ProxyID != "proxy-1" || q.ThroughputKbps <= 0 {
+		t.Errorf("Expected grade A with measured throughput, got %+v", q)
+	}
+	app.checkQuality()
+
+	// Slow, lossy probes drag the grade down
+	for i := 0; i < 20; i++ {
+		app.Router.ObserveLink("proxy-1", 0, true)
+		app.Router.ObserveLink("proxy-1", 700*time.Millisecond, false)
+	}
+	if q := app.ConnectionQuality(); q.Grade != GradeF {
+		t.Errorf("Expected grade F on a slow, lossy path, got %+v", q)
+	}
+	app.checkQuality()
+	app.checkQuality()
+
+	app.InternetClient.Disconnect()
+	app.checkQuality()
+	if len(grades) != 3 || grades[0] != GradeA || grades[1] != GradeF || grades[2] != GradeNone {
+		t.Errorf("Expected A, F and no grade events, got %q", grades)
+	}
+
+	if got := gradeQuality(ConnectionQuality{LatencyMs: 100, ErrorRate: 0.2, ThroughputKbps: 2048}); got != GradeC {
+		t.Errorf("Expected grade C, got %s", got)
+	}
+}
+
+// TestWarmStandby tests that the standby proxy takes over when the primary one is lost
+func TestWarmStandby(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	var failovers []*Event
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventProxyFailover {
+			failovers = append(failovers, e)
+		}
+	}})
+
+	newProxy := func(name string) (*httptest.Server, string, int) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		u, _ := url.Parse(server.URL)
+		port, _ := strconv.Atoi(u.Port())
+		return server, u.Hostname(), port
+	}
+	proxyA, ipA, portA := newProxy("a")
+	proxyB, ipB, portB := newProxy("b")
+	defer proxyB.Close()
+
+	fetch := func() (string, error) {
+		resp, err := app.InternetClient.MakeRequest("http://example.invalid/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if err := app.InternetClient.ConnectToProxy("proxy-a", ipA, portA); err != nil {
+		t.Fatalf("ConnectToProxy failed: %v", err)
+	}
+	if err := app.InternetClient.SetStandby("proxy-b", ipB, portB); err != nil {
+		t.Fatalf("SetStandby failed: %v", err)
+	}
+	if !app.InternetClient.UsesProxy("proxy-b") || app.InternetClient.Standby() != "proxy-b" {
+		t.Error("Expected proxy-b to be the standby")
+	}
+	if body, err := fetch(); err != nil || body != "a" {
+		t.Errorf("Expected requests through the primary while it works, got %q (%v)", body, err)
+	}
+
+	// Once the primary fails, requests use the standby before the loss is noticed
+	proxyA.Close()
+	fetch()
+	if body, err := fetch(); err != nil || body != "b" {
+		t.Errorf("Expected requests through the standby, got %q (%v)", body, err)
+	}
+
+	// Losing the primary promotes the standby
+	app.handleProxyLost("proxy-a")
+	if got := app.InternetClient.ProxyPeerID(); got != "proxy-b" {
+		t.Errorf("Expected proxy-b to be the primary, got %q", got)
+	}
+	if app.InternetClient.Standby() != "" || app.InternetClient.UsesProxy("proxy-a") {
+		t.Error("Expected no standby and the lost proxy dropped")
+	}
+	if len(failovers) != 1 || failovers[0].PeerID != "proxy-b" {
+		t.Errorf("Expected one failover event to proxy-b, got %v", failovers)
+	}
+
+	// Without a standby or bonded proxy there is nothing to fail over to
+	app.handleProxyLost("proxy-b")
+	if got := app.InternetClient.ProxyPeerID(); got != "proxy-b" || len(failovers) != 1 {
+		t.Errorf("Expected the primary to stay without a replacement, got %q", got)
+	}
+}
+
+// TestNetworkChange tests that a reported network change updates the node's address once
+func TestNetworkChange(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	var changes []string
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventNetworkChanged {
+			changes = append(changes, e.Detail)
+		}
+	}})
+
+	app.NetworkChanged("10.0.0.5", "")
+	app.NetworkChanged("10.0.0.5", "")
+	if ip, mac := app.Node.Address(); ip != "10.0.0.5" || mac != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("Expected new IP with the MAC kept, got %s %s", ip, mac)
+	}
+	if len(changes) != 1 || changes[0] != "192.168.1.100 -> 10.0.0.5" {
+		t.Errorf("Expected one network change event, got %q", changes)
+	}
+
+	app.NetworkChanged("10.0.0.5", "11:22:33:44:55:66")
+	if _, mac := app.Node.Address(); mac != "11:22:33:44:55:66" || len(changes) != 2 {
+		t.Errorf("Expected a MAC change to count, got %s after %d events", mac, len(changes))
+	}
+
+	// The OS watcher stops with its context, where the platform supports one
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- watchInterfaces(ctx, func() {}) }()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Error("Expected the interface watcher to stop with its context")
+	}
+}
+
+// TestListPeers tests filtering, sorting and paging the peer list
+func TestListPeers(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "peer-a", Name: "Alice", Port: 9999}, "192.168.1.2")
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "peer-b", Name: "bob", Port: 9999, HasInternet: true, Tier: 1}, "192.168.1.3")
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "peer-c", Name: "Carol", Port: 9999, HasInternet: true}, "192.168.1.4")
+	app.Node.AddPeer(&Peer{NodeID: "peer-d", IP: "192.168.1.5"})
+	app.Node.UpdatePeerSignal("peer-d", -40, 0.9)
+	app.Node.AddPeer(&Peer{NodeID: "peer-b", IP: "192.168.1.3"})
+	app.Node.UpdatePeerSignal("peer-b", -70, 0.5)
+
+	app.Pairing.verified["peer-c"] = time.Now()
+	app.PersonalNetworkMgr.CreateNetwork("home", "Home", "node-1").AddMember(&NetworkMember{NodeID: "peer-a"})
+	app.Abuse.SetOverride("peer-d", StandingBanned, time.Now())
+
+	ids := func(peers []PeerSummary) string {
+		var out []string
+		for _, p := range peers {
+			out = append(out, p.ID)
+		}
+		return strings.Join(out, ",")
+	}
+
+	if got := ids(app.ListPeers(PeerQuery{})); got != "peer-d,peer-a,peer-b,peer-c" {
+		t.Errorf("Expected peers by name with unnamed first, got %s", got)
+	}
+	if got := ids(app.ListPeers(PeerQuery{SortBy: PeerSortSignal})); got != "peer-d,peer-b,peer-a,peer-c" {
+		t.Errorf("Expected strongest signal first, got %s", got)
+	}
+	if got := ids(app.ListPeers(PeerQuery{SortBy: PeerSortInternet, InternetOnly: true})); got != "peer-c,peer-b" {
+		t.Errorf("Expected internet peers by tier, got %s", got)
+	}
+	if got := ids(app.ListPeers(PeerQuery{SortBy: PeerSortTrust})); got != "peer-c,peer-a,peer-b,peer-d" {
+		t.Errorf("Expected most trusted first, got %s", got)
+	}
+	member := TrustMember
+	if got := ids(app.ListPeers(PeerQuery{MinTrust: &member})); got != "peer-a,peer-c" {
+		t.Errorf("Expected only members and verified peers, got %s", got)
+	}
+	if got := app.ListPeers(PeerQuery{Network: "home"}); len(got) != 1 || got[0].ID != "peer-a" || got[0].Networks[0] != "home" {
+		t.Errorf("Expected only the home network member, got %+v", got)
+	}
+	if got := ids(app.ListPeers(PeerQuery{Offset: 1, Limit: 2})); got != "peer-a,peer-b" {
+		t.Errorf("Expected the second page, got %s", got)
+	}
+	if got := app.ListPeers(PeerQuery{Offset: 10}); len(got) != 0 {
+		t.Errorf("Expected an empty page past the end, got %d peers", len(got))
+	}
+}
+
+// TestNetworkStats tests that a network owner collects summed stats from paired members
+func TestNetworkStats(t *testing.T) {
+	newNode := func(id string) *MeshApp {
+		app := NewMeshApp(id, id, "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+		app.Transport = NewTransport(id, 0)
+		app.Transport.SetMessageHandler(app.handleMessage)
+		if err := app.Transport.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", id, err)
+		}
+		t.Cleanup(app.Transport.Stop)
+		return app
+	}
+	owner := newNode("owner")
+	member := newNode("member")
+	pair := func(a, b *MeshApp) {
+		key := []byte("shared pairing key")
+		a.Pairing.verified[b.Node.ID], a.Pairing.keys[b.Node.ID] = time.Now(), key
+		b.Pairing.verified[a.Node.ID], b.Pairing.keys[a.Node.ID] = time.Now(), key
+	}
+	pair(owner, member)
+
+	network := owner.PersonalNetworkMgr.CreateNetwork("home", "Home", "owner")
+	network.AddMember(&NetworkMember{NodeID: "member"})
+	network.AddMember(&NetworkMember{NodeID: "absent"})
+	member.PersonalNetworkMgr.CreateNetwork("home", "Home", "owner")
+	member.InternetProxy.relayed.Add(4096)
+	member.sharing.setSharing(true, time.Now().Add(-30*time.Minute))
+
+	_, port, _ := net.SplitHostPort(member.Transport.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := owner.Transport.ConnectToPeer("member", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	usage, err := owner.CollectNetworkStats("home", 2*time.Second)
+	if err != nil {
+		t.Fatalf("CollectNetworkStats failed: %v", err)
+	}
+	if usage.Members != 2 || usage.Responded != 1 {
+		t.Errorf("Expected one of two members to answer, got %d of %d", usage.Responded, usage.Members)
+	}
+	if usage.RelayedBytes != 4096 || usage.ConnectedPeers != 1 {
+		t.Errorf("Expected the member's counters, got %+v", usage)
+	}
+	var hours float64
+	for _, h := range usage.SharingHours {
+		hours += h
+	}
+	if hours < 0.49 || hours > 0.51 {
+		t.Errorf("Expected half an hour of sharing, got %.2f", hours)
+	}
+
+	// Only the owner may collect, and members only answer the owner
+	if _, err := member.CollectNetworkStats("home", time.Second); !errors.Is(err, ErrNotNetworkOwner) {
+		t.Errorf("Expected a member to be refused, got %v", err)
+	}
+	if _, err := member.memberStatsPayload("member", "home"); !errors.Is(err, ErrNotNetworkOwner) {
+		t.Errorf("Expected stats to be refused to anyone but the owner, got %v", err)
+	}
+}
+
+// TestConfigBundle tests moving settings and trust to a new device through an encrypted bundle
+func TestConfigBundle(t *testing.T) {
+	old := NewMeshApp("node-1", "Old Phone", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	old.ApplyConfig(Config{MaxBondedProxies: 3, RequireApproval: true})
+	old.Pairing.verified["peer-1"], old.Pairing.keys["peer-1"] = time.Now(), []byte("pairing key")
+	old.MACFilter.Deny("11:22:33:44:55:66")
+	old.ProxyACL.DenyPeer("freeloader")
+	old.ExitConsent.GrantRegion("DE")
+	old.AddStaticPeer("gateway", "10.0.0.1", 9999)
+	home := old.PersonalNetworkMgr.CreateNetwork("home", "Home", "node-1")
+	home.AddMember(&NetworkMember{NodeID: "peer-1", IsProxy: true})
+	home.SetPolicies(&NetworkPolicy{AllowInternet: true, BlockedMessageTypes: []string{"file_transfer"}})
+
+	bundle, err := old.ExportConfig("correct horse", true)
+	if err != nil {
+		t.Fatalf("ExportConfig failed: %v", err)
+	}
+	if bytes.Contains(bundle, []byte("pairing key")) || bytes.Contains(bundle, []byte("Home")) {
+		t.Error("Expected the bundle to be encrypted")
+	}
+	if _, err := OpenConfigBundle(bundle, "wrong"); !errors.Is(err, ErrBundlePassphrase) {
+		t.Errorf("Expected a wrong passphrase to fail, got %v", err)
+	}
+	if _, err := NewMeshApp("node-2", "", "", "").ImportConfig(bundle, "correct horse"); !errors.Is(err, ErrBundleIdentity) {
+		t.Errorf("Expected another node's identity to be refused, got %v", err)
+	}
+
+	opened, err := OpenConfigBundle(bundle, "correct horse")
+	if err != nil || opened.Identity.NodeID != "node-1" {
+		t.Fatalf("Expected to read the identity, got %+v (%v)", opened, err)
+	}
+	moved := NewMeshApp(opened.Identity.NodeID, "", "10.0.0.5", "aa:bb:cc:dd:ee:00")
+	if _, err := moved.ImportConfig(bundle, "correct horse"); err != nil {
+		t.Fatalf("ImportConfig failed: %v", err)
+	}
+	if moved.Node.Name != "Old Phone" || moved.Config().MaxBondedProxies != 3 || !moved.Config().RequireApproval {
+		t.Errorf("Expected settings to move, got %q %+v", moved.Node.Name, moved.Config())
+	}
+	if key, ok := moved.Pairing.key("peer-1"); !ok || string(key) != "pairing key" {
+		t.Error("Expected the verified peer to move with its key")
+	}
+	if moved.MACFilter.Allowed("11:22:33:44:55:66") || !moved.ExitConsent.HasConsent(&DiscoveredPeer{ID: "x", Region: "DE"}) {
+		t.Error("Expected MAC rules and exit consent to move")
+	}
+	if moved.ProxyACL.Permitted("freeloader") {
+		t.Error("Expected the proxy access list to move")
+	}
+	if _, ok := moved.staticPeers["gateway"]; !ok {
+		t.Error("Expected the static peer to move")
+	}
+	network, ok := moved.PersonalNetworkMgr.GetNetwork("home")
+	if !ok || !network.IsMember("peer-1") || network.CheckMessage(&Message{Type: "file_transfer"}) == nil {
+		t.Error("Expected the network to move with its members and policy")
+	}
+
+	// Without the identity any node can import the settings
+	anonymous, _ := old.ExportConfig("correct horse", false)
+	if _, err := NewMeshApp("node-2", "", "", "").ImportConfig(anonymous, "correct horse"); err != nil {
+		t.Errorf("Expected a bundle without identity to import anywhere, got %v", err)
+	}
+}
+
+// TestPolicyDryRun tests evaluating a policy bundle against recent exit traffic
+func TestPolicyDryRun(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.SetContentFilter(&ContentFilterPolicy{Categories: []string{CategoryGambling}})
+	req := httptest.NewRequest(http.MethodGet, "http://www.bet365.com/", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+app.InternetProxy.AuthorizeClient("guest-2"))
+	app.InternetProxy.handleProxy(httptest.NewRecorder(), req)
+
+	now := time.Now()
+	for _, record := range []trafficRecord{
+		{Client: "member-1", Host: "news.example.com", Bytes: 2 << 20},
+		{Client: "member-1", Host: "cdn.test", Bytes: 1 << 20},
+		{Client: "member-1", Host: "cdn.test", Bytes: 1 << 20},
+		{Client: "guest-1", Host: "cdn.test", Bytes: 100},
+		{Client: "member-1", Host: "cdn.test", Bytes: 1 << 20},
+	} {
+		record.At = now
+		app.InternetProxy.history.add(record)
+	}
+
+	report, err := app.DryRunPolicy(&PolicyBundle{
+		NetworkID:      "family",
+		Version:        1,
+		Blocklist:      []string{"example.com"},
+		DefaultQuotaMB: 2,
+	})
+	if err != nil {
+		t.Fatalf("DryRunPolicy failed: %v", err)
+	}
+	if report.Requests != 6 || report.Refused != 2 || report.NewlyRefused != 2 || report.Released != 1 {
+		t.Errorf("Expected 2 of 6 requests refused and the filtered one released, got %+v", report)
+	}
+	if len(report.Hits) != 2 || report.Hits[0].Host != "cdn.test" || report.Hits[0].Reason != RefusedQuota ||
+		report.Hits[1].Host != "news.example.com" || report.Hits[1].Reason != RefusedBlocklist {
+		t.Errorf("Expected a quota and a blocklist hit, got %+v", report.Hits)
+	}
+	if len(report.Clients) != 1 || report.Clients[0].Client != "member-1" || !report.Clients[0].OverQuota {
+		t.Errorf("Expected only member-1 to be affected, got %+v", report.Clients)
+	}
+
+	// Nothing is applied
+	if _, active := app.PolicyEngine.Active("family"); active || app.PolicyEngine.IsBlocked("news.example.com") {
+		t.Error("Expected the dry run not to apply the bundle")
+	}
+	if _, err := app.DryRunPolicy(&PolicyBundle{NetworkID: "family"}); err == nil {
+		t.Error("Expected an invalid bundle to be rejected")
+	}
+}
+
+// TestDialBackoff tests that unreachable peers are redialed with backoff and reported apart from lost ones
+func TestDialBackoff(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.Transport = NewTransport("node-1", 0)
+	if err := app.Transport.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer app.Transport.Stop()
+	var events []string
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventPeerUnreachable || e.Type == EventPeerReachable {
+			events = append(events, e.Type)
+		}
+	}})
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "peer-1", Port: deadPort, HasInternet: true}, "127.0.0.1")
+	discovered, _ := app.Discovery.GetPeer("peer-1")
+	app.handlePeerDiscovered(discovered)
+
+	state, unreachable := app.PeerDialState("peer-1")
+	if !unreachable || state.Failures != 1 {
+		t.Fatalf("Expected peer-1 to be unreachable after a failed dial, got %+v", state)
+	}
+	if wait := time.Until(state.NextAttempt); wait < time.Second || wait > 3*time.Second {
+		t.Errorf("Expected the first retry in about %v, got %v", DialBackoffBase, wait)
+	}
+	if app.connectOnDemand("peer-1") {
+		t.Error("Expected no dial before the backoff runs out")
+	}
+	if state, _ := app.PeerDialState("peer-1"); state.Failures != 1 {
+		t.Errorf("Expected a skipped dial not to count as a failure, got %d", state.Failures)
+	}
+	if peers := app.ListPeers(PeerQuery{}); len(peers) != 1 || !peers[0].Unreachable {
+		t.Errorf("Expected the peer list to show peer-1 unreachable, got %+v", peers)
+	}
+
+	// Each failure doubles the wait up to the cap
+	backoff := newDialBackoff()
+	now := time.Now()
+	for i := 0; i < 12; i++ {
+		backoff.failed("x", errors.New("refused"), now)
+	}
+	if s, _ := backoff.state("x"); s.NextAttempt.Sub(now) > DialBackoffMax*6/5 || s.NextAttempt.Sub(now) < DialBackoffMax*4/5 {
+		t.Errorf("Expected the wait to be capped near %v, got %v", DialBackoffMax, s.NextAttempt.Sub(now))
+	}
+
+	// Once due, the peer is retried at its current address
+	peer := NewTransport("peer-1", 0)
+	if err := peer.Start(); err != nil {
+		t.Fatalf("Failed to start peer: %v", err)
+	}
+	defer peer.Stop()
+	_, port, _ := net.SplitHostPort(peer.ListenAddr())
+	livePort, _ := strconv.Atoi(port)
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "peer-1", Port: livePort, HasInternet: true}, "127.0.0.1")
+	app.dials.mu.Lock()
+	app.dials.peers["peer-1"].NextAttempt = time.Now()
+	app.dials.mu.Unlock()
+	app.retryUnreachablePeers()
+
+	if _, unreachable := app.PeerDialState("peer-1"); unreachable {
+		t.Error("Expected a successful dial to clear the unreachable state")
+	}
+	if strings.Join(events, ",") != "peer_unreachable,peer_reachable" {
+		t.Errorf("Expected unreachable then reachable events, got %v", events)
+	}
+}
+
+// TestIncomingPeerVerification tests that connections are checked against discovery
+func TestIncomingPeerVerification(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	var flagged []string
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventPeerUnverified {
+			flagged = append(flagged, e.PeerID)
+		}
+	}})
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "peer-1", Port: 9999}, "192.168.1.2")
+	app.AddStaticPeer("peer-s", "10.0.0.9", 9999)
+
+	from := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+	if err := app.verifyIncomingPeer("peer-1", from("192.168.1.2")); err != nil {
+		t.Errorf("Expected a discovered peer at its address to pass, got %v", err)
+	}
+	if err := app.verifyIncomingPeer("peer-s", from("::ffff:10.0.0.9")); err != nil {
+		t.Errorf("Expected a static peer at its address to pass, got %v", err)
+	}
+	if err := app.verifyIncomingPeer("peer-1", from("192.168.1.66")); err != nil {
+		t.Errorf("Expected mismatches to only be flagged by default, got %v", err)
+	}
+	app.verifyIncomingPeer("ghost", from("192.168.1.66"))
+	if strings.Join(flagged, ",") != "peer-1,ghost" {
+		t.Errorf("Expected the spoofed and unknown peers to be flagged, got %v", flagged)
+	}
+
+	// With the policy on, an unknown node's connection is closed
+	cfg := app.Config()
+	cfg.RejectUnverified = true
+	app.ApplyConfig(cfg)
+	if err := app.verifyIncomingPeer("peer-1", from("192.168.1.66")); !errors.Is(err, ErrPeerUnverified) {
+		t.Errorf("Expected a mismatched address to be refused, got %v", err)
+	}
+
+	app.Transport = NewTransport("node-1", 0)
+	app.Transport.SetConnectionVerifier(app.verifyIncomingPeer)
+	if err := app.Transport.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer app.Transport.Stop()
+	_, port, _ := net.SplitHostPort(app.Transport.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	spoofer := NewTransport("ghost", 0)
+	if err := spoofer.ConnectToPeer("node-1", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if peers := app.Transport.GetConnectedPeers(); len(peers) != 0 {
+		t.Error("Expected the unknown peer's connection to be refused")
+	}
+}
+
+// TestHopLimit tests that forwarded messages lose a hop and are dropped when out of hops
+func TestHopLimit(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.Transport = NewTransport("node-1", 0)
+	received := make(chan *Message, 2)
+	peer := NewTransport("peer-1", 0)
+	peer.SetMessageHandler(func(peerID string, msg *Message) { received <- msg })
+	if err := peer.Start(); err != nil {
+		t.Fatalf("Failed to start peer: %v", err)
+	}
+	defer peer.Stop()
+	_, port, _ := net.SplitHostPort(peer.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := app.Transport.ConnectToPeer("peer-1", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer app.Transport.DisconnectPeer("peer-1")
+	app.Router.UpdateRoute("node-x", "peer-1", 2, 10*time.Millisecond)
+
+	next := func() *Message {
+		t.Helper()
+		select {
+		case msg := <-received:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected a message")
+			return nil
+		}
+	}
+
+	app.handleDataMessage("peer-1", &Message{Type: "data", Source: "node-s", Dest: "node-x", HopLimit: 3})
+	if got := next(); got.Type != "data" || got.HopLimit != 2 {
+		t.Errorf("Expected the message forwarded with 2 hops left, got %+v", got)
+	}
+	app.handleDataMessage("peer-1", &Message{Type: "data", Source: "node-s", Dest: "node-x"})
+	if got := next(); got.HopLimit != DefaultHopLimit-1 {
+		t.Errorf("Expected unlimited messages to start from the default, got %d", got.HopLimit)
+	}
+
+	// Out of hops, the message is dropped and its source told through the peer it came from
+	app.handleDataMessage("peer-1", &Message{Type: "data", Source: "node-s", Dest: "node-x", HopLimit: 1})
+	got := next()
+	if got.Type != "hop_limit_exceeded" || got.Dest != "node-s" || got.Metadata["dest"] != "node-x" {
+		t.Errorf("Expected a hop limit report to node-s, got %+v", got)
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("Expected the exhausted message to be dropped, got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var events []*Event
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) { events = append(events, e) }})
+	got.Dest = "node-1"
+	app.handleMessage("peer-1", got)
+	if len(events) != 1 || events[0].Type != EventHopLimitExceeded || events[0].PeerID != "node-1" {
+		t.Errorf("Expected a hop limit event, got %+v", events)
+	}
+}
+
+// TestSourceRouting tests that relays follow a message's hop list only when enabled
+func TestSourceRouting(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.Transport = NewTransport("node-1", 0)
+	received := make(map[string]chan *Message)
+	for _, id := range []string{"node-s", "node-n"} {
+		ch := make(chan *Message, 4)
+		received[id] = ch
+		peer := NewTransport(id, 0)
+		peer.SetMessageHandler(func(peerID string, msg *Message) { ch <- msg })
+		if err := peer.Start(); err != nil {
+			t.Fatalf("Failed to start peer: %v", err)
+		}
+		defer peer.Stop()
+		_, port, _ := net.SplitHostPort(peer.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		if err := app.Transport.ConnectToPeer(id, "127.0.0.1", portNum); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer app.Transport.DisconnectPeer(id)
+	}
+	next := func(id string) *Message {
+		t.Helper()
+		select {
+		case msg := <-received[id]:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected a message at %s", id)
+			return nil
+		}
+	}
+	routed := &Message{Type: "data", Source: "node-s", Dest: "node-d", Route: []string{"node-1", "node-n"}}
+
+	app.handleDataMessage("node-s", routed)
+	if got := next("node-s"); got.Type != "source_route_failed" || got.Metadata["reason"] != "source routing disabled" {
+		t.Errorf("Expected relays to refuse source routes by default, got %+v", got)
+	}
+
+	cfg := app.Config()
+	cfg.SourceRouting = true
+	app.ApplyConfig(cfg)
+	app.handleDataMessage("node-s", routed)
+	if got := next("node-n"); got.Dest != "node-d" || got.HopLimit != DefaultHopLimit-1 {
+		t.Errorf("Expected the message relayed to the next listed hop, got %+v", got)
+	}
+	app.handleDataMessage("node-s", &Message{Type: "data", Source: "node-s", Dest: "node-d", Route: []string{"node-1", "node-q"}})
+	if got := next("node-s"); !strings.Contains(got.Metadata["reason"], "node-q") {
+		t.Errorf("Expected an unreachable next hop to be reported, got %+v", got)
+	}
+	if hop, _ := nextSourceHop(&Message{Dest: "node-d", Route: []string{"node-a", "node-1"}}, "node-1"); hop != "node-d" {
+		t.Errorf("Expected the last relay to deliver to the destination, got %s", hop)
+	}
+
+	if err := app.SendSourceRouted(&Message{Type: "data", Dest: "node-d"}, nil); !errors.Is(err, ErrSourceRoute) {
+		t.Errorf("Expected an empty route to be refused, got %v", err)
+	}
+	if err := app.SendSourceRouted(&Message{Type: "data", Dest: "node-d"}, []string{"node-n", "node-d"}); !errors.Is(err, ErrSourceRoute) {
+		t.Errorf("Expected the destination as a relay to be refused, got %v", err)
+	}
+	if err := app.SendSourceRouted(&Message{Type: "data", Dest: "node-d"}, []string{"node-n", "node-x"}); err != nil {
+		t.Fatalf("SendSourceRouted failed: %v", err)
+	}
+	if got := next("node-n"); got.Source != "node-1" || strings.Join(got.Route, ",") != "node-n,node-x" {
+		t.Errorf("Expected the message sent to the first relay with its route, got %+v", got)
+	}
+
+	var events []*Event
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) { events = append(events, e) }})
+	app.handleMessage("node-n", &Message{Type: "source_route_failed", Source: "node-x", Dest: "node-1", Metadata: map[string]string{"dest": "node-d", "reason": "relay not on the route"}})
+	if len(events) != 1 || events[0].Type != EventSourceRouteFailed || events[0].PeerID != "node-x" {
+		t.Errorf("Expected a source route event, got %+v", events)
+	}
+}
+
+// TestInternetClientTunnels tests requests and CONNECT tunnels through a local exit
+func TestInternetClientTunnels(t *testing.T) {
+	app := NewMeshApp("exit-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ApplyConfig(Config{ExitAllowlist: []string{"127.0.0.1"}})
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer site.Close()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	exit := httptest.NewServer(http.HandlerFunc(app.InternetProxy.handleProxy))
+	defer exit.Close()
+	u, _ := url.Parse(exit.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	client := NewInternetClient("peer-1")
+	if _, err := client.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Error("Expected tunnels to fail before connecting to a proxy")
+	}
+	if err := client.ConnectToProxy("exit-1", u.Hostname(), port); err != nil {
+		t.Fatalf("ConnectToProxy failed: %v", err)
+	}
+	if _, err := client.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("Expected a tunnel without our token to be refused, got %v", err)
+	}
+	client.SetProxyToken("exit-1", app.InternetProxy.AuthorizeClient("peer-1"))
+
+	resp, err := client.MakeRequest(site.URL)
+	if err != nil {
+		t.Fatalf("Request through the proxy failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" || app.InternetProxy.ClientUsage("peer-1") == 0 {
+		t.Errorf("Expected the request served by the exit, got %q", body)
+	}
+
+	conn, err := client.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected echo through the tunnel, got %q (%v)", buf, err)
+	}
+	if up := client.Upstreams()[0]; up.InFlight != 1 {
+		t.Errorf("Expected the open tunnel in flight, got %+v", up)
+	}
+	conn.Close()
+	conn.Close()
+	if up := client.Upstreams()[0]; up.InFlight != 0 || up.Failing {
+		t.Errorf("Expected the closed tunnel released, got %+v", up)
+	}
+
+	// A destination the exit refuses isn't the proxy failing
+	if _, err := client.DialContext(context.Background(), "tcp", "192.168.1.1:22"); err == nil {
+		t.Error("Expected a tunnel into the sharer's LAN to be refused")
+	}
+	if _, err := client.DialContext(context.Background(), "udp", echo.Addr().String()); err == nil {
+		t.Error("Expected UDP to be refused")
+	}
+	if up := client.Upstreams()[0]; up.Failing {
+		t.Errorf("Expected the proxy still healthy, got %+v", up)
+	}
+
+	exit.Close()
+	if _, err := client.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatal("Expected a tunnel through a lost proxy to fail")
+	}
+	if up := client.Upstreams()[0]; !up.Failing {
+		t.Errorf("Expected the lost proxy to be avoided, got %+v", up)
+	}
+}
+
+// TestProxyReauthorization tests that a client refused for its token asks the proxy again
+func TestProxyReauthorization(t *testing.T) {
+	app := NewMeshApp("exit-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ApplyConfig(Config{ExitAllowlist: []string{"127.0.0.1"}})
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer site.Close()
+	exit := httptest.NewServer(http.HandlerFunc(app.InternetProxy.handleProxy))
+	defer exit.Close()
+	u, _ := url.Parse(exit.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	client := NewInternetClient("peer-1")
+	asked := make(chan string, 4)
+	client.SetAuthRequiredHandler(func(proxyPeerID string) { asked <- proxyPeerID })
+	if err := client.ConnectToProxy("exit-1", u.Hostname(), port); err != nil {
+		t.Fatalf("ConnectToProxy failed: %v", err)
+	}
+	fetch := func() int {
+		resp, err := client.MakeRequest(site.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The exit forgot the token it issued, e.g. after a restart
+	client.SetProxyToken("exit-1", "forgotten")
+	app.InternetProxy.AuthorizeClient("peer-1")
+	if code := fetch(); code != http.StatusProxyAuthRequired {
+		t.Fatalf("Expected the stale token refused, got %d", code)
+	}
+	select {
+	case got := <-asked:
+		if got != "exit-1" {
+			t.Errorf("Expected access asked of exit-1, got %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the client to ask the proxy for access again")
+	}
+	fetch()
+	if _, err := client.DialContext(context.Background(), "tcp", "example.com:443"); err == nil {
+		t.Error("Expected the tunnel refused too")
+	}
+	select {
+	case <-asked:
+		t.Error("Expected access asked at most once per interval")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The proxy's answer carries a token that works
+	client.SetProxyToken("exit-1", app.InternetProxy.AuthorizeClient("peer-1"))
+	if code := fetch(); code != http.StatusOK {
+		t.Errorf("Expected the new token accepted, got %d", code)
+	}
+}
+
+// TestProxyTokens tests that the exit only serves clients presenting the token it issued them
+func TestProxyTokens(t *testing.T) {
+	app := NewMeshApp("exit-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ApplyConfig(Config{ExitAllowlist: []string{"127.0.0.1"}})
+
+	var leaked []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = append(leaked, r.Header.Get("Proxy-Authorization")+r.Header.Get(ClientNodeHeader))
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	exit := httptest.NewServer(http.HandlerFunc(app.InternetProxy.handleProxy))
+	defer exit.Close()
+	u, _ := url.Parse(exit.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	client := NewInternetClient("peer-1")
+	if err := client.ConnectToProxy("exit-1", u.Hostname(), port); err != nil {
+		t.Fatalf("ConnectToProxy failed: %v", err)
+	}
+	fetch := func() int {
+		resp, err := client.MakeRequest(upstream.URL + "/")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Being authorized isn't enough: the node ID a client claims proves nothing
+	token := app.InternetProxy.AuthorizeClient("peer-1")
+	if code := fetch(); code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected a client without its token to be refused, got %d", code)
+	}
+	client.SetProxyToken("exit-1", token)
+	if code := fetch(); code != http.StatusOK {
+		t.Errorf("Expected the client with its token to be served, got %d", code)
+	}
+	if len(leaked) != 1 || leaked[0] != "" {
+		t.Errorf("Expected credentials to stay off the internet, got %q", leaked)
+	}
+	if again := app.InternetProxy.AuthorizeClient("peer-1"); again != token {
+		t.Error("Expected a client authorized again to keep its token")
+	}
+
+	client.SetProxyToken("exit-1", "forged")
+	if code := fetch(); code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected a forged token to be refused, got %d", code)
+	}
+	client.SetProxyToken("exit-1", token)
+	app.InternetProxy.RevokeClient("peer-1")
+	if code := fetch(); code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected a revoked client's token to be refused, got %d", code)
+	}
+
+	// Tunnels present the token with their CONNECT
+	req := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	app.InternetProxy.handleProxy(rec, req)
+	if rec.Code != http.StatusProxyAuthRequired || rec.Header().Get("Proxy-Authenticate") == "" {
+		t.Errorf("Expected a CONNECT with a revoked token to be asked for one, got %d", rec.Code)
+	}
+
+	// Clients keep the token that comes with the proxy's authorization
+	app.handleProxyResponse("exit-2", &Message{Type: "proxy_response", Metadata: map[string]string{"status": "authorized", "token": "t-2"}})
+	if got := app.InternetClient.proxyURL(&upstreamProxy{peerID: "exit-2", url: &url.URL{Host: "proxy"}}); got.User == nil {
+		t.Error("Expected the issued token to be presented to the proxy")
+	} else if password, _ := got.User.Password(); password != "t-2" {
+		t.Errorf("Expected token t-2, got %q", password)
+	}
+}
+
+// TestProxyRequestLimits tests refusing a client's requests over its rate and concurrency limits
+func TestProxyRequestLimits(t *testing.T) {
+	app := NewMeshApp("exit-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ApplyConfig(Config{
+		ExitAllowlist: []string{"127.0.0.1"},
+		ProxyLimits:   ProxyLimits{RequestsPerSecond: 1, MaxRequestsPerClient: 1},
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	greedy := app.InternetProxy.AuthorizeClient("peer-1")
+	polite := app.InternetProxy.AuthorizeClient("peer-2")
+	fetch := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+"/", nil)
+		req.Header.Set("Proxy-Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		app.InternetProxy.handleProxy(rec, req)
+		return rec
+	}
+
+	// A burst of twice the rate is served, then the client is told to slow down
+	for i := 0; i < 2; i++ {
+		if rec := fetch(greedy); rec.Code != http.StatusOK {
+			t.Fatalf("Expected request %d within the burst to be served, got %d", i, rec.Code)
+		}
+	}
+	rec := fetch(greedy)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After over the rate, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if got := app.InternetProxy.RateLimitViolations("peer-1"); got != 1 {
+		t.Errorf("Expected 1 violation, got %d", got)
+	}
+	if rec := fetch(polite); rec.Code != http.StatusOK {
+		t.Errorf("Expected another client to be served, got %d", rec.Code)
+	}
+
+	// A client with a request in flight can't open another
+	release, _, ok := app.InternetProxy.admitRequest("peer-2", time.Now())
+	if !ok {
+		t.Fatal("Expected a slot for the polite client")
+	}
+	if _, _, ok := app.InternetProxy.admitRequest("peer-2", time.Now()); ok {
+		t.Error("Expected a second concurrent request to be refused")
+	}
+	release()
+	if _, _, ok := app.InternetProxy.admitRequest("peer-2", time.Now().Add(time.Second)); !ok {
+		t.Error("Expected the freed slot to be reused")
+	}
+	if got := app.InternetProxy.RateLimitViolations("peer-2"); got != 1 {
+		t.Errorf("Expected 1 violation for the polite client, got %d", got)
+	}
+}
+
+// TestProxyQuota tests revoking or throttling proxy clients that used up their data quota
+func TestProxyQuota(t *testing.T) {
+	app := NewMeshApp("exit-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ApplyConfig(Config{ExitAllowlist: []string{"127.0.0.1"}})
+	exceeded := make(chan *Event, 4)
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventQuotaExceeded {
+			exceeded <- e
+		}
+	}})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer upstream.Close()
+	fetch := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+"/", nil)
+		req.Header.Set("Proxy-Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		app.InternetProxy.handleProxy(rec, req)
+		return rec.Code
+	}
+
+	if err := app.InternetProxy.SetQuota(ProxyQuota{Action: "slow down"}); err == nil {
+		t.Error("Expected an unknown quota action to be rejected")
+	}
+	app.InternetProxy.SetQuota(ProxyQuota{TotalBytes: 1500})
+	token := app.InternetProxy.AuthorizeClient("peer-1")
+	for i := 0; i < 2; i++ {
+		if code := fetch(token); code != http.StatusOK {
+			t.Fatalf("Expected request %d to be served, got %d", i, code)
+		}
+	}
+	select {
+	case e := <-exceeded:
+		if e.PeerID != "peer-1" || e.Detail != "total quota, revoke" {
+			t.Errorf("Unexpected quota event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected an event for the client crossing its quota")
+	}
+	if code := fetch(token); code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected the client over its quota to be revoked, got %d", code)
+	}
+	if usage := app.InternetProxy.ClientUsage("peer-1"); usage != 2000 {
+		t.Errorf("Expected 2000 bytes used, got %d", usage)
+	}
+	if limit := app.InternetProxy.OverQuota("peer-1"); limit != "total" {
+		t.Errorf("Expected the total quota to be used up, got %q", limit)
+	}
+
+	// A throttling quota keeps serving the client, slowly
+	app.InternetProxy.SetQuota(ProxyQuota{DailyBytes: 500, Action: QuotaThrottle})
+	token = app.InternetProxy.AuthorizeClient("peer-2")
+	for i := 0; i < 2; i++ {
+		if code := fetch(token); code != http.StatusOK {
+			t.Errorf("Expected throttled request %d to be served, got %d", i, code)
+		}
+	}
+	if rate := app.InternetProxy.throttleRate("peer-2"); rate != DefaultQuotaThrottleRate {
+		t.Errorf("Expected the client to be throttled to the default rate, got %d", rate)
+	}
+	if usage := app.InternetProxy.DailyUsage("peer-2"); usage != 2000 {
+		t.Errorf("Expected 2000 bytes used today, got %d", usage)
+	}
+	p := &pacer{rate: 10000}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		p.wait(1000)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected writes to be paced to the rate, took %v", elapsed)
+	}
+}
+
+// TestDataSaver tests the image, compression and tracker transformations a client asks
+// its exit for
+func TestDataSaver(t *testing.T) {
+	app := NewMeshApp("exit-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ApplyConfig(Config{ExitAllowlist: []string{"127.0.0.1"}})
+	if err := app.InternetProxy.SetDataSaver([]string{"images", "video"}); err == nil {
+		t.Error("Expected an unknown option to be rejected")
+	}
+	app.InternetProxy.SetDataSaver([]string{SaveImages, SaveCompress, SaveTrackers})
+
+	picture := image.NewRGBA(image.Rect(0, 0, 2048, 512))
+	var encoded bytes.Buffer
+	png.Encode(&encoded, picture)
+	text := strings.Repeat("the same words again and again ", 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(DataSaverHeader) != "" {
+			t.Error("Expected the data saver header to stay off the internet")
+		}
+		if r.URL.Path == "/picture.png" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(encoded.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(text))
+	}))
+	defer upstream.Close()
+	exit := httptest.NewServer(http.HandlerFunc(app.InternetProxy.handleProxy))
+	defer exit.Close()
+	u, _ := url.Parse(exit.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	client := NewInternetClient("peer-1")
+	client.ConnectToProxy("exit-1", u.Hostname(), port)
+	client.SetProxyToken("exit-1", app.InternetProxy.AuthorizeClient("peer-1"))
+	fetch := func(path string) (*http.Response, []byte) {
+		resp, err := client.MakeRequest(upstream.URL + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	// Without asking, responses pass through untouched
+	if _, body := fetch("/picture.png"); !bytes.Equal(body, encoded.Bytes()) {
+		t.Error("Expected the image untouched for a client that didn't ask")
+	}
+
+	client.SetDataSaver([]string{SaveImages, SaveCompress})
+	resp, body := fetch("/picture.png")
+	if resp.Header.Get(DataSavedHeader) != SaveImages {
+		t.Errorf("Expected the image to be transformed, got %q", resp.Header.Get(DataSavedHeader))
+	}
+	if config, err := png.DecodeConfig(bytes.NewReader(body)); err != nil || config.Width != DataSaverMaxImageSide || config.Height != 256 {
+		t.Errorf("Expected the image downscaled to %dx256, got %+v (%v)", DataSaverMaxImageSide, config, err)
+	}
+	resp, body = fetch("/text")
+	if resp.Header.Get(DataSavedHeader) != SaveCompress || !resp.Uncompressed || string(body) != text {
+		t.Errorf("Expected text to arrive gzipped and intact, got %q, %d bytes", resp.Header.Get(DataSavedHeader), len(body))
+	}
+	if usage := app.InternetProxy.ClientUsage("peer-1"); usage >= uint64(2*encoded.Len()) {
+		t.Errorf("Expected saved responses to count less against the client, got %d bytes", usage)
+	}
+
+	// Trackers are refused for clients that ask, tunnels included
+	req := httptest.NewRequest(http.MethodConnect, "stats.g.doubleclick.net:443", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+app.InternetProxy.AuthorizeClient("peer-1"))
+	req.Header.Set(DataSaverHeader, SaveTrackers)
+	rec := httptest.NewRecorder()
+	app.InternetProxy.handleProxy(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a tunnel to a tracker to be refused, got %d", rec.Code)
+	}
+	if records := app.InternetProxy.history.snapshot(); records[len(records)-1].Refused != RefusedDataSaver {
+		t.Errorf("Expected the tracker to be recorded as refused by the data saver, got %+v", records[len(records)-1])
+	}
+}
+
+func TestPrivacyMode(t *testing.T) {
+	app := NewMeshApp("exit-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	app.ApplyConfig(Config{ExitAllowlist: []string{"127.0.0.1"}})
+	if err := app.InternetProxy.SetPrivacyMode("paranoid"); err == nil {
+		t.Error("Expected an unknown privacy mode to be rejected")
+	}
+	if app.InternetProxy.PrivacyMode() != PrivacyOff {
+		t.Errorf("Expected privacy off by default, got %s", app.InternetProxy.PrivacyMode())
+	}
+
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}))
+	defer upstream.Close()
+	exit := httptest.NewServer(http.HandlerFunc(app.InternetProxy.handleProxy))
+	defer exit.Close()
+	u, _ := url.Parse(exit.URL)
+	port, _ := strconv.Atoi(u.Port())
+	client := NewInternetClient("peer-1")
+	client.ConnectToProxy("exit-1", u.Hostname(), port)
+	client.SetProxyToken("exit-1", app.InternetProxy.AuthorizeClient("peer-1"))
+	fetch := func() http.Header {
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/page", nil)
+		req.Header.Set("User-Agent", "RareBrowser/0.1 (device 42)")
+		req.Header.Set("Cookie", "session=abc")
+		req.Header.Set("Referer", "https://example.com/private/path?q=1")
+		req.Header.Set("Accept-Language", "eo")
+		req.Header.Set("X-Forwarded-For", "10.1.2.3")
+		resp, err := client.DoRequest(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return <-received
+	}
+
+	if h := fetch(); h.Get("User-Agent") != "RareBrowser/0.1 (device 42)" || h.Get("Cookie") == "" || h.Get("X-Forwarded-For") == "" {
+		t.Errorf("Expected headers relayed as sent with privacy off, got %v", h)
+	}
+	app.InternetProxy.SetPrivacyMode(PrivacyNormalize)
+	h := fetch()
+	if h.Get("User-Agent") != PrivacyUserAgent || h.Get("Accept-Language") != privacyLanguage || h.Get("Referer") != "https://example.com/" {
+		t.Errorf("Expected normalized headers, got %v", h)
+	}
+	if h.Get("X-Forwarded-For") != "" || h.Get("Cookie") != "session=abc" {
+		t.Errorf("Expected forwarding headers dropped and cookies kept, got %v", h)
+	}
+	app.InternetProxy.SetPrivacyMode(PrivacyStrip)
+	if h := fetch(); h.Get("User-Agent") != "" || h.Get("Cookie") != "" || h.Get("Referer") != "" || h.Get("X-Forwarded-For") != "" {
+		t.Errorf("Expected identifying headers stripped, got %v", h)
+	}
+}
+
+// TestProxyACL tests restricting our internet to listed peers and personal networks
+func TestProxyACL(t *testing.T) {
+	app := NewMeshApp("exit-1", "Exit", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	home := app.PersonalNetworkMgr.CreateNetwork("home", "Home", "exit-1")
+	home.AddMember(&NetworkMember{NodeID: "family-1"})
+	home.AddMember(&NetworkMember{NodeID: "family-2"})
+	acl := app.ProxyACL
+
+	if !acl.Permitted("anyone") {
+		t.Error("Expected an empty ACL to admit everyone")
+	}
+	acl.DenyPeer("neighbor")
+	if acl.Permitted("neighbor") || !acl.Permitted("anyone") {
+		t.Error("Expected only the denied peer to be refused")
+	}
+
+	// Allowing a network admits only its members, unless one is denied by name
+	acl.AllowNetwork("home")
+	acl.AllowPeer("guest")
+	acl.DenyPeer("family-2")
+	for peer, want := range map[string]bool{"family-1": true, "family-2": false, "guest": true, "anyone": false} {
+		if got := acl.Permitted(peer); got != want {
+			t.Errorf("Expected %s permitted=%v, got %v", peer, want, got)
+		}
+	}
+	acl.RemovePeer("family-2")
+	acl.DenyNetwork("home")
+	if acl.Permitted("family-1") || !acl.Permitted("guest") {
+		t.Error("Expected a denied network to refuse its members")
+	}
+	if rules := acl.Rules(); strings.Join(rules.AllowPeers, ",") != "guest" ||
+		strings.Join(rules.DenyPeers, ",") != "neighbor" || strings.Join(rules.DenyNetworks, ",") != "home" {
+		t.Errorf("Expected the ACL's rules, got %+v", rules)
+	}
+
+	// The exit refuses clients the ACL doesn't admit, even with a valid token
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer "+app.InternetProxy.AuthorizeClient("family-1"))
+	rec := httptest.NewRecorder()
+	app.InternetProxy.handleProxy(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a client outside the ACL to be refused, got %d", rec.Code)
+	}
+
+	acl.SetRules(ProxyACLRules{})
+	if !acl.Permitted("family-1") {
+		t.Error("Expected clearing the rules to admit everyone again")
+	}
+}
+
+func TestNetworkInvites(t *testing.T) {
+	newNode := func(id string) *MeshApp {
+		app := NewMeshApp(id, id, "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+		app.Transport = NewTransport(id, 0)
+		app.Transport.SetMessageHandler(app.handleMessage)
+		if err := app.Transport.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", id, err)
+		}
+		t.Cleanup(app.Transport.Stop)
+		return app
+	}
+	owner := newNode("owner")
+	guest := newNode("guest")
+	owner.PersonalNetworkMgr.CreateNetwork("home", "Home", "owner")
+
+	if _, err := guest.CreateNetworkInvite("home", time.Hour); err == nil {
+		t.Error("Expected invites for unknown networks to fail")
+	}
+	guest.PersonalNetworkMgr.CreateNetwork("other", "Other", "owner")
+	if _, err := guest.CreateNetworkInvite("other", time.Hour); !errors.Is(err, ErrNotNetworkOwner) {
+		t.Errorf("Expected only owners to create invites, got %v", err)
+	}
+
+	_, port, _ := net.SplitHostPort(owner.Transport.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := guest.Transport.ConnectToPeer("owner", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	// A made-up code is refused and nobody is added
+	if _, err := guest.JoinNetwork("owner", "AAAA-BBBB-CCCC-DDDD", 2*time.Second); err == nil {
+		t.Fatal("Expected an unknown code to be refused")
+	}
+	home, _ := owner.PersonalNetworkMgr.GetNetwork("home")
+	if home.IsMember("guest") {
+		t.Fatal("Expected no membership without a valid code")
+	}
+
+	code, err := owner.CreateNetworkInvite("home", time.Hour)
+	if err != nil {
+		t.Fatalf("CreateNetworkInvite failed: %v", err)
+	}
+	typed := strings.ToLower(strings.ReplaceAll(code, "-", ""))
+	joined, err := guest.JoinNetwork("owner", typed, 2*time.Second)
+	if err != nil {
+		t.Fatalf("JoinNetwork failed: %v", err)
+	}
+	if joined.ID != "home" || joined.Name != "Home" || joined.Owner != "owner" || !joined.IsMember("guest") {
+		t.Errorf("Expected to join Home, got %+v", joined)
+	}
+	if !home.IsMember("guest") {
+		t.Error("Expected the owner to add the guest")
+	}
+
+	// Codes are single-use
+	home.RemoveMember("guest")
+	if _, err := guest.JoinNetwork("owner", code, 2*time.Second); err == nil || home.IsMember("guest") {
+		t.Errorf("Expected a used code to be refused, got %v", err)
+	}
+
+	// Expired and revoked codes are refused
+	expired, _ := owner.CreateNetworkInvite("home", time.Hour)
+	owner.PersonalNetworkMgr.invites[expired].expires = time.Now().Add(-time.Second)
+	if _, err := owner.PersonalNetworkMgr.RedeemInvite(expired, "guest"); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("Expected an expired code to be refused, got %v", err)
+	}
+	revoked, _ := owner.CreateNetworkInvite("home", time.Hour)
+	owner.PersonalNetworkMgr.RevokeInvite(revoked)
+	if _, err := owner.PersonalNetworkMgr.RedeemInvite(revoked, "guest"); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("Expected a revoked code to be refused, got %v", err)
+	}
+
+	// Answers to joins we didn't ask for are ignored
+	guest.handleMessage("owner", &Message{
+		Type:     "network_join_response",
+		Source:   "owner",
+		Metadata: map[string]string{"network_id": "unasked", "name": "Unasked"},
+	})
+	if _, ok := guest.PersonalNetworkMgr.GetNetwork("unasked"); ok {
+		t.Error("Expected an unsolicited join response to be ignored")
+	}
+}
+
+func TestLinkPeers(t *testing.T) {
+	newNode := func(id string) (*MeshApp, int) {
+		app := NewMeshApp(id, id, "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+		app.Transport = NewTransport(id, 0)
+		app.Transport.SetMessageHandler(app.handleMessage)
+		if err := app.Transport.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", id, err)
+		}
+		t.Cleanup(app.Transport.Stop)
+		app.IsConnected = true
+		app.Discovery.SetCallbacks(app.handlePeerDiscovered, app.handlePeerLost)
+		_, port, _ := net.SplitHostPort(app.Transport.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		return app, portNum
+	}
+	phone, phonePort := newNode("phone")
+	tablet, tabletPort := newNode("tablet")
+	tablet.Discovery.UpdateInternetStatus(true)
+
+	waitForPeer := func(app *MeshApp, peerID string, hasInternet bool) *DiscoveredPeer {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if peer, ok := app.Discovery.GetPeer(peerID); ok && peer.HasInternet == hasInternet {
+				return peer
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("%s never learned about %s over the link", app.Node.ID, peerID)
+		return nil
+	}
+
+	// Announcements over a link are only taken from peers the platform registered
+	if err := phone.AddLinkPeer(LinkWifiAware, "tablet", "127.0.0.1", tabletPort); err != nil {
+		t.Fatalf("AddLinkPeer failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := tablet.Discovery.GetPeer("phone"); ok {
+		t.Error("Expected an announcement from an unregistered link peer to be ignored")
+	}
+
+	if err := tablet.AddLinkPeer(LinkWifiAware, "phone", "127.0.0.1", phonePort); err != nil {
+		t.Fatalf("AddLinkPeer failed: %v", err)
+	}
+	phone.announceToLinkPeers()
+	if peer := waitForPeer(tablet, "phone", false); peer.Link != LinkWifiAware {
+		t.Errorf("Expected the phone on the Wi-Fi Aware link, got %q", peer.Link)
+	}
+	peer := waitForPeer(phone, "tablet", true)
+	if peer.Link != LinkWifiAware || peer.IP != "127.0.0.1" || peer.Port != tabletPort {
+		t.Errorf("Expected the tablet at its link address, got %+v", peer)
+	}
+
+	// Within a tier the faster link wins over a stronger signal
+	phone.ProxyManager.RegisterProxy(&Peer{NodeID: "ble-proxy", HasInternet: true, RSSI: -30, Link: LinkBLE})
+	phone.ProxyManager.RegisterProxy(&Peer{NodeID: "lan-proxy", HasInternet: true, RSSI: -40})
+	if best, err := phone.ProxyManager.SelectBestProxy(); err != nil || best.NodeID != "tablet" {
+		t.Errorf("Expected the Wi-Fi Aware proxy to be preferred, got %+v (%v)", best, err)
+	}
+
+	// The peer is lost with its link
+	phone.RemoveLinkPeer("tablet")
+	if _, ok := phone.Discovery.GetPeer("tablet"); ok {
+		t.Error("Expected the tablet to be dropped when its link went down")
+	}
+}
+
+type testDataListener struct {
+	received chan string
+}
+
+func (l *testDataListener) OnData(sourceID string, payload []byte) {
+	l.received <- sourceID + ":" + string(payload)
+}
+
+func TestNetworkEncryption(t *testing.T) {
+	var relayed sync.Mutex
+	var seen []*Message
+	newNode := func(id string) *MeshApp {
+		app := NewMeshApp(id, id, "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+		app.Transport = NewTransport(id, 0)
+		app.Transport.SetMessageHandler(func(peerID string, msg *Message) {
+			if id == "relay" && msg.Type == "data" {
+				relayed.Lock()
+				seen = append(seen, msg)
+				relayed.Unlock()
+			}
+			app.handleMessage(peerID, msg)
+		})
+		if err := app.Transport.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", id, err)
+		}
+		t.Cleanup(app.Transport.Stop)
+		return app
+	}
+	connect := func(a, b *MeshApp) {
+		_, port, _ := net.SplitHostPort(b.Transport.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		if err := a.Transport.ConnectToPeer(b.Node.ID, "127.0.0.1", portNum); err != nil {
+			t.Fatalf("Failed to connect %s to %s: %v", a.Node.ID, b.Node.ID, err)
+		}
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	owner := newNode("owner")
+	member := newNode("member")
+	relay := newNode("relay")
+	stranger := newNode("stranger")
+	connect(owner, member)
+	connect(owner, relay)
+	connect(relay, member)
+	connect(stranger, owner)
+	key := []byte("shared pairing key")
+	owner.Pairing.verified["member"], owner.Pairing.keys["member"] = time.Now(), key
+	member.Pairing.verified["owner"], member.Pairing.keys["owner"] = time.Now(), key
+
+	withheld := make(chan *Event, 4)
+	owner.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		if e.Type == EventNetworkKeyWithheld {
+			withheld <- e
+		}
+	}})
+	data := &testDataListener{received: make(chan string, 4)}
+	member.RegisterDataListener(data)
+
+	home := owner.PersonalNetworkMgr.CreateNetwork("home", "Home", "owner")
+	home.AddMember(&NetworkMember{NodeID: "member"})
+	memberHome := member.PersonalNetworkMgr.CreateNetwork("home", "Home", "owner")
+	if err := member.EnableNetworkEncryption("home"); !errors.Is(err, ErrNotNetworkOwner) {
+		t.Errorf("Expected only owners to enable encryption, got %v", err)
+	}
+	if err := owner.EnableNetworkEncryption("home"); err != nil {
+		t.Fatalf("EnableNetworkEncryption failed: %v", err)
+	}
+	waitFor("the member to get the key", func() bool {
+		epoch, _ := memberHome.GroupKey()
+		return epoch == 1
+	})
+
+	// Data relayed through a node outside the network is sealed end to end
+	owner.Router.UpdateRoute("member", "relay", 2, 10*time.Millisecond)
+	relay.Router.UpdateRoute("member", "member", 1, 10*time.Millisecond)
+	if err := owner.SendData("member", []byte("secret")); err != nil {
+		t.Fatalf("SendData failed: %v", err)
+	}
+	select {
+	case got := <-data.received:
+		if got != "owner:secret" {
+			t.Errorf("Expected the member to read the payload, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the data message")
+	}
+	relayed.Lock()
+	if len(seen) != 1 || bytes.Contains(seen[0].Payload, []byte("secret")) || seen[0].Metadata["enc_net"] != "home" {
+		t.Errorf("Expected the relay to see only ciphertext, got %+v", seen)
+	}
+	relayed.Unlock()
+
+	// A membership change rotates the key; messages sealed just before still open
+	inFlight := &Message{Type: "data", Source: "owner", Dest: "member", Payload: []byte("in flight")}
+	if err := owner.sealData(inFlight); err != nil {
+		t.Fatalf("sealData failed: %v", err)
+	}
+	home.AddMember(&NetworkMember{NodeID: "stranger"})
+	waitFor("the member to get the rotated key", func() bool {
+		epoch, _ := memberHome.GroupKey()
+		return epoch == 2
+	})
+	if !memberHome.IsMember("stranger") {
+		t.Error("Expected the key to come with the roster it was issued for")
+	}
+	if payload, err := member.openData(inFlight); err != nil || string(payload) != "in flight" {
+		t.Errorf("Expected the previous key to still open, got %q, %v", payload, err)
+	}
+
+	// Without pairing or an encrypted transport the key is withheld
+	select {
+	case e := <-withheld:
+		if e.PeerID != "stranger" || !strings.Contains(e.Detail, ErrNoKeyChannel.Error()) {
+			t.Errorf("Expected the stranger's key to be withheld, got %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the key to be withheld from an unpaired member")
+	}
+
+	tampered := &Message{Type: "data", Source: "owner", Dest: "member", Payload: []byte("x")}
+	owner.sealData(tampered)
+	tampered.Dest = "relay"
+	if _, err := member.openData(tampered); !errors.Is(err, ErrUndecryptable) {
+		t.Errorf("Expected a re-addressed message not to open, got %v", err)
+	}
+}
+
+// TestIdentityRevocation tests that revocations and rotations spread over the mesh and
+// cut the revoked identity off
+func TestIdentityRevocation(t *testing.T) {
+	newNode := func(name string) *MeshApp {
+		identity, err := NewIdentity()
+		if err != nil {
+			t.Fatalf("NewIdentity failed: %v", err)
+		}
+		app := NewMeshAppWithIdentity(identity, name, "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+		app.Transport = NewTransport(app.Node.ID, 0)
+		app.Transport.SetIdentity(identity)
+		app.Transport.SetMessageHandler(app.handleMessage)
+		app.Transport.SetMessageFilter(app.checkMessagePolicy)
+		app.Transport.SetConnectionVerifier(app.verifyIncomingPeer)
+		if err := app.Transport.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", name, err)
+		}
+		t.Cleanup(app.Transport.Stop)
+		return app
+	}
+	port := func(app *MeshApp) int {
+		_, port, _ := net.SplitHostPort(app.Transport.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		return portNum
+	}
+	connect := func(a, b *MeshApp) {
+		if err := a.dialPeer(b.Node.ID, "127.0.0.1", port(b)); err != nil {
+			t.Fatalf("Failed to connect %s to %s: %v", a.Node.Name, b.Node.Name, err)
+		}
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	owner := newNode("owner")
+	member := newNode("member")
+	bystander := newNode("bystander")
+	far := newNode("far")
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	owner.ApplyConfig(Config{RevocationsPath: path})
+
+	home := owner.PersonalNetworkMgr.CreateNetwork("home", "Home", owner.Node.ID)
+	home.AddMember(&NetworkMember{NodeID: member.Node.ID})
+	home.AddMember(&NetworkMember{NodeID: bystander.Node.ID})
+	home.EnableEncryption()
+	bystander.PersonalNetworkMgr.CreateNetwork("home", "Home", owner.Node.ID)
+	connect(owner, member)
+	connect(owner, bystander)
+	connect(bystander, far)
+
+	// Only owners may revoke others; the member is dropped and the group key rotated
+	if _, err := bystander.RevokeNode(member.Node.ID, "lost phone"); err == nil {
+		t.Error("Expected a non-owner to be refused")
+	}
+	epoch, _ := home.GroupKey()
+	if _, err := owner.RevokeNode(member.Node.ID, "lost phone"); err != nil {
+		t.Fatalf("RevokeNode failed: %v", err)
+	}
+	if home.IsMember(member.Node.ID) {
+		t.Error("Expected the revoked member to leave the network")
+	}
+	if rotated, _ := home.GroupKey(); rotated != epoch+1 {
+		t.Errorf("Expected the group key to rotate, got epoch %d after %d", rotated, epoch)
+	}
+	waitFor("the bystander to accept the revocation", func() bool { return bystander.Revocations.Revoked(member.Node.ID) })
+	if err := owner.dialPeer(member.Node.ID, "127.0.0.1", port(member)); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected revoked peers not to be dialed, got %v", err)
+	}
+	if err := owner.checkMessagePolicy(member.Node.ID, &Message{Type: "data", Source: member.Node.ID}, false); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected messages from revoked peers to be dropped, got %v", err)
+	}
+
+	// A rotation is accepted by anyone, since it is signed by the identity it revokes
+	next, _ := NewIdentity()
+	if _, err := bystander.RotateIdentity(next, "scheduled"); err != nil {
+		t.Fatalf("RotateIdentity failed: %v", err)
+	}
+	waitFor("the rotation to spread", func() bool {
+		return owner.Revocations.Revoked(bystander.Node.ID) && far.Revocations.Revoked(bystander.Node.ID)
+	})
+	if r, _ := far.Revocations.Get(bystander.Node.ID); r.Successor != next.NodeID() {
+		t.Errorf("Expected the successor to be named, got %+v", r)
+	}
+	if far.Revocations.Revoked(member.Node.ID) {
+		t.Error("Expected an owner's revocation to be ignored by nodes outside its networks")
+	}
+
+	// Peers that were away catch up when dialed
+	late := newNode("late")
+	connect(owner, late)
+	waitFor("the late node to sync", func() bool { return late.Revocations.Revoked(bystander.Node.ID) })
+
+	// Records persist, and tampered ones are refused
+	stored := NewRevocationList()
+	if err := stored.Load(path); err != nil || !stored.Revoked(member.Node.ID) || !stored.Revoked(bystander.Node.ID) {
+		t.Errorf("Expected both records to be stored, got %d records, %v", len(stored.All()), err)
+	}
+	r, _ := stored.Get(member.Node.ID)
+	forged := *r
+	forged.NodeID = owner.Node.ID
+	if forged.Verify() == nil {
+		t.Error("Expected a tampered record to fail verification")
+	}
+}
+
+func TestPlatformNetwork(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	var events []*Event
+	app.RegisterEventListener(&testEventListener{onEvent: func(e *Event) {
+		events = append(events, e)
+	}})
+
+	app.SetPlatformNetwork(PlatformNetwork{Type: "wifi", Interface: "wlan0"})
+	if !app.Discovery.unicastReplies || len(events) != 1 || events[0].Type != EventMulticastBlocked {
+		t.Errorf("Expected Wi-Fi without a multicast lock to switch to unicast answers, got %+v", events)
+	}
+	app.SetPlatformNetwork(PlatformNetwork{Type: "wifi", Interface: "wlan0", MulticastLock: true})
+	if app.Discovery.unicastReplies || len(events) != 1 {
+		t.Errorf("Expected multicast with the lock held, got %+v", events)
+	}
+	if app.Discovery.iface != "wlan0" {
+		t.Errorf("Expected discovery to join on wlan0, got %q", app.Discovery.iface)
+	}
+
+	app.SetPlatformNetwork(PlatformNetwork{Type: "wifi", IP: "10.0.0.7"})
+	if ip, _ := app.Node.Address(); ip != "10.0.0.7" {
+		t.Errorf("Expected the reported address to be taken, got %s", ip)
+	}
+
+	if app.WantsMulticastLock() {
+		t.Error("Expected no multicast lock while discovery is stopped")
+	}
+	app.Discovery.running = true
+	if !app.WantsMulticastLock() {
+		t.Error("Expected a multicast lock while discovering on Wi-Fi")
+	}
+	app.SetPlatformNetwork(PlatformNetwork{Type: "cellular"})
+	if app.WantsMulticastLock() {
+		t.Error("Expected no multicast lock on cellular")
+	}
+}
+
+func TestScanOnly(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+	app.Transport = NewTransport("node-1", 0)
+	app.Discovery.macResolver = nil
+	free, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	_, port, _ := net.SplitHostPort(free.LocalAddr().String())
+	free.Close()
+	app.Discovery.multicastAddr = "224.0.0.250:" + port
+
+	seq := app.Discovery.seq
+	if err := app.StartScan(); err != nil {
+		t.Skipf("Multicast unavailable: %v", err)
+	}
+	defer app.StopScan()
+	time.Sleep(50 * time.Millisecond)
+	if !app.IsScanning() || app.Transport.IsRunning() {
+		t.Error("Expected scanning without the transport")
+	}
+	if app.Discovery.seq != seq {
+		t.Error("Expected a scan not to announce us")
+	}
+
+	terms := &SharingTerms{MaxMBPerClient: 100}
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "proxy-far", Port: 1, HasInternet: true, Tier: 1, MessageType: "announce"}, "10.0.0.3")
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "proxy-near", Port: 1, HasInternet: true, Terms: terms, MessageType: "announce"}, "10.0.0.2")
+	app.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "client", Port: 1, MessageType: "announce"}, "10.0.0.4")
+	proxies := app.ScanProxies()
+	if len(proxies) != 2 || proxies[0].ID != "proxy-near" || !proxies[0].Terms.Equal(terms) || proxies[1].ID != "proxy-far" {
+		t.Errorf("Expected both proxies, nearest first with its terms, got %+v", proxies)
+	}
+	if len(app.DiscoveredPeers) != 0 {
+		t.Error("Expected scanned proxies not to become mesh peers")
+	}
+
+	// Joining ends the scan; found peers are discovered afresh
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer app.Stop()
+	if app.IsScanning() || len(app.ScanProxies()) != 0 {
+		t.Error("Expected joining to end the scan")
+	}
+	if err := app.StartScan(); !errors.Is(err, ErrMeshRunning) {
+		t.Errorf("Expected no scan while in the mesh, got %v", err)
+	}
+}
+
+func TestFetchOnce(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("sunny"))
+	}))
+	defer upstream.Close()
+
+	proxy := NewMeshApp("proxy", "Proxy", "127.0.0.1", "aa:bb:cc:dd:ee:01")
+	proxy.Transport = NewTransport("proxy", 0)
+	proxy.Transport.SetMessageHandler(proxy.handleMessage)
+	if err := proxy.Transport.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer proxy.Transport.Stop()
+	proxy.ExitGuard.SetAllowlist([]string{"127.0.0.1"})
+	if err := proxy.InternetProxy.Enable(); err != nil {
+		t.Fatalf("Failed to enable the proxy: %v", err)
+	}
+	defer proxy.InternetProxy.Disable()
+	_, port, _ := net.SplitHostPort(proxy.Transport.ListenAddr())
+	proxyPort, _ := strconv.Atoi(port)
+
+	client := NewMeshApp("client", "Client", "127.0.0.1", "aa:bb:cc:dd:ee:02")
+	client.Transport = NewTransport("client", 0)
+	client.Discovery.macResolver = nil
+	free, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	_, group, _ := net.SplitHostPort(free.LocalAddr().String())
+	free.Close()
+	client.Discovery.multicastAddr = "224.0.0.250:" + group
+
+	// Nobody offering internet
+	if _, err := client.FetchOnce(upstream.URL, 300*time.Millisecond); !errors.Is(err, ErrNoProxy) {
+		if err != nil && strings.Contains(err.Error(), "multicast") {
+			t.Skipf("Multicast unavailable: %v", err)
+		}
+		t.Fatalf("Expected no proxy to be found, got %v", err)
+	}
+
+	// A proxy the user didn't approve isn't used without asking
+	announce := func() {
+		client.Discovery.handlePeerAnnounce(&AnnounceMessage{ID: "proxy", Port: proxyPort, HasInternet: true, MessageType: "announce"}, "127.0.0.1")
+	}
+	announce()
+	if _, err := client.FetchOnce(upstream.URL, 300*time.Millisecond); !errors.Is(err, ErrNoProxy) {
+		t.Fatalf("Expected an unapproved proxy to be skipped, got %v", err)
+	}
+
+	client.ExitConsent.GrantPeer("proxy")
+	announce()
+	result, err := client.FetchOnce(upstream.URL, 5*time.Second)
+	if err != nil {
+		t.Fatalf("FetchOnce failed: %v", err)
+	}
+	if result.StatusCode != http.StatusOK || string(result.Body) != "sunny" || result.ProxyID != "proxy" ||
+		result.ContentType != "text/plain" {
+		t.Errorf("Expected the resource through the proxy, got %+v", result)
+	}
+
+	// Nothing is left running
+	if client.Transport.IsRunning() || client.Discovery.IsRunning() || client.InternetClient.IsConnected() ||
+		len(client.Discovery.GetPeers()) != 0 {
+		t.Error("Expected the fetch to tear everything down")
+	}
+	client.IsConnected = true
+	if _, err := client.FetchOnce(upstream.URL, time.Second); !errors.Is(err, ErrMeshRunning) {
+		t.Errorf("Expected no fetch while in the mesh, got %v", err)
+	}
+}
+
+// TestPairingPayload tests that a scanned pairing payload pre-authorizes a device once it
+// proves the identity in it
+func TestPairingPayload(t *testing.T) {
+	newNode := func(name string) *MeshApp {
+		identity, err := NewIdentity()
+		if err != nil {
+			t.Fatalf("NewIdentity failed: %v", err)
+		}
+		app := NewMeshAppWithIdentity(identity, name, "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+		app.Transport = NewTransport(app.Node.ID, 0)
+		app.Transport.SetIdentity(identity)
+		app.Transport.SetMessageHandler(app.handleMessage)
+		if err := app.Transport.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", name, err)
+		}
+		t.Cleanup(app.Transport.Stop)
+		return app
+	}
+	phone := newNode("phone")
+	laptop := newNode("laptop")
+	_, port, _ := net.SplitHostPort(phone.Transport.ListenAddr())
+
+	payload, err := phone.PairingPayload(0)
+	if err != nil {
+		t.Fatalf("PairingPayload failed: %v", err)
+	}
+	if strings.Trim(payload, "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567:") != "" || !strings.HasPrefix(payload, PairingPayloadPrefix) || len(payload) > 256 {
+		t.Errorf("Expected a short upper-case base32 payload, got %q", payload)
+	}
+	parsed, err := ParsePairingPayload(strings.ToLower(payload), time.Now())
+	if err != nil {
+		t.Fatalf("ParsePairingPayload failed: %v", err)
+	}
+	if parsed.NodeID != phone.Node.ID || parsed.Name != "phone" || parsed.MAC != "aa:bb:cc:dd:ee:ff" ||
+		len(parsed.Addrs) != 1 || parsed.Addrs[0] != "127.0.0.1:"+port {
+		t.Errorf("Unexpected payload contents %+v", parsed)
+	}
+	if _, err := ParsePairingPayload(payload, time.Now().Add(time.Hour)); !errors.Is(err, ErrPairingPayloadExpired) {
+		t.Errorf("Expected an expired payload to be refused, got %v", err)
+	}
+	last := len(PairingPayloadPrefix) + 70
+	tampered := payload[:last] + map[bool]string{true: "B", false: "A"}[payload[last] == 'A'] + payload[last+1:]
+	if _, err := ParsePairingPayload(tampered, time.Now()); err == nil {
+		t.Error("Expected a tampered payload to be refused")
+	}
+	if _, err := phone.AcceptPairingPayload(payload); err == nil {
+		t.Error("Expected a device's own payload to be refused")
+	}
+
+	// Scanning pre-authorizes the phone, which counts as paired once it proves its identity
+	laptop.SetRequirePairing(true)
+	if _, err := laptop.AcceptPairingPayload(payload); err != nil {
+		t.Fatalf("AcceptPairingPayload failed: %v", err)
+	}
+	if !laptop.Pairing.IsPreauthorized(phone.Node.ID) || !laptop.pairingRequired(phone.Node.ID) {
+		t.Error("Expected the phone to be pre-authorized but not paired before proving its identity")
+	}
+	if peer, ok := laptop.staticPeers[phone.Node.ID]; !ok || strconv.Itoa(peer.Port) != port {
+		t.Errorf("Expected the phone's address to be added as a static peer, got %+v", peer)
+	}
+	portNum, _ := strconv.Atoi(port)
+	if err := laptop.dialPeer(phone.Node.ID, "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if laptop.pairingRequired(phone.Node.ID) {
+		t.Error("Expected the pre-authorized phone to count as paired after proving its identity")
+	}
+}
+
+// TestMembershipCerts tests that certificate-based networks count members by the
+// certificates their owner signed rather than by the roster
+func TestMembershipCerts(t *testing.T) {
+	newNode := func(name string) *MeshApp {
+		identity, err := NewIdentity()
+		if err != nil {
+			t.Fatalf("NewIdentity failed: %v", err)
+		}
+		app := NewMeshAppWithIdentity(identity, name, "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+		app.Transport = NewTransport(app.Node.ID, 0)
+		app.Transport.SetIdentity(identity)
+		app.Transport.SetMessageHandler(app.handleMessage)
+		if err := app.Transport.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", name, err)
+		}
+		t.Cleanup(app.Transport.Stop)
+		return app
+	}
+	connect := func(a, b *MeshApp) {
+		_, port, _ := net.SplitHostPort(b.Transport.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		if err := a.dialPeer(b.Node.ID, "127.0.0.1", portNum); err != nil {
+			t.Fatalf("Failed to connect %s to %s: %v", a.Node.Name, b.Node.Name, err)
+		}
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	owner := newNode("owner")
+	member := newNode("member")
+	guest := newNode("guest")
+	connect(member, owner)
+	connect(guest, owner)
+	home := owner.PersonalNetworkMgr.CreateNetwork("home", "Home", owner.Node.ID)
+	home.AddMember(&NetworkMember{NodeID: member.Node.ID})
+	memberHome := member.PersonalNetworkMgr.CreateNetwork("home", "Home", owner.Node.ID)
+
+	if err := member.EnableMembershipCerts("home"); !errors.Is(err, ErrNotNetworkOwner) {
+		t.Errorf("Expected only owners to enable certificates, got %v", err)
+	}
+	if err := owner.EnableMembershipCerts("home"); err != nil {
+		t.Fatalf("EnableMembershipCerts failed: %v", err)
+	}
+	waitFor("the member to get its certificate", func() bool {
+		_, ok := memberHome.Cert(member.Node.ID)
+		return ok && memberHome.IsMember(member.Node.ID)
+	})
+
+	// The roster alone no longer makes a member
+	memberHome.AddMember(&NetworkMember{NodeID: "intruder"})
+	if memberHome.IsMember("intruder") {
+		t.Error("Expected a roster entry without a certificate not to count")
+	}
+	if _, err := member.openData(&Message{Type: "data", Source: "intruder", Dest: member.Node.ID,
+		Metadata: map[string]string{"enc_net": "home", "enc_epoch": "1"}}); !errors.Is(err, ErrUndecryptable) {
+		t.Errorf("Expected network traffic from an uncertified node to be refused, got %v", err)
+	}
+
+	// Joining with an invite certifies the guest, and the other members learn of it
+	code, _ := owner.CreateNetworkInvite("home", time.Hour)
+	joined, err := guest.JoinNetwork(owner.Node.ID, code, 2*time.Second)
+	if err != nil {
+		t.Fatalf("JoinNetwork failed: %v", err)
+	}
+	if !joined.RequireCerts || !joined.IsMember(guest.Node.ID) || !joined.IsMember(member.Node.ID) {
+		t.Error("Expected the guest to hold the network's certificates after joining")
+	}
+	waitFor("the member to learn the guest's certificate", func() bool { return memberHome.IsMember(guest.Node.ID) })
+
+	// Certificates must come from the owner and be current
+	forged := newMembershipCert(guest.Node.Identity, joined, "intruder", time.Hour)
+	if err := memberHome.AddCert(forged, time.Now()); err == nil {
+		t.Error("Expected a certificate not signed by the owner to be refused")
+	}
+	cert, _ := home.Cert(guest.Node.ID)
+	if err := memberHome.AddCert(cert, cert.Expires.Add(time.Second)); err == nil {
+		t.Error("Expected an expired certificate to be refused")
+	}
+
+	// Removing a member drops its certificate
+	home.RemoveMember(guest.Node.ID)
+	if home.IsMember(guest.Node.ID) {
+		t.Error("Expected a removed member's certificate to be dropped")
+	}
+}
+
+// TestPingPeer tests that pings reach peers through relays and time out when unanswered
+func TestPingPeer(t *testing.T) {
+	newNode := func(id string) *MeshApp {
+		app := NewMeshApp(id, id, "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+		app.Transport = NewTransport(id, 0)
+		app.Transport.SetMessageHandler(app.handleMessage)
+		if err := app.Transport.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", id, err)
+		}
+		t.Cleanup(app.Transport.Stop)
+		return app
+	}
+	connect := func(a, b *MeshApp) {
+		_, port, _ := net.SplitHostPort(b.Transport.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		if err := a.Transport.ConnectToPeer(b.Node.ID, "127.0.0.1", portNum); err != nil {
+			t.Fatalf("Failed to connect %s to %s: %v", a.Node.ID, b.Node.ID, err)
+		}
+	}
+
+	phone := newNode("phone")
+	relay := newNode("relay")
+	tablet := newNode("tablet")
+	connect(phone, relay)
+	connect(relay, tablet)
+	phone.Router.UpdateRoute("tablet", "relay", 2, 10*time.Millisecond)
+	relay.Router.UpdateRoute("tablet", "tablet", 1, 10*time.Millisecond)
+	relay.Router.UpdateRoute("phone", "phone", 1, 10*time.Millisecond)
+	tablet.Router.UpdateRoute("phone", "relay", 2, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	rtt, err := phone.PingPeer("relay", time.Second)
+	if err != nil || rtt <= 0 {
+		t.Errorf("Expected the neighbor to answer, got %v, %v", rtt, err)
+	}
+	if rtt, err = phone.PingPeer("tablet", time.Second); err != nil || rtt <= 0 {
+		t.Errorf("Expected the peer behind the relay to answer, got %v, %v", rtt, err)
+	}
+
+	// A peer on the route that goes quiet times out
+	relay.Transport.SetMessageHandler(func(peerID string, msg *Message) {})
+	if _, err := phone.PingPeer("tablet", 100*time.Millisecond); !errors.Is(err, ErrPingTimeout) {
+		t.Errorf("Expected an unanswered ping to time out, got %v", err)
+	}
+	if _, err := phone.PingPeer("nowhere", 100*time.Millisecond); err == nil {
+		t.Error("Expected pinging an unreachable peer to fail")
+	}
+}
+
+// TestConfigTimeouts tests that configured timeouts and retry pacing reach the components
+func TestConfigTimeouts(t *testing.T) {
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	identity, _ := NewIdentity()
+	app.Transport = NewTransport(identity.NodeID(), 0)
+	app.Transport.SetIdentity(identity)
+	app.ApplyConfig(Config{Timeouts: Timeouts{PeerHandshake: 100 * time.Millisecond, RetryBase: time.Minute, TunnelSetup: time.Second}})
+
+	applied := app.Config().Timeouts
+	if applied.PeerHandshake != 100*time.Millisecond || applied.PeerDial != DefaultPeerDialTimeout || applied.RetryMax != DialBackoffMax {
+		t.Errorf("Expected unset timeouts to keep their defaults, got %+v", applied)
+	}
+	if got := app.InternetClient.timeoutPolicy().TunnelSetup; got != time.Second {
+		t.Errorf("Expected the client's tunnel setup timeout to be applied, got %v", got)
+	}
+
+	// A peer that accepts but never answers the handshake is given up on in time
+	silent, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	start := time.Now()
+	err := app.dialPeer("node-silent", "127.0.0.1", silent.Addr().(*net.TCPAddr).Port)
+	if err == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the handshake to time out quickly, got %v after %v", err, time.Since(start))
+	}
+	state, _ := app.PeerDialState("node-silent")
+	if wait := time.Until(state.NextAttempt); wait < 40*time.Second || wait > 80*time.Second {
+		t.Errorf("Expected the first retry in about a minute, got %v", wait)
+	}
+}
+
+// TestSealForPeer tests that payloads sealed for a paired peer only open for it
+func TestSealForPeer(t *testing.T) {
+	a := NewMeshApp("node-a", "A", "127.0.0.1", "")
+	b := NewMeshApp("node-b", "B", "127.0.0.1", "")
+	c := NewMeshApp("node-c", "C", "127.0.0.1", "")
+	key := []byte("pairing key")
+	a.Pairing.verified["node-b"], a.Pairing.keys["node-b"] = time.Now(), key
+	b.Pairing.verified["node-a"], b.Pairing.keys["node-a"] = time.Now(), key
+	c.Pairing.verified["node-a"], c.Pairing.keys["node-a"] = time.Now(), []byte("other key")
+
+	if _, err := a.SealForPeer("node-c", []byte("hi")); !errors.Is(err, ErrNotPaired) {
+		t.Errorf("Expected sealing for an unpaired peer to fail, got %v", err)
+	}
+	sealed, err := a.SealForPeer("node-b", []byte(`{"url":"http://example.com/secret"}`))
+	if err != nil {
+		t.Fatalf("SealForPeer failed: %v", err)
+	}
+	if !IsSealedPayload(sealed) || IsSealedPayload([]byte(`{"url":"x"}`)) || bytes.Contains(sealed, []byte("secret")) {
+		t.Errorf("Expected an opaque envelope, got %s", sealed)
+	}
+	from, plaintext, err := b.OpenFromPeer(sealed)
+	if err != nil || from != "node-a" || string(plaintext) != `{"url":"http://example.com/secret"}` {
+		t.Errorf("Expected the recipient to open the payload, got %q from %q, %v", plaintext, from, err)
+	}
+
+	// Only the recipient opens it, and the envelope can't be altered
+	if _, _, err := c.OpenFromPeer(sealed); !errors.Is(err, ErrUndecryptable) {
+		t.Errorf("Expected another node not to open the payload, got %v", err)
+	}
+	if _, _, err := a.OpenFromPeer(sealed); !errors.Is(err, ErrUndecryptable) {
+		t.Errorf("Expected the payload not to be reflected back to its sender, got %v", err)
+	}
+	var envelope SealedPayload
+	json.Unmarshal(sealed, &envelope)
+	envelope.Sealed[len(envelope.Sealed)-1] ^= 1
+	tampered, _ := json.Marshal(&envelope)
+	if _, _, err := b.OpenFromPeer(tampered); !errors.Is(err, ErrUndecryptable) {
+		t.Errorf("Expected a tampered payload to be refused, got %v", err)
+	}
+}
+
+// TestOnionRelay tests that onion requests reach the exit through a relay that can't read
+// them or their replies, and that forged exit keys are caught
+func TestOnionRelay(t *testing.T) {
+	start := func(app *MeshApp) *MeshApp {
+		app.Transport = NewTransport(app.Node.ID, 0)
+		if app.Node.Identity != nil {
+			app.Transport.SetIdentity(app.Node.Identity)
+		}
+		app.Transport.SetMessageHandler(app.handleMessage)
+		if err := app.Transport.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", app.Node.ID, err)
+		}
+		t.Cleanup(app.Transport.Stop)
+		return app
+	}
+	connect := func(a, b *MeshApp) {
+		_, port, _ := net.SplitHostPort(b.Transport.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		if err := a.Transport.ConnectToPeer(b.Node.ID, "127.0.0.1", portNum); err != nil {
+			t.Fatalf("Failed to connect %s to %s: %v", a.Node.ID, b.Node.ID, err)
+		}
+	}
+
+	identity, _ := NewIdentity()
+	phone := start(NewMeshApp("phone", "phone", "127.0.0.1", "aa:bb:cc:dd:ee:01"))
+	relay := start(NewMeshApp("relay", "relay", "127.0.0.1", "aa:bb:cc:dd:ee:02"))
+	exit := start(NewMeshAppWithIdentity(identity, "exit", "127.0.0.1", "aa:bb:cc:dd:ee:03"))
+	connect(phone, relay)
+	connect(relay, exit)
+	phone.Router.UpdateRoute(exit.Node.ID, "relay", 2, 10*time.Millisecond)
+	relay.Router.UpdateRoute(exit.Node.ID, exit.Node.ID, 1, 10*time.Millisecond)
+	relay.Router.UpdateRoute("phone", "phone", 1, 10*time.Millisecond)
+	exit.Router.UpdateRoute("phone", "relay", 2, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	servedFor := make(chan string, 1)
+	exit.SetOnionExit(func(fromPeer string, payload []byte) ([]byte, error) {
+		servedFor <- fromPeer
+		return append([]byte("answer to "), payload...), nil
+	})
+	// Everything the exit exchanges with the relay is recorded
+	var seen [][]byte
+	var seenMu sync.Mutex
+	record := func(app *MeshApp) {
+		app.Transport.SetMessageHandler(func(peerID string, msg *Message) {
+			seenMu.Lock()
+			seen = append(seen, msg.Payload)
+			seenMu.Unlock()
+			app.handleMessage(peerID, msg)
+		})
+	}
+	record(exit)
+	record(relay)
+
+	exitKey, err := phone.FetchOnionKey(exit.Node.ID, time.Second)
+	if err != nil || exitKey.Signature == nil {
+		t.Fatalf("Expected the exit's signed onion key, got %+v (%v)", exitKey, err)
+	}
+	path := []*OnionKey{relay.OnionKey(), exitKey}
+	if _, err := phone.SendOnion(path, []byte("secret request"), time.Second); !errors.Is(err, ErrOnionRefused) {
+		t.Errorf("Expected the exit to refuse a relay it hasn't authorized, got %v", err)
+	}
+	exit.InternetProxy.AuthorizeClient("relay")
+	reply, err := phone.SendOnion(path, []byte("secret request"), time.Second)
+	if err != nil || string(reply) != "answer to secret request" {
+		t.Fatalf("Expected the exit's answer, got %q (%v)", reply, err)
+	}
+	if from := <-servedFor; from != "relay" {
+		t.Errorf("Expected the exit to see the relay as its client, got %q", from)
+	}
+	seenMu.Lock()
+	for _, payload := range seen {
+		if bytes.Contains(payload, []byte("secret")) {
+			t.Errorf("Expected relays to see neither request nor answer, got %q", payload)
+		}
+	}
+	seenMu.Unlock()
+
+	// A relay can't pass off its own key as the exit's
+	forged := relay.OnionKey()
+	forged.NodeID, forged.Signer, forged.Signature = exitKey.NodeID, exitKey.Signer, exitKey.Signature
+	if _, _, err := BuildOnion([]*OnionKey{relay.OnionKey(), forged}, []byte("x")); !errors.Is(err, ErrOnionKey) {
+		t.Errorf("Expected a forged exit key to be refused, got %v", err)
+	}
+	forged.Signer, forged.Signature = nil, nil
+	if err := forged.Verify(); !errors.Is(err, ErrOnionKey) {
+		t.Errorf("Expected an unsigned key for an identity-derived ID to be refused, got %v", err)
+	}
+
+	// Unsigned keys are only taken straight from the node they belong to
+	if key, err := phone.FetchOnionKey("relay", time.Second); err != nil || key.Signature != nil {
+		t.Errorf("Expected the relay's unsigned key over the direct link, got %+v (%v)", key, err)
+	}
+	if _, err := exit.FetchOnionKey("phone", time.Second); !errors.Is(err, ErrOnionKey) {
+		t.Errorf("Expected an unsigned key through a relay to be refused, got %v", err)
+	}
+}
+
+func TestDaemonHandoff(t *testing.T) {
+	peer := NewTransport("peer-1", 0)
+	if err := peer.Start(); err != nil {
+		t.Fatalf("Failed to start peer: %v", err)
+	}
+	defer peer.Stop()
+	_, port, _ := net.SplitHostPort(peer.ListenAddr())
+	peerPort, _ := strconv.Atoi(port)
+
+	old := NewMeshApp("node-a", "node-a", "127.0.0.1", "aa:bb:cc:dd:ee:01")
+	old.Transport = NewTransport("node-a", 0)
+	old.InternetProxy.port = 0
+	if err := old.Transport.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	if err := old.InternetProxy.Enable(); err != nil {
+		t.Fatalf("Failed to enable proxy: %v", err)
+	}
+	old.AddStaticPeer("peer-1", "127.0.0.1", peerPort)
+	if err := old.Transport.ConnectToPeer("peer-1", "127.0.0.1", peerPort); err != nil {
+		t.Fatalf("Failed to connect to peer: %v", err)
+	}
+	token := old.InternetProxy.AuthorizeClient("client-1")
+	old.InternetClient.SetProxyToken("proxy-1", "issued-to-us")
+	transportAddr := old.Transport.ListenAddr()
+	deadline := time.Now().Add(2 * time.Second)
+	for old.InternetProxy.currentListener() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	proxyAddr := old.InternetProxy.currentListener().Addr().String()
+
+	// Hand over the sockets and state, then stop as the old daemon would
+	names, files, err := old.HandoffListeners()
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected both listeners handed over, got %v (%v)", names, err)
+	}
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := SaveHandoffState(path, old.HandoffSnapshot()); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	old.StopForHandoff()
+
+	listeners, err := fileListeners(names, files)
+	if err != nil {
+		t.Fatalf("Failed to inherit listeners: %v", err)
+	}
+	successor := NewMeshApp("node-a", "node-a", "127.0.0.1", "aa:bb:cc:dd:ee:01")
+	successor.Transport = NewTransport("node-a", 0)
+	successor.AdoptListeners(listeners)
+	if err := successor.Transport.Start(); err != nil {
+		t.Fatalf("Failed to start successor transport: %v", err)
+	}
+	defer successor.Transport.Stop()
+	if err := successor.InternetProxy.Enable(); err != nil {
+		t.Fatalf("Failed to enable successor proxy: %v", err)
+	}
+	defer successor.InternetProxy.Disable()
+
+	state, err := LoadHandoffState(path)
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if err := successor.RestoreHandoff(state); err != nil {
+		t.Fatalf("Failed to restore state: %v", err)
+	}
+
+	if addr := successor.Transport.ListenAddr(); addr != transportAddr {
+		t.Errorf("Expected the transport to keep serving on %s, got %s", transportAddr, addr)
+	}
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Expected the proxy socket to survive the handover: %v", err)
+	}
+	conn.Close()
+	if !successor.InternetProxy.IsAuthorized("client-1") || successor.InternetProxy.issuedTokens()["client-1"] != token {
+		t.Error("Expected the client to keep its authorization and token")
+	}
+	if !successor.InternetClient.hasProxyToken("proxy-1") {
+		t.Error("Expected the token the proxy issued us to be kept")
+	}
+
+	deadline = time.Now().Add(2 * time.Second)
+	for !slices.Contains(successor.Transport.GetConnectedPeers(), "peer-1") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the peer to be dialed again after the handover")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	other := NewMeshApp("node-b", "node-b", "127.0.0.1", "aa:bb:cc:dd:ee:02")
+	if err := other.RestoreHandoff(state); !errors.Is(err, ErrHandoffMismatch) {
+		t.Errorf("Expected another node's state to be refused, got %v", err)
+	}
+}
+
+func TestKeystore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore")
+	ks, err := OpenKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to create keystore: %v", err)
+	}
+	app, err := NewMeshAppWithKeystore(ks, "node", "127.0.0.1", "aa:bb:cc:dd:ee:01")
+	if err != nil {
+		t.Fatalf("Failed to create app: %v", err)
+	}
+	static, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if err := app.Transport.EnableNoise(static); err != nil {
+		t.Fatalf("Failed to enable Noise: %v", err)
+	}
+	peerKey := bytes.Repeat([]byte{7}, noiseKeySize)
+	app.Transport.PinNoiseKey("peer-1", peerKey)
+	app.Pairing.restore([]BundlePairing{{PeerID: "peer-2", VerifiedAt: time.Now(), Key: []byte("pairing key")}})
+	token := app.InternetProxy.AuthorizeClient("client-1")
+	app.InternetClient.SetProxyToken("proxy-1", "issued-to-us")
+	if err := app.SaveKeystore(); err != nil {
+		t.Fatalf("Failed to save keystore: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte(token)) || bytes.Contains(data, []byte("issued-to-us")) {
+		t.Error("Expected the keystore to be encrypted")
+	}
+	if _, err := OpenKeystore(path, "wrong"); !errors.Is(err, ErrKeystorePassphrase) {
+		t.Errorf("Expected the wrong passphrase to be refused, got %v", err)
+	}
+	var file keystoreFile
+	json.Unmarshal(data, &file)
+	file.Iterations = maxKeystoreIterations + 1
+	tampered, _ := json.Marshal(&file)
+	tamperedPath := filepath.Join(t.TempDir(), "tampered")
+	os.WriteFile(tamperedPath, tampered, 0600)
+	if _, err := OpenKeystore(tamperedPath, "correct horse"); err == nil || errors.Is(err, ErrKeystorePassphrase) {
+		t.Errorf("Expected an excessive iteration count to be refused before deriving, got %v", err)
+	}
+
+	// A restarted node gets the same identity back and, once started, its pins and tokens
+	ks, err = OpenKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to reopen keystore: %v", err)
+	}
+	restarted, err := NewMeshAppWithKeystore(ks, "node", "127.0.0.1", "aa:bb:cc:dd:ee:01")
+	if err != nil {
+		t.Fatalf("Failed to create restarted app: %v", err)
+	}
+	if restarted.Node.ID != app.Node.ID {
+		t.Fatalf("Expected the identity to survive the restart, got %s instead of %s", restarted.Node.ID, app.Node.ID)
+	}
+	restarted.Transport.EnableNoise(static)
+	restarted.loadKeystore()
+	if key, ok := restarted.Transport.PeerNoiseKey("peer-1"); !ok || !bytes.Equal(key, peerKey) {
+		t.Error("Expected the pinned Noise key to be restored")
+	}
+	if key, ok := restarted.Pairing.key("peer-2"); !ok || string(key) != "pairing key" || !restarted.Pairing.IsVerified("peer-2") {
+		t.Error("Expected the pairing to be restored")
+	}
+	if restarted.InternetProxy.issuedTokens()["client-1"] != token || !restarted.InternetProxy.IsAuthorized("client-1") {
+		t.Error("Expected the issued token to be restored")
+	}
+	if !restarted.InternetClient.hasProxyToken("proxy-1") {
+		t.Error("Expected the token a proxy issued us to be restored")
+	}
+}
+
+func TestTrafficRecording(t *testing.T) {
+	app := NewMeshApp("node-alpha-real", "Alpha's phone", "192.168.5.1", "aa:bb:cc:dd:ee:01")
+	app.Transport.dial = func(addr string, timeout time.Duration) (net.Conn, error) {
+		if addr == "192.168.5.11:9999" {
+			return nil, errors.New("connection refused by 192.168.5.11")
+		}
+		local, remote := net.Pipe()
+		go io.Copy(io.Discard, remote)
+		t.Cleanup(func() { remote.Close() })
+		return local, nil
+	}
+	if err := app.StartRecording(); err != nil {
+		t.Fatalf("Failed to start recording: %v", err)
+	}
+	if err := app.StartRecording(); !errors.Is(err, ErrRecording) {
+		t.Errorf("Expected a second recording to be refused, got %v", err)
+	}
+	app.handlePeerDiscovered(&DiscoveredPeer{ID: "node-bravo-real", Name: "Bravo's laptop", IP: "192.168.5.10", Port: 9999, MAC: "aa:bb:cc:dd:ee:02"})
+	app.handlePeerDiscovered(&DiscoveredPeer{ID: "node-charlie-real", Name: "Charlie", IP: "192.168.5.11", Port: 9999})
+	app.handleMessage("node-bravo-real", &Message{Type: "data", Source: "node-bravo-real", Dest: "node-alpha-real", Payload: []byte("private message"), Metadata: map[string]string{"token": "secret-token"}})
+	app.handleMessage("node-bravo-real", &Message{Type: "route_update", Source: "node-bravo-real", Dest: "node-alpha-real", Metadata: map[string]string{"probe": "1"}})
+	rec, err := app.StopRecording()
+	if err != nil {
+		t.Fatalf("Failed to stop recording: %v", err)
+	}
+	app.Transport.DisconnectPeer("node-bravo-real")
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatalf("Failed to encode recording: %v", err)
+	}
+	for _, secret := range []string{"-real", "192.168.5", "Bravo", "aa:bb:cc", "private message", "secret-token"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("Expected %q to be anonymized out of the recording", secret)
+		}
+	}
+	kinds := make(map[string]int)
+	for _, event := range rec.Events {
+		kinds[event.Kind]++
+		if event.Kind == RecordMessage && event.Message.Type == "data" && (event.Message.Payload != nil || event.Size != len("private message")) {
+			t.Error("Expected only the size of a data payload to be recorded")
+		}
+	}
+	if kinds[RecordPeerDiscovered] != 2 || kinds[RecordDial] != 2 || kinds[RecordMessage] != 2 {
+		t.Errorf("Unexpected recorded events: %v", kinds)
+	}
+
+	// Replaying the recording reproduces the links and routes, the same way every time
+	parsed, err := ParseRecording(data)
+	if err != nil {
+		t.Fatalf("Failed to parse recording: %v", err)
+	}
+	result, err := ReplayRecording(parsed)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if !slices.Equal(result.Peers, []string{"peer-1", "peer-2"}) || !slices.Equal(result.Connected, []string{"peer-1"}) {
+		t.Errorf("Expected both peers discovered and only peer-1 linked, got %v and %v", result.Peers, result.Connected)
+	}
+	if result.Routes["peer-1"] != "peer-1" || result.Routes["peer-2"] != "" {
+		t.Errorf("Expected a direct route to peer-1 only, got %v", result.Routes)
+	}
+	again, err := ReplayRecording(parsed)
+	if err != nil {
+		t.Fatalf("Second replay failed: %v", err)
+	}
+	if !reflect.DeepEqual(result, again) {
+		t.Error("Expected replays of a recording to match")
+	}
+}
+
+// TestWiFiCredentials tests that Wi-Fi credentials reach only paired network members,
+// sealed, and are forgotten when revoked
+func TestWiFiCredentials(t *testing.T) {
+	newNode := func(id string) *MeshApp {
+		app := NewMeshApp(id, id, "127.0.0.1", "aa:bb:cc:dd:ee:ff")
+		app.Transport = NewTransport(id, 0)
+		app.Transport.SetMessageHandler(app.handleMessage)
+		if err := app.Transport.Start(); err != nil {
+			t.Fatalf("Failed to start %s: %v", id, err)
+		}
+		t.Cleanup(app.Transport.Stop)
+		return app
+	}
+	owner := newNode("owner")
+	member := newNode("member")
+	stranger := newNode("stranger")
+	key := []byte("shared pairing key")
+	owner.Pairing.verified["member"], owner.Pairing.keys["member"] = time.Now(), key
+	member.Pairing.verified["owner"], member.Pairing.keys["owner"] = time.Now(), key
+
+	network := owner.PersonalNetworkMgr.CreateNetwork("home", "Home", "owner")
+	network.AddMember(&NetworkMember{NodeID: "member"})
+	network.AddMember(&NetworkMember{NodeID: "unpaired"})
+	member.PersonalNetworkMgr.CreateNetwork("home", "Home", "owner").AddMember(&NetworkMember{NodeID: "member"})
+
+	var sent [][]byte
+	var sentMu sync.Mutex
+	member.Transport.SetMessageHandler(func(peerID string, msg *Message) {
+		sentMu.Lock()
+		sent = append(sent, msg.Payload)
+		sentMu.Unlock()
+		member.handleMessage(peerID, msg)
+	})
+	for _, peer := range []*MeshApp{member, stranger} {
+		_, port, _ := net.SplitHostPort(peer.Transport.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		if err := owner.Transport.ConnectToPeer(peer.Node.ID, "127.0.0.1", portNum); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+	}
+
+	// Only the paired member gets it; a stranger outside the network is refused
+	if _, err := owner.ShareWiFiCredential("home", "HomeAP", "hunter22", "wpa2", time.Hour, "stranger"); err == nil {
+		t.Error("Expected sharing with a stranger to fail")
+	}
+	if err := owner.CheckWiFiCredentialPeer("unpaired", "home"); !errors.Is(err, ErrNotCredentialPeer) {
+		t.Errorf("Expected an unpaired member to be refused, got %v", err)
+	}
+	id, err := owner.ShareWiFiCredential("home", "HomeAP", "hunter22", "wpa2", 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("ShareWiFiCredential failed: %v", err)
+	}
+	var credential WiFiCredential
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if c, ok := member.WiFiCredentialFor("homeap"); ok {
+			credential = c
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the member to receive the credential")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if credential.ID != id || credential.Passphrase != "hunter22" || credential.From != "owner" {
+		t.Errorf("Unexpected credential %+v", credential)
+	}
+	if credential.Expires.After(time.Now().Add(MaxWiFiCredentialTTL)) {
+		t.Errorf("Expected the lifetime to be capped, expires %v", credential.Expires)
+	}
+	if s := fmt.Sprintf("%v %#v", credential, credential); strings.Contains(s, "hunter22") {
+		t.Errorf("Expected the passphrase to stay out of the string form, got %s", s)
+	}
+	sentMu.Lock()
+	for _, payload := range sent {
+		if strings.Contains(string(payload), "hunter22") || strings.Contains(string(payload), "HomeAP") {
+			t.Errorf("Expected the credential to travel sealed, got %s", payload)
+		}
+	}
+	sentMu.Unlock()
+	if len(stranger.WiFiCredentials()) != 0 {
+		t.Error("Expected the stranger to get nothing")
+	}
+
+	// Revoking makes the member forget it
+	if err := owner.RevokeWiFiCredential(id); err != nil {
+		t.Fatalf("RevokeWiFiCredential failed: %v", err)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for len(member.WiFiCredentials()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the member to forget the revoked credential")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
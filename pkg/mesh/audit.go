@@ -0,0 +1,231 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Audit actions. Audit events record security-relevant decisions and are kept apart
+// from debug logs so they can be retained and reviewed on their own.
+const (
+	AuditPeerAuthorized     = "peer_authorized"
+	AuditPeerRevoked        = "peer_revoked"
+	AuditPairingVerified    = "pairing_verified"
+	AuditPolicyChanged      = "policy_changed"
+	AuditBlocklistHit       = "blocklist_hit"
+	AuditQuotaExceeded      = "quota_exceeded"
+	AuditMACFilterBlocked   = "mac_filter_blocked"
+	AuditLogsFetched        = "logs_fetched"
+	AuditMgmtDenied         = "mgmt_denied"
+	AuditClientStanding     = "client_standing"
+	AuditAccessRequested    = "access_requested"
+	AuditAccessDenied       = "access_denied"
+	AuditStatsShared        = "stats_shared"
+	AuditConfigImported     = "config_imported"
+	AuditPeerUnverified     = "peer_unverified"
+	AuditForgedMessage      = "forged_message"
+	AuditProxyTokenRejected = "proxy_token_rejected"
+	AuditProxyACLDenied     = "proxy_acl_denied"
+	AuditNetworkJoined      = "network_joined"
+	AuditNetworkJoinRefused = "network_join_refused"
+	AuditPeerTrust          = "peer_trust"         // A peer's trust level changed
+	AuditTrustRefused       = "trust_refused"      // An untrusted peer was refused internet access
+	AuditIdentityRevoked    = "identity_revoked"   // A node identity was revoked or rotated
+	AuditMemberCertIssued   = "member_cert_issued" // We certified a node as a member of a network we own; Detail is the network
+	AuditAbuseWarning       = "abuse_warning"      // A peer warned it banned a client; PeerID is the client
+)
+
+// AuditEvent is a single structured audit record
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	NodeID string    `json:"node_id"` // Node that made the decision
+	Action string    `json:"action"`
+	PeerID string    `json:"peer_id,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// AuditSink receives audit events
+type AuditSink interface {
+	WriteAudit(event *AuditEvent) error
+	Close() error
+}
+
+// Auditor fans audit events out to its sinks. A nil Auditor discards events.
+type Auditor struct {
+	nodeID string
+	sinks  []AuditSink
+	errors uint64
+	mu     sync.RWMutex
+}
+
+// NewAuditor creates an auditor with no sinks
+func NewAuditor(nodeID string) *Auditor {
+	return &Auditor{nodeID: nodeID}
+}
+
+// AddSink starts delivering events to a sink
+func (a *Auditor) AddSink(sink AuditSink) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sinks = append(a.sinks, sink)
+}
+
+// Close closes and removes all sinks
+func (a *Auditor) Close() error {
+	a.mu.Lock()
+	sinks := a.sinks
+	a.sinks = nil
+	a.mu.Unlock()
+
+	var firstErr error
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Record writes an audit event to every sink
+func (a *Auditor) Record(action, peerID, detail string) {
+	if a == nil {
+		return
+	}
+	event := &AuditEvent{
+		Time:   time.Now().UTC(),
+		NodeID: a.nodeID,
+		Action: action,
+		PeerID: peerID,
+		Detail: detail,
+	}
+
+	a.mu.RLock()
+	sinks := a.sinks
+	a.mu.RUnlock()
+	for _, sink := range sinks {
+		if err := sink.WriteAudit(event); err != nil {
+			atomic.AddUint64(&a.errors, 1)
+		}
+	}
+}
+
+// Errors returns how many events sinks failed to write
+func (a *Auditor) Errors() uint64 {
+	return atomic.LoadUint64(&a.errors)
+}
+
+// FileAuditSink appends audit events to a file as JSON lines
+type FileAuditSink struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+// NewFileAuditSink opens (or creates) an audit log readable only by its owner
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &FileAuditSink{file: file}, nil
+}
+
+// WriteAudit appends one event
+func (s *FileAuditSink) WriteAudit(event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the audit log
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// webhookQueueSize bounds the events waiting to be posted to a webhook
+const webhookQueueSize = 256
+
+// WebhookAuditSink posts audit events as JSON to an HTTP endpoint. Events are queued
+// so a slow endpoint never holds up the proxy; when the queue is full they are dropped.
+type WebhookAuditSink struct {
+	url     string
+	client  *http.Client
+	queue   chan *AuditEvent
+	dropped uint64
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewWebhookAuditSink starts delivering events to url
+func NewWebhookAuditSink(url string) *WebhookAuditSink {
+	s := &WebhookAuditSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *AuditEvent, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go s.deliverLoop()
+	return s
+}
+
+// WriteAudit queues an event for delivery
+func (s *WebhookAuditSink) WriteAudit(event *AuditEvent) error {
+	select {
+	case <-s.done:
+		return fmt.Errorf("audit webhook closed")
+	default:
+	}
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		return fmt.Errorf("audit webhook queue full")
+	}
+}
+
+// Dropped returns how many events were dropped because the queue was full
+func (s *WebhookAuditSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops delivery; queued events that were not yet posted are discarded
+func (s *WebhookAuditSink) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *WebhookAuditSink) deliverLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case event := <-s.queue:
+			s.post(event)
+		}
+	}
+}
+
+func (s *WebhookAuditSink) post(event *AuditEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
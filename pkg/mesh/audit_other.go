@@ -0,0 +1,23 @@
+//go:build windows || plan9
+
+package mesh
+
+import "errors"
+
+// SyslogAuditSink is unavailable on this platform
+type SyslogAuditSink struct{}
+
+// NewSyslogAuditSink always fails on this platform
+func NewSyslogAuditSink(network, addr string) (*SyslogAuditSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+// WriteAudit is a no-op
+func (s *SyslogAuditSink) WriteAudit(event *AuditEvent) error {
+	return nil
+}
+
+// Close is a no-op
+func (s *SyslogAuditSink) Close() error {
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build !windows && !plan9
+
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+)
+
+// SyslogAuditSink sends audit events to the system logger under the auth facility
+type SyslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogAuditSink connects to syslog; an empty network and addr use the local daemon
+func NewSyslogAuditSink(network, addr string) (*SyslogAuditSink, error) {
+	writer, err := syslog.Dial(network, addr, syslog.LOG_AUTH|syslog.LOG_NOTICE, "intermesh")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	return &SyslogAuditSink{writer: writer}, nil
+}
+
+// WriteAudit logs one event as JSON
+func (s *SyslogAuditSink) WriteAudit(event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.writer.Notice(string(line))
+}
+
+// Close disconnects from syslog
+func (s *SyslogAuditSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,311 @@
+package mesh
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bench topologies
+const (
+	TopologyFull = "full"
+	TopologyRing = "ring"
+	TopologyLine = "line"
+	TopologyStar = "star"
+)
+
+// BenchConfig describes a reproducible stress test: the same config and seed produce
+// the same topology and traffic pattern
+type BenchConfig struct {
+	Nodes             int           // Virtual nodes, each with its own loopback transport
+	Topology          string        // full, ring, line or star
+	BroadcastRate     int           // Broadcasts per second across the whole mesh
+	MessageSize       int           // Payload bytes per broadcast
+	Duration          time.Duration // How long to drive broadcast traffic
+	TunnelRequests    int           // HTTP requests proxied through node 0; 0 skips the tunnel phase
+	TunnelConcurrency int
+	TunnelBodySize    int // Response body bytes served per tunnel request
+	Seed              int64
+}
+
+// DefaultBenchConfig returns a small benchmark that runs in a few seconds
+func DefaultBenchConfig() BenchConfig {
+	return BenchConfig{
+		Nodes:             10,
+		Topology:          TopologyFull,
+		BroadcastRate:     100,
+		MessageSize:       256,
+		Duration:          5 * time.Second,
+		TunnelRequests:    100,
+		TunnelConcurrency: 4,
+		TunnelBodySize:    16 * 1024,
+		Seed:              1,
+	}
+}
+
+// BenchReport holds the results of a stress test
+type BenchReport struct {
+	Config BenchConfig `json:"config"`
+
+	Links            int           `json:"links"`
+	ConvergenceTime  time.Duration `json:"convergence_time_ns"`
+	BroadcastsSent   int           `json:"broadcasts_sent"`
+	ExpectedDelivery int           `json:"expected_deliveries"`
+	Delivered        int64         `json:"delivered"`
+	DeliveryRatio    float64       `json:"delivery_ratio"`
+	MessagesPerSec   float64       `json:"messages_per_sec"`
+	BytesPerSec      float64       `json:"bytes_per_sec"`
+
+	TunnelOK          int           `json:"tunnel_ok"`
+	TunnelFailed      int           `json:"tunnel_failed"`
+	TunnelPerSec      float64       `json:"tunnel_requests_per_sec"`
+	TunnelP50         time.Duration `json:"tunnel_p50_ns"`
+	TunnelP95         time.Duration `json:"tunnel_p95_ns"`
+	TunnelBytesPerSec float64       `json:"tunnel_bytes_per_sec"`
+
+	HeapBytes        uint64 `json:"heap_bytes"`
+	HeapBytesPerNode uint64 `json:"heap_bytes_per_node"`
+	Goroutines       int    `json:"goroutines"`
+}
+
+// benchLinks returns the node pairs connected in a topology; the lower index dials
+func benchLinks(topology string, n int) ([][2]int, error) {
+	var links [][2]int
+	switch topology {
+	case TopologyFull:
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				links = append(links, [2]int{i, j})
+			}
+		}
+	case TopologyRing, TopologyLine:
+		for i := 0; i+1 < n; i++ {
+			links = append(links, [2]int{i, i + 1})
+		}
+		if topology == TopologyRing && n > 2 {
+			links = append(links, [2]int{0, n - 1})
+		}
+	case TopologyStar:
+		for i := 1; i < n; i++ {
+			links = append(links, [2]int{0, i})
+		}
+	default:
+		return nil, fmt.Errorf("unknown topology %q", topology)
+	}
+	return links, nil
+}
+
+// RunBench spawns virtual nodes on loopback ports, connects them in the configured
+// topology, drives broadcast and tunnel traffic, and reports what it measured
+func RunBench(cfg BenchConfig) (*BenchReport, error) {
+	if cfg.Nodes < 2 {
+		return nil, fmt.Errorf("need at least 2 nodes, got %d", cfg.Nodes)
+	}
+	links, err := benchLinks(cfg.Topology, cfg.Nodes)
+	if err != nil {
+		return nil, err
+	}
+	report := &BenchReport{Config: cfg, Links: len(links)}
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	// Start one transport per node on an ephemeral loopback port
+	var delivered int64
+	transports := make([]*Transport, cfg.Nodes)
+	ports := make([]int, cfg.Nodes)
+	for i := range transports {
+		t := NewTransport(fmt.Sprintf("bench-%d", i), 0)
+		t.SetMessageHandler(func(peerID string, msg *Message) {
+			if msg.Type == "data" {
+				atomic.AddInt64(&delivered, 1)
+			}
+		})
+		if err := t.Start(); err != nil {
+			stopTransports(transports)
+			return nil, fmt.Errorf("node %d: %w", i, err)
+		}
+		_, port, _ := net.SplitHostPort(t.ListenAddr())
+		ports[i], _ = strconv.Atoi(port)
+		transports[i] = t
+	}
+	defer stopTransports(transports)
+
+	// Convergence: time until every node sees all of its neighbors
+	degree := make([]int, cfg.Nodes)
+	start := time.Now()
+	for _, link := range links {
+		a, b := link[0], link[1]
+		if err := transports[a].ConnectToPeer(fmt.Sprintf("bench-%d", b), "127.0.0.1", ports[b]); err != nil {
+			return nil, fmt.Errorf("link %d-%d: %w", a, b, err)
+		}
+		degree[a]++
+		degree[b]++
+	}
+	for {
+		converged := true
+		for i, t := range transports {
+			if len(t.GetConnectedPeers()) < degree[i] {
+				converged = false
+				break
+			}
+		}
+		if converged {
+			break
+		}
+		if time.Since(start) > 30*time.Second {
+			return nil, fmt.Errorf("mesh did not converge within 30s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	report.ConvergenceTime = time.Since(start)
+
+	// Broadcast phase, with senders chosen by the seeded generator
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	payload := make([]byte, cfg.MessageSize)
+	rng.Read(payload)
+	if cfg.BroadcastRate > 0 && cfg.Duration > 0 {
+		interval := time.Second / time.Duration(cfg.BroadcastRate)
+		ticker := time.NewTicker(interval)
+		phaseStart := time.Now()
+		for time.Since(phaseStart) < cfg.Duration {
+			<-ticker.C
+			sender := rng.Intn(cfg.Nodes)
+			transports[sender].BroadcastMessage(&Message{
+				Type:      "data",
+				Source:    fmt.Sprintf("bench-%d", sender),
+				Payload:   payload,
+				Timestamp: time.Now(),
+			})
+			report.BroadcastsSent++
+			report.ExpectedDelivery += degree[sender]
+		}
+		ticker.Stop()
+		elapsed := time.Since(phaseStart)
+
+		// Let in-flight messages land before counting
+		deadline := time.Now().Add(2 * time.Second)
+		for atomic.LoadInt64(&delivered) < int64(report.ExpectedDelivery) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		report.Delivered = atomic.LoadInt64(&delivered)
+		if report.ExpectedDelivery > 0 {
+			report.DeliveryRatio = float64(report.Delivered) / float64(report.ExpectedDelivery)
+		}
+		report.MessagesPerSec = float64(report.Delivered) / elapsed.Seconds()
+		report.BytesPerSec = report.MessagesPerSec * float64(cfg.MessageSize)
+	}
+
+	if cfg.TunnelRequests > 0 {
+		if err := runTunnelBench(cfg, report); err != nil {
+			return nil, err
+		}
+	}
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if after.HeapAlloc > before.HeapAlloc {
+		report.HeapBytes = after.HeapAlloc - before.HeapAlloc
+	}
+	report.HeapBytesPerNode = report.HeapBytes / uint64(cfg.Nodes)
+	report.Goroutines = runtime.NumGoroutine()
+	return report, nil
+}
+
+// runTunnelBench proxies HTTP requests through an InternetProxy on node 0 to a local upstream
+func runTunnelBench(cfg BenchConfig, report *BenchReport) error {
+	body := make([]byte, cfg.TunnelBodySize)
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to start upstream: %w", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})}
+	go server.Serve(upstream)
+	defer server.Close()
+
+	proxy := NewInternetProxy("bench-0", nil)
+	if err := proxy.Enable(); err != nil {
+		return fmt.Errorf("failed to start proxy: %w", err)
+	}
+	defer proxy.Disable()
+	if !proxy.IsEnabled() {
+		return fmt.Errorf("proxy port %d is unavailable", ProxyPort)
+	}
+
+	client := NewInternetClient("bench-1")
+	if err := client.ConnectToProxy("bench-0", "127.0.0.1", ProxyPort); err != nil {
+		return err
+	}
+	client.SetProxyToken("bench-0", proxy.AuthorizeClient("bench-1"))
+	url := "http://" + upstream.Addr().String() + "/"
+
+	concurrency := cfg.TunnelConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	jobs := make(chan struct{}, cfg.TunnelRequests)
+	for i := 0; i < cfg.TunnelRequests; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	var latencies []time.Duration
+	var received int64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				reqStart := time.Now()
+				resp, err := client.MakeRequest(url)
+				var n int64
+				if err == nil {
+					n, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				mu.Lock()
+				if err == nil {
+					report.TunnelOK++
+					received += n
+					latencies = append(latencies, time.Since(reqStart))
+				} else {
+					report.TunnelFailed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report.TunnelPerSec = float64(report.TunnelOK) / elapsed.Seconds()
+	report.TunnelBytesPerSec = float64(received) / elapsed.Seconds()
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		report.TunnelP50 = latencies[len(latencies)*50/100]
+		report.TunnelP95 = latencies[len(latencies)*95/100]
+	}
+	return nil
+}
+
+func stopTransports(transports []*Transport) {
+	for _, t := range transports {
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bonding spreads a client's requests over several proxies at once, so one device can
+// use the bandwidth of more than one shared connection. Each request, and each CONNECT
+// tunnel, goes to the proxy with the fewest requests in flight.
+
+const (
+	// DefaultMaxBondedProxies is how many proxies a client uses at once; 1 disables bonding
+	DefaultMaxBondedProxies = 1
+
+	// UpstreamFailureCooldown is how long a proxy that failed a request is avoided by default
+	UpstreamFailureCooldown = 30 * time.Second
+
+	// TunnelSetupTimeout bounds connecting to a proxy and its answer to CONNECT by default
+	TunnelSetupTimeout = 30 * time.Second
+)
+
+// upstreamProxy is one proxy a client sends requests through
+type upstreamProxy struct {
+	peerID      string
+	url         *url.URL
+	inFlight    atomic.Int64
+	requests    atomic.Int64
+	failedUntil atomic.Int64 // Monotonic instant (see monoNow) until which the proxy is avoided
+	reauthAfter atomic.Int64 // Monotonic instant before which we don't ask the proxy for a new token
+	session     *ProxySession
+}
+
+// UpstreamStats describes how a client is using one of its proxies
+type UpstreamStats struct {
+	PeerID   string `json:"peer_id"`
+	Primary  bool   `json:"primary"`
+	InFlight int64  `json:"in_flight"`
+	Requests int64  `json:"requests"`
+	Failing  bool   `json:"failing"`
+}
+
+func newUpstreamProxy(peerID, ip string, port int) (*upstreamProxy, error) {
+	u, err := url.Parse(proxyURL(ip, port))
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy address: %w", err)
+	}
+	return &upstreamProxy{peerID: peerID, url: u}, nil
+}
+
+func (u *upstreamProxy) failing(now time.Time) bool {
+	return monoAt(now) < u.failedUntil.Load()
+}
+
+type upstreamKey struct{}
+
+// bondedTransport schedules each request onto one of the client's proxies
+type bondedTransport struct {
+	client *InternetClient
+	base   *http.Transport
+}
+
+func newBondedTransport(client *InternetClient) *bondedTransport {
+	return &bondedTransport{
+		client: client,
+		base: &http.Transport{
+			// Connections are pooled per proxy, so each keeps its own keep-alives and tunnels
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				if up, ok := req.Context().Value(upstreamKey{}).(*upstreamProxy); ok {
+					return client.proxyURL(up), nil
+				}
+				return nil, fmt.Errorf("no proxy scheduled for request")
+			},
+			// Seal connections to proxies we share a session with
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				if up, ok := ctx.Value(upstreamKey{}).(*upstreamProxy); ok && up.session != nil && up.url.Host == addr {
+					return wrapSession(conn, up.session)
+				}
+				return conn, nil
+			},
+			// Identify ourselves to proxies; only the token in the proxy URL proves it
+			GetProxyConnectHeader: func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+				header := http.Header{ClientNodeHeader: {client.nodeID}}
+				if saver := client.dataSaver(); saver != "" {
+					header.Set(DataSaverHeader, saver)
+				}
+				return header, nil
+			},
+		},
+	}
+}
+
+func (t *bondedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	up := t.client.pickUpstream(time.Now())
+	if up == nil {
+		return nil, fmt.Errorf("not connected to proxy")
+	}
+	up.inFlight.Add(1)
+	up.requests.Add(1)
+
+	scheduled := req.Clone(context.WithValue(req.Context(), upstreamKey{}, up))
+	if scheduled.Header.Get(ClientNodeHeader) == "" {
+		scheduled.Header.Set(ClientNodeHeader, t.client.nodeID)
+	}
+	if saver := t.client.dataSaver(); saver != "" && scheduled.Header.Get(DataSaverHeader) == "" {
+		scheduled.Header.Set(DataSaverHeader, saver)
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(scheduled)
+	if err != nil {
+		up.inFlight.Add(-1)
+		if req.Context().Err() == nil {
+			up.failedUntil.Store(monoAt(time.Now().Add(t.client.timeoutPolicy().ProxyCooldown)))
+			t.client.samples.observeRequest(true)
+			t.client.trustTracker().Record(up.peerID, TrustRelayFailed, time.Now())
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		t.client.authRequired(up)
+	}
+	// Gateway errors mean the proxy couldn't reach the destination
+	t.client.samples.observeRequest(resp.StatusCode >= http.StatusBadGateway)
+	if resp.StatusCode < http.StatusBadGateway {
+		t.client.trustTracker().Record(up.peerID, TrustRelaySucceeded, time.Now())
+	}
+	body := &upstreamBody{ReadCloser: resp.Body}
+	body.release = func() {
+		up.inFlight.Add(-1)
+		t.client.samples.observeTransfer(body.read, time.Since(start))
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections to every proxy
+func (t *bondedTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+}
+
+// DialContext opens a tunnel to addr, a host:port, with CONNECT through one of the
+// client's proxies, for traffic other than HTTP requests. It suits net.Dialer-style
+// hooks; network must be TCP.
+func (c *InternetClient) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	host, port, err := splitAuthority(addr)
+	if err != nil {
+		return nil, err
+	}
+	if port == "" {
+		return nil, fmt.Errorf("missing port in %q", addr)
+	}
+	target := net.JoinHostPort(host, port)
+	up := c.pickUpstream(time.Now())
+	if up == nil {
+		return nil, fmt.Errorf("not connected to proxy")
+	}
+	up.inFlight.Add(1)
+	up.requests.Add(1)
+
+	conn, err := c.connectVia(ctx, up, target)
+	var refused *connectRefusedError
+	switch {
+	case errors.As(err, &refused) && refused.status < http.StatusBadGateway:
+		// The proxy answered; it just won't take us there
+		up.inFlight.Add(-1)
+		if refused.status == http.StatusProxyAuthRequired {
+			c.authRequired(up)
+		}
+		c.samples.observeRequest(false)
+		c.trustTracker().Record(up.peerID, TrustRelaySucceeded, time.Now())
+		return nil, err
+	case err != nil:
+		up.inFlight.Add(-1)
+		if ctx.Err() == nil {
+			up.failedUntil.Store(monoAt(time.Now().Add(c.timeoutPolicy().ProxyCooldown)))
+			c.samples.observeRequest(true)
+			c.trustTracker().Record(up.peerID, TrustRelayFailed, time.Now())
+		}
+		return nil, err
+	}
+	c.samples.observeRequest(false)
+	c.trustTracker().Record(up.peerID, TrustRelaySucceeded, time.Now())
+	return &upstreamConn{Conn: conn, release: func() { up.inFlight.Add(-1) }}, nil
+}
+
+// connectVia opens a tunnel to target through one proxy, presenting our token for it
+func (c *InternetClient) connectVia(ctx context.Context, up *upstreamProxy, target string) (net.Conn, error) {
+	proxy := c.proxyURL(up)
+	ctx, cancel := context.WithTimeout(ctx, c.timeoutPolicy().TunnelSetup)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach proxy: %w", err)
+	}
+	if up.session != nil {
+		if conn, err = wrapSession(conn, up.session); err != nil {
+			return nil, fmt.Errorf("failed to reach proxy: %w", err)
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Give up the handshake if the caller does
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	header := http.Header{ClientNodeHeader: {c.nodeID}}
+	if saver := c.dataSaver(); saver != "" {
+		header.Set(DataSaverHeader, saver)
+	}
+	tunnel, err := httpConnect(conn, proxy.User, target, header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !stop() {
+		tunnel.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// upstreamConn ends a tunnel's time in flight when it is closed
+type upstreamConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// upstreamBody ends a request's time in flight when its body is closed
+type upstreamBody struct {
+	io.ReadCloser
+	read    int64
+	release func()
+	once    sync.Once
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+func (b *upstreamBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// pickUpstream returns the healthy proxy with the fewest requests in flight, preferring
+// the primary on ties. When every proxy recently failed, the standby is used if it is
+// healthy, and otherwise the least busy proxy is tried anyway.
+func (c *InternetClient) pickUpstream(now time.Time) *upstreamProxy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var best, bestFailing *upstreamProxy
+	for _, up := range c.upstreams {
+		if up.failing(now) {
+			if bestFailing == nil || up.inFlight.Load() < bestFailing.inFlight.Load() {
+				bestFailing = up
+			}
+			continue
+		}
+		if best == nil || up.inFlight.Load() < best.inFlight.Load() {
+			best = up
+		}
+	}
+	if best != nil {
+		return best
+	}
+	if c.standby != nil && !c.standby.failing(now) {
+		return c.standby
+	}
+	return bestFailing
+}
+
+// AddBondedProxy adds a proxy that shares the client's requests with the primary one
+func (c *InternetClient) AddBondedProxy(proxyPeerID, proxyIP string, port int) error {
+	up, err := newUpstreamProxy(proxyPeerID, proxyIP, port)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return fmt.Errorf("not connected to proxy")
+	}
+	up.session = c.sessionLocked(proxyPeerID)
+	for i, existing := range c.upstreams {
+		if existing.peerID == proxyPeerID {
+			c.upstreams[i] = up
+			return nil
+		}
+	}
+	c.upstreams = append(c.upstreams, up)
+	return nil
+}
+
+// RemoveBondedProxy stops sending requests through a bonded proxy; the primary proxy is
+// only removed by Disconnect
+func (c *InternetClient) RemoveBondedProxy(proxyPeerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if proxyPeerID == c.proxyPeerID {
+		return
+	}
+	for i, up := range c.upstreams {
+		if up.peerID == proxyPeerID {
+			c.upstreams = append(c.upstreams[:i:i], c.upstreams[i+1:]...)
+			return
+		}
+	}
+}
+
+// UsesProxy reports whether a peer is one of our proxies: primary, bonded or standby
+func (c *InternetClient) UsesProxy(peerID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.standby != nil && c.standby.peerID == peerID {
+		return true
+	}
+	for _, up := range c.upstreams {
+		if up.peerID == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// Upstreams returns how the client is using each of its proxies, primary first
+func (c *InternetClient) Upstreams() []UpstreamStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	stats := make([]UpstreamStats, 0, len(c.upstreams))
+	for _, up := range c.upstreams {
+		stats = append(stats, UpstreamStats{
+			PeerID:   up.peerID,
+			Primary:  up.peerID == c.proxyPeerID,
+			InFlight: up.inFlight.Load(),
+			Requests: up.requests.Load(),
+			Failing:  up.failing(now),
+		})
+	}
+	return stats
+}
+
+// usableExit reports whether a discovered peer may be used as an exit right now
+func (ma *MeshApp) usableExit(peer *DiscoveredPeer) bool {
+	now := time.Now()
+	return peer.HasInternet && ma.ExitConsent.IsAllowedExit(peer.ID) && peer.Terms.IsAvailableAt(now) &&
+		ma.Trust.Trusted(peer.ID, now)
+}
+
+// betterExit reports whether peer is a better exit than best, which may be nil. Exits
+// serving any destination win over scoped ones, then the lowest tier so chains through
+// other mesh proxies are a last resort, then those plugged in or with battery to spare,
+// then the fastest link.
+func betterExit(peer, best *DiscoveredPeer) bool {
+	if best == nil {
+		return true
+	}
+	if peer.Terms.Scoped() != best.Terms.Scoped() {
+		return best.Terms.Scoped()
+	}
+	if peer.Tier != best.Tier {
+		return peer.Tier < best.Tier
+	}
+	if power, bestPower := powerRank(peer.Power), powerRank(best.Power); power != bestPower {
+		return power > bestPower
+	}
+	return linkRank(peer.Link) > linkRank(best.Link)
+}
+
+// bondProxies adds proxies alongside the primary until MaxBondedProxies are in use. Only
+// peers the user already approved and paired with are bonded; they are never prompted for.
+func (ma *MeshApp) bondProxies() {
+	max := ma.Config().MaxBondedProxies
+	if max <= 1 || !ma.InternetClient.IsConnected() {
+		return
+	}
+	ma.mu.RLock()
+	tier := ma.upstreamTier
+	ma.mu.RUnlock()
+
+	inUse := len(ma.InternetClient.Upstreams())
+	for _, peer := range ma.Discovery.GetPeers() {
+		if inUse >= max {
+			return
+		}
+		// Proxies further from a direct connection than the primary would only add chain hops,
+		// and scoped ones would refuse much of what is spread over the bond
+		if peer.Tier > tier || peer.Terms.Scoped() || ma.InternetClient.UsesProxy(peer.ID) || !ma.usableExit(peer) ||
+			!ma.ExitConsent.HasConsent(peer) || ma.pairingRequired(peer.ID) {
+			continue
+		}
+		if err := ma.Transport.ConnectToPeer(peer.ID, peer.IP, peer.Port); err != nil {
+			continue
+		}
+		if err := ma.InternetClient.AddBondedProxy(peer.ID, peer.IP, ProxyPort); err != nil {
+			continue
+		}
+		ma.requestProxyAccess(peer.ID)
+		inUse++
+	}
+}
@@ -0,0 +1,326 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A config bundle carries a node's settings and trust relationships to another device,
+// encrypted with a passphrase: a 6-byte magic, a random salt and nonce, then the
+// AES-256-GCM sealed JSON of a ConfigBundle. The key is derived with PBKDF2-SHA256.
+const (
+	bundleMagic      = "IMCB1\n"
+	bundleSaltSize   = 16
+	bundleIterations = 600000
+)
+
+var (
+	// ErrBundlePassphrase is returned when a bundle can't be opened with the passphrase
+	ErrBundlePassphrase = errors.New("wrong passphrase or damaged config bundle")
+	// ErrBundleIdentity is returned when importing another node's identity into a running node
+	ErrBundleIdentity = errors.New("config bundle belongs to another node")
+)
+
+// ConfigBundle is the content of an exported configuration
+type ConfigBundle struct {
+	Identity    *BundleIdentity  `json:"identity,omitempty"` // Only when exported with the identity
+	Config      Config           `json:"config"`
+	Pairings    []BundlePairing  `json:"pairings,omitempty"`
+	MACAllow    []string         `json:"mac_allow,omitempty"`
+	MACDeny     []string         `json:"mac_deny,omitempty"`
+	ProxyACL    ProxyACLRules    `json:"proxy_acl"`
+	ExitPeers   []string         `json:"exit_peers,omitempty"`   // Peers consented to as exits
+	ExitRegions []string         `json:"exit_regions,omitempty"` // Regions consented to as exits
+	ExitOnly    []string         `json:"exit_only,omitempty"`    // The only exits allowed, if restricted
+	StaticPeers []DiscoveredPeer `json:"static_peers,omitempty"`
+	Networks    []BundleNetwork  `json:"networks,omitempty"`
+	ExportedAt  time.Time        `json:"exported_at"`
+}
+
+// BundleIdentity is the node ID peers know this device by
+type BundleIdentity struct {
+	NodeID string `json:"node_id"`
+	Name   string `json:"name"`
+}
+
+// BundlePairing is a verified peer and the key shared with it
+type BundlePairing struct {
+	PeerID     string    `json:"peer_id"`
+	VerifiedAt time.Time `json:"verified_at"`
+	Key        []byte    `json:"key,omitempty"`
+}
+
+// BundleNetwork is a personal network with its members and policy
+type BundleNetwork struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Owner     string            `json:"owner"`
+	OwnerKey  ed25519.PublicKey `json:"owner_key,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Members   []NetworkMember   `json:"members,omitempty"`
+	Policies  *NetworkPolicy    `json:"policies,omitempty"`
+	// Certificate-based networks carry their members' certificates
+	RequireCerts bool              `json:"require_certs,omitempty"`
+	Certs        []*MembershipCert `json:"certs,omitempty"`
+}
+
+// ExportConfig returns the node's settings, verified peers, exit consent, static peers
+// and personal networks as a bundle encrypted with passphrase. With includeIdentity the
+// new device takes over this node's ID, so peers keep trusting it without re-pairing.
+func (ma *MeshApp) ExportConfig(passphrase string, includeIdentity bool) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("a passphrase is required to export the configuration")
+	}
+
+	bundle := &ConfigBundle{Config: ma.Config(), ExportedAt: time.Now()}
+	if includeIdentity {
+		bundle.Identity = &BundleIdentity{NodeID: ma.Node.ID, Name: ma.Node.Name}
+	}
+	bundle.Pairings = ma.Pairing.export()
+	bundle.MACAllow, bundle.MACDeny = ma.MACFilter.export()
+	bundle.ProxyACL = ma.ProxyACL.Rules()
+	bundle.ExitPeers, bundle.ExitRegions, bundle.ExitOnly = ma.ExitConsent.export()
+
+	ma.mu.RLock()
+	for _, peer := range ma.staticPeers {
+		bundle.StaticPeers = append(bundle.StaticPeers, DiscoveredPeer{ID: peer.ID, IP: peer.IP, Port: peer.Port})
+	}
+	ma.mu.RUnlock()
+	sort.Slice(bundle.StaticPeers, func(i, j int) bool { return bundle.StaticPeers[i].ID < bundle.StaticPeers[j].ID })
+
+	bundle.Networks = ma.PersonalNetworkMgr.export()
+
+	plaintext, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	return sealBundle(plaintext, passphrase)
+}
+
+// OpenConfigBundle decrypts a bundle without applying it, e.g. to read the identity
+// a new node has to be created with before importing
+func OpenConfigBundle(data []byte, passphrase string) (*ConfigBundle, error) {
+	plaintext, err := openBundle(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var bundle ConfigBundle
+	if err := json.Unmarshal(plaintext, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid config bundle: %w", err)
+	}
+	return &bundle, nil
+}
+
+// ImportConfig applies an exported bundle: settings are replaced, and verified peers,
+// exit consent, static peers and networks are merged into what the node has. A bundle
+// carrying an identity can only be imported by a node created with that ID.
+func (ma *MeshApp) ImportConfig(data []byte, passphrase string) (*ConfigBundle, error) {
+	bundle, err := OpenConfigBundle(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.Identity != nil && bundle.Identity.NodeID != ma.Node.ID {
+		return nil, fmt.Errorf("%w: create the node as %q to import it", ErrBundleIdentity, bundle.Identity.NodeID)
+	}
+
+	if bundle.Identity != nil && bundle.Identity.Name != "" {
+		ma.Node.Name = bundle.Identity.Name
+	}
+	ma.ApplyConfig(bundle.Config)
+	ma.Pairing.restore(bundle.Pairings)
+	for _, mac := range bundle.MACAllow {
+		ma.MACFilter.Allow(mac)
+	}
+	for _, mac := range bundle.MACDeny {
+		ma.MACFilter.Deny(mac)
+	}
+	ma.ProxyACL.merge(bundle.ProxyACL)
+	for _, peerID := range bundle.ExitPeers {
+		ma.ExitConsent.GrantPeer(peerID)
+	}
+	for _, region := range bundle.ExitRegions {
+		ma.ExitConsent.GrantRegion(region)
+	}
+	for _, peerID := range bundle.ExitOnly {
+		ma.ExitConsent.AllowExit(peerID)
+	}
+	for _, peer := range bundle.StaticPeers {
+		// A peer that can't be dialed now stays configured and is retried like any other
+		ma.AddStaticPeer(peer.ID, peer.IP, peer.Port)
+	}
+	ma.PersonalNetworkMgr.restore(bundle.Networks)
+
+	ma.Audit.Record(AuditConfigImported, "", fmt.Sprintf("%d verified peers, %d networks", len(bundle.Pairings), len(bundle.Networks)))
+	return bundle, nil
+}
+
+// sealBundle encrypts a bundle's JSON with a key derived from passphrase
+func sealBundle(plaintext []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, bundleSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := bundleCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(bundleMagic), salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, []byte(bundleMagic)), nil
+}
+
+// openBundle decrypts a sealed bundle
+func openBundle(data []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(bundleMagic)) {
+		return nil, errors.New("not a config bundle")
+	}
+	data = data[len(bundleMagic):]
+	if len(data) < bundleSaltSize {
+		return nil, ErrBundlePassphrase
+	}
+	aead, err := bundleCipher(passphrase, data[:bundleSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	data = data[bundleSaltSize:]
+	if len(data) < aead.NonceSize() {
+		return nil, ErrBundlePassphrase
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(bundleMagic))
+	if err != nil {
+		return nil, ErrBundlePassphrase
+	}
+	return plaintext, nil
+}
+
+// bundleCipher derives the bundle key from a passphrase
+func bundleCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, bundleIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// export returns the verified peers with their keys
+func (p *Pairing) export() []BundlePairing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pairings := make([]BundlePairing, 0, len(p.verified))
+	for peerID, at := range p.verified {
+		pairings = append(pairings, BundlePairing{PeerID: peerID, VerifiedAt: at, Key: p.keys[peerID]})
+	}
+	sort.Slice(pairings, func(i, j int) bool { return pairings[i].PeerID < pairings[j].PeerID })
+	return pairings
+}
+
+// restore adds exported verified peers
+func (p *Pairing) restore(pairings []BundlePairing) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pairing := range pairings {
+		p.verified[pairing.PeerID] = pairing.VerifiedAt
+		if len(pairing.Key) > 0 {
+			p.keys[pairing.PeerID] = pairing.Key
+		}
+	}
+}
+
+// export returns the allowed and denied MAC addresses
+func (f *MACFilter) export() (allow, deny []string) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return sortedKeys(f.allow), sortedKeys(f.deny)
+}
+
+// export returns the consented peers and regions and the exits use is restricted to
+func (ec *ExitConsent) export() (peers, regions, only []string) {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	return sortedKeys(ec.consentedPeers), sortedKeys(ec.consentedRegions), sortedKeys(ec.allowedExits)
+}
+
+// export returns every personal network with its members
+func (pnm *PersonalNetworkManager) export() []BundleNetwork {
+	pnm.mu.RLock()
+	defer pnm.mu.RUnlock()
+	networks := make([]BundleNetwork, 0, len(pnm.Networks))
+	for _, network := range pnm.Networks {
+		network.mu.RLock()
+		exported := BundleNetwork{
+			ID:        network.ID,
+			Name:      network.Name,
+			Owner:     network.Owner,
+			OwnerKey:  network.OwnerKey,
+			CreatedAt: network.CreatedAt,
+			Policies:  network.Policies,
+
+			RequireCerts: network.RequireCerts,
+		}
+		for _, cert := range network.certs {
+			exported.Certs = append(exported.Certs, cert)
+		}
+		sort.Slice(exported.Certs, func(i, j int) bool { return exported.Certs[i].NodeID < exported.Certs[j].NodeID })
+		for _, member := range network.Members {
+			exported.Members = append(exported.Members, *member)
+		}
+		network.mu.RUnlock()
+		sort.Slice(exported.Members, func(i, j int) bool { return exported.Members[i].NodeID < exported.Members[j].NodeID })
+		networks = append(networks, exported)
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].ID < networks[j].ID })
+	return networks
+}
+
+// restore adds exported personal networks, replacing networks with the same ID
+func (pnm *PersonalNetworkManager) restore(networks []BundleNetwork) {
+	for _, exported := range networks {
+		network := NewPersonalNetwork(exported.ID, exported.Name, exported.Owner)
+		network.OwnerKey = exported.OwnerKey
+		network.CreatedAt = exported.CreatedAt
+		if exported.Policies != nil {
+			network.Policies = exported.Policies
+		}
+		for _, member := range exported.Members {
+			member := member
+			network.Members[member.NodeID] = &member
+		}
+		network.RequireCerts = exported.RequireCerts
+		for _, cert := range exported.Certs {
+			network.AddCert(cert, time.Now()) // Expired or forged certificates are left behind
+		}
+
+		pnm.mu.Lock()
+		pnm.Networks[network.ID] = network
+		pnm.mu.Unlock()
+	}
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
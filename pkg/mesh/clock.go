@@ -0,0 +1,66 @@
+package mesh
+
+import "time"
+
+// Timeouts, cooldowns and round-trip times are measured with Go's monotonic clock, which
+// an NTP step or a user setting the clock can't move. Instants kept as integers, e.g. in
+// atomics, lose the monotonic reading of a time.Time, so they are kept as monotonic
+// nanoseconds since the process started instead of Unix time. The wall clock is only
+// read where wall time is the point: schedules, per-hour statistics and timestamps that
+// peers check. Changing the time zone moves none of these, as Unix time stays the same.
+
+// ClockJumpThreshold is how far the wall clock must move against the monotonic clock
+// before it is reported as a jump rather than drift being corrected
+const ClockJumpThreshold = 5 * time.Second
+
+// processStart anchors the monotonic instants returned by monoNow
+var processStart = time.Now()
+
+// monoNow returns the monotonic time since the process started, in nanoseconds
+func monoNow() int64 {
+	return monoAt(time.Now())
+}
+
+// monoAt converts a time read from time.Now into monotonic nanoseconds since the
+// process started
+func monoAt(t time.Time) int64 {
+	return int64(t.Sub(processStart))
+}
+
+// monoSince returns the time elapsed since a monotonic instant from monoNow
+func monoSince(mono int64) time.Duration {
+	return time.Duration(monoNow() - mono)
+}
+
+// clockSample reads the wall, monotonic and, where the platform has one, boot clocks at
+// the same moment. The boot clock keeps counting while the host sleeps, which the
+// monotonic clock doesn't, and isn't moved by setting the time, which the wall clock is.
+type clockSample struct {
+	wall    time.Time // Without the monotonic reading
+	mono    time.Time
+	boot    time.Duration
+	hasBoot bool
+}
+
+func sampleClocks() clockSample {
+	now := time.Now()
+	boot, ok := bootClock()
+	return clockSample{wall: now.Round(0), mono: now, boot: boot, hasBoot: ok}
+}
+
+// since splits the time between two samples into how long the host slept and how far
+// the wall clock was set. Without a boot clock a forward jump can't be told apart from
+// sleep and is counted as sleep; a backward one can only be a jump.
+func (s clockSample) since(prev clockSample) (slept, jumped time.Duration) {
+	monoGap := s.mono.Sub(prev.mono)
+	wallGap := s.wall.Sub(prev.wall)
+	if s.hasBoot && prev.hasBoot {
+		bootGap := s.boot - prev.boot
+		return bootGap - monoGap, wallGap - bootGap
+	}
+	drift := wallGap - monoGap
+	if drift < 0 {
+		return 0, drift
+	}
+	return drift, 0
+}
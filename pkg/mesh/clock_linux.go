@@ -0,0 +1,21 @@
+//go:build linux
+
+package mesh
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// clockBoottime is CLOCK_BOOTTIME from linux/time.h (not exported by package syscall)
+const clockBoottime = 7
+
+// bootClock reads CLOCK_BOOTTIME, which counts time asleep and ignores the wall clock
+func bootClock() (time.Duration, bool) {
+	var ts syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockBoottime, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		return 0, false
+	}
+	return time.Duration(ts.Nano()), true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package mesh
+
+import "time"
+
+// bootClock is not supported on this platform
+func bootClock() (time.Duration, bool) {
+	return 0, false
+}
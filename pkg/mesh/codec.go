@@ -0,0 +1,66 @@
+package mesh
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// CodecDict names the compact wire encoding: JSON deflated against a static dictionary of
+// the keys and values control messages repeat. Nodes advertise it in handshakes and
+// announcements and only receive compact frames from peers that know they support it.
+const CodecDict = "dict1"
+
+// compactMarker starts a compact frame; plain frames are JSON and start with '{'
+const compactMarker = 0x01
+
+// wireDict holds the fragments most control messages are made of. Deflate references
+// the end of the dictionary most cheaply, so the most common fragments come last.
+// Changing it breaks compatibility: a new dictionary needs a new codec name.
+var wireDict = []byte(`"network_id":"","step":"","error":"","mac":"",` +
+	`"type":"mgmt_request","type":"mgmt_response","type":"policy_bundle","type":"pairing",` +
+	`"type":"file_transfer","type":"proxy_response","type":"proxy_request","type":"data",` +
+	`"terms":{"region":"","network_type":"wifi","network_type":"cellular","tier":1,` +
+	`{"id":"","name":"","port":9998,"has_internet":false,"has_internet":true,"type":"goodbye",` +
+	`"codec":"dict1","type":"announce"}` +
+	`"metadata":{"status":"authorized","traceparent":"00-` +
+	`"metadata":{"codec":"dict1"}},{"type":"handshake",` +
+	`"metadata":{"probe_ack":"},{"type":"presence",{"type":"hibernate",` +
+	`"payload":null,"timestamp":"20","metadata":{"probe":"` +
+	`{"type":"route_update","source":"","dest":"","payload":null,"timestamp":"20`)
+
+// encodeCompact deflates a JSON frame against the wire dictionary
+func encodeCompact(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(compactMarker)
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, wireDict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeFrame returns the JSON of a plain or compact frame, and whether it was compact.
+// Compact frames may not inflate beyond limit bytes.
+func decodeFrame(data []byte, limit int) ([]byte, bool, error) {
+	if len(data) == 0 || data[0] != compactMarker {
+		return data, false, nil
+	}
+	r := flate.NewReaderDict(bytes.NewReader(data[1:]), wireDict)
+	defer r.Close()
+	decoded, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid compact frame: %w", err)
+	}
+	if len(decoded) > limit {
+		return nil, true, fmt.Errorf("compact frame inflates beyond %d bytes", limit)
+	}
+	return decoded, true, nil
+}
@@ -0,0 +1,288 @@
+package mesh
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config tunes resource usage of a MeshApp. Zero values fall back to the defaults.
+type Config struct {
+	MaxPeers            int           // Connected peer table limit
+	MaxDiscoveredPeers  int           // Discovered peer table limit
+	MaxMessageSize      int           // Largest transport message accepted, in bytes
+	DiscoveryBufferSize int           // Multicast receive buffer, in bytes
+	UplinkWindow        int           // Probe samples kept by the uplink monitor
+	PeerArchivePath     string        // On-disk spillover for evicted peers; "" keeps no peer history
+	RouteMetricsPath    string        // Where learned route latency and loss persist; "" keeps them in memory
+	HibernateAfter      time.Duration // Idle time before a peer goes dormant; negative never hibernates peers
+	ConnectPolicy       string        // ConnectEager or ConnectOnDemand for non-priority discovered peers
+	MaxEagerConnections int           // Open connections beyond which discovered peers aren't dialed; negative for no limit
+	CompressLogs        bool          // Gzip log files opened with OpenLogFile
+	ProxyLimits         ProxyLimits   // Exit proxy timeouts, connection caps and per-client request limits; negative fields disable a limit
+	AbusePolicy         AbusePolicy   // Abuse scoring thresholds, and whether banned clients are revoked and the mesh warned
+	Timeouts            Timeouts      // Peer, exit and tunnel connect timeouts and retry pacing
+	ExitAllowlist       []string      // Private networks (CIDRs or IPs) clients may reach through the exit
+	UpstreamProxy       string        // HTTP or SOCKS5 proxy URL exit traffic goes through, credentials included; "" connects directly
+	OTelEndpoint        string        // OTLP/HTTP traces URL spans are exported to; "" disables tracing
+	MaxBondedProxies    int           // Proxies requests are spread over at once; 1 uses a single proxy
+	RequireApproval     bool          // Exit clients must be authorized; others are sent to the access page
+	DisableStandby      bool          // Don't keep a second proxy authorized for instant failover
+	RejectUnverified    bool          // Refuse incoming connections from peers not discovered at the connecting address
+	SourceRouting       bool          // Relay messages along the hops they list instead of refusing them
+	RequireSigned       bool          // Ignore discovery announcements not signed by a node identity
+	RequireProof        bool          // Refuse peer connections whose node ID isn't proven by its identity key
+	MinProtocolVersion  int           // Oldest wire protocol version accepted from peers; raise once every node speaks a newer one
+	AnnounceSeqPath     string        // Where our announcement sequence number persists; "" seeds it from the clock
+	RevocationsPath     string        // Where revoked identities persist; "" keeps them in memory
+}
+
+// DefaultConfig returns the profile used on phones and desktops
+func DefaultConfig() Config {
+	return Config{
+		MaxPeers:            DefaultMaxPeers,
+		MaxDiscoveredPeers:  DefaultMaxDiscoveredPeers,
+		MaxMessageSize:      MaxMessageSize,
+		DiscoveryBufferSize: 4096,
+		UplinkWindow:        DefaultUplinkThresholds().Window,
+		HibernateAfter:      DefaultHibernateAfter,
+		ConnectPolicy:       ConnectEager,
+		MaxEagerConnections: DefaultMaxEagerConnections,
+		ProxyLimits:         DefaultProxyLimits(),
+		AbusePolicy:         DefaultAbusePolicy(),
+		Timeouts:            DefaultTimeouts(),
+		MaxBondedProxies:    DefaultMaxBondedProxies,
+		MinProtocolVersion:  MinProtocolVersion,
+	}
+}
+
+// LowMemoryConfig returns a constrained profile for ESP32-class gateways and small SBCs:
+// small buffers, reduced peer tables, no peer history kept, and compressed logs.
+// See docs/LOW_MEMORY.md for measured memory usage.
+func LowMemoryConfig() Config {
+	return Config{
+		MaxPeers:            16,
+		MaxDiscoveredPeers:  32,
+		MaxMessageSize:      16 * 1024,
+		DiscoveryBufferSize: 1500, // one Ethernet MTU is enough for an announcement
+		UplinkWindow:        minUplinkSamples,
+		HibernateAfter:      DefaultHibernateAfter,
+		ConnectPolicy:       ConnectOnDemand,
+		MaxEagerConnections: 8,
+		CompressLogs:        true,
+		ProxyLimits: ProxyLimits{
+			HeaderTimeout:           10 * time.Second,
+			IdleTimeout:             time.Minute,
+			TunnelTimeout:           time.Hour,
+			MaxConnections:          32,
+			MaxConnectionsPerClient: 8,
+			RequestsPerSecond:       10,
+			MaxRequestsPerClient:    8,
+		},
+		AbusePolicy:        DefaultAbusePolicy(),
+		Timeouts:           DefaultTimeouts(),
+		MaxBondedProxies:   1,
+		DisableStandby:     true,
+		MinProtocolVersion: MinProtocolVersion,
+	}
+}
+
+// withDefaults fills zero fields from DefaultConfig
+func (c Config) withDefaults() Config {
+	d := DefaultConfig()
+	if c.MaxPeers <= 0 {
+		c.MaxPeers = d.MaxPeers
+	}
+	if c.MaxDiscoveredPeers <= 0 {
+		c.MaxDiscoveredPeers = d.MaxDiscoveredPeers
+	}
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = d.MaxMessageSize
+	}
+	if c.DiscoveryBufferSize <= 0 {
+		c.DiscoveryBufferSize = d.DiscoveryBufferSize
+	}
+	if c.UplinkWindow <= 0 {
+		c.UplinkWindow = d.UplinkWindow
+	}
+	if c.HibernateAfter == 0 {
+		c.HibernateAfter = d.HibernateAfter
+	}
+	if c.ConnectPolicy == "" {
+		c.ConnectPolicy = d.ConnectPolicy
+	}
+	if c.MaxEagerConnections == 0 {
+		c.MaxEagerConnections = d.MaxEagerConnections
+	}
+	if c.MaxBondedProxies <= 0 {
+		c.MaxBondedProxies = d.MaxBondedProxies
+	}
+	if c.MinProtocolVersion <= 0 {
+		c.MinProtocolVersion = d.MinProtocolVersion
+	}
+	c.ProxyLimits = c.ProxyLimits.withDefaults(d.ProxyLimits)
+	c.AbusePolicy = c.AbusePolicy.withDefaults(d.AbusePolicy)
+	c.Timeouts = c.Timeouts.withDefaults(d.Timeouts)
+	return c
+}
+
+// withDefaults fills zero fields from d
+func (l ProxyLimits) withDefaults(d ProxyLimits) ProxyLimits {
+	if l.HeaderTimeout == 0 {
+		l.HeaderTimeout = d.HeaderTimeout
+	}
+	if l.IdleTimeout == 0 {
+		l.IdleTimeout = d.IdleTimeout
+	}
+	if l.TunnelTimeout == 0 {
+		l.TunnelTimeout = d.TunnelTimeout
+	}
+	if l.MaxConnections == 0 {
+		l.MaxConnections = d.MaxConnections
+	}
+	if l.MaxConnectionsPerClient == 0 {
+		l.MaxConnectionsPerClient = d.MaxConnectionsPerClient
+	}
+	if l.RequestsPerSecond == 0 {
+		l.RequestsPerSecond = d.RequestsPerSecond
+	}
+	if l.MaxRequestsPerClient == 0 {
+		l.MaxRequestsPerClient = d.MaxRequestsPerClient
+	}
+	return l
+}
+
+// enforced turns the config's negative "no limit" fields into the proxy's zero values
+func (l ProxyLimits) enforced() ProxyLimits {
+	if l.HeaderTimeout < 0 {
+		l.HeaderTimeout = 0
+	}
+	if l.IdleTimeout < 0 {
+		l.IdleTimeout = 0
+	}
+	if l.TunnelTimeout < 0 {
+		l.TunnelTimeout = 0
+	}
+	if l.MaxConnections < 0 {
+		l.MaxConnections = 0
+	}
+	if l.MaxConnectionsPerClient < 0 {
+		l.MaxConnectionsPerClient = 0
+	}
+	if l.RequestsPerSecond < 0 {
+		l.RequestsPerSecond = 0
+	}
+	if l.MaxRequestsPerClient < 0 {
+		l.MaxRequestsPerClient = 0
+	}
+	return l
+}
+
+// NewMeshAppWithConfig creates a mesh application tuned by the given config
+func NewMeshAppWithConfig(nodeID, nodeName, ip, mac string, cfg Config) *MeshApp {
+	ma := NewMeshApp(nodeID, nodeName, ip, mac)
+	ma.ApplyConfig(cfg)
+	return ma
+}
+
+// ApplyConfig applies resource limits; buffer sizes take effect on the next Start
+func (ma *MeshApp) ApplyConfig(cfg Config) {
+	cfg = cfg.withDefaults()
+
+	ma.mu.Lock()
+	ma.config = cfg
+	ma.mu.Unlock()
+
+	ma.SetPeerLimits(cfg.MaxPeers, cfg.MaxDiscoveredPeers)
+	ma.Transport.SetMaxMessageSize(cfg.MaxMessageSize)
+	ma.Discovery.SetBufferSize(cfg.DiscoveryBufferSize)
+	ma.Discovery.SetRequireSigned(cfg.RequireSigned)
+	ma.Transport.SetRequireProof(cfg.RequireProof)
+	ma.Transport.SetMinProtocol(cfg.MinProtocolVersion)
+	ma.Discovery.SetMinProtocol(cfg.MinProtocolVersion)
+	ma.UplinkMonitor.SetWindow(cfg.UplinkWindow)
+	ma.Tracer.SetEndpoint(cfg.OTelEndpoint)
+	ma.InternetProxy.SetLimits(cfg.ProxyLimits.enforced())
+	ma.InternetProxy.SetRequireAuthorization(cfg.RequireApproval)
+	ma.Abuse.SetPolicy(cfg.AbusePolicy)
+	ma.Transport.SetTimeouts(cfg.Timeouts)
+	ma.ExitGuard.SetTimeouts(cfg.Timeouts)
+	ma.InternetClient.SetTimeouts(cfg.Timeouts)
+	ma.dials.setTimeouts(cfg.Timeouts)
+	if err := ma.ExitGuard.SetAllowlist(cfg.ExitAllowlist); err != nil {
+		ma.emitEvent(&Event{Type: EventConfigError, Component: "exit_allowlist", Detail: err.Error()})
+	}
+	if err := ma.ExitGuard.SetUpstreamProxy(cfg.UpstreamProxy); err != nil {
+		ma.emitEvent(&Event{Type: EventConfigError, Component: "upstream_proxy", Detail: err.Error()})
+	}
+	if cfg.PeerArchivePath != "" {
+		ma.SetPeerArchive(NewFilePeerArchive(cfg.PeerArchivePath))
+	}
+	if cfg.AnnounceSeqPath != "" {
+		if err := ma.Discovery.SetSequenceFile(cfg.AnnounceSeqPath); err != nil {
+			ma.emitEvent(&Event{Type: EventConfigError, Component: "announce_seq", Detail: err.Error()})
+		}
+	}
+	if cfg.RouteMetricsPath != "" {
+		if err := ma.Router.RoutingTable.Metrics.Load(cfg.RouteMetricsPath); err != nil {
+			ma.emitEvent(&Event{Type: EventRouteMetricsError, Detail: err.Error()})
+		}
+	}
+	if cfg.RevocationsPath != "" {
+		if err := ma.Revocations.Load(cfg.RevocationsPath); err != nil {
+			ma.emitEvent(&Event{Type: EventConfigError, Component: "revocations", Detail: err.Error()})
+		}
+	}
+}
+
+// Config returns the active resource configuration
+func (ma *MeshApp) Config() Config {
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	return ma.config
+}
+
+// OpenLogFile opens a log file for appending, gzip-compressed when compress is set.
+// Each write is flushed so the log stays readable if the process dies.
+func OpenLogFile(path string, compress bool) (io.WriteCloser, error) {
+	if compress {
+		path += ".gz"
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if !compress {
+		return f, nil
+	}
+	return &gzipLogWriter{file: f, gz: gzip.NewWriter(f)}, nil
+}
+
+// gzipLogWriter appends a gzip member per session; concatenated members decode as one stream
+type gzipLogWriter struct {
+	file *os.File
+	gz   *gzip.Writer
+	mu   sync.Mutex
+}
+
+func (w *gzipLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.gz.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.gz.Flush()
+}
+
+func (w *gzipLogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.gz.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
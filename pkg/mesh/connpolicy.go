@@ -0,0 +1,60 @@
+package mesh
+
+import "time"
+
+// Connection policies decide which discovered peers are dialed as soon as they are seen
+const (
+	// ConnectEager dials discovered peers until MaxEagerConnections are open
+	ConnectEager = "eager"
+	// ConnectOnDemand only dials priority peers eagerly; others are dialed when first sent to
+	ConnectOnDemand = "on_demand"
+
+	// DefaultMaxEagerConnections bounds automatic dialing in dense environments
+	DefaultMaxEagerConnections = 32
+)
+
+// isPriorityPeer reports whether a peer is always dialed eagerly: personal network
+// members, peers hinting they share a network with us, static peers and peers offering
+// internet
+func (ma *MeshApp) isPriorityPeer(peer *DiscoveredPeer) bool {
+	if peer.HasInternet || len(peer.Networks) > 0 || ma.PersonalNetworkMgr.IsMemberOfAny(peer.ID) {
+		return true
+	}
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	_, static := ma.staticPeers[peer.ID]
+	return static
+}
+
+// shouldDial applies the connection policy to a newly discovered peer. Peers whose
+// protocol versions aren't compatible with ours are never dialed; relays reach them.
+func (ma *MeshApp) shouldDial(peer *DiscoveredPeer) bool {
+	if !ma.Transport.ProtocolCompatible(peer.Protocol, peer.MinProtocol) {
+		return false
+	}
+	if ma.isPriorityPeer(peer) {
+		return true
+	}
+	cfg := ma.Config()
+	if cfg.ConnectPolicy == ConnectOnDemand {
+		return false
+	}
+	return cfg.MaxEagerConnections < 0 || len(ma.Transport.GetConnectedPeers()) < cfg.MaxEagerConnections
+}
+
+// connectOnDemand is the transport's reconnect handler: it wakes dormant peers and
+// dials discovered peers that the connection policy left unconnected
+func (ma *MeshApp) connectOnDemand(peerID string) bool {
+	if ma.wakePeer(peerID) {
+		return true
+	}
+	peer, ok := ma.Discovery.GetPeer(peerID)
+	if !ok || !ma.MACFilter.Allowed(peer.MAC) || !ma.Transport.ProtocolCompatible(peer.Protocol, peer.MinProtocol) {
+		return false
+	}
+	if err := ma.dialPeer(peerID, peer.IP, peer.Port); err != nil {
+		return false
+	}
+	ma.Router.UpdateRoute(peerID, peerID, 1, 10*time.Millisecond)
+	return true
+}
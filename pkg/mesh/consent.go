@@ -0,0 +1,92 @@
+package mesh
+
+import (
+	"strings"
+	"sync"
+)
+
+// ExitConsent tracks which exit nodes the user has agreed to send traffic through.
+// Consent can be given for a single peer or for every exit in a region, and the
+// set of usable exits can optionally be restricted to specific peers.
+type ExitConsent struct {
+	consentedPeers   map[string]bool
+	consentedRegions map[string]bool
+	allowedExits     map[string]bool // empty means any exit may be used
+	mu               sync.RWMutex
+}
+
+// NewExitConsent creates an empty consent store
+func NewExitConsent() *ExitConsent {
+	return &ExitConsent{
+		consentedPeers:   make(map[string]bool),
+		consentedRegions: make(map[string]bool),
+		allowedExits:     make(map[string]bool),
+	}
+}
+
+// GrantPeer records consent to exit through the given peer
+func (ec *ExitConsent) GrantPeer(peerID string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.consentedPeers[peerID] = true
+}
+
+// RevokePeer withdraws consent for the given peer
+func (ec *ExitConsent) RevokePeer(peerID string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	delete(ec.consentedPeers, peerID)
+}
+
+// GrantRegion records consent to exit through any peer in the given region. The region
+// is the one a peer advertises for itself, which nothing verifies, so a region grant
+// trusts every peer claiming that region.
+func (ec *ExitConsent) GrantRegion(region string) {
+	if region == "" {
+		return
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.consentedRegions[strings.ToUpper(region)] = true
+}
+
+// RevokeRegion withdraws consent for the given region
+func (ec *ExitConsent) RevokeRegion(region string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	delete(ec.consentedRegions, strings.ToUpper(region))
+}
+
+// HasConsent returns whether traffic may exit through the given peer
+func (ec *ExitConsent) HasConsent(peer *DiscoveredPeer) bool {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	if ec.consentedPeers[peer.ID] {
+		return true
+	}
+	return peer.Region != "" && ec.consentedRegions[strings.ToUpper(peer.Region)]
+}
+
+// SetAllowedExits restricts exits to the given peers; an empty list lifts the restriction
+func (ec *ExitConsent) SetAllowedExits(peerIDs []string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.allowedExits = make(map[string]bool, len(peerIDs))
+	for _, id := range peerIDs {
+		ec.allowedExits[id] = true
+	}
+}
+
+// AllowExit adds a peer to the exit restriction list
+func (ec *ExitConsent) AllowExit(peerID string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.allowedExits[peerID] = true
+}
+
+// IsAllowedExit returns whether the exit policy permits using the given peer
+func (ec *ExitConsent) IsAllowedExit(peerID string) bool {
+	ec.mu.RLock()
+	defer ec.mu.RUnlock()
+	return len(ec.allowedExits) == 0 || ec.allowedExits[peerID]
+}
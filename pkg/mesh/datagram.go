@@ -0,0 +1,283 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Small latency-sensitive control messages, such as route probes and pings, can skip the
+// peer connection, where one lost segment holds up everything queued behind it, and go
+// as single UDP datagrams instead. A message opts in with Message.Datagram. Each side of
+// a link that speaks FeatureDatagrams offers the other its UDP port and a key over the
+// connection; datagrams are sealed with the receiver's key, so they are as private as the
+// link and come from whoever holds its other end. A probe answered over UDP confirms the
+// path before it is used, so firewalls that drop UDP only cost the probe. Until then, and
+// for messages larger than MaxDatagramSize, the connection carries them.
+//
+// Datagrams may be lost, duplicated or reordered. They are numbered and signed like any
+// message, so the replay guard drops duplicates; what is lost stays lost, which is why
+// data always takes the connection.
+
+const (
+	// MaxDatagramSize is the largest encoded message sent as a datagram, small enough not
+	// to be fragmented on any path; larger ones take the connection
+	MaxDatagramSize = 1200
+
+	// datagramMessageType offers the peer our UDP port and the key its datagrams are sealed with
+	datagramMessageType = "datagram"
+	datagramProbeType   = "datagram_probe"
+	datagramAckType     = "datagram_ack"
+
+	datagramKeySize    = 32
+	datagramProbeEvery = time.Second       // How often an unconfirmed path is probed while in demand
+	datagramOverhead   = 2 + 255 + 12 + 16 // Sender ID length and ID, GCM nonce and tag
+)
+
+// errDatagramTooLarge is returned for messages that don't fit a datagram
+var errDatagramTooLarge = errors.New("message too large for a datagram")
+
+// datagramPath is where and how a peer takes our datagrams
+type datagramPath struct {
+	addr   *net.UDPAddr
+	key    []byte
+	ready  atomic.Bool  // A probe was answered, so datagrams get through
+	probed atomic.Int64 // Monotonic instant of the last probe
+}
+
+// startDatagrams opens the UDP socket on the port the listener is bound to; without it
+// links simply don't offer datagrams
+func (t *Transport) startDatagrams(listener net.Listener) {
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	t.udp = udp
+	t.mu.Unlock()
+	go t.datagramLoop(udp)
+}
+
+// stopDatagrams closes the UDP socket
+func (t *Transport) stopDatagrams() {
+	t.mu.Lock()
+	udp := t.udp
+	t.udp = nil
+	t.mu.Unlock()
+	if udp != nil {
+		udp.Close()
+	}
+}
+
+func (t *Transport) datagramSocket() *net.UDPConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.udp
+}
+
+// DatagramAddr returns the address datagrams are received on, or "" if there is none
+func (t *Transport) DatagramAddr() string {
+	if udp := t.datagramSocket(); udp != nil {
+		return udp.LocalAddr().String()
+	}
+	return ""
+}
+
+// PeerDatagrams reports whether messages to a peer can go as datagrams
+func (t *Transport) PeerDatagrams(peerID string) bool {
+	t.connMu.RLock()
+	conn, ok := t.connections[peerID]
+	t.connMu.RUnlock()
+	if !ok {
+		return false
+	}
+	path := conn.datagram.Load()
+	return path != nil && path.ready.Load()
+}
+
+// offerDatagrams hands a peer whose link supports datagrams our UDP port and a fresh key
+// for what it sends us
+func (t *Transport) offerDatagrams(conn *Connection) {
+	udp := t.datagramSocket()
+	if udp == nil || len(t.nodeID) > 255 || int(conn.protocol.Load()) < protocolFeatures[FeatureDatagrams] {
+		return
+	}
+	key := make([]byte, datagramKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return
+	}
+	conn.mu.Lock()
+	conn.datagramKey = key
+	conn.mu.Unlock()
+	t.sendMessage(conn.Conn, &Message{
+		Type:      datagramMessageType,
+		Source:    t.nodeID,
+		Dest:      conn.PeerID,
+		Timestamp: time.Now(),
+		Metadata: map[string]string{
+			"port": strconv.Itoa(udp.LocalAddr().(*net.UDPAddr).Port),
+			"key":  base64.StdEncoding.EncodeToString(key),
+		},
+	}, conn.compact.Load())
+}
+
+// handleDatagramOffer records where a peer takes datagrams and probes the path
+func (t *Transport) handleDatagramOffer(conn *Connection, msg *Message) {
+	remote, ok := conn.Conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return // Links that aren't over IP, such as BLE, have no datagram path
+	}
+	port, err := strconv.Atoi(msg.Metadata["port"])
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(msg.Metadata["key"])
+	if err != nil || len(key) != datagramKeySize {
+		return
+	}
+	path := &datagramPath{addr: &net.UDPAddr{IP: remote.IP, Port: port, Zone: remote.Zone}, key: key}
+	conn.datagram.Store(path)
+	t.probeDatagrams(conn, path)
+}
+
+// probeDatagrams asks the peer to answer over UDP, confirming the path once it does
+func (t *Transport) probeDatagrams(conn *Connection, path *datagramPath) {
+	now := monoNow()
+	last := path.probed.Load()
+	if last != 0 && time.Duration(now-last) < datagramProbeEvery || !path.probed.CompareAndSwap(last, now) {
+		return
+	}
+	t.sendDatagram(conn, path, &Message{Type: datagramProbeType, Source: t.nodeID, Dest: conn.PeerID, Timestamp: time.Now()})
+}
+
+// trySendDatagram sends a message as a datagram if the path to the peer is confirmed and
+// the message fits, reporting false if it must take the connection
+func (t *Transport) trySendDatagram(conn *Connection, msg *Message) bool {
+	path := conn.datagram.Load()
+	if path == nil {
+		return false
+	}
+	if !path.ready.Load() {
+		t.probeDatagrams(conn, path)
+		return false
+	}
+	return t.sendDatagram(conn, path, msg) == nil
+}
+
+// sendDatagram seals a message with the peer's key and sends it: our node ID, so the peer
+// can find the key, then the sealed frame
+func (t *Transport) sendDatagram(conn *Connection, path *datagramPath, msg *Message) error {
+	udp := t.datagramSocket()
+	if udp == nil {
+		return net.ErrClosed
+	}
+	data, err := t.encodeMessage(msg, conn.compact.Load())
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxDatagramSize {
+		return errDatagramTooLarge
+	}
+	sealed, err := seal(path.key, data, []byte(t.nodeID))
+	if err != nil {
+		return err
+	}
+	packet := make([]byte, 2, 2+len(t.nodeID)+len(sealed))
+	binary.BigEndian.PutUint16(packet, uint16(len(t.nodeID)))
+	packet = append(append(packet, t.nodeID...), sealed...)
+	_, err = udp.WriteToUDP(packet, path.addr)
+	return err
+}
+
+// datagramLoop receives datagrams until the socket is closed
+func (t *Transport) datagramLoop(udp *net.UDPConn) {
+	buf := make([]byte, MaxDatagramSize+datagramOverhead)
+	for {
+		n, _, err := udp.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue // e.g. a port unreachable report for a datagram we sent
+		}
+		t.handleDatagram(buf[:n])
+	}
+}
+
+// handleDatagram opens a datagram with the key we gave its sender and handles the message
+// like one read from the sender's connection
+func (t *Transport) handleDatagram(packet []byte) {
+	if len(packet) < 2 {
+		return
+	}
+	idLen := int(binary.BigEndian.Uint16(packet))
+	if len(packet) < 2+idLen {
+		return
+	}
+	peerID := string(packet[2 : 2+idLen])
+	t.connMu.RLock()
+	conn, ok := t.connections[peerID]
+	t.connMu.RUnlock()
+	if !ok {
+		return
+	}
+	conn.mu.Lock()
+	key := conn.datagramKey
+	conn.mu.Unlock()
+	if key == nil {
+		return
+	}
+	data, err := open(key, packet[2+idLen:], []byte(peerID))
+	if err != nil {
+		return
+	}
+	msg, _, err := t.decodeMessage(data, t.messageLimit())
+	if errors.Is(err, ErrForgedMessage) {
+		if handler := t.signatureFailureHandler(); handler != nil {
+			handler(peerID, msg, err)
+		}
+		return
+	}
+	if err != nil || !t.replay.accept(msg) {
+		return
+	}
+
+	switch msg.Type {
+	case datagramProbeType:
+		if path := conn.datagram.Load(); path != nil {
+			t.sendDatagram(conn, path, &Message{Type: datagramAckType, Source: t.nodeID, Dest: peerID, Timestamp: time.Now()})
+			if !path.ready.Load() {
+				// Our own probe may have arrived before the peer knew where to answer
+				path.probed.Store(0)
+				t.probeDatagrams(conn, path)
+			}
+		}
+		return
+	case datagramAckType:
+		if path := conn.datagram.Load(); path != nil {
+			path.ready.Store(true)
+		}
+		return
+	}
+
+	if filter := t.messageFilter(); filter != nil && filter(peerID, msg, false) != nil {
+		return
+	}
+	conn.touch(msg)
+	msg.Datagram = true // Relays pass it on the same way
+	t.mu.Lock()
+	handler := t.onMessage
+	t.mu.Unlock()
+	if handler != nil {
+		handler(peerID, msg)
+	}
+}
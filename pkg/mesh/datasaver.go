@@ -0,0 +1,238 @@
+package mesh
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The exit can shrink what crosses the mesh for clients on slow or metered links. The
+// sharer chooses which transformations it offers with InternetProxy.SetDataSaver, each
+// client asks for the ones it wants with InternetClient.SetDataSaver, and a request gets
+// those both sides agreed to. Only plain HTTP responses can be transformed; tunnels are
+// encrypted end to end, so they only benefit from tracker blocking.
+
+// Data saver transformations
+const (
+	SaveImages   = "images"   // Downscale and recompress JPEG and PNG images
+	SaveCompress = "compress" // Gzip text responses the destination sent uncompressed
+	SaveTrackers = "trackers" // Refuse requests to known tracker and ad hosts
+)
+
+// DataSaverHeader carries the transformations a client asks for, comma-separated;
+// DataSavedHeader on the response lists those applied to it
+const (
+	DataSaverHeader = "X-InterMesh-Save-Data"
+	DataSavedHeader = "X-InterMesh-Saved"
+)
+
+const (
+	// DataSaverMaxImageSide is the longest side, in pixels, images are downscaled to
+	DataSaverMaxImageSide = 1024
+	// dataSaverMaxImageBytes is the largest image transformed; bigger ones pass through
+	dataSaverMaxImageBytes = 8 << 20
+	// dataSaverJPEGQuality is the quality images are recompressed at
+	dataSaverJPEGQuality = 50
+)
+
+var dataSaverOptions = []string{SaveImages, SaveCompress, SaveTrackers}
+
+// trackerHosts are tracker and ad hosts refused for clients saving data, subdomains included
+var trackerHosts = []string{
+	"doubleclick.net", "googlesyndication.com", "googleadservices.com", "google-analytics.com",
+	"googletagmanager.com", "googletagservices.com", "adservice.google.com", "amazon-adsystem.com",
+	"adnxs.com", "criteo.com", "criteo.net", "taboola.com", "outbrain.com", "scorecardresearch.com",
+	"quantserve.com", "hotjar.com", "moatads.com", "pubmatic.com", "rubiconproject.com",
+}
+
+// parseDataSaver splits a comma-separated list of transformations, rejecting unknown ones
+func parseDataSaver(options []string) ([]string, error) {
+	var parsed []string
+	for _, option := range options {
+		option = strings.ToLower(strings.TrimSpace(option))
+		if option == "" || slices.Contains(parsed, option) {
+			continue
+		}
+		if !slices.Contains(dataSaverOptions, option) {
+			return nil, fmt.Errorf("unknown data saver option %q", option)
+		}
+		parsed = append(parsed, option)
+	}
+	return parsed, nil
+}
+
+// SetDataSaver sets the transformations we offer clients that ask for them; none by default
+func (p *InternetProxy) SetDataSaver(options []string) error {
+	parsed, err := parseDataSaver(options)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.saver = parsed
+	return nil
+}
+
+// DataSaver returns the transformations we offer
+func (p *InternetProxy) DataSaver() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.saver)
+}
+
+// dataSaving returns the transformations to apply to a request: those the client asked
+// for that we offer. A browser's "Save-Data: on" asks for all of them.
+func (p *InternetProxy) dataSaving(r *http.Request) []string {
+	asked := strings.Split(r.Header.Get(DataSaverHeader), ",")
+	r.Header.Del(DataSaverHeader)
+	offered := p.DataSaver()
+	if strings.EqualFold(r.Header.Get("Save-Data"), "on") {
+		return offered
+	}
+	var saving []string
+	for _, option := range asked {
+		if option = strings.ToLower(strings.TrimSpace(option)); slices.Contains(offered, option) {
+			saving = append(saving, option)
+		}
+	}
+	return saving
+}
+
+// isTrackerHost returns whether host is a known tracker or ad host
+func isTrackerHost(host string) bool {
+	return hostInList(normalizeHost(host), trackerHosts)
+}
+
+// saveResponse applies the image and compression transformations to a response,
+// updating its headers, and returns the body to send. acceptsGzip is whether the client
+// takes gzip-encoded responses.
+func saveResponse(resp *http.Response, saving []string, acceptsGzip bool) io.ReadCloser {
+	if len(saving) == 0 || resp.Header.Get("Content-Encoding") != "" {
+		return resp.Body
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	if slices.Contains(saving, SaveImages) && (mediaType == "image/jpeg" || mediaType == "image/png") &&
+		resp.ContentLength <= dataSaverMaxImageBytes {
+		original, err := io.ReadAll(io.LimitReader(resp.Body, dataSaverMaxImageBytes+1))
+		if err != nil || len(original) > dataSaverMaxImageBytes {
+			return io.NopCloser(io.MultiReader(bytes.NewReader(original), resp.Body))
+		}
+		body := original
+		if smaller, ok := shrinkImage(original, mediaType); ok && len(smaller) < len(original) {
+			body = smaller
+			resp.Header.Set(DataSavedHeader, SaveImages)
+		}
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return io.NopCloser(bytes.NewReader(body))
+	}
+
+	if slices.Contains(saving, SaveCompress) && acceptsGzip && compressible(mediaType) {
+		pr, pw := io.Pipe()
+		go func() {
+			gz := gzip.NewWriter(pw)
+			_, err := io.Copy(gz, resp.Body)
+			if err == nil {
+				err = gz.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		resp.Header.Del("Content-Length")
+		resp.Header.Set("Content-Encoding", "gzip")
+		resp.Header.Add("Vary", "Accept-Encoding")
+		resp.Header.Set(DataSavedHeader, SaveCompress)
+		return pr
+	}
+	return resp.Body
+}
+
+// compressible returns whether a media type is text that gzip shrinks well
+func compressible(mediaType string) bool {
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml")
+}
+
+// shrinkImage downscales an image to DataSaverMaxImageSide and recompresses it in its
+// own format, JPEGs at a lower quality
+func shrinkImage(data []byte, mediaType string) ([]byte, bool) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	img = downscale(img, DataSaverMaxImageSide)
+	var out bytes.Buffer
+	if mediaType == "image/jpeg" {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: dataSaverJPEGQuality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&out, img)
+	}
+	if err != nil {
+		return nil, false
+	}
+	return out.Bytes(), true
+}
+
+// downscale shrinks an image so its longest side is at most maxSide, averaging the
+// source pixels each destination pixel covers
+func downscale(img image.Image, maxSide int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSide && h <= maxSide {
+		return img
+	}
+	dw, dh := maxSide, max(1, h*maxSide/w)
+	if h > w {
+		dw, dh = max(1, w*maxSide/h), maxSide
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// SetDataSaver asks our proxies for data saver transformations, see SaveImages; none
+// asks for nothing. Proxies apply those they offer.
+func (c *InternetClient) SetDataSaver(options []string) error {
+	parsed, err := parseDataSaver(options)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.saver = strings.Join(parsed, ",")
+	return nil
+}
+
+// dataSaver returns the transformations we ask proxies for, comma-separated
+func (c *InternetClient) dataSaver() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saver
+}
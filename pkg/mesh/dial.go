@@ -0,0 +1,162 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Happy eyeballs (RFC 8305) timing for exit-node dialing; the timeouts are defaults, see Timeouts
+const (
+	// DialResolveTimeout bounds the DNS lookup of a CONNECT target
+	DialResolveTimeout = 5 * time.Second
+	// DialAttemptDelay is how long one address gets before the next one is tried in parallel
+	DialAttemptDelay = 250 * time.Millisecond
+	// DialAttemptTimeout bounds a single connection attempt
+	DialAttemptTimeout = 5 * time.Second
+	// DialTotalTimeout bounds resolving and dialing together
+	DialTotalTimeout = 10 * time.Second
+)
+
+// happyDialer races connection attempts to every resolved address of a host
+type happyDialer struct {
+	lookup       func(ctx context.Context, host string) ([]net.IPAddr, error)
+	dial         func(ctx context.Context, network, addr string) (net.Conn, error)
+	attemptDelay time.Duration
+}
+
+var defaultHappyDialer = &happyDialer{
+	lookup:       net.DefaultResolver.LookupIPAddr,
+	dial:         (&net.Dialer{}).DialContext,
+	attemptDelay: DialAttemptDelay,
+}
+
+// dialHappyEyeballs connects to a host:port, racing IPv6 and IPv4 and multiple addresses
+// directly, or through the guard's upstream proxy if it has one
+func dialHappyEyeballs(ctx context.Context, hostport string, guard *ExitGuard) (net.Conn, error) {
+	if u := guard.upstreamProxy(); u != nil {
+		return guard.dialUpstream(ctx, u, hostport)
+	}
+	return defaultHappyDialer.DialContext(ctx, hostport, guard)
+}
+
+// DialContext resolves hostport and returns the first connection to succeed. Attempts
+// start DialAttemptDelay apart, or right away when the previous one fails. Addresses
+// the guard doesn't permit are never dialed.
+func (d *happyDialer) DialContext(ctx context.Context, hostport string, guard *ExitGuard) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	timeouts := guard.timeoutPolicy()
+	ctx, cancel := context.WithTimeout(ctx, timeouts.ExitDial)
+	defer cancel()
+
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else {
+		lookupCtx, lookupCancel := context.WithTimeout(ctx, timeouts.ExitResolve)
+		addrs, err = d.lookup(lookupCtx, host)
+		lookupCancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no addresses for %s", host)
+		}
+	}
+	permitted := addrs[:0:0]
+	for _, addr := range addrs {
+		if guard.Permitted(addr.IP) {
+			permitted = append(permitted, addr)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil, fmt.Errorf("%s: %w", host, ErrDestinationBlocked)
+	}
+	addrs = interleaveFamilies(permitted)
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	attempt := func(addr net.IPAddr) {
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, timeouts.ExitAttempt)
+		defer attemptCancel()
+		conn, err := d.dial(attemptCtx, "tcp", net.JoinHostPort(addr.String(), port))
+		results <- result{conn, err}
+	}
+
+	// Connections from attempts that finish after the outcome is decided are closed
+	discard := func(remaining int) {
+		for ; remaining > 0; remaining-- {
+			if late := <-results; late.conn != nil {
+				late.conn.Close()
+			}
+		}
+	}
+
+	next, pending := 0, 0
+	timer := time.NewTimer(d.attemptDelay)
+	defer timer.Stop()
+	startNext := func() {
+		go attempt(addrs[next])
+		next++
+		pending++
+		timer.Reset(d.attemptDelay)
+	}
+
+	var errs []error
+	startNext()
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				cancel()
+				go discard(pending)
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			if next < len(addrs) {
+				startNext()
+			}
+		case <-timer.C:
+			// The current attempt is slow; start the next one alongside it
+			if next < len(addrs) {
+				startNext()
+			}
+		case <-ctx.Done():
+			go discard(pending)
+			return nil, fmt.Errorf("failed to connect to %s: %w", hostport, ctx.Err())
+		}
+	}
+	return nil, fmt.Errorf("failed to connect to %s: %w", hostport, errors.Join(errs...))
+}
+
+// interleaveFamilies orders addresses IPv6 first, alternating with IPv4, keeping the
+// resolver's order within each family
+func interleaveFamilies(addrs []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	ordered := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
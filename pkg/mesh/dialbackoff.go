@@ -0,0 +1,173 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	// DialBackoffBase is the default wait after the first failed dial; each failure doubles it
+	DialBackoffBase = 2 * time.Second
+	// DialBackoffMax caps the wait between dials of an unreachable peer by default
+	DialBackoffMax = 5 * time.Minute
+	// dialBackoffJitter spreads retries by up to this fraction either way, so peers that
+	// failed together aren't all retried at once
+	dialBackoffJitter = 0.2
+)
+
+// ErrPeerUnreachable is returned when a peer is not dialed because recent dials failed
+var ErrPeerUnreachable = errors.New("peer is unreachable")
+
+// DialState describes a peer whose dials have been failing
+type DialState struct {
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error"`
+	Since       time.Time `json:"since"`        // First failure in the current run
+	NextAttempt time.Time `json:"next_attempt"` // Dials before this are skipped
+}
+
+// dialBackoff tracks failing dials per peer. A peer is unreachable from its first failed
+// dial until a dial succeeds; it is still discovered, unlike a lost peer.
+type dialBackoff struct {
+	peers map[string]*DialState
+	base  time.Duration
+	max   time.Duration
+	mu    sync.Mutex
+}
+
+func newDialBackoff() *dialBackoff {
+	return &dialBackoff{peers: make(map[string]*DialState), base: DialBackoffBase, max: DialBackoffMax}
+}
+
+// setTimeouts paces later retries by the policy's RetryBase and RetryMax
+func (b *dialBackoff) setTimeouts(timeouts Timeouts) {
+	timeouts = timeouts.withDefaults(DefaultTimeouts())
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.base, b.max = timeouts.RetryBase, timeouts.RetryMax
+}
+
+// allow reports whether a peer may be dialed now
+func (b *dialBackoff) allow(peerID string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.peers[peerID]
+	return !ok || !now.Before(state.NextAttempt)
+}
+
+// failed records a failed dial and reports whether the peer just became unreachable
+func (b *dialBackoff) failed(peerID string, err error, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.peers[peerID]
+	if !ok {
+		state = &DialState{Since: now}
+		b.peers[peerID] = state
+	}
+	state.Failures++
+	state.LastError = err.Error()
+
+	wait := b.max
+	if shift := state.Failures - 1; shift < 20 && b.base<<shift < b.max {
+		wait = b.base << shift
+	}
+	wait = time.Duration(float64(wait) * (1 + dialBackoffJitter*(2*rand.Float64()-1)))
+	state.NextAttempt = now.Add(wait)
+	return !ok
+}
+
+// succeeded clears a peer's failures and reports whether it was unreachable
+func (b *dialBackoff) succeeded(peerID string) bool {
+	return b.forget(peerID)
+}
+
+// forget drops a peer's failures, reporting whether it had any
+func (b *dialBackoff) forget(peerID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.peers[peerID]
+	delete(b.peers, peerID)
+	return ok
+}
+
+// state returns a peer's dial failures, if it is unreachable
+func (b *dialBackoff) state(peerID string) (DialState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.peers[peerID]
+	if !ok {
+		return DialState{}, false
+	}
+	return *state, true
+}
+
+// due returns the unreachable peers whose next dial is due
+func (b *dialBackoff) due(now time.Time) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var peers []string
+	for peerID, state := range b.peers {
+		if !now.Before(state.NextAttempt) {
+			peers = append(peers, peerID)
+		}
+	}
+	return peers
+}
+
+// dialPeer connects to a peer unless recent dials to it failed and its backoff hasn't
+// run out. Failures emit EventPeerUnreachable once; a later success EventPeerReachable.
+func (ma *MeshApp) dialPeer(peerID, ip string, port int) error {
+	if ma.Revocations.Revoked(peerID) {
+		return fmt.Errorf("%s: %w", peerID, ErrRevoked)
+	}
+	now := time.Now()
+	if !ma.dials.allow(peerID, now) {
+		state, _ := ma.dials.state(peerID)
+		return fmt.Errorf("%w: retrying after %s", ErrPeerUnreachable, state.NextAttempt.Format(time.TimeOnly))
+	}
+
+	err := ma.Transport.ConnectToPeer(peerID, ip, port)
+	ma.recorder.Load().dial(peerID, ip, port, err)
+	if err != nil {
+		if ma.dials.failed(peerID, err, now) {
+			ma.emitEvent(&Event{Type: EventPeerUnreachable, PeerID: peerID, Detail: err.Error()})
+		}
+		return err
+	}
+	if ma.dials.succeeded(peerID) {
+		ma.emitEvent(&Event{Type: EventPeerReachable, PeerID: peerID})
+	}
+	ma.syncRevocations(peerID)
+	ma.syncCerts(peerID)
+	return nil
+}
+
+// PeerDialState returns how dials to a peer have been failing; false means the peer
+// isn't unreachable
+func (ma *MeshApp) PeerDialState(peerID string) (DialState, bool) {
+	return ma.dials.state(peerID)
+}
+
+// retryUnreachablePeers dials discovered peers whose backoff ran out and that the
+// connection policy would dial
+func (ma *MeshApp) retryUnreachablePeers() {
+	if !ma.Transport.IsRunning() {
+		return
+	}
+	for _, peerID := range ma.dials.due(time.Now()) {
+		peer, ok := ma.Discovery.GetPeer(peerID)
+		if !ok {
+			continue // Static peers are retried on their own
+		}
+		if !ma.MACFilter.Allowed(peer.MAC) || !ma.shouldDial(peer) {
+			continue
+		}
+		if ma.dialPeer(peer.ID, peer.IP, peer.Port) == nil {
+			ma.Router.UpdateRoute(peer.ID, peer.ID, 1, 10*time.Millisecond)
+			ma.notifyPeerDiscovered(&Peer{NodeID: peer.ID, IP: peer.IP, MAC: peer.MAC, HasInternet: peer.HasInternet, LastSeen: time.Now().Unix()})
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,28 +16,60 @@ type Discovery struct {
 	nodeID         string
 	nodeName       string
 	hasInternet    bool
+	region         string
+	networkType    string
+	terms          *SharingTerms
+	tier           int
+	bufferSize     int
+	macResolver    MACResolver
+	identity       *Identity       // Signs our announcements; nil sends them unsigned
+	requireSigned  bool            // Ignore unsigned announcements
+	minProtocol    int             // Oldest protocol version we accept, as announced; 0 for MinProtocolVersion
+	networks       func() []string // Personal networks we are a member of, hinted in announcements
+	power          *PowerStatus    // Our battery, announced as reported
+	rejected       atomic.Uint64
+	seq            uint64 // Sequence number of our last announcement
+	seqPath        string // Where seq persists; "" keeps it in memory
+	seqReserved    uint64 // Highest sequence number saved to seqPath
+	peerSeqs       map[string]peerSequence
+	stale          atomic.Uint64
 	port           int
 	multicastAddr  string
+	iface          string // Interface the multicast group is joined on; "" for the default
+	unicastReplies bool   // We can't receive multicast; peers are asked to answer by unicast
+	passive        bool   // Only listen: no announcements, answers or goodbyes
+	replied        map[string]time.Time
 	conn           *net.UDPConn
 	peerDiscovered func(peer *DiscoveredPeer)
 	peerLost       func(peerID string)
 	peers          map[string]*DiscoveredPeer
 	peersMu        sync.RWMutex
 	running        bool
-	ctx            context.Context
-	cancel         context.CancelFunc
+	cancel         context.CancelFunc // Ends the current run's loops
 	mu             sync.Mutex
 }
 
 // DiscoveredPeer represents a discovered peer on the network
 type DiscoveredPeer struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	IP          string    `json:"ip"`
-	Port        int       `json:"port"`
-	HasInternet bool      `json:"has_internet"`
-	LastSeen    time.Time `json:"last_seen"`
-	MAC         string    `json:"mac"`
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	IP          string        `json:"ip"`
+	Port        int           `json:"port"`
+	HasInternet bool          `json:"has_internet"`
+	LastSeen    time.Time     `json:"last_seen"`
+	MAC         string        `json:"mac"`
+	Region      string        `json:"region,omitempty"`
+	NetworkType string        `json:"network_type,omitempty"`
+	Terms       *SharingTerms `json:"terms,omitempty"`
+	Tier        int           `json:"tier,omitempty"`
+	Codec       string        `json:"codec,omitempty"`     // Compact wire encoding the peer understands
+	Signed      bool          `json:"signed,omitempty"`    // Announcements are signed by the key the ID derives from
+	Seq         uint64        `json:"seq,omitempty"`       // Sequence number of the announcement this state came from
+	Link        string        `json:"link,omitempty"`      // Link the peer was found on, LinkLAN for multicast
+	Protocol    int           `json:"proto,omitempty"`     // Wire protocol version the peer speaks; 0 if it predates versioning
+	MinProtocol int           `json:"proto_min,omitempty"` // Oldest protocol version the peer accepts
+	Networks    []string      `json:"networks,omitempty"`  // Our personal networks the peer's announcements hint it is in
+	Power       *PowerStatus  `json:"power,omitempty"`     // Battery the peer announced, nil if unknown
 }
 
 // AnnounceMessage is broadcast to discover peers
@@ -44,7 +78,24 @@ type AnnounceMessage struct {
 	Name        string `json:"name"`
 	Port        int    `json:"port"`
 	HasInternet bool   `json:"has_internet"`
-	MessageType string `json:"type"` // "announce" or "goodbye"
+	Region      string `json:"region,omitempty"`       // Country code of the exit, e.g. "DE"
+	NetworkType string `json:"network_type,omitempty"` // "wifi", "cellular", "ethernet", ...
+	Tier        int    `json:"tier,omitempty"`         // Proxy hops to a direct uplink: 0 direct, 1 via one mesh proxy, ...
+	MessageType string `json:"type"`                   // "announce" or "goodbye"
+	Codec       string `json:"codec,omitempty"`        // Compact wire encoding we understand
+	Seq         uint64 `json:"seq,omitempty"`          // Grows with every announcement the node sends
+	UnicastOnly bool   `json:"unicast,omitempty"`      // The sender can't receive multicast; answer it by unicast
+	Protocol    int    `json:"proto,omitempty"`        // Wire protocol version we speak; not signed, see protocol.go
+	MinProtocol int    `json:"proto_min,omitempty"`    // Oldest protocol version we accept; not signed
+
+	NetworkHints []string     `json:"nets,omitempty"`  // A hint per personal network we are in; not signed, see networkhint.go
+	Power        *PowerStatus `json:"power,omitempty"` // Our battery, nil if unknown; not signed, see power.go
+
+	Terms *SharingTerms `json:"terms,omitempty"` // Conditions attached to our proxy offer
+
+	SentAt    int64  `json:"sent_at,omitempty"` // Unix time, so signed announcements can't be replayed for long
+	Key       []byte `json:"key,omitempty"`     // Public key of the node's identity, if it signed
+	Signature []byte `json:"sig,omitempty"`
 }
 
 const (
@@ -55,16 +106,18 @@ const (
 
 // NewDiscovery creates a new discovery service
 func NewDiscovery(nodeID, nodeName string, port int, hasInternet bool) *Discovery {
-	ctx, cancel := context.WithCancel(context.Background())
 	return &Discovery{
 		nodeID:        nodeID,
 		nodeName:      nodeName,
 		port:          port,
 		hasInternet:   hasInternet,
 		multicastAddr: MulticastGroup,
+		macResolver:   SystemMACResolver,
 		peers:         make(map[string]*DiscoveredPeer),
-		ctx:           ctx,
-		cancel:        cancel,
+		replied:       make(map[string]time.Time),
+		seq:           initialSequence(),
+		peerSeqs:      make(map[string]peerSequence),
+		cancel:        func() {},
 	}
 }
 
@@ -83,6 +136,103 @@ func (d *Discovery) UpdateInternetStatus(hasInternet bool) {
 	d.mu.Unlock()
 }
 
+// SetExitInfo sets the region and uplink type advertised to clients using us as an exit
+func (d *Discovery) SetExitInfo(region, networkType string) {
+	d.mu.Lock()
+	d.region = region
+	d.networkType = networkType
+	d.mu.Unlock()
+}
+
+// SetSharingTerms sets the terms advertised alongside our proxy offer (nil clears them)
+func (d *Discovery) SetSharingTerms(terms *SharingTerms) {
+	d.mu.Lock()
+	d.terms = terms
+	d.mu.Unlock()
+}
+
+// SetTier sets the proxy tier we advertise: 0 for a direct uplink, n for internet obtained n mesh hops away
+func (d *Discovery) SetTier(tier int) {
+	d.mu.Lock()
+	d.tier = tier
+	d.mu.Unlock()
+}
+
+// SetPower sets the battery state we announce (nil if unknown)
+func (d *Discovery) SetPower(power *PowerStatus) {
+	d.mu.Lock()
+	d.power = power
+	d.mu.Unlock()
+}
+
+// SetMinProtocol sets the oldest protocol version we announce that we accept
+func (d *Discovery) SetMinProtocol(version int) {
+	d.mu.Lock()
+	d.minProtocol = version
+	d.mu.Unlock()
+}
+
+// SetBufferSize sets the multicast receive buffer size used from the next Start
+func (d *Discovery) SetBufferSize(size int) {
+	d.mu.Lock()
+	d.bufferSize = size
+	d.mu.Unlock()
+}
+
+func (d *Discovery) bufferLen() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.bufferSize <= 0 {
+		return 4096
+	}
+	return d.bufferSize
+}
+
+// SetMACResolver sets how peer MAC addresses are looked up (nil disables resolution)
+func (d *Discovery) SetMACResolver(resolver MACResolver) {
+	d.mu.Lock()
+	d.macResolver = resolver
+	d.mu.Unlock()
+}
+
+// resolvePeerMAC returns the MAC of a peer, reusing the known one while its IP is unchanged
+func (d *Discovery) resolvePeerMAC(peerID, ip string) string {
+	d.peersMu.RLock()
+	existing, found := d.peers[peerID]
+	d.peersMu.RUnlock()
+	if found && existing.IP == ip && existing.MAC != "" {
+		return existing.MAC
+	}
+
+	d.mu.Lock()
+	resolver := d.macResolver
+	d.mu.Unlock()
+	if resolver == nil {
+		return ""
+	}
+	mac, err := resolver.ResolveMAC(ip)
+	if err != nil {
+		return ""
+	}
+	return mac
+}
+
+// ResetPeers forgets all discovered peers without reporting them lost, so the next
+// announcement from each is treated as a fresh discovery
+func (d *Discovery) ResetPeers() {
+	d.peersMu.Lock()
+	d.peers = make(map[string]*DiscoveredPeer)
+	d.peersMu.Unlock()
+}
+
+// GetPeer returns a discovered peer by ID
+func (d *Discovery) GetPeer(peerID string) (*DiscoveredPeer, bool) {
+	d.peersMu.RLock()
+	defer d.peersMu.RUnlock()
+	peer, exists := d.peers[peerID]
+	return peer, exists
+}
+
 // Start begins the discovery process
 func (d *Discovery) Start() error {
 	d.mu.Lock()
@@ -90,57 +240,96 @@ func (d *Discovery) Start() error {
 		d.mu.Unlock()
 		return nil // Already running, not an error
 	}
-	// Reset context for restart capability
-	d.ctx, d.cancel = context.WithCancel(context.Background())
+	// Each run gets its own context, so loops from a previous run never see this one's
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
 	d.running = true
 	d.mu.Unlock()
 
 	// Setup multicast listener
 	addr, err := net.ResolveUDPAddr("udp", d.multicastAddr)
 	if err != nil {
+		d.setStopped()
 		return fmt.Errorf("failed to resolve multicast address: %w", err)
 	}
 
-	conn, err := net.ListenMulticastUDP("udp", nil, addr)
+	conn, err := net.ListenMulticastUDP("udp", d.multicastInterface(), addr)
 	if err != nil {
+		d.setStopped()
 		return fmt.Errorf("failed to listen on multicast: %w", err)
 	}
-	conn.SetReadBuffer(4096)
+	conn.SetReadBuffer(d.bufferLen())
+	d.mu.Lock()
 	d.conn = conn
+	d.mu.Unlock()
 
 	// Start announcement broadcast
-	go d.announceLoop()
+	if !d.isPassive() {
+		go d.announceLoop(ctx)
+	}
 
 	// Start listening for announcements
-	go d.listenLoop()
+	go d.listenLoop(ctx, conn)
 
 	// Start peer timeout checker
-	go d.timeoutLoop()
+	go d.timeoutLoop(ctx)
 
 	return nil
 }
 
 // Stop stops the discovery process
 func (d *Discovery) Stop() {
+	d.stop(true)
+}
+
+// Rebind re-joins the multicast group on the current default interface, after the
+// network changed, without telling peers we are leaving
+func (d *Discovery) Rebind() error {
+	d.mu.Lock()
+	running := d.running
+	d.mu.Unlock()
+	if !running {
+		return nil
+	}
+	d.stop(false)
+	return d.Start()
+}
+
+func (d *Discovery) stop(goodbye bool) {
 	d.mu.Lock()
 	if !d.running {
 		d.mu.Unlock()
 		return
 	}
 	d.running = false
+	cancel, conn := d.cancel, d.conn
+	d.conn = nil
 	d.mu.Unlock()
 
-	// Send goodbye message
-	d.sendGoodbye()
+	if goodbye && !d.isPassive() {
+		d.sendGoodbye()
+	}
 
 	// Cancel context and close connection
-	d.cancel()
-	if d.conn != nil {
-		d.conn.Close()
+	cancel()
+	if conn != nil {
+		conn.Close()
 	}
+}
+
+// setStopped marks discovery as not running after a failed start
+func (d *Discovery) setStopped() {
+	d.mu.Lock()
+	d.running = false
+	d.cancel()
+	d.mu.Unlock()
+}
 
-	// Reset context for restart capability
-	d.ctx, d.cancel = context.WithCancel(context.Background())
+// IsRunning returns whether discovery is running
+func (d *Discovery) IsRunning() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running
 }
 
 // GetPeers returns all discovered peers
@@ -156,7 +345,7 @@ func (d *Discovery) GetPeers() []*DiscoveredPeer {
 }
 
 // announceLoop periodically broadcasts presence
-func (d *Discovery) announceLoop() {
+func (d *Discovery) announceLoop(ctx context.Context) {
 	ticker := time.NewTicker(AnnounceInterval)
 	defer ticker.Stop()
 
@@ -165,7 +354,7 @@ func (d *Discovery) announceLoop() {
 
 	for {
 		select {
-		case <-d.ctx.Done():
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
 			d.sendAnnounce()
@@ -176,16 +365,10 @@ func (d *Discovery) announceLoop() {
 // sendAnnounce sends an announcement message
 func (d *Discovery) sendAnnounce() {
 	d.mu.Lock()
-	msg := AnnounceMessage{
-		ID:          d.nodeID,
-		Name:        d.nodeName,
-		Port:        d.port,
-		HasInternet: d.hasInternet,
-		MessageType: "announce",
-	}
+	msg := d.announcementLocked()
 	d.mu.Unlock()
 
-	data, err := json.Marshal(msg)
+	data, err := d.encodeAnnouncement(&msg)
 	if err != nil {
 		return
 	}
@@ -200,6 +383,31 @@ func (d *Discovery) sendAnnounce() {
 	conn.Write(data)
 }
 
+// announcementLocked builds our next announcement; d.mu must be held
+func (d *Discovery) announcementLocked() AnnounceMessage {
+	msg := AnnounceMessage{
+		ID:          d.nodeID,
+		Name:        d.nodeName,
+		Port:        d.port,
+		HasInternet: d.hasInternet,
+		Region:      d.region,
+		NetworkType: d.networkType,
+		MessageType: "announce",
+		Codec:       CodecDict,
+		Seq:         d.nextSequence(),
+		UnicastOnly: d.unicastReplies,
+		Protocol:    ProtocolVersion,
+		MinProtocol: clampProtocol(d.minProtocol),
+	}
+	if d.hasInternet {
+		msg.Terms = d.terms.announced(time.Now())
+		msg.Tier = d.tier
+	}
+	msg.NetworkHints = d.networkHintsLocked(msg.Seq)
+	msg.Power = d.power
+	return msg
+}
+
 // sendGoodbye sends a goodbye message before stopping
 func (d *Discovery) sendGoodbye() {
 	d.mu.Lock()
@@ -208,10 +416,12 @@ func (d *Discovery) sendGoodbye() {
 		Name:        d.nodeName,
 		Port:        d.port,
 		MessageType: "goodbye",
+		Codec:       CodecDict,
+		Seq:         d.nextSequence(),
 	}
 	d.mu.Unlock()
 
-	data, err := json.Marshal(msg)
+	data, err := d.encodeAnnouncement(&msg)
 	if err != nil {
 		return
 	}
@@ -227,18 +437,18 @@ func (d *Discovery) sendGoodbye() {
 }
 
 // listenLoop listens for announcements from other peers
-func (d *Discovery) listenLoop() {
-	buffer := make([]byte, 4096)
+func (d *Discovery) listenLoop(ctx context.Context, conn *net.UDPConn) {
+	buffer := make([]byte, d.bufferLen())
 
 	for {
 		select {
-		case <-d.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
 		}
 
-		d.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, remoteAddr, err := d.conn.ReadFromUDP(buffer)
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, remoteAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
@@ -246,8 +456,12 @@ func (d *Discovery) listenLoop() {
 			return
 		}
 
+		data, _, err := decodeFrame(buffer[:n], len(buffer)*8)
+		if err != nil {
+			continue
+		}
 		var msg AnnounceMessage
-		if err := json.Unmarshal(buffer[:n], &msg); err != nil {
+		if err := json.Unmarshal(data, &msg); err != nil {
 			continue
 		}
 
@@ -257,6 +471,15 @@ func (d *Discovery) listenLoop() {
 		}
 
 		if msg.MessageType == "goodbye" {
+			if d.checkAnnouncement(&msg) != nil {
+				continue
+			}
+			d.peersMu.Lock()
+			fresh := d.acceptSequence(&msg)
+			d.peersMu.Unlock()
+			if !fresh {
+				continue
+			}
 			d.handlePeerGoodbye(msg.ID)
 		} else {
 			d.handlePeerAnnounce(&msg, remoteAddr.IP.String())
@@ -266,17 +489,48 @@ func (d *Discovery) listenLoop() {
 
 // handlePeerAnnounce processes a peer announcement
 func (d *Discovery) handlePeerAnnounce(msg *AnnounceMessage, ip string) {
+	d.handleAnnounce(msg, ip, msg.Port, LinkLAN)
+	if msg.UnicastOnly && !d.isPassive() {
+		d.replyUnicast(msg, ip)
+	}
+}
+
+// handleAnnounce processes an announcement that arrived over a link, from a peer
+// reachable at ip and port
+func (d *Discovery) handleAnnounce(msg *AnnounceMessage, ip string, port int, link string) {
+	if d.checkAnnouncement(msg) != nil {
+		return
+	}
+	mac := d.resolvePeerMAC(msg.ID, ip)
+	networks := d.sharedNetworks(msg)
+
 	d.peersMu.Lock()
+	if !d.acceptSequence(msg) {
+		d.peersMu.Unlock()
+		return
+	}
 	existing, found := d.peers[msg.ID]
 
 	peer := &DiscoveredPeer{
 		ID:          msg.ID,
 		Name:        msg.Name,
 		IP:          ip,
-		Port:        msg.Port,
+		Port:        port,
 		HasInternet: msg.HasInternet,
 		LastSeen:    time.Now(),
-		MAC:         "", // MAC address would need ARP lookup
+		MAC:         mac,
+		Region:      msg.Region,
+		NetworkType: msg.NetworkType,
+		Terms:       msg.Terms,
+		Tier:        msg.Tier,
+		Codec:       msg.Codec,
+		Protocol:    msg.Protocol,
+		MinProtocol: msg.MinProtocol,
+		Signed:      len(msg.Signature) > 0,
+		Seq:         msg.Seq,
+		Link:        link,
+		Networks:    networks,
+		Power:       msg.Power,
 	}
 
 	d.peers[msg.ID] = peer
@@ -285,14 +539,49 @@ func (d *Discovery) handlePeerAnnounce(msg *AnnounceMessage, ip string) {
 	// Notify if this is a new peer
 	if !found && d.peerDiscovered != nil {
 		d.peerDiscovered(peer)
-	} else if found && existing.HasInternet != peer.HasInternet {
-		// Internet status changed
+	} else if found && (existing.HasInternet != peer.HasInternet ||
+		existing.Region != peer.Region || existing.NetworkType != peer.NetworkType ||
+		!existing.Terms.Equal(peer.Terms) || existing.Tier != peer.Tier || existing.MAC != peer.MAC ||
+		existing.Link != peer.Link || !slices.Equal(existing.Networks, peer.Networks) ||
+		!existing.Power.Equal(peer.Power)) {
+		// Internet status, exit info, resolved MAC, link, shared networks or battery changed
 		if d.peerDiscovered != nil {
 			d.peerDiscovered(peer)
 		}
 	}
 }
 
+// encodeAnnouncement encodes an announcement compactly once every peer we know of
+// understands compact frames; a single older peer keeps announcements plain JSON
+func (d *Discovery) encodeAnnouncement(msg *AnnounceMessage) ([]byte, error) {
+	d.mu.Lock()
+	identity := d.identity
+	d.mu.Unlock()
+	if identity != nil {
+		identity.signAnnouncement(msg)
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	d.peersMu.RLock()
+	compact := len(d.peers) > 0
+	for _, peer := range d.peers {
+		if peer.Codec != CodecDict {
+			compact = false
+			break
+		}
+	}
+	d.peersMu.RUnlock()
+
+	if !compact {
+		return data, nil
+	}
+	return encodeCompact(data)
+}
+
 // handlePeerGoodbye processes a peer goodbye message
 func (d *Discovery) handlePeerGoodbye(peerID string) {
 	d.peersMu.Lock()
@@ -305,13 +594,13 @@ func (d *Discovery) handlePeerGoodbye(peerID string) {
 }
 
 // timeoutLoop checks for peers that haven't been seen recently
-func (d *Discovery) timeoutLoop() {
+func (d *Discovery) timeoutLoop(ctx context.Context) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-d.ctx.Done():
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
 			d.checkPeerTimeouts()
@@ -332,5 +621,6 @@ func (d *Discovery) checkPeerTimeouts() {
 			}
 		}
 	}
+	d.pruneSequences(now)
 	d.peersMu.Unlock()
 }
@@ -0,0 +1,192 @@
+package mesh
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTrafficHistory is how many recent exit requests are kept for policy dry runs
+const DefaultTrafficHistory = 512
+
+// Reasons the exit refused a request, or a policy dry run would have
+const (
+	RefusedBlocklist     = "blocklist"      // Host on a policy blocklist
+	RefusedContentFilter = "content_filter" // Host in a filtered category
+	RefusedExitGuard     = "exit_guard"     // Private destination; not up to network policy
+	RefusedQuota         = "quota"          // Client over its data quota
+	RefusedSharingHours  = "sharing_hours"  // Outside the hours sharing is allowed
+	RefusedOutOfScope    = "out_of_scope"   // Destination the sharer's scoped offer doesn't cover
+	RefusedDataSaver     = "data_saver"     // Tracker or ad host the client's data saver blocks
+)
+
+// trafficRecord is one request the exit handled
+type trafficRecord struct {
+	At      time.Time
+	Client  string
+	Host    string
+	Bytes   int64
+	Refused string // Why the request was refused, "" if it was served
+}
+
+// trafficHistory keeps the most recent exit requests. A nil trafficHistory keeps nothing.
+type trafficHistory struct {
+	records []trafficRecord
+	next    int
+	full    bool
+	mu      sync.Mutex
+}
+
+func newTrafficHistory(capacity int) *trafficHistory {
+	return &trafficHistory{records: make([]trafficRecord, capacity)}
+}
+
+func (h *trafficHistory) add(record trafficRecord) {
+	if h == nil || len(h.records) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records[h.next] = record
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// snapshot returns the kept records, oldest first
+func (h *trafficHistory) snapshot() []trafficRecord {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var records []trafficRecord
+	if h.full {
+		records = append(records, h.records[h.next:]...)
+	}
+	return append(records, h.records[:h.next]...)
+}
+
+// PolicyDryRun reports what a policy bundle would have done to recent exit traffic
+type PolicyDryRun struct {
+	Requests     int           `json:"requests"`      // Requests evaluated
+	From         time.Time     `json:"from"`          // Oldest request evaluated
+	Refused      int           `json:"refused"`       // Requests the bundle would refuse
+	NewlyRefused int           `json:"newly_refused"` // Of those, requests that were served
+	Released     int           `json:"released"`      // Requests refused by policy now that the bundle would serve
+	Hits         []DryRunHit   `json:"hits,omitempty"`
+	Clients      []DryRunUsage `json:"clients,omitempty"` // Clients the bundle would affect
+}
+
+// DryRunHit counts the requests to one host a bundle would refuse for one reason
+type DryRunHit struct {
+	Host     string `json:"host"`
+	Reason   string `json:"reason"`
+	Category string `json:"category,omitempty"` // Content filter category
+	Requests int    `json:"requests"`
+}
+
+// DryRunUsage counts the requests of one client a bundle would refuse
+type DryRunUsage struct {
+	Client    string `json:"client"`
+	Refused   int    `json:"refused"`
+	OverQuota bool   `json:"over_quota"`
+}
+
+// DryRunPolicy evaluates a policy bundle against the exit's recent requests without
+// applying it, showing owners what a new quota, filter, blocklist or schedule would
+// block before they publish it. Active policies of other networks are left out, so
+// the report shows the bundle on its own.
+func (ma *MeshApp) DryRunPolicy(bundle *PolicyBundle) (*PolicyDryRun, error) {
+	if err := bundle.Validate(); err != nil {
+		return nil, err
+	}
+
+	candidate := NewPolicyEngine()
+	candidate.active[bundle.NetworkID] = bundle
+	var filter *ContentFilter
+	if bundle.ContentFilter != nil {
+		filter = NewContentFilter(*bundle.ContentFilter, ma.PersonalNetworkMgr.NetworksOf)
+	}
+
+	records := ma.InternetProxy.history.snapshot()
+	report := &PolicyDryRun{Requests: len(records)}
+	if len(records) > 0 {
+		report.From = records[0].At
+	}
+
+	// Quotas count everything a client used: what it used before the window, then the window
+	used := make(map[string]int64)
+	for _, record := range records {
+		used[record.Client] -= record.Bytes
+	}
+	for client := range used {
+		used[client] += int64(ma.InternetProxy.ClientUsage(client))
+		if used[client] < 0 {
+			used[client] = 0
+		}
+	}
+
+	hits := make(map[DryRunHit]int)
+	clients := make(map[string]*DryRunUsage)
+	for _, record := range records {
+		reason, category := "", ""
+		switch {
+		case record.Refused == RefusedExitGuard || record.Refused == RefusedOutOfScope || record.Refused == RefusedDataSaver:
+			continue // Refused whatever the policy says
+		case candidate.IsBlocked(record.Host):
+			reason = RefusedBlocklist
+		case filter.ForClient(record.Client) != nil && filter.ForClient(record.Client).BlockedCategory(record.Host) != "":
+			reason, category = RefusedContentFilter, filter.ForClient(record.Client).BlockedCategory(record.Host)
+		case !candidate.SharingAllowedAt(record.At):
+			reason = RefusedSharingHours
+		default:
+			if quota := candidate.QuotaBytes(record.Client); quota > 0 && used[record.Client] >= quota {
+				reason = RefusedQuota
+			}
+		}
+		if reason == "" {
+			used[record.Client] += record.Bytes
+			if record.Refused != "" {
+				report.Released++
+			}
+			continue
+		}
+		report.Refused++
+		if record.Refused == "" {
+			report.NewlyRefused++
+		}
+		hits[DryRunHit{Host: record.Host, Reason: reason, Category: category}]++
+		usage, ok := clients[record.Client]
+		if !ok {
+			usage = &DryRunUsage{Client: record.Client}
+			clients[record.Client] = usage
+		}
+		usage.Refused++
+		usage.OverQuota = usage.OverQuota || reason == RefusedQuota
+	}
+
+	for hit, count := range hits {
+		hit.Requests = count
+		report.Hits = append(report.Hits, hit)
+	}
+	sort.Slice(report.Hits, func(i, j int) bool {
+		a, b := report.Hits[i], report.Hits[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Host < b.Host || (a.Host == b.Host && a.Reason < b.Reason)
+	})
+	for _, usage := range clients {
+		report.Clients = append(report.Clients, *usage)
+	}
+	sort.Slice(report.Clients, func(i, j int) bool {
+		a, b := report.Clients[i], report.Clients[j]
+		if a.Refused != b.Refused {
+			return a.Refused > b.Refused
+		}
+		return a.Client < b.Client
+	})
+	return report, nil
+}
@@ -0,0 +1,92 @@
+package mesh
+
+import "time"
+
+// Event types emitted through EventListener
+const (
+	EventComponentDegraded      = "component_degraded"
+	EventComponentRecovered     = "component_recovered"
+	EventPolicyApplied          = "policy_applied"
+	EventPolicyRejected         = "policy_rejected"
+	EventPolicyViolation        = "policy_violation" // A message was dropped by a network's message policy
+	EventSharingRefused         = "sharing_refused"
+	EventSuspended              = "suspended"
+	EventResumed                = "resumed"
+	EventWakeDetected           = "wake_detected"
+	EventClockJumped            = "clock_jumped" // The wall clock was set; timeouts are unaffected, Detail says by how much
+	EventPairingCode            = "pairing_code"
+	EventPairingVerified        = "pairing_verified"
+	EventPairingFailed          = "pairing_failed"
+	EventRouteMetricsError      = "route_metrics_error"      // Learned route metrics could not be loaded or saved
+	EventPeerHibernated         = "peer_hibernated"          // An idle peer's connection was closed; it is still known
+	EventPeerWoke               = "peer_woke"                // A dormant peer was reconnected on demand
+	EventTelemetryError         = "telemetry_error"          // Spans could not be exported to the collector
+	EventConfigError            = "config_error"             // A config setting was invalid and left unchanged
+	EventClientDemoted          = "client_demoted"           // An abusive proxy client was limited to a lower request rate
+	EventClientBanned           = "client_banned"            // An abusive proxy client was temporarily banned
+	EventClientRestored         = "client_restored"          // A demoted or banned proxy client is back in good standing
+	EventAccessRequested        = "access_requested"         // A device asked for internet access from the access page
+	EventQualityChanged         = "quality_changed"          // The active proxy's connection grade changed; Detail is the grade
+	EventProxyFailover          = "proxy_failover"           // The primary proxy was lost and another took over
+	EventNetworkChanged         = "network_changed"          // The node's address changed; Detail is "old -> new"
+	EventPeerUnreachable        = "peer_unreachable"         // Dialing a discovered peer failed; it is retried with backoff
+	EventPeerReachable          = "peer_reachable"           // An unreachable peer was dialed successfully
+	EventPeerUnverified         = "peer_unverified"          // A peer connected that discovery doesn't know at that address; Detail says why
+	EventForgedMessage          = "forged_message"           // A received message's signature didn't prove its source; it was dropped
+	EventSourceRouteFailed      = "source_route_failed"      // A source-routed message we sent was refused by a relay; Detail says why
+	EventHopLimitExceeded       = "hop_limit_exceeded"       // A message we sent was dropped for running out of hops; PeerID is the node that dropped it
+	EventNetworkJoined          = "network_joined"           // We joined a personal network with an invite code; Detail is the network ID
+	EventNetworkJoinFailed      = "network_join_failed"      // A network owner refused our invite code; Detail says why
+	EventNetworkMemberJoined    = "network_member_joined"    // A peer joined a network we own with an invite code; Detail is the network ID
+	EventNetworkKeyUpdated      = "network_key_updated"      // A personal network's owner sent a new group key; Detail is the network ID
+	EventNetworkKeyWithheld     = "network_key_withheld"     // A group key couldn't be exchanged privately with a peer; Detail says why
+	EventDataUndecryptable      = "data_undecryptable"       // A sealed data message for us couldn't be opened and was dropped
+	EventMulticastBlocked       = "multicast_blocked"        // The platform drops incoming multicast; peers are asked to answer discovery by unicast
+	EventIdentityRevoked        = "identity_revoked"         // A node identity was revoked; Detail is why, or its successor when rotated
+	EventTrustChanged           = "trust_changed"            // A peer's trust level changed; Detail is the level and why
+	EventQuotaExceeded          = "quota_exceeded"           // A proxy client used up its data quota; Detail is the limit and the action taken
+	EventMemberCertRejected     = "member_cert_rejected"     // A peer sent a membership certificate that didn't verify; Detail says why
+	EventAbuseWarning           = "abuse_warning"            // Another exit banned a client for abuse; PeerID is the client, Detail who warned and why
+	EventWiFiCredentialReceived = "wifi_credential_received" // A network member shared Wi-Fi credentials with us; Detail is their ID
+	EventWiFiCredentialRevoked  = "wifi_credential_revoked"  // A member revoked Wi-Fi credentials it shared; Detail is their ID
+	EventWiFiCredentialWithheld = "wifi_credential_withheld" // Wi-Fi credentials weren't sent to or accepted from a peer; Detail says why
+	EventRelayPaused            = "relay_paused"             // The battery fell below the relay threshold; relaying and sharing stop. Detail says why
+	EventRelayResumed           = "relay_resumed"            // We are charged or plugged in again; relaying and sharing resume
+)
+
+// ComponentRetryInterval is how often components that failed to start are retried
+const ComponentRetryInterval = 30 * time.Second
+
+// Event describes a notable state change in the mesh application
+type Event struct {
+	Type      string    `json:"type"`
+	Component string    `json:"component,omitempty"`
+	PeerID    string    `json:"peer_id,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// EventListener is called for every event emitted by the mesh application
+type EventListener interface {
+	OnEvent(event *Event)
+}
+
+// RegisterEventListener registers a listener for mesh application events
+func (ma *MeshApp) RegisterEventListener(listener EventListener) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.eventListeners = append(ma.eventListeners, listener)
+}
+
+// emitEvent delivers an event to all registered listeners; ma.mu must not be held
+func (ma *MeshApp) emitEvent(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	ma.mu.RLock()
+	listeners := ma.eventListeners
+	ma.mu.RUnlock()
+	for _, listener := range listeners {
+		listener.OnEvent(event)
+	}
+}
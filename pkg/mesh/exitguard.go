@@ -0,0 +1,193 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrDestinationBlocked is returned when exit traffic targets the sharer's own networks
+var ErrDestinationBlocked = errors.New("destination is on a private network")
+
+// internalExitNets are special-purpose ranges not covered by the net.IP classifiers
+var internalExitNets = mustParseCIDRs(
+	"0.0.0.0/8",     // "This" network
+	"100.64.0.0/10", // Carrier-grade NAT, also used by overlay VPNs
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // Benchmarking
+	"240.0.0.0/4",   // Reserved
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// isInternalIP reports whether ip is loopback, private, link-local or otherwise not on the internet
+func isInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range internalExitNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExitGuard keeps mesh clients from reaching the sharer's LAN through the exit: it refuses
+// private, loopback and link-local destinations unless they are explicitly allowlisted.
+// Addresses are checked when connecting, after DNS resolution, so hostnames that resolve
+// to internal addresses are refused too. A nil ExitGuard permits everything.
+type ExitGuard struct {
+	allow     []*net.IPNet
+	upstream  *url.URL // Proxy exit traffic goes through; nil connects directly
+	timeouts  Timeouts
+	transport *http.Transport
+	mu        sync.RWMutex
+}
+
+// NewExitGuard creates a guard with an empty allowlist
+func NewExitGuard() *ExitGuard {
+	g := &ExitGuard{timeouts: DefaultTimeouts()}
+	g.transport = &http.Transport{
+		Proxy:                 g.proxyFor,
+		DialContext:           g.dialTransport,
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          16,
+	}
+	return g
+}
+
+// SetAllowlist replaces the internal networks clients may reach; entries are CIDRs or single IPs
+func (g *ExitGuard) SetAllowlist(entries []string) error {
+	allow := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid allowlist entry %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			allow = append(allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid allowlist entry %q: %w", entry, err)
+		}
+		allow = append(allow, n)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.allow = allow
+	// Pooled connections were checked against the old allowlist
+	g.transport.CloseIdleConnections()
+	return nil
+}
+
+// Allowlist returns the allowlisted networks
+func (g *ExitGuard) Allowlist() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	entries := make([]string, 0, len(g.allow))
+	for _, n := range g.allow {
+		entries = append(entries, n.String())
+	}
+	return entries
+}
+
+// Permitted reports whether clients may connect to ip
+func (g *ExitGuard) Permitted(ip net.IP) bool {
+	if g == nil || !isInternalIP(ip) {
+		return true
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, n := range g.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckHost rejects destinations that are refused without resolving them: internal
+// address literals and localhost names. Hostnames are checked again when connecting.
+func (g *ExitGuard) CheckHost(host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		if !g.Permitted(ip) {
+			return fmt.Errorf("%s: %w", host, ErrDestinationBlocked)
+		}
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		if !g.Permitted(net.IPv4(127, 0, 0, 1)) {
+			return fmt.Errorf("%s: %w", host, ErrDestinationBlocked)
+		}
+	}
+	return nil
+}
+
+// control refuses resolved addresses the guard doesn't permit, as a net.Dialer Control hook
+func (g *ExitGuard) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && !g.Permitted(ip) {
+		return fmt.Errorf("%s: %w", host, ErrDestinationBlocked)
+	}
+	return nil
+}
+
+// DialContext connects like net.Dialer, refusing addresses the guard doesn't permit,
+// through the upstream proxy if one is set
+func (g *ExitGuard) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if u := g.upstreamProxy(); u != nil {
+		return g.dialUpstream(ctx, u, addr)
+	}
+	dialer := &net.Dialer{Timeout: g.timeoutPolicy().ExitDial}
+	if g != nil {
+		dialer.Control = g.control
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// RoundTripper returns a shared HTTP transport whose connections go through the guard
+func (g *ExitGuard) RoundTripper() http.RoundTripper {
+	if g == nil {
+		return http.DefaultTransport
+	}
+	return g.transport
+}
@@ -0,0 +1,167 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// FetchOnce is for grabbing something small, like a weather report, without keeping
+// the mesh and its radios running: discovery and the transport run only for the one
+// request, and everything is torn down again before it returns.
+
+const (
+	// DefaultFetchTimeout bounds a FetchOnce given no timeout, from discovery to teardown
+	DefaultFetchTimeout = 30 * time.Second
+
+	// FetchMaxBody is the most of a response body FetchOnce returns
+	FetchMaxBody = 1 << 20
+
+	// fetchPollInterval is how often FetchOnce checks for a proxy and its authorization
+	fetchPollInterval = 50 * time.Millisecond
+)
+
+var (
+	// ErrFetchInProgress is returned when the mesh or another fetch is started during a fetch
+	ErrFetchInProgress = errors.New("a one-shot fetch is in progress")
+	// ErrNoProxy is returned when no proxy we may use was found in time
+	ErrNoProxy = errors.New("no usable proxy found")
+)
+
+// FetchResult is the response to a FetchOnce
+type FetchResult struct {
+	StatusCode  int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body"`
+	Truncated   bool   `json:"truncated,omitempty"` // The body was longer than FetchMaxBody
+	ProxyID     string `json:"proxy_id"`
+}
+
+// FetchOnce GETs a URL through a mesh proxy without joining the mesh for longer than it
+// takes: it starts discovery and the transport, waits for a proxy the user already
+// approved, connects, asks it for authorization, makes the request and tears it all
+// down again, all within timeout (DefaultFetchTimeout if <= 0). Our announcements ask
+// peers to answer at once, so a proxy doesn't have to wait for its next announcement.
+func (ma *MeshApp) FetchOnce(rawURL string, timeout time.Duration) (*FetchResult, error) {
+	if timeout <= 0 {
+		timeout = DefaultFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ma.mu.Lock()
+	switch {
+	case ma.IsConnected:
+		ma.mu.Unlock()
+		return nil, ErrMeshRunning
+	case ma.fetching:
+		ma.mu.Unlock()
+		return nil, ErrFetchInProgress
+	}
+	ma.stopScanLocked()
+	ma.fetching = true
+	multicastBlocked := ma.platformNet.multicastBlocked()
+	ma.mu.Unlock()
+
+	ma.Discovery.SetCallbacks(nil, nil) // Only the proxy we pick is dialed
+	ma.Discovery.SetUnicastReplies(true)
+	ma.Transport.SetMessageHandler(ma.handleMessage)
+	defer func() {
+		ma.InternetClient.Disconnect()
+		ma.Discovery.Stop()
+		ma.Discovery.SetUnicastReplies(multicastBlocked)
+		ma.Discovery.ResetPeers()
+		ma.Transport.Stop()
+		ma.mu.Lock()
+		ma.fetching = false
+		ma.mu.Unlock()
+	}()
+	if err := ma.Transport.Start(); err != nil {
+		return nil, err
+	}
+	if err := ma.Discovery.Start(); err != nil {
+		return nil, err
+	}
+
+	proxy, err := ma.awaitFetchProxy(ctx, req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if err := ma.Transport.ConnectToPeer(proxy.ID, proxy.IP, proxy.Port); err != nil {
+		return nil, err
+	}
+	if err := ma.InternetClient.ConnectToProxy(proxy.ID, proxy.IP, ProxyPort); err != nil {
+		return nil, err
+	}
+	if err := ma.awaitFetchAuthorization(ctx, proxy.ID); err != nil {
+		return nil, err
+	}
+
+	resp, err := ma.InternetClient.DoRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, FetchMaxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	result := &FetchResult{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        body,
+		ProxyID:     proxy.ID,
+	}
+	if len(body) > FetchMaxBody {
+		result.Body, result.Truncated = body[:FetchMaxBody], true
+	}
+	return result, nil
+}
+
+// awaitFetchProxy waits for the best proxy serving host that can be used without asking
+// the user, who isn't there to approve a new exit or compare pairing codes during a fetch
+func (ma *MeshApp) awaitFetchProxy(ctx context.Context, host string) (*DiscoveredPeer, error) {
+	ticker := time.NewTicker(fetchPollInterval)
+	defer ticker.Stop()
+	for {
+		var best *DiscoveredPeer
+		for _, peer := range ma.Discovery.GetPeers() {
+			if ma.usableExit(peer) && peer.Terms.Serves(host) && ma.ExitConsent.HasConsent(peer) &&
+				!ma.pairingRequired(peer.ID) && betterExit(peer, best) {
+				best = peer
+			}
+		}
+		if best != nil {
+			return best, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ErrNoProxy
+		case <-ticker.C:
+		}
+	}
+}
+
+// awaitFetchAuthorization asks a proxy to authorize us and waits for its token
+func (ma *MeshApp) awaitFetchAuthorization(ctx context.Context, proxyID string) error {
+	if err := ma.requestProxyAccess(proxyID); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(fetchPollInterval)
+	defer ticker.Stop()
+	for !ma.InternetClient.hasProxyToken(proxyID) {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("proxy %s didn't authorize us: %w", proxyID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
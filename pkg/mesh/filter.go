@@ -0,0 +1,233 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Content filter categories with built-in host lists
+const (
+	CategoryAdult     = "adult"
+	CategoryGambling  = "gambling"
+	CategorySocial    = "social"
+	CategoryStreaming = "streaming"
+	CategoryCustom    = "custom" // Hosts a policy lists in BlockedHosts
+)
+
+// ClientNodeHeader identifies the mesh node a proxied request comes from
+const ClientNodeHeader = "X-InterMesh-Node"
+
+// defaultCategoryHosts seeds the category lists; owners can extend them with AddCategoryHosts
+var defaultCategoryHosts = map[string][]string{
+	CategoryAdult:    {"pornhub.com", "xvideos.com", "xhamster.com", "onlyfans.com"},
+	CategoryGambling: {"bet365.com", "pokerstars.com", "williamhill.com", "draftkings.com"},
+	CategorySocial:   {"tiktok.com", "instagram.com", "snapchat.com", "facebook.com"},
+	CategoryStreaming: {"youtube.com", "googlevideo.com", "netflix.com", "nflxvideo.net", "twitch.tv",
+		"disneyplus.com", "hulu.com", "primevideo.com"},
+}
+
+// safeSearchHosts maps search engines to the hosts that force SafeSearch at the DNS level
+var safeSearchHosts = map[string]string{
+	"www.google.com":     "forcesafesearch.google.com",
+	"google.com":         "forcesafesearch.google.com",
+	"www.bing.com":       "strict.bing.com",
+	"bing.com":           "strict.bing.com",
+	"www.youtube.com":    "restrict.youtube.com",
+	"m.youtube.com":      "restrict.youtube.com",
+	"youtube.com":        "restrict.youtube.com",
+	"duckduckgo.com":     "safe.duckduckgo.com",
+	"www.duckduckgo.com": "safe.duckduckgo.com",
+}
+
+// safeSearchParams are query parameters that enable SafeSearch on plain HTTP requests
+var safeSearchParams = map[string][2]string{
+	"google.com":     {"safe", "active"},
+	"bing.com":       {"adlt", "strict"},
+	"duckduckgo.com": {"kp", "1"},
+}
+
+// ContentFilterPolicy describes a content filter a network owner requires
+type ContentFilterPolicy struct {
+	Categories   []string `json:"categories,omitempty"`
+	BlockedHosts []string `json:"blocked_hosts,omitempty"` // hostnames, subdomains included
+	SafeSearch   bool     `json:"safe_search,omitempty"`
+	GuestsOnly   bool     `json:"guests_only,omitempty"` // apply only to clients outside our personal networks
+
+	// Networks replaces the policy for members of the given personal networks, by network
+	// ID; a member of several is filtered by the first of them in ID order
+	Networks map[string]*ContentFilterPolicy `json:"networks,omitempty"`
+}
+
+// validate checks categories and hosts, including those of the network overrides
+func (p *ContentFilterPolicy) validate() error {
+	for _, category := range p.Categories {
+		if _, ok := defaultCategoryHosts[category]; !ok {
+			return fmt.Errorf("unknown filter category %q", category)
+		}
+	}
+	for _, host := range p.BlockedHosts {
+		if host == "" || strings.ContainsAny(host, " /:") {
+			return fmt.Errorf("bad blocked host %q", host)
+		}
+	}
+	for networkID, override := range p.Networks {
+		if networkID == "" || override == nil {
+			return fmt.Errorf("bad filter override for network %q", networkID)
+		}
+		if len(override.Networks) > 0 {
+			return fmt.Errorf("filter override for network %q has overrides of its own", networkID)
+		}
+		if err := override.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ContentFilter blocks host categories and listed hosts and enforces SafeSearch on
+// proxied traffic
+type ContentFilter struct {
+	policy     ContentFilterPolicy
+	hosts      map[string]string // host -> category
+	overrides  map[string]*ContentFilter
+	networksOf func(nodeID string) []string
+	mu         sync.RWMutex
+}
+
+// NewContentFilter creates a filter for the given policy. networksOf returns the personal
+// networks a client is a member of, sorted, which decides who counts as a guest and which
+// network override applies.
+func NewContentFilter(policy ContentFilterPolicy, networksOf func(nodeID string) []string) *ContentFilter {
+	cf := &ContentFilter{
+		policy:     policy,
+		hosts:      make(map[string]string),
+		overrides:  make(map[string]*ContentFilter),
+		networksOf: networksOf,
+	}
+	for _, category := range policy.Categories {
+		for _, host := range defaultCategoryHosts[category] {
+			cf.hosts[host] = category
+		}
+	}
+	for _, host := range policy.BlockedHosts {
+		cf.hosts[normalizeHost(host)] = CategoryCustom
+	}
+	for networkID, override := range policy.Networks {
+		cf.overrides[networkID] = NewContentFilter(*override, nil)
+	}
+	return cf
+}
+
+// AddCategoryHosts adds hosts to a category; they are blocked where the category is enabled
+func (cf *ContentFilter) AddCategoryHosts(category string, hosts []string) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	for _, override := range cf.overrides {
+		override.AddCategoryHosts(category, hosts)
+	}
+	for _, enabled := range cf.policy.Categories {
+		if enabled != category {
+			continue
+		}
+		for _, host := range hosts {
+			cf.hosts[strings.ToLower(host)] = category
+		}
+	}
+}
+
+// ForClient returns the filter to enforce for a client node: its personal network's
+// override if it has one, else this filter unless it exempts the client, else nil.
+// A nil filter returns nil.
+func (cf *ContentFilter) ForClient(nodeID string) *ContentFilter {
+	if cf == nil {
+		return nil
+	}
+	var networks []string
+	if nodeID != "" && cf.networksOf != nil {
+		networks = cf.networksOf(nodeID)
+	}
+	for _, networkID := range networks {
+		if override, ok := cf.overrides[networkID]; ok {
+			return override
+		}
+	}
+	if cf.policy.GuestsOnly && len(networks) > 0 {
+		return nil
+	}
+	return cf
+}
+
+// Policy returns the policy the filter enforces
+func (cf *ContentFilter) Policy() ContentFilterPolicy {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return cf.policy
+}
+
+// AppliesTo returns whether the filter's own policy is enforced for the given client
+// node, rather than a network override or no filter at all
+func (cf *ContentFilter) AppliesTo(nodeID string) bool {
+	return cf.ForClient(nodeID) == cf
+}
+
+// BlockedCategory returns the category that blocks host, or "" if it is allowed
+func (cf *ContentFilter) BlockedCategory(host string) string {
+	host = normalizeHost(host)
+
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	for h := host; h != ""; {
+		if category, ok := cf.hosts[h]; ok {
+			return category
+		}
+		dot := strings.IndexByte(h, '.')
+		if dot < 0 {
+			break
+		}
+		h = h[dot+1:]
+	}
+	return ""
+}
+
+// SafeSearchHost returns the SafeSearch host to dial in place of host, if any
+func (cf *ContentFilter) SafeSearchHost(host string) (string, bool) {
+	if !cf.policy.SafeSearch {
+		return "", false
+	}
+	safe, ok := safeSearchHosts[normalizeHost(host)]
+	return safe, ok
+}
+
+// EnforceSafeSearch adds SafeSearch parameters to a plain HTTP search request
+func (cf *ContentFilter) EnforceSafeSearch(u *url.URL) {
+	if !cf.policy.SafeSearch {
+		return
+	}
+	host := normalizeHost(u.Host)
+	for engine, param := range safeSearchParams {
+		if host == engine || strings.HasSuffix(host, "."+engine) {
+			q := u.Query()
+			q.Set(param[0], param[1])
+			u.RawQuery = q.Encode()
+			return
+		}
+	}
+}
+
+// clientFor identifies the mesh node behind a proxied request
+func clientFor(r *http.Request) string {
+	return r.Header.Get(ClientNodeHeader)
+}
+
+// normalizeHost strips the port and trailing dot and lowercases a host
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
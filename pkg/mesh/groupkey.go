@@ -0,0 +1,411 @@
+package mesh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A personal network with encryption enabled has a symmetric group key, held by its owner
+// and members. Data messages between two nodes of the network are sealed with it by the
+// sender and opened by the destination, so relays outside the network only see the
+// envelope. The owner rotates the key whenever membership changes and sends it to each
+// member in a "network_key" message, sealed with the pairing key if the member is paired
+// and otherwise only over an encrypted transport. The previous key is kept so messages
+// sealed just before a rotation can still be opened.
+
+// GroupKeySize is the size of network group keys, for AES-256-GCM
+const GroupKeySize = 32
+
+var (
+	// ErrNoKeyChannel is returned when a group key can't be sent to a member privately
+	ErrNoKeyChannel = errors.New("no private channel to send the network key")
+	// ErrUndecryptable is returned for sealed data messages that can't be opened
+	ErrUndecryptable = errors.New("sealed message can't be opened")
+)
+
+// seal encrypts plaintext with AES-GCM, returning the nonce followed by the ciphertext
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open decrypts what seal returned
+func open(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrUndecryptable
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+// EnableEncryption gives the network its first group key and has it rotated whenever
+// membership changes. Only the owner's copy of a network should be enabled.
+func (pn *PersonalNetwork) EnableEncryption() error {
+	pn.mu.Lock()
+	pn.rotateKeys = true
+	err := pn.rotateKeyLocked()
+	onRotate := pn.onRotate
+	pn.mu.Unlock()
+	if err == nil && onRotate != nil {
+		onRotate(pn)
+	}
+	return err
+}
+
+// RotateKey replaces the group key, keeping the current one for messages in flight
+func (pn *PersonalNetwork) RotateKey() error {
+	pn.mu.Lock()
+	err := pn.rotateKeyLocked()
+	onRotate := pn.onRotate
+	pn.mu.Unlock()
+	if err == nil && onRotate != nil {
+		onRotate(pn)
+	}
+	return err
+}
+
+func (pn *PersonalNetwork) rotateKeyLocked() error {
+	key := make([]byte, GroupKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate network key: %w", err)
+	}
+	pn.prevKey, pn.groupKey = pn.groupKey, key
+	pn.keyEpoch++
+	return nil
+}
+
+// GroupKey returns the current group key and its epoch; a nil key means the network
+// isn't encrypted
+func (pn *PersonalNetwork) GroupKey() (uint64, []byte) {
+	pn.mu.RLock()
+	defer pn.mu.RUnlock()
+	return pn.keyEpoch, pn.groupKey
+}
+
+// installKey takes a group key from the owner, if it is newer than ours
+func (pn *PersonalNetwork) installKey(epoch uint64, key []byte) bool {
+	if len(key) != GroupKeySize {
+		return false
+	}
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	if epoch <= pn.keyEpoch {
+		return false
+	}
+	if epoch == pn.keyEpoch+1 {
+		pn.prevKey = pn.groupKey
+	} else {
+		pn.prevKey = nil // Missed a rotation; the key before this one is unknown
+	}
+	pn.groupKey, pn.keyEpoch = key, epoch
+	return true
+}
+
+// keyForEpoch returns the current or previous group key
+func (pn *PersonalNetwork) keyForEpoch(epoch uint64) []byte {
+	pn.mu.RLock()
+	defer pn.mu.RUnlock()
+	switch {
+	case epoch == pn.keyEpoch:
+		return pn.groupKey
+	case epoch+1 == pn.keyEpoch:
+		return pn.prevKey
+	}
+	return nil
+}
+
+// includes reports whether a node is the network's owner or one of its members
+func (pn *PersonalNetwork) includes(nodeID string) bool {
+	return nodeID == pn.Owner || pn.IsMember(nodeID)
+}
+
+// SetKeyRotationHandler sets what is called after a network's group key changes, for
+// current and future networks
+func (pnm *PersonalNetworkManager) SetKeyRotationHandler(handler func(*PersonalNetwork)) {
+	pnm.mu.Lock()
+	defer pnm.mu.Unlock()
+	pnm.onRotate = handler
+	for _, network := range pnm.Networks {
+		network.mu.Lock()
+		network.onRotate = handler
+		network.mu.Unlock()
+	}
+}
+
+// sharedKeyedNetwork returns the encrypted network, lowest ID first, that both nodes
+// belong to, or nil
+func (pnm *PersonalNetworkManager) sharedKeyedNetwork(a, b string) *PersonalNetwork {
+	pnm.mu.RLock()
+	defer pnm.mu.RUnlock()
+	ids := make([]string, 0, len(pnm.Networks))
+	for id := range pnm.Networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		network := pnm.Networks[id]
+		if _, key := network.GroupKey(); key != nil && network.includes(a) && network.includes(b) {
+			return network
+		}
+	}
+	return nil
+}
+
+// EnableNetworkEncryption turns on end-to-end encryption for a personal network we own
+// and sends the group key to its members
+func (ma *MeshApp) EnableNetworkEncryption(networkID string) error {
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(networkID)
+	if !ok {
+		return fmt.Errorf("unknown personal network %q", networkID)
+	}
+	if network.Owner != ma.Node.ID {
+		return ErrNotNetworkOwner
+	}
+	return network.EnableEncryption()
+}
+
+// RotateNetworkKey replaces the group key of an encrypted personal network we own and
+// sends the new one to its members
+func (ma *MeshApp) RotateNetworkKey(networkID string) error {
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(networkID)
+	if !ok {
+		return fmt.Errorf("unknown personal network %q", networkID)
+	}
+	if network.Owner != ma.Node.ID {
+		return ErrNotNetworkOwner
+	}
+	if _, key := network.GroupKey(); key == nil {
+		return fmt.Errorf("network %q isn't encrypted", networkID)
+	}
+	return network.RotateKey()
+}
+
+// wrapGroupKey prepares the current group key for a member: sealed with the pairing key
+// if we paired, or as is if the transport encrypts the link
+func (ma *MeshApp) wrapGroupKey(network *PersonalNetwork, peerID string) (epoch uint64, wrapped []byte, sealed bool, err error) {
+	epoch, key := network.GroupKey()
+	if key == nil {
+		return 0, nil, false, nil
+	}
+	if pairingKey, ok := ma.Pairing.key(peerID); ok {
+		wrapped, err = seal(groupKeyWrapKey(pairingKey), key, []byte(network.ID))
+		return epoch, wrapped, true, err
+	}
+	if ma.Transport.TLSEnabled() || ma.Transport.NoiseEnabled() {
+		return epoch, key, false, nil
+	}
+	return 0, nil, false, ErrNoKeyChannel
+}
+
+// unwrapGroupKey reverses wrapGroupKey for a key from the network's owner
+func (ma *MeshApp) unwrapGroupKey(networkID, ownerID string, wrapped []byte, sealed bool) ([]byte, error) {
+	if !sealed {
+		if !ma.Transport.TLSEnabled() && !ma.Transport.NoiseEnabled() {
+			return nil, ErrNoKeyChannel
+		}
+		return wrapped, nil
+	}
+	pairingKey, ok := ma.Pairing.key(ownerID)
+	if !ok {
+		return nil, ErrNotPaired
+	}
+	return open(groupKeyWrapKey(pairingKey), wrapped, []byte(networkID))
+}
+
+// groupKeyWrapKey derives the key group keys are sealed with from a pairing key
+func groupKeyWrapKey(pairingKey []byte) []byte {
+	sum := sha256.Sum256(append([]byte("intermesh network key\x00"), pairingKey...))
+	return sum[:]
+}
+
+// distributeGroupKey sends a network's new group key to every member
+func (ma *MeshApp) distributeGroupKey(network *PersonalNetwork) {
+	if network.Owner != ma.Node.ID {
+		return
+	}
+	for _, member := range network.GetAllMembers() {
+		if member.NodeID == ma.Node.ID {
+			continue
+		}
+		if err := ma.sendGroupKey(network, member.NodeID); err != nil {
+			ma.emitEvent(&Event{Type: EventNetworkKeyWithheld, PeerID: member.NodeID,
+				Detail: fmt.Sprintf("%s: %v", network.ID, err)})
+		}
+	}
+}
+
+func (ma *MeshApp) sendGroupKey(network *PersonalNetwork, peerID string) error {
+	epoch, wrapped, sealed, err := ma.wrapGroupKey(network, peerID)
+	if err != nil || wrapped == nil {
+		return err
+	}
+	return ma.Transport.SendMessage(peerID, &Message{
+		Type:      "network_key",
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Payload:   wrapped,
+		Timestamp: time.Now(),
+		Metadata: map[string]string{
+			"network_id": network.ID,
+			"epoch":      strconv.FormatUint(epoch, 10),
+			"sealed":     strconv.FormatBool(sealed),
+			"members":    strings.Join(network.memberIDs(), ","),
+		},
+	})
+}
+
+func (ma *MeshApp) handleNetworkKey(peerID string, msg *Message) {
+	meta := msg.Metadata
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(meta["network_id"])
+	if !ok || network.Owner != peerID || msg.Source != peerID {
+		return
+	}
+	epoch, err := strconv.ParseUint(meta["epoch"], 10, 64)
+	if err != nil {
+		return
+	}
+	ma.installGroupKey(network, epoch, msg.Payload, meta["sealed"] == "true", meta["members"])
+}
+
+// installGroupKey unwraps and installs a group key the network's owner sent us, along
+// with the roster it was issued for so we know whom to seal data for
+func (ma *MeshApp) installGroupKey(network *PersonalNetwork, epoch uint64, wrapped []byte, sealed bool, members string) {
+	key, err := ma.unwrapGroupKey(network.ID, network.Owner, wrapped, sealed)
+	if err != nil {
+		ma.emitEvent(&Event{Type: EventNetworkKeyWithheld, PeerID: network.Owner,
+			Detail: fmt.Sprintf("%s: %v", network.ID, err)})
+		return
+	}
+	if !network.installKey(epoch, key) {
+		return
+	}
+	if members != "" {
+		network.syncMembers(strings.Split(members, ","))
+	}
+	ma.emitEvent(&Event{Type: EventNetworkKeyUpdated, PeerID: network.Owner, Detail: network.ID})
+}
+
+// dataAAD binds a sealed payload to its envelope, so it can't be replayed to another
+// destination or under another network's key
+func dataAAD(msg *Message, networkID, epoch string) []byte {
+	return []byte(msg.Type + "\x00" + msg.Source + "\x00" + msg.Dest + "\x00" + networkID + "\x00" + epoch)
+}
+
+// sealData encrypts the payload of a data message we send to a node we share an
+// encrypted network with
+func (ma *MeshApp) sealData(msg *Message) error {
+	if msg.Type != "data" || msg.Source != ma.Node.ID || msg.Metadata["enc_net"] != "" {
+		return nil
+	}
+	network := ma.PersonalNetworkMgr.sharedKeyedNetwork(ma.Node.ID, msg.Dest)
+	if network == nil {
+		return nil
+	}
+	epoch, key := network.GroupKey()
+	epochStr := strconv.FormatUint(epoch, 10)
+	meta := make(map[string]string, len(msg.Metadata)+2)
+	for k, v := range msg.Metadata {
+		meta[k] = v
+	}
+	meta["enc_net"], meta["enc_epoch"] = network.ID, epochStr
+	sealed, err := seal(key, msg.Payload, dataAAD(msg, network.ID, epochStr))
+	if err != nil {
+		return err
+	}
+	msg.Payload, msg.Metadata = sealed, meta
+	return nil
+}
+
+// openData returns the plaintext payload of a data message addressed to us
+func (ma *MeshApp) openData(msg *Message) ([]byte, error) {
+	networkID := msg.Metadata["enc_net"]
+	if networkID == "" {
+		return msg.Payload, nil
+	}
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(networkID)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown network %s", ErrUndecryptable, networkID)
+	}
+	if !network.includes(msg.Source) {
+		network.mu.RLock()
+		required := network.RequireCerts
+		network.mu.RUnlock()
+		if required {
+			return nil, fmt.Errorf("%w: %s has %v for %s", ErrUndecryptable, msg.Source, ErrNotCertified, networkID)
+		}
+	}
+	epochStr := msg.Metadata["enc_epoch"]
+	epoch, err := strconv.ParseUint(epochStr, 10, 64)
+	key := network.keyForEpoch(epoch)
+	if err != nil || key == nil {
+		return nil, fmt.Errorf("%w: no key for epoch %s of %s", ErrUndecryptable, epochStr, networkID)
+	}
+	payload, err := open(key, msg.Payload, dataAAD(msg, networkID, epochStr))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUndecryptable, err)
+	}
+	return payload, nil
+}
+
+// SendData sends a payload to a node through the mesh, encrypted end to end if we share
+// an encrypted personal network with it
+func (ma *MeshApp) SendData(dest string, payload []byte) error {
+	msg := &Message{
+		Type:      "data",
+		Source:    ma.Node.ID,
+		Dest:      dest,
+		Payload:   payload,
+		Timestamp: time.Now(),
+	}
+	if err := ma.sealData(msg); err != nil {
+		return err
+	}
+	nextHop := dest
+	if route := ma.Router.GetRoute(dest); route != nil && route.NextHop != ma.Node.ID {
+		nextHop = route.NextHop
+	}
+	return ma.Transport.SendMessage(nextHop, msg)
+}
+
+// groupKeyReply adds the current group key to a join response for a new member
+func (ma *MeshApp) groupKeyReply(network *PersonalNetwork, peerID string, reply map[string]string) {
+	epoch, wrapped, sealed, err := ma.wrapGroupKey(network, peerID)
+	if err != nil {
+		ma.emitEvent(&Event{Type: EventNetworkKeyWithheld, PeerID: peerID, Detail: fmt.Sprintf("%s: %v", network.ID, err)})
+		return
+	}
+	if wrapped == nil {
+		return
+	}
+	reply["key"] = base64.StdEncoding.EncodeToString(wrapped)
+	reply["key_epoch"] = strconv.FormatUint(epoch, 10)
+	reply["key_sealed"] = strconv.FormatBool(sealed)
+	reply["members"] = strings.Join(network.memberIDs(), ",")
+}
@@ -0,0 +1,338 @@
+package mesh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A daemon hands over to its successor, a newer binary or the same one restarted by a
+// supervisor, without closing its listening sockets: the successor inherits them as file
+// descriptors in the systemd socket activation layout (LISTEN_FDS from descriptor 3 on,
+// named by LISTEN_FDNAMES), so peers and proxy clients dialing in during the handover
+// queue on the socket instead of being refused. A state snapshot carries what peers would
+// otherwise have to set up again: the peers we were linked with, the clients we
+// authorized with the tokens we issued them, the tokens proxies issued us and the proxy
+// we used. Links themselves are dialed again rather than migrated, since their keys and
+// codec state live in the process that set them up.
+const (
+	HandoffListenerTransport = "transport"
+	HandoffListenerProxy     = "proxy"
+
+	// HandoffStateEnv names the file a predecessor left its state snapshot in
+	HandoffStateEnv = "INTERMESH_HANDOFF_STATE"
+	// HandoffReadyEnv names the descriptor the successor reports readiness on
+	HandoffReadyEnv = "INTERMESH_HANDOFF_READY"
+
+	listenFDsStart = 3
+)
+
+// ErrHandoffMismatch is returned for state snapshots taken by another node
+var ErrHandoffMismatch = errors.New("handoff state belongs to another node")
+
+// HandoffState is the snapshot a node hands its successor
+type HandoffState struct {
+	NodeID      string            `json:"node_id"`
+	SavedAt     time.Time         `json:"saved_at"`
+	Peers       []*DiscoveredPeer `json:"peers,omitempty"`        // Peers we were linked with, dialed again
+	Clients     map[string]string `json:"clients,omitempty"`      // Token issued to each authorized client
+	ProxyTokens map[string]string `json:"proxy_tokens,omitempty"` // Token each proxy issued us
+	Proxy       *HandoffProxy     `json:"proxy,omitempty"`        // Proxy we used for internet access
+	Sharing     bool              `json:"sharing,omitempty"`
+}
+
+// HandoffProxy is where the proxy we used listens
+type HandoffProxy struct {
+	PeerID string `json:"peer_id"`
+	IP     string `json:"ip"`
+	Port   int    `json:"port"`
+}
+
+// HandoffSnapshot captures the state our successor restores with RestoreHandoff
+func (ma *MeshApp) HandoffSnapshot() *HandoffState {
+	state := &HandoffState{
+		NodeID:      ma.Node.ID,
+		SavedAt:     time.Now(),
+		Clients:     ma.InternetProxy.issuedTokens(),
+		ProxyTokens: ma.InternetClient.proxyTokens(),
+		Proxy:       ma.InternetClient.proxyEndpoint(),
+		Sharing:     ma.InternetProxy.IsEnabled(),
+	}
+	for _, peerID := range ma.Transport.GetConnectedPeers() {
+		peer, ok := ma.Discovery.GetPeer(peerID)
+		if !ok {
+			ma.mu.RLock()
+			peer, ok = ma.staticPeers[peerID]
+			ma.mu.RUnlock()
+		}
+		if ok {
+			state.Peers = append(state.Peers, peer)
+		}
+	}
+	return state
+}
+
+// RestoreHandoff takes up the state our predecessor left, once the app has started:
+// clients keep their tokens, we use the same proxy, and peers are dialed again
+func (ma *MeshApp) RestoreHandoff(state *HandoffState) error {
+	if state.NodeID != ma.Node.ID {
+		return fmt.Errorf("%w: %s", ErrHandoffMismatch, state.NodeID)
+	}
+	for peerID, token := range state.Clients {
+		ma.InternetProxy.restoreClient(peerID, token)
+	}
+	for proxyPeerID, token := range state.ProxyTokens {
+		ma.InternetClient.SetProxyToken(proxyPeerID, token)
+	}
+	if state.Sharing && !ma.InternetProxy.IsEnabled() {
+		ma.EnableInternetSharing()
+	}
+	if proxy := state.Proxy; proxy != nil {
+		if err := ma.InternetClient.ConnectToProxy(proxy.PeerID, proxy.IP, proxy.Port); err != nil {
+			return err
+		}
+	}
+	go func() {
+		for _, peer := range state.Peers {
+			ma.dialPeer(peer.ID, peer.IP, peer.Port)
+		}
+	}()
+	return nil
+}
+
+// StopForHandoff stops the app for a successor that took over our listeners, without
+// telling discovered peers we are leaving
+func (ma *MeshApp) StopForHandoff() {
+	ma.stop(false)
+}
+
+// AdoptListeners makes the app serve on listeners inherited from its predecessor, by
+// name, instead of binding its ports; call it before Start
+func (ma *MeshApp) AdoptListeners(listeners map[string]net.Listener) {
+	for name, listener := range listeners {
+		switch name {
+		case HandoffListenerTransport:
+			ma.Transport.SetListener(listener)
+		case HandoffListenerProxy:
+			ma.InternetProxy.SetListener(listener)
+		default:
+			listener.Close()
+		}
+	}
+}
+
+// HandoffListeners returns the names of our listening sockets and duplicates of their
+// descriptors, to pass to a successor in that order
+func (ma *MeshApp) HandoffListeners() ([]string, []*os.File, error) {
+	var names []string
+	var files []*os.File
+	for _, entry := range []struct {
+		name     string
+		listener net.Listener
+	}{
+		{HandoffListenerTransport, ma.Transport.currentListener()},
+		{HandoffListenerProxy, ma.InternetProxy.currentListener()},
+	} {
+		if entry.listener == nil {
+			continue
+		}
+		file, err := listenerFile(entry.listener)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to hand over the %s listener: %w", entry.name, err)
+		}
+		names = append(names, entry.name)
+		files = append(files, file)
+	}
+	return names, files, nil
+}
+
+// HandoffEnv returns the environment telling a successor which inherited descriptors
+// are which listeners, for descriptors passed from 3 on in the order of names
+func HandoffEnv(names []string) []string {
+	return []string{
+		"LISTEN_FDS=" + strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES=" + strings.Join(names, ":"),
+	}
+}
+
+// InheritedListeners returns the listeners a predecessor or supervisor passed us, by
+// name; unnamed descriptors are taken as the transport's, then the proxy's. The
+// variables describing them are cleared so processes we start don't inherit them.
+func InheritedListeners() (map[string]net.Listener, error) {
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	pid := os.Getenv("LISTEN_PID")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || count <= 0 || (pid != "" && pid != strconv.Itoa(os.Getpid())) {
+		return nil, nil
+	}
+
+	files := make([]*os.File, count)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), "listener")
+	}
+	return fileListeners(names, files)
+}
+
+// fileListeners turns inherited descriptors into listeners, closing the descriptors
+func fileListeners(names []string, files []*os.File) (map[string]net.Listener, error) {
+	defaults := []string{HandoffListenerTransport, HandoffListenerProxy}
+	listeners := make(map[string]net.Listener, len(files))
+	for i, file := range files {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if name == "" && i < len(defaults) {
+			name = defaults[i]
+		}
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited descriptor %d: %w", listenFDsStart+i, err)
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
+
+// SignalHandoffReady tells the predecessor that started us that we have taken over, so
+// it can stop; it does nothing when no predecessor is waiting
+func SignalHandoffReady() error {
+	fd, err := strconv.Atoi(os.Getenv(HandoffReadyEnv))
+	os.Unsetenv(HandoffReadyEnv)
+	if err != nil {
+		return nil
+	}
+	ready := os.NewFile(uintptr(fd), "handoff-ready")
+	defer ready.Close()
+	_, err = ready.Write([]byte("ready\n"))
+	return err
+}
+
+// SaveHandoffState writes a state snapshot readable only by us, since it holds tokens
+func SaveHandoffState(path string, state *HandoffState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadHandoffState reads a state snapshot written by SaveHandoffState
+func LoadHandoffState(path string) (*HandoffState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state HandoffState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid handoff state: %w", err)
+	}
+	return &state, nil
+}
+
+// listenerFile duplicates a listener's descriptor
+func listenerFile(listener net.Listener) (*os.File, error) {
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T has no descriptor", listener)
+	}
+	return filer.File()
+}
+
+// SetListener makes the next Start serve on l instead of binding the port
+func (t *Transport) SetListener(l net.Listener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.adopted = l
+}
+
+func (t *Transport) currentListener() net.Listener {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.running {
+		return nil
+	}
+	return t.listener
+}
+
+// SetListener makes the next Enable serve on l instead of binding the port
+func (p *InternetProxy) SetListener(l net.Listener) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.adopted = l
+}
+
+func (p *InternetProxy) currentListener() net.Listener {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.listener
+}
+
+// issuedTokens returns the token issued to each authorized client
+func (p *InternetProxy) issuedTokens() map[string]string {
+	p.clientsMu.RLock()
+	defer p.clientsMu.RUnlock()
+	tokens := make(map[string]string, len(p.tokens))
+	for token, peerID := range p.tokens {
+		tokens[peerID] = token
+	}
+	return tokens
+}
+
+// restoreClient authorizes a client again with the token it was issued before
+func (p *InternetProxy) restoreClient(peerID, token string) {
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+	client, exists := p.clients[peerID]
+	if !exists {
+		client = &ProxyClient{PeerID: peerID, Connected: time.Now()}
+		p.clients[peerID] = client
+	}
+	if client.token != "" {
+		delete(p.tokens, client.token)
+	}
+	client.Authorized = true
+	client.token = token
+	p.tokens[token] = peerID
+}
+
+// proxyTokens returns the token each proxy issued us
+func (c *InternetClient) proxyTokens() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tokens := make(map[string]string, len(c.tokens))
+	for proxyPeerID, token := range c.tokens {
+		tokens[proxyPeerID] = token
+	}
+	return tokens
+}
+
+// proxyEndpoint returns where our primary proxy listens, or nil
+func (c *InternetClient) proxyEndpoint() *HandoffProxy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected || len(c.upstreams) == 0 {
+		return nil
+	}
+	up := c.upstreams[0]
+	port, err := strconv.Atoi(up.url.Port())
+	if err != nil {
+		return nil
+	}
+	return &HandoffProxy{PeerID: up.peerID, IP: up.url.Hostname(), Port: port}
+}
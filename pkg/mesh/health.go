@@ -0,0 +1,130 @@
+package mesh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultStatusSocket is where a running node answers local status queries
+var DefaultStatusSocket = filepath.Join(os.TempDir(), "intermesh.sock")
+
+// ErrStatusSocketInUse is returned when another running node answers on the status socket
+var ErrStatusSocketInUse = errors.New("status socket is in use by a running node")
+
+// HealthState describes the state of a component
+type HealthState string
+
+const (
+	HealthOK       HealthState = "ok"
+	HealthDegraded HealthState = "degraded"
+	HealthDown     HealthState = "down"
+	HealthDisabled HealthState = "disabled"
+)
+
+// ComponentHealth is the health of a single MeshApp component
+type ComponentHealth struct {
+	Name   string      `json:"name"`
+	State  HealthState `json:"state"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// HealthReport aggregates the health of all components of a MeshApp
+type HealthReport struct {
+	NodeID            string            `json:"node_id"`
+	Status            HealthState       `json:"status"`
+	Components        []ComponentHealth `json:"components"`
+	LastInternetCheck time.Time         `json:"last_internet_check,omitempty"`
+	LastInternetOK    time.Time         `json:"last_internet_ok,omitempty"`
+	GeneratedAt       time.Time         `json:"generated_at"`
+}
+
+// Component returns the health of a component by name
+func (hr *HealthReport) Component(name string) (*ComponentHealth, bool) {
+	for i := range hr.Components {
+		if hr.Components[i].Name == name {
+			return &hr.Components[i], true
+		}
+	}
+	return nil, false
+}
+
+// JSON returns the machine-readable form of the report
+func (hr *HealthReport) JSON() ([]byte, error) {
+	return json.MarshalIndent(hr, "", "  ")
+}
+
+// ListenStatus opens the local status socket at path, replacing a stale one left by a
+// node that didn't shut down cleanly. Only the owner can connect to it.
+func ListenStatus(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrStatusSocketInUse, path)
+	}
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ServeStatus answers each connection to the listener with our current health report,
+// until the listener is closed
+func (ma *MeshApp) ServeStatus(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		json.NewEncoder(conn).Encode(ma.Health())
+		conn.Close()
+	}
+}
+
+// QueryStatus asks the node serving the status socket at path for its health report
+func QueryStatus(path string, timeout time.Duration) (*HealthReport, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var report HealthReport
+	if err := json.NewDecoder(conn).Decode(&report); err != nil {
+		return nil, fmt.Errorf("invalid status reply: %w", err)
+	}
+	return &report, nil
+}
+
+// add appends a component and folds its state into the overall status
+func (hr *HealthReport) add(name string, state HealthState, reason string) {
+	hr.Components = append(hr.Components, ComponentHealth{Name: name, State: state, Reason: reason})
+	if healthSeverity(state) > healthSeverity(hr.Status) {
+		hr.Status = state
+	}
+}
+
+// healthSeverity orders states for computing the overall status; disabled components don't count
+func healthSeverity(state HealthState) int {
+	switch state {
+	case HealthDown:
+		return 2
+	case HealthDegraded:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,224 @@
+package mesh
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DefaultHibernateAfter is how long a peer may exchange nothing but background
+	// chatter before its connection is closed and it is kept as a dormant peer
+	DefaultHibernateAfter = 2 * time.Minute
+
+	// HibernateCheckInterval is how often connections are checked for idleness
+	HibernateCheckInterval = 30 * time.Second
+
+	// HibernatePresenceInterval is how often a dormant peer is contacted to confirm it
+	// is still around, instead of the usual route updates every few seconds
+	HibernatePresenceInterval = 5 * time.Minute
+
+	// hibernateMaxMissedPresence is how many presence exchanges may fail in a row
+	// before a dormant peer is considered lost
+	hibernateMaxMissedPresence = 3
+)
+
+// backgroundMessageTypes don't count as activity, so they never keep a peer awake
+var backgroundMessageTypes = map[string]bool{
+	"handshake":     true,
+	"route_update":  true,
+	"hibernate":     true,
+	"presence":      true,
+	"link_announce": true,
+	"network_key":   true,
+}
+
+// hibernatedPeer is a peer whose connection was closed for idleness but is still known
+type hibernatedPeer struct {
+	IP           string
+	Port         int
+	Since        time.Time
+	lastPresence time.Time
+	missed       int
+}
+
+// IsPeerHibernated returns whether a peer is dormant: known, but without an open connection
+func (ma *MeshApp) IsPeerHibernated(peerID string) bool {
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	_, ok := ma.hibernated[peerID]
+	return ok
+}
+
+// HibernatedPeers returns the IDs of all dormant peers
+func (ma *MeshApp) HibernatedPeers() []string {
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	peers := make([]string, 0, len(ma.hibernated))
+	for peerID := range ma.hibernated {
+		peers = append(peers, peerID)
+	}
+	return peers
+}
+
+// peerAddr returns where a peer's transport listens, from discovery or the static peer list
+func (ma *MeshApp) peerAddr(peerID string) (string, int, bool) {
+	if peer, ok := ma.Discovery.GetPeer(peerID); ok {
+		return peer.IP, peer.Port, true
+	}
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	if peer, ok := ma.staticPeers[peerID]; ok {
+		return peer.IP, peer.Port, true
+	}
+	return "", 0, false
+}
+
+// hibernatePeer tells an idle peer we are going dormant and closes the connection
+func (ma *MeshApp) hibernatePeer(peerID string) bool {
+	ip, port, ok := ma.peerAddr(peerID)
+	if !ok {
+		// Without an address we couldn't reconnect on demand, so keep the connection
+		return false
+	}
+
+	ma.Transport.SendMessage(peerID, &Message{
+		Type:      "hibernate",
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Timestamp: time.Now(),
+	})
+	ma.Transport.DisconnectPeer(peerID)
+	ma.routeProbes.forget(peerID)
+	ma.markHibernated(peerID, ip, port)
+	return true
+}
+
+func (ma *MeshApp) markHibernated(peerID, ip string, port int) {
+	now := time.Now()
+	ma.mu.Lock()
+	ma.hibernated[peerID] = &hibernatedPeer{IP: ip, Port: port, Since: now, lastPresence: now}
+	ma.mu.Unlock()
+	ma.emitEvent(&Event{Type: EventPeerHibernated, PeerID: peerID})
+}
+
+// wakePeer reconnects to a dormant peer; it is the transport's reconnect handler, so
+// sending to a dormant peer brings it back on demand
+func (ma *MeshApp) wakePeer(peerID string) bool {
+	ma.mu.RLock()
+	peer, ok := ma.hibernated[peerID]
+	ma.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if err := ma.Transport.ConnectToPeer(peerID, peer.IP, peer.Port); err != nil {
+		return false
+	}
+
+	ma.mu.Lock()
+	delete(ma.hibernated, peerID)
+	ma.mu.Unlock()
+	ma.Router.UpdateRoute(peerID, peerID, 1, 10*time.Millisecond)
+	ma.emitEvent(&Event{Type: EventPeerWoke, PeerID: peerID})
+	return true
+}
+
+// forgetHibernated drops a dormant peer's record, e.g. when discovery lost it
+func (ma *MeshApp) forgetHibernated(peerID string) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	delete(ma.hibernated, peerID)
+}
+
+// handleHibernate records a peer that closed an idle connection to us as dormant
+func (ma *MeshApp) handleHibernate(peerID string, msg *Message) {
+	if ip, port, ok := ma.peerAddr(peerID); ok {
+		ma.markHibernated(peerID, ip, port)
+	}
+}
+
+// handlePresence refreshes a dormant peer that checked in
+func (ma *MeshApp) handlePresence(peerID string, msg *Message) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	if peer, ok := ma.hibernated[peerID]; ok {
+		peer.lastPresence = time.Now()
+		peer.missed = 0
+	}
+}
+
+// sendPresence briefly connects to a dormant peer to confirm both sides are still around
+func (ma *MeshApp) sendPresence(peerID string, peer hibernatedPeer) error {
+	if err := ma.Transport.ConnectToPeer(peerID, peer.IP, peer.Port); err != nil {
+		return err
+	}
+	defer ma.Transport.DisconnectPeer(peerID)
+	return ma.Transport.SendMessage(peerID, &Message{
+		Type:      "presence",
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Timestamp: time.Now(),
+	})
+}
+
+func (ma *MeshApp) hibernateLoop(ctx context.Context) {
+	ticker := time.NewTicker(HibernateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ma.checkHibernation(time.Now())
+		}
+	}
+}
+
+// checkHibernation puts idle peers to sleep and runs the low-rate presence exchange
+func (ma *MeshApp) checkHibernation(now time.Time) {
+	after := ma.Config().HibernateAfter
+	if after < 0 {
+		return
+	}
+
+	for _, peerID := range ma.Transport.GetConnectedPeers() {
+		// Our internet upstreams stay connected so proxy authorization isn't lost
+		if ma.InternetClient.UsesProxy(peerID) {
+			continue
+		}
+		if idle, ok := ma.Transport.IdleTime(peerID); ok && idle >= after {
+			ma.hibernatePeer(peerID)
+		}
+	}
+
+	ma.mu.RLock()
+	due := make(map[string]hibernatedPeer)
+	for peerID, peer := range ma.hibernated {
+		if now.Sub(peer.lastPresence) >= HibernatePresenceInterval {
+			due[peerID] = *peer
+		}
+	}
+	ma.mu.RUnlock()
+
+	for peerID, peer := range due {
+		err := ma.sendPresence(peerID, peer)
+
+		ma.mu.Lock()
+		current, ok := ma.hibernated[peerID]
+		lost := false
+		if ok {
+			current.lastPresence = now
+			if err != nil {
+				current.missed++
+				lost = current.missed >= hibernateMaxMissedPresence
+			} else {
+				current.missed = 0
+			}
+		}
+		ma.mu.Unlock()
+
+		if lost {
+			ma.handlePeerLost(peerID)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package mesh
+
+import "sort"
+
+// When nearby devices share no Wi-Fi network, one of them starts a hotspot for the others
+// to join. The devices exchange what they know about themselves and each picks the host
+// with ElectHotspot; as all of them rank the same candidates the same way, they agree
+// without a coordinator. The mobile bindings carry the exchange over BLE.
+
+// HotspotLowBattery is the charge, in percent, below which a device on battery is only
+// elected host when no other device can be
+const HotspotLowBattery = 20
+
+// HotspotCandidate is what a device tells the others when electing a hotspot host
+type HotspotCandidate struct {
+	NodeID      string `json:"id"`
+	CanHost     bool   `json:"can_host"`               // The platform allows it to start a hotspot
+	Hosting     bool   `json:"hosting,omitempty"`      // Its hotspot is already up
+	Battery     int    `json:"battery"`                // Charge in percent, -1 if unknown
+	Charging    bool   `json:"charging,omitempty"`     // Plugged in
+	DataLimited bool   `json:"data_limited,omitempty"` // Its carrier caps or bills hotspot use
+}
+
+// ElectHotspot returns the node ID of the device that should host the hotspot, or "" if
+// none of the candidates can. A device already hosting keeps the role, so late arrivals
+// don't move everyone to another network; otherwise plugged-in devices come first, then
+// devices whose carrier doesn't limit hotspots, then the fullest battery. Devices low on
+// battery come last, and ties go to the lowest node ID.
+func ElectHotspot(candidates []HotspotCandidate) string {
+	var eligible []HotspotCandidate
+	for _, c := range candidates {
+		if c.CanHost && c.NodeID != "" {
+			eligible = append(eligible, c)
+		}
+	}
+	if len(eligible) == 0 {
+		return ""
+	}
+	low := func(c HotspotCandidate) bool {
+		return !c.Charging && c.Battery >= 0 && c.Battery < HotspotLowBattery
+	}
+	sort.Slice(eligible, func(i, j int) bool {
+		a, b := eligible[i], eligible[j]
+		switch {
+		case a.Hosting != b.Hosting:
+			return a.Hosting
+		case low(a) != low(b):
+			return !low(a)
+		case a.Charging != b.Charging:
+			return a.Charging
+		case a.DataLimited != b.DataLimited:
+			return !a.DataLimited
+		case a.Battery != b.Battery:
+			return a.Battery > b.Battery
+		}
+		return a.NodeID < b.NodeID
+	})
+	return eligible[0].NodeID
+}
@@ -0,0 +1,424 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A node identity is an Ed25519 key pair, and the node ID is derived from its public key,
+// so only the key's holder can use the ID. During the transport handshake a node with an
+// identity offers its key and a nonce; the peer answers with its own key, nonce and a
+// signature over both nonces, and the dialer closes the exchange with its signature.
+// Peers whose ID doesn't match their key, or who can't sign for it, are refused. Peers
+// without an identity are let through unproven unless the transport requires proof or
+// they claim a derived or previously proven ID.
+
+const (
+	identityPrefix    = "node-"
+	identityIDBytes   = 10 // Hash bytes in a node ID; 80 bits
+	identityNonceSize = 16
+	identityProofType = "identity_proof"
+	identityContext   = "InterMesh identity v1"
+)
+
+var (
+	// ErrIdentityProof is returned when a peer can't prove it owns its node ID
+	ErrIdentityProof = errors.New("peer failed to prove its node ID")
+	// ErrForgedMessage is returned for messages whose signature doesn't prove their source
+	ErrForgedMessage = errors.New("forged message")
+
+	nodeIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// Identity is the key pair a node ID is derived from
+type Identity struct {
+	PrivateKey ed25519.PrivateKey
+}
+
+// NewIdentity generates a new identity
+func NewIdentity() (*Identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity: %w", err)
+	}
+	return &Identity{PrivateKey: key}, nil
+}
+
+// LoadOrCreateIdentity reads the identity stored at path, creating and storing a new
+// one if the file doesn't exist, so a device keeps its node ID across restarts
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		identity, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if err := identity.Save(path); err != nil {
+			return nil, err
+		}
+		return identity, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("identity file holds no private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity: %w", err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("identity is not an Ed25519 key")
+	}
+	return &Identity{PrivateKey: edKey}, nil
+}
+
+// Save stores the identity at path as a PEM private key, replacing the file atomically
+func (id *Identity) Save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.PrivateKey)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to store identity: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to store identity: %w", err)
+	}
+	return nil
+}
+
+// PublicKey returns the key peers verify the identity with
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// NodeID returns the node ID derived from the identity
+func (id *Identity) NodeID() string {
+	return NodeIDFromKey(id.PublicKey())
+}
+
+// NodeIDFromKey derives the node ID of a public key: "node-" and the base32 of the
+// first bytes of its SHA-256
+func NodeIDFromKey(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return identityPrefix + strings.ToLower(nodeIDEncoding.EncodeToString(sum[:identityIDBytes]))
+}
+
+// NewNodeWithIdentity creates a node whose ID is derived from identity
+func NewNodeWithIdentity(identity *Identity, name, ip, mac string) *Node {
+	node := NewNode(identity.NodeID(), name, ip, mac)
+	node.Identity = identity
+	return node
+}
+
+// NewMeshAppWithIdentity creates a mesh application whose node ID is derived from
+// identity and that proves it to peers in every transport handshake and announcement
+func NewMeshAppWithIdentity(identity *Identity, nodeName, ip, mac string) *MeshApp {
+	ma := NewMeshApp(identity.NodeID(), nodeName, ip, mac)
+	ma.Node.Identity = identity
+	ma.Transport.SetIdentity(identity)
+	ma.Discovery.SetIdentity(identity)
+	return ma
+}
+
+// SetIdentity makes the transport prove its node ID in handshakes; identity must be the
+// one the transport's node ID was derived from
+func (t *Transport) SetIdentity(identity *Identity) error {
+	if identity.NodeID() != t.nodeID {
+		return fmt.Errorf("identity is for %s, not %s", identity.NodeID(), t.nodeID)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.identity = identity
+	return nil
+}
+
+// SetRequireProof makes the transport refuse peers that don't prove their node ID in the
+// handshake, both ones we dial and ones dialing us. Dialing then needs an identity of our own.
+func (t *Transport) SetRequireProof(require bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requireProof = require
+}
+
+func (t *Transport) proofRequired() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.requireProof
+}
+
+func (t *Transport) identitySetup() *Identity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.identity
+}
+
+// PeerProven returns whether a peer proved it owns its node ID on its last handshake
+func (t *Transport) PeerProven(peerID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.proven[peerID]
+}
+
+// setProven records that a peer proved its ID. A proven ID stays proven: its owner
+// proves it on every connection, so an unproven one claiming it is an impostor.
+func (t *Transport) setProven(peerID string, proven bool) {
+	if !proven {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.proven[peerID] = true
+}
+
+// claimsIdentity reports whether a peer ID can only be used by proving it: it is derived
+// from a key, or was proven before
+func (t *Transport) claimsIdentity(peerID string) bool {
+	return derivedNodeID(peerID) || t.PeerProven(peerID)
+}
+
+// derivedNodeID reports whether id has the form of a node ID derived from a key
+func derivedNodeID(id string) bool {
+	encoded, ok := strings.CutPrefix(id, identityPrefix)
+	if !ok || encoded != strings.ToLower(encoded) {
+		return false
+	}
+	raw, err := nodeIDEncoding.DecodeString(strings.ToUpper(encoded))
+	return err == nil && len(raw) == identityIDBytes
+}
+
+// identityTranscript is what each side signs: its role, both node IDs and both nonces
+func identityTranscript(role, initiator, responder string, initiatorNonce, responderNonce []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(identityContext + "\x00" + role + "\x00" + initiator + "\x00" + responder + "\x00")
+	buf.Write(initiatorNonce)
+	buf.Write(responderNonce)
+	return buf.Bytes()
+}
+
+// offer adds the dialer's key and nonce to its handshake, returning the nonce
+func (id *Identity) offer(metadata map[string]string) []byte {
+	nonce := make([]byte, identityNonceSize)
+	rand.Read(nonce)
+	metadata["id_key"] = base64.StdEncoding.EncodeToString(id.PublicKey())
+	metadata["id_nonce"] = base64.StdEncoding.EncodeToString(nonce)
+	return nonce
+}
+
+// checkProof verifies that key derives peerID and signed the transcript
+func checkProof(peerID, key, sig string, transcript []byte) error {
+	pub, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: invalid key", ErrIdentityProof)
+	}
+	if NodeIDFromKey(pub) != peerID {
+		return fmt.Errorf("%w: key belongs to %s", ErrIdentityProof, NodeIDFromKey(pub))
+	}
+	signature, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || !ed25519.Verify(pub, transcript, signature) {
+		return fmt.Errorf("%w: bad signature", ErrIdentityProof)
+	}
+	return nil
+}
+
+// proveDial runs the dialer's side of the identity exchange after its handshake offered
+// nonce; it reports whether the peer proved its ID
+func (t *Transport) proveDial(conn net.Conn, identity *Identity, peerID string, nonce []byte) (bool, error) {
+	conn.SetDeadline(time.Now().Add(t.timeoutPolicy().PeerHandshake))
+	defer conn.SetDeadline(time.Time{})
+
+	reply, _, err := t.readMessage(conn)
+	if err != nil {
+		return false, fmt.Errorf("identity exchange failed: %w", err)
+	}
+	if reply.Type != identityProofType {
+		return false, fmt.Errorf("%w: no identity exchange", ErrIdentityProof)
+	}
+	peerNonce, err := base64.StdEncoding.DecodeString(reply.Metadata["id_nonce"])
+	if err != nil || len(peerNonce) != identityNonceSize {
+		return false, fmt.Errorf("%w: invalid nonce", ErrIdentityProof)
+	}
+
+	proven := false
+	if reply.Metadata["id_key"] != "" {
+		transcript := identityTranscript("responder", t.nodeID, peerID, nonce, peerNonce)
+		if err := checkProof(peerID, reply.Metadata["id_key"], reply.Metadata["id_sig"], transcript); err != nil {
+			return false, err
+		}
+		proven = true
+	}
+
+	transcript := identityTranscript("initiator", t.nodeID, peerID, nonce, peerNonce)
+	final := &Message{
+		Type:     identityProofType,
+		Source:   t.nodeID,
+		Dest:     peerID,
+		Metadata: map[string]string{"id_sig": base64.StdEncoding.EncodeToString(ed25519.Sign(identity.PrivateKey, transcript))},
+	}
+	if err := t.sendMessage(conn, final, false); err != nil {
+		return false, fmt.Errorf("identity exchange failed: %w", err)
+	}
+	return proven, nil
+}
+
+// proveAccept runs the accepting side of the identity exchange for a handshake msg; a
+// dialer that offered no key is let through unproven
+func (t *Transport) proveAccept(conn net.Conn, msg *Message) (bool, error) {
+	if msg.Metadata["id_key"] == "" {
+		return false, nil
+	}
+	peerNonce, err := base64.StdEncoding.DecodeString(msg.Metadata["id_nonce"])
+	if err != nil || len(peerNonce) != identityNonceSize {
+		return false, fmt.Errorf("%w: invalid nonce", ErrIdentityProof)
+	}
+
+	conn.SetDeadline(time.Now().Add(t.timeoutPolicy().PeerHandshake))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, identityNonceSize)
+	rand.Read(nonce)
+	reply := &Message{
+		Type:     identityProofType,
+		Source:   t.nodeID,
+		Dest:     msg.Source,
+		Metadata: map[string]string{"id_nonce": base64.StdEncoding.EncodeToString(nonce)},
+	}
+	if identity := t.identitySetup(); identity != nil {
+		transcript := identityTranscript("responder", msg.Source, t.nodeID, peerNonce, nonce)
+		reply.Metadata["id_key"] = base64.StdEncoding.EncodeToString(identity.PublicKey())
+		reply.Metadata["id_sig"] = base64.StdEncoding.EncodeToString(ed25519.Sign(identity.PrivateKey, transcript))
+	}
+	if err := t.sendMessage(conn, reply, false); err != nil {
+		return false, fmt.Errorf("identity exchange failed: %w", err)
+	}
+
+	final, _, err := t.readMessage(conn)
+	if err != nil {
+		return false, fmt.Errorf("identity exchange failed: %w", err)
+	}
+	if final.Type != identityProofType {
+		return false, fmt.Errorf("%w: no identity exchange", ErrIdentityProof)
+	}
+	transcript := identityTranscript("initiator", msg.Source, t.nodeID, peerNonce, nonce)
+	if err := checkProof(msg.Source, msg.Metadata["id_key"], final.Metadata["id_sig"], transcript); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sign returns a copy of msg signed by the identity. The signature covers everything
+// but the hop limit and trace context, which relays rewrite.
+func (id *Identity) sign(msg *Message) *Message {
+	signed := *msg
+	signed.Signer = id.PublicKey()
+	signed.Signature = ed25519.Sign(id.PrivateKey, messageSigningBytes(msg))
+	return &signed
+}
+
+// messageSigningBytes encodes the signed fields of a message unambiguously
+func messageSigningBytes(msg *Message) []byte {
+	var buf bytes.Buffer
+	field := func(data []byte) {
+		binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+		buf.Write(data)
+	}
+	field([]byte(identityContext + " message"))
+	field([]byte(msg.Type))
+	field([]byte(msg.Source))
+	field([]byte(msg.Dest))
+	field(msg.Payload)
+	for _, hop := range msg.Route {
+		field([]byte(hop))
+	}
+	binary.Write(&buf, binary.BigEndian, msg.Timestamp.Unix())
+	binary.Write(&buf, binary.BigEndian, int32(msg.Timestamp.Nanosecond()))
+	if msg.Seq != 0 {
+		binary.Write(&buf, binary.BigEndian, msg.Seq) // Left out when unset, as older nodes sign
+	}
+	if msg.Boot != 0 {
+		field(binary.BigEndian.AppendUint64(nil, msg.Boot)) // A field, so it can't pass for metadata
+	}
+	keys := make([]string, 0, len(msg.Metadata))
+	for key := range msg.Metadata {
+		if key != TraceparentKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field([]byte(key))
+		field([]byte(msg.Metadata[key]))
+	}
+	return buf.Bytes()
+}
+
+// verifySignature checks a received message's signature. Unsigned messages are accepted
+// unless their source claims an identity, since such nodes sign everything they send.
+func (t *Transport) verifySignature(msg *Message) error {
+	if len(msg.Signature) == 0 {
+		if t.claimsIdentity(msg.Source) {
+			return fmt.Errorf("%w: unsigned message from %s", ErrForgedMessage, msg.Source)
+		}
+		return nil
+	}
+	if len(msg.Signer) != ed25519.PublicKeySize || NodeIDFromKey(msg.Signer) != msg.Source {
+		return fmt.Errorf("%w: signer is not %s", ErrForgedMessage, msg.Source)
+	}
+	if !ed25519.Verify(msg.Signer, messageSigningBytes(msg), msg.Signature) {
+		return fmt.Errorf("%w: bad signature from %s", ErrForgedMessage, msg.Source)
+	}
+	return nil
+}
+
+// SetSignatureFailureHandler sets a callback for received messages dropped as forged
+func (t *Transport) SetSignatureFailureHandler(handler func(peerID string, msg *Message, err error)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onForged = handler
+}
+
+// SetHandshakeFailureHandler sets a callback for peers we dialed that failed to prove
+// themselves in the TLS, Noise or identity handshake. Incoming connections aren't
+// reported: the node ID they claim isn't proven, so blaming it would let anyone smear a peer.
+func (t *Transport) SetHandshakeFailureHandler(handler func(peerID string, err error)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onHandshake = handler
+}
+
+// handshakeFailed reports a peer we dialed that failed to prove itself
+func (t *Transport) handshakeFailed(peerID string, err error) {
+	t.mu.Lock()
+	handler := t.onHandshake
+	t.mu.Unlock()
+	if handler != nil {
+		handler(peerID, err)
+	}
+}
+
+func (t *Transport) signatureFailureHandler() func(peerID string, msg *Message, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.onForged
+}
@@ -0,0 +1,50 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// IDs for tunnels, requests and networks are 128 random bits rather than timestamps, so
+// they stay unique under load and across devices whose clocks disagree. Sortable IDs
+// spend the first 48 of those bits on the creation time in milliseconds, so they order
+// by age while keeping 80 random bits to tell apart IDs made in the same millisecond.
+
+// IDLength is the length of the hex strings NewID and NewSortableID return
+const IDLength = 32
+
+// NewID returns a random 128-bit ID as hex
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewSortableID returns a 128-bit ID as hex that sorts by creation time
+func NewSortableID() string {
+	return sortableID(time.Now())
+}
+
+func sortableID(t time.Time) string {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixMilli())<<16)
+	rand.Read(b[6:])
+	return hex.EncodeToString(b)
+}
+
+// SortableIDTime returns when a sortable ID was made, to the millisecond
+func SortableIDTime(id string) (time.Time, bool) {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 16 {
+		return time.Time{}, false
+	}
+	ms := binary.BigEndian.Uint64(b[:8]) >> 16
+	return time.UnixMilli(int64(ms)), true
+}
+
+// NewNetworkID returns an ID for a new personal network
+func NewNetworkID() string {
+	return "pnet-" + NewID()
+}
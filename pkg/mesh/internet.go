@@ -2,11 +2,17 @@ package mesh
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,18 +23,51 @@ type InternetProxy struct {
 	proxyServer *http.Server
 	port        int
 	clients     map[string]*ProxyClient
+	tokens      map[string]string         // Issued token to the client holding it
+	requests    map[string]*AccessRequest // Pending access requests from the access page
 	clientsMu   sync.RWMutex
 	transport   *Transport
+	authPaused  bool
+	policy      *PolicyEngine
+	filter      *ContentFilter
+	audit       *Auditor
+	traces      *TraceLog
+	tracer      *Tracer
+	limits      ProxyLimits
+	guard       *ExitGuard
+	abuse       *AbuseScorer
+	acl         *ProxyACL
+	scope       *SharingTerms // Destinations we offer, if scoped
+	quota       ProxyQuota
+	onQuota     func(peerID, limit, action string)
+	saver       []string // Data saver transformations we offer
+	privacy     string   // How relayed requests are rewritten to protect clients; see privacy.go
+	requireAuth bool
+	onRequest   func(req AccessRequest)
+	relayed     atomic.Int64 // Bytes carried for clients since start
+	history     *trafficHistory
+	secrets     func(peerID string) ([]byte, bool) // Secret shared with a client, to key its sessions from
+	usage       *UsageLog                          // What clients used the connection for, if the sharer opted in
+	tunnels     *TunnelTable
+	listener    net.Listener // Bound while enabled, before sessions and limits wrap it
+	adopted     net.Listener // Listener the next Enable serves on instead of binding the port
 	mu          sync.Mutex
 }
 
 // ProxyClient represents a client using our internet
 type ProxyClient struct {
-	PeerID     string
-	Authorized bool
-	BytesSent  uint64
-	BytesRecv  uint64
-	Connected  time.Time
+	PeerID      string
+	Authorized  bool
+	BytesSent   uint64
+	BytesRecv   uint64
+	Connected   time.Time
+	RateLimited uint64 // Requests refused for exceeding the client's request limits
+	day         int    // Day dayBytes were counted on, see quotaDay
+	dayBytes    uint64
+	token       string
+	tokens      float64 // Request rate budget
+	lastRequest time.Time
+	inFlight    int
 }
 
 // InternetClient handles connecting through a proxy for internet access
@@ -37,6 +76,15 @@ type InternetClient struct {
 	proxyPeerID string
 	proxyAddr   string
 	client      *http.Client
+	upstreams   []*upstreamProxy  // Primary proxy first, then bonded ones
+	standby     *upstreamProxy    // Authorized proxy kept idle to take over from the primary
+	samples     pathSamples       // Outcome of recent requests, for grading the connection
+	tokens      map[string]string // Token each proxy issued us
+	saver       string            // Data saver transformations we ask for, comma-separated
+	trust       *TrustTracker     // Credited and blamed with how our proxies carry requests
+	onAuth      func(proxyPeerID string)
+	sessions    func(proxyPeerID string) *ProxySession // Keys our connections to a proxy, if we can
+	timeouts    Timeouts
 	connected   bool
 	mu          sync.Mutex
 }
@@ -45,16 +93,85 @@ const (
 	ProxyPort = 9997
 )
 
+// internetProbeServers are well-known servers used to check and measure connectivity
+var internetProbeServers = []string{
+	"8.8.8.8:53",        // Google DNS
+	"1.1.1.1:53",        // Cloudflare DNS
+	"208.67.222.222:53", // OpenDNS
+}
+
 // NewInternetProxy creates a new internet proxy
 func NewInternetProxy(nodeID string, transport *Transport) *InternetProxy {
 	return &InternetProxy{
 		nodeID:    nodeID,
 		port:      ProxyPort,
 		clients:   make(map[string]*ProxyClient),
+		tokens:    make(map[string]string),
+		history:   newTrafficHistory(DefaultTrafficHistory),
 		transport: transport,
+		limits:    DefaultProxyLimits(),
+		requests:  make(map[string]*AccessRequest),
+		tunnels:   NewTunnelTable(),
 	}
 }
 
+// SetLimits sets connection timeouts and caps; caps and the header timeout take effect
+// the next time sharing is enabled
+func (p *InternetProxy) SetLimits(limits ProxyLimits) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limits = limits
+}
+
+// SetExitGuard refuses destinations on the sharer's own networks
+func (p *InternetProxy) SetExitGuard(guard *ExitGuard) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.guard = guard
+}
+
+// SetAbuseScorer demotes and bans clients that misbehave
+func (p *InternetProxy) SetAbuseScorer(abuse *AbuseScorer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.abuse = abuse
+}
+
+// SetACL restricts which clients may use our internet; nil admits every authorized client
+func (p *InternetProxy) SetACL(acl *ProxyACL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.acl = acl
+}
+
+// SetSessionSecrets accepts session connections from clients that share a secret with us;
+// it takes effect the next time sharing is enabled
+func (p *InternetProxy) SetSessionSecrets(secrets func(peerID string) ([]byte, bool)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.secrets = secrets
+}
+
+// SetScope limits the destinations served to those the terms cover; nil serves any
+func (p *InternetProxy) SetScope(terms *SharingTerms) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scope = terms
+}
+
+func (p *InternetProxy) exitGuard() *ExitGuard {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.guard
+}
+
+// Limits returns the connection timeouts and caps
+func (p *InternetProxy) Limits() ProxyLimits {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limits
+}
+
 // Enable enables internet sharing
 func (p *InternetProxy) Enable() error {
 	p.mu.Lock()
@@ -68,20 +185,39 @@ func (p *InternetProxy) Enable() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", p.handleProxy)
 
-	p.proxyServer = &http.Server{
-		Addr:         fmt.Sprintf(":%d", p.port),
-		Handler:      mux,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", p.port),
+		Handler:           mux,
+		ReadHeaderTimeout: p.limits.HeaderTimeout,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       p.limits.IdleTimeout,
 	}
+	p.proxyServer = server
+	limits := p.limits
+	secrets := p.secrets
+	adopted := p.adopted
+	p.adopted = nil
 
 	p.enabled = true
 
 	// Start server in background
 	go func() {
-		// Note: ListenAndServe blocks, so we run it in a goroutine
+		// Note: Serve blocks, so we run it in a goroutine
 		// It returns ErrServerClosed when Shutdown is called
-		if err := p.proxyServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		listener, err := adopted, error(nil)
+		if listener == nil {
+			listener, err = net.Listen("tcp", server.Addr)
+		}
+		if err == nil {
+			p.mu.Lock()
+			if p.proxyServer == server {
+				p.listener = listener
+			}
+			p.mu.Unlock()
+			err = server.Serve(newLimitListener(newSessionListener(listener, p.nodeID, secrets), limits))
+		}
+		if err != nil && err != http.ErrServerClosed {
 			// In production, log this error
 			p.mu.Lock()
 			p.enabled = false
@@ -110,6 +246,7 @@ func (p *InternetProxy) Disable() error {
 		p.proxyServer.Shutdown(ctx)
 		p.proxyServer = nil
 	}
+	p.listener = nil
 
 	p.enabled = false
 	return nil
@@ -122,29 +259,143 @@ func (p *InternetProxy) IsEnabled() bool {
 	return p.enabled
 }
 
-// AuthorizeClient authorizes a peer to use our internet
-func (p *InternetProxy) AuthorizeClient(peerID string) {
-	p.clientsMu.Lock()
-	defer p.clientsMu.Unlock()
+// PauseAuthorizations stops or resumes accepting new clients without dropping existing ones
+func (p *InternetProxy) PauseAuthorizations(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.authPaused = paused
+}
+
+// AuthorizationsPaused returns whether new client authorizations are paused
+func (p *InternetProxy) AuthorizationsPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.authPaused
+}
+
+// SetPolicyEngine enforces network policies (such as blocklists) on proxied traffic
+func (p *InternetProxy) SetPolicyEngine(policy *PolicyEngine) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policy = policy
+}
+
+// SetContentFilter enforces a content filter on proxied traffic; nil disables filtering
+func (p *InternetProxy) SetContentFilter(filter *ContentFilter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filter = filter
+}
+
+// SetAuditor records authorization changes and blocked requests to an audit stream
+func (p *InternetProxy) SetAuditor(audit *Auditor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.audit = audit
+}
+
+// SetTraceLog records the exit hop of traced requests
+func (p *InternetProxy) SetTraceLog(traces *TraceLog) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.traces = traces
+}
+
+// SetTracer records a span for every proxied request
+func (p *InternetProxy) SetTracer(tracer *Tracer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tracer = tracer
+}
+
+// SetUsageLog records every client request's destination and bytes; nil stops recording
+func (p *InternetProxy) SetUsageLog(usage *UsageLog) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.usage = usage
+}
+
+// UsageLog returns the usage log requests are recorded to, or nil
+func (p *InternetProxy) UsageLog() *UsageLog {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.usage
+}
+
+func (p *InternetProxy) auditor() *Auditor {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.audit
+}
+
+// ContentFilter returns the active content filter, or nil
+func (p *InternetProxy) ContentFilter() *ContentFilter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.filter
+}
+
+// RelayedBytes returns how many bytes the proxy has carried for all clients
+func (p *InternetProxy) RelayedBytes() int64 {
+	return p.relayed.Load()
+}
+
+// ClientUsage returns the bytes a client has transferred through the proxy
+func (p *InternetProxy) ClientUsage(peerID string) uint64 {
+	p.clientsMu.RLock()
+	defer p.clientsMu.RUnlock()
+	if client, exists := p.clients[peerID]; exists {
+		return client.BytesSent + client.BytesRecv
+	}
+	return 0
+}
 
+// RateLimitViolations returns how many of a client's requests were refused for exceeding
+// its request rate or concurrent request limit
+func (p *InternetProxy) RateLimitViolations(peerID string) uint64 {
+	p.clientsMu.RLock()
+	defer p.clientsMu.RUnlock()
 	if client, exists := p.clients[peerID]; exists {
-		client.Authorized = true
-	} else {
-		p.clients[peerID] = &ProxyClient{
-			PeerID:     peerID,
-			Authorized: true,
-			Connected:  time.Now(),
-		}
+		return client.RateLimited
+	}
+	return 0
+}
+
+// AuthorizeClient authorizes a peer to use our internet and returns the token it must
+// present with its requests; a peer authorized again keeps its token
+func (p *InternetProxy) AuthorizeClient(peerID string) string {
+	p.clientsMu.Lock()
+	client, exists := p.clients[peerID]
+	if !exists {
+		client = &ProxyClient{PeerID: peerID, Connected: time.Now()}
+		p.clients[peerID] = client
+	}
+	client.Authorized = true
+	if client.token == "" {
+		client.token = NewID()
+		p.tokens[client.token] = peerID
 	}
+	token := client.token
+	delete(p.requests, peerID)
+	p.clientsMu.Unlock()
+
+	p.auditor().Record(AuditPeerAuthorized, peerID, "")
+	return token
 }
 
 // RevokeClient revokes a peer's internet access
 func (p *InternetProxy) RevokeClient(peerID string) {
 	p.clientsMu.Lock()
-	defer p.clientsMu.Unlock()
-
-	if client, exists := p.clients[peerID]; exists {
+	client, exists := p.clients[peerID]
+	if exists {
 		client.Authorized = false
+		delete(p.tokens, client.token)
+		client.token = ""
+	}
+	p.clientsMu.Unlock()
+
+	if exists {
+		p.auditor().Record(AuditPeerRevoked, peerID, "")
 	}
 }
 
@@ -162,23 +413,200 @@ func (p *InternetProxy) GetClients() []*ProxyClient {
 
 // handleProxy handles HTTP proxy requests
 func (p *InternetProxy) handleProxy(w http.ResponseWriter, r *http.Request) {
-	// Extract peer ID from headers or connection
-	// For now, we'll accept all requests if proxy is enabled
+	p.mu.Lock()
+	policy := p.policy
+	filter := p.filter
+	audit := p.audit
+	traces := p.traces
+	tracer := p.tracer
+	guard := p.guard
+	abuse := p.abuse
+	acl := p.acl
+	scope := p.scope
+	requireAuth := p.requireAuth
+	usage := p.usage
+	p.mu.Unlock()
+
+	// Continue the relay chain's trace, or start one for requests from plain clients
+	traceID := r.Header.Get(TraceHeader)
+	if traceID == "" {
+		traceID = NewTraceID()
+	}
+	r.Header.Del(TraceHeader)
+	span := traces.Start(traceID, TraceHopExit, r.Host)
+	tw := &traceStatusWriter{ResponseWriter: w}
+	w = tw
+	w.Header().Set(TraceHeader, traceID)
+
+	parent, _ := ParseTraceparent(r.Header.Get(TraceparentKey))
+	r.Header.Del(TraceparentKey)
+	otelSpan := tracer.Start(parent, "proxy "+r.Method, SpanKindServer)
+	otelSpan.SetAttribute("http.request.method", r.Method)
+	otelSpan.SetAttribute("server.address", r.Host)
+	otelSpan.SetAttribute("intermesh.trace_id", traceID)
+	defer func() {
+		span.End(tw.status, "")
+		otelSpan.SetAttribute("http.response.status_code", strconv.Itoa(tw.status))
+		otelSpan.End()
+	}()
+
+	presented := proxyTokenFrom(r) != ""
+	client, authorized := p.authenticate(r)
+	if ok, standing := abuse.Allow(client, time.Now()); !ok {
+		if standing == StandingBanned {
+			http.Error(w, "Temporarily banned for abuse", http.StatusForbidden)
+		} else {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		}
+		return
+	}
+
+	if isPortalRequest(r) {
+		p.servePortal(w, r, client)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		target, err := ConnectTarget(r.Host, "443")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Host = target
+	}
+	if !authorized {
+		// Guessing or replaying tokens counts against the client; plain devices asking
+		// for access from the access page when approval is on doesn't
+		if presented {
+			abuse.Record(client, OffenseAuthFailure, time.Now())
+		}
+		if requireAuth && !presented {
+			refuseUnauthorized(w, r)
+		} else {
+			refuseUnauthenticated(w)
+		}
+		return
+	}
+	if !acl.Permitted(client) {
+		audit.Record(AuditProxyACLDenied, client, r.Host)
+		http.Error(w, "Not permitted by the sharer's access list", http.StatusForbidden)
+		return
+	}
+
+	// One greedy client mustn't starve the others
+	release, retryAfter, admitted := p.admitRequest(client, time.Now())
+	if !admitted {
+		abuse.Record(client, OffenseRateLimited, time.Now())
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	// Keep what was requested and how it ended, for dry runs of policy changes
+	record := trafficRecord{At: time.Now(), Client: client, Host: normalizeHost(r.Host)}
+	var sent, received int64
+	defer func() {
+		p.history.add(record)
+		usage.Record(UsageRecord{
+			Time:          record.At,
+			Client:        client,
+			Method:        r.Method,
+			Host:          record.Host,
+			BytesSent:     sent,
+			BytesReceived: received,
+			Status:        tw.status,
+			Refused:       record.Refused,
+			DurationMs:    time.Since(record.At).Milliseconds(),
+		})
+	}()
+
+	// Clients over their quota are cut off, or served slowly if the quota throttles
+	if limit := p.OverQuota(client); limit != "" && p.Quota().Action != QuotaThrottle {
+		record.Refused = RefusedQuota
+		p.RevokeClient(client)
+		http.Error(w, fmt.Sprintf("Data quota used up (%s)", limit), http.StatusForbidden)
+		return
+	}
+	throttle := p.throttleRate(client)
+
+	// A scoped offer serves its destinations only; not the client's fault, so not an offense
+	if !scope.Serves(r.Host) {
+		record.Refused = RefusedOutOfScope
+		http.Error(w, "Not offered by this sharer, who only serves: "+strings.Join(scope.Destinations, ", "),
+			http.StatusForbidden)
+		return
+	}
+
+	if policy != nil && policy.IsBlocked(r.Host) {
+		record.Refused = RefusedBlocklist
+		abuse.Record(client, OffenseBlockedDestination, time.Now())
+		audit.Record(AuditBlocklistHit, clientFor(r), r.Host)
+		http.Error(w, "Blocked by network policy", http.StatusForbidden)
+		return
+	}
+
+	// Members of a personal network may be filtered by its own rules, or not at all
+	if filter := filter.ForClient(client); filter != nil {
+		if category := filter.BlockedCategory(r.Host); category != "" {
+			record.Refused = RefusedContentFilter
+			abuse.Record(client, OffenseBlockedDestination, time.Now())
+			audit.Record(AuditBlocklistHit, clientFor(r), fmt.Sprintf("%s (%s)", r.Host, category))
+			http.Error(w, fmt.Sprintf("Blocked by content filter (%s)", category), http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodConnect {
+			// Resolve search engines to their SafeSearch endpoints, as DNS-based enforcement would
+			if safe, ok := filter.SafeSearchHost(r.Host); ok {
+				_, port, err := net.SplitHostPort(r.Host)
+				if err != nil {
+					port = "443"
+				}
+				r.Host = net.JoinHostPort(safe, port)
+			}
+		} else {
+			filter.EnforceSafeSearch(r.URL)
+		}
+	}
+	r.Header.Del(ClientNodeHeader)
+
+	saving := p.dataSaving(r)
+	if slices.Contains(saving, SaveTrackers) && isTrackerHost(r.Host) {
+		record.Refused = RefusedDataSaver
+		http.Error(w, "Blocked by data saver: tracker or ad host", http.StatusForbidden)
+		return
+	}
+
+	if err := guard.CheckHost(r.Host); err != nil {
+		record.Refused = RefusedExitGuard
+		abuse.Record(client, OffenseBlockedDestination, time.Now())
+		audit.Record(AuditBlocklistHit, clientFor(r), r.Host)
+		http.Error(w, "Destination not allowed: private network", http.StatusForbidden)
+		return
+	}
 
 	if r.Method == http.MethodConnect {
-		p.handleConnect(w, r)
+		sent, received = p.handleConnect(w, r, client, abuse, throttle)
 	} else {
-		p.handleHTTP(w, r)
+		sent, received = p.handleHTTP(w, r, client, abuse, throttle, saving)
 	}
+	record.Bytes = sent + received
+	p.addUsage(client, sent, received, time.Now())
 }
 
-// handleConnect handles HTTPS CONNECT method
-func (p *InternetProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
-	// Establish connection to destination
-	destConn, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+// handleConnect handles HTTPS CONNECT method, returning the bytes the client sent and
+// received; throttle, if not 0, holds the tunnel to that many bytes per second
+func (p *InternetProxy) handleConnect(w http.ResponseWriter, r *http.Request, client string, abuse *AbuseScorer, throttle int64) (int64, int64) {
+	// Establish connection to destination, racing its addresses
+	destConn, err := dialHappyEyeballs(r.Context(), r.Host, p.exitGuard())
+	if errors.Is(err, ErrDestinationBlocked) {
+		abuse.Record(client, OffenseBlockedDestination, time.Now())
+		http.Error(w, "Destination not allowed: private network", http.StatusForbidden)
+		return 0, 0
+	}
 	if err != nil {
+		abuse.Record(client, OffenseUpstreamError, time.Now())
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
+		return 0, 0
 	}
 	defer destConn.Close()
 
@@ -186,51 +614,85 @@ func (p *InternetProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-		return
+		return 0, 0
 	}
 
 	clientConn, _, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
+		return 0, 0
 	}
 	defer clientConn.Close()
 
+	// The server's request deadlines would cut long tunnels short; the tunnel has its own
+	clientConn.SetDeadline(time.Time{})
+
 	// Send 200 Connection Established
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
-	// Bidirectional copy
-	go io.Copy(destConn, clientConn)
-	io.Copy(clientConn, destConn)
+	// Bidirectional copy until either side closes or the tunnel times out
+	var tunnelConn net.Conn = clientConn
+	if throttle > 0 {
+		tunnelConn = &pacedConn{Conn: clientConn, pacer: &pacer{rate: throttle}}
+	}
+	limits := p.Limits()
+	tunnel := p.tunnels.Open(client, r.Host)
+	defer p.tunnels.Close(tunnel)
+	sent, received := pipeTunnel(tunnelConn, destConn, limits.IdleTimeout, limits.TunnelTimeout, tunnel)
+	abuse.RecordBytes(client, sent+received, time.Now())
+	p.relayed.Add(sent + received)
+	return sent, received
 }
 
-// handleHTTP handles regular HTTP requests
-func (p *InternetProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	// Create new request to destination
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// handleHTTP handles regular HTTP requests, returning the bytes the client sent and
+// received; throttle, if not 0, holds the response to that many bytes per second, and
+// saving lists the data saver transformations to apply
+func (p *InternetProxy) handleHTTP(w http.ResponseWriter, r *http.Request, client string, abuse *AbuseScorer, throttle int64, saving []string) (int64, int64) {
+	// Create new request to destination, never connecting to the sharer's own networks
+	httpClient := &http.Client{
+		Transport: p.exitGuard().RoundTripper(),
+		Timeout:   30 * time.Second,
 	}
 
-	req, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
+	// Count what the client uploads; bodies of unknown length stay chunked
+	body := &countingReader{ReadCloser: r.Body}
+	var upload io.Reader = body
+	if r.ContentLength == 0 {
+		upload = http.NoBody
+	}
+	// Tie the upstream request to the client so an aborted relay stops the download
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), upload)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return 0, 0
 	}
+	req.ContentLength = r.ContentLength
 
-	// Copy headers
+	// Copy headers, leaving out what identifies the client if we protect it
 	for key, values := range r.Header {
 		for _, value := range values {
 			req.Header.Add(key, value)
 		}
 	}
+	ApplyPrivacy(req.Header, p.PrivacyMode())
 
 	// Forward request
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
+	if errors.Is(err, ErrDestinationBlocked) {
+		abuse.Record(client, OffenseBlockedDestination, time.Now())
+		http.Error(w, "Destination not allowed: private network", http.StatusForbidden)
+		return 0, 0
+	}
 	if err != nil {
+		if r.Context().Err() == nil {
+			abuse.Record(client, OffenseUpstreamError, time.Now())
+		}
 		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+		return 0, 0
 	}
 	defer resp.Body.Close()
+	saved := saveResponse(resp, saving, strings.Contains(r.Header.Get("Accept-Encoding"), "gzip"))
+	defer saved.Close()
 
 	// Copy response headers
 	for key, values := range resp.Header {
@@ -241,13 +703,21 @@ func (p *InternetProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Copy status code and body
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	var out io.Writer = w
+	if throttle > 0 {
+		out = &pacedWriter{w: w, pacer: &pacer{rate: throttle}}
+	}
+	n, _ := io.Copy(out, saved)
+	abuse.RecordBytes(client, body.n+n, time.Now())
+	p.relayed.Add(body.n + n)
+	return body.n, n
 }
 
 // NewInternetClient creates a new internet client
 func NewInternetClient(nodeID string) *InternetClient {
 	return &InternetClient{
-		nodeID: nodeID,
+		nodeID:   nodeID,
+		timeouts: DefaultTimeouts(),
 	}
 }
 
@@ -257,21 +727,21 @@ func (c *InternetClient) ConnectToProxy(proxyPeerID, proxyIP string, port int) e
 	defer c.mu.Unlock()
 
 	c.proxyPeerID = proxyPeerID
-	c.proxyAddr = fmt.Sprintf("http://%s:%d", proxyIP, port)
-
-	// Create HTTP client configured to use proxy
-	proxyURL, err := http.ProxyFromEnvironment(&http.Request{})
-	if err == nil && proxyURL != nil {
-		c.client = &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyURL(proxyURL),
-			},
-			Timeout: 30 * time.Second,
-		}
-	} else {
-		c.client = &http.Client{
-			Timeout: 30 * time.Second,
-		}
+	c.proxyAddr = proxyURL(proxyIP, port)
+
+	// Create HTTP client that schedules requests onto the peer's proxy and any bonded ones
+	up, err := newUpstreamProxy(proxyPeerID, proxyIP, port)
+	if err != nil {
+		return err
+	}
+	up.session = c.sessionLocked(proxyPeerID)
+	c.closeIdleLocked()
+	c.upstreams = []*upstreamProxy{up}
+	c.standby = nil
+	c.samples.reset()
+	c.client = &http.Client{
+		Transport: newBondedTransport(c),
+		Timeout:   30 * time.Second,
 	}
 
 	c.connected = true
@@ -286,9 +756,19 @@ func (c *InternetClient) Disconnect() {
 	c.connected = false
 	c.proxyPeerID = ""
 	c.proxyAddr = ""
+	c.closeIdleLocked()
+	c.upstreams = nil
+	c.standby = nil
 	c.client = nil
 }
 
+// closeIdleLocked drops pooled proxy connections of the current client; c.mu must be held
+func (c *InternetClient) closeIdleLocked() {
+	if c.client != nil {
+		c.client.CloseIdleConnections()
+	}
+}
+
 // IsConnected returns whether connected to a proxy
 func (c *InternetClient) IsConnected() bool {
 	c.mu.Lock()
@@ -296,6 +776,13 @@ func (c *InternetClient) IsConnected() bool {
 	return c.connected
 }
 
+// ProxyPeerID returns the peer we are connected to for internet access, or ""
+func (c *InternetClient) ProxyPeerID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proxyPeerID
+}
+
 // MakeRequest makes an HTTP request through the proxy
 func (c *InternetClient) MakeRequest(url string) (*http.Response, error) {
 	c.mu.Lock()
@@ -327,13 +814,7 @@ func CheckInternetConnectivity() bool {
 	// Try to connect to common DNS servers
 	timeout := 3 * time.Second
 
-	servers := []string{
-		"8.8.8.8:53",        // Google DNS
-		"1.1.1.1:53",        // Cloudflare DNS
-		"208.67.222.222:53", // OpenDNS
-	}
-
-	for _, server := range servers {
+	for _, server := range internetProbeServers {
 		conn, err := net.DialTimeout("tcp", server, timeout)
 		if err == nil {
 			conn.Close()
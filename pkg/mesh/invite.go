@@ -0,0 +1,244 @@
+package mesh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Joining a personal network takes an invite code from its owner. The owner generates a
+// code, shares it out of band, and the new member presents it in a "network_join"
+// message; the owner answers with a "network_join_response" and adds the member only if
+// the code is valid. Codes are single-use and expire.
+
+// DefaultInviteTTL is how long an invite code is valid when no lifetime is given
+const DefaultInviteTTL = 24 * time.Hour
+
+var (
+	// ErrInviteInvalid is returned for invite codes that are unknown, used or expired
+	ErrInviteInvalid = errors.New("invalid or expired invite code")
+	// ErrJoinTimeout is returned when a network owner doesn't answer a join in time
+	ErrJoinTimeout = errors.New("network join timed out")
+)
+
+// inviteEncoding spells codes in upper case letters and the digits 2 to 7
+var inviteEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// networkInvite is an invite code the owner of a network handed out
+type networkInvite struct {
+	networkID string
+	expires   time.Time
+}
+
+// newInviteCode returns a random code of 80 bits, as four groups of four characters
+func newInviteCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate invite code: %w", err)
+	}
+	s := inviteEncoding.EncodeToString(b)
+	return s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16], nil
+}
+
+// normalizeInviteCode lets users type codes in lower case and without dashes
+func normalizeInviteCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 16 {
+		return code
+	}
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+}
+
+// CreateInvite generates an invite code for a network, valid for ttl or DefaultInviteTTL
+func (pnm *PersonalNetworkManager) CreateInvite(networkID string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		ttl = DefaultInviteTTL
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		return "", err
+	}
+
+	pnm.mu.Lock()
+	defer pnm.mu.Unlock()
+	if _, ok := pnm.Networks[networkID]; !ok {
+		return "", fmt.Errorf("unknown personal network %q", networkID)
+	}
+	now := time.Now()
+	for c, invite := range pnm.invites {
+		if now.After(invite.expires) {
+			delete(pnm.invites, c)
+		}
+	}
+	pnm.invites[code] = &networkInvite{networkID: networkID, expires: now.Add(ttl)}
+	return code, nil
+}
+
+// RevokeInvite invalidates an invite code that hasn't been used yet
+func (pnm *PersonalNetworkManager) RevokeInvite(code string) {
+	pnm.mu.Lock()
+	defer pnm.mu.Unlock()
+	delete(pnm.invites, normalizeInviteCode(code))
+}
+
+// RedeemInvite adds a node to the network an invite code is for and uses the code up
+func (pnm *PersonalNetworkManager) RedeemInvite(code, nodeID string) (*PersonalNetwork, error) {
+	code = normalizeInviteCode(code)
+	pnm.mu.Lock()
+	invite, ok := pnm.invites[code]
+	if ok {
+		delete(pnm.invites, code)
+	}
+	var network *PersonalNetwork
+	if ok && time.Now().Before(invite.expires) {
+		network = pnm.Networks[invite.networkID]
+	}
+	pnm.mu.Unlock()
+	if network == nil {
+		return nil, ErrInviteInvalid
+	}
+
+	network.AddMember(&NetworkMember{NodeID: nodeID, JoinedAt: time.Now()})
+	return network, nil
+}
+
+// CreateNetworkInvite generates an invite code for a personal network we own
+func (ma *MeshApp) CreateNetworkInvite(networkID string, ttl time.Duration) (string, error) {
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(networkID)
+	if !ok {
+		return "", fmt.Errorf("unknown personal network %q", networkID)
+	}
+	if network.Owner != ma.Node.ID {
+		return "", ErrNotNetworkOwner
+	}
+	return ma.PersonalNetworkMgr.CreateInvite(networkID, ttl)
+}
+
+// JoinNetwork presents an invite code to the owner of a personal network and, once the
+// owner accepts it, adds the network to ours
+func (ma *MeshApp) JoinNetwork(ownerID, code string, timeout time.Duration) (*PersonalNetwork, error) {
+	// Owners that connected to us may not be discovered; SendMessage reports if there is no link
+	if peer, ok := ma.Discovery.GetPeer(ownerID); ok {
+		if err := ma.Transport.ConnectToPeer(peer.ID, peer.IP, peer.Port); err != nil {
+			return nil, fmt.Errorf("failed to connect to network owner: %w", err)
+		}
+	}
+
+	respChan := make(chan *Message, 1)
+	ma.joinsMu.Lock()
+	ma.joins[ownerID] = respChan
+	ma.joinsMu.Unlock()
+	defer func() {
+		ma.joinsMu.Lock()
+		delete(ma.joins, ownerID)
+		ma.joinsMu.Unlock()
+	}()
+
+	err := ma.Transport.SendMessage(ownerID, &Message{
+		Type:      "network_join",
+		Source:    ma.Node.ID,
+		Dest:      ownerID,
+		Timestamp: time.Now(),
+		Metadata:  map[string]string{"code": normalizeInviteCode(code)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *Message
+	select {
+	case resp = <-respChan:
+	case <-time.After(timeout):
+		return nil, ErrJoinTimeout
+	}
+	meta := resp.Metadata
+	if errMsg := meta["error"]; errMsg != "" {
+		ma.emitEvent(&Event{Type: EventNetworkJoinFailed, PeerID: ownerID, Detail: errMsg})
+		return nil, fmt.Errorf("owner refused: %s", errMsg)
+	}
+	ownerKey, _ := base64.StdEncoding.DecodeString(meta["owner_key"])
+	var certs []*MembershipCert
+	if encoded := meta["certs"]; encoded != "" {
+		// A certificate-based network: the owner must have certified us
+		var err error
+		if certs, err = joinCerts(encoded, meta["network_id"], ownerID, ma.Node.ID, ownerKey); err != nil {
+			ma.emitEvent(&Event{Type: EventNetworkJoinFailed, PeerID: ownerID, Detail: err.Error()})
+			return nil, err
+		}
+	}
+
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(meta["network_id"])
+	if !ok {
+		network = ma.PersonalNetworkMgr.CreateNetwork(meta["network_id"], meta["name"], ownerID)
+	}
+	if len(ownerKey) == ed25519.PublicKeySize {
+		network.mu.Lock()
+		network.OwnerKey = ed25519.PublicKey(ownerKey)
+		network.RequireCerts = certs != nil
+		network.mu.Unlock()
+	}
+	network.AddMember(&NetworkMember{NodeID: ownerID})
+	network.AddMember(&NetworkMember{NodeID: ma.Node.ID, JoinedAt: time.Now()})
+	for _, cert := range certs {
+		if err := network.AddCert(cert, time.Now()); err != nil {
+			ma.emitEvent(&Event{Type: EventMemberCertRejected, PeerID: ownerID, Detail: fmt.Sprintf("%s: %v", network.ID, err)})
+		}
+	}
+	if wrapped, err := base64.StdEncoding.DecodeString(meta["key"]); err == nil && len(wrapped) > 0 {
+		epoch, _ := strconv.ParseUint(meta["key_epoch"], 10, 64)
+		ma.installGroupKey(network, epoch, wrapped, meta["key_sealed"] == "true", meta["members"])
+	}
+	ma.emitEvent(&Event{Type: EventNetworkJoined, PeerID: ownerID, Detail: network.ID})
+	return network, nil
+}
+
+func (ma *MeshApp) handleNetworkJoin(peerID string, msg *Message) {
+	reply := map[string]string{}
+	network, err := ma.PersonalNetworkMgr.RedeemInvite(msg.Metadata["code"], peerID)
+	if err == nil {
+		err = ma.certifyJoin(network, peerID, reply)
+	}
+	if err != nil {
+		ma.Audit.Record(AuditNetworkJoinRefused, peerID, err.Error())
+		reply["error"] = err.Error()
+	} else {
+		ma.Audit.Record(AuditNetworkJoined, peerID, network.ID)
+		ma.emitEvent(&Event{Type: EventNetworkMemberJoined, PeerID: peerID, Detail: network.ID})
+		reply["network_id"] = network.ID
+		reply["name"] = network.Name
+		network.mu.RLock()
+		if len(network.OwnerKey) > 0 {
+			reply["owner_key"] = base64.StdEncoding.EncodeToString(network.OwnerKey)
+		}
+		network.mu.RUnlock()
+		ma.groupKeyReply(network, peerID, reply)
+	}
+	ma.Transport.SendMessage(peerID, &Message{
+		Type:      "network_join_response",
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Timestamp: time.Now(),
+		Metadata:  reply,
+	})
+}
+
+// handleNetworkJoinResponse passes an owner's answer to the join waiting on it; answers
+// nobody asked for are ignored so peers can't enroll us in their networks
+func (ma *MeshApp) handleNetworkJoinResponse(peerID string, msg *Message) {
+	ma.joinsMu.Lock()
+	ch, ok := ma.joins[peerID]
+	ma.joinsMu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- msg:
+	default:
+	}
+}
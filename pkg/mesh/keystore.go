@@ -0,0 +1,269 @@
+package mesh
+
+import (
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A keystore keeps what a node must not lose across restarts in one file sealed with
+// AES-GCM under a key derived from a passphrase (PBKDF2-SHA256): the identity key the
+// node ID derives from, the Noise keys and TLS certificate fingerprints pinned for peers,
+// the keys of peers we paired with, and the proxy tokens we issued and were issued. The
+// identity is stored as soon as it is created; the rest is loaded when the app starts
+// and saved when it stops, or whenever SaveKeystore is called.
+const (
+	keystoreVersion    = 1
+	keystoreIterations = 600_000
+	keystoreSaltSize   = 16
+
+	// maxKeystoreIterations bounds the work a keystore file can ask for, so a tampered one
+	// can't hang the node deriving its key
+	maxKeystoreIterations = 10 * keystoreIterations
+)
+
+// ErrKeystorePassphrase is returned when a keystore doesn't open with the passphrase given
+var ErrKeystorePassphrase = errors.New("wrong keystore passphrase")
+
+// Keystore is an encrypted file holding a node's keys and tokens
+type Keystore struct {
+	path     string
+	key      []byte
+	header   keystoreHeader
+	contents keystoreContents
+	mu       sync.Mutex
+}
+
+// keystoreHeader is stored in the clear and authenticated with the contents
+type keystoreHeader struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+}
+
+type keystoreFile struct {
+	keystoreHeader
+	Sealed []byte `json:"sealed"`
+}
+
+type keystoreContents struct {
+	Identity     ed25519.PrivateKey `json:"identity,omitempty"`
+	NoisePins    map[string][]byte  `json:"noise_pins,omitempty"`
+	TLSPins      map[string][]byte  `json:"tls_pins,omitempty"`
+	Pairings     []BundlePairing    `json:"pairings,omitempty"`
+	ClientTokens map[string]string  `json:"client_tokens,omitempty"` // Token issued to each client we authorized
+	ProxyTokens  map[string]string  `json:"proxy_tokens,omitempty"`  // Token each proxy issued us
+}
+
+// OpenKeystore opens the keystore at path with passphrase. A missing file is a new,
+// empty keystore, written on the first save.
+func OpenKeystore(path, passphrase string) (*Keystore, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		salt := make([]byte, keystoreSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		header := keystoreHeader{Version: keystoreVersion, Salt: salt, Iterations: keystoreIterations}
+		key, err := keystoreKey(passphrase, header)
+		if err != nil {
+			return nil, err
+		}
+		return &Keystore{path: path, key: key, header: header}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+
+	var file keystoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid keystore: %w", err)
+	}
+	if file.Version != keystoreVersion || len(file.Salt) == 0 || file.Iterations <= 0 {
+		return nil, fmt.Errorf("unsupported keystore version %d", file.Version)
+	}
+	if file.Iterations > maxKeystoreIterations {
+		return nil, fmt.Errorf("invalid keystore: %d iterations exceeds the limit of %d", file.Iterations, maxKeystoreIterations)
+	}
+	key, err := keystoreKey(passphrase, file.keystoreHeader)
+	if err != nil {
+		return nil, err
+	}
+	aad, err := json.Marshal(file.keystoreHeader)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(key, file.Sealed, aad)
+	if err != nil {
+		return nil, ErrKeystorePassphrase
+	}
+	ks := &Keystore{path: path, key: key, header: file.keystoreHeader}
+	if err := json.Unmarshal(plaintext, &ks.contents); err != nil {
+		return nil, fmt.Errorf("invalid keystore contents: %w", err)
+	}
+	return ks, nil
+}
+
+func keystoreKey(passphrase string, header keystoreHeader) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, header.Salt, header.Iterations, 32)
+}
+
+// Identity returns the stored identity, creating and storing one if there is none
+func (k *Keystore) Identity() (*Identity, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.contents.Identity) == ed25519.PrivateKeySize {
+		return &Identity{PrivateKey: k.contents.Identity}, nil
+	}
+	identity, err := NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	k.contents.Identity = identity.PrivateKey
+	if err := k.saveLocked(); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// Save writes the keystore, replacing the file atomically
+func (k *Keystore) Save() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.saveLocked()
+}
+
+func (k *Keystore) saveLocked() error {
+	plaintext, err := json.Marshal(&k.contents)
+	if err != nil {
+		return err
+	}
+	aad, err := json.Marshal(k.header)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(k.key, plaintext, aad)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&keystoreFile{keystoreHeader: k.header, Sealed: sealed})
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to store keystore: %w", err)
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		return fmt.Errorf("failed to store keystore: %w", err)
+	}
+	return nil
+}
+
+// NewMeshAppWithKeystore creates a mesh application with the identity kept in ks,
+// creating one on first use, that loads its pinned keys and tokens from ks when it starts
+func NewMeshAppWithKeystore(ks *Keystore, nodeName, ip, mac string) (*MeshApp, error) {
+	identity, err := ks.Identity()
+	if err != nil {
+		return nil, err
+	}
+	ma := NewMeshAppWithIdentity(identity, nodeName, ip, mac)
+	ma.Keystore = ks
+	return ma, nil
+}
+
+// loadKeystore restores the pinned keys, pairings and tokens kept in the keystore
+func (ma *MeshApp) loadKeystore() {
+	ks := ma.Keystore
+	if ks == nil {
+		return
+	}
+	ks.mu.Lock()
+	contents := ks.contents
+	ks.mu.Unlock()
+
+	ma.Transport.restorePins(contents.NoisePins, contents.TLSPins)
+	ma.Pairing.restore(contents.Pairings)
+	for peerID, token := range contents.ClientTokens {
+		ma.InternetProxy.restoreClient(peerID, token)
+	}
+	for proxyPeerID, token := range contents.ProxyTokens {
+		ma.InternetClient.SetProxyToken(proxyPeerID, token)
+	}
+}
+
+// SaveKeystore stores the current pinned keys, pairings and tokens in the keystore;
+// it does nothing without one
+func (ma *MeshApp) SaveKeystore() error {
+	ks := ma.Keystore
+	if ks == nil {
+		return nil
+	}
+	noisePins, tlsPins := ma.Transport.pins()
+	pairings := ma.Pairing.export()
+	clientTokens := ma.InternetProxy.issuedTokens()
+	proxyTokens := ma.InternetClient.proxyTokens()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.contents.NoisePins = noisePins
+	ks.contents.TLSPins = tlsPins
+	ks.contents.Pairings = pairings
+	ks.contents.ClientTokens = clientTokens
+	ks.contents.ProxyTokens = proxyTokens
+	return ks.saveLocked()
+}
+
+// saveKeystore saves the keystore, reporting failures as events
+func (ma *MeshApp) saveKeystore() {
+	if err := ma.SaveKeystore(); err != nil {
+		ma.emitEvent(&Event{Type: EventConfigError, Component: "keystore", Detail: err.Error()})
+	}
+}
+
+// pins returns the Noise keys and TLS certificate fingerprints pinned for peers; TLS
+// pins are only kept when peers aren't verified against roots
+func (t *Transport) pins() (map[string][]byte, map[string][]byte) {
+	var noisePins, tlsPins map[string][]byte
+	if setup := t.noiseSetup(); setup != nil {
+		setup.mu.Lock()
+		noisePins = make(map[string][]byte, len(setup.pins))
+		for peerID, key := range setup.pins {
+			noisePins[peerID] = key
+		}
+		setup.mu.Unlock()
+	}
+	if setup := t.tlsSetup(); setup != nil && setup.roots == nil {
+		setup.mu.Lock()
+		tlsPins = make(map[string][]byte, len(setup.pins))
+		for peerID, fingerprint := range setup.pins {
+			tlsPins[peerID] = fingerprint[:]
+		}
+		setup.mu.Unlock()
+	}
+	return noisePins, tlsPins
+}
+
+// restorePins pins peers' keys again, for whichever of Noise and TLS is enabled
+func (t *Transport) restorePins(noisePins, tlsPins map[string][]byte) {
+	for peerID, key := range noisePins {
+		t.PinNoiseKey(peerID, key)
+	}
+	setup := t.tlsSetup()
+	if setup == nil {
+		return
+	}
+	setup.mu.Lock()
+	defer setup.mu.Unlock()
+	for peerID, fingerprint := range tlsPins {
+		if len(fingerprint) == sha256.Size {
+			setup.pins[peerID] = [sha256.Size]byte(fingerprint)
+		}
+	}
+}
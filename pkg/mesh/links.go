@@ -0,0 +1,150 @@
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Discovery finds peers on the local network by multicast. Other radios, like Wi-Fi Aware
+// on Android, are driven by the platform, which reports each data link it brings up with
+// AddLinkPeer. Multicast doesn't cross those links, so peers on them send each other their
+// announcements over the transport instead, as "link_announce" messages.
+const (
+	LinkLAN       = ""           // Found by multicast on the local network
+	LinkWifiAware = "wifi_aware" // Wi-Fi Aware (NAN) data path, without an access point
+	LinkBLE       = "ble"        // Bluetooth LE, registered by the platform
+)
+
+// linkRank orders links by the throughput they usually offer, higher is better. A direct
+// Wi-Fi Aware link doesn't share airtime with an access point; BLE is far slower than both.
+func linkRank(link string) int {
+	switch link {
+	case LinkWifiAware:
+		return 2
+	case LinkBLE:
+		return 0
+	}
+	return 1
+}
+
+// linkAnnouncement returns our next announcement, signed if we have an identity, to send
+// over a link multicast doesn't reach
+func (d *Discovery) linkAnnouncement() ([]byte, error) {
+	d.mu.Lock()
+	msg := d.announcementLocked()
+	identity := d.identity
+	d.mu.Unlock()
+	if identity != nil {
+		identity.signAnnouncement(&msg)
+	}
+	return json.Marshal(&msg)
+}
+
+// dropLinkPeer forgets a peer found on a link other than the LAN, when the link went down
+func (d *Discovery) dropLinkPeer(peerID string) {
+	d.peersMu.RLock()
+	peer, ok := d.peers[peerID]
+	d.peersMu.RUnlock()
+	if ok && peer.Link != LinkLAN {
+		d.handlePeerGoodbye(peerID)
+	}
+}
+
+// AddLinkPeer registers a peer the platform brought up a data link to, e.g. a Wi-Fi
+// Aware data path. ip may carry the link's interface as an IPv6 zone, "fe80::1%aware_data0".
+// The peer is dialed and sent our announcement, and becomes a discovered peer once its
+// own announcement arrives over the link.
+func (ma *MeshApp) AddLinkPeer(link, peerID, ip string, port int) error {
+	ma.mu.Lock()
+	ma.linkPeers[peerID] = &DiscoveredPeer{ID: peerID, IP: ip, Port: port, Link: link}
+	connected := ma.IsConnected
+	ma.mu.Unlock()
+	ma.dials.forget(peerID) // The link is new; dial it right away
+
+	if !connected || !ma.Transport.IsRunning() {
+		return nil // Dialed once the transport is up
+	}
+	if err := ma.dialPeer(peerID, ip, port); err != nil {
+		return err
+	}
+	return ma.sendLinkAnnouncement(peerID)
+}
+
+// RemoveLinkPeer forgets a peer whose data link went down
+func (ma *MeshApp) RemoveLinkPeer(peerID string) {
+	ma.mu.Lock()
+	_, ok := ma.linkPeers[peerID]
+	delete(ma.linkPeers, peerID)
+	ma.mu.Unlock()
+	if !ok {
+		return
+	}
+	ma.Transport.DisconnectPeer(peerID)
+	ma.Discovery.dropLinkPeer(peerID)
+}
+
+func (ma *MeshApp) sendLinkAnnouncement(peerID string) error {
+	payload, err := ma.Discovery.linkAnnouncement()
+	if err != nil {
+		return err
+	}
+	return ma.Transport.SendMessage(peerID, &Message{
+		Type:      "link_announce",
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Payload:   payload,
+		Timestamp: time.Now(),
+	})
+}
+
+// linkAnnounceLoop keeps link peers connected and announced to, as the multicast
+// announcements do for the LAN
+func (ma *MeshApp) linkAnnounceLoop(ctx context.Context) {
+	ticker := time.NewTicker(AnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ma.announceToLinkPeers()
+		}
+	}
+}
+
+func (ma *MeshApp) announceToLinkPeers() {
+	if !ma.Transport.IsRunning() {
+		return
+	}
+	ma.mu.RLock()
+	peers := make([]*DiscoveredPeer, 0, len(ma.linkPeers))
+	for _, peer := range ma.linkPeers {
+		peers = append(peers, peer)
+	}
+	ma.mu.RUnlock()
+
+	for _, peer := range peers {
+		if ma.dialPeer(peer.ID, peer.IP, peer.Port) == nil {
+			ma.sendLinkAnnouncement(peer.ID)
+		}
+	}
+}
+
+// handleLinkAnnounce takes an announcement from a link peer as if it arrived by
+// multicast, at the address and port the platform reported for the link
+func (ma *MeshApp) handleLinkAnnounce(peerID string, msg *Message) {
+	ma.mu.RLock()
+	link, ok := ma.linkPeers[peerID]
+	ma.mu.RUnlock()
+	if !ok {
+		return
+	}
+	var announce AnnounceMessage
+	if err := json.Unmarshal(msg.Payload, &announce); err != nil || announce.ID != peerID ||
+		announce.MessageType != "announce" {
+		return
+	}
+	ma.Discovery.handleAnnounce(&announce, link.IP, link.Port, link.Link)
+}
@@ -0,0 +1,367 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The owner of a personal network can act as its certificate authority: once membership
+// certificates are enabled, the owner signs a certificate for each member with its
+// identity key, and nodes only count a peer as a member while it holds a valid one.
+// Members receive every certificate of the network when they join or when the owner
+// issues one, and present their own when they dial a peer, so membership holds up
+// without trusting whichever roster a node happens to have in memory.
+
+// DefaultMembershipCertTTL is how long a membership certificate is valid when no
+// lifetime is given; owners renew certificates by issuing them again
+const DefaultMembershipCertTTL = 30 * 24 * time.Hour
+
+const memberCertMessageType = "network_cert"
+
+// ErrNotCertified is returned for peers without a valid membership certificate
+var ErrNotCertified = errors.New("no valid membership certificate")
+
+// MembershipCert certifies that a node is a member of a personal network
+type MembershipCert struct {
+	NetworkID string    `json:"network_id"`
+	NodeID    string    `json:"node_id"`
+	IssuedAt  time.Time `json:"issued_at"`
+	Expires   time.Time `json:"expires"`
+	Issuer    string    `json:"issuer"` // The network's owner
+	Signature []byte    `json:"signature"`
+}
+
+// signingBytes encodes the signed fields of a certificate unambiguously
+func (c *MembershipCert) signingBytes() []byte {
+	var buf bytes.Buffer
+	for _, field := range []string{identityContext + " membership", c.NetworkID, c.NodeID, c.Issuer} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	binary.Write(&buf, binary.BigEndian, c.IssuedAt.UnixNano())
+	binary.Write(&buf, binary.BigEndian, c.Expires.UnixNano())
+	return buf.Bytes()
+}
+
+// newMembershipCert issues a certificate for nodeID, signed by the identity of the network's owner
+func newMembershipCert(identity *Identity, network *PersonalNetwork, nodeID string, ttl time.Duration) *MembershipCert {
+	if ttl <= 0 {
+		ttl = DefaultMembershipCertTTL
+	}
+	now := time.Now()
+	c := &MembershipCert{
+		NetworkID: network.ID,
+		NodeID:    nodeID,
+		IssuedAt:  now,
+		Expires:   now.Add(ttl),
+		Issuer:    network.Owner,
+	}
+	c.Signature = ed25519.Sign(identity.PrivateKey, c.signingBytes())
+	return c
+}
+
+// Verify checks that the certificate was signed with ownerKey and is valid at now
+func (c *MembershipCert) Verify(ownerKey ed25519.PublicKey, now time.Time) error {
+	if len(ownerKey) != ed25519.PublicKeySize {
+		return errors.New("network has no owner key to verify certificates with")
+	}
+	if !ed25519.Verify(ownerKey, c.signingBytes(), c.Signature) {
+		return fmt.Errorf("bad signature on membership certificate of %s", c.NodeID)
+	}
+	if !now.Before(c.Expires) {
+		return fmt.Errorf("membership certificate of %s expired", c.NodeID)
+	}
+	return nil
+}
+
+// AddCert stores a member's certificate after checking it was issued for this network
+// by its owner. A certificate replaces one expiring earlier.
+func (pn *PersonalNetwork) AddCert(cert *MembershipCert, now time.Time) error {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	if cert.NetworkID != pn.ID || cert.Issuer != pn.Owner {
+		return fmt.Errorf("certificate of %s is not from the owner of %s", cert.NodeID, pn.ID)
+	}
+	if err := cert.Verify(pn.OwnerKey, now); err != nil {
+		return err
+	}
+	if existing, ok := pn.certs[cert.NodeID]; ok && !cert.Expires.After(existing.Expires) {
+		return nil
+	}
+	pn.certs[cert.NodeID] = cert
+	return nil
+}
+
+// Cert returns a member's certificate
+func (pn *PersonalNetwork) Cert(nodeID string) (*MembershipCert, bool) {
+	pn.mu.RLock()
+	defer pn.mu.RUnlock()
+	cert, ok := pn.certs[nodeID]
+	return cert, ok
+}
+
+// Certs returns the certificates of the network's members, by node ID
+func (pn *PersonalNetwork) Certs() []*MembershipCert {
+	pn.mu.RLock()
+	defer pn.mu.RUnlock()
+	certs := make([]*MembershipCert, 0, len(pn.certs))
+	for _, cert := range pn.certs {
+		certs = append(certs, cert)
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].NodeID < certs[j].NodeID })
+	return certs
+}
+
+// certifiedLocked returns whether a node is the owner or holds a valid certificate;
+// pn.mu must be held. Certificates are checked when stored, so only expiry is left.
+func (pn *PersonalNetwork) certifiedLocked(nodeID string, now time.Time) bool {
+	if nodeID == pn.Owner {
+		return true
+	}
+	cert, ok := pn.certs[nodeID]
+	return ok && now.Before(cert.Expires)
+}
+
+// ownedCertNetwork returns a network we own, with certificates enabled
+func (ma *MeshApp) ownedCertNetwork(networkID string) (*PersonalNetwork, *Identity, error) {
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(networkID)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown personal network %q", networkID)
+	}
+	if network.Owner != ma.Node.ID {
+		return nil, nil, ErrNotNetworkOwner
+	}
+	identity := ma.Node.Identity
+	if identity == nil {
+		return nil, nil, errors.New("node has no identity to sign certificates with")
+	}
+	return network, identity, nil
+}
+
+// EnableMembershipCerts makes a personal network we own certificate-based: every member
+// gets a certificate signed with our identity, and from then on nodes only count peers
+// holding one as members. Our identity key becomes the network's owner key.
+func (ma *MeshApp) EnableMembershipCerts(networkID string) error {
+	network, identity, err := ma.ownedCertNetwork(networkID)
+	if err != nil {
+		return err
+	}
+	network.mu.Lock()
+	if len(network.OwnerKey) > 0 && !bytes.Equal(network.OwnerKey, identity.PublicKey()) {
+		network.mu.Unlock()
+		return errors.New("network's owner key isn't this node's identity key")
+	}
+	network.OwnerKey = identity.PublicKey()
+	network.RequireCerts = true
+	var members []string
+	for nodeID := range network.Members {
+		if nodeID != ma.Node.ID {
+			members = append(members, nodeID)
+		}
+	}
+	network.mu.Unlock()
+
+	for _, nodeID := range members {
+		cert := newMembershipCert(identity, network, nodeID, 0)
+		network.AddCert(cert, time.Now())
+		ma.Audit.Record(AuditMemberCertIssued, nodeID, network.ID)
+	}
+	ma.distributeCerts(network)
+	return nil
+}
+
+// IssueMembershipCert certifies a node as a member of a certificate-based network we
+// own, adding it to the roster, and sends the certificate to the members. Issuing a
+// certificate again renews it.
+func (ma *MeshApp) IssueMembershipCert(networkID, nodeID string, ttl time.Duration) (*MembershipCert, error) {
+	network, identity, err := ma.ownedCertNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+	network.mu.RLock()
+	required := network.RequireCerts
+	network.mu.RUnlock()
+	if !required {
+		return nil, fmt.Errorf("network %q doesn't use membership certificates", networkID)
+	}
+	if ma.Revocations.Revoked(nodeID) {
+		return nil, fmt.Errorf("%s: %w", nodeID, ErrRevoked)
+	}
+
+	cert := newMembershipCert(identity, network, nodeID, ttl)
+	if err := network.AddCert(cert, time.Now()); err != nil {
+		return nil, err
+	}
+	if _, ok := network.GetMember(nodeID); !ok {
+		network.AddMember(&NetworkMember{NodeID: nodeID, JoinedAt: time.Now()})
+	}
+	ma.Audit.Record(AuditMemberCertIssued, nodeID, network.ID)
+	ma.distributeCerts(network)
+	return cert, nil
+}
+
+// distributeCerts sends every certificate of a network we own to its connected members,
+// so they can check each other without asking us
+func (ma *MeshApp) distributeCerts(network *PersonalNetwork) {
+	certs := network.Certs()
+	connected := make(map[string]bool)
+	for _, peerID := range ma.Transport.GetConnectedPeers() {
+		connected[peerID] = true
+	}
+	for _, cert := range certs {
+		if connected[cert.NodeID] {
+			ma.sendCerts(cert.NodeID, certs, false)
+		}
+	}
+}
+
+// sendCerts sends membership certificates to a peer; a sync asks it to answer with its
+// own. Our identity key goes along, so members that only know us by node ID learn the
+// key of networks we own.
+func (ma *MeshApp) sendCerts(peerID string, certs []*MembershipCert, sync bool) {
+	payload, err := json.Marshal(certs)
+	if err != nil {
+		return
+	}
+	meta := make(map[string]string)
+	if sync {
+		meta["sync"] = "1"
+	}
+	if identity := ma.Node.Identity; identity != nil {
+		meta["key"] = base64.StdEncoding.EncodeToString(identity.PublicKey())
+	}
+	ma.Transport.SendMessage(peerID, &Message{
+		Type:      memberCertMessageType,
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Payload:   payload,
+		Timestamp: time.Now(),
+		Metadata:  meta,
+	})
+}
+
+// ownCerts returns our certificates for the given networks, or all of them if nil
+func (ma *MeshApp) ownCerts(networkIDs map[string]bool) []*MembershipCert {
+	ma.PersonalNetworkMgr.mu.RLock()
+	networks := make([]*PersonalNetwork, 0, len(ma.PersonalNetworkMgr.Networks))
+	for id, network := range ma.PersonalNetworkMgr.Networks {
+		if networkIDs == nil || networkIDs[id] {
+			networks = append(networks, network)
+		}
+	}
+	ma.PersonalNetworkMgr.mu.RUnlock()
+
+	var certs []*MembershipCert
+	for _, network := range networks {
+		if cert, ok := network.Cert(ma.Node.ID); ok {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// syncCerts presents our certificates to a peer we dialed, which answers with its own
+// for the same networks
+func (ma *MeshApp) syncCerts(peerID string) {
+	if certs := ma.ownCerts(nil); len(certs) > 0 {
+		ma.sendCerts(peerID, certs, true)
+	}
+}
+
+// handleCerts stores the certificates a peer sent for networks we know and, for a
+// sync, answers with ours for the networks it presented. Certificates from a network's
+// owner also tell us that the network became certificate-based.
+func (ma *MeshApp) handleCerts(peerID string, msg *Message) {
+	var certs []*MembershipCert
+	if err := json.Unmarshal(msg.Payload, &certs); err != nil {
+		return
+	}
+	// Node IDs derive from identity keys, so the owner's key can be checked against its ID
+	senderKey, _ := base64.StdEncoding.DecodeString(msg.Metadata["key"])
+	ownerKnown := len(senderKey) == ed25519.PublicKeySize && NodeIDFromKey(senderKey) == peerID && msg.Source == peerID
+
+	presented := make(map[string]bool)
+	now := time.Now()
+	for _, cert := range certs {
+		network, ok := ma.PersonalNetworkMgr.GetNetwork(cert.NetworkID)
+		if !ok {
+			continue
+		}
+		presented[network.ID] = true
+		if ownerKnown && network.Owner == peerID {
+			network.mu.Lock()
+			if len(network.OwnerKey) == 0 {
+				network.OwnerKey = ed25519.PublicKey(senderKey)
+			}
+			network.mu.Unlock()
+		}
+		if err := network.AddCert(cert, now); err != nil {
+			ma.emitEvent(&Event{Type: EventMemberCertRejected, PeerID: peerID, Detail: fmt.Sprintf("%s: %v", network.ID, err)})
+			continue
+		}
+		if msg.Source == network.Owner && peerID == network.Owner {
+			network.mu.Lock()
+			network.RequireCerts = true
+			network.mu.Unlock()
+		}
+	}
+
+	if msg.Metadata["sync"] == "" {
+		return
+	}
+	if mine := ma.ownCerts(presented); len(mine) > 0 {
+		ma.sendCerts(peerID, mine, false)
+	}
+}
+
+// joinCerts verifies the certificates a network's owner sent with our join, which must
+// include a valid one for us, and returns them
+func joinCerts(encoded, networkID, ownerID, nodeID string, ownerKey ed25519.PublicKey) ([]*MembershipCert, error) {
+	var certs []*MembershipCert
+	if err := json.Unmarshal([]byte(encoded), &certs); err != nil {
+		return nil, fmt.Errorf("invalid membership certificates: %w", err)
+	}
+	now := time.Now()
+	for _, cert := range certs {
+		if cert.NodeID != nodeID {
+			continue
+		}
+		if cert.NetworkID != networkID || cert.Issuer != ownerID {
+			return nil, errors.New("owner sent a certificate for another network")
+		}
+		if err := cert.Verify(ownerKey, now); err != nil {
+			return nil, err
+		}
+		return certs, nil
+	}
+	return nil, errors.New("owner sent no membership certificate for us")
+}
+
+// certifyJoin issues a certificate for a peer that joined a certificate-based network we
+// own, adding the network's certificates to the join response and sending the new one to
+// the other members
+func (ma *MeshApp) certifyJoin(network *PersonalNetwork, peerID string, reply map[string]string) error {
+	network.mu.RLock()
+	required := network.RequireCerts
+	network.mu.RUnlock()
+	if !required {
+		return nil
+	}
+	if _, err := ma.IssueMembershipCert(network.ID, peerID, 0); err != nil {
+		network.RemoveMember(peerID)
+		return err
+	}
+	certs, err := json.Marshal(network.Certs())
+	if err != nil {
+		return err
+	}
+	reply["certs"] = string(certs)
+	return nil
+}
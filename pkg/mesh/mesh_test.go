@@ -1,7 +1,33 @@
 package mesh
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // TestNodeCreation tests node creation
@@ -95,6 +121,43 @@ func TestPersonalNetworkMembership(t *testing.T) {
 	}
 }
 
+// TestIDs tests random and sortable ID generation
+func TestIDs(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		for _, id := range []string{NewID(), NewSortableID()} {
+			if len(id) != IDLength {
+				t.Fatalf("Expected %d characters, got %q", IDLength, id)
+			}
+			if seen[id] {
+				t.Fatalf("Duplicate ID %q", id)
+			}
+			seen[id] = true
+		}
+	}
+
+	base := time.UnixMilli(1_700_000_000_000)
+	earlier, later := sortableID(base), sortableID(base.Add(time.Millisecond))
+	if earlier >= later {
+		t.Errorf("Expected %q to sort before %q", earlier, later)
+	}
+	if at, ok := SortableIDTime(later); !ok || !at.Equal(base.Add(time.Millisecond)) {
+		t.Errorf("Expected the ID's time to be %v, got %v", base.Add(time.Millisecond), at)
+	}
+	if _, ok := SortableIDTime("not-an-id"); ok {
+		t.Error("Expected a malformed ID to have no time")
+	}
+
+	pnm := NewPersonalNetworkManager()
+	network := pnm.CreateNetwork("", "Home", "user-1")
+	if !strings.HasPrefix(network.ID, "pnet-") {
+		t.Errorf("Expected a generated network ID, got %q", network.ID)
+	}
+	if _, ok := pnm.GetNetwork(network.ID); !ok {
+		t.Error("Expected the network to be stored under its generated ID")
+	}
+}
+
 // TestRoutingTable tests routing table operations
 func TestRoutingTable(t *testing.T) {
 	rt := NewRoutingTable()
@@ -131,6 +194,121 @@ func TestRouter(t *testing.T) {
 	}
 }
 
+// TestRouteMetrics tests that learned latency and loss steer route selection and persist
+func TestRouteMetrics(t *testing.T) {
+	rt := NewRoutingTable()
+
+	// A flappy path that is fast when it answers, and a steady slower one
+	for i := 0; i < 10; i++ {
+		rt.Metrics.Observe("dest-1", "flappy", 5*time.Millisecond, i%2 == 0)
+		rt.Metrics.Observe("dest-1", "steady", 40*time.Millisecond, false)
+	}
+	metric, _ := rt.Metrics.Get("dest-1", "flappy")
+	if metric.Loss < 0.3 || metric.Loss > 0.7 || metric.LatencyMs != 5 {
+		t.Errorf("Expected ~50%% loss at 5ms on the flappy path, got %+v", metric)
+	}
+
+	rt.UpdateRoute("dest-1", "steady", 2, 1000)
+	if rt.UpdateRoute("dest-1", "flappy", 2, 1) {
+		t.Error("Expected the lossy path to lose despite its low one-shot cost")
+	}
+	if route, _ := rt.GetRoute("dest-1"); route.NextHop != "steady" || route.Cost != 40 {
+		t.Errorf("Expected route via 'steady' at learned cost 40, got %+v", route)
+	}
+
+	// A single slow sample only nudges the average
+	rt.Metrics.Observe("dest-1", "steady", 500*time.Millisecond, false)
+	if cost, _ := rt.Metrics.Cost("dest-1", "steady"); cost >= 200 {
+		t.Errorf("Expected one slow sample to be smoothed, got cost %d", cost)
+	}
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := rt.Metrics.Save(path); err != nil {
+		t.Fatalf("Failed to save metrics: %v", err)
+	}
+	restored := NewRouteMetrics()
+	if err := restored.Load(path); err != nil {
+		t.Fatalf("Failed to load metrics: %v", err)
+	}
+	if got, _ := restored.Get("dest-1", "flappy"); got != metric {
+		t.Errorf("Expected %+v after reload, got %+v", metric, got)
+	}
+	if err := NewRouteMetrics().Load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("Expected a missing metrics file to be ignored, got %v", err)
+	}
+
+	// Unanswered probes count as lost when the next one goes out
+	prober := newRouteProber()
+	now := time.Now()
+	token, _ := prober.next("peer-1", now)
+	if _, lost := prober.next("peer-1", now.Add(time.Second)); !lost {
+		t.Error("Expected the unanswered probe to be reported lost")
+	}
+	if _, ok := prober.answer("peer-1", token, now.Add(2*time.Second)); ok {
+		t.Error("Expected a superseded probe answer to be ignored")
+	}
+}
+
+// TestHappyEyeballsDial tests that a hanging address doesn't hold up a working one
+func TestHappyEyeballsDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	var dialed []string
+	var mu sync.Mutex
+	dialer := &happyDialer{
+		lookup: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("2001:db8::1")}}, nil
+		},
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			if strings.Contains(addr, "2001:db8") {
+				<-ctx.Done() // A black-holed IPv6 route
+				return nil, ctx.Err()
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+		attemptDelay: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(context.Background(), net.JoinHostPort("dual.example", port), nil)
+	if err != nil {
+		t.Fatalf("Expected IPv4 fallback to connect, got %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected fallback within the attempt delay, took %v", elapsed)
+	}
+	mu.Lock()
+	if len(dialed) != 2 || !strings.Contains(dialed[0], "2001:db8") {
+		t.Errorf("Expected IPv6 to be tried first, then IPv4, got %v", dialed)
+	}
+	mu.Unlock()
+
+	dialer.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, fmt.Errorf("refused")
+	}
+	if _, err := dialer.DialContext(context.Background(), net.JoinHostPort("dual.example", port), nil); err == nil {
+		t.Error("Expected an error when every address fails")
+	}
+}
+
 // TestProxyManager tests proxy manager
 func TestProxyManager(t *testing.T) {
 	node := NewNode("node-1", "Test Node", "192.168.1.1", "aa:bb:cc:dd:ee:ff")
@@ -155,3 +333,1911 @@ func TestProxyManager(t *testing.T) {
 		t.Errorf("Expected 0 available proxies after unregistration, got %d", len(availableProxies))
 	}
 }
+
+// TestUplinkMonitor tests degradation and recovery of the uplink monitor
+func TestUplinkMonitor(t *testing.T) {
+	um := NewUplinkMonitor(UplinkThresholds{MaxLatency: 100 * time.Millisecond, MaxLoss: 0.3, Window: 4})
+
+	for i := 0; i < 4; i++ {
+		um.Record(20*time.Millisecond, nil)
+	}
+	if um.IsDegraded() {
+		t.Fatal("Expected healthy uplink with low latency")
+	}
+
+	degradedSeen := false
+	for i := 0; i < 4; i++ {
+		if changed, degraded := um.Record(500*time.Millisecond, nil); changed && degraded {
+			degradedSeen = true
+		}
+	}
+	if !degradedSeen || !um.IsDegraded() {
+		t.Fatal("Expected uplink to degrade with high latency")
+	}
+
+	// 90ms is under the degrade threshold but above the recovery threshold
+	for i := 0; i < 4; i++ {
+		um.Record(90*time.Millisecond, nil)
+	}
+	if !um.IsDegraded() {
+		t.Error("Expected uplink to stay degraded until well below the threshold")
+	}
+
+	for i := 0; i < 4; i++ {
+		um.Record(10*time.Millisecond, nil)
+	}
+	if um.IsDegraded() {
+		t.Error("Expected uplink to recover")
+	}
+}
+
+// TestPeerEviction tests LRU eviction, pinning and on-disk spillover of peers
+func TestPeerEviction(t *testing.T) {
+	node := NewNode("node-1", "Test Node", "192.168.1.1", "aa:bb:cc:dd:ee:ff")
+	node.SetPeerArchive(NewFilePeerArchive(t.TempDir() + "/peers.jsonl"))
+	node.SetPeerLimit(2)
+	node.PinPeer("pinned")
+
+	node.AddPeer(&Peer{NodeID: "pinned", IP: "192.168.1.2"})
+	node.AddPeer(&Peer{NodeID: "old", IP: "192.168.1.3"})
+	node.AddPeer(&Peer{NodeID: "new", IP: "192.168.1.4"})
+
+	if len(node.Peers) != 2 {
+		t.Fatalf("Expected 2 peers after eviction, got %d", len(node.Peers))
+	}
+	if _, exists := node.GetPeer("pinned"); !exists {
+		t.Error("Expected pinned peer to survive eviction")
+	}
+	if _, exists := node.GetPeer("old"); exists {
+		t.Error("Expected least recently seen peer to be evicted")
+	}
+
+	archived, ok := node.LookupArchivedPeer("old")
+	if !ok || archived.IP != "192.168.1.3" {
+		t.Errorf("Expected evicted peer in archive, got %+v", archived)
+	}
+}
+
+// TestSelectBestProxyPrefersLowerTier tests that direct uplinks win over mesh-derived ones
+func TestSelectBestProxyPrefersLowerTier(t *testing.T) {
+	node := NewNode("node-1", "Test Node", "192.168.1.1", "aa:bb:cc:dd:ee:ff")
+	pm := NewProxyManager(node)
+
+	pm.RegisterProxy(&Peer{NodeID: "relay", HasInternet: true, RSSI: -30, ProxyTier: 1})
+	pm.RegisterProxy(&Peer{NodeID: "direct-weak", HasInternet: true, RSSI: -80})
+	pm.RegisterProxy(&Peer{NodeID: "direct-strong", HasInternet: true, RSSI: -50})
+
+	best, err := pm.SelectBestProxy()
+	if err != nil {
+		t.Fatalf("Expected a proxy, got %v", err)
+	}
+	if best.NodeID != "direct-strong" {
+		t.Errorf("Expected 'direct-strong', got '%s'", best.NodeID)
+	}
+}
+
+// TestLowMemoryConfig tests that the constrained profile is applied to all components
+func TestLowMemoryConfig(t *testing.T) {
+	cfg := LowMemoryConfig()
+	app := NewMeshAppWithConfig("node-1", "Gateway", "192.168.1.1", "aa:bb:cc:dd:ee:ff", cfg)
+
+	if !reflect.DeepEqual(app.Config(), cfg) {
+		t.Errorf("Expected config %+v, got %+v", cfg, app.Config())
+	}
+	if app.Transport.messageLimit() != cfg.MaxMessageSize {
+		t.Errorf("Expected message limit %d, got %d", cfg.MaxMessageSize, app.Transport.messageLimit())
+	}
+
+	for i := 0; i < cfg.MaxPeers*2; i++ {
+		app.Node.AddPeer(&Peer{NodeID: fmt.Sprintf("peer-%d", i)})
+	}
+	if count := len(app.Node.GetAllPeers()); count != cfg.MaxPeers {
+		t.Errorf("Expected peer table capped at %d, got %d", cfg.MaxPeers, count)
+	}
+}
+
+// BenchmarkPeerTableMemory reports the heap retained by a node after 1000 peers were seen.
+// Results are documented in docs/LOW_MEMORY.md.
+func BenchmarkPeerTableMemory(b *testing.B) {
+	profiles := []struct {
+		name string
+		cfg  Config
+	}{
+		{"default", DefaultConfig()},
+		{"low-memory", LowMemoryConfig()},
+	}
+
+	for _, profile := range profiles {
+		b.Run(profile.name, func(b *testing.B) {
+			var before, after runtime.MemStats
+			var retained int64
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				app := NewMeshAppWithConfig("node-1", "Gateway", "192.168.1.1", "aa:bb:cc:dd:ee:ff", profile.cfg)
+				for j := 0; j < 1000; j++ {
+					app.Node.AddPeer(&Peer{NodeID: fmt.Sprintf("peer-%d", j), IP: "10.0.0.1"})
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained += int64(after.HeapAlloc) - int64(before.HeapAlloc)
+				runtime.KeepAlive(app)
+			}
+			b.ReportMetric(float64(retained)/float64(b.N), "heap-B/op")
+		})
+	}
+}
+
+// TestPeerMACResolution tests that announced peers get their MAC resolved and filtered
+func TestPeerMACResolution(t *testing.T) {
+	d := NewDiscovery("node-1", "Test Node", DefaultPort, false)
+	lookups := 0
+	d.SetMACResolver(MACResolverFunc(func(ip string) (string, error) {
+		lookups++
+		if ip == "192.168.1.20" {
+			return "AA:BB:CC:00:11:22", nil
+		}
+		return "", ErrMACNotFound
+	}))
+
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "peer-1", MessageType: "announce"}, "192.168.1.20")
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "peer-1", MessageType: "announce"}, "192.168.1.20")
+
+	peer, _ := d.GetPeer("peer-1")
+	if peer.MAC != "AA:BB:CC:00:11:22" {
+		t.Errorf("Expected resolved MAC, got '%s'", peer.MAC)
+	}
+	if lookups != 1 {
+		t.Errorf("Expected MAC to be reused while the IP is unchanged, got %d lookups", lookups)
+	}
+
+	filter := NewMACFilter()
+	filter.Deny("aa:bb:cc:00:11:22")
+	if filter.Allowed(peer.MAC) {
+		t.Error("Expected denied MAC to be rejected regardless of case")
+	}
+	if !filter.Allowed("") {
+		t.Error("Expected unresolved MAC to be admitted without an allow list")
+	}
+	filter.Allow("de:ad:be:ef:00:01")
+	if filter.Allowed("") {
+		t.Error("Expected unresolved MAC to be rejected once an allow list is set")
+	}
+}
+
+func TestPairingCodes(t *testing.T) {
+	alice, bob := NewPairing(), NewPairing()
+
+	commitment, err := alice.start("bob")
+	if err != nil {
+		t.Fatalf("Expected pairing to start, got %v", err)
+	}
+	keyMsg, err := bob.handle("alice", pairingStepCommit, commitment)
+	if err != nil || keyMsg.step != pairingStepKey {
+		t.Fatalf("Expected bob to answer with his key, got %q (%v)", keyMsg.step, err)
+	}
+	reveal, err := alice.handle("bob", pairingStepKey, keyMsg.payload)
+	if err != nil || reveal.step != pairingStepReveal {
+		t.Fatalf("Expected alice to reveal her key, got %q (%v)", reveal.step, err)
+	}
+	if _, err := bob.handle("alice", pairingStepReveal, reveal.payload); err != nil {
+		t.Fatalf("Expected reveal to match the commitment, got %v", err)
+	}
+
+	aliceCode, _ := alice.Code("bob")
+	bobCode, _ := bob.Code("alice")
+	if len(aliceCode) != 6 || aliceCode != bobCode {
+		t.Errorf("Expected matching 6-digit codes, got %q and %q", aliceCode, bobCode)
+	}
+
+	if err := alice.Confirm("bob", true); err != nil || !alice.IsVerified("bob") {
+		t.Errorf("Expected bob to be verified after confirmation, got %v", err)
+	}
+	if err := bob.Confirm("alice", false); err != ErrPairingMismatch || bob.IsVerified("alice") {
+		t.Errorf("Expected a mismatch to leave alice unverified, got %v", err)
+	}
+
+	// A key that doesn't match the commitment is rejected
+	commitment, _ = alice.start("bob")
+	bob.handle("alice", pairingStepCommit, commitment)
+	other, _ := NewPairing().start("x")
+	if _, err := bob.handle("alice", pairingStepReveal, other); err == nil {
+		t.Error("Expected a reveal that doesn't match the commitment to fail")
+	}
+}
+
+func TestLogRing(t *testing.T) {
+	ring := NewLogRing(3)
+	ring.Write([]byte("one\ntwo\n"))
+	ring.Write([]byte("thr"))
+	ring.Write([]byte("ee\nfour\n"))
+
+	lines := ring.Lines(0)
+	if strings.Join(lines, ",") != "two,three,four" {
+		t.Errorf("Expected the three most recent lines, got %v", lines)
+	}
+	if lines := ring.Lines(1); len(lines) != 1 || lines[0] != "four" {
+		t.Errorf("Expected only the latest line, got %v", lines)
+	}
+
+	app := NewMeshApp("node-1", "Test Device", "192.168.1.100", "aa:bb:cc:dd:ee:ff")
+	if _, err := app.FetchDiagnostics("stranger", 10, time.Second); err != ErrNotPaired {
+		t.Errorf("Expected ErrNotPaired for an unpaired peer, got %v", err)
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	report, err := RunBench(BenchConfig{
+		Nodes:         4,
+		Topology:      TopologyRing,
+		BroadcastRate: 200,
+		MessageSize:   64,
+		Duration:      200 * time.Millisecond,
+		Seed:          7,
+	})
+	if err != nil {
+		t.Fatalf("Expected bench to run, got %v", err)
+	}
+	if report.Links != 4 {
+		t.Errorf("Expected 4 links in a 4-node ring, got %d", report.Links)
+	}
+	if report.BroadcastsSent == 0 || report.DeliveryRatio < 1 {
+		t.Errorf("Expected every broadcast to be delivered, got %d/%d", report.Delivered, report.ExpectedDelivery)
+	}
+
+	if _, err := RunBench(BenchConfig{Nodes: 3, Topology: "mesh"}); err == nil {
+		t.Error("Expected an unknown topology to be rejected")
+	}
+}
+
+// TestProxyLimits tests connection caps and tunnel idle timeouts of the exit proxy
+func TestProxyLimits(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := newLimitListener(inner, ProxyLimits{MaxConnectionsPerClient: 1})
+	defer listener.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, _ := net.Dial("tcp", listener.Addr().String())
+	defer first.Close()
+	held := <-accepted
+	second, _ := net.Dial("tcp", listener.Addr().String())
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected connection over the per-client cap to be closed, got %v", err)
+	}
+	held.Close()
+	third, _ := net.Dial("tcp", listener.Addr().String())
+	defer third.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Error("Expected a freed slot to be reused")
+	}
+
+	// Traffic passes through a tunnel, and a quiet tunnel is closed
+	client, clientEnd := net.Pipe()
+	dest, destEnd := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		pipeTunnel(clientEnd, destEnd, 100*time.Millisecond, 0, nil)
+		close(done)
+	}()
+	go client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := dest.Read(buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected data through the tunnel, got %q (%v)", buf, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected idle tunnel to be closed")
+	}
+	client.Close()
+	dest.Close()
+}
+
+// TestProxySessions tests that proxy connections between paired peers are sealed with a
+// session key the proxy derives too, and that plain clients still get through
+func TestProxySessions(t *testing.T) {
+	secret := []byte("pairing key shared by both peers")
+	pm := NewProxyManager(NewNode("client", "Client", "127.0.0.1", "00:00:00:00:00:01"))
+	pm.RegisterProxy(&Peer{NodeID: "proxy", HasInternet: true})
+	pm.RegisterProxy(&Peer{NodeID: "stranger", HasInternet: true})
+	pm.SetSessionSecrets(func(peerID string) ([]byte, bool) { return secret, peerID == "proxy" })
+	conn, err := pm.CreateProxyConnection("client", "proxy")
+	if err != nil || conn.Session == nil {
+		t.Fatalf("Expected a session with a paired proxy, got %+v (%v)", conn, err)
+	}
+	if conn, _ := pm.CreateProxyConnection("client", "stranger"); conn.Session != nil {
+		t.Error("Expected no session with an unpaired proxy")
+	}
+	if other, _ := pm.CreateProxyConnection("client", "proxy"); bytes.Equal(other.Session.key, conn.Session.key) {
+		t.Error("Expected each connection to get a fresh session key")
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := newSessionListener(inner, "proxy", func(peerID string) ([]byte, bool) { return secret, peerID == "client" })
+	var served atomic.Int32
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		io.WriteString(w, "hello "+r.URL.Path)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	get := func(conn net.Conn, path string) (string, error) {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n", path)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	dialed, _ := net.Dial("tcp", inner.Addr().String())
+	raw := &recordingConn{Conn: dialed}
+	sealed, err := wrapSession(raw, conn.Session)
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	if body, err := get(sealed, "/sealed"); err != nil || body != "hello /sealed" {
+		t.Errorf("Expected a sealed request to be served, got %q (%v)", body, err)
+	}
+
+	// A captured connection replayed byte for byte meets a fresh proxy nonce and isn't served
+	replay, _ := net.Dial("tcp", inner.Addr().String())
+	replay.SetDeadline(time.Now().Add(5 * time.Second))
+	replay.Write(raw.written.Bytes())
+	io.Copy(io.Discard, replay)
+	replay.Close()
+	if n := served.Load(); n != 1 {
+		t.Errorf("Expected a replayed session not to be served, handled %d requests", n)
+	}
+	plain, _ := net.Dial("tcp", inner.Addr().String())
+	if body, err := get(plain, "/plain"); err != nil || body != "hello /plain" {
+		t.Errorf("Expected a plain request to be served, got %q (%v)", body, err)
+	}
+	stranger := newProxySession(secret, "stranger", "proxy", conn.Session.Nonce)
+	dialed, _ = net.Dial("tcp", inner.Addr().String())
+	if sealed, err = wrapSession(dialed, stranger); err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	if _, err := get(sealed, "/"); err == nil {
+		t.Error("Expected a session from a client without a shared secret to be refused")
+	}
+
+	// Both ends move to new keys after the threshold, and tampered records don't open
+	clientKey, proxyKey := conn.Session.connKeys([]byte("connection nonce"), []byte("proxy nonce"))
+	a, b := net.Pipe()
+	client, _ := newSessionConn(a, clientKey, proxyKey, 1000)
+	proxy, _ := newSessionConn(b, proxyKey, clientKey, 1000)
+	payload := bytes.Repeat([]byte("x"), 5000)
+	go func() {
+		for i := 0; i < 3; i++ {
+			client.Write(payload)
+		}
+	}()
+	got := make([]byte, 3*len(payload))
+	if _, err := io.ReadFull(proxy, got); err != nil || !bytes.Equal(got, bytes.Repeat(payload, 3)) {
+		t.Fatalf("Expected the payload across rekeys, got %d bytes (%v)", len(got), err)
+	}
+	if client.send.rekeys != 3 || proxy.recv.rekeys != 3 {
+		t.Errorf("Expected 3 rekeys on both ends, got %d and %d", client.send.rekeys, proxy.recv.rekeys)
+	}
+	go func() {
+		record, _ := client.send.seal([]byte("hi"))
+		record[0] ^= 1
+		a.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(record))), record...))
+	}()
+	if _, err := proxy.Read(make([]byte, 2)); !errors.Is(err, ErrProxySession) {
+		t.Errorf("Expected a tampered record to be refused, got %v", err)
+	}
+	a.Close()
+	b.Close()
+}
+
+// recordingConn keeps a copy of everything written to it
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.written.Write(p)
+	return c.Conn.Write(p)
+}
+
+// TestCompactCodec tests the dictionary encoding of control messages and its negotiation
+// TestActiveTunnels tests that open tunnels are listed with live byte counts
+func TestActiveTunnels(t *testing.T) {
+	tunnels := NewTunnelTable()
+	client, clientEnd := net.Pipe()
+	dest, destEnd := net.Pipe()
+	tunnel := tunnels.Open("peer-1", "example.com:443")
+	done := make(chan struct{})
+	go func() {
+		pipeTunnel(clientEnd, destEnd, 0, 0, tunnel)
+		tunnels.Close(tunnel)
+		close(done)
+	}()
+
+	go client.Write([]byte("hello"))
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(dest, buf[:5]); err != nil {
+		t.Fatalf("Expected data through the tunnel: %v", err)
+	}
+	go dest.Write([]byte("hi"))
+	if _, err := io.ReadFull(client, buf[:2]); err != nil {
+		t.Fatalf("Expected a reply through the tunnel: %v", err)
+	}
+
+	// Bytes are counted while the tunnel is still open
+	stats := tunnels.Stats(time.Now())
+	if stats.Active != 1 || stats.BytesSent != 5 || stats.BytesReceived != 2 {
+		t.Fatalf("Expected one tunnel with 5 bytes sent and 2 received, got %+v", stats)
+	}
+	if got := stats.Tunnels[0]; got.Client != "peer-1" || got.Host != "example.com:443" || got.DurationMs < 0 {
+		t.Errorf("Unexpected tunnel %+v", got)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the tunnel to end when the client closes")
+	}
+	if stats := tunnels.Stats(time.Now()); stats.Active != 0 || len(stats.Tunnels) != 0 {
+		t.Errorf("Expected no open tunnels, got %+v", stats)
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	guard := NewExitGuard()
+	// Names under .invalid never resolve, so they are left to the upstream proxy
+	const target = "site.invalid:443"
+
+	// An HTTP proxy that accepts CONNECT with the right credentials and echoes, and
+	// answers plain proxy requests itself
+	var connected, requested string
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != http.MethodConnect {
+			requested = r.URL.String()
+			io.WriteString(w, "via upstream")
+			return
+		}
+		connected = r.Host
+		w.WriteHeader(http.StatusOK)
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		io.Copy(conn, buf)
+	}))
+	defer httpProxy.Close()
+
+	if err := guard.SetUpstreamProxy("ftp://proxy:21"); err == nil {
+		t.Error("Expected unsupported scheme to be rejected")
+	}
+	if err := guard.SetUpstreamProxy("http://user:secret@" + httpProxy.Listener.Addr().String()); err != nil {
+		t.Fatalf("SetUpstreamProxy failed: %v", err)
+	}
+	if got := guard.UpstreamProxy(); strings.Contains(got, "secret") {
+		t.Errorf("Expected the password redacted, got %s", got)
+	}
+
+	echo := func(conn net.Conn) {
+		t.Helper()
+		defer conn.Close()
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("Expected echo through the upstream, got %q (%v)", buf, err)
+		}
+	}
+	conn, err := guard.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatalf("Expected dial through the HTTP upstream, got %v", err)
+	}
+	echo(conn)
+	if connected != target {
+		t.Errorf("Expected CONNECT to %s, got %q", target, connected)
+	}
+
+	resp, err := (&http.Client{Transport: guard.RoundTripper()}).Get("http://site.invalid/page")
+	if err != nil {
+		t.Fatalf("Expected request through the HTTP upstream, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "via upstream" || requested != "http://site.invalid/page" {
+		t.Errorf("Expected the upstream to fetch the page, got %q for %q", body, requested)
+	}
+
+	// The guard still refuses internal destinations, though the upstream is local
+	if _, err := guard.DialContext(context.Background(), "tcp", "127.0.0.1:9"); !errors.Is(err, ErrDestinationBlocked) {
+		t.Errorf("Expected dial to loopback to be refused, got %v", err)
+	}
+	if _, err := dialHappyEyeballs(context.Background(), "localhost:80", guard); !errors.Is(err, ErrDestinationBlocked) {
+		t.Errorf("Expected dial to localhost to be refused, got %v", err)
+	}
+
+	// A SOCKS5 proxy with username and password
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	socksTarget := make(chan string, 1)
+	go func() {
+		conn, err := socks.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 512)
+		io.ReadFull(conn, buf[:3]) // Version, one method, username and password
+		conn.Write([]byte{0x05, 0x02})
+		field := func() string {
+			io.ReadFull(conn, buf[:1])
+			io.ReadFull(conn, buf[1:1+int(buf[0])])
+			return string(buf[1 : 1+int(buf[0])])
+		}
+		io.ReadFull(conn, buf[:1]) // Subnegotiation version
+		user, password := field(), field()
+		if user != "user" || password != "secret" {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+		io.ReadFull(conn, buf[:5]) // Request up to the host name's length
+		io.ReadFull(conn, buf[5:5+int(buf[4])+2])
+		port := binary.BigEndian.Uint16(buf[5+int(buf[4]):])
+		socksTarget <- fmt.Sprintf("%s:%d", buf[5:5+int(buf[4])], port)
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		io.Copy(conn, conn)
+	}()
+	if err := guard.SetUpstreamProxy("socks5://user:secret@" + socks.Addr().String()); err != nil {
+		t.Fatalf("SetUpstreamProxy failed: %v", err)
+	}
+	conn, err = dialHappyEyeballs(context.Background(), target, guard)
+	if err != nil {
+		t.Fatalf("Expected dial through the SOCKS5 upstream, got %v", err)
+	}
+	echo(conn)
+	if got := <-socksTarget; got != target {
+		t.Errorf("Expected SOCKS5 connect to %s, got %s", target, got)
+	}
+
+	guard.SetUpstreamProxy("")
+	if guard.UpstreamProxy() != "" {
+		t.Error("Expected the upstream proxy cleared")
+	}
+}
+
+func TestCompactCodec(t *testing.T) {
+	msg := &Message{
+		Type:      "route_update",
+		Source:    "node-a1b2c3",
+		Dest:      "node-d4e5f6",
+		Timestamp: time.Now(),
+		Metadata:  map[string]string{"probe": "17"},
+	}
+	plain, _ := json.Marshal(msg)
+	compact, err := encodeCompact(plain)
+	if err != nil {
+		t.Fatalf("encodeCompact failed: %v", err)
+	}
+	if len(compact) > len(plain)/2 {
+		t.Errorf("Expected route update to shrink by half, got %d of %d bytes", len(compact), len(plain))
+	}
+
+	decoded, wasCompact, err := decodeFrame(compact, MaxMessageSize)
+	if err != nil || !wasCompact || string(decoded) != string(plain) {
+		t.Errorf("Expected compact frame to decode to the original, got %q (%v)", decoded, err)
+	}
+	if decoded, wasCompact, _ := decodeFrame(plain, MaxMessageSize); wasCompact || string(decoded) != string(plain) {
+		t.Error("Expected plain JSON to pass through")
+	}
+	if _, _, err := decodeFrame(compact, len(plain)-1); err == nil {
+		t.Error("Expected frames inflating beyond the limit to be refused")
+	}
+
+	// Peers that advertise the codec exchange compact frames both ways
+	received := make(chan *Message, 2)
+	a := NewTransport("node-a", 0)
+	b := NewTransport("node-b", 0)
+	a.SetMessageHandler(func(peerID string, msg *Message) { received <- msg })
+	b.SetMessageHandler(func(peerID string, msg *Message) { received <- msg })
+	for _, tr := range []*Transport{a, b} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Failed to start transport: %v", err)
+		}
+		defer tr.Stop()
+	}
+	_, port, _ := net.SplitHostPort(b.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := a.ConnectToPeer("node-b", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	waitFor := func(from *Transport, to string) {
+		t.Helper()
+		for i := 0; i < 50 && from.SendMessage(to, msg) != nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		select {
+		case got := <-received:
+			if got.Type != "route_update" || got.Metadata["probe"] != "17" {
+				t.Errorf("Expected the route update, got %+v", got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected message to arrive")
+		}
+	}
+	waitFor(b, "node-a")
+	waitFor(a, "node-b")
+
+	for _, tr := range []*Transport{a, b} {
+		tr.connMu.RLock()
+		for peerID, conn := range tr.connections {
+			if !conn.compact.Load() {
+				t.Errorf("Expected compact frames to %s", peerID)
+			}
+		}
+		tr.connMu.RUnlock()
+	}
+}
+
+// TestProtocolVersions tests that peers settle on the lower of their protocol versions,
+// treat unversioned peers as version 1, and refuse versions they no longer accept
+func TestProtocolVersions(t *testing.T) {
+	cases := []struct {
+		ours, ourMin, theirs, theirMin, want int
+	}{
+		{2, 1, 0, 0, 1},
+		{2, 1, 2, 1, 2},
+		{2, 1, 3, 2, 2},
+		{2, 2, 0, 0, 0},
+		{2, 1, 4, 3, 0},
+	}
+	for _, c := range cases {
+		got, err := negotiateProtocol(c.ours, c.ourMin, c.theirs, c.theirMin)
+		if got != c.want || (c.want == 0) != errors.Is(err, ErrProtocolVersion) {
+			t.Errorf("negotiateProtocol(%d, %d, %d, %d) = %d, %v; want %d", c.ours, c.ourMin, c.theirs, c.theirMin, got, err, c.want)
+		}
+	}
+
+	a := NewTransport("node-a", 0)
+	b := NewTransport("node-b", 0)
+	for _, tr := range []*Transport{a, b} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Failed to start transport: %v", err)
+		}
+		defer tr.Stop()
+	}
+	_, port, _ := net.SplitHostPort(b.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := a.ConnectToPeer("node-b", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	waitProtocol := func(tr *Transport, peerID string, want int) {
+		t.Helper()
+		for i := 0; i < 100 && tr.PeerProtocol(peerID) != want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := tr.PeerProtocol(peerID); got != want {
+			t.Errorf("Expected version %d with %s, got %d", want, peerID, got)
+		}
+	}
+	waitProtocol(a, "node-b", ProtocolVersion)
+	waitProtocol(b, "node-a", ProtocolVersion)
+	if !a.PeerSupports("node-b", FeatureProtocolHello) || a.PeerSupports("node-b", "binary_codec") {
+		t.Error("Expected features up to the negotiated version only")
+	}
+
+	// A peer that predates versioning speaks version 1 until the minimum is raised
+	legacy := NewTransport("node-old", 0)
+	dialLegacy := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", b.ListenAddr())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		legacy.sendMessage(conn, &Message{Type: "handshake", Source: "node-old", Dest: "node-b", Timestamp: time.Now()}, false)
+		return conn
+	}
+	old := dialLegacy()
+	defer old.Close()
+	waitProtocol(b, "node-old", 1)
+	if b.PeerSupports("node-old", FeatureProtocolHello) {
+		t.Error("Expected no version 2 features with an unversioned peer")
+	}
+	b.SetMinProtocol(2)
+	refused := dialLegacy()
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected an unversioned peer to be refused, got %v", err)
+	}
+	if b.ProtocolCompatible(0, 0) || !b.ProtocolCompatible(2, 1) {
+		t.Error("Expected only version 2 peers to be dialed")
+	}
+
+	// Announcement versions are left out of signatures, as version 1 verifiers drop them
+	identity, _ := NewIdentity()
+	announce := &AnnounceMessage{ID: identity.NodeID(), MessageType: "announce", Protocol: ProtocolVersion, MinProtocol: 1}
+	identity.signAnnouncement(announce)
+	stripped := *announce
+	stripped.Protocol, stripped.MinProtocol = 0, 0
+	if !ed25519.Verify(announce.Key, announcementSigningBytes(&stripped), announce.Signature) {
+		t.Error("Expected the signature to verify without the version fields")
+	}
+}
+
+// TestTransportTLS tests encrypted peer connections and peer identity checks
+func TestTransportTLS(t *testing.T) {
+	start := func(id string, ca *tls.Certificate, roots *x509.CertPool, received chan *Message) (*Transport, int) {
+		t.Helper()
+		cert, err := NewNodeCertificate(id, ca)
+		if err != nil {
+			t.Fatalf("NewNodeCertificate failed: %v", err)
+		}
+		tr := NewTransport(id, 0)
+		if err := tr.EnableTLS(cert, roots); err != nil {
+			t.Fatalf("EnableTLS failed: %v", err)
+		}
+		tr.SetMessageHandler(func(peerID string, msg *Message) { received <- msg })
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Failed to start transport: %v", err)
+		}
+		t.Cleanup(tr.Stop)
+		_, port, _ := net.SplitHostPort(tr.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		return tr, portNum
+	}
+	exchange := func(a, b *Transport, bPort int, received chan *Message) {
+		t.Helper()
+		if err := a.ConnectToPeer(b.nodeID, "127.0.0.1", bPort); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		msg := &Message{Type: "data", Source: a.nodeID, Dest: b.nodeID, Payload: []byte("secret")}
+		for i := 0; i < 50 && b.SendMessage(a.nodeID, msg) != nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		select {
+		case got := <-received:
+			if string(got.Payload) != "secret" {
+				t.Errorf("Expected the message, got %+v", got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected message to arrive over TLS")
+		}
+	}
+
+	other, _ := NewNodeCertificate("node-x", nil)
+	if err := NewTransport("node-a", 0).EnableTLS(other, nil); err == nil {
+		t.Error("Expected a certificate for another node to be refused")
+	}
+
+	// Self-signed certificates are pinned on first contact
+	received := make(chan *Message, 4)
+	a, _ := start("node-a", nil, nil, received)
+	b, bPort := start("node-b", nil, nil, received)
+	exchange(a, b, bPort, received)
+	if _, ok := a.PeerFingerprint("node-b"); !ok {
+		t.Error("Expected node-b's certificate to be pinned")
+	}
+	a.connMu.RLock()
+	if conn, ok := a.connections["node-b"]; !ok {
+		t.Error("Expected a connection to node-b")
+	} else if _, ok := conn.Conn.(*tls.Conn); !ok {
+		t.Error("Expected the connection to be TLS")
+	}
+	a.connMu.RUnlock()
+
+	// A node claiming another's ID can't complete the connection
+	impostor := NewTransport("node-c", 0)
+	impostorCert, _ := NewNodeCertificate("node-z", nil)
+	impostor.tls = &transportTLS{cert: impostorCert, pins: make(map[string][32]byte)}
+	impostor.ConnectToPeer("node-b", "127.0.0.1", bPort)
+	time.Sleep(100 * time.Millisecond)
+	b.connMu.RLock()
+	if _, ok := b.connections["node-c"]; ok {
+		t.Error("Expected the impostor's connection to be refused")
+	}
+	b.connMu.RUnlock()
+
+	// A plaintext peer can't connect to a TLS peer
+	plain := NewTransport("node-p", 0)
+	plain.ConnectToPeer("node-b", "127.0.0.1", bPort)
+	time.Sleep(100 * time.Millisecond)
+	b.connMu.RLock()
+	if _, ok := b.connections["node-p"]; ok {
+		t.Error("Expected the plaintext peer to be refused")
+	}
+	b.connMu.RUnlock()
+
+	// With a mesh CA, only certificates it issued are accepted
+	ca, err := NewMeshCA("test mesh")
+	if err != nil {
+		t.Fatalf("NewMeshCA failed: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	c, _ := start("node-c", &ca, roots, received)
+	d, dPort := start("node-d", &ca, roots, received)
+	exchange(c, d, dPort, received)
+
+	outsider, _ := start("node-e", nil, roots, received)
+	if err := outsider.ConnectToPeer("node-d", "127.0.0.1", dPort); err == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	d.connMu.RLock()
+	if _, ok := d.connections["node-e"]; ok {
+		t.Error("Expected a certificate outside the mesh CA to be refused")
+	}
+	d.connMu.RUnlock()
+	if err := outsider.ConnectToPeer("node-c", "127.0.0.1", dPort); !errors.Is(err, ErrPeerCertificate) {
+		t.Errorf("Expected dialing the wrong node to fail its certificate check, got %v", err)
+	}
+}
+
+// TestTransportNoise tests Noise channels between peers and key pinning
+func TestTransportNoise(t *testing.T) {
+	received := make(chan *Message, 4)
+	start := func(id string) (*Transport, int) {
+		t.Helper()
+		key, err := NewNoiseKey()
+		if err != nil {
+			t.Fatalf("NewNoiseKey failed: %v", err)
+		}
+		tr := NewTransport(id, 0)
+		if err := tr.EnableNoise(key); err != nil {
+			t.Fatalf("EnableNoise failed: %v", err)
+		}
+		tr.SetMessageHandler(func(peerID string, msg *Message) { received <- msg })
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Failed to start transport: %v", err)
+		}
+		t.Cleanup(tr.Stop)
+		_, port, _ := net.SplitHostPort(tr.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		return tr, portNum
+	}
+	connected := func(tr *Transport, peerID string) bool {
+		tr.connMu.RLock()
+		defer tr.connMu.RUnlock()
+		_, ok := tr.connections[peerID]
+		return ok
+	}
+
+	a, _ := start("node-a")
+	b, bPort := start("node-b")
+	if err := a.ConnectToPeer("node-b", "127.0.0.1", bPort); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	msg := &Message{Type: "data", Source: "node-b", Dest: "node-a", Payload: []byte("secret")}
+	for i := 0; i < 50 && b.SendMessage("node-a", msg) != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case got := <-received:
+		if string(got.Payload) != "secret" {
+			t.Errorf("Expected the message, got %+v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected message to arrive over Noise")
+	}
+	if pinned, ok := a.PeerNoiseKey("node-b"); !ok || !bytes.Equal(pinned, b.NoisePublicKey()) {
+		t.Error("Expected node-b's key to be pinned")
+	}
+	if pinned, ok := b.PeerNoiseKey("node-a"); !ok || !bytes.Equal(pinned, a.NoisePublicKey()) {
+		t.Error("Expected node-a's key to be pinned")
+	}
+
+	// A node reusing a pinned ID with another key is refused
+	b.connMu.RLock()
+	original := b.connections["node-a"]
+	b.connMu.RUnlock()
+	impostor, _ := start("node-a")
+	impostor.ConnectToPeer("node-b", "127.0.0.1", bPort)
+	time.Sleep(100 * time.Millisecond)
+	b.connMu.RLock()
+	if b.connections["node-a"] != original {
+		t.Error("Expected the impostor's connection to be refused")
+	}
+	b.connMu.RUnlock()
+
+	// Dialing a node whose key differs from the pin fails
+	_, cPort := start("node-c")
+	other, _ := NewNoiseKey()
+	a.PinNoiseKey("node-c", other.PublicKey().Bytes())
+	if err := a.ConnectToPeer("node-c", "127.0.0.1", cPort); !errors.Is(err, ErrNoiseKey) {
+		t.Errorf("Expected a key mismatch, got %v", err)
+	}
+
+	// Plaintext peers can't connect to Noise peers
+	plain := NewTransport("node-p", 0)
+	plain.ConnectToPeer("node-b", "127.0.0.1", bPort)
+	time.Sleep(100 * time.Millisecond)
+	if connected(b, "node-p") {
+		t.Error("Expected the plaintext peer to be refused")
+	}
+	if err := NewTransport("node-t", 0).EnableNoise(nil); err == nil {
+		t.Error("Expected a missing key to be refused")
+	}
+
+	// Writes larger than a frame are split and reassembled
+	left, right := net.Pipe()
+	k1 := make([]byte, 32)
+	send1, _ := newNoiseCipher(k1)
+	recv1, _ := newNoiseCipher(k1)
+	w := newNoiseConn(left, send1, nil)
+	r := newNoiseConn(right, nil, recv1)
+	big := bytes.Repeat([]byte("x"), 3*noiseMaxFrame)
+	go w.Write(big)
+	got := make([]byte, len(big))
+	if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, big) {
+		t.Errorf("Expected large writes to survive framing, got %v", err)
+	}
+}
+
+// TestTransportWebSocket tests peer links over WebSocket, from a transport and from a
+// client writing frames itself as a browser would
+func TestTransportWebSocket(t *testing.T) {
+	received := make(chan *Message, 8)
+	a := NewTransport("node-a", 0)
+	a.SetMessageHandler(func(peerID string, msg *Message) { received <- msg })
+	if err := a.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	t.Cleanup(a.Stop)
+	if err := a.ListenWebSocket("127.0.0.1:0"); err != nil {
+		t.Fatalf("ListenWebSocket failed: %v", err)
+	}
+	wsURL := "ws://" + a.WebSocketAddr()
+
+	bReceived := make(chan *Message, 8)
+	b := NewTransport("node-b", 0)
+	b.SetMessageHandler(func(peerID string, msg *Message) { bReceived <- msg })
+	if err := b.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	t.Cleanup(b.Stop)
+	if err := b.ConnectWebSocket("node-a", wsURL); err != nil {
+		t.Fatalf("ConnectWebSocket failed: %v", err)
+	}
+	large := bytes.Repeat([]byte("x"), 20000)
+	if err := b.SendMessage("node-a", &Message{Type: "data", Source: "node-b", Dest: "node-a", Payload: large}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got.Payload, large) {
+			t.Errorf("Expected the large message intact, got %d bytes", len(got.Payload))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the message to arrive over WebSocket")
+	}
+	for i := 0; i < 50 && a.SendMessage("node-b", &Message{Type: "data", Source: "node-a", Dest: "node-b", Payload: []byte("back")}) != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case got := <-bReceived:
+		if string(got.Payload) != "back" {
+			t.Errorf("Expected the reply, got %+v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the reply to arrive over WebSocket")
+	}
+
+	// A browser sends each length-prefixed frame as one binary message
+	conn, err := dialWebSocket(wsURL+WebSocketPath, time.Second, MaxMessageSize)
+	if err != nil {
+		t.Fatalf("dialWebSocket failed: %v", err)
+	}
+	defer conn.Close()
+	browser := conn.(*wsConn)
+	for _, msg := range []*Message{
+		{Type: "handshake", Source: "browser", Dest: "node-a", Timestamp: time.Now()},
+		{Type: "data", Source: "browser", Dest: "node-a", Payload: []byte("from the browser"), Timestamp: time.Now()},
+	} {
+		data, _ := json.Marshal(msg)
+		frame := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		if err := browser.writeFrame(wsOpBinary, append(frame, data...)); err != nil {
+			t.Fatalf("writeFrame failed: %v", err)
+		}
+	}
+	select {
+	case got := <-received:
+		if got.Source != "browser" || string(got.Payload) != "from the browser" {
+			t.Errorf("Expected the browser's message, got %+v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the browser's message to arrive")
+	}
+
+	// Text messages end the link
+	browser.writeFrame(wsOpText, []byte("hello"))
+	browser.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var netErr net.Error
+	if _, err := io.ReadAll(browser); errors.As(err, &netErr) && netErr.Timeout() {
+		t.Error("Expected the link to close on a text message")
+	}
+
+	// Plain HTTP requests are told to upgrade
+	resp, err := http.Get("http://" + a.WebSocketAddr() + WebSocketPath)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("Expected 426, got %d", resp.StatusCode)
+	}
+
+	a.Stop()
+	if a.WebSocketAddr() != "" {
+		t.Error("Expected the WebSocket listener to stop with the transport")
+	}
+}
+
+// TestTransportDatagrams tests that flagged messages go as datagrams once the path is
+// confirmed, and that large ones and forged datagrams don't
+func TestTransportDatagrams(t *testing.T) {
+	received := make(chan *Message, 16)
+	a := NewTransport("node-a", 0)
+	a.SetMessageHandler(func(peerID string, msg *Message) {
+		if peerID == "node-b" {
+			received <- msg
+		}
+	})
+	b := NewTransport("node-b", 0)
+	b.SetMessageHandler(func(string, *Message) {})
+	for _, tr := range []*Transport{a, b} {
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Failed to start transport: %v", err)
+		}
+		t.Cleanup(tr.Stop)
+		if tr.DatagramAddr() == "" {
+			t.Fatal("Expected a datagram socket")
+		}
+	}
+	_, port, _ := net.SplitHostPort(a.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := b.ConnectToPeer("node-a", "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	for i := 0; i < 100 && !(a.PeerDatagrams("node-b") && b.PeerDatagrams("node-a")); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !a.PeerDatagrams("node-b") || !b.PeerDatagrams("node-a") {
+		t.Fatal("Expected the datagram path to be confirmed both ways")
+	}
+	next := func() *Message {
+		t.Helper()
+		select {
+		case msg := <-received:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected a message")
+			return nil
+		}
+	}
+
+	large := make([]byte, 4*MaxDatagramSize) // Random, so it doesn't compress to fit
+	rand.Read(large)
+	sends := []struct {
+		msg      *Message
+		datagram bool
+	}{
+		{&Message{Type: "route_update", Metadata: map[string]string{"probe": "1"}, Datagram: true}, true},
+		{&Message{Type: "data", Payload: large, Datagram: true}, false},
+		{&Message{Type: "data", Payload: []byte("reliable")}, false},
+	}
+	for _, send := range sends {
+		send.msg.Source, send.msg.Dest, send.msg.Timestamp = "node-b", "node-a", time.Now()
+		if err := b.SendMessage("node-a", send.msg); err != nil {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+		if got := next(); got.Type != send.msg.Type || got.Datagram != send.datagram || !bytes.Equal(got.Payload, send.msg.Payload) {
+			t.Errorf("Expected %s with datagram %v, got %s with datagram %v", send.msg.Type, send.datagram, got.Type, got.Datagram)
+		}
+	}
+
+	// A datagram sealed with any key but the one node-a gave node-b is dropped
+	forger := NewTransport("node-b", 0)
+	udpAddr, _ := net.ResolveUDPAddr("udp", a.DatagramAddr())
+	path := &datagramPath{addr: udpAddr, key: bytes.Repeat([]byte{7}, datagramKeySize)}
+	forger.udp, _ = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer forger.udp.Close()
+	forger.sendDatagram(&Connection{}, path, &Message{Type: "route_update", Source: "node-b", Dest: "node-a", Timestamp: time.Now()})
+	select {
+	case msg := <-received:
+		t.Errorf("Expected the forged datagram to be dropped, got %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestNodeIdentity tests node IDs derived from keys and their proof in handshakes
+func TestNodeIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.pem")
+	identity, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatalf("LoadOrCreateIdentity failed: %v", err)
+	}
+	reloaded, err := LoadOrCreateIdentity(path)
+	if err != nil || reloaded.NodeID() != identity.NodeID() {
+		t.Fatalf("Expected the stored identity to be reloaded, got %v", err)
+	}
+	if !strings.HasPrefix(identity.NodeID(), "node-") || len(identity.NodeID()) != len("node-")+16 {
+		t.Errorf("Unexpected node ID format %q", identity.NodeID())
+	}
+	if node := NewNodeWithIdentity(identity, "Test", "10.0.0.1", ""); node.ID != identity.NodeID() {
+		t.Errorf("Expected the node ID to be derived from the key, got %s", node.ID)
+	}
+
+	start := func(id string, identity *Identity) (*Transport, int) {
+		t.Helper()
+		tr := NewTransport(id, 0)
+		if identity != nil {
+			if err := tr.SetIdentity(identity); err != nil {
+				t.Fatalf("SetIdentity failed: %v", err)
+			}
+		}
+		if err := tr.Start(); err != nil {
+			t.Fatalf("Failed to start transport: %v", err)
+		}
+		t.Cleanup(tr.Stop)
+		_, port, _ := net.SplitHostPort(tr.ListenAddr())
+		portNum, _ := strconv.Atoi(port)
+		return tr, portNum
+	}
+	waitConnected := func(tr *Transport, peerID string) bool {
+		for i := 0; i < 20; i++ {
+			tr.connMu.RLock()
+			_, ok := tr.connections[peerID]
+			tr.connMu.RUnlock()
+			if ok {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	idA, _ := NewIdentity()
+	idB, _ := NewIdentity()
+	a, _ := start(idA.NodeID(), idA)
+	b, bPort := start(idB.NodeID(), idB)
+	if err := a.SetIdentity(idB); err == nil {
+		t.Error("Expected another node's identity to be refused")
+	}
+	if err := a.ConnectToPeer(idB.NodeID(), "127.0.0.1", bPort); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if !waitConnected(b, idA.NodeID()) || !a.PeerProven(idB.NodeID()) || !b.PeerProven(idA.NodeID()) {
+		t.Error("Expected both peers to prove their IDs")
+	}
+
+	// Claiming a derived ID without its key fails
+	b.connMu.RLock()
+	original := b.connections[idA.NodeID()]
+	b.connMu.RUnlock()
+	idC, _ := NewIdentity()
+	impostor := NewTransport(idA.NodeID(), 0)
+	impostor.identity = idC
+	impostor.ConnectToPeer(idB.NodeID(), "127.0.0.1", bPort)
+	time.Sleep(100 * time.Millisecond)
+	b.connMu.RLock()
+	if b.connections[idA.NodeID()] != original {
+		t.Error("Expected the impostor's connection to be refused")
+	}
+	b.connMu.RUnlock()
+
+	// So does claiming it without offering any key, which mustn't unprove the real node
+	unkeyed := NewTransport(idA.NodeID(), 0)
+	unkeyed.ConnectToPeer(idB.NodeID(), "127.0.0.1", bPort)
+	time.Sleep(100 * time.Millisecond)
+	b.connMu.RLock()
+	if b.connections[idA.NodeID()] != original || !b.PeerProven(idA.NodeID()) {
+		t.Error("Expected a connection claiming a derived ID without proof to be refused")
+	}
+	b.connMu.RUnlock()
+	if !derivedNodeID(idA.NodeID()) || derivedNodeID("node-legacy") || derivedNodeID(strings.ToUpper(idA.NodeID())) {
+		t.Error("Expected only key-derived IDs to be recognized")
+	}
+	if err := a.ConnectToPeer("node-zzzz", "127.0.0.1", bPort); !errors.Is(err, ErrIdentityProof) {
+		t.Errorf("Expected dialing a node under the wrong ID to fail, got %v", err)
+	}
+
+	// Nodes without an identity still connect, unproven
+	legacy := NewTransport("node-legacy", 0)
+	if err := legacy.ConnectToPeer(idB.NodeID(), "127.0.0.1", bPort); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if !waitConnected(b, "node-legacy") || b.PeerProven("node-legacy") {
+		t.Error("Expected the legacy node to connect unproven")
+	}
+
+	// Requiring proof refuses peers without an identity, both ways
+	idD, _ := NewIdentity()
+	strict, strictPort := start(idD.NodeID(), idD)
+	strict.SetRequireProof(true)
+	legacy2 := NewTransport("node-legacy2", 0)
+	legacy2.ConnectToPeer(idD.NodeID(), "127.0.0.1", strictPort)
+	if waitConnected(strict, "node-legacy2") {
+		t.Error("Expected an unproven dialer to be refused")
+	}
+	plain, plainPort := start("node-plain", nil)
+	if err := strict.ConnectToPeer("node-plain", "127.0.0.1", plainPort); !errors.Is(err, ErrIdentityProof) {
+		t.Errorf("Expected dialing an unproven peer to fail, got %v", err)
+	}
+	plain.SetRequireProof(true)
+	if err := plain.ConnectToPeer(idD.NodeID(), "127.0.0.1", strictPort); err == nil {
+		t.Error("Expected dialing without an identity to fail when proof is required")
+	}
+	if err := strict.ConnectToPeer(idB.NodeID(), "127.0.0.1", bPort); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if !strict.PeerProven(idB.NodeID()) || !waitConnected(b, idD.NodeID()) || !b.PeerProven(idD.NodeID()) {
+		t.Error("Expected proven peers to connect when proof is required")
+	}
+}
+
+// TestMessageSigning tests that messages are signed by their source and forgeries dropped
+func TestMessageSigning(t *testing.T) {
+	idA, _ := NewIdentity()
+	idB, _ := NewIdentity()
+	msg := &Message{Type: "data", Source: idA.NodeID(), Dest: "x", Payload: []byte("hi"), Timestamp: time.Now(), Metadata: map[string]string{"k": "v"}}
+	signed := idA.sign(msg)
+	if msg.Signature != nil {
+		t.Error("Expected signing to leave the original message untouched")
+	}
+	tr := NewTransport("node-r", 0)
+	if err := tr.verifySignature(signed); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	relayed := *signed
+	relayed.HopLimit = 3
+	relayed.Metadata = map[string]string{"k": "v", TraceparentKey: "00-abc"}
+	if err := tr.verifySignature(&relayed); err != nil {
+		t.Errorf("Expected relays' hop limit and trace context to be unsigned, got %v", err)
+	}
+	tampered := *signed
+	tampered.Payload = []byte("bye")
+	if err := tr.verifySignature(&tampered); !errors.Is(err, ErrForgedMessage) {
+		t.Errorf("Expected a tampered payload to be caught, got %v", err)
+	}
+	borrowed := *idB.sign(msg)
+	if err := tr.verifySignature(&borrowed); !errors.Is(err, ErrForgedMessage) {
+		t.Errorf("Expected another node's signature to be refused, got %v", err)
+	}
+	if err := tr.verifySignature(&Message{Type: "data", Source: idA.NodeID(), Dest: "x"}); !errors.Is(err, ErrForgedMessage) {
+		t.Errorf("Expected an unsigned message from an identity-derived ID to be refused, got %v", err)
+	}
+	if err := tr.verifySignature(&Message{Type: "data", Source: "node-legacy", Dest: "x"}); err != nil {
+		t.Errorf("Expected an unsigned message from a legacy ID to be accepted, got %v", err)
+	}
+
+	// Over a connection, forgeries are dropped and reported
+	received := make(chan *Message, 4)
+	forged := make(chan error, 4)
+	a := NewTransport(idA.NodeID(), 0)
+	a.SetIdentity(idA)
+	b := NewTransport(idB.NodeID(), 0)
+	b.SetIdentity(idB)
+	b.SetMessageHandler(func(peerID string, msg *Message) { received <- msg })
+	b.SetSignatureFailureHandler(func(peerID string, msg *Message, err error) { forged <- err })
+	if err := b.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer b.Stop()
+	_, port, _ := net.SplitHostPort(b.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := a.ConnectToPeer(idB.NodeID(), "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer a.DisconnectPeer(idB.NodeID())
+
+	a.SendMessage(idB.NodeID(), &Message{Type: "data", Source: idA.NodeID(), Dest: idB.NodeID(), Payload: []byte("ok")})
+	select {
+	case got := <-received:
+		if len(got.Signature) == 0 {
+			t.Error("Expected the message to arrive signed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the signed message to arrive")
+	}
+
+	a.connMu.RLock()
+	conn := a.connections[idB.NodeID()].Conn
+	a.connMu.RUnlock()
+	a.sendMessage(conn, &tampered, false)
+	unsigned := &Message{Type: "data", Source: idA.NodeID(), Dest: idB.NodeID()}
+	data, _ := json.Marshal(unsigned)
+	binary.Write(conn, binary.BigEndian, uint32(len(data)))
+	conn.Write(data)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-forged:
+			if !errors.Is(err, ErrForgedMessage) {
+				t.Errorf("Expected a forgery report, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected the forged message to be reported")
+		}
+	}
+	select {
+	case got := <-received:
+		t.Errorf("Expected forged messages to be dropped, got %+v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestSignedAnnouncements tests that announcements are signed and spoofed ones ignored
+func TestSignedAnnouncements(t *testing.T) {
+	identity, _ := NewIdentity()
+	sender := NewDiscovery(identity.NodeID(), "Proxy", DefaultPort, true)
+	if err := sender.SetIdentity(identity); err != nil {
+		t.Fatalf("SetIdentity failed: %v", err)
+	}
+	announce := func() *AnnounceMessage {
+		msg := &AnnounceMessage{ID: identity.NodeID(), Port: 9999, HasInternet: true, MessageType: "announce"}
+		data, err := sender.encodeAnnouncement(msg)
+		if err != nil {
+			t.Fatalf("encodeAnnouncement failed: %v", err)
+		}
+		var decoded AnnounceMessage
+		json.Unmarshal(data, &decoded)
+		return &decoded
+	}
+
+	d := NewDiscovery("node-r", "Receiver", DefaultPort, false)
+	d.macResolver = nil
+	d.handlePeerAnnounce(announce(), "10.0.0.2")
+	if peer, ok := d.GetPeer(identity.NodeID()); !ok || !peer.Signed {
+		t.Fatal("Expected the signed announcement to be accepted")
+	}
+
+	spoofed := announce()
+	spoofed.Port = 1
+	d.handlePeerAnnounce(spoofed, "10.0.0.66")
+	stale := announce()
+	stale.SentAt -= int64(2 * AnnouncementMaxAge / time.Second)
+	stale.Signature = ed25519.Sign(identity.PrivateKey, announcementSigningBytes(stale))
+	d.handlePeerAnnounce(stale, "10.0.0.66")
+	other, _ := NewIdentity()
+	borrowed := announce()
+	borrowed.Key = other.PublicKey()
+	borrowed.Signature = ed25519.Sign(other.PrivateKey, announcementSigningBytes(borrowed))
+	d.handlePeerAnnounce(borrowed, "10.0.0.66")
+	downgraded := &AnnounceMessage{ID: identity.NodeID(), Port: 1, HasInternet: true, MessageType: "announce"}
+	d.handlePeerAnnounce(downgraded, "10.0.0.66")
+	if peer, _ := d.GetPeer(identity.NodeID()); peer.IP != "10.0.0.2" || peer.Port != 9999 {
+		t.Errorf("Expected spoofed announcements to be ignored, got %+v", peer)
+	}
+	if d.RejectedAnnouncements() != 4 {
+		t.Errorf("Expected 4 rejected announcements, got %d", d.RejectedAnnouncements())
+	}
+
+	// Unsigned announcements are only accepted until signing is required
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-legacy", Port: 9999, MessageType: "announce"}, "10.0.0.3")
+	d.SetRequireSigned(true)
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-fake", Port: 9999, HasInternet: true, MessageType: "announce"}, "10.0.0.4")
+	if _, ok := d.GetPeer("node-legacy"); !ok {
+		t.Error("Expected unsigned announcements to be accepted by default")
+	}
+	if _, ok := d.GetPeer("node-fake"); ok {
+		t.Error("Expected unsigned announcements to be ignored once signing is required")
+	}
+}
+
+// TestAnnouncementSequence tests that stale announcements don't overwrite fresher ones
+// and that the sequence survives a restart through its file
+func TestAnnouncementSequence(t *testing.T) {
+	d := NewDiscovery("node-r", "Receiver", DefaultPort, false)
+	d.macResolver = nil
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-p", Port: 1, Seq: 5, MessageType: "announce"}, "10.0.0.2")
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-p", Port: 2, Seq: 7, MessageType: "announce"}, "10.0.0.2")
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-p", Port: 3, Seq: 6, MessageType: "announce"}, "10.0.0.2")
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-p", Port: 4, Seq: 7, MessageType: "announce"}, "10.0.0.2")
+	if peer, _ := d.GetPeer("node-p"); peer.Port != 2 || peer.Seq != 7 {
+		t.Errorf("Expected the freshest announcement's state, got %+v", peer)
+	}
+	if seq, ok := d.PeerSequence("node-p"); !ok || seq != 7 {
+		t.Errorf("Expected latest sequence 7, got %d", seq)
+	}
+	if d.StaleAnnouncements() != 2 {
+		t.Errorf("Expected 2 stale announcements, got %d", d.StaleAnnouncements())
+	}
+
+	// Peers without sequence numbers are accepted as before
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-legacy", Port: 1, MessageType: "announce"}, "10.0.0.3")
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-legacy", Port: 2, MessageType: "announce"}, "10.0.0.3")
+	if peer, _ := d.GetPeer("node-legacy"); peer.Port != 2 {
+		t.Errorf("Expected unsequenced announcements to be accepted, got %+v", peer)
+	}
+
+	// A sequence file set far ahead of the clock is continued from after a restart
+	path := filepath.Join(t.TempDir(), "announce.seq")
+	ahead := initialSequence() + 1_000_000
+	os.WriteFile(path, []byte(strconv.FormatUint(ahead, 10)), 0600)
+	sender := NewDiscovery("node-s", "Sender", DefaultPort, false)
+	if err := sender.SetSequenceFile(path); err != nil {
+		t.Fatalf("SetSequenceFile failed: %v", err)
+	}
+	first := sender.nextSequence()
+	if first <= ahead {
+		t.Errorf("Expected the sequence to continue past %d, got %d", ahead, first)
+	}
+	restarted := NewDiscovery("node-s", "Sender", DefaultPort, false)
+	if err := restarted.SetSequenceFile(path); err != nil {
+		t.Fatalf("SetSequenceFile failed: %v", err)
+	}
+	if next := restarted.nextSequence(); next <= first {
+		t.Errorf("Expected the sequence to keep growing across restarts, got %d after %d", next, first)
+	}
+}
+
+// TestNetworkHints tests that peers recognize shared personal networks from signed
+// announcements, without outsiders learning them
+func TestNetworkHints(t *testing.T) {
+	identity, _ := NewIdentity()
+	sender := NewMeshAppWithIdentity(identity, "Sender", "10.0.0.2", "")
+	for _, id := range []string{"net-home", "net-private"} {
+		sender.PersonalNetworkMgr.CreateNetwork(id, id, sender.Node.ID).AddMember(&NetworkMember{NodeID: sender.Node.ID})
+	}
+	announce := func() *AnnounceMessage {
+		sender.Discovery.mu.Lock()
+		msg := sender.Discovery.announcementLocked()
+		sender.Discovery.mu.Unlock()
+		data, err := sender.Discovery.encodeAnnouncement(&msg)
+		if err != nil {
+			t.Fatalf("encodeAnnouncement failed: %v", err)
+		}
+		var decoded AnnounceMessage
+		json.Unmarshal(data, &decoded)
+		return &decoded
+	}
+	first, second := announce(), announce()
+	if len(first.NetworkHints) != 2 || slices.Equal(first.NetworkHints, second.NetworkHints) {
+		t.Errorf("Expected two hints that change with every announcement, got %v and %v", first.NetworkHints, second.NetworkHints)
+	}
+	if slices.Contains(first.NetworkHints, networkHint("net-home", "node-other", first.Seq)) {
+		t.Error("Expected hints to differ between nodes")
+	}
+
+	receiver := NewMeshApp("node-r", "Receiver", "10.0.0.1", "")
+	receiver.Discovery.macResolver = nil
+	receiver.PersonalNetworkMgr.CreateNetwork("net-home", "Home", "node-r").AddMember(&NetworkMember{NodeID: "node-r"})
+	receiver.PersonalNetworkMgr.CreateNetwork("net-work", "Work", "node-r").AddMember(&NetworkMember{NodeID: "node-r"})
+	receiver.Discovery.handlePeerAnnounce(first, "10.0.0.2")
+	peer, ok := receiver.Discovery.GetPeer(sender.Node.ID)
+	if !ok || !peer.Signed {
+		t.Fatal("Expected the signed announcement with hints to be accepted")
+	}
+	if !slices.Equal(peer.Networks, []string{"net-home"}) {
+		t.Errorf("Expected only the shared network to be recognized, got %v", peer.Networks)
+	}
+	if !receiver.isPriorityPeer(peer) {
+		t.Error("Expected a peer sharing a network to be dialed eagerly")
+	}
+	peers := receiver.ListPeers(PeerQuery{Network: "net-home"})
+	if len(peers) != 1 || peers[0].ID != sender.Node.ID || peers[0].Trust != TrustUnknown {
+		t.Errorf("Expected the peer listed under the shared network without member trust, got %+v", peers)
+	}
+	if peers := receiver.ListPeers(PeerQuery{Network: "net-work"}); len(peers) != 0 {
+		t.Errorf("Expected no peers in the network the sender isn't in, got %+v", peers)
+	}
+
+	outsider := NewDiscovery("node-o", "Outsider", DefaultPort, false)
+	outsider.macResolver = nil
+	outsider.handlePeerAnnounce(second, "10.0.0.2")
+	if peer, ok := outsider.GetPeer(sender.Node.ID); !ok || len(peer.Networks) != 0 {
+		t.Error("Expected a node without networks to recognize none")
+	}
+}
+
+func TestPowerStatus(t *testing.T) {
+	identity, _ := NewIdentity()
+	sender := NewMeshAppWithIdentity(identity, "Sender", "10.0.0.2", "")
+	sender.SetPowerStatus(47, false)
+	sender.Discovery.mu.Lock()
+	msg := sender.Discovery.announcementLocked()
+	sender.Discovery.mu.Unlock()
+	data, err := sender.Discovery.encodeAnnouncement(&msg)
+	if err != nil {
+		t.Fatalf("encodeAnnouncement failed: %v", err)
+	}
+	var decoded AnnounceMessage
+	json.Unmarshal(data, &decoded)
+	if decoded.Power == nil || *decoded.Power != (PowerStatus{Battery: 45}) {
+		t.Errorf("Expected the charge announced in steps, got %+v", decoded.Power)
+	}
+
+	receiver := NewDiscovery("node-r", "Receiver", DefaultPort, false)
+	receiver.macResolver = nil
+	receiver.handlePeerAnnounce(&decoded, "10.0.0.2")
+	peer, ok := receiver.GetPeer(sender.Node.ID)
+	if !ok || !peer.Signed || !peer.Power.Equal(decoded.Power) {
+		t.Fatalf("Expected the signed announcement to be accepted with its battery, got %+v", peer)
+	}
+
+	if cost, plugged := calculateCost(&Peer{RSSI: -50, Power: peer.Power}), calculateCost(&Peer{RSSI: -50, Power: &PowerStatus{Battery: 45, Charging: true}}); cost <= plugged {
+		t.Errorf("Expected a peer on battery to cost more than a plugged-in one, got %d and %d", cost, plugged)
+	}
+	if calculateCost(&Peer{RSSI: -50}) != 50 {
+		t.Error("Expected no penalty for a peer that doesn't announce its battery")
+	}
+
+	pm := NewProxyManager(NewNode("node-1", "Test Node", "192.168.1.1", ""))
+	pm.RegisterProxy(&Peer{NodeID: "drained", HasInternet: true, RSSI: -30, Power: &PowerStatus{Battery: 10}})
+	pm.RegisterProxy(&Peer{NodeID: "phone", HasInternet: true, RSSI: -40, Power: &PowerStatus{Battery: 80}})
+	pm.RegisterProxy(&Peer{NodeID: "plugged", HasInternet: true, RSSI: -70, Power: &PowerStatus{Battery: 30, Charging: true}})
+	if best, _ := pm.SelectBestProxy(); best == nil || best.NodeID != "plugged" {
+		t.Errorf("Expected the plugged-in proxy, got %+v", best)
+	}
+	pm.UnregisterProxy("plugged")
+	if best, _ := pm.SelectBestProxy(); best == nil || best.NodeID != "phone" {
+		t.Errorf("Expected the charged proxy over the drained one, got %+v", best)
+	}
+}
+
+func TestElectHotspot(t *testing.T) {
+	phone := HotspotCandidate{NodeID: "node-a", CanHost: true, Battery: 90}
+	plugged := HotspotCandidate{NodeID: "node-b", CanHost: true, Battery: 40, Charging: true}
+	capped := HotspotCandidate{NodeID: "node-c", CanHost: true, Battery: 60, Charging: true, DataLimited: true}
+	drained := HotspotCandidate{NodeID: "node-d", CanHost: true, Battery: 10}
+	tablet := HotspotCandidate{NodeID: "node-e", Battery: 100, Charging: true}
+
+	tests := []struct {
+		candidates []HotspotCandidate
+		want       string
+	}{
+		{[]HotspotCandidate{phone, plugged, capped, drained, tablet}, "node-b"},
+		{[]HotspotCandidate{phone, capped, drained}, "node-c"},
+		{[]HotspotCandidate{phone, drained}, "node-a"},
+		{[]HotspotCandidate{drained, tablet}, "node-d"},
+		{[]HotspotCandidate{tablet}, ""},
+		{[]HotspotCandidate{plugged, {NodeID: "node-f", CanHost: true, Battery: 5, Hosting: true}}, "node-f"},
+		{[]HotspotCandidate{{NodeID: "node-z", CanHost: true, Battery: -1}, {NodeID: "node-y", CanHost: true, Battery: -1}}, "node-y"},
+	}
+	for i, tt := range tests {
+		if got := ElectHotspot(tt.candidates); got != tt.want {
+			t.Errorf("Case %d: expected %q elected, got %q", i, tt.want, got)
+		}
+	}
+}
+
+func TestClockJumps(t *testing.T) {
+	base := time.Now()
+	at := func(mono, wall, boot time.Duration, hasBoot bool) clockSample {
+		return clockSample{wall: base.Round(0).Add(wall), mono: base.Add(mono), boot: boot, hasBoot: hasBoot}
+	}
+	start := at(0, 0, time.Minute, true)
+
+	// The wall clock set an hour ahead while the host was awake
+	slept, jumped := at(5*time.Second, time.Hour+5*time.Second, time.Minute+5*time.Second, true).since(start)
+	if slept != 0 || jumped != time.Hour {
+		t.Errorf("Expected a one hour jump without sleep, got slept %v jumped %v", slept, jumped)
+	}
+
+	// Ten minutes asleep, with the wall clock keeping time
+	slept, jumped = at(5*time.Second, 10*time.Minute, 11*time.Minute, true).since(start)
+	if slept != 10*time.Minute-5*time.Second || jumped != 0 {
+		t.Errorf("Expected sleep without a jump, got slept %v jumped %v", slept, jumped)
+	}
+
+	// Without a boot clock, a backward step is a jump and a forward one counts as sleep
+	plain := at(0, 0, 0, false)
+	slept, jumped = at(5*time.Second, -time.Hour+5*time.Second, 0, false).since(plain)
+	if slept != 0 || jumped != -time.Hour {
+		t.Errorf("Expected a backward jump, got slept %v jumped %v", slept, jumped)
+	}
+	slept, jumped = at(5*time.Second, time.Hour, 0, false).since(plain)
+	if slept != time.Hour-5*time.Second || jumped != 0 {
+		t.Errorf("Expected a forward step to count as sleep, got slept %v jumped %v", slept, jumped)
+	}
+
+	// Monotonic instants ignore the wall clock entirely
+	sent := monoAt(base)
+	if rtt := time.Duration(monoAt(base.Add(20*time.Millisecond)) - sent); rtt != 20*time.Millisecond {
+		t.Errorf("Expected a 20ms round trip, got %v", rtt)
+	}
+
+	// A management request can't be replayed by setting the clock back after its ID
+	// was forgotten
+	s := newMgmtState()
+	wall := base.Round(0)
+	if !s.firstUse("req-1", wall, wall) {
+		t.Fatal("Expected the first use to be accepted")
+	}
+	if s.firstUse("req-1", wall, wall) {
+		t.Error("Expected an immediate replay to be refused")
+	}
+	later := wall.Add(2 * MgmtRequestMaxAge)
+	if !s.firstUse("req-2", later, later) {
+		t.Fatal("Expected a fresh request to be accepted")
+	}
+	if s.firstUse("req-1", wall, wall) {
+		t.Error("Expected a replay after the clock was set back to be refused")
+	}
+	if !s.firstUse("req-3", later.Add(time.Second), later.Add(time.Second)) {
+		t.Error("Expected requests newer than forgotten ones to be accepted")
+	}
+
+	// Sharing time is attributed by wall time even when the samples carry monotonic readings
+	var log sharingLog
+	log.mu.Lock()
+	noon := time.Date(2026, 1, 1, 12, 30, 0, 0, time.UTC)
+	log.addLocked(noon, noon.Add(time.Hour))
+	log.mu.Unlock()
+	if log.hours[12] != 30*time.Minute || log.hours[13] != 30*time.Minute {
+		t.Errorf("Expected the hour split across 12:00 and 13:00, got %v and %v", log.hours[12], log.hours[13])
+	}
+}
+
+func TestDiscoveryUnicastReplies(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer peer.Close()
+	_, port, _ := net.SplitHostPort(peer.LocalAddr().String())
+
+	d := NewDiscovery("node-r", "Receiver", DefaultPort, false)
+	d.macResolver = nil
+	d.multicastAddr = "224.0.0.250:" + port
+	receive := func() *AnnounceMessage {
+		buf := make([]byte, 4096)
+		peer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		data, _, err := decodeFrame(buf[:n], len(buf)*8)
+		if err != nil {
+			t.Fatalf("Failed to decode reply: %v", err)
+		}
+		var msg AnnounceMessage
+		json.Unmarshal(data, &msg)
+		return &msg
+	}
+
+	// Peers that receive multicast aren't answered
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-p", Port: 1, Seq: 1, MessageType: "announce"}, "127.0.0.1")
+	if reply := receive(); reply != nil {
+		t.Fatalf("Expected no unicast reply, got %+v", reply)
+	}
+
+	// A peer that can't is answered at its address, once per interval
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-p", Port: 1, Seq: 2, MessageType: "announce", UnicastOnly: true}, "127.0.0.1")
+	if reply := receive(); reply == nil || reply.ID != "node-r" || reply.MessageType != "announce" {
+		t.Fatalf("Expected our announcement by unicast, got %+v", reply)
+	}
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-p", Port: 1, Seq: 3, MessageType: "announce", UnicastOnly: true}, "127.0.0.1")
+	if reply := receive(); reply != nil {
+		t.Errorf("Expected replies to be rate limited, got %+v", reply)
+	}
+
+	// Stale announcements aren't answered either
+	d.replied = make(map[string]time.Time)
+	d.handlePeerAnnounce(&AnnounceMessage{ID: "node-p", Port: 1, Seq: 2, MessageType: "announce", UnicastOnly: true}, "127.0.0.1")
+	if reply := receive(); reply != nil {
+		t.Errorf("Expected a replayed announcement not to be answered, got %+v", reply)
+	}
+
+	if !d.SetUnicastReplies(true) || d.SetUnicastReplies(true) {
+		t.Error("Expected SetUnicastReplies to report changes only")
+	}
+	if msg := d.announcementLocked(); !msg.UnicastOnly {
+		t.Error("Expected our announcements to ask for unicast answers")
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+	id, _ := NewIdentity()
+	g := newReplayGuard()
+	accept := func(seq uint64) bool {
+		return g.accept(id.sign(&Message{Source: id.NodeID(), Seq: seq}))
+	}
+	if !accept(1000) || !accept(1002) || !accept(1001) {
+		t.Error("Expected new numbers to be accepted, even out of order")
+	}
+	if accept(1001) || g.duplicates.Load() != 1 {
+		t.Error("Expected a duplicate to be dropped and counted")
+	}
+	if !accept(1000+ReplayWindow+5) || accept(1004) || g.stale.Load() != 1 {
+		t.Error("Expected numbers behind the window to be dropped as stale")
+	}
+	if !accept(1000+ReplayWindow+4) || accept(1000+ReplayWindow+4) {
+		t.Error("Expected the window to slide with the highest number")
+	}
+	if !g.accept(&Message{Source: "node-a"}) || !g.accept(&Message{Source: "node-a"}) {
+		t.Error("Expected unnumbered messages from older nodes to be accepted")
+	}
+	g.accept(&Message{Source: id.NodeID(), Seq: math.MaxUint64})
+	if !accept(1000 + ReplayWindow + 6) {
+		t.Error("Expected an unsigned number not to move the source's window")
+	}
+	restarted := id.sign(&Message{Source: id.NodeID(), Seq: 10, Boot: 42})
+	if !g.accept(restarted) || g.accept(restarted) {
+		t.Error("Expected a source restarted with its clock behind to get a window of its own")
+	}
+	if accept(1000+ReplayWindow+6) || accept(1004) {
+		t.Error("Expected messages from before the restart to still be dropped")
+	}
+
+	// The sequence number is signed, so a replay can't be renumbered
+	signed := id.sign(&Message{Type: "data", Source: id.NodeID(), Timestamp: time.Now(), Seq: 7})
+	tr := NewTransport("node-r", 0)
+	if err := tr.verifySignature(signed); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	renumbered := *signed
+	renumbered.Seq = 8
+	if err := tr.verifySignature(&renumbered); !errors.Is(err, ErrForgedMessage) {
+		t.Errorf("Expected a renumbered message to be caught, got %v", err)
+	}
+
+	// Over a connection, a message sent twice with its number arrives once
+	idA, _ := NewIdentity()
+	idB, _ := NewIdentity()
+	received := make(chan *Message, 4)
+	b := NewTransport(idB.NodeID(), 0)
+	b.SetIdentity(idB)
+	b.SetMessageHandler(func(peerID string, msg *Message) { received <- msg })
+	if err := b.Start(); err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer b.Stop()
+	a := NewTransport(idA.NodeID(), 0)
+	a.SetIdentity(idA)
+	defer a.Stop()
+	_, port, _ := net.SplitHostPort(b.ListenAddr())
+	portNum, _ := strconv.Atoi(port)
+	if err := a.ConnectToPeer(idB.NodeID(), "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	first := &Message{Type: "data", Source: idA.NodeID(), Dest: idB.NodeID(), Payload: []byte("one")}
+	a.SendMessage(idB.NodeID(), first)
+	a.SendMessage(idB.NodeID(), first)
+	captured := &Message{Type: "data", Source: idA.NodeID(), Dest: idB.NodeID(), Payload: []byte("two"), Seq: a.replay.nextSeq()}
+	a.SendMessage(idB.NodeID(), captured)
+	a.SendMessage(idB.NodeID(), captured)
+	a.SendMessage(idB.NodeID(), &Message{Type: "data", Source: idA.NodeID(), Dest: idB.NodeID(), Payload: []byte("three")})
+
+	var payloads []string
+	for len(payloads) < 4 {
+		select {
+		case msg := <-received:
+			payloads = append(payloads, string(msg.Payload))
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("Expected 4 messages, got %v", payloads)
+		}
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("Expected the replay to be dropped, got %q", msg.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if b.ReplayedMessages()+b.StaleMessages() != 1 {
+		t.Errorf("Expected one dropped replay, got %d duplicate and %d stale", b.ReplayedMessages(), b.StaleMessages())
+	}
+
+	// The sender restarting, even with its clock behind, doesn't let a captured message
+	// through again
+	a.DisconnectPeer(idB.NodeID())
+	replayer := NewTransport(idA.NodeID(), 0)
+	replayer.SetIdentity(idA)
+	replayer.replay.next -= uint64(time.Hour.Microseconds())
+	defer replayer.Stop()
+	if err := replayer.ConnectToPeer(idB.NodeID(), "127.0.0.1", portNum); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	replayer.SendMessage(idB.NodeID(), captured)
+	replayer.SendMessage(idB.NodeID(), &Message{Type: "data", Source: idA.NodeID(), Dest: idB.NodeID(), Payload: []byte("four")})
+	select {
+	case msg := <-received:
+		if string(msg.Payload) != "four" {
+			t.Errorf("Expected the replay after reconnecting to be dropped, got %q", msg.Payload)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Expected the new message after reconnecting")
+	}
+	if b.ReplayedMessages()+b.StaleMessages() != 2 {
+		t.Errorf("Expected two dropped replays, got %d duplicate and %d stale", b.ReplayedMessages(), b.StaleMessages())
+	}
+}
+
+// TestProxyRequestURLs tests URL and CONNECT target reconstruction for IPv6 literals and ports
+func TestProxyRequestURLs(t *testing.T) {
+	urls := []struct {
+		request string
+		want    string
+		wantErr bool
+	}{
+		{"GET http://example.com/a?b=c HTTP/1.1\r\nHost: example.com\r\n\r\n", "http://example.com/a?b=c", false},
+		{"GET http://example.com:8080/ HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "http://example.com:8080/", false},
+		{"GET http://[2001:db8::1]:8080/x HTTP/1.1\r\nHost: [2001:db8::1]:8080\r\n\r\n", "http://[2001:db8::1]:8080/x", false},
+		{"GET http://[::1]/ HTTP/1.1\r\nHost: [::1]\r\n\r\n", "http://[::1]/", false},
+		{"GET http://192.0.2.1:81/ HTTP/1.1\r\nHost: 192.0.2.1:81\r\n\r\n", "http://192.0.2.1:81/", false},
+		{"GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n", "http://example.com/path", false},
+		{"GET /httpfoo HTTP/1.1\r\nHost: example.com:8443\r\n\r\n", "http://example.com:8443/httpfoo", false},
+		{"GET /v6 HTTP/1.1\r\nHost: [2001:db8::2]:9000\r\n\r\n", "http://[2001:db8::2]:9000/v6", false},
+		{"GET /v6 HTTP/1.1\r\nHost: [fe80::1%25eth0]\r\n\r\n", "http://[fe80::1%25eth0]/v6", false},
+		{"GET /none HTTP/1.1\r\n\r\n", "", true},
+		{"GET /bad HTTP/1.1\r\nHost: example.com:99999\r\n\r\n", "", true},
+		{"GET /bad HTTP/1.1\r\nHost: [2001:db8::1\r\n\r\n", "", true},
+	}
+	for _, tc := range urls {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tc.request)))
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tc.request, err)
+		}
+		got, err := RequestURL(req)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("RequestURL(%q) = %q, %v; want %q", tc.request, got, err, tc.want)
+		}
+	}
+
+	targets := []struct {
+		authority string
+		want      string
+		wantErr   bool
+	}{
+		{"example.com:443", "example.com:443", false},
+		{"example.com", "example.com:443", false},
+		{"example.com:8443", "example.com:8443", false},
+		{"192.0.2.1", "192.0.2.1:443", false},
+		{"[2001:db8::1]:8443", "[2001:db8::1]:8443", false},
+		{"[2001:db8::1]", "[2001:db8::1]:443", false},
+		{"2001:db8::1", "[2001:db8::1]:443", false},
+		{"[fe80::1%eth0]:443", "[fe80::1%eth0]:443", false},
+		{"example.com:", "example.com:443", false},
+		{"", "", true},
+		{":443", "", true},
+		{"example.com:0", "", true},
+		{"example.com:https", "", true},
+		{"[192.0.2.1]:443", "", true},
+		{"[2001:db8::1]x", "", true},
+		{"not:an:address", "", true},
+	}
+	for _, tc := range targets {
+		got, err := ConnectTarget(tc.authority, "443")
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ConnectTarget(%q) = %q, %v; want %q", tc.authority, got, err, tc.want)
+		}
+	}
+
+	if got := proxyURL("fd00::5", 9997); got != "http://[fd00::5]:9997" {
+		t.Errorf("Expected bracketed proxy URL, got %q", got)
+	}
+	if got := normalizeHost("[2001:DB8::1]"); got != "2001:db8::1" {
+		t.Errorf("Expected brackets stripped from host, got %q", got)
+	}
+}
@@ -0,0 +1,160 @@
+package mesh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A personal network's owner can ask its members how the mesh is used. Members answer
+// with counters only: no peer IDs, destinations or per-client figures leave the device,
+// and the owner sees the members' answers summed.
+
+// MemberStats is one member's answer to the stats management command
+type MemberStats struct {
+	RelayedBytes   int64       `json:"relayed_bytes"`   // Carried for proxy clients since start
+	ConnectedPeers int         `json:"connected_peers"` // Peers linked right now
+	KnownPeers     int         `json:"known_peers"`     // Peers discovered on the local network
+	Sharing        bool        `json:"sharing"`         // Whether it offers internet right now
+	SharingHours   [24]float64 `json:"sharing_hours"`   // Hours spent sharing in each hour of the day, UTC
+}
+
+// NetworkUsage sums the stats of a personal network's members
+type NetworkUsage struct {
+	NetworkID      string      `json:"network_id"`
+	Members        int         `json:"members"`   // Members asked
+	Responded      int         `json:"responded"` // Members that answered in time
+	RelayedBytes   int64       `json:"relayed_bytes"`
+	ConnectedPeers int         `json:"connected_peers"`
+	KnownPeers     int         `json:"known_peers"`
+	SharingNow     int         `json:"sharing_now"` // Members offering internet right now
+	SharingHours   [24]float64 `json:"sharing_hours"`
+	CollectedAt    time.Time   `json:"collected_at"`
+}
+
+// ErrNotNetworkOwner is returned when collecting stats for a network owned by someone else
+var ErrNotNetworkOwner = errors.New("not the owner of the network")
+
+// sharingLog accumulates how long internet sharing was on, per hour of the day
+type sharingLog struct {
+	hours [24]time.Duration
+	since time.Time // Start of the current sharing period, zero when not sharing
+	mu    sync.Mutex
+}
+
+// setSharing starts or ends a sharing period
+func (l *sharingLog) setSharing(on bool, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case on && l.since.IsZero():
+		l.since = now
+	case !on && !l.since.IsZero():
+		l.addLocked(l.since, now)
+		l.since = time.Time{}
+	}
+}
+
+// Hours returns the hours spent sharing per hour of the day, including the current period
+func (l *sharingLog) Hours(now time.Time) [24]float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.since.IsZero() {
+		l.addLocked(l.since, now)
+		l.since = now
+	}
+	var hours [24]float64
+	for i, d := range l.hours {
+		hours[i] = d.Hours()
+	}
+	return hours
+}
+
+// addLocked spreads the period from..to over the hours of the day it covers. Its length
+// is taken from the monotonic clock, so setting the wall clock during the period neither
+// adds phantom hours nor loses it.
+func (l *sharingLog) addLocked(from, to time.Time) {
+	from, to = to.Add(-to.Sub(from)).UTC(), to.UTC()
+	for from.Before(to) {
+		next := from.Truncate(time.Hour).Add(time.Hour)
+		if next.After(to) {
+			next = to
+		}
+		l.hours[from.Hour()] += next.Sub(from)
+		from = next
+	}
+}
+
+// CollectNetworkStats asks the members of a personal network we own for their usage
+// and sums the answers. Members have to be paired with us; those that don't answer
+// within timeout are left out and counted as not responding.
+func (ma *MeshApp) CollectNetworkStats(networkID string, timeout time.Duration) (*NetworkUsage, error) {
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(networkID)
+	if !ok {
+		return nil, fmt.Errorf("unknown personal network %q", networkID)
+	}
+	if network.Owner != ma.Node.ID {
+		return nil, ErrNotNetworkOwner
+	}
+
+	usage := &NetworkUsage{NetworkID: networkID}
+	answers := make(chan *MemberStats)
+	for _, member := range network.GetAllMembers() {
+		if member.NodeID == ma.Node.ID {
+			continue
+		}
+		usage.Members++
+		go func(peerID string) {
+			payload, err := ma.mgmtCall(peerID, map[string]string{
+				"command": MgmtCommandStats,
+				"network": networkID,
+			}, timeout)
+			var stats MemberStats
+			if err != nil || json.Unmarshal(payload, &stats) != nil {
+				answers <- nil
+				return
+			}
+			answers <- &stats
+		}(member.NodeID)
+	}
+
+	for i := 0; i < usage.Members; i++ {
+		stats := <-answers
+		if stats == nil {
+			continue
+		}
+		usage.Responded++
+		usage.RelayedBytes += stats.RelayedBytes
+		usage.ConnectedPeers += stats.ConnectedPeers
+		usage.KnownPeers += stats.KnownPeers
+		if stats.Sharing {
+			usage.SharingNow++
+		}
+		for hour, hours := range stats.SharingHours {
+			usage.SharingHours[hour] += hours
+		}
+	}
+	usage.CollectedAt = time.Now()
+	return usage, nil
+}
+
+// memberStatsPayload answers the stats command, only for the owner of a network we know
+func (ma *MeshApp) memberStatsPayload(peerID, networkID string) ([]byte, error) {
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(networkID)
+	if !ok || network.Owner != peerID {
+		return nil, ErrNotNetworkOwner
+	}
+
+	ma.mu.RLock()
+	sharing := ma.IsInternetSharing
+	ma.mu.RUnlock()
+	return json.Marshal(&MemberStats{
+		RelayedBytes:   ma.InternetProxy.RelayedBytes(),
+		ConnectedPeers: len(ma.Transport.GetConnectedPeers()),
+		KnownPeers:     len(ma.Discovery.GetPeers()),
+		Sharing:        sharing,
+		SharingHours:   ma.sharing.Hours(time.Now()),
+	})
+}
@@ -0,0 +1,346 @@
+package mesh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Management commands travel as "mgmt_request"/"mgmt_response" messages. Requests and
+// responses are authenticated with the pairing key, so only peers the user has paired
+// with can manage a node, and the answers can't be forged by other peers.
+const (
+	MgmtCommandLogs  = "logs"
+	MgmtCommandStats = "stats" // Aggregate usage, answered only to the owner of a personal network
+
+	// MgmtRequestMaxAge is how old a request may be before it is rejected as a replay
+	MgmtRequestMaxAge = 5 * time.Minute
+
+	// DefaultLogRingLines is how many recent log lines a node keeps for remote retrieval
+	DefaultLogRingLines = 200
+	maxLogLineLength    = 1024
+)
+
+var (
+	// ErrNotPaired is returned when managing a peer that hasn't been paired with
+	ErrNotPaired = errors.New("peer is not paired")
+	// ErrMgmtTimeout is returned when a management request gets no answer in time
+	ErrMgmtTimeout = errors.New("management request timed out")
+)
+
+// LogRing keeps the most recent log lines in memory. It is an io.Writer, so it can be
+// added to the log output with CaptureLogs.
+type LogRing struct {
+	lines   []string
+	next    int
+	full    bool
+	partial []byte
+	mu      sync.Mutex
+}
+
+// NewLogRing creates a ring holding up to capacity lines
+func NewLogRing(capacity int) *LogRing {
+	if capacity <= 0 {
+		capacity = DefaultLogRingLines
+	}
+	return &LogRing{lines: make([]string, capacity)}
+}
+
+// Write appends complete lines to the ring; an unterminated tail waits for the next write
+func (r *LogRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.partial, p...)
+	for {
+		i := strings.IndexByte(string(data), '\n')
+		if i < 0 {
+			break
+		}
+		r.appendLocked(string(data[:i]))
+		data = data[i+1:]
+	}
+	if len(data) > maxLogLineLength {
+		r.appendLocked(string(data))
+		data = nil
+	}
+	r.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+func (r *LogRing) appendLocked(line string) {
+	if len(line) > maxLogLineLength {
+		line = line[:maxLogLineLength]
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Lines returns up to n of the most recent lines, oldest first; n <= 0 returns all
+func (r *LogRing) Lines(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var all []string
+	if r.full {
+		all = append(all, r.lines[r.next:]...)
+	}
+	all = append(all, r.lines[:r.next]...)
+	if n > 0 && n < len(all) {
+		all = all[len(all)-n:]
+	}
+	return all
+}
+
+// DiagnosticsBundle is returned by the logs management command
+type DiagnosticsBundle struct {
+	NodeID      string        `json:"node_id"`
+	Logs        []string      `json:"logs"`
+	Health      *HealthReport `json:"health"`
+	Traces      []TraceRecord `json:"traces,omitempty"` // Recent relay hops this node handled
+	GeneratedAt time.Time     `json:"generated_at"`
+}
+
+// mgmtWaiter is a request we sent and are waiting on
+type mgmtWaiter struct {
+	peerID string
+	ch     chan *Message
+}
+
+// mgmtState tracks management requests in both directions
+type mgmtState struct {
+	pending map[string]mgmtWaiter // Requests we sent, by ID
+	seen    map[string]time.Time  // Request IDs we answered and when they were sent, for replay protection
+	horizon time.Time             // Latest send time of a forgotten request ID; none that old is accepted
+	mu      sync.Mutex
+}
+
+func newMgmtState() *mgmtState {
+	return &mgmtState{
+		pending: make(map[string]mgmtWaiter),
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// firstUse records a request ID and reports whether it is new. IDs are forgotten once
+// their send time is too old to be accepted, and requests sent no later than the last
+// forgotten one are refused, so setting the clock back can't make a replay valid again.
+func (s *mgmtState) firstUse(id string, sent, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for seenID, at := range s.seen {
+		if now.Sub(at) > MgmtRequestMaxAge {
+			delete(s.seen, seenID)
+			if at.After(s.horizon) {
+				s.horizon = at
+			}
+		}
+	}
+	if _, ok := s.seen[id]; ok || !sent.After(s.horizon) {
+		return false
+	}
+	s.seen[id] = sent
+	return true
+}
+
+// CaptureLogs adds the node's log ring to the standard logger's output
+func (ma *MeshApp) CaptureLogs() {
+	log.SetOutput(io.MultiWriter(log.Writer(), ma.Logs))
+}
+
+// FetchDiagnostics pulls recent log lines and a health report from a paired peer
+func (ma *MeshApp) FetchDiagnostics(peerID string, lines int, timeout time.Duration) (*DiagnosticsBundle, error) {
+	payload, err := ma.mgmtCall(peerID, map[string]string{
+		"command": MgmtCommandLogs,
+		"lines":   strconv.Itoa(lines),
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var bundle DiagnosticsBundle
+	if err := json.Unmarshal(payload, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid diagnostics: %w", err)
+	}
+	return &bundle, nil
+}
+
+// mgmtCall sends a management command to a paired peer and returns the authenticated
+// payload of its answer
+func (ma *MeshApp) mgmtCall(peerID string, meta map[string]string, timeout time.Duration) ([]byte, error) {
+	key, ok := ma.Pairing.key(peerID)
+	if !ok {
+		return nil, ErrNotPaired
+	}
+
+	meta["id"] = NewID()
+	meta["ts"] = strconv.FormatInt(time.Now().Unix(), 10)
+	meta["mac"] = mgmtRequestMAC(key, meta)
+
+	respChan := make(chan *Message, 1)
+	ma.mgmt.mu.Lock()
+	ma.mgmt.pending[meta["id"]] = mgmtWaiter{peerID: peerID, ch: respChan}
+	ma.mgmt.mu.Unlock()
+	defer func() {
+		ma.mgmt.mu.Lock()
+		delete(ma.mgmt.pending, meta["id"])
+		ma.mgmt.mu.Unlock()
+	}()
+
+	err := ma.Transport.SendMessage(peerID, &Message{
+		Type:      "mgmt_request",
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Timestamp: time.Now(),
+		Metadata:  meta,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-respChan:
+		if errMsg := resp.Metadata["error"]; errMsg != "" {
+			return nil, fmt.Errorf("peer refused: %s", errMsg)
+		}
+		expected := mgmtMAC(key, "mgmt_response", meta["id"], string(resp.Payload))
+		if !hmac.Equal([]byte(expected), []byte(resp.Metadata["mac"])) {
+			return nil, fmt.Errorf("%s response from %s failed authentication", meta["command"], peerID)
+		}
+		return resp.Payload, nil
+	case <-time.After(timeout):
+		return nil, ErrMgmtTimeout
+	}
+}
+
+func (ma *MeshApp) handleMgmtRequest(peerID string, msg *Message) {
+	meta := msg.Metadata
+	refuse := func(reason string) {
+		ma.Audit.Record(AuditMgmtDenied, peerID, reason)
+		ma.Transport.SendMessage(peerID, &Message{
+			Type:      "mgmt_response",
+			Source:    ma.Node.ID,
+			Dest:      peerID,
+			Timestamp: time.Now(),
+			Metadata:  map[string]string{"id": meta["id"], "error": reason},
+		})
+	}
+
+	key, ok := ma.Pairing.key(peerID)
+	if !ok {
+		refuse("not paired")
+		return
+	}
+	expected := mgmtRequestMAC(key, meta)
+	if !hmac.Equal([]byte(expected), []byte(meta["mac"])) {
+		refuse("authentication failed")
+		return
+	}
+	ts, err := strconv.ParseInt(meta["ts"], 10, 64)
+	sent, now := time.Unix(ts, 0), time.Now().Round(0)
+	if err != nil || now.Sub(sent).Abs() > MgmtRequestMaxAge || !ma.mgmt.firstUse(meta["id"], sent, now) {
+		refuse("stale or replayed request")
+		return
+	}
+
+	var payload []byte
+	switch meta["command"] {
+	case MgmtCommandLogs:
+		lines, _ := strconv.Atoi(meta["lines"])
+		payload, err = ma.diagnosticsPayload(lines)
+		if err == nil {
+			ma.Audit.Record(AuditLogsFetched, peerID, fmt.Sprintf("%d lines", lines))
+		}
+	case MgmtCommandStats:
+		payload, err = ma.memberStatsPayload(peerID, meta["network"])
+		if err == nil {
+			ma.Audit.Record(AuditStatsShared, peerID, meta["network"])
+		}
+	default:
+		err = errors.New("unknown command")
+	}
+	if err != nil {
+		refuse(err.Error())
+		return
+	}
+	ma.Transport.SendMessage(peerID, &Message{
+		Type:      "mgmt_response",
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Payload:   payload,
+		Timestamp: time.Now(),
+		Metadata: map[string]string{
+			"id":  meta["id"],
+			"mac": mgmtMAC(key, "mgmt_response", meta["id"], string(payload)),
+		},
+	})
+}
+
+// diagnosticsPayload encodes a diagnostics bundle, dropping the oldest log lines and
+// then trace records until it fits in a transport message
+func (ma *MeshApp) diagnosticsPayload(lines int) ([]byte, error) {
+	bundle := &DiagnosticsBundle{
+		NodeID:      ma.Node.ID,
+		Logs:        ma.Logs.Lines(lines),
+		Health:      ma.Health(),
+		Traces:      ma.Traces.Records(""),
+		GeneratedAt: time.Now(),
+	}
+	// Payloads are base64 encoded inside the message; leave room for the envelope
+	budget := (ma.Transport.messageLimit() - 2048) * 3 / 4
+	for {
+		payload, err := json.Marshal(bundle)
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) <= budget || (len(bundle.Logs) == 0 && len(bundle.Traces) == 0) {
+			return payload, nil
+		}
+		if len(bundle.Logs) > 0 {
+			bundle.Logs = bundle.Logs[len(bundle.Logs)/4+1:]
+		} else {
+			bundle.Traces = bundle.Traces[len(bundle.Traces)/4+1:]
+		}
+	}
+}
+
+func (ma *MeshApp) handleMgmtResponse(peerID string, msg *Message) {
+	ma.mgmt.mu.Lock()
+	waiter, ok := ma.mgmt.pending[msg.Metadata["id"]]
+	ma.mgmt.mu.Unlock()
+	if !ok || waiter.peerID != peerID {
+		return
+	}
+	select {
+	case waiter.ch <- msg:
+	default:
+	}
+}
+
+// mgmtRequestMAC authenticates a request's fields. The network is only covered when
+// present, so requests from nodes that predate it still verify.
+func mgmtRequestMAC(key []byte, meta map[string]string) string {
+	fields := []string{"mgmt_request", meta["command"], meta["id"], meta["lines"], meta["ts"]}
+	if network := meta["network"]; network != "" {
+		fields = append(fields, network)
+	}
+	return mgmtMAC(key, fields...)
+}
+
+// mgmtMAC authenticates the given fields with a pairing key
+func mgmtMAC(key []byte, fields ...string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
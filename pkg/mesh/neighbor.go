@@ -0,0 +1,105 @@
+package mesh
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// ErrMACNotFound is returned when the neighbor table has no entry for an IP
+var ErrMACNotFound = errors.New("no neighbor entry for address")
+
+// MACResolver maps a peer's IP address to its link-layer address
+type MACResolver interface {
+	ResolveMAC(ip string) (string, error)
+}
+
+// MACResolverFunc adapts a function to the MACResolver interface
+type MACResolverFunc func(ip string) (string, error)
+
+// ResolveMAC calls f(ip)
+func (f MACResolverFunc) ResolveMAC(ip string) (string, error) {
+	return f(ip)
+}
+
+// SystemMACResolver looks addresses up in the OS neighbor table (ARP for IPv4,
+// NDP for IPv6). On platforms without support it always returns an error.
+var SystemMACResolver MACResolver = MACResolverFunc(lookupNeighbor)
+
+// MACFilter allows or denies peers by link-layer address. A non-empty allow list
+// admits only listed addresses; the deny list always wins.
+type MACFilter struct {
+	allow map[string]bool
+	deny  map[string]bool
+	mu    sync.RWMutex
+}
+
+// NewMACFilter creates a filter that admits every peer
+func NewMACFilter() *MACFilter {
+	return &MACFilter{
+		allow: make(map[string]bool),
+		deny:  make(map[string]bool),
+	}
+}
+
+// Allow adds a MAC address to the allow list
+func (f *MACFilter) Allow(mac string) error {
+	normalized, err := normalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allow[normalized] = true
+	return nil
+}
+
+// Deny adds a MAC address to the deny list
+func (f *MACFilter) Deny(mac string) error {
+	normalized, err := normalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deny[normalized] = true
+	return nil
+}
+
+// Remove drops a MAC address from both lists
+func (f *MACFilter) Remove(mac string) {
+	normalized, err := normalizeMAC(mac)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.allow, normalized)
+	delete(f.deny, normalized)
+}
+
+// Allowed returns whether a peer with the given MAC may join. Peers whose MAC could
+// not be resolved are only rejected when an allow list is in force.
+func (f *MACFilter) Allowed(mac string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	normalized, err := normalizeMAC(mac)
+	if err != nil {
+		return len(f.allow) == 0
+	}
+	if f.deny[normalized] {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow[normalized]
+}
+
+// normalizeMAC parses a MAC address into lowercase colon-separated form
+func normalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
+}
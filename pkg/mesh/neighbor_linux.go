@@ -0,0 +1,77 @@
+//go:build linux
+
+package mesh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Neighbor table definitions from linux/neighbour.h (not exported by package syscall)
+const (
+	sizeofNdMsg   = 12
+	ndaDst        = 1
+	ndaLLAddr     = 2
+	nudIncomplete = 0x01
+	nudFailed     = 0x20
+)
+
+// lookupNeighbor dumps the kernel neighbor table over rtnetlink and returns the
+// link-layer address for ip. The same dump covers ARP (IPv4) and NDP (IPv6) entries.
+func lookupNeighbor(ip string) (string, error) {
+	target := net.ParseIP(ip)
+	if target == nil {
+		return "", fmt.Errorf("invalid IP address %q", ip)
+	}
+	family := syscall.AF_INET
+	if target.To4() == nil {
+		family = syscall.AF_INET6
+	}
+
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, family)
+	if err != nil {
+		return "", fmt.Errorf("failed to read neighbor table: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse neighbor table: %w", err)
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWNEIGH || len(msg.Data) < sizeofNdMsg {
+			continue
+		}
+		state := binary.NativeEndian.Uint16(msg.Data[8:10])
+		if state&(nudIncomplete|nudFailed) != 0 {
+			continue
+		}
+
+		var dst net.IP
+		var lladdr net.HardwareAddr
+		for attrs := msg.Data[sizeofNdMsg:]; len(attrs) >= syscall.SizeofRtAttr; {
+			length := int(binary.NativeEndian.Uint16(attrs[0:2]))
+			if length < syscall.SizeofRtAttr || length > len(attrs) {
+				break
+			}
+			value := attrs[syscall.SizeofRtAttr:length]
+			switch binary.NativeEndian.Uint16(attrs[2:4]) {
+			case ndaDst:
+				dst = net.IP(value)
+			case ndaLLAddr:
+				lladdr = net.HardwareAddr(value)
+			}
+			aligned := (length + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+			if aligned > len(attrs) {
+				break
+			}
+			attrs = attrs[aligned:]
+		}
+
+		if dst.Equal(target) && len(lladdr) > 0 {
+			return lladdr.String(), nil
+		}
+	}
+	return "", ErrMACNotFound
+}
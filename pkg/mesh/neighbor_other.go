@@ -0,0 +1,8 @@
+//go:build !linux
+
+package mesh
+
+// lookupNeighbor is not supported on this platform
+func lookupNeighbor(ip string) (string, error) {
+	return "", ErrMACNotFound
+}
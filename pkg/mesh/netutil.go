@@ -14,6 +14,16 @@ type NetworkInfo struct {
 
 // DetectNetworkInfo auto-detects the local network configuration
 func DetectNetworkInfo() *NetworkInfo {
+	info := detectInterface()
+	if info.Interface != "" {
+		info.HasInternet = CheckInternetConnectivity()
+	}
+	return info
+}
+
+// detectInterface finds the address of the best interface without probing connectivity;
+// Interface is "" when none was found
+func detectInterface() *NetworkInfo {
 	info := &NetworkInfo{
 		IP:  "127.0.0.1",
 		MAC: "00:00:00:00:00:00",
@@ -64,9 +74,6 @@ func DetectNetworkInfo() *NetworkInfo {
 				info.MAC = "00:00:00:00:00:00"
 			}
 
-			// Check internet connectivity
-			info.HasInternet = CheckInternetConnectivity()
-
 			return info
 		}
 	}
@@ -0,0 +1,111 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// InterfaceRefreshInterval is how often interfaces are re-read, in case a change
+	// notification was missed or the platform has none
+	InterfaceRefreshInterval = 30 * time.Second
+
+	// interfaceChangeSettle is how long a burst of interface notifications is waited out
+	// before the address is re-read; a network switch reports several changes at once
+	interfaceChangeSettle = time.Second
+)
+
+// interfaceWatchLoop keeps the node's address current as networks come and go. OS change
+// notifications trigger a refresh, and interfaces are polled in case they are missed.
+func (ma *MeshApp) interfaceWatchLoop(ctx context.Context) {
+	changes := make(chan struct{}, 1)
+	go watchInterfaces(ctx, func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+
+	// Only a change from what was detected before counts, so an address the platform
+	// set explicitly isn't overwritten while the network stays the same
+	last := detectInterface()
+	ticker := time.NewTicker(InterfaceRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changes:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interfaceChangeSettle):
+			}
+			select {
+			case <-changes:
+			default:
+			}
+		}
+
+		info := detectInterface()
+		if info.Interface == "" || (info.IP == last.IP && info.MAC == last.MAC) {
+			continue
+		}
+		last = info
+		ma.applyNetworkChange(info.IP, info.MAC)
+	}
+}
+
+// NetworkChanged tells the node its network changed, for platforms that report it
+// themselves (such as mobile connectivity callbacks). An empty ip re-reads the
+// interfaces; otherwise ip and mac are the node's new address.
+func (ma *MeshApp) NetworkChanged(ip, mac string) {
+	if ip == "" {
+		info := detectInterface()
+		if info.Interface == "" {
+			return
+		}
+		ip, mac = info.IP, info.MAC
+	}
+	if mac == "" {
+		_, mac = ma.Node.Address()
+	}
+	ma.applyNetworkChange(ip, mac)
+}
+
+// applyNetworkChange records the node's new address, re-joins discovery on the new
+// network and re-checks connectivity. Peer connections on the old network fail their
+// read deadline and are re-established through discovery.
+func (ma *MeshApp) applyNetworkChange(ip, mac string) {
+	oldIP, _ := ma.Node.Address()
+	if !ma.Node.SetAddress(ip, mac) {
+		return
+	}
+
+	ma.mu.RLock()
+	running := ma.IsConnected && !ma.suspended
+	ma.mu.RUnlock()
+	if running {
+		if err := ma.Discovery.Rebind(); err != nil {
+			ma.mu.Lock()
+			ma.componentErrs["discovery"] = err
+			ma.mu.Unlock()
+			ma.emitEvent(&Event{Type: EventComponentDegraded, Component: "discovery", Detail: err.Error()})
+		}
+	}
+	ma.emitEvent(&Event{Type: EventNetworkChanged, Detail: fmt.Sprintf("%s -> %s", oldIP, ip)})
+
+	if running {
+		go func() {
+			hasInternet := CheckInternetConnectivity()
+			ma.mu.Lock()
+			ma.Node.HasInternet = hasInternet
+			ma.recordInternetCheckLocked(hasInternet)
+			ma.mu.Unlock()
+			ma.updateProxyAdvertisement()
+		}()
+	}
+}
@@ -0,0 +1,46 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// watchInterfaces calls changed whenever an interface or address comes or goes, as
+// reported on a routing socket, until ctx is done
+func watchInterfaces(ctx context.Context, changed func()) error {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("failed to open routing socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	// Wake up regularly to notice ctx being done
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("failed to set routing socket timeout: %w", err)
+	}
+
+	buf := make([]byte, 16*1024)
+	for ctx.Err() == nil {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read interface changes: %w", err)
+		}
+		// Every routing message starts with its length, version and type
+		if n < 4 {
+			continue
+		}
+		switch int(buf[3]) {
+		case syscall.RTM_NEWADDR, syscall.RTM_DELADDR, syscall.RTM_IFINFO:
+			changed()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package mesh
+
+import (
+	"context"
+	"errors"
+)
+
+// watchInterfaces is not supported on this platform; interfaces are polled instead
+func watchInterfaces(ctx context.Context, changed func()) error {
+	return errors.New("interface change notifications are not supported on this platform")
+}
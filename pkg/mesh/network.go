@@ -1,6 +1,11 @@
 package mesh
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
@@ -10,10 +15,21 @@ type PersonalNetwork struct {
 	ID        string
 	Name      string
 	Owner     string
+	OwnerKey  ed25519.PublicKey // verifies policy bundles signed by the owner
 	CreatedAt time.Time
 	Members   map[string]*NetworkMember
 	Policies  *NetworkPolicy
-	mu        sync.RWMutex
+	// RequireCerts makes membership a matter of certificates signed with OwnerKey
+	// rather than of the roster in Members
+	RequireCerts bool
+
+	certs      map[string]*MembershipCert // Members' certificates, by node ID
+	groupKey   []byte                     // Seals data messages between members; nil if not encrypted
+	prevKey    []byte                     // The key before the last rotation, for messages still in flight
+	keyEpoch   uint64
+	rotateKeys bool // We own the key and rotate it when membership changes
+	onRotate   func(*PersonalNetwork)
+	mu         sync.RWMutex
 }
 
 // NetworkMember represents a member in a personal network
@@ -26,10 +42,48 @@ type NetworkMember struct {
 
 // NetworkPolicy defines policies for a personal network
 type NetworkPolicy struct {
-	AllowInternet bool
-	AllowProxy    bool
-	MaxBandwidth  int64 // bytes per second
-	TTL           int   // Time to live for packets
+	AllowInternet       bool
+	AllowProxy          bool
+	MaxBandwidth        int64    // bytes per second
+	TTL                 int      // Time to live for packets
+	MaxMessageSize      int      // Largest encoded message members may exchange, 0 for the transport limit
+	MaxMetadataSize     int      // Largest JSON-encoded message metadata, 0 for unlimited
+	BlockedMessageTypes []string // Message types members may not exchange, e.g. file transfers on a guest network
+}
+
+// ErrMessagePolicy is wrapped by errors for messages a network policy forbids
+var ErrMessagePolicy = errors.New("message violates network policy")
+
+// CheckMessage returns an error wrapping ErrMessagePolicy if the policy forbids a message.
+// Policy bundles are always allowed so an owner can relax a policy that is too strict.
+func (p *NetworkPolicy) CheckMessage(msg *Message) error {
+	if msg.Type == "policy_bundle" {
+		return nil
+	}
+	for _, blocked := range p.BlockedMessageTypes {
+		if msg.Type == blocked {
+			return fmt.Errorf("%w: %s messages are not allowed", ErrMessagePolicy, msg.Type)
+		}
+	}
+	if p.MaxMetadataSize > 0 && len(msg.Metadata) > 0 {
+		data, err := json.Marshal(msg.Metadata)
+		if err != nil {
+			return err
+		}
+		if len(data) > p.MaxMetadataSize {
+			return fmt.Errorf("%w: metadata is %d bytes, limit %d", ErrMessagePolicy, len(data), p.MaxMetadataSize)
+		}
+	}
+	if p.MaxMessageSize > 0 {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if len(data) > p.MaxMessageSize {
+			return fmt.Errorf("%w: message is %d bytes, limit %d", ErrMessagePolicy, len(data), p.MaxMessageSize)
+		}
+	}
+	return nil
 }
 
 // NewPersonalNetwork creates a new personal network
@@ -40,6 +94,7 @@ func NewPersonalNetwork(id, name, owner string) *PersonalNetwork {
 		Owner:     owner,
 		CreatedAt: time.Now(),
 		Members:   make(map[string]*NetworkMember),
+		certs:     make(map[string]*MembershipCert),
 		Policies: &NetworkPolicy{
 			AllowInternet: true,
 			AllowProxy:    true,
@@ -52,15 +107,63 @@ func NewPersonalNetwork(id, name, owner string) *PersonalNetwork {
 // AddMember adds a member to the personal network
 func (pn *PersonalNetwork) AddMember(member *NetworkMember) {
 	pn.mu.Lock()
-	defer pn.mu.Unlock()
+	_, existed := pn.Members[member.NodeID]
 	pn.Members[member.NodeID] = member
+	pn.membershipChangedLocked(!existed)
 }
 
 // RemoveMember removes a member from the personal network
 func (pn *PersonalNetwork) RemoveMember(nodeID string) {
 	pn.mu.Lock()
-	defer pn.mu.Unlock()
+	_, existed := pn.Members[nodeID]
 	delete(pn.Members, nodeID)
+	delete(pn.certs, nodeID)
+	pn.membershipChangedLocked(existed)
+}
+
+// membershipChangedLocked rotates the group key of an encrypted network we own after
+// its membership changed, so neither past nor new members read traffic outside their
+// membership. It unlocks pn.mu before telling the rotation handler.
+func (pn *PersonalNetwork) membershipChangedLocked(changed bool) {
+	rotated := changed && pn.rotateKeys && pn.rotateKeyLocked() == nil
+	onRotate := pn.onRotate
+	pn.mu.Unlock()
+	if rotated && onRotate != nil {
+		onRotate(pn)
+	}
+}
+
+// syncMembers replaces the members with the roster the owner sent, keeping what we
+// know about those that stay; certificates of members the owner removed are dropped
+func (pn *PersonalNetwork) syncMembers(nodeIDs []string) {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	members := make(map[string]*NetworkMember, len(nodeIDs))
+	for _, id := range nodeIDs {
+		if existing, ok := pn.Members[id]; ok {
+			members[id] = existing
+		} else {
+			members[id] = &NetworkMember{NodeID: id, JoinedAt: time.Now()}
+		}
+	}
+	pn.Members = members
+	for id := range pn.certs {
+		if _, ok := members[id]; !ok {
+			delete(pn.certs, id)
+		}
+	}
+}
+
+// memberIDs returns the IDs of the members, sorted
+func (pn *PersonalNetwork) memberIDs() []string {
+	pn.mu.RLock()
+	defer pn.mu.RUnlock()
+	ids := make([]string, 0, len(pn.Members))
+	for id := range pn.Members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
 }
 
 // GetMember retrieves a member by node ID
@@ -82,14 +185,36 @@ func (pn *PersonalNetwork) GetAllMembers() []*NetworkMember {
 	return members
 }
 
-// IsMember checks if a node is a member of the personal network
+// IsMember checks if a node is a member of the personal network: for a
+// certificate-based network, whether it is the owner or holds a valid certificate
 func (pn *PersonalNetwork) IsMember(nodeID string) bool {
 	pn.mu.RLock()
 	defer pn.mu.RUnlock()
+	if pn.RequireCerts {
+		return pn.certifiedLocked(nodeID, time.Now())
+	}
 	_, exists := pn.Members[nodeID]
 	return exists
 }
 
+// SetPolicies replaces the network's policies
+func (pn *PersonalNetwork) SetPolicies(policy *NetworkPolicy) {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	pn.Policies = policy
+}
+
+// CheckMessage applies the network's message policy
+func (pn *PersonalNetwork) CheckMessage(msg *Message) error {
+	pn.mu.RLock()
+	policy := pn.Policies
+	pn.mu.RUnlock()
+	if policy == nil {
+		return nil
+	}
+	return policy.CheckMessage(msg)
+}
+
 // GetProxyPeers returns all members in the network that can act as proxies
 func (pn *PersonalNetwork) GetProxyPeers() []*NetworkMember {
 	pn.mu.RLock()
@@ -106,6 +231,8 @@ func (pn *PersonalNetwork) GetProxyPeers() []*NetworkMember {
 // PersonalNetworkManager manages all personal networks
 type PersonalNetworkManager struct {
 	Networks map[string]*PersonalNetwork
+	invites  map[string]*networkInvite // Unused invite codes, by code
+	onRotate func(*PersonalNetwork)    // Called after a network's group key changed
 	mu       sync.RWMutex
 }
 
@@ -113,6 +240,7 @@ type PersonalNetworkManager struct {
 func NewPersonalNetworkManager() *PersonalNetworkManager {
 	return &PersonalNetworkManager{
 		Networks: make(map[string]*PersonalNetwork),
+		invites:  make(map[string]*networkInvite),
 	}
 }
 
@@ -123,11 +251,15 @@ func (pnm *PersonalNetworkManager) GetNetworkCount() int {
 	return len(pnm.Networks)
 }
 
-// CreateNetwork creates a new personal network
+// CreateNetwork creates a new personal network, with a new ID if id is empty
 func (pnm *PersonalNetworkManager) CreateNetwork(id, name, owner string) *PersonalNetwork {
+	if id == "" {
+		id = NewNetworkID()
+	}
 	pnm.mu.Lock()
 	defer pnm.mu.Unlock()
 	network := NewPersonalNetwork(id, name, owner)
+	network.onRotate = pnm.onRotate
 	pnm.Networks[id] = network
 	return network
 }
@@ -147,6 +279,47 @@ func (pnm *PersonalNetworkManager) DeleteNetwork(id string) {
 	delete(pnm.Networks, id)
 }
 
+// IsMemberOfAny checks if a node belongs to any personal network
+func (pnm *PersonalNetworkManager) IsMemberOfAny(nodeID string) bool {
+	pnm.mu.RLock()
+	defer pnm.mu.RUnlock()
+	for _, network := range pnm.Networks {
+		if network.IsMember(nodeID) {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworksOf returns the IDs of the personal networks a node is a member of, sorted
+func (pnm *PersonalNetworkManager) NetworksOf(nodeID string) []string {
+	pnm.mu.RLock()
+	defer pnm.mu.RUnlock()
+	var ids []string
+	for id, network := range pnm.Networks {
+		if network.IsMember(nodeID) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// CheckMessage applies the message policy of every network the peer belongs to
+func (pnm *PersonalNetworkManager) CheckMessage(peerID string, msg *Message) error {
+	pnm.mu.RLock()
+	defer pnm.mu.RUnlock()
+	for _, network := range pnm.Networks {
+		if !network.IsMember(peerID) {
+			continue
+		}
+		if err := network.CheckMessage(msg); err != nil {
+			return fmt.Errorf("network %s: %w", network.ID, err)
+		}
+	}
+	return nil
+}
+
 // GetNetworksByOwner retrieves all personal networks owned by a user
 func (pnm *PersonalNetworkManager) GetNetworksByOwner(owner string) []*PersonalNetwork {
 	pnm.mu.RLock()
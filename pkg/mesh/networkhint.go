@@ -0,0 +1,84 @@
+package mesh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Announcements carry a hint for each personal network the node is a member of, so
+// peers in the same network recognize each other as soon as they are discovered. A hint
+// is an HMAC keyed with the network ID over the node ID and the announcement's sequence
+// number: only nodes that know a network's ID can tell which hints are for it, and as
+// hints differ between nodes and change with every announcement, nobody else can link
+// them to each other. Hints are claims rather than proof, as network IDs aren't secret:
+// they group peers in the UI and make peers in a shared network priority dials, while
+// trust and access still go by the roster. Like protocol versions they aren't signed,
+// since older verifiers don't know them.
+const (
+	// MaxNetworkHints bounds the hints in an announcement, keeping it to one datagram
+	MaxNetworkHints = 8
+
+	networkHintSize = 8
+)
+
+// networkHint is what a node announcing with seq puts in for a network it is in
+func networkHint(networkID, nodeID string, seq uint64) string {
+	mac := hmac.New(sha256.New, []byte(identityContext+" network hint\x00"+networkID))
+	mac.Write([]byte(nodeID))
+	mac.Write(binary.BigEndian.AppendUint64(nil, seq))
+	return hex.EncodeToString(mac.Sum(nil)[:networkHintSize])
+}
+
+// SetNetworks sets where discovery learns the personal networks we are a member of, to
+// hint them in our announcements and find them in peers'; nil hints none
+func (d *Discovery) SetNetworks(networks func() []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.networks = networks
+}
+
+func (d *Discovery) ourNetworks() []string {
+	d.mu.Lock()
+	networks := d.networks
+	d.mu.Unlock()
+	if networks == nil {
+		return nil
+	}
+	return networks()
+}
+
+// networkHintsLocked returns the hints for an announcement of ours; d.mu must be held
+func (d *Discovery) networkHintsLocked(seq uint64) []string {
+	if d.networks == nil {
+		return nil
+	}
+	var hints []string
+	for _, networkID := range d.networks() {
+		if len(hints) == MaxNetworkHints {
+			break
+		}
+		hints = append(hints, networkHint(networkID, d.nodeID, seq))
+	}
+	return hints
+}
+
+// sharedNetworks returns our personal networks that an announcement hints its sender
+// is a member of, in the order of ours
+func (d *Discovery) sharedNetworks(msg *AnnounceMessage) []string {
+	if len(msg.NetworkHints) == 0 {
+		return nil
+	}
+	var shared []string
+	for _, networkID := range d.ourNetworks() {
+		hint := networkHint(networkID, msg.ID, msg.Seq)
+		for _, h := range msg.NetworkHints {
+			if hmac.Equal([]byte(h), []byte(hint)) {
+				shared = append(shared, networkID)
+				break
+			}
+		}
+	}
+	return shared
+}
@@ -3,6 +3,7 @@ package mesh
 import (
 	"context"
 	"sync"
+	"time"
 )
 
 // Node represents a device in the mesh network
@@ -12,7 +13,11 @@ type Node struct {
 	IP          string
 	MAC         string
 	HasInternet bool
+	Identity    *Identity // Key pair the ID is derived from; nil for a freely chosen ID
 	Peers       map[string]*Peer
+	maxPeers    int
+	lru         *peerLRU
+	archive     PeerArchive
 	mu          sync.RWMutex
 }
 
@@ -24,24 +29,85 @@ type Peer struct {
 	RSSI        int // Signal strength
 	LastSeen    int64
 	HasInternet bool
+	ProxyTier   int    // 0 for a direct uplink, n for internet obtained n mesh proxies away
+	Link        string // Link the peer is reached over, LinkLAN for the local network
+
+	LinkQuality   float64 // 0..1 as reported by the platform radio, 0 if unknown
+	SignalUpdated int64   // Unix time of the last radio measurement
+
+	Power *PowerStatus // Battery the peer announced, nil if unknown
+}
+
+// signalSmoothing weights a new radio measurement against the previous estimate
+const signalSmoothing = 0.3
+
+// applySignal folds a radio measurement into the peer's signal estimate
+func (p *Peer) applySignal(rssi int, linkQuality float64, now int64) {
+	if p.SignalUpdated == 0 {
+		p.RSSI = rssi
+		p.LinkQuality = linkQuality
+	} else {
+		p.RSSI = int(float64(p.RSSI)*(1-signalSmoothing) + float64(rssi)*signalSmoothing)
+		p.LinkQuality = p.LinkQuality*(1-signalSmoothing) + linkQuality*signalSmoothing
+	}
+	p.SignalUpdated = now
 }
 
 // NewNode creates a new mesh node
 func NewNode(id, name, ip, mac string) *Node {
 	return &Node{
-		ID:    id,
-		Name:  name,
-		IP:    ip,
-		MAC:   mac,
-		Peers: make(map[string]*Peer),
+		ID:       id,
+		Name:     name,
+		IP:       ip,
+		MAC:      mac,
+		Peers:    make(map[string]*Peer),
+		maxPeers: DefaultMaxPeers,
+		lru:      newPeerLRU(),
 	}
 }
 
-// AddPeer adds a peer to the node's peer list
+// AddPeer adds a peer to the node's peer list, evicting the least recently
+// seen unpinned peer when the list is full
 func (n *Node) AddPeer(peer *Peer) {
 	n.mu.Lock()
-	defer n.mu.Unlock()
 	n.Peers[peer.NodeID] = peer
+	n.lru.touch(peer.NodeID)
+	evicted := n.evictLocked()
+	archive := n.archive
+	n.mu.Unlock()
+
+	if archive != nil {
+		for _, p := range evicted {
+			archive.Store(p)
+		}
+	}
+}
+
+// evictLocked removes peers over the limit and returns them; n.mu must be held
+func (n *Node) evictLocked() []*Peer {
+	var evicted []*Peer
+	for n.maxPeers > 0 && len(n.Peers) > n.maxPeers {
+		victim, ok := n.lru.victim(nil)
+		if !ok {
+			break // Everything left is pinned
+		}
+		evicted = append(evicted, n.Peers[victim])
+		delete(n.Peers, victim)
+		n.lru.remove(victim)
+	}
+	return evicted
+}
+
+// UpdatePeerSignal records a radio measurement for a known peer and returns its updated state
+func (n *Node) UpdatePeerSignal(peerID string, rssi int, linkQuality float64) (Peer, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peer, exists := n.Peers[peerID]
+	if !exists {
+		return Peer{}, false
+	}
+	peer.applySignal(rssi, linkQuality, time.Now().Unix())
+	return *peer, true
 }
 
 // RemovePeer removes a peer from the node's peer list
@@ -49,6 +115,54 @@ func (n *Node) RemovePeer(peerID string) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	delete(n.Peers, peerID)
+	n.lru.remove(peerID)
+}
+
+// SetPeerLimit sets the maximum number of peers kept in memory (0 means unlimited)
+func (n *Node) SetPeerLimit(limit int) {
+	n.mu.Lock()
+	n.maxPeers = limit
+	evicted := n.evictLocked()
+	archive := n.archive
+	n.mu.Unlock()
+
+	if archive != nil {
+		for _, p := range evicted {
+			archive.Store(p)
+		}
+	}
+}
+
+// PinPeer protects a peer from eviction
+func (n *Node) PinPeer(peerID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lru.pin(peerID)
+}
+
+// UnpinPeer allows a peer to be evicted again
+func (n *Node) UnpinPeer(peerID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lru.unpin(peerID)
+}
+
+// SetPeerArchive sets where evicted peers are spilled to (nil discards them)
+func (n *Node) SetPeerArchive(archive PeerArchive) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.archive = archive
+}
+
+// LookupArchivedPeer returns a peer that was evicted to the archive
+func (n *Node) LookupArchivedPeer(peerID string) (*Peer, bool) {
+	n.mu.RLock()
+	archive := n.archive
+	n.mu.RUnlock()
+	if archive == nil {
+		return nil, false
+	}
+	return archive.Load(peerID)
 }
 
 // GetPeer retrieves a peer by ID
@@ -70,6 +184,24 @@ func (n *Node) GetAllPeers() []*Peer {
 	return peers
 }
 
+// Address returns the node's IP and MAC address
+func (n *Node) Address() (string, string) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.IP, n.MAC
+}
+
+// SetAddress updates the node's IP and MAC address, reporting whether they changed
+func (n *Node) SetAddress(ip, mac string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.IP == ip && n.MAC == mac {
+		return false
+	}
+	n.IP, n.MAC = ip, mac
+	return true
+}
+
 // SetInternetStatus sets whether the node has internet connectivity
 func (n *Node) SetInternetStatus(hasInternet bool) {
 	n.mu.Lock()
@@ -0,0 +1,500 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Noise mode secures peer connections with the Noise_XX_25519_AESGCM_SHA256 handshake,
+// which is far lighter than TLS on constrained devices: no certificates, just a static
+// X25519 key per node. The initiator carries the first handshake message in the metadata
+// of the usual transport handshake; the other two follow as "noise_handshake" messages,
+// after which every frame is encrypted. A peer's static key is pinned to its node ID the
+// first time it is seen.
+
+const (
+	// SecureNoiseXX is the "secure" handshake metadata value asking for a Noise channel
+	SecureNoiseXX = "noise_xx"
+
+	noiseProtocolName  = "Noise_XX_25519_AESGCM_SHA256"
+	noisePrologue      = "InterMesh noise v1"
+	noiseHandshakeType = "noise_handshake"
+	noiseKeySize       = 32
+	noiseTagSize       = 16
+	noiseMaxFrame      = 65535
+)
+
+var (
+	// ErrNoiseKey is returned when a peer's static key doesn't match the one pinned for it
+	ErrNoiseKey = errors.New("peer noise key rejected")
+	// ErrSecureChannel is returned when a peer doesn't offer the secure channel required
+	ErrSecureChannel = errors.New("peer didn't negotiate the required secure channel")
+)
+
+// NewNoiseKey generates a node's static Noise key
+func NewNoiseKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// transportNoise is the Noise setup of a transport
+type transportNoise struct {
+	static *ecdh.PrivateKey
+	pins   map[string][]byte // Static public keys by peer
+	mu     sync.Mutex
+}
+
+// EnableNoise makes every new peer connection a Noise channel keyed by static. Peers'
+// keys are pinned on first contact, or ahead of time with PinNoiseKey. Peers without
+// Noise can no longer connect. Noise and TLS are alternatives; only one can be enabled.
+func (t *Transport) EnableNoise(static *ecdh.PrivateKey) error {
+	if static == nil || static.Curve() != ecdh.X25519() {
+		return errors.New("noise key must be an X25519 key")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tls != nil {
+		return errors.New("TLS is already enabled")
+	}
+	t.noise = &transportNoise{static: static, pins: make(map[string][]byte)}
+	return nil
+}
+
+func (t *Transport) noiseSetup() *transportNoise {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.noise
+}
+
+// NoiseEnabled returns whether peer connections use Noise
+func (t *Transport) NoiseEnabled() bool {
+	return t.noiseSetup() != nil
+}
+
+// NoisePublicKey returns this node's static Noise public key, or nil without Noise
+func (t *Transport) NoisePublicKey() []byte {
+	setup := t.noiseSetup()
+	if setup == nil {
+		return nil
+	}
+	return setup.static.PublicKey().Bytes()
+}
+
+// PinNoiseKey sets the static key a peer must present, e.g. one exchanged while pairing
+func (t *Transport) PinNoiseKey(peerID string, key []byte) error {
+	setup := t.noiseSetup()
+	if setup == nil {
+		return errors.New("noise is not enabled")
+	}
+	if len(key) != noiseKeySize {
+		return fmt.Errorf("noise key must be %d bytes", noiseKeySize)
+	}
+	setup.mu.Lock()
+	defer setup.mu.Unlock()
+	setup.pins[peerID] = bytes.Clone(key)
+	return nil
+}
+
+// PeerNoiseKey returns the static key pinned for a peer
+func (t *Transport) PeerNoiseKey(peerID string) ([]byte, bool) {
+	setup := t.noiseSetup()
+	if setup == nil {
+		return nil, false
+	}
+	setup.mu.Lock()
+	defer setup.mu.Unlock()
+	key, ok := setup.pins[peerID]
+	return bytes.Clone(key), ok
+}
+
+// verifyPeer checks a peer's static key against its pin, pinning it on first contact
+func (s *transportNoise) verifyPeer(peerID string, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pinned, ok := s.pins[peerID]; ok && !bytes.Equal(pinned, key) {
+		return fmt.Errorf("%w: %s presented a different key than pinned", ErrNoiseKey, peerID)
+	}
+	s.pins[peerID] = bytes.Clone(key)
+	return nil
+}
+
+// noisePrologueFor binds the handshake to the node IDs the plaintext handshake names
+func noisePrologueFor(source, dest string) []byte {
+	return []byte(noisePrologue + "\x00" + source + "\x00" + dest)
+}
+
+// startInitiator begins the handshake, returning the first message for the handshake
+// metadata
+func (s *transportNoise) startInitiator(source, dest string) (*noiseHandshake, string, error) {
+	hs, err := newNoiseHandshake(s.static, noisePrologueFor(source, dest))
+	if err != nil {
+		return nil, "", err
+	}
+	return hs, base64.StdEncoding.EncodeToString(hs.writeEphemeral()), nil
+}
+
+// noiseFinishDial completes a dialed handshake on conn and returns the encrypted connection
+func (t *Transport) noiseFinishDial(s *transportNoise, hs *noiseHandshake, conn net.Conn, peerID string) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(t.timeoutPolicy().PeerHandshake))
+	defer conn.SetDeadline(time.Time{})
+
+	reply, _, err := t.readMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake failed: %w", err)
+	}
+	if reply.Type != noiseHandshakeType {
+		return nil, ErrSecureChannel
+	}
+	remoteStatic, err := hs.readResponse(reply.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake failed: %w", err)
+	}
+	if err := s.verifyPeer(peerID, remoteStatic); err != nil {
+		return nil, err
+	}
+	final, err := hs.writeFinal()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.sendMessage(conn, &Message{Type: noiseHandshakeType, Source: t.nodeID, Dest: peerID, Payload: final}, false); err != nil {
+		return nil, fmt.Errorf("noise handshake failed: %w", err)
+	}
+	send, recv := hs.split()
+	return newNoiseConn(conn, send, recv), nil
+}
+
+// noiseAccept completes an accepted handshake whose transport handshake message is msg
+func (t *Transport) noiseAccept(s *transportNoise, conn net.Conn, msg *Message) (net.Conn, error) {
+	if msg.Metadata["secure"] != SecureNoiseXX {
+		return nil, ErrSecureChannel
+	}
+	first, err := base64.StdEncoding.DecodeString(msg.Metadata["noise"])
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake failed: %w", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(t.timeoutPolicy().PeerHandshake))
+	defer conn.SetDeadline(time.Time{})
+
+	hs, err := newNoiseHandshake(s.static, noisePrologueFor(msg.Source, msg.Dest))
+	if err != nil {
+		return nil, err
+	}
+	response, err := hs.writeResponse(first)
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake failed: %w", err)
+	}
+	if err := t.sendMessage(conn, &Message{Type: noiseHandshakeType, Source: t.nodeID, Dest: msg.Source, Payload: response}, false); err != nil {
+		return nil, fmt.Errorf("noise handshake failed: %w", err)
+	}
+	final, _, err := t.readMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake failed: %w", err)
+	}
+	if final.Type != noiseHandshakeType {
+		return nil, ErrSecureChannel
+	}
+	remoteStatic, err := hs.readFinal(final.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake failed: %w", err)
+	}
+	if err := s.verifyPeer(msg.Source, remoteStatic); err != nil {
+		return nil, err
+	}
+	recv, send := hs.split()
+	return newNoiseConn(conn, send, recv), nil
+}
+
+// noiseCipher is a Noise CipherState: an AES-GCM key and its nonce counter
+type noiseCipher struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newNoiseCipher(key []byte) (*noiseCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &noiseCipher{aead: aead}, nil
+}
+
+// nextNonce returns the 96-bit nonce Noise's AESGCM uses: 32 zero bits, then the
+// counter big-endian
+func (c *noiseCipher) nextNonce() []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], c.nonce)
+	c.nonce++
+	return nonce
+}
+
+func (c *noiseCipher) seal(dst, ad, plaintext []byte) []byte {
+	return c.aead.Seal(dst, c.nextNonce(), plaintext, ad)
+}
+
+func (c *noiseCipher) open(dst, ad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(dst, c.nextNonce(), ciphertext, ad)
+}
+
+// noiseHandshake is the Noise SymmetricState and HandshakeState of the XX pattern:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+type noiseHandshake struct {
+	ck, h        []byte
+	cipher       *noiseCipher // nil until the first key is mixed in
+	static       *ecdh.PrivateKey
+	ephemeral    *ecdh.PrivateKey
+	remoteE      *ecdh.PublicKey
+	remoteStatic *ecdh.PublicKey
+}
+
+func newNoiseHandshake(static *ecdh.PrivateKey, prologue []byte) (*noiseHandshake, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocolName) // Names up to the hash length are zero padded
+	hs := &noiseHandshake{ck: bytes.Clone(h), h: h, static: static, ephemeral: ephemeral}
+	hs.mixHash(prologue)
+	return hs, nil
+}
+
+func (hs *noiseHandshake) mixHash(data []byte) {
+	sum := sha256.New()
+	sum.Write(hs.h)
+	sum.Write(data)
+	hs.h = sum.Sum(nil)
+}
+
+func (hs *noiseHandshake) mixKey(ikm []byte) error {
+	var key []byte
+	hs.ck, key = noiseHKDF(hs.ck, ikm)
+	c, err := newNoiseCipher(key)
+	if err != nil {
+		return err
+	}
+	hs.cipher = c
+	return nil
+}
+
+// mixDH mixes the shared secret of a local and a remote key
+func (hs *noiseHandshake) mixDH(local *ecdh.PrivateKey, remote *ecdh.PublicKey) error {
+	secret, err := local.ECDH(remote)
+	if err != nil {
+		return err
+	}
+	return hs.mixKey(secret)
+}
+
+func (hs *noiseHandshake) encryptAndHash(plaintext []byte) []byte {
+	out := plaintext
+	if hs.cipher != nil {
+		out = hs.cipher.seal(nil, hs.h, plaintext)
+	}
+	hs.mixHash(out)
+	return out
+}
+
+func (hs *noiseHandshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	out := ciphertext
+	if hs.cipher != nil {
+		var err error
+		if out, err = hs.cipher.open(nil, hs.h, ciphertext); err != nil {
+			return nil, err
+		}
+	}
+	hs.mixHash(ciphertext)
+	return out, nil
+}
+
+// writeEphemeral writes the initiator's "-> e"
+func (hs *noiseHandshake) writeEphemeral() []byte {
+	e := hs.ephemeral.PublicKey().Bytes()
+	hs.mixHash(e)
+	return append(e, hs.encryptAndHash(nil)...)
+}
+
+// writeResponse reads the initiator's "-> e" and writes "<- e, ee, s, es"
+func (hs *noiseHandshake) writeResponse(first []byte) ([]byte, error) {
+	if len(first) != noiseKeySize {
+		return nil, errors.New("malformed first message")
+	}
+	var err error
+	if hs.remoteE, err = ecdh.X25519().NewPublicKey(first); err != nil {
+		return nil, err
+	}
+	hs.mixHash(first)
+	hs.decryptAndHash(nil)
+
+	out := hs.ephemeral.PublicKey().Bytes()
+	hs.mixHash(out)
+	if err := hs.mixDH(hs.ephemeral, hs.remoteE); err != nil {
+		return nil, err
+	}
+	out = append(out, hs.encryptAndHash(hs.static.PublicKey().Bytes())...)
+	if err := hs.mixDH(hs.static, hs.remoteE); err != nil {
+		return nil, err
+	}
+	return append(out, hs.encryptAndHash(nil)...), nil
+}
+
+// readResponse reads "<- e, ee, s, es" and returns the responder's static key
+func (hs *noiseHandshake) readResponse(msg []byte) ([]byte, error) {
+	if len(msg) != noiseKeySize+noiseKeySize+noiseTagSize+noiseTagSize {
+		return nil, errors.New("malformed second message")
+	}
+	var err error
+	if hs.remoteE, err = ecdh.X25519().NewPublicKey(msg[:noiseKeySize]); err != nil {
+		return nil, err
+	}
+	hs.mixHash(msg[:noiseKeySize])
+	if err := hs.mixDH(hs.ephemeral, hs.remoteE); err != nil {
+		return nil, err
+	}
+	msg = msg[noiseKeySize:]
+	static, err := hs.decryptAndHash(msg[:noiseKeySize+noiseTagSize])
+	if err != nil {
+		return nil, err
+	}
+	if hs.remoteStatic, err = ecdh.X25519().NewPublicKey(static); err != nil {
+		return nil, err
+	}
+	if err := hs.mixDH(hs.ephemeral, hs.remoteStatic); err != nil {
+		return nil, err
+	}
+	if _, err := hs.decryptAndHash(msg[noiseKeySize+noiseTagSize:]); err != nil {
+		return nil, err
+	}
+	return static, nil
+}
+
+// writeFinal writes the initiator's "-> s, se"
+func (hs *noiseHandshake) writeFinal() ([]byte, error) {
+	out := hs.encryptAndHash(hs.static.PublicKey().Bytes())
+	if err := hs.mixDH(hs.static, hs.remoteE); err != nil {
+		return nil, err
+	}
+	return append(out, hs.encryptAndHash(nil)...), nil
+}
+
+// readFinal reads "-> s, se" and returns the initiator's static key
+func (hs *noiseHandshake) readFinal(msg []byte) ([]byte, error) {
+	if len(msg) != noiseKeySize+noiseTagSize+noiseTagSize {
+		return nil, errors.New("malformed final message")
+	}
+	static, err := hs.decryptAndHash(msg[:noiseKeySize+noiseTagSize])
+	if err != nil {
+		return nil, err
+	}
+	if hs.remoteStatic, err = ecdh.X25519().NewPublicKey(static); err != nil {
+		return nil, err
+	}
+	if err := hs.mixDH(hs.ephemeral, hs.remoteStatic); err != nil {
+		return nil, err
+	}
+	if _, err := hs.decryptAndHash(msg[noiseKeySize+noiseTagSize:]); err != nil {
+		return nil, err
+	}
+	return static, nil
+}
+
+// split returns the initiator-to-responder and responder-to-initiator ciphers
+func (hs *noiseHandshake) split() (*noiseCipher, *noiseCipher) {
+	k1, k2 := noiseHKDF(hs.ck, nil)
+	c1, _ := newNoiseCipher(k1) // 32-byte keys always make valid AES-256 ciphers
+	c2, _ := newNoiseCipher(k2)
+	return c1, c2
+}
+
+// noiseHKDF is Noise's HKDF with two outputs
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	return out1, mac.Sum(nil)
+}
+
+// noiseConn encrypts a connection after the handshake. Each write is sent as frames of a
+// 2-byte length and the sealed data.
+type noiseConn struct {
+	net.Conn
+	send, recv *noiseCipher
+	pending    []byte // Decrypted data not read yet
+	writeMu    sync.Mutex
+	readMu     sync.Mutex
+}
+
+func newNoiseConn(conn net.Conn, send, recv *noiseCipher) *noiseConn {
+	return &noiseConn{Conn: conn, send: send, recv: recv}
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > noiseMaxFrame-noiseTagSize {
+			chunk = chunk[:noiseMaxFrame-noiseTagSize]
+		}
+		frame := make([]byte, 2, 2+len(chunk)+noiseTagSize)
+		frame = c.send.seal(frame, nil, chunk)
+		binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending) == 0 {
+		var header [2]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			return 0, err
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(header[:]))
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			return 0, err
+		}
+		plaintext, err := c.recv.open(frame[:0], nil, frame)
+		if err != nil {
+			return 0, fmt.Errorf("noise frame rejected: %w", err)
+		}
+		c.pending = plaintext
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
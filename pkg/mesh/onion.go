@@ -0,0 +1,368 @@
+package mesh
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// An onion request reaches an exit through relays that can only forward it. The client
+// wraps the request in one layer per hop, the exit's innermost, each sealed with AES-GCM
+// under a key agreed with that hop's onion key (X25519, signed by its identity) and a
+// fresh ephemeral key. A hop peels its layer to learn the next hop and passes the rest
+// on as an "onion" message; the exit hands the request to its exit handler. The reply
+// comes back the same way, each hop sealing it under its layer key, so only the client
+// can open it and no relay sees the request or the response.
+const (
+	onionMessageType      = "onion"
+	onionReplyMessageType = "onion_reply"
+	onionKeyRequestType   = "onion_key_request"
+
+	// DefaultOnionTimeout is how long a hop waits for the reply from the rest of the path
+	DefaultOnionTimeout = 30 * time.Second
+)
+
+var (
+	// ErrOnionRefused is returned when a hop won't carry or serve an onion request
+	ErrOnionRefused = errors.New("onion request refused")
+	// ErrOnionKey is returned for onion keys whose signature doesn't hold
+	ErrOnionKey = errors.New("invalid onion key")
+)
+
+// OnionKey is a node's key for onion layers. Nodes with an identity sign it, so a relay
+// can't pass off its own key as the exit's. Keys of nodes without one are unsigned and
+// only as trustworthy as whoever handed them over, so they are only taken from the node
+// itself over a direct link, and never for an identity-derived node ID.
+type OnionKey struct {
+	NodeID    string `json:"node_id"`
+	Key       []byte `json:"key"`
+	Signer    []byte `json:"signer,omitempty"`
+	Signature []byte `json:"sig,omitempty"`
+}
+
+// Verify checks a signed key's signature and that its node ID derives from the signer.
+// Unsigned keys pass unless the node ID is identity-derived, whose keys must be signed.
+func (k *OnionKey) Verify() error {
+	if len(k.Key) != 32 {
+		return fmt.Errorf("%w: bad key", ErrOnionKey)
+	}
+	if k.Signature == nil {
+		if derivedNodeID(k.NodeID) {
+			return fmt.Errorf("%w: unsigned key for %s", ErrOnionKey, k.NodeID)
+		}
+		return nil
+	}
+	signer := ed25519.PublicKey(k.Signer)
+	if len(signer) != ed25519.PublicKeySize || NodeIDFromKey(signer) != k.NodeID ||
+		!ed25519.Verify(signer, onionKeySigningBytes(k), k.Signature) {
+		return fmt.Errorf("%w: signature doesn't match %s", ErrOnionKey, k.NodeID)
+	}
+	return nil
+}
+
+func onionKeySigningBytes(k *OnionKey) []byte {
+	return []byte(identityContext + " onion key\x00" + k.NodeID + "\x00" + string(k.Key))
+}
+
+// onionLayer is what one hop finds under its layer: where the rest goes, "" at the exit
+type onionLayer struct {
+	Next    string `json:"next,omitempty"`
+	Payload []byte `json:"payload"`
+}
+
+// OnionCircuit holds the layer keys of a request the client built, to open its reply
+type OnionCircuit struct {
+	keys [][]byte
+}
+
+// BuildOnion wraps payload for a path of hops ending at the exit, returning the onion for
+// the first hop and the circuit that opens the reply
+func BuildOnion(path []*OnionKey, payload []byte) ([]byte, *OnionCircuit, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("onion path is empty")
+	}
+	circuit := &OnionCircuit{keys: make([][]byte, len(path))}
+	onion := payload
+	for i := len(path) - 1; i >= 0; i-- {
+		hop := path[i]
+		if err := hop.Verify(); err != nil {
+			return nil, nil, err
+		}
+		peer, err := ecdh.X25519().NewPublicKey(hop.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrOnionKey, err)
+		}
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		shared, err := ephemeral.ECDH(peer)
+		if err != nil {
+			return nil, nil, err
+		}
+		layer := onionLayer{Payload: onion}
+		if i+1 < len(path) {
+			layer.Next = path[i+1].NodeID
+		}
+		data, err := json.Marshal(&layer)
+		if err != nil {
+			return nil, nil, err
+		}
+		circuit.keys[i] = onionLayerKey(shared, ephemeral.PublicKey().Bytes(), hop.Key)
+		sealed, err := seal(circuit.keys[i], data, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		onion = append(ephemeral.PublicKey().Bytes(), sealed...)
+	}
+	return onion, circuit, nil
+}
+
+// OpenReply peels every hop's layer off a reply
+func (c *OnionCircuit) OpenReply(reply []byte) ([]byte, error) {
+	for _, key := range c.keys {
+		opened, err := open(key, reply, nil)
+		if err != nil {
+			return nil, ErrUndecryptable
+		}
+		reply = opened
+	}
+	return reply, nil
+}
+
+func onionLayerKey(shared, ephemeral, static []byte) []byte {
+	sum := sha256.Sum256(append(append(append([]byte("intermesh onion layer\x00"), shared...), ephemeral...), static...))
+	return sum[:]
+}
+
+// onionWaiter is an onion request or key request we sent and are waiting on
+type onionWaiter struct {
+	peerID string
+	ch     chan onionAnswer
+}
+
+// onionAnswer is the answer to an onion call and whether the node we asked sent it to
+// us directly, rather than through relays
+type onionAnswer struct {
+	msg    *Message
+	direct bool
+}
+
+// OnionKey returns our onion key, signed if we have an identity
+func (ma *MeshApp) OnionKey() *OnionKey {
+	key := &OnionKey{NodeID: ma.Node.ID, Key: ma.onionKey.PublicKey().Bytes()}
+	if identity := ma.Node.Identity; identity != nil {
+		key.Signer = identity.PublicKey()
+		key.Signature = ed25519.Sign(identity.PrivateKey, onionKeySigningBytes(key))
+	}
+	return key
+}
+
+// SetOnionExit sets what serves onion requests that end with us; without one we only relay
+func (ma *MeshApp) SetOnionExit(handler func(fromPeer string, payload []byte) ([]byte, error)) {
+	ma.onionMu.Lock()
+	defer ma.onionMu.Unlock()
+	ma.onionExit = handler
+}
+
+// FetchOnionKey asks a peer for its onion key, directly or through relays. Relays could
+// swap an unsigned key for their own, so one is only accepted straight from the peer, and
+// never from a peer that has an identity to sign it with.
+func (ma *MeshApp) FetchOnionKey(peerID string, timeout time.Duration) (*OnionKey, error) {
+	answer, err := ma.awaitOnion(peerID, &Message{Type: onionKeyRequestType}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var key OnionKey
+	if err := json.Unmarshal(answer.msg.Payload, &key); err != nil || key.NodeID != peerID {
+		return nil, fmt.Errorf("%w: from %s", ErrOnionKey, peerID)
+	}
+	if err := key.Verify(); err != nil {
+		return nil, err
+	}
+	if key.Signature == nil && (!answer.direct || ma.Transport.claimsIdentity(peerID)) {
+		return nil, fmt.Errorf("%w: unsigned key for %s", ErrOnionKey, peerID)
+	}
+	return &key, nil
+}
+
+// SendOnion sends a request along a path of hops and returns the exit's reply
+func (ma *MeshApp) SendOnion(path []*OnionKey, payload []byte, timeout time.Duration) ([]byte, error) {
+	onion, circuit, err := BuildOnion(path, payload)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := ma.callOnion(path[0].NodeID, &Message{Type: onionMessageType, Payload: onion}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return circuit.OpenReply(reply.Payload)
+}
+
+// RelayOnion peels our layer off an onion that reached us outside the mesh, such as over
+// BLE, and carries it on or serves it; the reply comes back sealed under our layer
+func (ma *MeshApp) RelayOnion(fromPeer string, onion []byte) ([]byte, error) {
+	return ma.relayOnion(fromPeer, onion, false)
+}
+
+// relayOnion peels our layer and passes the rest to the next hop, or to the exit handler
+// if the path ends here. Exits only serve mesh peers they authorized as proxy clients.
+func (ma *MeshApp) relayOnion(fromPeer string, onion []byte, overMesh bool) ([]byte, error) {
+	if len(onion) < 32 {
+		return nil, ErrUndecryptable
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(onion[:32])
+	if err != nil {
+		return nil, ErrUndecryptable
+	}
+	shared, err := ma.onionKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrUndecryptable
+	}
+	key := onionLayerKey(shared, onion[:32], ma.onionKey.PublicKey().Bytes())
+	data, err := open(key, onion[32:], nil)
+	if err != nil {
+		return nil, ErrUndecryptable
+	}
+	var layer onionLayer
+	if err := json.Unmarshal(data, &layer); err != nil {
+		return nil, ErrUndecryptable
+	}
+
+	var reply []byte
+	if layer.Next == "" {
+		ma.onionMu.Lock()
+		exit := ma.onionExit
+		ma.onionMu.Unlock()
+		if exit == nil || (overMesh && !ma.InternetProxy.IsAuthorized(fromPeer)) {
+			return nil, fmt.Errorf("%w: not an exit for %s", ErrOnionRefused, fromPeer)
+		}
+		if reply, err = exit(fromPeer, layer.Payload); err != nil {
+			return nil, err
+		}
+	} else {
+		if ma.LowPower() {
+			return nil, fmt.Errorf("%w: battery low", ErrOnionRefused)
+		}
+		answer, err := ma.callOnion(layer.Next, &Message{Type: onionMessageType, Payload: layer.Payload}, DefaultOnionTimeout)
+		if err != nil {
+			return nil, err
+		}
+		reply = answer.Payload
+	}
+	return seal(key, reply, nil)
+}
+
+// callOnion sends an onion message to a peer and waits for its answer
+func (ma *MeshApp) callOnion(peerID string, msg *Message, timeout time.Duration) (*Message, error) {
+	answer, err := ma.awaitOnion(peerID, msg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return answer.msg, nil
+}
+
+// awaitOnion is callOnion, also telling whether the answer came straight from the peer
+func (ma *MeshApp) awaitOnion(peerID string, msg *Message, timeout time.Duration) (onionAnswer, error) {
+	if timeout <= 0 {
+		timeout = DefaultOnionTimeout
+	}
+	id := NewID()
+	answer := make(chan onionAnswer, 1)
+	ma.onionMu.Lock()
+	ma.onionCalls[id] = onionWaiter{peerID: peerID, ch: answer}
+	ma.onionMu.Unlock()
+	defer func() {
+		ma.onionMu.Lock()
+		delete(ma.onionCalls, id)
+		ma.onionMu.Unlock()
+	}()
+
+	msg.Source = ma.Node.ID
+	msg.Dest = peerID
+	msg.Timestamp = time.Now()
+	msg.Metadata = map[string]string{"id": id}
+	if err := ma.Transport.SendMessage(ma.nextHopTo(peerID), msg); err != nil {
+		return onionAnswer{}, err
+	}
+	select {
+	case reply := <-answer:
+		if reason := reply.msg.Metadata["error"]; reason != "" {
+			return onionAnswer{}, fmt.Errorf("%w by %s: %s", ErrOnionRefused, peerID, reason)
+		}
+		return reply, nil
+	case <-time.After(timeout):
+		return onionAnswer{}, fmt.Errorf("onion request to %s timed out", peerID)
+	}
+}
+
+// nextHopTo returns the peer a message for dest is handed to
+func (ma *MeshApp) nextHopTo(dest string) string {
+	if route := ma.Router.GetRoute(dest); route != nil && route.NextHop != ma.Node.ID {
+		return route.NextHop
+	}
+	return dest
+}
+
+// handleOnion carries or serves an onion for a trusted peer, and answers with the reply
+// or why there is none
+func (ma *MeshApp) handleOnion(peerID string, msg *Message) {
+	if msg.Dest != ma.Node.ID {
+		if !ma.forward(msg) {
+			ma.reportHopLimitExceeded(peerID, msg)
+		}
+		return
+	}
+	answer := func(payload []byte, err error) {
+		reply := &Message{
+			Type:      onionReplyMessageType,
+			Source:    ma.Node.ID,
+			Dest:      msg.Source,
+			Payload:   payload,
+			Timestamp: time.Now(),
+			Metadata:  map[string]string{"id": msg.Metadata["id"]},
+		}
+		if err != nil {
+			reply.Metadata["error"] = err.Error()
+		}
+		ma.Transport.SendMessage(ma.nextHopTo(msg.Source), reply)
+	}
+
+	switch msg.Type {
+	case onionKeyRequestType:
+		data, err := json.Marshal(ma.OnionKey())
+		answer(data, err)
+	case onionMessageType:
+		now := time.Now()
+		if !ma.Trust.Trusted(msg.Source, now) || ma.Abuse.Standing(msg.Source, now) == StandingBanned {
+			answer(nil, ErrOnionRefused)
+			return
+		}
+		go func() {
+			answer(ma.relayOnion(msg.Source, msg.Payload, true))
+		}()
+	}
+}
+
+// handleOnionReply wakes the call waiting on an answer from the peer it asked
+func (ma *MeshApp) handleOnionReply(peerID string, msg *Message) {
+	if msg.Dest != ma.Node.ID {
+		ma.forward(msg)
+		return
+	}
+	ma.onionMu.Lock()
+	waiter, ok := ma.onionCalls[msg.Metadata["id"]]
+	ma.onionMu.Unlock()
+	if !ok || waiter.peerID != msg.Source {
+		return
+	}
+	select {
+	case waiter.ch <- onionAnswer{msg: msg, direct: peerID == msg.Source}:
+	default:
+	}
+}
@@ -0,0 +1,380 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenTelemetry spans for larger pilots. Spans follow the OTel data model and are exported
+// as OTLP/HTTP JSON, so any OpenTelemetry collector receives them without an SDK.
+
+// TraceparentKey carries W3C trace context in message metadata and HTTP headers
+const TraceparentKey = "traceparent"
+
+const (
+	// OTelExportInterval is how often finished spans are sent to the collector
+	OTelExportInterval = 10 * time.Second
+	// OTelMaxBufferedSpans bounds the spans kept while no node with internet is reachable;
+	// the oldest are dropped first
+	OTelMaxBufferedSpans = 2048
+	// otelServiceName is the service.name resource attribute of exported spans
+	otelServiceName = "intermesh"
+)
+
+// Span kinds, numbered as in OTLP
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+	SpanKindProducer = 4
+	SpanKindConsumer = 5
+)
+
+// SpanContext identifies a span across nodes
+type SpanContext struct {
+	TraceID string // 16 bytes, hex
+	SpanID  string // 8 bytes, hex
+}
+
+// Valid reports whether the context refers to a span
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+// Traceparent formats the context as a W3C traceparent value
+func (sc SpanContext) Traceparent() string {
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-01"
+}
+
+// ParseTraceparent reads a W3C traceparent value
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.DecodeString(parts[2]); err != nil {
+		return SpanContext{}, false
+	}
+	return SpanContext{TraceID: parts[1], SpanID: parts[2]}, true
+}
+
+// MessageSpanContext returns the span context a message was sent under, if any
+func MessageSpanContext(msg *Message) SpanContext {
+	sc, _ := ParseTraceparent(msg.Metadata[TraceparentKey])
+	return sc
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Tracer records spans while an export endpoint is set. A nil or disabled Tracer hands
+// out nil spans, whose methods do nothing.
+type Tracer struct {
+	nodeID   string
+	endpoint string
+	spans    []otlpSpan
+	mu       sync.Mutex
+}
+
+// NewTracer creates a disabled tracer for a node
+func NewTracer(nodeID string) *Tracer {
+	return &Tracer{nodeID: nodeID}
+}
+
+// SetEndpoint sets the OTLP/HTTP traces URL, e.g. http://collector:4318/v1/traces; "" disables tracing
+func (t *Tracer) SetEndpoint(endpoint string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endpoint = endpoint
+	if endpoint == "" {
+		t.spans = nil
+	}
+}
+
+// Enabled reports whether spans are being recorded
+func (t *Tracer) Enabled() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.endpoint != ""
+}
+
+// Start begins a span, as a child of parent when it is valid
+func (t *Tracer) Start(parent SpanContext, name string, kind int) *Span {
+	if !t.Enabled() {
+		return nil
+	}
+	traceID := parent.TraceID
+	if !parent.Valid() {
+		traceID = randomHex(16)
+	}
+	return &Span{
+		tracer: t,
+		data: otlpSpan{
+			TraceID:      traceID,
+			SpanID:       randomHex(8),
+			ParentSpanID: parent.SpanID,
+			Name:         name,
+			Kind:         kind,
+			start:        time.Now(),
+		},
+	}
+}
+
+// Pending returns how many finished spans await export
+func (t *Tracer) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.spans)
+}
+
+func (t *Tracer) finish(span otlpSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.endpoint == "" {
+		return
+	}
+	if len(t.spans) >= OTelMaxBufferedSpans {
+		t.spans = t.spans[1:]
+	}
+	t.spans = append(t.spans, span)
+}
+
+// Export sends the finished spans to the collector with post, which may route through the
+// mesh. Spans that fail to export are kept for the next attempt.
+func (t *Tracer) Export(ctx context.Context, post func(*http.Request) (*http.Response, error)) error {
+	t.mu.Lock()
+	endpoint := t.endpoint
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if endpoint == "" || len(spans) == 0 {
+		return nil
+	}
+
+	err := t.export(ctx, post, endpoint, spans)
+	if err != nil {
+		t.mu.Lock()
+		if t.endpoint == endpoint {
+			t.spans = append(spans, t.spans...)
+			if excess := len(t.spans) - OTelMaxBufferedSpans; excess > 0 {
+				t.spans = t.spans[excess:]
+			}
+		}
+		t.mu.Unlock()
+	}
+	return err
+}
+
+func (t *Tracer) export(ctx context.Context, post func(*http.Request) (*http.Response, error), endpoint string, spans []otlpSpan) error {
+	for i := range spans {
+		spans[i].StartTimeUnixNano = strconv.FormatInt(spans[i].start.UnixNano(), 10)
+		spans[i].EndTimeUnixNano = strconv.FormatInt(spans[i].end.UnixNano(), 10)
+	}
+	body, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			otlpString("service.name", otelServiceName),
+			otlpString("service.instance.id", t.nodeID),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: otelServiceName},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid telemetry endpoint: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := post(req)
+	if err != nil {
+		return fmt.Errorf("failed to export spans: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to export spans: collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Span is one timed operation; only the first End is recorded
+type Span struct {
+	tracer *Tracer
+	data   otlpSpan
+	ended  bool
+	mu     sync.Mutex
+}
+
+// Context returns the span's context for propagation
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID}
+}
+
+// SetAttribute attaches a string attribute
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, otlpString(key, value))
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Status = &otlpStatus{Code: 2, Message: err.Error()}
+}
+
+// Inject adds the span's context to a message's metadata
+func (s *Span) Inject(msg *Message) {
+	if s == nil {
+		return
+	}
+	metadata := make(map[string]string, len(msg.Metadata)+1)
+	for k, v := range msg.Metadata {
+		metadata[k] = v
+	}
+	metadata[TraceparentKey] = s.Context().Traceparent()
+	msg.Metadata = metadata
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.end = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	s.tracer.finish(data)
+}
+
+// OTLP/HTTP JSON encoding of exported spans
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+
+	start, end time.Time
+}
+
+type otlpAttribute struct {
+	Key   string        `json:"key"`
+	Value otlpAnyString `json:"value"`
+}
+
+type otlpAnyString struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyString{StringValue: value}}
+}
+
+func (ma *MeshApp) telemetryExportLoop(ctx context.Context) {
+	ticker := time.NewTicker(OTelExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ma.exportTelemetry(ctx)
+		}
+	}
+}
+
+// exportTelemetry sends finished spans to the collector, directly when this node has
+// internet and otherwise through the mesh's internet proxy
+func (ma *MeshApp) exportTelemetry(ctx context.Context) {
+	if ma.Tracer.Pending() == 0 {
+		return
+	}
+	ma.mu.RLock()
+	hasInternet := ma.Node.HasInternet
+	ma.mu.RUnlock()
+
+	var post func(*http.Request) (*http.Response, error)
+	switch {
+	case hasInternet:
+		post = (&http.Client{Timeout: 30 * time.Second}).Do
+	case ma.InternetClient.IsConnected():
+		post = ma.InternetClient.DoRequest
+	default:
+		return // Kept until a node with internet is reachable
+	}
+	if err := ma.Tracer.Export(ctx, post); err != nil {
+		ma.emitEvent(&Event{Type: EventTelemetryError, Detail: err.Error()})
+	}
+}
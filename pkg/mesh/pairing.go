@@ -0,0 +1,314 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pairing steps, carried in the "step" metadata of "pairing" messages. The initiator
+// commits to its key before seeing the responder's, so a man in the middle can't search
+// for keys that produce a matching code.
+const (
+	pairingStepCommit = "commit" // initiator -> responder: SHA-256 of the initiator's key
+	pairingStepKey    = "key"    // responder -> initiator: responder's key
+	pairingStepReveal = "reveal" // initiator -> responder: initiator's key
+)
+
+// PairingTimeout is how long a pairing may take before it has to be restarted
+const PairingTimeout = 2 * time.Minute
+
+var (
+	// ErrPairingNotFound is returned when there is no pairing in progress with a peer
+	ErrPairingNotFound = errors.New("no pairing in progress with peer")
+	// ErrPairingMismatch is returned when the user reports that the codes differ
+	ErrPairingMismatch = errors.New("pairing codes do not match")
+)
+
+// pairingSession is one key exchange with a peer
+type pairingSession struct {
+	initiator  bool
+	key        *ecdh.PrivateKey
+	remoteKey  []byte
+	commitment []byte // responder only: the initiator's commitment
+	code       string // set once both keys are known
+	secret     []byte // Key derived from the exchange, kept for authenticating the peer later
+	started    time.Time
+}
+
+// pairingReply is a pairing message to send back to the peer; an empty step means none
+type pairingReply struct {
+	step    string
+	payload []byte
+}
+
+// Pairing verifies first contact with a peer by a short authentication string: both
+// devices derive a 6-digit code from an ephemeral X25519 exchange and the users
+// compare them. Peers whose codes were confirmed are remembered as verified.
+type Pairing struct {
+	sessions map[string]*pairingSession
+	verified map[string]time.Time
+	keys     map[string][]byte    // Pairing keys of verified peers
+	preauth  map[string]time.Time // Peers pre-authorized by a scanned pairing payload
+	mu       sync.Mutex
+}
+
+// NewPairing creates a pairing manager with no verified peers
+func NewPairing() *Pairing {
+	return &Pairing{
+		sessions: make(map[string]*pairingSession),
+		verified: make(map[string]time.Time),
+		keys:     make(map[string][]byte),
+		preauth:  make(map[string]time.Time),
+	}
+}
+
+// start begins a pairing as initiator and returns the commitment to send
+func (p *Pairing) start(peerID string) ([]byte, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate pairing key: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[peerID] = &pairingSession{initiator: true, key: key, started: time.Now()}
+	commitment := sha256.Sum256(key.PublicKey().Bytes())
+	return commitment[:], nil
+}
+
+// handle processes a pairing message and returns the reply to send, if any
+func (p *Pairing) handle(peerID, step string, payload []byte) (pairingReply, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	session, ok := p.sessions[peerID]
+	if ok && time.Since(session.started) > PairingTimeout {
+		delete(p.sessions, peerID)
+		session, ok = nil, false
+	}
+
+	switch step {
+	case pairingStepCommit:
+		// A new commitment always restarts the exchange
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return pairingReply{}, fmt.Errorf("failed to generate pairing key: %w", err)
+		}
+		p.sessions[peerID] = &pairingSession{
+			key:        key,
+			commitment: append([]byte(nil), payload...),
+			started:    time.Now(),
+		}
+		return pairingReply{step: pairingStepKey, payload: key.PublicKey().Bytes()}, nil
+
+	case pairingStepKey:
+		if !ok || !session.initiator || session.remoteKey != nil {
+			return pairingReply{}, ErrPairingNotFound
+		}
+		code, secret, err := pairingCode(session.key, payload, session.key.PublicKey().Bytes(), payload)
+		if err != nil {
+			delete(p.sessions, peerID)
+			return pairingReply{}, err
+		}
+		session.remoteKey = append([]byte(nil), payload...)
+		session.code, session.secret = code, secret
+		return pairingReply{step: pairingStepReveal, payload: session.key.PublicKey().Bytes()}, nil
+
+	case pairingStepReveal:
+		if !ok || session.initiator || session.remoteKey != nil {
+			return pairingReply{}, ErrPairingNotFound
+		}
+		if digest := sha256.Sum256(payload); !bytes.Equal(digest[:], session.commitment) {
+			delete(p.sessions, peerID)
+			return pairingReply{}, fmt.Errorf("pairing key does not match commitment")
+		}
+		code, secret, err := pairingCode(session.key, payload, payload, session.key.PublicKey().Bytes())
+		if err != nil {
+			delete(p.sessions, peerID)
+			return pairingReply{}, err
+		}
+		session.remoteKey = append([]byte(nil), payload...)
+		session.code, session.secret = code, secret
+		return pairingReply{}, nil
+	}
+
+	return pairingReply{}, fmt.Errorf("unknown pairing step %q", step)
+}
+
+// Code returns the code to show the user for a pairing in progress
+func (p *Pairing) Code(peerID string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	session, ok := p.sessions[peerID]
+	if !ok || session.code == "" {
+		return "", false
+	}
+	return session.code, true
+}
+
+// Confirm records the user's comparison of the codes. Matching codes mark the peer
+// verified; either way the pairing session ends.
+func (p *Pairing) Confirm(peerID string, matches bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	session, ok := p.sessions[peerID]
+	if !ok || session.code == "" {
+		return ErrPairingNotFound
+	}
+	delete(p.sessions, peerID)
+	if !matches {
+		return ErrPairingMismatch
+	}
+	p.verified[peerID] = time.Now()
+	p.keys[peerID] = session.secret
+	return nil
+}
+
+// IsVerified returns whether the user has confirmed pairing with a peer
+func (p *Pairing) IsVerified(peerID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.verified[peerID]
+	return ok
+}
+
+// Forget drops a peer's verification and any pairing in progress
+func (p *Pairing) Forget(peerID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.verified, peerID)
+	delete(p.keys, peerID)
+	delete(p.preauth, peerID)
+	delete(p.sessions, peerID)
+}
+
+// Preauthorize trusts a peer out of band, e.g. from its scanned pairing payload. Only a
+// peer that proves its identity counts as paired this way, see MeshApp.pairingRequired.
+func (p *Pairing) Preauthorize(peerID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.preauth[peerID] = time.Now()
+}
+
+// IsPreauthorized returns whether a peer was pre-authorized
+func (p *Pairing) IsPreauthorized(peerID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.preauth[peerID]
+	return ok
+}
+
+// key returns the pairing key shared with a verified peer
+func (p *Pairing) key(peerID string) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[peerID]
+	return key, ok
+}
+
+// pairingCode derives the 6-digit code and the pairing key from the shared secret and both public keys
+func pairingCode(key *ecdh.PrivateKey, remote, initiatorKey, responderKey []byte) (string, []byte, error) {
+	remoteKey, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid pairing key: %w", err)
+	}
+	shared, err := key.ECDH(remoteKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("pairing key exchange failed: %w", err)
+	}
+
+	derive := func(label string) []byte {
+		h := sha256.New()
+		h.Write([]byte(label))
+		h.Write(shared)
+		h.Write(initiatorKey)
+		h.Write(responderKey)
+		return h.Sum(nil)
+	}
+	sum := derive("intermesh-pairing")
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[:4])%1000000), derive("intermesh-pairing-key"), nil
+}
+
+// SetRequirePairing makes first contact for proxy use, in either direction, wait until
+// the users have compared pairing codes
+func (ma *MeshApp) SetRequirePairing(required bool) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.requirePairing = required
+}
+
+// pairingRequired returns whether a peer must be paired before it is trusted. Peers
+// pre-authorized by their pairing payload are paired once they prove the identity in it.
+func (ma *MeshApp) pairingRequired(peerID string) bool {
+	ma.mu.RLock()
+	required := ma.requirePairing
+	ma.mu.RUnlock()
+	if !required || ma.Pairing.IsVerified(peerID) {
+		return false
+	}
+	return !ma.Pairing.IsPreauthorized(peerID) || !ma.Transport.PeerProven(peerID)
+}
+
+// StartPairing begins code verification with a peer. Both sides emit EventPairingCode
+// with the code to display once the key exchange completes.
+func (ma *MeshApp) StartPairing(peerID string) error {
+	// Peers that connected to us may not be discovered; SendMessage reports if there is no link
+	if peer, ok := ma.Discovery.GetPeer(peerID); ok {
+		if err := ma.Transport.ConnectToPeer(peer.ID, peer.IP, peer.Port); err != nil {
+			return fmt.Errorf("failed to connect for pairing: %w", err)
+		}
+	}
+
+	commitment, err := ma.Pairing.start(peerID)
+	if err != nil {
+		return err
+	}
+	return ma.sendPairing(peerID, pairingReply{step: pairingStepCommit, payload: commitment})
+}
+
+// ConfirmPairing records whether the code shown matched the one on the peer's screen
+func (ma *MeshApp) ConfirmPairing(peerID string, matches bool) error {
+	if err := ma.Pairing.Confirm(peerID, matches); err != nil {
+		ma.emitEvent(&Event{Type: EventPairingFailed, PeerID: peerID, Detail: err.Error()})
+		return err
+	}
+	ma.Audit.Record(AuditPairingVerified, peerID, "")
+	ma.emitEvent(&Event{Type: EventPairingVerified, PeerID: peerID})
+	return nil
+}
+
+func (ma *MeshApp) handlePairing(peerID string, msg *Message) {
+	reply, err := ma.Pairing.handle(peerID, msg.Metadata["step"], msg.Payload)
+	if err != nil {
+		ma.emitEvent(&Event{Type: EventPairingFailed, PeerID: peerID, Detail: err.Error()})
+		return
+	}
+	if reply.step != "" {
+		if err := ma.sendPairing(peerID, reply); err != nil {
+			ma.emitEvent(&Event{Type: EventPairingFailed, PeerID: peerID, Detail: err.Error()})
+			return
+		}
+	}
+	if code, ok := ma.Pairing.Code(peerID); ok {
+		ma.emitEvent(&Event{Type: EventPairingCode, PeerID: peerID, Detail: code})
+	}
+}
+
+func (ma *MeshApp) sendPairing(peerID string, reply pairingReply) error {
+	return ma.Transport.SendMessage(peerID, &Message{
+		Type:      "pairing",
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Payload:   reply.payload,
+		Timestamp: time.Now(),
+		Metadata:  map[string]string{"step": reply.step},
+	})
+}
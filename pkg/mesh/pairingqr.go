@@ -0,0 +1,232 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A pairing payload lets two devices pre-authorize each other before they meet on the
+// mesh: each shows its payload as a QR code and scans the other's. The payload carries
+// the device's public key, which its node ID derives from, and where to reach it, signed
+// with that key. The text form is upper-case base32 behind a prefix, so it fits a QR
+// code's compact alphanumeric mode.
+
+// PairingPayloadPrefix starts every pairing payload, so scanners can tell them from other QR codes
+const PairingPayloadPrefix = "INTERMESH:"
+
+// DefaultPairingPayloadTTL is how long a payload is valid when no lifetime is given
+const DefaultPairingPayloadTTL = 10 * time.Minute
+
+const (
+	pairingPayloadVersion = 1
+	maxPairingName        = 32 // Bytes of the device name kept, so the QR code stays small
+)
+
+// Transport hint kinds in the binary payload
+const (
+	hintTCP4 = 1 // IPv4 address and port
+	hintTCP6 = 2 // IPv6 address and port
+	hintMAC  = 3 // Bluetooth or Wi-Fi MAC address
+)
+
+// ErrPairingPayloadExpired is returned for payloads scanned after their expiry
+var ErrPairingPayloadExpired = errors.New("pairing payload expired")
+
+// PairingPayload is what a device shows as a QR code for another to scan
+type PairingPayload struct {
+	NodeID  string            `json:"node_id"`
+	Name    string            `json:"name,omitempty"`
+	Key     ed25519.PublicKey `json:"key"`
+	Addrs   []string          `json:"addrs,omitempty"` // host:port of its mesh transport
+	MAC     string            `json:"mac,omitempty"`
+	Expires time.Time         `json:"expires"`
+}
+
+// NewPairingPayload encodes and signs a payload for identity, valid for ttl or
+// DefaultPairingPayloadTTL. Addresses that aren't an IP and port are left out.
+func NewPairingPayload(identity *Identity, name string, addrs []string, mac string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		ttl = DefaultPairingPayloadTTL
+	}
+	if len(name) > maxPairingName {
+		name = strings.ToValidUTF8(name[:maxPairingName], "")
+	}
+
+	var hints [][]byte
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		n, err := strconv.Atoi(port)
+		if ip == nil || err != nil || n < 1 || n > 65535 {
+			continue
+		}
+		hint := []byte{hintTCP6}
+		if ip4 := ip.To4(); ip4 != nil {
+			hint, ip = []byte{hintTCP4}, ip4
+		}
+		hint = append(hint, ip...)
+		hints = append(hints, binary.BigEndian.AppendUint16(hint, uint16(n)))
+	}
+	if hw, err := net.ParseMAC(mac); err == nil && len(hw) == 6 {
+		hints = append(hints, append([]byte{hintMAC}, hw...))
+	}
+	if len(hints) > 255 {
+		return "", errors.New("too many transport hints")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(pairingPayloadVersion)
+	buf.Write(identity.PublicKey())
+	binary.Write(&buf, binary.BigEndian, uint32(time.Now().Add(ttl).Unix()))
+	buf.WriteByte(byte(len(name)))
+	buf.WriteString(name)
+	buf.WriteByte(byte(len(hints)))
+	for _, hint := range hints {
+		buf.Write(hint)
+	}
+	buf.Write(ed25519.Sign(identity.PrivateKey, pairingSigningBytes(buf.Bytes())))
+	return PairingPayloadPrefix + inviteEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// pairingSigningBytes binds a payload signature to its purpose
+func pairingSigningBytes(payload []byte) []byte {
+	return append([]byte(identityContext+" pairing\x00"), payload...)
+}
+
+// ParsePairingPayload decodes a scanned payload, checking its signature and that it
+// hasn't expired by now
+func ParsePairingPayload(text string, now time.Time) (*PairingPayload, error) {
+	text = strings.TrimSpace(text)
+	if len(text) < len(PairingPayloadPrefix) || !strings.EqualFold(text[:len(PairingPayloadPrefix)], PairingPayloadPrefix) {
+		return nil, errors.New("not a pairing payload")
+	}
+	data, err := inviteEncoding.DecodeString(strings.ToUpper(text[len(PairingPayloadPrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pairing payload: %w", err)
+	}
+	if len(data) < ed25519.SignatureSize {
+		return nil, errors.New("pairing payload too short")
+	}
+	signed, sig := data[:len(data)-ed25519.SignatureSize], data[len(data)-ed25519.SignatureSize:]
+
+	r := bytes.NewReader(signed)
+	truncated := errors.New("pairing payload truncated")
+	if version, err := r.ReadByte(); err != nil {
+		return nil, truncated
+	} else if version != pairingPayloadVersion {
+		return nil, fmt.Errorf("unsupported pairing payload version %d", version)
+	}
+	key := make([]byte, ed25519.PublicKeySize)
+	var expires uint32
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, truncated
+	}
+	if err := binary.Read(r, binary.BigEndian, &expires); err != nil {
+		return nil, truncated
+	}
+	if !ed25519.Verify(key, pairingSigningBytes(signed), sig) {
+		return nil, errors.New("bad signature on pairing payload")
+	}
+
+	p := &PairingPayload{NodeID: NodeIDFromKey(key), Key: key, Expires: time.Unix(int64(expires), 0)}
+	nameLen, err := r.ReadByte()
+	if err != nil {
+		return nil, truncated
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, truncated
+	}
+	if !utf8.Valid(name) {
+		return nil, errors.New("invalid name in pairing payload")
+	}
+	p.Name = string(name)
+
+	count, err := r.ReadByte()
+	if err != nil {
+		return nil, truncated
+	}
+	for i := 0; i < int(count); i++ {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, truncated
+		}
+		size := map[byte]int{hintTCP4: net.IPv4len + 2, hintTCP6: net.IPv6len + 2, hintMAC: 6}[kind]
+		if size == 0 {
+			return nil, fmt.Errorf("unknown transport hint %d in pairing payload", kind)
+		}
+		hint := make([]byte, size)
+		if _, err := io.ReadFull(r, hint); err != nil {
+			return nil, truncated
+		}
+		if kind == hintMAC {
+			p.MAC = net.HardwareAddr(hint).String()
+			continue
+		}
+		port := binary.BigEndian.Uint16(hint[size-2:])
+		p.Addrs = append(p.Addrs, net.JoinHostPort(net.IP(hint[:size-2]).String(), strconv.Itoa(int(port))))
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("trailing data in pairing payload")
+	}
+
+	if now.After(p.Expires) {
+		return nil, ErrPairingPayloadExpired
+	}
+	return p, nil
+}
+
+// PairingPayload returns this node's payload to show as a QR code, valid for ttl or
+// DefaultPairingPayloadTTL. It needs a node identity, since the payload is signed.
+func (ma *MeshApp) PairingPayload(ttl time.Duration) (string, error) {
+	identity := ma.Node.Identity
+	if identity == nil {
+		return "", errors.New("node has no identity to sign a pairing payload with")
+	}
+	var addrs []string
+	if _, port, err := net.SplitHostPort(ma.Transport.ListenAddr()); err == nil && ma.Node.IP != "" {
+		addrs = append(addrs, net.JoinHostPort(ma.Node.IP, port))
+	}
+	return NewPairingPayload(identity, ma.Node.Name, addrs, ma.Node.MAC, ttl)
+}
+
+// AcceptPairingPayload pre-authorizes the device whose payload was scanned: once it
+// proves the identity in the payload, it counts as paired without comparing codes. Its
+// first address is added as a static peer so the devices find each other.
+func (ma *MeshApp) AcceptPairingPayload(text string) (*PairingPayload, error) {
+	p, err := ParsePairingPayload(text, time.Now())
+	if err != nil {
+		ma.emitEvent(&Event{Type: EventPairingFailed, Detail: err.Error()})
+		return nil, err
+	}
+	if p.NodeID == ma.Node.ID {
+		return nil, errors.New("pairing payload is our own")
+	}
+	if ma.Revocations.Revoked(p.NodeID) {
+		return nil, fmt.Errorf("%s: %w", p.NodeID, ErrRevoked)
+	}
+
+	ma.Pairing.Preauthorize(p.NodeID)
+	if len(p.Addrs) > 0 {
+		if host, port, err := net.SplitHostPort(p.Addrs[0]); err == nil {
+			// The device may not be in range yet; static peers are dialed again later
+			n, _ := strconv.Atoi(port)
+			ma.AddStaticPeer(p.NodeID, host, n)
+		}
+	}
+	ma.Audit.Record(AuditPairingVerified, p.NodeID, "pre-authorized by pairing payload")
+	ma.emitEvent(&Event{Type: EventPairingVerified, PeerID: p.NodeID, Detail: "pre-authorized"})
+	return p, nil
+}
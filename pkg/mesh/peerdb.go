@@ -0,0 +1,130 @@
+package mesh
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+const (
+	DefaultMaxPeers           = 256
+	DefaultMaxDiscoveredPeers = 512
+)
+
+// peerLRU tracks how recently peers were seen so the least recently seen
+// unpinned peer can be evicted when a peer table is full
+type peerLRU struct {
+	order  *list.List // Front is the most recently seen peer
+	elems  map[string]*list.Element
+	pinned map[string]bool
+}
+
+func newPeerLRU() *peerLRU {
+	return &peerLRU{
+		order:  list.New(),
+		elems:  make(map[string]*list.Element),
+		pinned: make(map[string]bool),
+	}
+}
+
+// touch marks a peer as most recently seen
+func (l *peerLRU) touch(peerID string) {
+	if elem, ok := l.elems[peerID]; ok {
+		l.order.MoveToFront(elem)
+		return
+	}
+	l.elems[peerID] = l.order.PushFront(peerID)
+}
+
+// remove forgets a peer's recency (its pin is kept)
+func (l *peerLRU) remove(peerID string) {
+	if elem, ok := l.elems[peerID]; ok {
+		l.order.Remove(elem)
+		delete(l.elems, peerID)
+	}
+}
+
+func (l *peerLRU) pin(peerID string) {
+	l.pinned[peerID] = true
+}
+
+func (l *peerLRU) unpin(peerID string) {
+	delete(l.pinned, peerID)
+}
+
+// victim returns the least recently seen peer that is neither pinned nor kept by keep
+func (l *peerLRU) victim(keep func(peerID string) bool) (string, bool) {
+	for elem := l.order.Back(); elem != nil; elem = elem.Prev() {
+		peerID := elem.Value.(string)
+		if l.pinned[peerID] || (keep != nil && keep(peerID)) {
+			continue
+		}
+		return peerID, true
+	}
+	return "", false
+}
+
+// PeerArchive stores peers evicted from memory so their history isn't lost
+type PeerArchive interface {
+	Store(peer *Peer) error
+	Load(peerID string) (*Peer, bool)
+}
+
+// FilePeerArchive spills evicted peers to a JSON-lines file on disk
+type FilePeerArchive struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFilePeerArchive creates an archive backed by the given file
+func NewFilePeerArchive(path string) *FilePeerArchive {
+	return &FilePeerArchive{path: path}
+}
+
+// Store appends a peer record to the archive
+func (a *FilePeerArchive) Store(peer *Peer) error {
+	data, err := json.Marshal(peer)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Load returns the most recently archived record for a peer
+func (a *FilePeerArchive) Load(peerID string) (*Peer, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	var found *Peer
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var peer Peer
+		if err := json.Unmarshal(scanner.Bytes(), &peer); err != nil {
+			continue
+		}
+		if peer.NodeID == peerID {
+			p := peer
+			found = &p
+		}
+	}
+	return found, found != nil
+}
@@ -0,0 +1,178 @@
+package mesh
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Trust levels of a peer, from least to most trusted
+const (
+	TrustRestricted = -1 // Demoted or banned on our proxy, or refused by the MAC filter
+	TrustUnknown    = 0  // Nothing known about the peer
+	TrustMember     = 1  // Member of one of our personal networks
+	TrustVerified   = 2  // Paired by comparing codes
+)
+
+// Peer list orders
+const (
+	PeerSortName     = "name"     // By name, then ID
+	PeerSortSignal   = "signal"   // Strongest signal first
+	PeerSortInternet = "internet" // Peers with internet first, closest uplink first
+	PeerSortTrust    = "trust"    // Most trusted first
+)
+
+// PeerSummary is a peer as shown in a peer list
+type PeerSummary struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name,omitempty"`
+	IP          string   `json:"ip,omitempty"`
+	Connected   bool     `json:"connected"`
+	Unreachable bool     `json:"unreachable,omitempty"` // Discovered, but recent dials failed
+	HasInternet bool     `json:"has_internet"`
+	Tier        int      `json:"tier"`
+	RSSI        int      `json:"rssi,omitempty"` // 0 if never measured
+	LinkQuality float64  `json:"link_quality,omitempty"`
+	Trust       int      `json:"trust"`
+	Networks    []string `json:"networks,omitempty"` // Personal networks the peer is a member of
+	Hinted      []string `json:"hinted,omitempty"`   // Our personal networks the peer announces it is in, roster or not
+}
+
+// PeerQuery selects, orders and pages a peer list. The zero value lists every peer by name.
+type PeerQuery struct {
+	SortBy       string `json:"sort_by,omitempty"`
+	InternetOnly bool   `json:"internet_only,omitempty"`
+	MinTrust     *int   `json:"min_trust,omitempty"` // nil for any trust level
+	Network      string `json:"network,omitempty"`   // Only members of this personal network, or peers announcing they are
+	Offset       int    `json:"offset,omitempty"`
+	Limit        int    `json:"limit,omitempty"` // 0 for no limit
+}
+
+// ListPeers returns the discovered and connected peers matching q, in its order, so
+// clients on slow bridges only fetch the page they display
+func (ma *MeshApp) ListPeers(q PeerQuery) []PeerSummary {
+	byID := make(map[string]*PeerSummary)
+	summary := func(id string) *PeerSummary {
+		s, ok := byID[id]
+		if !ok {
+			s = &PeerSummary{ID: id}
+			byID[id] = s
+		}
+		return s
+	}
+
+	for _, peer := range ma.Discovery.GetPeers() {
+		s := summary(peer.ID)
+		s.Name, s.IP, s.HasInternet, s.Tier = peer.Name, peer.IP, peer.HasInternet, peer.Tier
+		s.Hinted = peer.Networks
+	}
+	for _, peer := range ma.Node.GetAllPeers() {
+		s := summary(peer.NodeID)
+		if s.IP == "" {
+			s.IP = peer.IP
+		}
+		s.HasInternet = s.HasInternet || peer.HasInternet
+		if peer.SignalUpdated > 0 {
+			s.RSSI, s.LinkQuality = peer.RSSI, peer.LinkQuality
+		}
+	}
+	for _, id := range ma.Transport.GetConnectedPeers() {
+		summary(id).Connected = true
+	}
+
+	now := time.Now()
+	peers := make([]PeerSummary, 0, len(byID))
+	for _, s := range byID {
+		s.Networks = ma.PersonalNetworkMgr.NetworksOf(s.ID)
+		s.Trust = ma.peerTrust(s, now)
+		_, s.Unreachable = ma.dials.state(s.ID)
+
+		if q.InternetOnly && !s.HasInternet {
+			continue
+		}
+		if q.MinTrust != nil && s.Trust < *q.MinTrust {
+			continue
+		}
+		if q.Network != "" && !containsString(s.Networks, q.Network) && !containsString(s.Hinted, q.Network) {
+			continue
+		}
+		peers = append(peers, *s)
+	}
+
+	sort.Slice(peers, peerLess(peers, q.SortBy))
+
+	if q.Offset > 0 {
+		if q.Offset >= len(peers) {
+			return []PeerSummary{}
+		}
+		peers = peers[q.Offset:]
+	}
+	if q.Limit > 0 && len(peers) > q.Limit {
+		peers = peers[:q.Limit]
+	}
+	return peers
+}
+
+// peerTrust rates a peer from pairing, network membership and its record on our proxy
+func (ma *MeshApp) peerTrust(s *PeerSummary, now time.Time) int {
+	if standing := ma.Abuse.Standing(s.ID, now); standing != StandingGood {
+		return TrustRestricted
+	}
+	if peer, ok := ma.Discovery.GetPeer(s.ID); ok && !ma.MACFilter.Allowed(peer.MAC) {
+		return TrustRestricted
+	}
+	if ma.Pairing.IsVerified(s.ID) {
+		return TrustVerified
+	}
+	if len(s.Networks) > 0 {
+		return TrustMember
+	}
+	return TrustUnknown
+}
+
+// peerLess orders peers by sortBy, falling back to name and ID so the order is stable
+// across calls and pages don't overlap
+func peerLess(peers []PeerSummary, sortBy string) func(i, j int) bool {
+	byName := func(a, b *PeerSummary) bool {
+		if an, bn := strings.ToLower(a.Name), strings.ToLower(b.Name); an != bn {
+			return an < bn
+		}
+		return a.ID < b.ID
+	}
+
+	return func(i, j int) bool {
+		a, b := &peers[i], &peers[j]
+		switch sortBy {
+		case PeerSortSignal:
+			// Unmeasured peers (RSSI 0) go last
+			if (a.RSSI == 0) != (b.RSSI == 0) {
+				return b.RSSI == 0
+			}
+			if a.RSSI != b.RSSI {
+				return a.RSSI > b.RSSI
+			}
+		case PeerSortInternet:
+			if a.HasInternet != b.HasInternet {
+				return a.HasInternet
+			}
+			if a.HasInternet && a.Tier != b.Tier {
+				return a.Tier < b.Tier
+			}
+		case PeerSortTrust:
+			if a.Trust != b.Trust {
+				return a.Trust > b.Trust
+			}
+		}
+		return byName(a, b)
+	}
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
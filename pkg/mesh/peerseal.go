@@ -0,0 +1,70 @@
+package mesh
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+)
+
+// Payloads that travel outside the mesh transport, such as proxy requests carried over
+// BLE by the platform, can be sealed for one paired peer: AES-GCM under a key derived
+// from the pairing key, bound to sender and recipient so it can't be reflected back or
+// passed off as another peer's. The envelope names the sender, since the platform
+// delivers some payloads without saying where they came from.
+
+// SealedPayload is a payload sealed for a paired peer
+type SealedPayload struct {
+	From   string `json:"sealed_from"`
+	To     string `json:"sealed_to"`
+	Sealed []byte `json:"sealed"`
+}
+
+// IsSealedPayload reports whether data is a SealedPayload envelope
+func IsSealedPayload(data []byte) bool {
+	var probe struct {
+		Sealed []byte `json:"sealed"`
+	}
+	return json.Unmarshal(data, &probe) == nil && len(probe.Sealed) > 0
+}
+
+// SealForPeer seals a payload so only a paired peer can read it, returning the envelope
+// as JSON. It fails with ErrNotPaired for peers we haven't paired with.
+func (ma *MeshApp) SealForPeer(peerID string, plaintext []byte) ([]byte, error) {
+	pairingKey, ok := ma.Pairing.key(peerID)
+	if !ok {
+		return nil, ErrNotPaired
+	}
+	sealed, err := seal(peerPayloadKey(pairingKey), plaintext, peerPayloadAAD(ma.Node.ID, peerID))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&SealedPayload{From: ma.Node.ID, To: peerID, Sealed: sealed})
+}
+
+// OpenFromPeer opens an envelope a paired peer sealed for us, returning its sender and
+// payload. Envelopes for other nodes, from unpaired peers or tampered with fail with
+// ErrUndecryptable or ErrNotPaired.
+func (ma *MeshApp) OpenFromPeer(data []byte) (string, []byte, error) {
+	var envelope SealedPayload
+	if err := json.Unmarshal(data, &envelope); err != nil || len(envelope.Sealed) == 0 || envelope.To != ma.Node.ID {
+		return "", nil, ErrUndecryptable
+	}
+	pairingKey, ok := ma.Pairing.key(envelope.From)
+	if !ok {
+		return "", nil, ErrNotPaired
+	}
+	plaintext, err := open(peerPayloadKey(pairingKey), envelope.Sealed, peerPayloadAAD(envelope.From, envelope.To))
+	if err != nil {
+		return "", nil, ErrUndecryptable
+	}
+	return envelope.From, plaintext, nil
+}
+
+// peerPayloadKey derives the key peer payloads are sealed with from a pairing key
+func peerPayloadKey(pairingKey []byte) []byte {
+	sum := sha256.Sum256(append([]byte("intermesh peer payload\x00"), pairingKey...))
+	return sum[:]
+}
+
+func peerPayloadAAD(from, to string) []byte {
+	return []byte(from + "\x00" + to)
+}
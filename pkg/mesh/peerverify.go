@@ -0,0 +1,72 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrPeerUnverified is returned for incoming connections from peers discovery can't vouch for
+var ErrPeerUnverified = errors.New("peer not verified by discovery")
+
+// verifyIncomingPeer checks an incoming connection against what discovery and the static
+// and link peer lists know: the claimed ID must have been seen, at the address it connects from.
+// For peers that can't prove their identity cryptographically, this stops a device from
+// taking over another's ID just by naming it in the handshake. Mismatches are flagged with an
+// event and audited; they are refused only with Config.RejectUnverified.
+func (ma *MeshApp) verifyIncomingPeer(peerID string, addr net.Addr) error {
+	if ma.Revocations.Revoked(peerID) {
+		return fmt.Errorf("%s: %w", peerID, ErrRevoked)
+	}
+	if ma.Transport.PeerProven(peerID) {
+		return nil // It signed for its ID; the address doesn't matter
+	}
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	knownIP := ""
+	if peer, ok := ma.Discovery.GetPeer(peerID); ok {
+		knownIP = peer.IP
+	} else {
+		ma.mu.RLock()
+		if peer, ok := ma.staticPeers[peerID]; ok {
+			knownIP = peer.IP
+		} else if peer, ok := ma.linkPeers[peerID]; ok {
+			knownIP = peer.IP
+		}
+		ma.mu.RUnlock()
+	}
+
+	var reason string
+	switch {
+	case knownIP == "":
+		reason = fmt.Sprintf("never discovered; connected from %s", host)
+	case !sameIP(knownIP, host):
+		reason = fmt.Sprintf("discovered at %s but connected from %s", knownIP, host)
+	default:
+		return nil
+	}
+
+	reject := ma.Config().RejectUnverified
+	if reject {
+		reason += "; refused"
+	}
+	ma.Audit.Record(AuditPeerUnverified, peerID, reason)
+	ma.emitEvent(&Event{Type: EventPeerUnverified, PeerID: peerID, Detail: reason})
+	if reject {
+		return fmt.Errorf("%w: %s", ErrPeerUnverified, reason)
+	}
+	return nil
+}
+
+// sameIP reports whether two textual addresses are the same IP, so "::ffff:10.0.0.1"
+// matches "10.0.0.1"
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	return ipA.Equal(ipB)
+}
@@ -0,0 +1,111 @@
+package mesh
+
+import (
+	"errors"
+	"time"
+)
+
+// A ping checks that a peer is reachable end to end: the "ping" message is routed to
+// the peer over whatever links lead there, and the peer routes a "pong" back, so the
+// round-trip time covers every relay on the way. Relays forward both like data. Both go
+// as datagrams where links allow, so a ping measures the path without the connection's
+// queueing, and may be lost like one.
+const (
+	pingMessageType = "ping"
+	pongMessageType = "pong"
+
+	// DefaultPingTimeout is how long PingPeer waits for the answer when given no timeout
+	DefaultPingTimeout = 5 * time.Second
+)
+
+// ErrPingTimeout is returned when a pinged peer doesn't answer in time
+var ErrPingTimeout = errors.New("ping timed out")
+
+// pingWaiter is a ping we sent and are waiting on
+type pingWaiter struct {
+	peerID string
+	ch     chan struct{}
+}
+
+// PingPeer sends a ping to a peer, directly or through relays, and returns the round-trip
+// time of its answer
+func (ma *MeshApp) PingPeer(peerID string, timeout time.Duration) (time.Duration, error) {
+	if timeout <= 0 {
+		timeout = DefaultPingTimeout
+	}
+	id := NewID()
+	pong := make(chan struct{}, 1)
+	ma.pingsMu.Lock()
+	ma.pings[id] = pingWaiter{peerID: peerID, ch: pong}
+	ma.pingsMu.Unlock()
+	defer func() {
+		ma.pingsMu.Lock()
+		delete(ma.pings, id)
+		ma.pingsMu.Unlock()
+	}()
+
+	nextHop := peerID
+	if route := ma.Router.GetRoute(peerID); route != nil && route.NextHop != ma.Node.ID {
+		nextHop = route.NextHop
+	}
+	start := time.Now()
+	err := ma.Transport.SendMessage(nextHop, &Message{
+		Type:      pingMessageType,
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Timestamp: start,
+		Metadata:  map[string]string{"id": id},
+		Datagram:  true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-time.After(timeout):
+		return 0, ErrPingTimeout
+	}
+}
+
+// handlePing answers pings addressed to us, back the way the route table leads to the
+// sender or else through the peer the ping came from
+func (ma *MeshApp) handlePing(peerID string, msg *Message) {
+	if msg.Dest != ma.Node.ID {
+		if !ma.forward(msg) {
+			ma.reportHopLimitExceeded(peerID, msg)
+		}
+		return
+	}
+	nextHop := peerID
+	if route := ma.Router.GetRoute(msg.Source); route != nil && route.NextHop != ma.Node.ID {
+		nextHop = route.NextHop
+	}
+	ma.Transport.SendMessage(nextHop, &Message{
+		Type:      pongMessageType,
+		Source:    ma.Node.ID,
+		Dest:      msg.Source,
+		Timestamp: time.Now(),
+		Metadata:  map[string]string{"id": msg.Metadata["id"]},
+		Datagram:  true,
+	})
+}
+
+// handlePong wakes the PingPeer call waiting on an answer from the pinged peer
+func (ma *MeshApp) handlePong(peerID string, msg *Message) {
+	if msg.Dest != ma.Node.ID {
+		ma.forward(msg)
+		return
+	}
+	ma.pingsMu.Lock()
+	waiter, ok := ma.pings[msg.Metadata["id"]]
+	ma.pingsMu.Unlock()
+	if !ok || waiter.peerID != msg.Source {
+		return
+	}
+	select {
+	case waiter.ch <- struct{}{}:
+	default:
+	}
+}
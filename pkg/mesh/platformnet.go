@@ -0,0 +1,141 @@
+package mesh
+
+import (
+	"net"
+	"time"
+)
+
+// Mobile platforms know things about the current network the library can't see for
+// itself. Android drops incoming multicast on Wi-Fi unless the app holds a multicast
+// lock, so discovery would hear nothing while its own announcements still go out. The
+// platform reports the network with SetPlatformNetwork; without the lock, our
+// announcements ask peers to answer with a unicast announcement, which Android delivers.
+
+// unicastReplyInterval limits how often we answer a peer that can't receive multicast,
+// so two such peers can't keep answering each other
+const unicastReplyInterval = AnnounceInterval / 2
+
+// PlatformNetwork describes the network the host platform says the device is on
+type PlatformNetwork struct {
+	Type          string `json:"type"`                     // "wifi", "ethernet", "cellular" or "none"; "" if unknown
+	Interface     string `json:"interface,omitempty"`      // Name of the network interface, e.g. "wlan0"
+	IP            string `json:"ip,omitempty"`             // The device's IPv4 address on it
+	MulticastLock bool   `json:"multicast_lock,omitempty"` // The app holds a Wi-Fi multicast lock
+}
+
+// multicastBlocked reports whether the platform drops incoming multicast on this network
+func (n PlatformNetwork) multicastBlocked() bool {
+	return n.Type == "wifi" && !n.MulticastLock
+}
+
+// SetInterface sets the interface the multicast group is joined on from the next Start;
+// "" uses the system default. Reports whether it changed.
+func (d *Discovery) SetInterface(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := d.iface != name
+	d.iface = name
+	return changed
+}
+
+// multicastInterface returns the interface to join the group on, nil for the default
+func (d *Discovery) multicastInterface() *net.Interface {
+	d.mu.Lock()
+	name := d.iface
+	d.mu.Unlock()
+	if name == "" {
+		return nil
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil // Gone already; the default is better than nothing
+	}
+	return ifi
+}
+
+// SetUnicastReplies sets whether our announcements ask peers to answer by unicast, for
+// when we can't receive multicast. Reports whether it changed.
+func (d *Discovery) SetUnicastReplies(enabled bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := d.unicastReplies != enabled
+	d.unicastReplies = enabled
+	return changed
+}
+
+// replyUnicast answers an announcement from a peer that can't receive multicast with
+// our own announcement, sent to the discovery port at its address. Only announcements
+// that were accepted are answered, at most once per unicastReplyInterval per peer.
+func (d *Discovery) replyUnicast(msg *AnnounceMessage, ip string) {
+	d.peersMu.Lock()
+	peer, ok := d.peers[msg.ID]
+	if !ok || peer.Seq != msg.Seq || peer.IP != ip || time.Since(d.replied[msg.ID]) < unicastReplyInterval {
+		d.peersMu.Unlock()
+		return
+	}
+	for id, at := range d.replied {
+		if time.Since(at) >= unicastReplyInterval {
+			delete(d.replied, id)
+		}
+	}
+	d.replied[msg.ID] = time.Now()
+	d.peersMu.Unlock()
+
+	_, port, err := net.SplitHostPort(d.multicastAddr)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	reply := d.announcementLocked()
+	d.mu.Unlock()
+	data, err := d.encodeAnnouncement(&reply)
+	if err != nil {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, port))
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write(data)
+}
+
+// SetPlatformNetwork tells the library about the network the device is on, from the
+// platform's connectivity callbacks. Discovery joins the multicast group on the given
+// interface, asks peers for unicast answers while multicast is blocked, and a new
+// address is handled like NetworkChanged.
+func (ma *MeshApp) SetPlatformNetwork(info PlatformNetwork) {
+	ma.mu.Lock()
+	ma.platformNet = info
+	running := ma.IsConnected && !ma.suspended
+	ma.mu.Unlock()
+
+	blocked := info.multicastBlocked()
+	if ma.Discovery.SetUnicastReplies(blocked) && blocked {
+		ma.emitEvent(&Event{Type: EventMulticastBlocked, Component: "discovery", Detail: info.Interface})
+	}
+	ifaceChanged := ma.Discovery.SetInterface(info.Interface)
+
+	if ip, _ := ma.Node.Address(); info.IP != "" && info.IP != ip {
+		ma.NetworkChanged(info.IP, "") // Rebinds discovery too
+		return
+	}
+	if ifaceChanged && running {
+		if err := ma.Discovery.Rebind(); err != nil {
+			ma.emitEvent(&Event{Type: EventComponentDegraded, Component: "discovery", Detail: err.Error()})
+		}
+	}
+}
+
+// WantsMulticastLock reports whether the platform should hold a Wi-Fi multicast lock:
+// while discovery runs on Wi-Fi, or on a network the platform hasn't described
+func (ma *MeshApp) WantsMulticastLock() bool {
+	ma.mu.RLock()
+	networkType := ma.platformNet.Type
+	ma.mu.RUnlock()
+	return ma.Discovery.IsRunning() && (networkType == "wifi" || networkType == "")
+}
@@ -0,0 +1,258 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PolicyBundle is a set of rules a personal network owner distributes to members
+type PolicyBundle struct {
+	NetworkID      string               `json:"network_id"`
+	Version        int64                `json:"version"`
+	IssuedAt       time.Time            `json:"issued_at"`
+	DefaultQuotaMB int64                `json:"default_quota_mb,omitempty"` // 0 means unlimited
+	MemberQuotaMB  map[string]int64     `json:"member_quota_mb,omitempty"`  // overrides per node ID
+	Blocklist      []string             `json:"blocklist,omitempty"`        // hostnames, subdomains included
+	SharingHours   string               `json:"sharing_hours,omitempty"`    // "HH:MM-HH:MM", empty means always
+	AllowedExits   []string             `json:"allowed_exits,omitempty"`    // empty means any exit
+	ContentFilter  *ContentFilterPolicy `json:"content_filter,omitempty"`   // required filter for proxied clients
+
+	MaxMessageSize      int      `json:"max_message_size,omitempty"`      // bytes, 0 means the transport limit
+	MaxMetadataSize     int      `json:"max_metadata_size,omitempty"`     // bytes of JSON metadata, 0 means unlimited
+	BlockedMessageTypes []string `json:"blocked_message_types,omitempty"` // message types members may not exchange
+}
+
+// SignedPolicyBundle carries the raw bundle JSON with the owner's signature over it
+type SignedPolicyBundle struct {
+	Bundle    json.RawMessage `json:"bundle"`
+	Signature []byte          `json:"signature"`
+}
+
+var (
+	ErrPolicySignature = errors.New("policy bundle signature invalid")
+	ErrPolicyStale     = errors.New("policy bundle is older than the active one")
+)
+
+// ParsePolicyBundle strictly decodes and validates bundle JSON; unknown fields are rejected
+func ParsePolicyBundle(data []byte) (*PolicyBundle, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var bundle PolicyBundle
+	if err := dec.Decode(&bundle); err != nil {
+		return nil, fmt.Errorf("invalid policy bundle: %w", err)
+	}
+	if err := bundle.Validate(); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// Validate checks the bundle against the policy schema
+func (b *PolicyBundle) Validate() error {
+	if b.NetworkID == "" {
+		return fmt.Errorf("invalid policy bundle: network_id is required")
+	}
+	if b.Version <= 0 {
+		return fmt.Errorf("invalid policy bundle: version must be positive")
+	}
+	if b.DefaultQuotaMB < 0 {
+		return fmt.Errorf("invalid policy bundle: default_quota_mb must not be negative")
+	}
+	for nodeID, quota := range b.MemberQuotaMB {
+		if nodeID == "" || quota < 0 {
+			return fmt.Errorf("invalid policy bundle: bad quota for member %q", nodeID)
+		}
+	}
+	for _, host := range b.Blocklist {
+		if host == "" || strings.ContainsAny(host, " /:") {
+			return fmt.Errorf("invalid policy bundle: bad blocklist entry %q", host)
+		}
+	}
+	if b.ContentFilter != nil {
+		if err := b.ContentFilter.validate(); err != nil {
+			return fmt.Errorf("invalid policy bundle: %w", err)
+		}
+	}
+	if b.MaxMessageSize < 0 || b.MaxMetadataSize < 0 {
+		return fmt.Errorf("invalid policy bundle: message size limits must not be negative")
+	}
+	for _, msgType := range b.BlockedMessageTypes {
+		if msgType == "" || msgType == "policy_bundle" {
+			return fmt.Errorf("invalid policy bundle: bad blocked message type %q", msgType)
+		}
+	}
+	if b.SharingHours != "" {
+		if _, _, err := parseHoursRange(b.SharingHours); err != nil {
+			return fmt.Errorf("invalid policy bundle: %w", err)
+		}
+	}
+	return nil
+}
+
+// SignPolicyBundle validates, encodes and signs a bundle with the owner's key
+func SignPolicyBundle(bundle *PolicyBundle, key ed25519.PrivateKey) (*SignedPolicyBundle, error) {
+	if err := bundle.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode policy bundle: %w", err)
+	}
+	return &SignedPolicyBundle{
+		Bundle:    data,
+		Signature: ed25519.Sign(key, data),
+	}, nil
+}
+
+// Verify checks the signature against the owner's key and returns the decoded bundle
+func (s *SignedPolicyBundle) Verify(ownerKey ed25519.PublicKey) (*PolicyBundle, error) {
+	if len(ownerKey) != ed25519.PublicKeySize || !ed25519.Verify(ownerKey, s.Bundle, s.Signature) {
+		return nil, ErrPolicySignature
+	}
+	return ParsePolicyBundle(s.Bundle)
+}
+
+// PolicyEngine holds the active policy of each personal network and answers enforcement queries
+type PolicyEngine struct {
+	active map[string]*PolicyBundle // network ID -> bundle
+	mu     sync.RWMutex
+}
+
+// NewPolicyEngine creates an engine with no active policies
+func NewPolicyEngine() *PolicyEngine {
+	return &PolicyEngine{
+		active: make(map[string]*PolicyBundle),
+	}
+}
+
+// Apply verifies a signed bundle for the given network and makes it active.
+// Bundles not newer than the active version are rejected.
+func (pe *PolicyEngine) Apply(network *PersonalNetwork, signed *SignedPolicyBundle) (*PolicyBundle, error) {
+	bundle, err := signed.Verify(network.OwnerKey)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.NetworkID != network.ID {
+		return nil, fmt.Errorf("policy bundle is for network %q, not %q", bundle.NetworkID, network.ID)
+	}
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if current, ok := pe.active[bundle.NetworkID]; ok && current.Version >= bundle.Version {
+		return nil, ErrPolicyStale
+	}
+	pe.active[bundle.NetworkID] = bundle
+	return bundle, nil
+}
+
+// Remove drops the active policy of a network
+func (pe *PolicyEngine) Remove(networkID string) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	delete(pe.active, networkID)
+}
+
+// Active returns the active policy of a network
+func (pe *PolicyEngine) Active(networkID string) (*PolicyBundle, bool) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	bundle, ok := pe.active[networkID]
+	return bundle, ok
+}
+
+// IsBlocked returns whether any active policy blocks the given host
+func (pe *PolicyEngine) IsBlocked(host string) bool {
+	host = normalizeHost(host)
+
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	for _, bundle := range pe.active {
+		if hostInList(host, bundle.Blocklist) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostInList returns whether a normalized host is one of the listed hosts or a subdomain of one
+func hostInList(host string, list []string) bool {
+	for _, listed := range list {
+		listed = strings.ToLower(listed)
+		if host == listed || strings.HasSuffix(host, "."+listed) {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaBytes returns the tightest quota that applies to a node, 0 meaning unlimited
+func (pe *PolicyEngine) QuotaBytes(nodeID string) int64 {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	var quota int64
+	for _, bundle := range pe.active {
+		mb, ok := bundle.MemberQuotaMB[nodeID]
+		if !ok {
+			mb = bundle.DefaultQuotaMB
+		}
+		if mb > 0 && (quota == 0 || mb*1024*1024 < quota) {
+			quota = mb * 1024 * 1024
+		}
+	}
+	return quota
+}
+
+// SharingAllowedAt returns whether every active sharing schedule permits sharing at t
+func (pe *PolicyEngine) SharingAllowedAt(t time.Time) bool {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	for _, bundle := range pe.active {
+		terms := &SharingTerms{HoursAvailable: bundle.SharingHours}
+		if !terms.IsAvailableAt(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// ContentFilter returns the content filter required by the active policy with the lowest
+// network ID that sets one, nil if none does
+func (pe *PolicyEngine) ContentFilter() *ContentFilterPolicy {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	var filter *ContentFilterPolicy
+	var from string
+	for networkID, bundle := range pe.active {
+		if bundle.ContentFilter != nil && (filter == nil || networkID < from) {
+			filter, from = bundle.ContentFilter, networkID
+		}
+	}
+	return filter
+}
+
+// AllowedExits returns the union of exit filters across active policies
+func (pe *PolicyEngine) AllowedExits() []string {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	var exits []string
+	seen := make(map[string]bool)
+	for _, bundle := range pe.active {
+		for _, id := range bundle.AllowedExits {
+			if !seen[id] {
+				seen[id] = true
+				exits = append(exits, id)
+			}
+		}
+	}
+	return exits
+}
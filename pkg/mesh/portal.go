@@ -0,0 +1,223 @@
+package mesh
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PortalHost is the name served by the proxy itself: browsing to it through the proxy
+// shows the access page, where unapproved devices ask the sharer for internet access.
+const PortalHost = "access.intermesh"
+
+// maxAccessRequestName bounds the device name a client may leave with its request
+const maxAccessRequestName = 64
+
+// AccessRequest is a device asking for internet access through the access page
+type AccessRequest struct {
+	ClientID  string    `json:"client_id"` // Mesh node ID, or address of a plain client
+	Name      string    `json:"name,omitempty"`
+	Requested time.Time `json:"requested"`
+}
+
+var portalPage = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+{{if .Pending}}<meta http-equiv="refresh" content="5">{{end}}
+<title>InterMesh internet access</title>
+</head>
+<body>
+<h1>InterMesh internet access</h1>
+{{if .Authorized}}
+<p>This device is approved to use this connection.</p>
+{{if .Continue}}<p><a href="{{.Continue}}">Continue to {{.Continue}}</a></p>{{end}}
+{{else if .Pending}}
+<p>Your request was sent. This page refreshes once the owner of this connection approves it.</p>
+{{else}}
+<p>This connection is shared by its owner. Ask for access and they will be notified.</p>
+<form method="post">
+<input type="hidden" name="continue" value="{{.Continue}}">
+<label>Device name <input type="text" name="name" maxlength="64"></label>
+<button type="submit">Request access</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// portalURL returns the access page address, returning to dest once access is granted
+func portalURL(dest string) string {
+	u := url.URL{Scheme: "http", Host: PortalHost, Path: "/"}
+	if dest != "" {
+		u.RawQuery = url.Values{"continue": {dest}}.Encode()
+	}
+	return u.String()
+}
+
+// isPortalRequest reports whether a request is for the access page: addressed to
+// PortalHost, or sent to the proxy directly rather than as a proxied request
+func isPortalRequest(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return false
+	}
+	return r.URL.Host == "" || normalizeHost(r.Host) == PortalHost
+}
+
+// continueURL keeps only plain web addresses as the page to return to
+func continueURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		normalizeHost(u.Host) == PortalHost {
+		return ""
+	}
+	return u.String()
+}
+
+// servePortal shows the access page and records the access requests sent from it
+func (p *InternetProxy) servePortal(w http.ResponseWriter, r *http.Request, client string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, 4096)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(r.PostFormValue("name"))
+		if runes := []rune(name); len(runes) > maxAccessRequestName {
+			name = string(runes[:maxAccessRequestName])
+		}
+		p.requestAccess(client, name)
+		// Stay on whichever address the page was opened at
+		target := "/"
+		if dest := continueURL(r.PostFormValue("continue")); dest != "" {
+			target += "?" + url.Values{"continue": {dest}}.Encode()
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authorized := p.IsAuthorized(client)
+	p.clientsMu.RLock()
+	_, pending := p.requests[client]
+	p.clientsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	portalPage.Execute(w, struct {
+		Authorized, Pending bool
+		Continue            string
+	}{authorized, pending && !authorized, continueURL(r.URL.Query().Get("continue"))})
+}
+
+// refuseUnauthorized turns away a client that hasn't been approved: plain HTTP requests
+// are redirected to the access page, which a CONNECT can't be, so those get its address
+func refuseUnauthorized(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		http.Error(w, fmt.Sprintf("Not approved for internet access; open %s to request it", portalURL("")),
+			http.StatusForbidden)
+		return
+	}
+	dest := ""
+	if r.Method == http.MethodGet {
+		dest = r.URL.String()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, portalURL(continueURL(dest)), http.StatusFound)
+}
+
+// SetRequireAuthorization refuses clients that haven't been authorized, pointing them to
+// the access page instead
+func (p *InternetProxy) SetRequireAuthorization(require bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requireAuth = require
+}
+
+// SetAccessRequestHandler sets a callback for access requests sent from the access page
+func (p *InternetProxy) SetAccessRequestHandler(handler func(req AccessRequest)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onRequest = handler
+}
+
+// IsAuthorized returns whether a client may use our internet
+func (p *InternetProxy) IsAuthorized(clientID string) bool {
+	p.clientsMu.RLock()
+	defer p.clientsMu.RUnlock()
+	client, exists := p.clients[clientID]
+	return exists && client.Authorized
+}
+
+// requestAccess records a client's access request, notifying the handler of new ones
+func (p *InternetProxy) requestAccess(clientID, name string) {
+	if p.IsAuthorized(clientID) {
+		return
+	}
+	p.clientsMu.Lock()
+	req, exists := p.requests[clientID]
+	if !exists {
+		req = &AccessRequest{ClientID: clientID, Requested: time.Now()}
+		p.requests[clientID] = req
+	}
+	req.Name = name
+	notify := *req
+	p.clientsMu.Unlock()
+
+	p.mu.Lock()
+	handler := p.onRequest
+	p.mu.Unlock()
+	if !exists && handler != nil {
+		handler(notify)
+	}
+}
+
+// DenyAccessRequest discards a client's pending access request; it may ask again
+func (p *InternetProxy) DenyAccessRequest(clientID string) bool {
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+	if _, exists := p.requests[clientID]; !exists {
+		return false
+	}
+	delete(p.requests, clientID)
+	return true
+}
+
+// AccessRequests returns the pending access requests, oldest first
+func (p *InternetProxy) AccessRequests() []AccessRequest {
+	p.clientsMu.RLock()
+	defer p.clientsMu.RUnlock()
+	reqs := make([]AccessRequest, 0, len(p.requests))
+	for _, req := range p.requests {
+		reqs = append(reqs, *req)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Requested.Before(reqs[j].Requested) })
+	return reqs
+}
+
+// ApproveAccessRequest authorizes a client that asked for access from the access page
+func (ma *MeshApp) ApproveAccessRequest(clientID string) {
+	ma.InternetProxy.AuthorizeClient(clientID)
+}
+
+// DenyAccessRequest discards a client's access request
+func (ma *MeshApp) DenyAccessRequest(clientID string) {
+	if ma.InternetProxy.DenyAccessRequest(clientID) {
+		ma.Audit.Record(AuditAccessDenied, clientID, "")
+	}
+}
+
+// handleAccessRequest asks the user to approve a device that requested access
+func (ma *MeshApp) handleAccessRequest(req AccessRequest) {
+	ma.Audit.Record(AuditAccessRequested, req.ClientID, req.Name)
+	ma.emitEvent(&Event{Type: EventAccessRequested, PeerID: req.ClientID, Detail: req.Name})
+}
@@ -0,0 +1,152 @@
+package mesh
+
+import "fmt"
+
+// Nodes on battery tell their peers how much charge they have left in announcements.
+// Peers route through and pick proxies that are plugged in or well charged before ones
+// running low, and a node whose battery falls below its relay threshold while unplugged
+// stops relaying for others and sharing its internet until it is charged or plugged in
+// again. Charge is announced in steps of PowerReportStep, so a draining battery doesn't
+// change the announcement every percent and makes a poorer fingerprint.
+
+const (
+	// DefaultMinRelayBattery is the charge, in percent, below which a node on battery
+	// stops relaying and sharing
+	DefaultMinRelayBattery = 20
+	// PowerReportStep is the granularity, in percent, of the charge we announce
+	PowerReportStep = 5
+
+	maxPowerPenalty = 60 // Route cost added for relaying through an empty battery
+)
+
+// PowerStatus is a node's battery as its platform reports it
+type PowerStatus struct {
+	Battery  int  `json:"battery"`            // Charge in percent, -1 if unknown or there is no battery
+	Charging bool `json:"charging,omitempty"` // Plugged in
+}
+
+// Low reports whether the node is on battery with less than minBattery percent left
+func (p *PowerStatus) Low(minBattery int) bool {
+	return p != nil && !p.Charging && p.Battery >= 0 && p.Battery < minBattery
+}
+
+// Equal reports whether two power states are the same; nil is unknown
+func (p *PowerStatus) Equal(other *PowerStatus) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	return *p == *other
+}
+
+// reported returns the status as we announce it, with the charge rounded down to a step
+func (p *PowerStatus) reported() *PowerStatus {
+	if p == nil {
+		return nil
+	}
+	reported := *p
+	if reported.Battery > 0 {
+		reported.Battery -= reported.Battery % PowerReportStep
+	}
+	return &reported
+}
+
+// powerPenalty is the route cost added for a peer on battery, growing as it drains
+func powerPenalty(p *PowerStatus) int {
+	if p == nil || p.Charging || p.Battery < 0 {
+		return 0
+	}
+	return (100 - min(p.Battery, 100)) * maxPowerPenalty / 100
+}
+
+// powerRank orders relays by how well they can afford to relay: plugged in first, then
+// those with enough charge or that don't say, then those running low
+func powerRank(p *PowerStatus) int {
+	switch {
+	case p.Low(DefaultMinRelayBattery):
+		return 0
+	case p != nil && p.Charging:
+		return 2
+	}
+	return 1
+}
+
+// SetPowerStatus reports our battery: the charge in percent, -1 if unknown or there is no
+// battery, and whether we are plugged in. Peers learn it from our announcements. Falling
+// below the relay threshold on battery stops relaying and sharing; charging resumes them.
+func (ma *MeshApp) SetPowerStatus(battery int, charging bool) {
+	power := &PowerStatus{Battery: min(battery, 100), Charging: charging}
+	if battery < 0 {
+		power.Battery = -1
+	}
+	ma.mu.Lock()
+	wasLow := ma.lowPowerLocked()
+	ma.power = power
+	low := ma.lowPowerLocked()
+	ma.mu.Unlock()
+	ma.Discovery.SetPower(power.reported())
+	ma.powerChanged(wasLow, low)
+}
+
+// SetMinRelayBattery sets the charge, in percent, below which we stop relaying and sharing
+// while on battery; 0 relays whatever the charge
+func (ma *MeshApp) SetMinRelayBattery(percent int) {
+	ma.mu.Lock()
+	wasLow := ma.lowPowerLocked()
+	ma.minRelayBattery = percent
+	low := ma.lowPowerLocked()
+	ma.mu.Unlock()
+	ma.powerChanged(wasLow, low)
+}
+
+// PowerStatus returns our battery as last reported, nil if it never was
+func (ma *MeshApp) PowerStatus() *PowerStatus {
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	if ma.power == nil {
+		return nil
+	}
+	power := *ma.power
+	return &power
+}
+
+// LowPower reports whether we are on battery below the relay threshold, and so refuse to
+// relay or share
+func (ma *MeshApp) LowPower() bool {
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	return ma.lowPowerLocked()
+}
+
+// lowPowerLocked is LowPower; ma.mu must be held
+func (ma *MeshApp) lowPowerLocked() bool {
+	return ma.power.Low(ma.minRelayBattery)
+}
+
+// powerChanged stops sharing when we cross below the relay threshold and resumes it when
+// we are back above
+func (ma *MeshApp) powerChanged(wasLow, low bool) {
+	if wasLow == low {
+		return
+	}
+	ma.mu.Lock()
+	threshold := ma.minRelayBattery
+	resume := ma.powerResumeSharing
+	if low {
+		ma.powerResumeSharing = ma.IsInternetSharing
+	} else {
+		ma.powerResumeSharing = false
+	}
+	ma.mu.Unlock()
+
+	if low {
+		ma.emitEvent(&Event{Type: EventRelayPaused, Detail: fmt.Sprintf("battery below %d%%", threshold)})
+		ma.DisableInternetSharing()
+		return
+	}
+	ma.emitEvent(&Event{Type: EventRelayResumed})
+	if resume {
+		ma.EnableInternetSharing()
+	} else {
+		ma.updateProxyAdvertisement()
+	}
+}
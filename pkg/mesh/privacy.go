@@ -0,0 +1,96 @@
+package mesh
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Requests a sharer relays leave from its connection with whatever the client put in
+// them, so sites can tell its clients apart, follow them across sessions and learn the
+// addresses other proxies added on the way. A privacy mode makes relayed requests
+// reveal less about the client: normalizing makes every client look like the same
+// common browser, stripping also drops cookies and referrers, which breaks logins. Both
+// drop the headers naming addresses a request was forwarded for. Tunnels are encrypted
+// end to end, so only plain HTTP requests can be changed.
+
+// Privacy modes for relayed requests
+const (
+	PrivacyOff       = "off"       // Relay headers as the client sent them
+	PrivacyNormalize = "normalize" // Common browser User-Agent and Accept-Language, referrers cut to their origin
+	PrivacyStrip     = "strip"     // No User-Agent, cookies or referrers
+)
+
+// PrivacyUserAgent is what requests claim to be sent by once normalized
+const PrivacyUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+// privacyLanguage is the Accept-Language of normalized requests
+const privacyLanguage = "en-US,en;q=0.9"
+
+// forwardingHeaders name the addresses a request was sent from or forwarded for
+var forwardingHeaders = []string{
+	"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip",
+	"Client-Ip", "X-Client-Ip", "True-Client-Ip", "X-Originating-Ip", "Via",
+}
+
+// ParsePrivacyMode validates a privacy mode; "" is PrivacyOff
+func ParsePrivacyMode(mode string) (string, error) {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case "":
+		return PrivacyOff, nil
+	case PrivacyOff, PrivacyNormalize, PrivacyStrip:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown privacy mode %q", mode)
+}
+
+// ApplyPrivacy rewrites the headers of a request about to be relayed for a privacy mode
+func ApplyPrivacy(h http.Header, mode string) {
+	if mode != PrivacyNormalize && mode != PrivacyStrip {
+		return
+	}
+	for _, name := range forwardingHeaders {
+		h.Del(name)
+	}
+	if mode == PrivacyStrip {
+		// An empty User-Agent keeps the HTTP client from adding its own
+		h.Set("User-Agent", "")
+		h.Del("Cookie")
+		h.Del("Referer")
+		return
+	}
+	h.Set("User-Agent", PrivacyUserAgent)
+	if h.Get("Accept-Language") != "" {
+		h.Set("Accept-Language", privacyLanguage)
+	}
+	if referer := h.Get("Referer"); referer != "" {
+		if u, err := url.Parse(referer); err == nil && u.Scheme != "" && u.Host != "" {
+			h.Set("Referer", u.Scheme+"://"+u.Host+"/")
+		} else {
+			h.Del("Referer")
+		}
+	}
+}
+
+// SetPrivacyMode sets how the requests we relay are rewritten to protect our clients
+func (p *InternetProxy) SetPrivacyMode(mode string) error {
+	parsed, err := ParsePrivacyMode(mode)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.privacy = parsed
+	return nil
+}
+
+// PrivacyMode returns how the requests we relay are rewritten
+func (p *InternetProxy) PrivacyMode() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.privacy == "" {
+		return PrivacyOff
+	}
+	return p.privacy
+}
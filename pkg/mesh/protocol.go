@@ -0,0 +1,144 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Wire protocol versions let the wire format change across a mesh whose nodes upgrade at
+// different times. Nodes state the version they speak and the oldest they accept in
+// handshakes and announcements. Two peers speak the lower of their versions, and link
+// directly only when each accepts the other's; peers that state no version predate
+// versioning and speak version 1. Incompatible peers aren't dialed and are refused at
+// handshake, but still reach each other through relays that accept both, so raising the
+// minimum never splits the mesh while relays remain that speak both versions.
+//
+// Version 1 verifiers re-encode announcements to check their signatures and would drop
+// fields they don't know, so the version fields of announcements aren't signed. They
+// only decide whom we dial; the versions exchanged in the handshake are authoritative.
+const (
+	// ProtocolVersion is the wire protocol version this node speaks
+	ProtocolVersion = 3
+	// MinProtocolVersion is the oldest version accepted from peers unless configured otherwise
+	MinProtocolVersion = 1
+
+	// protocolMessageType carries the acceptor's versions to the peer that dialed it
+	protocolMessageType = "protocol"
+)
+
+// Wire features, for PeerSupports
+const (
+	FeatureCompactCodec  = "compact_codec"  // CodecDict frames, still advertised with "codec"
+	FeatureProtocolHello = "protocol_hello" // The acceptor states its versions after a handshake
+	FeatureDatagrams     = "datagrams"      // Small control messages may go as UDP datagrams, see datagram.go
+)
+
+// protocolFeatures is the compatibility matrix: the version a link must negotiate before a
+// feature is used on it. New wire changes add a version and their feature here.
+var protocolFeatures = map[string]int{
+	FeatureCompactCodec:  1,
+	FeatureProtocolHello: 2,
+	FeatureDatagrams:     3,
+}
+
+// ErrProtocolVersion is returned for peers whose protocol version we don't accept, or
+// that don't accept ours
+var ErrProtocolVersion = errors.New("incompatible protocol version")
+
+// negotiateProtocol returns the version two peers speak, given the version each speaks and
+// the oldest each accepts. Unset versions and minimums are 1.
+func negotiateProtocol(ours, ourMin, theirs, theirMin int) (int, error) {
+	theirs, theirMin = max(theirs, 1), max(theirMin, 1)
+	if theirs < ourMin || ours < theirMin {
+		return 0, fmt.Errorf("%w: we speak %d and accept %d, peer speaks %d and accepts %d",
+			ErrProtocolVersion, ours, ourMin, theirs, theirMin)
+	}
+	return min(ours, theirs), nil
+}
+
+// clampProtocol bounds a configured minimum to the versions we speak; 0 is the default
+func clampProtocol(version int) int {
+	if version <= 0 {
+		return MinProtocolVersion
+	}
+	return min(version, ProtocolVersion)
+}
+
+// stampProtocol states our versions in handshake metadata
+func (t *Transport) stampProtocol(metadata map[string]string) {
+	metadata["proto"] = strconv.Itoa(ProtocolVersion)
+	metadata["proto_min"] = strconv.Itoa(t.minProtocol())
+}
+
+// peerProtocol reads the versions a peer stated in message metadata
+func peerProtocol(metadata map[string]string) (int, int) {
+	version, _ := strconv.Atoi(metadata["proto"])
+	minVersion, _ := strconv.Atoi(metadata["proto_min"])
+	return version, minVersion
+}
+
+// SetMinProtocol sets the oldest protocol version accepted from peers. Raise it once
+// every node has upgraded, to retire what older versions needed.
+func (t *Transport) SetMinProtocol(version int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.minVersion = clampProtocol(version)
+}
+
+func (t *Transport) minProtocol() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return clampProtocol(t.minVersion)
+}
+
+// ProtocolCompatible reports whether we'd link with a peer that announced these versions
+func (t *Transport) ProtocolCompatible(version, minVersion int) bool {
+	_, err := negotiateProtocol(ProtocolVersion, t.minProtocol(), version, minVersion)
+	return err == nil
+}
+
+// PeerProtocol returns the protocol version spoken with a connected peer, or 0. Links we
+// dialed speak version 1 until the peer states its versions.
+func (t *Transport) PeerProtocol(peerID string) int {
+	t.connMu.RLock()
+	conn, ok := t.connections[peerID]
+	t.connMu.RUnlock()
+	if !ok {
+		return 0
+	}
+	return int(conn.protocol.Load())
+}
+
+// PeerSupports reports whether the link to a peer speaks a version with a wire feature
+func (t *Transport) PeerSupports(peerID, feature string) bool {
+	since, ok := protocolFeatures[feature]
+	return ok && t.PeerProtocol(peerID) >= since
+}
+
+// protocolHello tells a peer that dialed us our versions; older peers ignore it
+func (t *Transport) protocolHello(peerID string) *Message {
+	msg := &Message{
+		Type:      protocolMessageType,
+		Source:    t.nodeID,
+		Dest:      peerID,
+		Timestamp: time.Now(),
+		Metadata:  map[string]string{},
+	}
+	t.stampProtocol(msg.Metadata)
+	return msg
+}
+
+// handleProtocol settles the version of a link we dialed from the acceptor's versions,
+// dropping the link if they aren't compatible with ours
+func (t *Transport) handleProtocol(conn *Connection, msg *Message) {
+	version, minVersion := peerProtocol(msg.Metadata)
+	negotiated, err := negotiateProtocol(ProtocolVersion, t.minProtocol(), version, minVersion)
+	if err != nil {
+		conn.Conn.Close()
+		return
+	}
+	conn.protocol.Store(int32(negotiated))
+	t.offerDatagrams(conn)
+}
@@ -1,6 +1,7 @@
 package mesh
 
 import (
+	"crypto/rand"
 	"sync"
 	"time"
 )
@@ -12,6 +13,7 @@ type ProxyConnection struct {
 	EstablishedAt    time.Time
 	BytesTransferred int64
 	LastActivity     time.Time
+	Session          *ProxySession // Keys the connection's traffic; nil between unpaired peers
 }
 
 // ProxyManager manages proxy connections and internet sharing
@@ -19,6 +21,8 @@ type ProxyManager struct {
 	Node        *Node
 	Proxies     map[string]*Peer            // Available proxy peers
 	Connections map[string]*ProxyConnection // Active proxy connections
+	trust       *TrustTracker
+	secrets     func(peerID string) ([]byte, bool) // Secret shared with a peer, to key sessions from
 	mu          sync.RWMutex
 }
 
@@ -45,6 +49,18 @@ func (pm *ProxyManager) UnregisterProxy(peerID string) {
 	delete(pm.Proxies, peerID)
 }
 
+// UpdateProxySignal records a radio measurement for a registered proxy
+func (pm *ProxyManager) UpdateProxySignal(peerID string, rssi int, linkQuality float64) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	proxy, exists := pm.Proxies[peerID]
+	if !exists {
+		return false
+	}
+	proxy.applySignal(rssi, linkQuality, time.Now().Unix())
+	return true
+}
+
 // GetAvailableProxies returns all available proxy peers
 func (pm *ProxyManager) GetAvailableProxies() []*Peer {
 	pm.mu.RLock()
@@ -58,6 +74,14 @@ func (pm *ProxyManager) GetAvailableProxies() []*Peer {
 	return proxies
 }
 
+// SetSessionSecrets sets where the secrets shared with peers come from; connections with
+// peers that share one get a session key
+func (pm *ProxyManager) SetSessionSecrets(secrets func(peerID string) ([]byte, bool)) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.secrets = secrets
+}
+
 // CreateProxyConnection creates a new proxy connection
 func (pm *ProxyManager) CreateProxyConnection(clientID, proxyID string) (*ProxyConnection, error) {
 	pm.mu.Lock()
@@ -75,6 +99,19 @@ func (pm *ProxyManager) CreateProxyConnection(clientID, proxyID string) (*ProxyC
 		EstablishedAt: time.Now(),
 		LastActivity:  time.Now(),
 	}
+	peerID := proxyID
+	if proxyID == pm.Node.ID {
+		peerID = clientID
+	}
+	if pm.secrets != nil {
+		if secret, ok := pm.secrets(peerID); ok {
+			nonce := make([]byte, proxySessionNonceSize)
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, err
+			}
+			connection.Session = newProxySession(secret, clientID, proxyID, nonce)
+		}
+	}
 
 	connID := clientID + "-" + proxyID
 	pm.Connections[connID] = connection
@@ -122,18 +159,50 @@ func (pm *ProxyManager) UpdateProxyActivity(clientID, proxyID string, bytesTrans
 	}
 }
 
-// SelectBestProxy selects the best available proxy for a client
+// SelectBestProxy selects the best available proxy for a client.
+// Untrusted proxies are skipped. Lower proxy tiers win; within a tier more trusted
+// proxies win, then those plugged in or with battery to spare, then faster links, then
+// signal strength.
 func (pm *ProxyManager) SelectBestProxy() (*Peer, error) {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
 	var bestProxy *Peer
 	var bestSignal int = -150 // Worse than any real RSSI
+	var bestTrust int
+	now := time.Now()
 
 	for _, proxy := range pm.Proxies {
-		if proxy.HasInternet && proxy.RSSI > bestSignal {
+		if !proxy.HasInternet {
+			continue
+		}
+		trust := trustRank(pm.trust.Level(proxy.NodeID, now))
+		if trust == 0 {
+			continue // Untrusted
+		}
+		if bestProxy == nil || proxy.ProxyTier < bestProxy.ProxyTier ||
+			(proxy.ProxyTier == bestProxy.ProxyTier && trust > bestTrust) {
+			bestProxy = proxy
+			bestSignal = proxy.RSSI
+			bestTrust = trust
+			continue
+		}
+		if proxy.ProxyTier > bestProxy.ProxyTier || trust < bestTrust {
+			continue
+		}
+		if power, bestPower := powerRank(proxy.Power), powerRank(bestProxy.Power); power != bestPower {
+			if power > bestPower {
+				bestProxy = proxy
+				bestSignal = proxy.RSSI
+				bestTrust = trust
+			}
+			continue
+		}
+		if rank, bestRank := linkRank(proxy.Link), linkRank(bestProxy.Link); rank > bestRank ||
+			(rank == bestRank && proxy.RSSI > bestSignal) {
 			bestProxy = proxy
 			bestSignal = proxy.RSSI
+			bestTrust = trust
 		}
 	}
 
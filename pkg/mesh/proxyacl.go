@@ -0,0 +1,173 @@
+package mesh
+
+import (
+	"sort"
+	"sync"
+)
+
+// ProxyACL decides which clients may use our internet, by peer ID and by personal
+// network membership. A non-empty allow list admits only listed peers and members of
+// listed networks; a denial always wins. Plain devices are listed by their address.
+type ProxyACL struct {
+	allowPeers    map[string]bool
+	denyPeers     map[string]bool
+	allowNetworks map[string]bool
+	denyNetworks  map[string]bool
+	networksOf    func(peerID string) []string
+	mu            sync.RWMutex
+}
+
+// ProxyACLRules is the content of a ProxyACL
+type ProxyACLRules struct {
+	AllowPeers    []string `json:"allow_peers,omitempty"`
+	DenyPeers     []string `json:"deny_peers,omitempty"`
+	AllowNetworks []string `json:"allow_networks,omitempty"`
+	DenyNetworks  []string `json:"deny_networks,omitempty"`
+}
+
+// NewProxyACL creates an ACL that admits every client. networksOf returns the personal
+// networks a peer is a member of; nil means network entries never match.
+func NewProxyACL(networksOf func(peerID string) []string) *ProxyACL {
+	return &ProxyACL{
+		allowPeers:    make(map[string]bool),
+		denyPeers:     make(map[string]bool),
+		allowNetworks: make(map[string]bool),
+		denyNetworks:  make(map[string]bool),
+		networksOf:    networksOf,
+	}
+}
+
+// AllowPeer adds a peer to the allow list
+func (a *ProxyACL) AllowPeer(peerID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.denyPeers, peerID)
+	a.allowPeers[peerID] = true
+}
+
+// DenyPeer adds a peer to the deny list
+func (a *ProxyACL) DenyPeer(peerID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.allowPeers, peerID)
+	a.denyPeers[peerID] = true
+}
+
+// RemovePeer drops a peer from both lists
+func (a *ProxyACL) RemovePeer(peerID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.allowPeers, peerID)
+	delete(a.denyPeers, peerID)
+}
+
+// AllowNetwork admits the members of a personal network
+func (a *ProxyACL) AllowNetwork(networkID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.denyNetworks, networkID)
+	a.allowNetworks[networkID] = true
+}
+
+// DenyNetwork refuses the members of a personal network
+func (a *ProxyACL) DenyNetwork(networkID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.allowNetworks, networkID)
+	a.denyNetworks[networkID] = true
+}
+
+// RemoveNetwork drops a personal network from both lists
+func (a *ProxyACL) RemoveNetwork(networkID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.allowNetworks, networkID)
+	delete(a.denyNetworks, networkID)
+}
+
+// SetRules replaces the ACL's entries
+func (a *ProxyACL) SetRules(rules ProxyACLRules) {
+	set := func(ids []string) map[string]bool {
+		m := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			m[id] = true
+		}
+		return m
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allowPeers = set(rules.AllowPeers)
+	a.denyPeers = set(rules.DenyPeers)
+	a.allowNetworks = set(rules.AllowNetworks)
+	a.denyNetworks = set(rules.DenyNetworks)
+}
+
+// merge adds rules to the ACL's entries
+func (a *ProxyACL) merge(rules ProxyACLRules) {
+	for _, id := range rules.AllowPeers {
+		a.AllowPeer(id)
+	}
+	for _, id := range rules.DenyPeers {
+		a.DenyPeer(id)
+	}
+	for _, id := range rules.AllowNetworks {
+		a.AllowNetwork(id)
+	}
+	for _, id := range rules.DenyNetworks {
+		a.DenyNetwork(id)
+	}
+}
+
+// Rules returns the ACL's entries, sorted
+func (a *ProxyACL) Rules() ProxyACLRules {
+	list := func(m map[string]bool) []string {
+		var ids []string
+		for id := range m {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return ProxyACLRules{
+		AllowPeers:    list(a.allowPeers),
+		DenyPeers:     list(a.denyPeers),
+		AllowNetworks: list(a.allowNetworks),
+		DenyNetworks:  list(a.denyNetworks),
+	}
+}
+
+// Permitted returns whether a client may use our internet. A nil ACL admits everyone.
+func (a *ProxyACL) Permitted(peerID string) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.denyPeers[peerID] {
+		return false
+	}
+	var networks []string
+	if a.networksOf != nil && (len(a.denyNetworks) > 0 || len(a.allowNetworks) > 0) {
+		networks = a.networksOf(peerID)
+	}
+	for _, id := range networks {
+		if a.denyNetworks[id] {
+			return false
+		}
+	}
+	if len(a.allowPeers) == 0 && len(a.allowNetworks) == 0 {
+		return true
+	}
+	if a.allowPeers[peerID] {
+		return true
+	}
+	for _, id := range networks {
+		if a.allowNetworks[id] {
+			return true
+		}
+	}
+	return false
+}
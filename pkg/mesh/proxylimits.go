@@ -0,0 +1,221 @@
+package mesh
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyLimits bounds how long and how many client connections the internet proxy serves,
+// so slow or abandoned clients can't pin the exit's resources. Zero fields disable a limit.
+type ProxyLimits struct {
+	HeaderTimeout           time.Duration // Time a client has to send its request headers
+	IdleTimeout             time.Duration // A CONNECT tunnel or keep-alive connection without traffic is closed
+	TunnelTimeout           time.Duration // Total lifetime of a CONNECT tunnel
+	MaxConnections          int           // Concurrent client connections
+	MaxConnectionsPerClient int           // Concurrent connections from one client address
+	RequestsPerSecond       float64       // Requests from one authorized client, in bursts of up to twice as many
+	MaxRequestsPerClient    int           // Concurrent requests and tunnels from one authorized client
+}
+
+// DefaultProxyLimits returns the limits used unless configured otherwise
+func DefaultProxyLimits() ProxyLimits {
+	return ProxyLimits{
+		HeaderTimeout:           10 * time.Second,
+		IdleTimeout:             2 * time.Minute,
+		TunnelTimeout:           time.Hour,
+		MaxConnections:          256,
+		MaxConnectionsPerClient: 64,
+		RequestsPerSecond:       25,
+		MaxRequestsPerClient:    32,
+	}
+}
+
+// admitRequest takes a request slot for an authorized client within its request rate and
+// concurrent request limits. It returns the func that frees the slot, or, when refused,
+// how long the client should wait before retrying. Refusals count as the client's
+// violations; unknown clients are admitted.
+func (p *InternetProxy) admitRequest(peerID string, now time.Time) (func(), time.Duration, bool) {
+	limits := p.Limits()
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+	client, ok := p.clients[peerID]
+	if !ok {
+		return func() {}, 0, true
+	}
+
+	if limits.MaxRequestsPerClient > 0 && client.inFlight >= limits.MaxRequestsPerClient {
+		client.RateLimited++
+		return nil, time.Second, false
+	}
+	if rate := limits.RequestsPerSecond; rate > 0 {
+		burst := 2 * rate
+		if client.lastRequest.IsZero() {
+			client.tokens = burst
+		} else {
+			client.tokens = math.Min(burst, client.tokens+rate*now.Sub(client.lastRequest).Seconds())
+		}
+		client.lastRequest = now
+		if client.tokens < 1 {
+			client.RateLimited++
+			wait := time.Duration((1 - client.tokens) / rate * float64(time.Second))
+			return nil, max(wait, time.Second), false
+		}
+		client.tokens--
+	}
+
+	client.inFlight++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.clientsMu.Lock()
+			client.inFlight--
+			p.clientsMu.Unlock()
+		})
+	}, 0, true
+}
+
+// limitListener refuses connections beyond the total and per-client caps
+type limitListener struct {
+	net.Listener
+	max       int
+	perClient int
+	active    int
+	byClient  map[string]int
+	mu        sync.Mutex
+}
+
+func newLimitListener(l net.Listener, limits ProxyLimits) net.Listener {
+	if limits.MaxConnections <= 0 && limits.MaxConnectionsPerClient <= 0 {
+		return l
+	}
+	return &limitListener{
+		Listener:  l,
+		max:       limits.MaxConnections,
+		perClient: limits.MaxConnectionsPerClient,
+		byClient:  make(map[string]int),
+	}
+}
+
+// Accept returns the next connection within the caps, closing the ones over them
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		client, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !l.acquire(client) {
+			conn.Close()
+			continue
+		}
+		return &limitConn{Conn: conn, release: func() { l.release(client) }}, nil
+	}
+}
+
+func (l *limitListener) acquire(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.active >= l.max {
+		return false
+	}
+	if l.perClient > 0 && l.byClient[client] >= l.perClient {
+		return false
+	}
+	l.active++
+	l.byClient[client]++
+	return true
+}
+
+func (l *limitListener) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.byClient[client]--; l.byClient[client] <= 0 {
+		delete(l.byClient, client)
+	}
+}
+
+// limitConn frees its slot when closed, including after being hijacked for a tunnel
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// pipeTunnel copies between a CONNECT client and its destination until either side
+// closes, neither side sends anything for idle, or the tunnel has been open for total.
+// It counts traffic on tunnel as it flows, if not nil, and returns the bytes the client
+// sent and received.
+func pipeTunnel(client, dest net.Conn, idle, total time.Duration, tunnel *Tunnel) (int64, int64) {
+	var end time.Time
+	if total > 0 {
+		end = time.Now().Add(total)
+	}
+	if tunnel == nil {
+		tunnel = &Tunnel{}
+	}
+	var lastActive atomic.Int64
+	lastActive.Store(monoNow())
+
+	deadline := func() time.Time {
+		if idle <= 0 {
+			return end
+		}
+		d := time.Now().Add(idle)
+		if !end.IsZero() && end.Before(d) {
+			return end
+		}
+		return d
+	}
+
+	copyDir := func(dst, src net.Conn, transferred *atomic.Int64) {
+		buf := make([]byte, 32*1024)
+		for {
+			src.SetReadDeadline(deadline())
+			n, err := src.Read(buf)
+			if n > 0 {
+				lastActive.Store(monoNow())
+				transferred.Add(int64(n))
+				dst.SetWriteDeadline(deadline())
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				// A quiet direction is fine while the other one still carries traffic
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && idle > 0 &&
+					monoSince(lastActive.Load()) < idle &&
+					(end.IsZero() || time.Now().Before(end)) {
+					continue
+				}
+				return
+			}
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		copyDir(dest, client, &tunnel.sent)
+		done <- struct{}{}
+	}()
+	go func() {
+		copyDir(client, dest, &tunnel.received)
+		done <- struct{}{}
+	}()
+	<-done
+	// Closing both ends unblocks the other direction
+	client.Close()
+	dest.Close()
+	<-done
+	return tunnel.sent.Load(), tunnel.received.Load()
+}
@@ -0,0 +1,384 @@
+package mesh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A proxy connection between paired peers gets its own session key, derived from the
+// pairing key and a fresh nonce when the connection is created. Every TCP connection the
+// client opens to the proxy starts with a preface naming the client, the session nonce
+// and a per-connection nonce, and the proxy answers with a nonce of its own; both
+// directions are then sealed with AES-GCM in records under keys derived from the session
+// key and both connection nonces, so a replayed preface gets fresh keys and its records
+// don't open. Each direction moves to a new key after ProxySessionRekeyBytes. Proxies
+// still accept plain connections from unpaired clients.
+const (
+	// ProxySessionRekeyBytes is how much traffic one direction of a session connection
+	// seals under a key before moving to the next
+	ProxySessionRekeyBytes = 64 << 20
+
+	proxySessionMagic     = "IMSESS2\n"
+	proxySessionNonceSize = 16
+	proxySessionRecord    = 16 << 10         // Largest plaintext sealed in one record
+	proxySessionHandshake = 10 * time.Second // How long the client waits for the proxy's nonce
+)
+
+// ErrProxySession is returned for session connections that can't be set up or whose
+// records don't open
+var ErrProxySession = errors.New("proxy session failed")
+
+// ProxySession keys the traffic of one proxy connection
+type ProxySession struct {
+	ClientID   string
+	ProxyID    string
+	Nonce      []byte
+	key        []byte
+	rekeyAfter int64
+}
+
+// newProxySession derives a session key from the secret the client and proxy share
+func newProxySession(secret []byte, clientID, proxyID string, nonce []byte) *ProxySession {
+	return &ProxySession{
+		ClientID:   clientID,
+		ProxyID:    proxyID,
+		Nonce:      nonce,
+		key:        hmacSum(secret, "intermesh proxy session\x00"+clientID+"\x00"+proxyID+"\x00"+string(nonce)),
+		rekeyAfter: ProxySessionRekeyBytes,
+	}
+}
+
+// connKeys derives the keys of one TCP connection from the client's and the proxy's
+// nonces, client to proxy and proxy to client
+func (s *ProxySession) connKeys(connNonce, proxyNonce []byte) ([]byte, []byte) {
+	nonces := string(connNonce) + string(proxyNonce)
+	return hmacSum(s.key, "client\x00"+nonces), hmacSum(s.key, "proxy\x00"+nonces)
+}
+
+// Client starts a session connection over conn to the proxy
+func (s *ProxySession) Client(conn net.Conn) (net.Conn, error) {
+	connNonce := make([]byte, proxySessionNonceSize)
+	if _, err := rand.Read(connNonce); err != nil {
+		return nil, err
+	}
+	if len(s.ClientID) > 255 {
+		return nil, fmt.Errorf("%w: client ID too long", ErrProxySession)
+	}
+	preface := append([]byte(proxySessionMagic), byte(len(s.ClientID)))
+	preface = append(preface, s.ClientID...)
+	preface = append(preface, s.Nonce...)
+	preface = append(preface, connNonce...)
+	if _, err := conn.Write(preface); err != nil {
+		return nil, err
+	}
+	proxyNonce := make([]byte, proxySessionNonceSize)
+	conn.SetReadDeadline(time.Now().Add(proxySessionHandshake))
+	if _, err := io.ReadFull(conn, proxyNonce); err != nil {
+		return nil, fmt.Errorf("%w: no nonce from the proxy: %v", ErrProxySession, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	send, recv := s.connKeys(connNonce, proxyNonce)
+	return newSessionConn(conn, send, recv, s.rekeyAfter)
+}
+
+// wrapSession starts a session connection over conn, closing conn if it can't
+func wrapSession(conn net.Conn, session *ProxySession) (net.Conn, error) {
+	wrapped, err := session.Client(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// SetProxySessions sets where the sessions keying our connections to each proxy come
+// from; proxies it has none for are reached in the clear
+func (c *InternetClient) SetProxySessions(sessions func(proxyPeerID string) *ProxySession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions = sessions
+}
+
+// sessionLocked returns the session for a proxy we are about to use, or nil; c.mu is held
+func (c *InternetClient) sessionLocked(proxyPeerID string) *ProxySession {
+	if c.sessions == nil {
+		return nil
+	}
+	return c.sessions(proxyPeerID)
+}
+
+// proxySession records a proxy connection to a proxy we are about to use and returns its
+// session, or nil if we haven't paired with the proxy
+func (ma *MeshApp) proxySession(proxyPeerID string) *ProxySession {
+	conn, err := ma.ProxyManager.CreateProxyConnection(ma.Node.ID, proxyPeerID)
+	if err != nil {
+		return nil
+	}
+	return conn.Session
+}
+
+func hmacSum(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// sessionCipher seals or opens one direction of a session connection. Nonces count
+// records; the key ratchets forward once enough plaintext has passed under it.
+type sessionCipher struct {
+	key        []byte
+	aead       cipher.AEAD
+	seq        uint64 // Records under the current key
+	bytes      int64  // Plaintext under the current key
+	rekeyAfter int64
+	rekeys     int
+}
+
+func newSessionCipher(key []byte, rekeyAfter int64) (*sessionCipher, error) {
+	c := &sessionCipher{rekeyAfter: rekeyAfter}
+	if err := c.setKey(key); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *sessionCipher) setKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	c.key, c.aead, c.seq, c.bytes = key, aead, 0, 0
+	return nil
+}
+
+func (c *sessionCipher) nonce() []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.seq)
+	return nonce
+}
+
+// advance moves past a record of n plaintext bytes, rekeying once the threshold is reached
+func (c *sessionCipher) advance(n int) error {
+	c.seq++
+	c.bytes += int64(n)
+	if c.bytes < c.rekeyAfter {
+		return nil
+	}
+	c.rekeys++
+	return c.setKey(hmacSum(c.key, "rekey"))
+}
+
+func (c *sessionCipher) seal(plaintext []byte) ([]byte, error) {
+	sealed := c.aead.Seal(nil, c.nonce(), plaintext, nil)
+	return sealed, c.advance(len(plaintext))
+}
+
+func (c *sessionCipher) open(sealed []byte) ([]byte, error) {
+	plaintext, err := c.aead.Open(nil, c.nonce(), sealed, nil)
+	if err != nil {
+		return nil, ErrProxySession
+	}
+	return plaintext, c.advance(len(plaintext))
+}
+
+// sessionConn seals what is written to it into length-prefixed records and opens the
+// records read from it. A read cut short by a deadline keeps what it got for the next.
+type sessionConn struct {
+	net.Conn
+	rmu     sync.Mutex
+	recv    *sessionCipher
+	partial []byte // Record bytes read but not yet opened
+	pending []byte // Opened plaintext not yet returned
+	buf     []byte
+	wmu     sync.Mutex
+	send    *sessionCipher
+}
+
+func newSessionConn(conn net.Conn, sendKey, recvKey []byte, rekeyAfter int64) (*sessionConn, error) {
+	send, err := newSessionCipher(sendKey, rekeyAfter)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newSessionCipher(recvKey, rekeyAfter)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionConn{Conn: conn, send: send, recv: recv}, nil
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), proxySessionRecord)]
+		sealed, err := c.send.seal(chunk)
+		if err != nil {
+			return written, err
+		}
+		record := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(sealed)), uint32(len(sealed)))
+		if _, err := c.Conn.Write(append(record, sealed...)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.pending) == 0 {
+		if err := c.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// fill reads until a whole record is buffered and opens it
+func (c *sessionConn) fill() error {
+	for {
+		if len(c.partial) >= 4 {
+			size := int(binary.BigEndian.Uint32(c.partial))
+			if size > proxySessionRecord+c.recv.aead.Overhead() {
+				return fmt.Errorf("%w: record too large", ErrProxySession)
+			}
+			if len(c.partial) >= 4+size {
+				plaintext, err := c.recv.open(c.partial[4 : 4+size])
+				if err != nil {
+					return err
+				}
+				c.partial = append(c.partial[:0], c.partial[4+size:]...)
+				if len(plaintext) == 0 {
+					continue
+				}
+				c.pending = plaintext
+				return nil
+			}
+		}
+		if c.buf == nil {
+			c.buf = make([]byte, proxySessionRecord+64)
+		}
+		n, err := c.Conn.Read(c.buf)
+		c.partial = append(c.partial, c.buf[:n]...)
+		if err != nil {
+			if err == io.EOF && len(c.partial) > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
+
+// sessionListener hands out connections that become session connections when the
+// client opens with a session preface, and stay plain otherwise
+type sessionListener struct {
+	net.Listener
+	nodeID  string
+	secrets func(peerID string) ([]byte, bool)
+}
+
+func newSessionListener(l net.Listener, nodeID string, secrets func(peerID string) ([]byte, bool)) net.Listener {
+	if secrets == nil {
+		return l
+	}
+	return &sessionListener{Listener: l, nodeID: nodeID, secrets: secrets}
+}
+
+func (l *sessionListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sessionAcceptConn{Conn: conn, listener: l}, nil
+}
+
+// sessionAcceptConn looks for a session preface the first time it is used
+type sessionAcceptConn struct {
+	net.Conn
+	listener *sessionListener
+	once     sync.Once
+	inner    net.Conn
+	err      error
+}
+
+func (c *sessionAcceptConn) Read(b []byte) (int, error) {
+	c.once.Do(c.sniff)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.inner.Read(b)
+}
+
+func (c *sessionAcceptConn) Write(b []byte) (int, error) {
+	c.once.Do(c.sniff)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.inner.Write(b)
+}
+
+func (c *sessionAcceptConn) sniff() {
+	magic := make([]byte, len(proxySessionMagic))
+	n, err := io.ReadFull(c.Conn, magic)
+	if err != nil || !bytes.Equal(magic, []byte(proxySessionMagic)) {
+		if err != nil && n == 0 {
+			c.err = err
+			return
+		}
+		// A plain client: hand back what we read ahead of the rest
+		c.inner = &bufferedConn{Conn: c.Conn, r: bufio.NewReader(io.MultiReader(bytes.NewReader(magic[:n]), c.Conn))}
+		return
+	}
+	c.inner, c.err = c.acceptSession()
+}
+
+// acceptSession reads the rest of the preface and keys the connection from the secret
+// shared with the client it names
+func (c *sessionAcceptConn) acceptSession() (net.Conn, error) {
+	var idLen [1]byte
+	if _, err := io.ReadFull(c.Conn, idLen[:]); err != nil {
+		return nil, err
+	}
+	rest := make([]byte, int(idLen[0])+2*proxySessionNonceSize)
+	if _, err := io.ReadFull(c.Conn, rest); err != nil {
+		return nil, err
+	}
+	clientID := string(rest[:idLen[0]])
+	nonce := rest[idLen[0] : int(idLen[0])+proxySessionNonceSize]
+	connNonce := rest[int(idLen[0])+proxySessionNonceSize:]
+	proxyNonce := make([]byte, proxySessionNonceSize)
+	if _, err := rand.Read(proxyNonce); err != nil {
+		return nil, err
+	}
+	if _, err := c.Conn.Write(proxyNonce); err != nil {
+		return nil, err
+	}
+	secret, ok := c.listener.secrets(clientID)
+	if !ok {
+		return nil, fmt.Errorf("%w: no secret shared with %s", ErrProxySession, clientID)
+	}
+	session := newProxySession(secret, clientID, c.listener.nodeID, nonce)
+	clientKey, proxyKey := session.connKeys(connNonce, proxyNonce)
+	return newSessionConn(c.Conn, proxyKey, clientKey, session.rekeyAfter)
+}
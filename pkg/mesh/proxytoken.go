@@ -0,0 +1,137 @@
+package mesh
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Exit clients prove they were authorized with a token the proxy issued them, since the
+// node ID a request claims is just a header anyone can set. Mesh peers get their token
+// in the response to their proxy request and present it in the Proxy-Authorization
+// header of every request, or of the CONNECT that opens a tunnel: as a bearer token, or
+// as the password of basic credentials. Devices approved from the access page can't
+// carry a token, so requests without one are recognized by their address alone.
+// Tokens travel in mesh messages and proxy headers, so they are only as private as the
+// transport: enable TLS or Noise where the LAN isn't trusted.
+
+// ProxyAuthRealm is the realm proxies name when asking for a token
+const ProxyAuthRealm = "intermesh"
+
+// proxyTokenFrom returns the token a request presents, or ""
+func proxyTokenFrom(r *http.Request) string {
+	scheme, credentials, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok {
+		return ""
+	}
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		return strings.TrimSpace(credentials)
+	case strings.EqualFold(scheme, "Basic"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+		if err != nil {
+			return ""
+		}
+		_, token, _ := strings.Cut(string(decoded), ":")
+		return token
+	}
+	return ""
+}
+
+// remoteHost returns the address a request came from, without its port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// authenticate identifies a proxy request's client and whether it may use our internet.
+// Only a valid token vouches for a node ID; the credentials and any claimed ID are
+// stripped so neither reaches the internet or is trusted further along.
+func (p *InternetProxy) authenticate(r *http.Request) (client string, authorized bool) {
+	token := proxyTokenFrom(r)
+	r.Header.Del("Proxy-Authorization")
+	r.Header.Del(ClientNodeHeader)
+	if token == "" {
+		client = remoteHost(r)
+		return client, p.IsAuthorized(client)
+	}
+
+	p.clientsMu.RLock()
+	peerID, found := p.tokens[token]
+	p.clientsMu.RUnlock()
+	if !found {
+		p.auditor().Record(AuditProxyTokenRejected, remoteHost(r), "")
+		return remoteHost(r), false
+	}
+	r.Header.Set(ClientNodeHeader, peerID)
+	return peerID, p.IsAuthorized(peerID)
+}
+
+// refuseUnauthenticated asks a client for the token it was issued
+func refuseUnauthenticated(w http.ResponseWriter) {
+	w.Header().Set("Proxy-Authenticate", `Bearer realm="`+ProxyAuthRealm+`"`)
+	http.Error(w, "Proxy authorization required", http.StatusProxyAuthRequired)
+}
+
+// ReauthInterval is how often at most a client asks a proxy that refused its token for a new one
+const ReauthInterval = 10 * time.Second
+
+// SetAuthRequiredHandler sets a callback for when a proxy refuses us for lacking a valid
+// token: because its answer to our request for access hasn't arrived yet, or because it
+// forgot or revoked the token it issued. The callback should ask it for access again.
+func (c *InternetClient) SetAuthRequiredHandler(handler func(proxyPeerID string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onAuth = handler
+}
+
+// authRequired asks again for access to a proxy that refused us, at most once per ReauthInterval
+func (c *InternetClient) authRequired(up *upstreamProxy) {
+	now := monoNow()
+	after := up.reauthAfter.Load()
+	if now < after || !up.reauthAfter.CompareAndSwap(after, monoAt(time.Now().Add(ReauthInterval))) {
+		return
+	}
+	c.mu.Lock()
+	handler := c.onAuth
+	c.mu.Unlock()
+	if handler != nil {
+		go handler(up.peerID)
+	}
+}
+
+// SetProxyToken sets the token a proxy issued us, presented with every request to it
+func (c *InternetClient) SetProxyToken(proxyPeerID, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens == nil {
+		c.tokens = make(map[string]string)
+	}
+	c.tokens[proxyPeerID] = token
+}
+
+// hasProxyToken reports whether a proxy issued us a token
+func (c *InternetClient) hasProxyToken(proxyPeerID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens[proxyPeerID] != ""
+}
+
+// proxyURL returns where to send requests for a proxy, carrying our token for it
+func (c *InternetClient) proxyURL(up *upstreamProxy) *url.URL {
+	c.mu.Lock()
+	token := c.tokens[up.peerID]
+	c.mu.Unlock()
+	if token == "" {
+		return up.url
+	}
+	withToken := *up.url
+	withToken.User = url.UserPassword(c.nodeID, token)
+	return &withToken
+}
@@ -0,0 +1,106 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// splitAuthority splits a host[:port] authority into its host, without IPv6 brackets,
+// and port, which is "" when absent. Unbracketed IPv6 literals are accepted without a
+// port, since their last colon can't be told apart from a port separator.
+func splitAuthority(authority string) (string, string, error) {
+	host, port := authority, ""
+	switch {
+	case strings.HasPrefix(authority, "["):
+		end := strings.Index(authority, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("invalid authority %q: missing ']'", authority)
+		}
+		host, port = authority[1:end], authority[end+1:]
+		if port != "" && !strings.HasPrefix(port, ":") {
+			return "", "", fmt.Errorf("invalid authority %q", authority)
+		}
+		port = strings.TrimPrefix(port, ":")
+		if ip, _, _ := strings.Cut(host, "%"); net.ParseIP(ip) == nil || !strings.Contains(ip, ":") {
+			return "", "", fmt.Errorf("invalid IPv6 literal in %q", authority)
+		}
+	case strings.Count(authority, ":") > 1:
+		if ip, _, _ := strings.Cut(host, "%"); net.ParseIP(ip) == nil {
+			return "", "", fmt.Errorf("invalid authority %q", authority)
+		}
+	default:
+		host, port, _ = strings.Cut(authority, ":")
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("invalid authority %q: missing host", authority)
+	}
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", "", fmt.Errorf("invalid port in %q", authority)
+		}
+	}
+	return host, port, nil
+}
+
+// joinAuthority joins a host and optional port, bracketing IPv6 literals
+func joinAuthority(host, port string) string {
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// ConnectTarget returns the host:port a CONNECT request's authority names, with
+// defaultPort added when it has none and IPv6 literals bracketed
+func ConnectTarget(authority, defaultPort string) (string, error) {
+	host, port, err := splitAuthority(authority)
+	if err != nil {
+		return "", err
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// RequestURL returns the absolute URL a proxied HTTP request is for. Requests sent to a
+// proxy carry it (absolute-form); origin-form requests only carry the path, and the
+// authority comes from their Host header.
+func RequestURL(r *http.Request) (string, error) {
+	u := *r.URL
+	if u.Host == "" && r.Host != "" {
+		// The Host header is escaped as in a URL, e.g. an IPv6 zone as %25
+		host, err := url.Parse("http://" + r.Host)
+		if err != nil || host.Path != "" {
+			return "", fmt.Errorf("invalid Host header %q", r.Host)
+		}
+		u.Host = host.Host
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("request for %q names no host", r.URL.String())
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	host, port, err := splitAuthority(u.Host)
+	if err != nil {
+		return "", err
+	}
+	u.Host = joinAuthority(host, port)
+	return u.String(), nil
+}
+
+// proxyURL returns the URL of the HTTP proxy at ip and port
+func proxyURL(ip string, port int) string {
+	return "http://" + net.JoinHostPort(strings.Trim(ip, "[]"), strconv.Itoa(port))
+}
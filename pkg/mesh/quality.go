@@ -0,0 +1,172 @@
+package mesh
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Connection quality grades, best first; GradeNone means no proxy is in use
+const (
+	GradeA    = "A"
+	GradeB    = "B"
+	GradeC    = "C"
+	GradeD    = "D"
+	GradeF    = "F"
+	GradeNone = ""
+)
+
+const (
+	// QualityCheckInterval is how often the active proxy path is graded
+	QualityCheckInterval = 10 * time.Second
+
+	// qualitySampleAlpha is the weight of a new request in the error and throughput averages
+	qualitySampleAlpha = 0.2
+	// qualityMinTransfer is the smallest response that says anything about throughput
+	qualityMinTransfer = 64 * 1024
+)
+
+// ConnectionQuality grades the path to the proxy we use for internet access. Measurements
+// that haven't been taken yet are zero and don't count against the grade.
+type ConnectionQuality struct {
+	Grade          string  `json:"grade"`
+	ProxyID        string  `json:"proxy_id,omitempty"`
+	LatencyMs      float64 `json:"latency_ms"`      // Probe round-trip time to the proxy
+	Loss           float64 `json:"loss"`            // Share of probes to the proxy lost
+	ErrorRate      float64 `json:"error_rate"`      // Share of recent requests that failed
+	ThroughputKbps float64 `json:"throughput_kbps"` // Recent download rate of large responses
+}
+
+// pathSamples averages the outcome of requests through the proxies
+type pathSamples struct {
+	errorRate  float64
+	throughput float64 // Bytes per second
+	requests   int
+	transfers  int
+	mu         sync.Mutex
+}
+
+func (s *pathSamples) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorRate, s.throughput, s.requests, s.transfers = 0, 0, 0, 0
+}
+
+func (s *pathSamples) observeRequest(failed bool) {
+	sample := 0.0
+	if failed {
+		sample = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorRate = ewma(s.errorRate, sample, s.requests)
+	s.requests++
+}
+
+func (s *pathSamples) observeTransfer(n int64, elapsed time.Duration) {
+	if n < qualityMinTransfer || elapsed <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.throughput = ewma(s.throughput, float64(n)/elapsed.Seconds(), s.transfers)
+	s.transfers++
+}
+
+// ewma folds a sample into an average, taking the first sample as is
+func ewma(avg, sample float64, n int) float64 {
+	if n == 0 {
+		return sample
+	}
+	return avg + qualitySampleAlpha*(sample-avg)
+}
+
+// gradeQuality scores a path out of 100 and turns the score into a letter grade
+func gradeQuality(q ConnectionQuality) string {
+	score := 100.0
+	switch {
+	case q.LatencyMs >= 600:
+		score -= 60
+	case q.LatencyMs >= 300:
+		score -= 40
+	case q.LatencyMs >= 150:
+		score -= 25
+	case q.LatencyMs >= 50:
+		score -= 10
+	}
+	score -= q.Loss * 150
+	score -= q.ErrorRate * 50
+	if q.ThroughputKbps > 0 {
+		switch {
+		case q.ThroughputKbps < 256:
+			score -= 40
+		case q.ThroughputKbps < 1024:
+			score -= 25
+		case q.ThroughputKbps < 5120:
+			score -= 10
+		}
+	}
+
+	switch {
+	case score >= 90:
+		return GradeA
+	case score >= 75:
+		return GradeB
+	case score >= 60:
+		return GradeC
+	case score >= 40:
+		return GradeD
+	}
+	return GradeF
+}
+
+// ConnectionQuality grades the path to the proxy we use for internet access. When
+// requests are bonded over several proxies, latency and loss are those of the primary.
+func (ma *MeshApp) ConnectionQuality() ConnectionQuality {
+	proxyID := ma.InternetClient.ProxyPeerID()
+	if proxyID == "" {
+		return ConnectionQuality{Grade: GradeNone}
+	}
+
+	q := ConnectionQuality{ProxyID: proxyID}
+	if m, ok := ma.Router.RoutingTable.Metrics.Get(proxyID, proxyID); ok {
+		q.LatencyMs = m.LatencyMs
+		q.Loss = m.Loss
+	}
+	samples := &ma.InternetClient.samples
+	samples.mu.Lock()
+	q.ErrorRate = samples.errorRate
+	q.ThroughputKbps = samples.throughput * 8 / 1024
+	samples.mu.Unlock()
+
+	q.Grade = gradeQuality(q)
+	return q
+}
+
+func (ma *MeshApp) qualityLoop(ctx context.Context) {
+	ticker := time.NewTicker(QualityCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ma.checkQuality()
+		}
+	}
+}
+
+// checkQuality emits EventQualityChanged when the active proxy's grade changes
+func (ma *MeshApp) checkQuality() {
+	q := ma.ConnectionQuality()
+
+	ma.mu.Lock()
+	changed := q.Grade != ma.lastGrade
+	ma.lastGrade = q.Grade
+	ma.mu.Unlock()
+
+	if changed {
+		ma.emitEvent(&Event{Type: EventQualityChanged, PeerID: q.ProxyID, Detail: q.Grade})
+	}
+}
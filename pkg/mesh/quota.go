@@ -0,0 +1,231 @@
+package mesh
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// What the proxy does with a client that used up its quota
+const (
+	QuotaRevoke   = "revoke"   // Access is revoked, and not granted again until the quota resets
+	QuotaThrottle = "throttle" // The client is served at ProxyQuota.ThrottleRate
+)
+
+// DefaultQuotaThrottleRate is the bytes per second a throttled client is served at
+const DefaultQuotaThrottleRate = 32 * 1024
+
+// ProxyQuota bounds the bytes one client may carry through the proxy, counting both
+// directions. Zero fields disable a limit. Usage is counted as requests and tunnels end,
+// so the request that crosses a limit completes.
+type ProxyQuota struct {
+	TotalBytes   int64  `json:"total_bytes,omitempty"`   // Since the client was first authorized
+	DailyBytes   int64  `json:"daily_bytes,omitempty"`   // Per calendar day, local time
+	Action       string `json:"action,omitempty"`        // QuotaRevoke (default) or QuotaThrottle
+	ThrottleRate int64  `json:"throttle_rate,omitempty"` // Bytes per second; DefaultQuotaThrottleRate if 0
+}
+
+// Validate checks the quota's limits and action
+func (q ProxyQuota) Validate() error {
+	if q.TotalBytes < 0 || q.DailyBytes < 0 || q.ThrottleRate < 0 {
+		return fmt.Errorf("quota limits must not be negative")
+	}
+	if q.Action != "" && q.Action != QuotaRevoke && q.Action != QuotaThrottle {
+		return fmt.Errorf("unknown quota action %q", q.Action)
+	}
+	return nil
+}
+
+// exceeded returns which of a client's limits it used up, or ""
+func (q ProxyQuota) exceeded(client *ProxyClient) string {
+	switch {
+	case q.TotalBytes > 0 && client.BytesSent+client.BytesRecv >= uint64(q.TotalBytes):
+		return "total"
+	case q.DailyBytes > 0 && client.dayBytes >= uint64(q.DailyBytes):
+		return "daily"
+	}
+	return ""
+}
+
+// quotaDay numbers calendar days in local time, for resetting daily usage
+func quotaDay(t time.Time) int {
+	return t.Year()*1000 + t.YearDay()
+}
+
+// SetQuota sets the byte quota of each client; clients already over it are dealt with
+// at their next request
+func (p *InternetProxy) SetQuota(quota ProxyQuota) error {
+	if err := quota.Validate(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.quota = quota
+	return nil
+}
+
+// Quota returns the byte quota of each client
+func (p *InternetProxy) Quota() ProxyQuota {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.quota
+}
+
+// SetQuotaHandler sets a callback for clients using up their quota; limit is "total" or
+// "daily", action what was done about it
+func (p *InternetProxy) SetQuotaHandler(handler func(peerID, limit, action string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onQuota = handler
+}
+
+// OverQuota returns which of a client's limits it used up today, or ""
+func (p *InternetProxy) OverQuota(peerID string) string {
+	quota := p.Quota()
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+	client, exists := p.clients[peerID]
+	if !exists {
+		return ""
+	}
+	client.rollDayLocked(time.Now())
+	return quota.exceeded(client)
+}
+
+// DailyUsage returns the bytes a client has transferred through the proxy today
+func (p *InternetProxy) DailyUsage(peerID string) uint64 {
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+	client, exists := p.clients[peerID]
+	if !exists {
+		return 0
+	}
+	client.rollDayLocked(time.Now())
+	return client.dayBytes
+}
+
+// rollDayLocked starts a new day's usage when the day changed; p.clientsMu must be held
+func (c *ProxyClient) rollDayLocked(now time.Time) {
+	if day := quotaDay(now); day != c.day {
+		c.day = day
+		c.dayBytes = 0
+	}
+}
+
+// addUsage counts bytes a client carried through the proxy, and acts on its quota the
+// first time it is used up
+func (p *InternetProxy) addUsage(peerID string, sent, recv int64, now time.Time) {
+	p.mu.Lock()
+	quota, onQuota := p.quota, p.onQuota
+	p.mu.Unlock()
+
+	p.clientsMu.Lock()
+	client, exists := p.clients[peerID]
+	if !exists {
+		p.clientsMu.Unlock()
+		return
+	}
+	client.rollDayLocked(now)
+	wasOver := quota.exceeded(client)
+	client.BytesSent += uint64(sent)
+	client.BytesRecv += uint64(recv)
+	client.dayBytes += uint64(sent + recv)
+	limit := quota.exceeded(client)
+	p.clientsMu.Unlock()
+
+	if limit == "" || wasOver != "" {
+		return
+	}
+	action := quota.Action
+	if action == "" {
+		action = QuotaRevoke
+	}
+	if action == QuotaRevoke {
+		p.RevokeClient(peerID)
+	}
+	p.auditor().Record(AuditQuotaExceeded, peerID, fmt.Sprintf("%s quota, %s", limit, action))
+	if onQuota != nil {
+		onQuota(peerID, limit, action)
+	}
+}
+
+// handleQuotaExceeded reports clients that used up their data quota
+func (ma *MeshApp) handleQuotaExceeded(peerID, limit, action string) {
+	ma.emitEvent(&Event{Type: EventQuotaExceeded, PeerID: peerID, Detail: fmt.Sprintf("%s quota, %s", limit, action)})
+	ma.Trust.Record(peerID, TrustQuotaExceeded, time.Now())
+}
+
+// throttleRate returns the bytes per second a client is held to for being over its
+// quota, or 0 if it isn't throttled
+func (p *InternetProxy) throttleRate(peerID string) int64 {
+	quota := p.Quota()
+	if quota.Action != QuotaThrottle || p.OverQuota(peerID) == "" {
+		return 0
+	}
+	if quota.ThrottleRate > 0 {
+		return quota.ThrottleRate
+	}
+	return DefaultQuotaThrottleRate
+}
+
+// pacer spaces out writes so they average no more than rate bytes per second
+type pacer struct {
+	rate int64
+	next time.Time
+	mu   sync.Mutex
+}
+
+// wait blocks until n more bytes may be written
+func (p *pacer) wait(n int) {
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	delay := p.next.Sub(now)
+	p.next = p.next.Add(time.Duration(int64(n) * int64(time.Second) / p.rate))
+	p.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// pacedConn throttles both directions of a tunnel's client connection
+type pacedConn struct {
+	net.Conn
+	pacer *pacer
+}
+
+func (c *pacedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.pacer.wait(n)
+	return n, err
+}
+
+func (c *pacedConn) Write(b []byte) (int, error) {
+	c.pacer.wait(len(b))
+	return c.Conn.Write(b)
+}
+
+// pacedWriter throttles a response body
+type pacedWriter struct {
+	w     io.Writer
+	pacer *pacer
+}
+
+func (w *pacedWriter) Write(b []byte) (int, error) {
+	w.pacer.wait(len(b))
+	return w.w.Write(b)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
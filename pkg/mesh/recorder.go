@@ -0,0 +1,299 @@
+package mesh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The traffic recorder captures a node's control plane for bug reports: peers discovery
+// found and lost, the messages handed to the app, and how dials to peers went, each with
+// its offset from the start of the recording. Recordings are anonymized as they are
+// taken: node IDs become "self" and "peer-N", addresses are replaced, names, MACs and
+// regions are dropped, credentials in message metadata are redacted, and only
+// control-plane payloads are kept, with the IDs and addresses in them replaced too.
+// ReplayRecording runs a recording through a simulated node to reproduce what it did.
+const (
+	recordingVersion = 1
+
+	// MaxRecordedEvents bounds a recording; later events are counted as dropped
+	MaxRecordedEvents = 10000
+)
+
+// Kinds of recorded events
+const (
+	RecordPeerDiscovered = "discovered"
+	RecordPeerLost       = "lost"
+	RecordMessage        = "message"
+	RecordDial           = "dial"
+)
+
+// ErrRecording is returned when starting a recording while one is running, or stopping
+// one that isn't
+var ErrRecording = errors.New("recording not in the expected state")
+
+// controlPlaneTypes are the messages whose payloads are recorded; the rest carry user
+// data or secrets and are recorded by size only
+var controlPlaneTypes = map[string]bool{
+	"route_update":        true,
+	"hop_limit_exceeded":  true,
+	"source_route_failed": true,
+	"hibernate":           true,
+	"presence":            true,
+	"link_announce":       true,
+	pingMessageType:       true,
+	pongMessageType:       true,
+	protocolMessageType:   true,
+}
+
+// redactedMetadata are metadata keys holding keys, proofs or tokens
+var redactedMetadata = map[string]bool{
+	"token":    true,
+	"key":      true,
+	"code":     true,
+	"mac":      true,
+	"noise":    true,
+	"id_key":   true,
+	"id_sig":   true,
+	"id_nonce": true,
+}
+
+// Recording is an anonymized capture of a node's control-plane traffic
+type Recording struct {
+	Version  int             `json:"version"`
+	Duration time.Duration   `json:"duration"`
+	Config   Config          `json:"config"`            // Settings of the recorded node, paths and endpoints removed
+	Events   []RecordedEvent `json:"events"`            // In the order the node saw them
+	Dropped  int             `json:"dropped,omitempty"` // Events past MaxRecordedEvents
+}
+
+// RecordedEvent is one thing the recorded node saw
+type RecordedEvent struct {
+	Offset  time.Duration   `json:"offset"` // Since the recording started
+	Kind    string          `json:"kind"`
+	PeerID  string          `json:"peer,omitempty"` // Peer discovered, lost or dialed, or the link a message came over
+	Peer    *DiscoveredPeer `json:"discovered,omitempty"`
+	Message *Message        `json:"message,omitempty"`
+	Size    int             `json:"size,omitempty"`  // Bytes of a payload that wasn't recorded
+	Addr    string          `json:"addr,omitempty"`  // Address dialed
+	Error   string          `json:"error,omitempty"` // Why a dial failed
+}
+
+// ParseRecording reads a recording written with json.Marshal
+func ParseRecording(data []byte) (*Recording, error) {
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("invalid recording: %w", err)
+	}
+	if rec.Version != recordingVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", rec.Version)
+	}
+	return &rec, nil
+}
+
+// StartRecording starts capturing control-plane traffic for a bug report
+func (ma *MeshApp) StartRecording() error {
+	recorder := newTrafficRecorder(ma.Node.ID, ma.Config())
+	ip, _ := ma.Node.Address()
+	recorder.anon.host(ip)
+	if !ma.recorder.CompareAndSwap(nil, recorder) {
+		return fmt.Errorf("%w: already recording", ErrRecording)
+	}
+	return nil
+}
+
+// StopRecording stops capturing and returns the recording
+func (ma *MeshApp) StopRecording() (*Recording, error) {
+	recorder := ma.recorder.Swap(nil)
+	if recorder == nil {
+		return nil, fmt.Errorf("%w: not recording", ErrRecording)
+	}
+	return recorder.finish(), nil
+}
+
+// trafficRecorder builds a recording, anonymizing as it goes. A nil recorder records nothing.
+type trafficRecorder struct {
+	started time.Time
+	rec     Recording
+	anon    *anonymizer
+	mu      sync.Mutex
+}
+
+func newTrafficRecorder(self string, cfg Config) *trafficRecorder {
+	cfg.PeerArchivePath = ""
+	cfg.RouteMetricsPath = ""
+	cfg.AnnounceSeqPath = ""
+	cfg.RevocationsPath = ""
+	cfg.UpstreamProxy = ""
+	cfg.OTelEndpoint = ""
+	cfg.ExitAllowlist = nil
+	return &trafficRecorder{
+		started: time.Now(),
+		rec:     Recording{Version: recordingVersion, Config: cfg},
+		anon:    newAnonymizer(self),
+	}
+}
+
+// add appends an event built under the recorder's lock, stamped with its offset
+func (r *trafficRecorder) add(build func(a *anonymizer) RecordedEvent) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.rec.Events) >= MaxRecordedEvents {
+		r.rec.Dropped++
+		return
+	}
+	event := build(r.anon)
+	event.Offset = time.Since(r.started)
+	r.rec.Events = append(r.rec.Events, event)
+}
+
+func (r *trafficRecorder) peerDiscovered(peer *DiscoveredPeer) {
+	r.add(func(a *anonymizer) RecordedEvent {
+		recorded := *peer
+		recorded.ID = a.node(peer.ID)
+		recorded.IP = a.host(peer.IP)
+		recorded.Name, recorded.MAC, recorded.Region = "", "", ""
+		recorded.LastSeen = time.Time{}
+		recorded.Networks = nil
+		for _, networkID := range peer.Networks {
+			recorded.Networks = append(recorded.Networks, a.network(networkID))
+		}
+		return RecordedEvent{Kind: RecordPeerDiscovered, PeerID: recorded.ID, Peer: &recorded}
+	})
+}
+
+func (r *trafficRecorder) peerLost(peerID string) {
+	r.add(func(a *anonymizer) RecordedEvent {
+		return RecordedEvent{Kind: RecordPeerLost, PeerID: a.node(peerID)}
+	})
+}
+
+func (r *trafficRecorder) message(peerID string, msg *Message) {
+	r.add(func(a *anonymizer) RecordedEvent {
+		recorded := &Message{
+			Type:     msg.Type,
+			Source:   a.node(msg.Source),
+			Dest:     a.node(msg.Dest),
+			HopLimit: msg.HopLimit,
+			Seq:      msg.Seq,
+		}
+		for _, hop := range msg.Route {
+			recorded.Route = append(recorded.Route, a.node(hop))
+		}
+		if len(msg.Metadata) > 0 {
+			recorded.Metadata = make(map[string]string, len(msg.Metadata))
+			for key, value := range msg.Metadata {
+				if redactedMetadata[key] {
+					value = "redacted"
+				}
+				recorded.Metadata[key] = a.scrub(value)
+			}
+		}
+		event := RecordedEvent{Kind: RecordMessage, PeerID: a.node(peerID), Message: recorded}
+		if controlPlaneTypes[msg.Type] {
+			recorded.Payload = []byte(a.scrub(string(msg.Payload)))
+		} else {
+			event.Size = len(msg.Payload)
+		}
+		return event
+	})
+}
+
+func (r *trafficRecorder) dial(peerID, ip string, port int, err error) {
+	r.add(func(a *anonymizer) RecordedEvent {
+		event := RecordedEvent{Kind: RecordDial, PeerID: a.node(peerID), Addr: net.JoinHostPort(a.host(ip), strconv.Itoa(port))}
+		if err != nil {
+			event.Error = a.scrub(err.Error())
+		}
+		return event
+	})
+}
+
+func (r *trafficRecorder) finish() *Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec := r.rec
+	rec.Duration = time.Since(r.started)
+	return &rec
+}
+
+// anonymizer hands out stand-ins for node IDs and addresses, the same one every time
+// the same ID or address comes up
+type anonymizer struct {
+	names    map[string]string // Real IDs and addresses to their stand-ins
+	peers    int
+	hosts    int
+	networks int
+}
+
+func newAnonymizer(self string) *anonymizer {
+	return &anonymizer{names: map[string]string{self: "self"}}
+}
+
+func (a *anonymizer) node(id string) string {
+	if id == "" {
+		return ""
+	}
+	if name, ok := a.names[id]; ok {
+		return name
+	}
+	a.peers++
+	name := fmt.Sprintf("peer-%d", a.peers)
+	a.names[id] = name
+	return name
+}
+
+// network replaces a personal network ID
+func (a *anonymizer) network(id string) string {
+	if name, ok := a.names[id]; ok {
+		return name
+	}
+	a.networks++
+	name := fmt.Sprintf("network-%d", a.networks)
+	a.names[id] = name
+	return name
+}
+
+// host replaces an address with one from 10.0.0.0/8, numbered in the order seen
+func (a *anonymizer) host(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	if name, ok := a.names[ip]; ok {
+		return name
+	}
+	a.hosts++
+	name := fmt.Sprintf("10.%d.%d.%d", a.hosts>>16&0xff, a.hosts>>8&0xff, a.hosts&0xff)
+	a.names[ip] = name
+	return name
+}
+
+// scrub replaces the IDs and addresses seen so far wherever they appear in s, longest
+// first so one that contains another is replaced whole. Very short names are left
+// alone, as replacing them would mangle unrelated text.
+func (a *anonymizer) scrub(s string) string {
+	if s == "" {
+		return s
+	}
+	reals := make([]string, 0, len(a.names))
+	for real := range a.names {
+		if len(real) >= 4 {
+			reals = append(reals, real)
+		}
+	}
+	sort.Slice(reals, func(i, j int) bool { return len(reals[i]) > len(reals[j]) })
+	pairs := make([]string, 0, 2*len(reals))
+	for _, real := range reals {
+		pairs = append(pairs, real, a.names[real])
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
@@ -0,0 +1,148 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messages a node sends carry a sequence number that grows with each one, so a message
+// captured and sent again, or arriving twice over two paths, is dropped. Each source is
+// tracked with a sliding window, as in IPsec: numbers may arrive out of order within
+// ReplayWindow of the highest seen, anything older is stale. The counter starts from
+// the clock in microseconds so it keeps growing across restarts, and messages also carry
+// a boot number picked at random when the node starts, with a window per source and boot
+// number: a node restarted with its clock behind isn't taken for a replayer, while its
+// messages from before the restart still meet their old window. A new connection from
+// a peer doesn't reset its window, as anyone can connect claiming an ID and would then
+// replay what it captured. Only signed messages are tracked: an unsigned number could be
+// set by anyone, and one spoofed far ahead would get everything the source really sends
+// dropped as stale. Unsigned messages, and those without a sequence number from older
+// peers, are accepted as before.
+
+const (
+	// ReplayWindow is how far behind the highest sequence number seen from a source a
+	// message may arrive and still be accepted, if it wasn't seen yet
+	ReplayWindow = 256
+
+	// replayStateTTL is how long a source's window is kept after its last message
+	replayStateTTL = 10 * time.Minute
+)
+
+// replayWindow is what was seen from one source in one boot: the highest sequence number, and a
+// bitmap of the ReplayWindow numbers up to it, indexed by sequence number modulo the size
+type replayWindow struct {
+	highest uint64
+	seen    [ReplayWindow / 64]uint64
+	at      int64 // Monotonic instant of the last accepted message
+}
+
+func (w *replayWindow) bit(seq uint64) (int, uint64) {
+	i := seq % ReplayWindow
+	return int(i / 64), 1 << (i % 64)
+}
+
+// replayKey identifies a window: a source, in one of its boots
+type replayKey struct {
+	source string
+	boot   uint64
+}
+
+// replayGuard numbers our messages and checks the numbers of received ones
+type replayGuard struct {
+	mu         sync.Mutex
+	next       uint64
+	boot       uint64
+	windows    map[replayKey]*replayWindow
+	lastPrune  int64
+	duplicates atomic.Uint64
+	stale      atomic.Uint64
+}
+
+func newReplayGuard() *replayGuard {
+	var boot [8]byte
+	rand.Read(boot[:])
+	return &replayGuard{
+		next:    uint64(time.Now().UnixMicro()),
+		boot:    binary.BigEndian.Uint64(boot[:]) | 1, // Never 0, which means unset
+		windows: make(map[replayKey]*replayWindow),
+	}
+}
+
+// nextSeq numbers an outgoing message
+func (g *replayGuard) nextSeq() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.next++
+	return g.next
+}
+
+// accept records a received message's sequence number, and returns false if the
+// message was seen before or is too old to tell. msg's signature must have been verified.
+func (g *replayGuard) accept(msg *Message) bool {
+	if msg.Seq == 0 || msg.Source == "" || len(msg.Signature) == 0 {
+		return true
+	}
+	now := monoNow()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pruneLocked(now)
+
+	key := replayKey{msg.Source, msg.Boot}
+	w, ok := g.windows[key]
+	if !ok {
+		w = &replayWindow{}
+		g.windows[key] = w
+	}
+	switch {
+	case msg.Seq > w.highest:
+		if advance := msg.Seq - w.highest; !ok || advance >= ReplayWindow {
+			w.seen = [ReplayWindow / 64]uint64{}
+		} else {
+			for seq := w.highest + 1; seq < msg.Seq; seq++ {
+				word, mask := w.bit(seq)
+				w.seen[word] &^= mask
+			}
+		}
+		w.highest = msg.Seq
+	case w.highest-msg.Seq >= ReplayWindow:
+		g.stale.Add(1)
+		return false
+	default:
+		if word, mask := w.bit(msg.Seq); w.seen[word]&mask != 0 {
+			g.duplicates.Add(1)
+			return false
+		}
+	}
+	word, mask := w.bit(msg.Seq)
+	w.seen[word] |= mask
+	w.at = now
+	return true
+}
+
+// pruneLocked forgets sources that went quiet, at most once per minute; g.mu must be held
+func (g *replayGuard) pruneLocked(now int64) {
+	if time.Duration(now-g.lastPrune) < time.Minute {
+		return
+	}
+	g.lastPrune = now
+	for key, w := range g.windows {
+		if time.Duration(now-w.at) > replayStateTTL {
+			delete(g.windows, key)
+		}
+	}
+}
+
+// ReplayedMessages returns how many received messages were dropped as duplicates of one
+// already accepted from the same source
+func (t *Transport) ReplayedMessages() uint64 {
+	return t.replay.duplicates.Load()
+}
+
+// StaleMessages returns how many received messages were dropped for a sequence number
+// too far behind the newest from the same source
+func (t *Transport) StaleMessages() uint64 {
+	return t.replay.stale.Load()
+}
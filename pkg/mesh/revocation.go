@@ -0,0 +1,355 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A revocation record tells the mesh to stop trusting a node identity. A node issues one
+// for its own identity when it rotates to a new key, naming the successor, and the owner
+// of a personal network issues one for a member whose key was compromised. Records are
+// signed, so they can be relayed by anyone: each node checks the signature, stores the
+// record and passes it on to its other peers. Nodes exchange their lists when they dial
+// each other, so peers that were away catch up.
+
+// ErrRevoked is returned for peers whose identity was revoked
+var ErrRevoked = errors.New("identity revoked")
+
+const revocationMessageType = "revocation"
+
+// Revocation revokes a node identity
+type Revocation struct {
+	NodeID    string    `json:"node_id"`
+	Successor string    `json:"successor,omitempty"` // Node ID of the identity that replaces it, when rotated
+	Reason    string    `json:"reason,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	Issuer    string    `json:"issuer"` // NodeID itself, or the owner of a personal network it belongs to
+	Key       []byte    `json:"key"`    // Issuer's public key
+	Signature []byte    `json:"signature"`
+}
+
+// signingBytes encodes the signed fields of a record unambiguously
+func (r *Revocation) signingBytes() []byte {
+	var buf bytes.Buffer
+	for _, field := range []string{identityContext + " revocation", r.NodeID, r.Successor, r.Reason, r.Issuer} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	binary.Write(&buf, binary.BigEndian, r.IssuedAt.UnixNano())
+	return buf.Bytes()
+}
+
+// newRevocation issues a record revoking nodeID, signed by identity
+func newRevocation(identity *Identity, nodeID, successor, reason string) *Revocation {
+	r := &Revocation{
+		NodeID:    nodeID,
+		Successor: successor,
+		Reason:    reason,
+		IssuedAt:  time.Now(),
+		Issuer:    identity.NodeID(),
+		Key:       identity.PublicKey(),
+	}
+	r.Signature = ed25519.Sign(identity.PrivateKey, r.signingBytes())
+	return r
+}
+
+// Verify checks that the record was signed by the identity of its issuer
+func (r *Revocation) Verify() error {
+	if r.NodeID == "" {
+		return errors.New("revocation names no node")
+	}
+	if len(r.Key) != ed25519.PublicKeySize || NodeIDFromKey(r.Key) != r.Issuer {
+		return fmt.Errorf("revocation key is not %s's", r.Issuer)
+	}
+	if !ed25519.Verify(r.Key, r.signingBytes(), r.Signature) {
+		return fmt.Errorf("bad signature on revocation of %s", r.NodeID)
+	}
+	return nil
+}
+
+// RevocationList stores the revocation records a node accepted. The first record for an
+// identity stands; revocations are permanent.
+type RevocationList struct {
+	records map[string]*Revocation
+	dirty   bool
+	mu      sync.RWMutex
+}
+
+// NewRevocationList creates an empty list
+func NewRevocationList() *RevocationList {
+	return &RevocationList{records: make(map[string]*Revocation)}
+}
+
+// Add stores a record, returning false if its identity was already revoked
+func (rl *RevocationList) Add(r *Revocation) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, ok := rl.records[r.NodeID]; ok {
+		return false
+	}
+	rl.records[r.NodeID] = r
+	rl.dirty = true
+	return true
+}
+
+// Revoked returns whether an identity was revoked
+func (rl *RevocationList) Revoked(nodeID string) bool {
+	if rl == nil {
+		return false
+	}
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	_, ok := rl.records[nodeID]
+	return ok
+}
+
+// Get returns the record revoking an identity
+func (rl *RevocationList) Get(nodeID string) (*Revocation, bool) {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	r, ok := rl.records[nodeID]
+	return r, ok
+}
+
+// All returns every record, oldest first
+func (rl *RevocationList) All() []*Revocation {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	all := make([]*Revocation, 0, len(rl.records))
+	for _, r := range rl.records {
+		all = append(all, r)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].IssuedAt.Before(all[j].IssuedAt) })
+	return all
+}
+
+// Save writes the records to path if they changed since the last save or load
+func (rl *RevocationList) Save(path string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if !rl.dirty {
+		return nil
+	}
+	all := make([]*Revocation, 0, len(rl.records))
+	for _, r := range rl.records {
+		all = append(all, r)
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a truncated file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	rl.dirty = false
+	return nil
+}
+
+// Load adds the records saved at path, skipping any whose signature doesn't check out;
+// a missing file is not an error
+func (rl *RevocationList) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var all []*Revocation
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, r := range all {
+		if _, ok := rl.records[r.NodeID]; !ok && r.Verify() == nil {
+			rl.records[r.NodeID] = r
+		}
+	}
+	return nil
+}
+
+// RotateIdentity replaces our identity with next: it revokes the current one in a record
+// naming next's node ID as its successor and sends it to our peers. The node keeps
+// running under the old identity; restart it with next to finish the rotation.
+func (ma *MeshApp) RotateIdentity(next *Identity, reason string) (*Revocation, error) {
+	identity := ma.Node.Identity
+	if identity == nil {
+		return nil, errors.New("node has no identity to rotate")
+	}
+	if next.NodeID() == identity.NodeID() {
+		return nil, errors.New("next identity is the current one")
+	}
+	r := newRevocation(identity, identity.NodeID(), next.NodeID(), reason)
+	ma.Revocations.Add(r)
+	ma.saveRevocations()
+	ma.Audit.Record(AuditIdentityRevoked, r.NodeID, fmt.Sprintf("rotated to %s", r.Successor))
+	ma.floodRevocations("", []*Revocation{r})
+	return r, nil
+}
+
+// RevokeNode revokes the identity of a member of a personal network we own, removing it
+// from those networks, which rotates their group keys, and telling the mesh to stop
+// trusting it
+func (ma *MeshApp) RevokeNode(nodeID, reason string) (*Revocation, error) {
+	identity := ma.Node.Identity
+	if identity == nil {
+		return nil, errors.New("node has no identity to sign revocations with")
+	}
+	if !ma.ownsNetworkWith(nodeID) {
+		return nil, fmt.Errorf("%s is not a member of a network we own", nodeID)
+	}
+	r := newRevocation(identity, nodeID, "", reason)
+	if !ma.applyRevocation(r) {
+		return nil, fmt.Errorf("%s is already revoked", nodeID)
+	}
+	ma.floodRevocations("", []*Revocation{r})
+	return r, nil
+}
+
+// ownsNetworkWith returns whether we own a personal network nodeID is a member of
+func (ma *MeshApp) ownsNetworkWith(nodeID string) bool {
+	for _, network := range ma.PersonalNetworkMgr.GetNetworksByOwner(ma.Node.ID) {
+		if network.IsMember(nodeID) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptRevocation checks that a received record is signed by the revoked identity
+// itself, or by the owner of a personal network we know. Owners vouch for their members,
+// and a member may already be off the roster the owner sent us when the record arrives.
+func (ma *MeshApp) acceptRevocation(r *Revocation) error {
+	if err := r.Verify(); err != nil {
+		return err
+	}
+	if r.Issuer == r.NodeID || len(ma.PersonalNetworkMgr.GetNetworksByOwner(r.Issuer)) > 0 {
+		return nil
+	}
+	return fmt.Errorf("%s can't revoke %s", r.Issuer, r.NodeID)
+}
+
+// applyRevocation stores a record and cuts the revoked identity off: its connection is
+// closed, it stops being a proxy or client of ours, and networks we own drop it. It
+// returns false if the identity was already revoked.
+func (ma *MeshApp) applyRevocation(r *Revocation) bool {
+	if !ma.Revocations.Add(r) {
+		return false
+	}
+	ma.saveRevocations()
+
+	ma.Transport.DisconnectPeer(r.NodeID)
+	ma.ProxyManager.UnregisterProxy(r.NodeID)
+	ma.InternetClient.RemoveBondedProxy(r.NodeID)
+	ma.InternetProxy.RevokeClient(r.NodeID)
+	for _, network := range ma.PersonalNetworkMgr.GetNetworksByOwner(ma.Node.ID) {
+		network.RemoveMember(r.NodeID)
+	}
+
+	detail := r.Reason
+	if r.Successor != "" {
+		detail = fmt.Sprintf("rotated to %s", r.Successor)
+	}
+	ma.Audit.Record(AuditIdentityRevoked, r.NodeID, detail)
+	ma.emitEvent(&Event{Type: EventIdentityRevoked, PeerID: r.NodeID, Detail: detail})
+	return true
+}
+
+// saveRevocations persists the revocation list when a path is configured
+func (ma *MeshApp) saveRevocations() {
+	path := ma.Config().RevocationsPath
+	if path == "" {
+		return
+	}
+	if err := ma.Revocations.Save(path); err != nil {
+		ma.emitEvent(&Event{Type: EventConfigError, Component: "revocations", Detail: err.Error()})
+	}
+}
+
+// sendRevocations sends records to a peer; a sync asks it to answer with the records we lack
+func (ma *MeshApp) sendRevocations(peerID string, records []*Revocation, sync bool) {
+	payload, err := json.Marshal(records)
+	if err != nil {
+		return
+	}
+	msg := &Message{
+		Type:      revocationMessageType,
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Payload:   payload,
+		Timestamp: time.Now(),
+	}
+	if sync {
+		msg.Metadata = map[string]string{"sync": "1"}
+	}
+	ma.Transport.SendMessage(peerID, msg)
+}
+
+// floodRevocations sends records to every connected peer but the one they came from
+func (ma *MeshApp) floodRevocations(from string, records []*Revocation) {
+	for _, peerID := range ma.Transport.GetConnectedPeers() {
+		if peerID != from && !ma.Revocations.Revoked(peerID) {
+			ma.sendRevocations(peerID, records, false)
+		}
+	}
+}
+
+// syncRevocations offers our records to a peer we dialed, which answers with its own
+func (ma *MeshApp) syncRevocations(peerID string) {
+	if records := ma.Revocations.All(); len(records) > 0 {
+		ma.sendRevocations(peerID, records, true)
+	}
+}
+
+// handleRevocations stores the records a peer sent that we accept, relays the new ones
+// to our other peers and, for a sync, answers with the records the peer lacks
+func (ma *MeshApp) handleRevocations(peerID string, msg *Message) {
+	var records []*Revocation
+	if err := json.Unmarshal(msg.Payload, &records); err != nil {
+		return
+	}
+	known := make(map[string]bool, len(records))
+	var fresh []*Revocation
+	for _, r := range records {
+		known[r.NodeID] = true
+		if ma.Revocations.Revoked(r.NodeID) {
+			continue
+		}
+		if err := ma.acceptRevocation(r); err != nil {
+			continue
+		}
+		if ma.applyRevocation(r) {
+			fresh = append(fresh, r)
+		}
+	}
+	if len(fresh) > 0 {
+		ma.floodRevocations(peerID, fresh)
+	}
+
+	if msg.Metadata["sync"] == "" {
+		return
+	}
+	var missing []*Revocation
+	for _, r := range ma.Revocations.All() {
+		if !known[r.NodeID] {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) > 0 {
+		ma.sendRevocations(peerID, missing, false)
+	}
+}
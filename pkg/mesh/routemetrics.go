@@ -0,0 +1,213 @@
+package mesh
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// RouteMetricsAlpha is the weight of a new sample in the latency and loss averages.
+	// A low weight keeps one slow or lost probe on a flappy radio link from moving routes.
+	RouteMetricsAlpha = 0.2
+
+	// routeLossPenalty is the cost added for a route that loses every probe
+	routeLossPenalty = 200
+)
+
+// RouteMetric is the learned quality of reaching a destination through a next hop
+type RouteMetric struct {
+	Destination string  `json:"destination"`
+	NextHop     string  `json:"next_hop"`
+	LatencyMs   float64 `json:"latency_ms"` // Weighted average round-trip time of answered probes
+	Loss        float64 `json:"loss"`       // Weighted share of probes that went unanswered
+	Samples     int     `json:"samples"`
+	LastUpdate  int64   `json:"last_update"`
+}
+
+// Cost turns the metric into a route cost comparable with other routes
+func (m *RouteMetric) Cost() int64 {
+	return int64(math.Round(m.LatencyMs + m.Loss*routeLossPenalty))
+}
+
+// RouteMetrics learns latency and loss per destination and next hop. The averages can be
+// saved and loaded so a restarted node doesn't have to relearn which paths are stable.
+type RouteMetrics struct {
+	metrics map[string]*RouteMetric
+	dirty   bool
+	mu      sync.RWMutex
+}
+
+// NewRouteMetrics creates an empty metrics store
+func NewRouteMetrics() *RouteMetrics {
+	return &RouteMetrics{metrics: make(map[string]*RouteMetric)}
+}
+
+func routeMetricKey(destination, nextHop string) string {
+	return destination + "|" + nextHop
+}
+
+// Observe folds one probe result into the averages for a route
+func (rm *RouteMetrics) Observe(destination, nextHop string, latency time.Duration, lost bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	key := routeMetricKey(destination, nextHop)
+	m, ok := rm.metrics[key]
+	if !ok {
+		m = &RouteMetric{Destination: destination, NextHop: nextHop}
+		rm.metrics[key] = m
+	}
+
+	loss := 0.0
+	if lost {
+		loss = 1
+	}
+	latencyMs := float64(latency) / float64(time.Millisecond)
+	if m.Samples == 0 {
+		m.Loss = loss
+	} else {
+		m.Loss += RouteMetricsAlpha * (loss - m.Loss)
+	}
+	// Lost probes carry no latency; the first answered probe seeds the average
+	if !lost {
+		if m.LatencyMs == 0 {
+			m.LatencyMs = latencyMs
+		} else {
+			m.LatencyMs += RouteMetricsAlpha * (latencyMs - m.LatencyMs)
+		}
+	}
+	m.Samples++
+	m.LastUpdate = getCurrentTimestamp()
+	rm.dirty = true
+}
+
+// Get returns a copy of the learned metric for a route
+func (rm *RouteMetrics) Get(destination, nextHop string) (RouteMetric, bool) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	m, ok := rm.metrics[routeMetricKey(destination, nextHop)]
+	if !ok {
+		return RouteMetric{}, false
+	}
+	return *m, true
+}
+
+// Cost returns the learned cost of a route, or false when it has never been measured
+func (rm *RouteMetrics) Cost(destination, nextHop string) (int64, bool) {
+	m, ok := rm.Get(destination, nextHop)
+	if !ok || m.Samples == 0 {
+		return 0, false
+	}
+	return m.Cost(), true
+}
+
+// All returns copies of every learned metric
+func (rm *RouteMetrics) All() []RouteMetric {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	all := make([]RouteMetric, 0, len(rm.metrics))
+	for _, m := range rm.metrics {
+		all = append(all, *m)
+	}
+	return all
+}
+
+// Save writes the metrics to path if they changed since the last save or load
+func (rm *RouteMetrics) Save(path string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if !rm.dirty {
+		return nil
+	}
+
+	all := make([]*RouteMetric, 0, len(rm.metrics))
+	for _, m := range rm.metrics {
+		all = append(all, m)
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a truncated file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	rm.dirty = false
+	return nil
+}
+
+// Load replaces the metrics with those saved at path; a missing file is not an error
+func (rm *RouteMetrics) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var all []*RouteMetric
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.metrics = make(map[string]*RouteMetric, len(all))
+	for _, m := range all {
+		rm.metrics[routeMetricKey(m.Destination, m.NextHop)] = m
+	}
+	rm.dirty = false
+	return nil
+}
+
+// routeProber tracks the outstanding latency probe to each neighbor. A probe that is
+// still unanswered when the next one goes out is counted as lost.
+type routeProber struct {
+	outstanding map[string]int64 // Neighbor -> monotonic send time of the unanswered probe (see monoAt)
+	mu          sync.Mutex
+}
+
+func newRouteProber() *routeProber {
+	return &routeProber{outstanding: make(map[string]int64)}
+}
+
+// next starts a probe to a neighbor, returning its token and whether the previous one was lost
+func (p *routeProber) next(peerID string, now time.Time) (token string, lostPrevious bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, lostPrevious = p.outstanding[peerID]
+	sent := monoAt(now)
+	p.outstanding[peerID] = sent
+	return strconv.FormatInt(sent, 10), lostPrevious
+}
+
+// answer matches an echoed token to the outstanding probe and returns the round-trip time
+func (p *routeProber) answer(peerID, token string, now time.Time) (time.Duration, bool) {
+	sent, err := strconv.ParseInt(token, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.outstanding[peerID] != sent {
+		return 0, false
+	}
+	delete(p.outstanding, peerID)
+	return time.Duration(monoAt(now) - sent), true
+}
+
+// forget drops the outstanding probe to a neighbor that went away
+func (p *routeProber) forget(peerID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.outstanding, peerID)
+}
@@ -1,6 +1,7 @@
 package mesh
 
 import (
+	"math"
 	"sync"
 	"time"
 )
@@ -16,14 +17,16 @@ type Route struct {
 
 // RoutingTable manages routes in the mesh network
 type RoutingTable struct {
-	Routes map[string]*Route
-	mu     sync.RWMutex
+	Routes  map[string]*Route
+	Metrics *RouteMetrics // Learned latency and loss, preferred over one-shot costs
+	mu      sync.RWMutex
 }
 
 // NewRoutingTable creates a new routing table
 func NewRoutingTable() *RoutingTable {
 	return &RoutingTable{
-		Routes: make(map[string]*Route),
+		Routes:  make(map[string]*Route),
+		Metrics: NewRouteMetrics(),
 	}
 }
 
@@ -55,13 +58,23 @@ func (rt *RoutingTable) RemoveRoute(destination string) {
 	delete(rt.Routes, destination)
 }
 
-// UpdateRoute updates an existing route if the new one is better
+// effectiveCost prefers the learned cost of a route over the one-shot cost it was offered with
+func (rt *RoutingTable) effectiveCost(destination, nextHop string, cost int64) int64 {
+	if learned, ok := rt.Metrics.Cost(destination, nextHop); ok {
+		return learned
+	}
+	return cost
+}
+
+// UpdateRoute updates an existing route if the new one is better. Routes that have been
+// measured are compared by their learned cost, so one lucky sample doesn't flip the path.
 func (rt *RoutingTable) UpdateRoute(destination, nextHop string, hopCount int, cost int64) bool {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
 
+	cost = rt.effectiveCost(destination, nextHop, cost)
 	existing, exists := rt.Routes[destination]
-	if !exists || cost < existing.Cost {
+	if !exists || cost < rt.effectiveCost(destination, existing.NextHop, existing.Cost) {
 		rt.Routes[destination] = &Route{
 			Destination: destination,
 			NextHop:     nextHop,
@@ -74,6 +87,20 @@ func (rt *RoutingTable) UpdateRoute(destination, nextHop string, hopCount int, c
 	return false
 }
 
+// Recost refreshes the cost of the current route to a destination if it goes through nextHop
+func (rt *RoutingTable) Recost(destination, nextHop string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	route, exists := rt.Routes[destination]
+	if !exists || route.NextHop != nextHop {
+		return
+	}
+	updated := *route
+	updated.Cost = rt.effectiveCost(destination, nextHop, route.Cost)
+	updated.LastUpdate = getCurrentTimestamp()
+	rt.Routes[destination] = &updated
+}
+
 // GetAllRoutes returns all routes in the routing table
 func (rt *RoutingTable) GetAllRoutes() []*Route {
 	rt.mu.RLock()
@@ -117,7 +144,21 @@ func (r *Router) UpdateRoutes(peers []*Peer) {
 	}
 }
 
-// calculateCost calculates a route cost based on signal strength
+// UpdateLinkSignal re-costs the direct route to a peer from its latest radio measurements.
+// Multi-hop routes through the peer are left to route updates.
+func (r *Router) UpdateLinkSignal(peer *Peer) {
+	route, exists := r.RoutingTable.GetRoute(peer.NodeID)
+	if exists && route.NextHop != peer.NodeID {
+		return
+	}
+	r.RoutingTable.AddRoute(peer.NodeID, peer.NodeID, 1, int64(calculateCost(peer)))
+}
+
+// maxLinkQualityPenalty is the cost added for a link with zero reported quality
+const maxLinkQualityPenalty = 50
+
+// calculateCost calculates a route cost based on signal strength, link quality and how
+// much battery the peer has to relay with
 func calculateCost(peer *Peer) int {
 	// Higher RSSI is better, so we invert it
 	// RSSI is typically negative, ranging from -30 (excellent) to -100 (poor)
@@ -126,7 +167,13 @@ func calculateCost(peer *Peer) int {
 		rssi = -rssi
 	}
 	// Convert to cost (lower is better): -30 becomes 30, -100 becomes 100
-	return -rssi
+	cost := -rssi
+
+	// Penalize lossy links when the platform reports link quality
+	if peer.LinkQuality > 0 {
+		cost += int(math.Round((1 - peer.LinkQuality) * maxLinkQualityPenalty))
+	}
+	return cost + powerPenalty(peer.Power)
 }
 
 // getCurrentTimestamp returns the current timestamp in milliseconds
@@ -134,9 +181,17 @@ func getCurrentTimestamp() int64 {
 	return time.Now().UnixMilli()
 }
 
-// UpdateRoute updates or adds a route in the routing table
+// UpdateRoute updates or adds a route in the routing table; a learned cost takes precedence
+// over the given latency
 func (r *Router) UpdateRoute(destination, nextHop string, hopCount int, latency time.Duration) {
-	r.RoutingTable.AddRoute(destination, nextHop, hopCount, int64(latency.Milliseconds()))
+	cost := r.RoutingTable.effectiveCost(destination, nextHop, latency.Milliseconds())
+	r.RoutingTable.AddRoute(destination, nextHop, hopCount, cost)
+}
+
+// ObserveLink records a latency probe to a neighbor and re-costs the direct route to it
+func (r *Router) ObserveLink(peerID string, latency time.Duration, lost bool) {
+	r.RoutingTable.Metrics.Observe(peerID, peerID, latency, lost)
+	r.RoutingTable.Recost(peerID, peerID)
 }
 
 // RemoveRoute removes a route from the routing table
@@ -0,0 +1,92 @@
+package mesh
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrMeshRunning is returned when scanning is started while the mesh is running
+var ErrMeshRunning = errors.New("mesh is running")
+
+// SetPassive sets whether discovery only listens from the next Start: it announces
+// nothing, answers nobody and leaves without a goodbye, so nobody learns we're here
+func (d *Discovery) SetPassive(passive bool) {
+	d.mu.Lock()
+	d.passive = passive
+	d.mu.Unlock()
+}
+
+func (d *Discovery) isPassive() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.passive
+}
+
+// StartScan listens for proxies and their terms without joining the mesh: the transport
+// isn't started and we don't announce ourselves, so a user can see what's around before
+// deciding to join. Start ends the scan.
+func (ma *MeshApp) StartScan() error {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	if ma.IsConnected {
+		return ErrMeshRunning
+	}
+	if ma.fetching {
+		return ErrFetchInProgress
+	}
+	if ma.scanning {
+		return nil
+	}
+	ma.Discovery.SetCallbacks(nil, nil) // Found peers aren't dialed
+	ma.Discovery.SetPassive(true)
+	if err := ma.Discovery.Start(); err != nil {
+		ma.Discovery.SetPassive(false)
+		return err
+	}
+	ma.scanning = true
+	return nil
+}
+
+// StopScan stops a scan started with StartScan
+func (ma *MeshApp) StopScan() {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.stopScanLocked()
+}
+
+// stopScanLocked ends a scan and forgets what it found, so joining reports each peer
+// as discovered again; ma.mu must be held
+func (ma *MeshApp) stopScanLocked() {
+	if !ma.scanning {
+		return
+	}
+	ma.scanning = false
+	ma.Discovery.Stop()
+	ma.Discovery.SetPassive(false)
+	ma.Discovery.ResetPeers()
+}
+
+// IsScanning reports whether a scan is running
+func (ma *MeshApp) IsScanning() bool {
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	return ma.scanning
+}
+
+// ScanProxies returns the proxies heard from, while scanning or in the mesh, with the
+// terms, tier and exit info they advertise; closest to a direct uplink first
+func (ma *MeshApp) ScanProxies() []*DiscoveredPeer {
+	proxies := make([]*DiscoveredPeer, 0)
+	for _, peer := range ma.Discovery.GetPeers() {
+		if peer.HasInternet {
+			proxies = append(proxies, peer)
+		}
+	}
+	sort.Slice(proxies, func(i, j int) bool {
+		if proxies[i].Tier != proxies[j].Tier {
+			return proxies[i].Tier < proxies[j].Tier
+		}
+		return proxies[i].ID < proxies[j].ID
+	})
+	return proxies
+}
@@ -0,0 +1,153 @@
+package mesh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReplayRecording runs a recording through a simulated node: a MeshApp with the recorded settings
+// that opens no sockets. Recorded discoveries and messages are handed to it in order on
+// one goroutine, as fast as it takes them; its dials to peers turn out as they did when
+// recorded, connecting over in-memory pipes whose far end discards what it is sent. The
+// same recording replays the same way, so a bug it captured can be reproduced and fixed
+// against it. Timers and backoffs run on the replay's time, not the recorded offsets.
+
+// simEpoch is the simulated time a replay starts at; events are stamped from it
+var simEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ReplayResult is what the simulated node did and where it ended up
+type ReplayResult struct {
+	Events    []*Event          `json:"events"`    // Emitted by the node, stamped with simulated time
+	Peers     []string          `json:"peers"`     // Discovered peers at the end
+	Connected []string          `json:"connected"` // Peers linked at the end
+	Routes    map[string]string `json:"routes"`    // Next hop to each destination at the end
+}
+
+// ReplayRecording feeds a recording into a simulated node and reports what it did
+func ReplayRecording(rec *Recording) (*ReplayResult, error) {
+	if rec.Version != recordingVersion {
+		return nil, errors.New("unsupported recording version")
+	}
+	sim := NewMeshApp("self", "self", "10.0.0.1", "")
+	// Simulated links carry no handshake back, so there are no identities to prove
+	cfg := rec.Config
+	cfg.RequireProof = false
+	sim.ApplyConfig(cfg)
+	dials := newSimDialer(rec)
+	sim.Transport.dial = dials.dial
+	defer dials.close()
+
+	// Events are collected until the replay ends; closing links may emit more after
+	var mu sync.Mutex
+	var now time.Duration
+	done := false
+	result := &ReplayResult{Routes: make(map[string]string)}
+	sim.RegisterEventListener(simListener(func(event *Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			event.Time = simEpoch.Add(now)
+			result.Events = append(result.Events, event)
+		}
+	}))
+
+	for _, event := range rec.Events {
+		mu.Lock()
+		now = event.Offset
+		mu.Unlock()
+		switch event.Kind {
+		case RecordPeerDiscovered:
+			if event.Peer == nil {
+				continue
+			}
+			peer := *event.Peer
+			peer.LastSeen = simEpoch.Add(now)
+			sim.Discovery.peersMu.Lock()
+			sim.Discovery.peers[peer.ID] = &peer
+			sim.Discovery.peersMu.Unlock()
+			sim.handlePeerDiscovered(&peer)
+		case RecordPeerLost:
+			sim.Discovery.peersMu.Lock()
+			delete(sim.Discovery.peers, event.PeerID)
+			sim.Discovery.peersMu.Unlock()
+			sim.handlePeerLost(event.PeerID)
+		case RecordMessage:
+			if event.Message != nil {
+				msg := *event.Message
+				msg.Timestamp = simEpoch.Add(now)
+				sim.handleMessage(event.PeerID, &msg)
+			}
+		}
+	}
+
+	sim.mu.RLock()
+	for peerID := range sim.DiscoveredPeers {
+		result.Peers = append(result.Peers, peerID)
+	}
+	sim.mu.RUnlock()
+	sort.Strings(result.Peers)
+	result.Connected = sim.Transport.GetConnectedPeers()
+	sort.Strings(result.Connected)
+	for _, route := range sim.Router.RoutingTable.GetAllRoutes() {
+		result.Routes[route.Destination] = route.NextHop
+	}
+	mu.Lock()
+	done = true
+	mu.Unlock()
+	for _, peerID := range result.Connected {
+		sim.Transport.DisconnectPeer(peerID)
+	}
+	return result, nil
+}
+
+// simListener adapts a function to EventListener
+type simListener func(event *Event)
+
+func (l simListener) OnEvent(event *Event) {
+	l(event)
+}
+
+// simDialer answers the simulated node's dials with the outcomes recorded for each
+// address, in order; addresses dialed more often than recorded connect
+type simDialer struct {
+	outcomes map[string][]string // Recorded dial errors by address, "" for success
+	conns    []net.Conn
+	mu       sync.Mutex
+}
+
+func newSimDialer(rec *Recording) *simDialer {
+	d := &simDialer{outcomes: make(map[string][]string)}
+	for _, event := range rec.Events {
+		if event.Kind == RecordDial {
+			d.outcomes[event.Addr] = append(d.outcomes[event.Addr], event.Error)
+		}
+	}
+	return d
+}
+
+func (d *simDialer) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if outcomes := d.outcomes[addr]; len(outcomes) > 0 {
+		d.outcomes[addr] = outcomes[1:]
+		if outcomes[0] != "" {
+			return nil, errors.New(outcomes[0])
+		}
+	}
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	d.conns = append(d.conns, remote)
+	return local, nil
+}
+
+func (d *simDialer) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,129 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Source routing pins a message to an explicit path: Message.Route lists the relays in
+// order, and each relay passes the message to the next one listed, or to the destination
+// after the last, whatever its routing table says. It exists to test multi-hop behavior
+// and to run diagnostic probes along chosen paths, so relays only honor it with
+// Config.SourceRouting; otherwise they refuse the message and tell its source.
+
+// ErrSourceRoute is returned when a message can't be sent along its source route
+var ErrSourceRoute = errors.New("invalid source route")
+
+// SendSourceRouted sends msg to its destination through the relays in route, in order
+func (ma *MeshApp) SendSourceRouted(msg *Message, route []string) error {
+	if len(route) == 0 {
+		return fmt.Errorf("%w: no relays", ErrSourceRoute)
+	}
+	for _, hop := range route {
+		if hop == "" || hop == ma.Node.ID || hop == msg.Dest {
+			return fmt.Errorf("%w: %q can't be a relay", ErrSourceRoute, hop)
+		}
+	}
+	if len(route)+1 > DefaultHopLimit && msg.HopLimit == 0 {
+		return fmt.Errorf("%w: %d relays exceed the hop limit", ErrSourceRoute, len(route))
+	}
+
+	routed := *msg
+	routed.Route = append([]string(nil), route...)
+	if routed.Source == "" {
+		routed.Source = ma.Node.ID
+	}
+	if routed.Timestamp.IsZero() {
+		routed.Timestamp = time.Now()
+	}
+	if err := ma.sealData(&routed); err != nil {
+		return err
+	}
+	return ma.Transport.SendMessage(route[0], &routed)
+}
+
+// nextSourceHop returns where a relay passes a source-routed message: the relay after
+// self in the route, or the destination if self is the last one
+func nextSourceHop(msg *Message, self string) (string, bool) {
+	for i, hop := range msg.Route {
+		if hop != self {
+			continue
+		}
+		if i+1 < len(msg.Route) {
+			return msg.Route[i+1], true
+		}
+		return msg.Dest, true
+	}
+	return "", false
+}
+
+// relaySourceRouted passes a source-routed message to the next hop it lists
+func (ma *MeshApp) relaySourceRouted(peerID string, msg *Message) {
+	if !ma.Config().SourceRouting {
+		ma.reportSourceRouteFailed(peerID, msg, "source routing disabled")
+		return
+	}
+	if ma.LowPower() {
+		ma.reportSourceRouteFailed(peerID, msg, "relay battery low")
+		return
+	}
+	hops, ok := remainingHops(msg)
+	if !ok {
+		ma.reportHopLimitExceeded(peerID, msg)
+		return
+	}
+	nextHop, ok := nextSourceHop(msg, ma.Node.ID)
+	if !ok {
+		ma.reportSourceRouteFailed(peerID, msg, "relay not on the route")
+		return
+	}
+
+	relayed := *msg
+	relayed.HopLimit = hops
+	if err := ma.Transport.SendMessage(nextHop, &relayed); err != nil {
+		ma.reportSourceRouteFailed(peerID, msg, fmt.Sprintf("next hop %s: %v", nextHop, err))
+	}
+}
+
+// reportSourceRouteFailed tells a source-routed message's source why a relay dropped it.
+// The report retraces the relays the message took, since they may be the only way back.
+func (ma *MeshApp) reportSourceRouteFailed(peerID string, msg *Message, reason string) {
+	if msg.Source == "" || msg.Source == ma.Node.ID || msg.Type == "source_route_failed" {
+		return // Failed reports aren't reported, so they can't bounce around
+	}
+	report := &Message{
+		Type:      "source_route_failed",
+		Source:    ma.Node.ID,
+		Dest:      msg.Source,
+		Timestamp: time.Now(),
+		Metadata:  map[string]string{"dest": msg.Dest, "type": msg.Type, "reason": reason},
+	}
+	for i := len(msg.Route) - 1; i >= 0; i-- {
+		if msg.Route[i] == ma.Node.ID {
+			for j := i - 1; j >= 0; j-- {
+				report.Route = append(report.Route, msg.Route[j])
+			}
+			break
+		}
+	}
+	ma.Transport.SendMessage(peerID, report)
+}
+
+// handleSourceRouteFailed surfaces a report that one of our source-routed messages was
+// dropped, and relays reports for others
+func (ma *MeshApp) handleSourceRouteFailed(peerID string, msg *Message) {
+	if msg.Dest != ma.Node.ID {
+		if len(msg.Route) > 0 {
+			ma.relaySourceRouted(peerID, msg)
+		} else {
+			ma.forward(msg)
+		}
+		return
+	}
+	ma.emitEvent(&Event{
+		Type:   EventSourceRouteFailed,
+		PeerID: msg.Source,
+		Detail: fmt.Sprintf("%s message to %s: %s", msg.Metadata["type"], msg.Metadata["dest"], msg.Metadata["reason"]),
+	})
+}
@@ -0,0 +1,132 @@
+package mesh
+
+import "fmt"
+
+// A warm standby is a second proxy we are connected to and authorized by but send no
+// requests through. When the primary proxy disappears the standby takes over at once,
+// without waiting for discovery, a handshake and authorization.
+
+// SetStandby sets the proxy that takes over when the primary one is lost
+func (c *InternetClient) SetStandby(proxyPeerID, proxyIP string, port int) error {
+	up, err := newUpstreamProxy(proxyPeerID, proxyIP, port)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return fmt.Errorf("not connected to proxy")
+	}
+	up.session = c.sessionLocked(proxyPeerID)
+	c.standby = up
+	return nil
+}
+
+// Standby returns the standby proxy's peer ID, or ""
+func (c *InternetClient) Standby() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.standby == nil {
+		return ""
+	}
+	return c.standby.peerID
+}
+
+// clearStandby drops the standby proxy if it is proxyPeerID, reporting whether it was
+func (c *InternetClient) clearStandby(proxyPeerID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.standby == nil || c.standby.peerID != proxyPeerID {
+		return false
+	}
+	c.standby = nil
+	return true
+}
+
+// Failover replaces a lost primary proxy with the standby, or else with a bonded proxy,
+// returning the new primary. Nothing changes when lost isn't the primary or no proxy can
+// replace it.
+func (c *InternetClient) Failover(lost string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected || lost != c.proxyPeerID {
+		return "", false
+	}
+
+	remaining := make([]*upstreamProxy, 0, len(c.upstreams))
+	for _, up := range c.upstreams {
+		if up.peerID != lost {
+			remaining = append(remaining, up)
+		}
+	}
+	next := c.standby
+	if next == nil {
+		if len(remaining) == 0 {
+			return "", false
+		}
+		next, remaining = remaining[0], remaining[1:]
+	}
+
+	c.proxyPeerID = next.peerID
+	c.proxyAddr = next.url.String()
+	c.upstreams = append([]*upstreamProxy{next}, remaining...)
+	c.standby = nil
+	return next.peerID, true
+}
+
+// prepareStandby connects to the best proxy not already in use and asks it for
+// authorization, keeping it as the standby. Only peers the user already approved and
+// paired with are considered.
+func (ma *MeshApp) prepareStandby() {
+	if ma.Config().DisableStandby || !ma.InternetClient.IsConnected() || ma.InternetClient.Standby() != "" {
+		return
+	}
+
+	var best *DiscoveredPeer
+	var bestCost int64
+	for _, peer := range ma.Discovery.GetPeers() {
+		if ma.InternetClient.UsesProxy(peer.ID) || !ma.usableExit(peer) ||
+			!ma.ExitConsent.HasConsent(peer) || ma.pairingRequired(peer.ID) {
+			continue
+		}
+		// Lowest tier first, then the lowest learned cost of the link
+		cost, _ := ma.Router.RoutingTable.Metrics.Cost(peer.ID, peer.ID)
+		if best == nil || peer.Tier < best.Tier || (peer.Tier == best.Tier && cost < bestCost) {
+			best, bestCost = peer, cost
+		}
+	}
+	if best == nil {
+		return
+	}
+
+	if err := ma.Transport.ConnectToPeer(best.ID, best.IP, best.Port); err != nil {
+		return
+	}
+	if err := ma.InternetClient.SetStandby(best.ID, best.IP, ProxyPort); err != nil {
+		return
+	}
+	ma.requestProxyAccess(best.ID)
+}
+
+// handleProxyLost fails over to the standby when our primary proxy disappears, and
+// replaces a standby that disappears
+func (ma *MeshApp) handleProxyLost(peerID string) {
+	if ma.InternetClient.clearStandby(peerID) {
+		go ma.prepareStandby()
+		return
+	}
+
+	next, ok := ma.InternetClient.Failover(peerID)
+	if !ok {
+		return
+	}
+	if peer, found := ma.Discovery.GetPeer(next); found {
+		ma.mu.Lock()
+		ma.upstreamTier = peer.Tier
+		ma.mu.Unlock()
+		ma.updateProxyAdvertisement()
+	}
+	ma.emitEvent(&Event{Type: EventProxyFailover, PeerID: next, Detail: fmt.Sprintf("replaced lost proxy %s", peerID)})
+	go ma.prepareStandby()
+}
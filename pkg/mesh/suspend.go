@@ -0,0 +1,129 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SleepCheckInterval is how often the wall clock is sampled to detect host sleep
+const SleepCheckInterval = 5 * time.Second
+
+// sleepGapFactor is how many check intervals must be missed before we assume the host slept
+const sleepGapFactor = 3
+
+// Suspend quiesces timers and sockets before the host sleeps. Peers are told we are
+// leaving so they don't keep routing through stale connections. Resume reverses it.
+func (ma *MeshApp) Suspend() {
+	ma.mu.Lock()
+	if !ma.IsConnected || ma.suspended {
+		ma.mu.Unlock()
+		return
+	}
+	ma.suspended = true
+	ma.resumeSharing = ma.IsInternetSharing
+	ma.hibernated = make(map[string]*hibernatedPeer)
+
+	// Stop background loops; Resume starts them again on a fresh context
+	ma.cancel()
+	ma.ctx, ma.cancel = context.WithCancel(context.Background())
+	ma.mu.Unlock()
+
+	ma.Discovery.Stop()
+	ma.Transport.Stop()
+	ma.InternetProxy.Disable()
+
+	ma.emitEvent(&Event{Type: EventSuspended})
+}
+
+// Resume restarts sockets and timers after wake and rapidly re-discovers and
+// reconnects to peers. It is a no-op unless the app was suspended.
+func (ma *MeshApp) Resume() {
+	ma.mu.Lock()
+	if !ma.suspended {
+		ma.mu.Unlock()
+		return
+	}
+	ma.suspended = false
+	resumeSharing := ma.resumeSharing
+
+	// Everything we knew about peers predates the sleep; forget it so fresh
+	// announcements trigger reconnection instead of being treated as duplicates
+	ma.Discovery.ResetPeers()
+
+	ma.componentErrs = make(map[string]error)
+	if err := ma.Transport.Start(); err != nil {
+		ma.componentErrs["transport"] = err
+	}
+	if err := ma.Discovery.Start(); err != nil {
+		ma.componentErrs["discovery"] = err
+	}
+	degraded := make(map[string]error, len(ma.componentErrs))
+	for name, err := range ma.componentErrs {
+		degraded[name] = err
+	}
+
+	ma.startBackgroundLoopsLocked()
+	ma.mu.Unlock()
+
+	for name, err := range degraded {
+		ma.emitEvent(&Event{Type: EventComponentDegraded, Component: name, Detail: err.Error()})
+	}
+
+	ma.connectStaticPeers()
+	ma.announceToLinkPeers()
+
+	// The network may have changed while asleep, so check connectivity right away
+	hasInternet := CheckInternetConnectivity()
+	ma.mu.Lock()
+	ma.Node.HasInternet = hasInternet
+	ma.recordInternetCheckLocked(hasInternet)
+	ma.mu.Unlock()
+
+	if resumeSharing && hasInternet {
+		ma.InternetProxy.Enable()
+	}
+	ma.updateProxyAdvertisement()
+
+	ma.emitEvent(&Event{Type: EventResumed})
+}
+
+// IsSuspended returns whether the app is suspended for host sleep
+func (ma *MeshApp) IsSuspended() bool {
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	return ma.suspended
+}
+
+// sleepWatchLoop detects host sleep the platform did not report, by watching for time
+// the monotonic clock missed, and cycles the app so connections don't silently rot.
+// The wall clock being set is reported instead, where it can be told apart from sleep.
+func (ma *MeshApp) sleepWatchLoop(ctx context.Context) {
+	ticker := time.NewTicker(SleepCheckInterval)
+	defer ticker.Stop()
+
+	last := sampleClocks()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := sampleClocks()
+			slept, jumped := now.since(last)
+			gap := now.mono.Sub(last.mono) + slept
+			last = now
+			if jumped.Abs() >= ClockJumpThreshold {
+				ma.emitEvent(&Event{Type: EventClockJumped, Detail: fmt.Sprintf("wall clock moved by %+v", jumped.Round(time.Second))})
+			}
+			if gap < sleepGapFactor*SleepCheckInterval {
+				continue
+			}
+			ma.emitEvent(&Event{Type: EventWakeDetected, Detail: "host slept for " + gap.Round(time.Second).String()})
+			go func() {
+				ma.Suspend()
+				ma.Resume()
+			}()
+			return
+		}
+	}
+}
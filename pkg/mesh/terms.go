@@ -0,0 +1,137 @@
+package mesh
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SharingTerms describes the conditions a sharer attaches to its proxy advertisement.
+// Clients receive them with discovery announcements and can show them before connecting.
+type SharingTerms struct {
+	MaxMBPerClient int64  `json:"max_mb_per_client,omitempty"` // 0 means unlimited
+	HoursAvailable string `json:"hours,omitempty"`             // "HH:MM-HH:MM" sharer's local time, empty means always
+	AskFirst       bool   `json:"ask_first,omitempty"`         // Sharer approves each client manually
+
+	// UTCOffset is the sharer's offset from UTC in minutes, which the hours are in. It is
+	// filled in when the terms are announced; without it, as from older peers, the hours
+	// are read in the client's own time.
+	UTCOffset *int `json:"utc_offset,omitempty"`
+
+	// Destinations scopes the offer to these hosts and their subdomains, e.g. wikipedia.org,
+	// so a sharer on a slow or metered uplink can still offer something with a predictable
+	// cost; empty means any destination
+	Destinations []string `json:"destinations,omitempty"`
+}
+
+// Validate checks that the terms are well-formed
+func (t *SharingTerms) Validate() error {
+	if t.MaxMBPerClient < 0 {
+		return fmt.Errorf("max MB per client must not be negative")
+	}
+	if t.HoursAvailable != "" {
+		if _, _, err := parseHoursRange(t.HoursAvailable); err != nil {
+			return err
+		}
+	}
+	for _, host := range t.Destinations {
+		if host == "" || strings.ContainsAny(host, " /:") {
+			return fmt.Errorf("invalid destination %q, expected a hostname", host)
+		}
+	}
+	return nil
+}
+
+// Scoped reports whether the offer is limited to some destinations
+func (t *SharingTerms) Scoped() bool {
+	return t != nil && len(t.Destinations) > 0
+}
+
+// Serves returns whether the offer covers a destination host, which may carry a port
+func (t *SharingTerms) Serves(host string) bool {
+	if !t.Scoped() {
+		return true
+	}
+	return hostInList(normalizeHost(host), t.Destinations)
+}
+
+// IsAvailableAt returns whether the sharer offers service at the given time, read on the
+// sharer's clock
+func (t *SharingTerms) IsAvailableAt(now time.Time) bool {
+	if t == nil || t.HoursAvailable == "" {
+		return true
+	}
+	start, end, err := parseHoursRange(t.HoursAvailable)
+	if err != nil {
+		return true // Malformed hours from a peer shouldn't hide the proxy
+	}
+	if t.UTCOffset != nil {
+		now = now.In(time.FixedZone("", *t.UTCOffset*60))
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	// Range wraps past midnight, e.g. "22:00-06:00"
+	return minute >= start || minute < end
+}
+
+// announced returns the terms as we announce them, with our current UTC offset
+func (t *SharingTerms) announced(now time.Time) *SharingTerms {
+	if t == nil || t.HoursAvailable == "" {
+		return t
+	}
+	announced := *t
+	_, offset := now.Zone()
+	offset /= 60
+	announced.UTCOffset = &offset
+	return &announced
+}
+
+// Equal reports whether two sets of terms are identical (nil-safe)
+func (t *SharingTerms) Equal(other *SharingTerms) bool {
+	if t == nil || other == nil {
+		return t == other
+	}
+	sameOffset := t.UTCOffset == nil && other.UTCOffset == nil ||
+		t.UTCOffset != nil && other.UTCOffset != nil && *t.UTCOffset == *other.UTCOffset
+	return t.MaxMBPerClient == other.MaxMBPerClient && t.HoursAvailable == other.HoursAvailable &&
+		t.AskFirst == other.AskFirst && slices.Equal(t.Destinations, other.Destinations) && sameOffset
+}
+
+// parseHoursRange parses "HH:MM-HH:MM" into minutes since midnight. The end may be
+// 24:00, so "00:00-24:00" is all day; an end before the start wraps past midnight, and
+// an empty range, with the end equal to the start, is refused.
+func parseHoursRange(hours string) (int, int, error) {
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid hours %q, expected HH:MM-HH:MM", hours)
+	}
+	start, startOK := parseClock(from)
+	end, endOK := parseClock(to)
+	if !startOK || !endOK || start == 24*60 {
+		return 0, 0, fmt.Errorf("invalid hours %q, expected HH:MM-HH:MM", hours)
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("invalid hours %q: the range is empty", hours)
+	}
+	return start, end, nil
+}
+
+// parseClock parses "HH:MM", 00:00 to 24:00, into minutes since midnight
+func parseClock(clock string) (int, bool) {
+	if len(clock) != 5 || clock[2] != ':' {
+		return 0, false
+	}
+	h, err := strconv.Atoi(clock[:2])
+	if err != nil || h < 0 || h > 24 || clock[0] == '+' || clock[0] == '-' {
+		return 0, false
+	}
+	m, err := strconv.Atoi(clock[3:])
+	if err != nil || m < 0 || m > 59 || clock[3] == '+' || clock[3] == '-' || h == 24 && m != 0 {
+		return 0, false
+	}
+	return h*60 + m, true
+}
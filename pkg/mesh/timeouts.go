@@ -0,0 +1,103 @@
+package mesh
+
+import "time"
+
+// Timeouts gathers how long a node waits on the connections it makes, and how it paces
+// retries, in one place. Slow links such as BLE relays call for longer timeouts; a wired
+// LAN can use shorter ones to notice dead peers sooner. Zero fields use the defaults.
+type Timeouts struct {
+	PeerDial      time.Duration // TCP connect to a mesh peer
+	PeerHandshake time.Duration // Each of a peer's TLS, Noise and identity handshakes
+	ExitResolve   time.Duration // DNS lookup of an exit destination
+	ExitAttempt   time.Duration // One connection attempt to an exit destination
+	ExitDial      time.Duration // Resolving and connecting to an exit destination altogether
+	UpstreamDial  time.Duration // Connecting to the upstream proxy and its handshake
+	TunnelSetup   time.Duration // Connecting to a mesh proxy and its answer to CONNECT
+	RetryBase     time.Duration // Wait after a first failed peer dial; doubles with each failure
+	RetryMax      time.Duration // Longest wait between dials of an unreachable peer
+	ProxyCooldown time.Duration // How long a proxy that failed a request is avoided
+}
+
+// DefaultPeerDialTimeout bounds the TCP connect to a mesh peer
+const DefaultPeerDialTimeout = 5 * time.Second
+
+// DefaultTimeouts returns the timeouts used unless configured otherwise
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		PeerDial:      DefaultPeerDialTimeout,
+		PeerHandshake: tlsHandshakeTimeout,
+		ExitResolve:   DialResolveTimeout,
+		ExitAttempt:   DialAttemptTimeout,
+		ExitDial:      DialTotalTimeout,
+		UpstreamDial:  UpstreamDialTimeout,
+		TunnelSetup:   TunnelSetupTimeout,
+		RetryBase:     DialBackoffBase,
+		RetryMax:      DialBackoffMax,
+		ProxyCooldown: UpstreamFailureCooldown,
+	}
+}
+
+// withDefaults fills zero and negative fields from d
+func (t Timeouts) withDefaults(d Timeouts) Timeouts {
+	fill := func(v *time.Duration, def time.Duration) {
+		if *v <= 0 {
+			*v = def
+		}
+	}
+	fill(&t.PeerDial, d.PeerDial)
+	fill(&t.PeerHandshake, d.PeerHandshake)
+	fill(&t.ExitResolve, d.ExitResolve)
+	fill(&t.ExitAttempt, d.ExitAttempt)
+	fill(&t.ExitDial, d.ExitDial)
+	fill(&t.UpstreamDial, d.UpstreamDial)
+	fill(&t.TunnelSetup, d.TunnelSetup)
+	fill(&t.RetryBase, d.RetryBase)
+	fill(&t.RetryMax, d.RetryMax)
+	fill(&t.ProxyCooldown, d.ProxyCooldown)
+	if t.RetryMax < t.RetryBase {
+		t.RetryMax = t.RetryBase
+	}
+	return t
+}
+
+// SetTimeouts sets the peer dial and handshake timeouts
+func (t *Transport) SetTimeouts(timeouts Timeouts) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timeouts = timeouts.withDefaults(DefaultTimeouts())
+}
+
+func (t *Transport) timeoutPolicy() Timeouts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timeouts
+}
+
+// SetTimeouts sets the timeouts of exit and upstream proxy dials
+func (g *ExitGuard) SetTimeouts(timeouts Timeouts) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.timeouts = timeouts.withDefaults(DefaultTimeouts())
+}
+
+func (g *ExitGuard) timeoutPolicy() Timeouts {
+	if g == nil {
+		return DefaultTimeouts()
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.timeouts
+}
+
+// SetTimeouts sets the tunnel setup timeout and how long failing proxies are avoided
+func (c *InternetClient) SetTimeouts(timeouts Timeouts) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeouts = timeouts.withDefaults(DefaultTimeouts())
+}
+
+func (c *InternetClient) timeoutPolicy() Timeouts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timeouts
+}
@@ -0,0 +1,174 @@
+package mesh
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TraceHeader carries a request's trace ID between relays; the exit strips it before
+// the request reaches the internet
+const TraceHeader = "X-Intermesh-Trace"
+
+// Hops a traced request passes through
+const (
+	TraceHopLocalProxy = "local_proxy" // The phone's local HTTP proxy, where the trace starts
+	TraceHopBLERelay   = "ble_relay"   // A device bridging BLE requests onto the mesh
+	TraceHopExit       = "exit"        // The node that makes the request on the internet
+)
+
+// DefaultTraceRecords is how many hop records a node keeps for diagnostics
+const DefaultTraceRecords = 256
+
+// NewTraceID returns a random trace ID
+func NewTraceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// TraceRecord is what one node saw of a traced request
+type TraceRecord struct {
+	TraceID    string    `json:"trace_id"`
+	NodeID     string    `json:"node_id"`
+	Hop        string    `json:"hop"`
+	Target     string    `json:"target,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Start      time.Time `json:"start"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// TraceLog keeps the most recent hop records and logs each one. A nil TraceLog discards records.
+type TraceLog struct {
+	nodeID  string
+	records []TraceRecord
+	next    int
+	full    bool
+	mu      sync.Mutex
+}
+
+// NewTraceLog creates a trace log holding up to capacity records
+func NewTraceLog(nodeID string, capacity int) *TraceLog {
+	if capacity <= 0 {
+		capacity = DefaultTraceRecords
+	}
+	return &TraceLog{nodeID: nodeID, records: make([]TraceRecord, capacity)}
+}
+
+// Start begins timing this node's hop of a traced request
+func (l *TraceLog) Start(traceID, hop, target string) *TraceSpan {
+	return &TraceSpan{
+		log: l,
+		record: TraceRecord{
+			TraceID: traceID,
+			Hop:     hop,
+			Target:  target,
+			Start:   time.Now(),
+		},
+	}
+}
+
+func (l *TraceLog) add(record TraceRecord) {
+	if l == nil {
+		return
+	}
+	record.NodeID = l.nodeID
+	log.Printf("trace=%s node=%s hop=%s target=%s status=%d duration=%dms error=%q",
+		record.TraceID, record.NodeID, record.Hop, record.Target, record.Status, record.DurationMs, record.Error)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records[l.next] = record
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Records returns the kept records of a trace, oldest first; an empty ID returns all
+func (l *TraceLog) Records(traceID string) []TraceRecord {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var all []TraceRecord
+	if l.full {
+		all = append(all, l.records[l.next:]...)
+	}
+	all = append(all, l.records[:l.next]...)
+	if traceID == "" {
+		return all
+	}
+	var matched []TraceRecord
+	for _, record := range all {
+		if record.TraceID == traceID {
+			matched = append(matched, record)
+		}
+	}
+	return matched
+}
+
+// TraceSpan times one hop; only the first End is recorded
+type TraceSpan struct {
+	log    *TraceLog
+	record TraceRecord
+	once   sync.Once
+}
+
+// TraceID returns the ID of the trace the span belongs to
+func (s *TraceSpan) TraceID() string {
+	return s.record.TraceID
+}
+
+// End records the hop's outcome
+func (s *TraceSpan) End(status int, errMsg string) {
+	s.once.Do(func() {
+		record := s.record
+		record.Status = status
+		record.Error = errMsg
+		record.DurationMs = time.Since(record.Start).Milliseconds()
+		s.log.add(record)
+	})
+}
+
+// traceStatusWriter captures the status a proxy handler answered with
+type traceStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *traceStatusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceStatusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Hijack hands over the connection for CONNECT tunnels, which answer 200 themselves
+func (w *traceStatusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return conn, rw, err
+}
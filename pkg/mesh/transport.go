@@ -2,35 +2,72 @@ package mesh
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Transport handles TCP connections between peers
 type Transport struct {
-	nodeID      string
-	port        int
-	listener    net.Listener
-	connections map[string]*Connection
-	connMu      sync.RWMutex
-	onMessage   func(peerID string, msg *Message)
-	ctx         context.Context
-	cancel      context.CancelFunc
-	running     bool
-	mu          sync.Mutex
+	nodeID         string
+	port           int
+	listener       net.Listener
+	adopted        net.Listener // Listener the next Start serves on instead of binding the port
+	connections    map[string]*Connection
+	connMu         sync.RWMutex
+	onMessage      func(peerID string, msg *Message)
+	filter         MessageFilter
+	reconnect      func(peerID string) bool
+	verifier       ConnectionVerifier
+	tracer         *Tracer
+	ctx            context.Context
+	cancel         context.CancelFunc
+	running        bool
+	maxMessageSize int
+	tls            *transportTLS   // nil for plaintext connections
+	noise          *transportNoise // nil unless connections use Noise instead of TLS
+	identity       *Identity       // Proves our node ID in handshakes; nil for unproven IDs
+	proven         map[string]bool // Peers that proved their node ID on their last handshake
+	requireProof   bool            // Refuse peers that don't prove their node ID
+	minVersion     int             // Oldest protocol version accepted from peers; 0 for MinProtocolVersion
+	timeouts       Timeouts        // Peer dial and handshake timeouts
+	onForged       func(peerID string, msg *Message, err error)
+	onHandshake    func(peerID string, err error)                             // Peers we dialed that failed to prove themselves
+	replay         *replayGuard                                               // Numbers our messages and drops replayed ones
+	dial           func(addr string, timeout time.Duration) (net.Conn, error) // Connects to peers; nil dials TCP
+	wsServer       *http.Server                                               // Serves WebSocket peers, see ListenWebSocket
+	wsListener     net.Listener
+	udp            *net.UDPConn // Receives and sends datagrams, see datagram.go; nil without
+	mu             sync.Mutex
 }
 
 // Connection represents a connection to a peer
 type Connection struct {
-	PeerID    string
-	Conn      net.Conn
-	Connected bool
-	mu        sync.Mutex
+	PeerID      string
+	Conn        net.Conn
+	Connected   bool
+	lastActive  int64                        // Monotonic instant (see monoNow) of the last message that wasn't background chatter
+	compact     atomic.Bool                  // Peer understands CodecDict frames
+	protocol    atomic.Int32                 // Protocol version spoken on the link
+	datagram    atomic.Pointer[datagramPath] // Where the peer takes our datagrams, once it offered
+	datagramKey []byte                       // Opens the datagrams the peer sends us; guarded by mu
+	mu          sync.Mutex
+}
+
+// touch records traffic on the connection unless the message is background chatter
+func (c *Connection) touch(msg *Message) {
+	if !backgroundMessageTypes[msg.Type] {
+		atomic.StoreInt64(&c.lastActive, monoNow())
+	}
 }
 
 // Message represents a message sent between peers
@@ -41,8 +78,18 @@ type Message struct {
 	Payload   []byte            `json:"payload"` // Message payload
 	Timestamp time.Time         `json:"timestamp"`
 	Metadata  map[string]string `json:"metadata,omitempty"`
+	HopLimit  int               `json:"hop_limit,omitempty"` // Hops left before the message is dropped; 0 for DefaultHopLimit
+	Route     []string          `json:"route,omitempty"`     // Relays to take in order, if source routed; see SendSourceRouted
+	Seq       uint64            `json:"seq,omitempty"`       // Grows with every message the source sends; see replayGuard
+	Boot      uint64            `json:"boot,omitempty"`      // Picked at random each time the source starts; see replayGuard
+	Signer    []byte            `json:"signer,omitempty"`    // Public key of the source's identity, if it signed
+	Signature []byte            `json:"sig,omitempty"`
+	Datagram  bool              `json:"-"` // Send as a UDP datagram where the link allows, see datagram.go
 }
 
+// DefaultHopLimit is how many hops a message may take when its sender set no limit
+const DefaultHopLimit = 16
+
 const (
 	DefaultPort    = 9998
 	MaxMessageSize = 65536 // 64KB max message size
@@ -55,11 +102,83 @@ func NewTransport(nodeID string, port int) *Transport {
 		nodeID:      nodeID,
 		port:        port,
 		connections: make(map[string]*Connection),
+		proven:      make(map[string]bool),
+		timeouts:    DefaultTimeouts(),
+		replay:      newReplayGuard(),
 		ctx:         ctx,
 		cancel:      cancel,
 	}
 }
 
+// MessageFilter vets messages to and from a peer; a non-nil error drops the message
+type MessageFilter func(peerID string, msg *Message, outbound bool) error
+
+// SetMessageFilter sets the filter applied to every message sent and received
+func (t *Transport) SetMessageFilter(filter MessageFilter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.filter = filter
+}
+
+func (t *Transport) messageFilter() MessageFilter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.filter
+}
+
+// ConnectionVerifier vets an incoming connection once its handshake names the peer; a
+// non-nil error closes the connection
+type ConnectionVerifier func(peerID string, addr net.Addr) error
+
+// SetConnectionVerifier sets the check applied to every incoming connection
+func (t *Transport) SetConnectionVerifier(verifier ConnectionVerifier) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.verifier = verifier
+}
+
+// SetTracer records spans around sent messages and propagates their context in metadata
+func (t *Transport) SetTracer(tracer *Tracer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tracer = tracer
+}
+
+// startSendSpan starts the span of an outgoing message and injects its context; routine
+// background chatter isn't traced so it doesn't drown out the traces of real traffic
+func (t *Transport) startSendSpan(msg *Message, peerID string) *Span {
+	if backgroundMessageTypes[msg.Type] {
+		return nil
+	}
+	t.mu.Lock()
+	tracer := t.tracer
+	t.mu.Unlock()
+
+	span := tracer.Start(MessageSpanContext(msg), "transport.send "+msg.Type, SpanKindProducer)
+	span.SetAttribute("peer.id", peerID)
+	span.Inject(msg)
+	return span
+}
+
+// SetReconnectHandler sets a callback that may re-establish the connection to a peer
+// when a message is sent to it while disconnected; it reports whether it did
+func (t *Transport) SetReconnectHandler(handler func(peerID string) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reconnect = handler
+}
+
+// IdleTime returns how long a connection has carried nothing but background chatter
+func (t *Transport) IdleTime(peerID string) (time.Duration, bool) {
+	t.connMu.RLock()
+	conn, exists := t.connections[peerID]
+	t.connMu.RUnlock()
+	if !exists {
+		return 0, false
+	}
+	return monoSince(atomic.LoadInt64(&conn.lastActive)), true
+}
+
 // SetMessageHandler sets the callback for received messages
 func (t *Transport) SetMessageHandler(handler func(string, *Message)) {
 	t.mu.Lock()
@@ -77,15 +196,29 @@ func (t *Transport) Start() error {
 	t.running = true
 	// Reset context for restart
 	t.ctx, t.cancel = context.WithCancel(context.Background())
+	ctx := t.ctx
 	t.mu.Unlock()
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", t.port))
+	t.mu.Lock()
+	listener := t.adopted
+	t.adopted = nil
+	t.mu.Unlock()
+	var err error
+	if listener == nil {
+		listener, err = net.Listen("tcp", fmt.Sprintf(":%d", t.port))
+	}
 	if err != nil {
+		t.mu.Lock()
+		t.running = false
+		t.mu.Unlock()
 		return fmt.Errorf("failed to start listener: %w", err)
 	}
+	t.mu.Lock()
 	t.listener = listener
+	t.mu.Unlock()
+	t.startDatagrams(listener)
 
-	go t.acceptLoop()
+	go t.acceptLoop(ctx, listener)
 
 	return nil
 }
@@ -98,13 +231,16 @@ func (t *Transport) Stop() {
 		return
 	}
 	t.running = false
+	cancel, listener := t.cancel, t.listener
 	t.mu.Unlock()
 
-	t.cancel()
+	cancel()
 
-	if t.listener != nil {
-		t.listener.Close()
+	if listener != nil {
+		listener.Close()
 	}
+	t.stopWebSocket()
+	t.stopDatagrams()
 
 	// Close all connections
 	t.connMu.Lock()
@@ -115,6 +251,23 @@ func (t *Transport) Stop() {
 	t.connMu.Unlock()
 }
 
+// IsRunning returns whether the transport is running
+func (t *Transport) IsRunning() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.running
+}
+
+// ListenAddr returns the address the transport listener is bound to, or "" if not listening
+func (t *Transport) ListenAddr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.running || t.listener == nil {
+		return ""
+	}
+	return t.listener.Addr().String()
+}
+
 // ConnectToPeer establishes a connection to a peer
 func (t *Transport) ConnectToPeer(peerID, ip string, port int) error {
 	// Check if already connected
@@ -126,11 +279,35 @@ func (t *Transport) ConnectToPeer(peerID, ip string, port int) error {
 	t.connMu.RUnlock()
 
 	// Establish TCP connection
-	addr := fmt.Sprintf("%s:%d", ip, port)
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	timeouts := t.timeoutPolicy()
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	dial := t.dial
+	if dial == nil {
+		dial = func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		}
+	}
+	conn, err := dial(addr, timeouts.PeerDial)
 	if err != nil {
 		return fmt.Errorf("failed to connect to peer: %w", err)
 	}
+	return t.connectOver(peerID, conn)
+}
+
+// connectOver runs our side of the handshake with a peer we dialed over conn and starts
+// serving the link
+func (t *Transport) connectOver(peerID string, conn net.Conn) error {
+	timeouts := t.timeoutPolicy()
+	var err error
+	if setup := t.tlsSetup(); setup != nil {
+		secured, err := setup.clientHandshake(conn, peerID, timeouts.PeerHandshake)
+		if err != nil {
+			conn.Close()
+			t.handshakeFailed(peerID, err)
+			return fmt.Errorf("failed to connect to peer: %w", err)
+		}
+		conn = secured
+	}
 
 	// Send handshake
 	handshake := Message{
@@ -138,18 +315,68 @@ func (t *Transport) ConnectToPeer(peerID, ip string, port int) error {
 		Source:    t.nodeID,
 		Dest:      peerID,
 		Timestamp: time.Now(),
+		Metadata:  map[string]string{"codec": CodecDict},
+	}
+	t.stampProtocol(handshake.Metadata)
+	noise := t.noiseSetup()
+	var hs *noiseHandshake
+	if noise != nil {
+		var first string
+		if hs, first, err = noise.startInitiator(t.nodeID, peerID); err != nil {
+			conn.Close()
+			return fmt.Errorf("handshake failed: %w", err)
+		}
+		handshake.Metadata["secure"] = SecureNoiseXX
+		handshake.Metadata["noise"] = first
+	}
+	identity := t.identitySetup()
+	requireProof := t.proofRequired()
+	if requireProof && identity == nil {
+		conn.Close()
+		return errors.New("handshake failed: proving peers requires an identity")
+	}
+	var nonce []byte
+	if identity != nil {
+		nonce = identity.offer(handshake.Metadata)
 	}
-	if err := t.sendMessage(conn, &handshake); err != nil {
+	if err := t.sendMessage(conn, &handshake, false); err != nil {
 		conn.Close()
 		return fmt.Errorf("handshake failed: %w", err)
 	}
+	if noise != nil {
+		secured, err := t.noiseFinishDial(noise, hs, conn, peerID)
+		if err != nil {
+			conn.Close()
+			t.handshakeFailed(peerID, err)
+			return fmt.Errorf("handshake failed: %w", err)
+		}
+		conn = secured
+	}
+	proven := false
+	if identity != nil {
+		if proven, err = t.proveDial(conn, identity, peerID, nonce); err != nil {
+			conn.Close()
+			t.handshakeFailed(peerID, err)
+			return fmt.Errorf("handshake failed: %w", err)
+		}
+	}
+	if !proven && (requireProof || (identity != nil && t.claimsIdentity(peerID))) {
+		conn.Close()
+		err := fmt.Errorf("%w: peer has no identity", ErrIdentityProof)
+		t.handshakeFailed(peerID, err)
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	t.setProven(peerID, proven)
 
 	// Create connection object
 	connection := &Connection{
-		PeerID:    peerID,
-		Conn:      conn,
-		Connected: true,
+		PeerID:     peerID,
+		Conn:       conn,
+		Connected:  true,
+		lastActive: monoNow(),
 	}
+	// Until the peer states its versions, assume it predates versioning
+	connection.protocol.Store(1)
 
 	t.connMu.Lock()
 	t.connections[peerID] = connection
@@ -181,11 +408,34 @@ func (t *Transport) SendMessage(peerID string, msg *Message) error {
 	conn, exists := t.connections[peerID]
 	t.connMu.RUnlock()
 
+	if !exists {
+		t.mu.Lock()
+		reconnect := t.reconnect
+		t.mu.Unlock()
+		if reconnect != nil && reconnect(peerID) {
+			t.connMu.RLock()
+			conn, exists = t.connections[peerID]
+			t.connMu.RUnlock()
+		}
+	}
 	if !exists {
 		return fmt.Errorf("not connected to peer %s", peerID)
 	}
+	if filter := t.messageFilter(); filter != nil {
+		if err := filter(peerID, msg, true); err != nil {
+			return err
+		}
+	}
 
-	return t.sendMessage(conn.Conn, msg)
+	span := t.startSendSpan(msg, peerID)
+	defer span.End()
+	conn.touch(msg)
+	if msg.Datagram && t.trySendDatagram(conn, msg) {
+		return nil
+	}
+	err := t.sendMessage(conn.Conn, msg, conn.compact.Load())
+	span.SetError(err)
+	return err
 }
 
 // BroadcastMessage sends a message to all connected peers
@@ -197,8 +447,15 @@ func (t *Transport) BroadcastMessage(msg *Message) {
 	}
 	t.connMu.RUnlock()
 
+	span := t.startSendSpan(msg, "*")
+	defer span.End()
+	filter := t.messageFilter()
 	for _, conn := range connections {
-		t.sendMessage(conn.Conn, msg)
+		if filter != nil && filter(conn.PeerID, msg, true) != nil {
+			continue
+		}
+		conn.touch(msg)
+		t.sendMessage(conn.Conn, msg, conn.compact.Load())
 	}
 }
 
@@ -214,17 +471,17 @@ func (t *Transport) GetConnectedPeers() []string {
 	return peers
 }
 
-// acceptLoop accepts incoming connections
-func (t *Transport) acceptLoop() {
+// acceptLoop accepts incoming connections; it is bound to the listener and context of one Start
+func (t *Transport) acceptLoop(ctx context.Context, listener net.Listener) {
 	for {
 		select {
-		case <-t.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
 		}
 
-		t.listener.(*net.TCPListener).SetDeadline(time.Now().Add(1 * time.Second))
-		conn, err := t.listener.Accept()
+		listener.(*net.TCPListener).SetDeadline(time.Now().Add(1 * time.Second))
+		conn, err := listener.Accept()
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
@@ -238,25 +495,77 @@ func (t *Transport) acceptLoop() {
 
 // handleIncomingConnection handles a new incoming connection
 func (t *Transport) handleIncomingConnection(conn net.Conn) {
+	setup := t.tlsSetup()
+	if setup != nil {
+		tlsConn, err := setup.serverHandshake(conn, t.timeoutPolicy().PeerHandshake)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+
 	// Read handshake
-	msg, err := t.readMessage(conn)
+	msg, _, err := t.readMessage(conn)
 	if err != nil || msg.Type != "handshake" {
 		conn.Close()
 		return
 	}
 
 	peerID := msg.Source
-
+	version, minVersion := peerProtocol(msg.Metadata)
+	negotiated, err := negotiateProtocol(ProtocolVersion, t.minProtocol(), version, minVersion)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if setup != nil {
+		// The peer must hold a certificate for the node it claims to be
+		if err := setup.verifyPeer(conn.(*tls.Conn), peerID); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	if noise := t.noiseSetup(); noise != nil {
+		// The peer must complete the Noise handshake with the key pinned for it
+		secured, err := t.noiseAccept(noise, conn, msg)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		conn = secured
+	}
+	proven, err := t.proveAccept(conn, msg)
+	if err != nil || (!proven && (t.proofRequired() || t.claimsIdentity(peerID))) {
+		conn.Close()
+		return
+	}
+	t.setProven(peerID, proven)
+	t.mu.Lock()
+	verifier := t.verifier
+	t.mu.Unlock()
+	if verifier != nil && verifier(peerID, conn.RemoteAddr()) != nil {
+		conn.Close()
+		return
+	}
 	// Create connection object
 	connection := &Connection{
-		PeerID:    peerID,
-		Conn:      conn,
-		Connected: true,
+		PeerID:     peerID,
+		Conn:       conn,
+		Connected:  true,
+		lastActive: monoNow(),
+	}
+	connection.compact.Store(msg.Metadata["codec"] == CodecDict)
+	connection.protocol.Store(int32(negotiated))
+	if version >= protocolFeatures[FeatureProtocolHello] {
+		// Best effort: what the peer already sent is still read if the link is going away
+		t.sendMessage(conn, t.protocolHello(peerID), connection.compact.Load())
 	}
 
 	t.connMu.Lock()
 	t.connections[peerID] = connection
 	t.connMu.Unlock()
+	t.offerDatagrams(connection)
 
 	// Handle messages from this connection
 	t.handleConnection(connection)
@@ -271,18 +580,48 @@ func (t *Transport) handleConnection(conn *Connection) {
 		t.connMu.Unlock()
 	}()
 
+	t.mu.Lock()
+	ctx := t.ctx
+	t.mu.Unlock()
+
 	for {
 		select {
-		case <-t.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
 		}
 
 		conn.Conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-		msg, err := t.readMessage(conn.Conn)
+		msg, compact, err := t.readMessage(conn.Conn)
+		if errors.Is(err, ErrForgedMessage) {
+			if handler := t.signatureFailureHandler(); handler != nil {
+				handler(conn.PeerID, msg, err)
+			}
+			continue
+		}
 		if err != nil {
 			return
 		}
+		// A peer sending compact frames can read them too
+		if compact {
+			conn.compact.Store(true)
+		}
+		if !t.replay.accept(msg) {
+			continue
+		}
+		if msg.Type == protocolMessageType {
+			t.handleProtocol(conn, msg)
+			continue
+		}
+		if msg.Type == datagramMessageType {
+			t.handleDatagramOffer(conn, msg)
+			continue
+		}
+
+		if filter := t.messageFilter(); filter != nil && filter(conn.PeerID, msg, false) != nil {
+			continue
+		}
+		conn.touch(msg)
 
 		// Handle message
 		if t.onMessage != nil {
@@ -291,50 +630,97 @@ func (t *Transport) handleConnection(conn *Connection) {
 	}
 }
 
-// sendMessage sends a message over a connection
-func (t *Transport) sendMessage(conn net.Conn, msg *Message) error {
-	// Serialize message
-	data, err := json.Marshal(msg)
+// sendMessage sends a message over a connection, as a compact frame if the peer supports it
+func (t *Transport) sendMessage(conn net.Conn, msg *Message, compact bool) error {
+	data, err := t.encodeMessage(msg, compact)
 	if err != nil {
 		return err
 	}
 
-	// Write length prefix (4 bytes)
-	length := uint32(len(data))
-	if err := binary.Write(conn, binary.BigEndian, length); err != nil {
-		return err
+	// Length prefix (4 bytes) and message data in one write, so a frame is one WebSocket message
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	_, err = conn.Write(append(frame, data...))
+	return err
+}
+
+// encodeMessage numbers and signs a message of ours and serializes it, compactly if asked
+func (t *Transport) encodeMessage(msg *Message, compact bool) ([]byte, error) {
+	if msg.Source == t.nodeID && msg.Seq == 0 {
+		numbered := *msg
+		numbered.Seq = t.replay.nextSeq()
+		numbered.Boot = t.replay.boot
+		msg = &numbered
+	}
+	if identity := t.identitySetup(); identity != nil && msg.Source == t.nodeID && msg.Signature == nil {
+		msg = identity.sign(msg)
 	}
 
-	// Write message data
-	_, err = conn.Write(data)
-	return err
+	// Serialize message
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if compact {
+		return encodeCompact(data)
+	}
+	return data, nil
+}
+
+// SetMaxMessageSize limits the size of messages accepted from peers
+func (t *Transport) SetMaxMessageSize(size int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxMessageSize = size
 }
 
-// readMessage reads a message from a connection
-func (t *Transport) readMessage(conn net.Conn) (*Message, error) {
+func (t *Transport) messageLimit() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.maxMessageSize <= 0 {
+		return MaxMessageSize
+	}
+	return t.maxMessageSize
+}
+
+// readMessage reads a message from a connection, reporting whether it was a compact frame
+func (t *Transport) readMessage(conn net.Conn) (*Message, bool, error) {
 	// Read length prefix
 	var length uint32
 	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	if length > MaxMessageSize {
-		return nil, fmt.Errorf("message too large: %d bytes", length)
+	limit := t.messageLimit()
+	if int64(length) > int64(limit) {
+		return nil, false, fmt.Errorf("message too large: %d bytes", length)
 	}
 
 	// Read message data
 	data := make([]byte, length)
 	if _, err := io.ReadFull(conn, data); err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	return t.decodeMessage(data, limit)
+}
+
+// decodeMessage deserializes a frame and checks its signature, reporting whether it was compact
+func (t *Transport) decodeMessage(data []byte, limit int) (*Message, bool, error) {
+	data, compact, err := decodeFrame(data, limit)
+	if err != nil {
+		return nil, compact, err
 	}
 
 	// Deserialize message
 	var msg Message
 	if err := json.Unmarshal(data, &msg); err != nil {
-		return nil, err
+		return nil, compact, err
+	}
+	if err := t.verifySignature(&msg); err != nil {
+		return &msg, compact, err
 	}
 
-	return &msg, nil
+	return &msg, compact, nil
 }
 
 // Close closes a connection
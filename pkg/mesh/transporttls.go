@@ -0,0 +1,227 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// In TLS mode every peer connection is mutual TLS. A node's certificate names its node
+// ID as the common name, and a peer is only accepted if its certificate names the node
+// it claims to be. Certificates are either issued by a mesh CA the nodes share, or
+// self-signed and pinned the first time a peer is seen.
+
+const (
+	// NodeCertificateValidity is how long generated node certificates are valid
+	NodeCertificateValidity = 2 * 365 * 24 * time.Hour
+	// tlsHandshakeTimeout bounds each handshake of a new peer connection by default
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrPeerCertificate is returned when a peer's certificate doesn't prove its node ID
+	ErrPeerCertificate = errors.New("peer certificate rejected")
+)
+
+// transportTLS is the TLS setup of a transport
+type transportTLS struct {
+	cert  tls.Certificate
+	roots *x509.CertPool      // Mesh CA; nil pins self-signed certificates instead
+	pins  map[string][32]byte // Certificate fingerprints by peer, when pinning
+	mu    sync.Mutex
+}
+
+// NewMeshCA creates a CA that issues node certificates for a mesh
+func NewMeshCA(name string) (tls.Certificate, error) {
+	return newCertificate(name, true, nil)
+}
+
+// NewNodeCertificate creates the certificate a node presents to its peers, issued by ca,
+// or self-signed if ca is nil
+func NewNodeCertificate(nodeID string, ca *tls.Certificate) (tls.Certificate, error) {
+	return newCertificate(nodeID, false, ca)
+}
+
+// newCertificate creates a P-256 certificate for name, signed by parent or by itself
+func newCertificate(name string, isCA bool, parent *tls.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour), // Tolerate clocks that are a little behind
+		NotAfter:     now.Add(NodeCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+	}
+
+	issuer, signer := template, any(key)
+	if parent != nil {
+		if parent.Leaf == nil {
+			if parent.Leaf, err = x509.ParseCertificate(parent.Certificate[0]); err != nil {
+				return tls.Certificate{}, fmt.Errorf("invalid CA certificate: %w", err)
+			}
+		}
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// EnableTLS makes every new peer connection mutual TLS with cert, which must name this
+// node's ID. Peers are verified against roots when given; otherwise their self-signed
+// certificates are pinned on first contact. Peers without TLS can no longer connect.
+func (t *Transport) EnableTLS(cert tls.Certificate, roots *x509.CertPool) error {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return errors.New("certificate is empty")
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("invalid certificate: %w", err)
+		}
+	}
+	if leaf.Subject.CommonName != t.nodeID {
+		return fmt.Errorf("certificate is for %q, not this node (%q)", leaf.Subject.CommonName, t.nodeID)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.noise != nil {
+		return errors.New("noise is already enabled")
+	}
+	t.tls = &transportTLS{cert: cert, roots: roots, pins: make(map[string][32]byte)}
+	return nil
+}
+
+// TLSEnabled returns whether peer connections use TLS
+func (t *Transport) TLSEnabled() bool {
+	return t.tlsSetup() != nil
+}
+
+func (t *Transport) tlsSetup() *transportTLS {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tls
+}
+
+// PeerFingerprint returns the SHA-256 fingerprint pinned for a peer's certificate, so
+// users can compare it out of band
+func (t *Transport) PeerFingerprint(peerID string) ([32]byte, bool) {
+	setup := t.tlsSetup()
+	if setup == nil {
+		return [32]byte{}, false
+	}
+	setup.mu.Lock()
+	defer setup.mu.Unlock()
+	pin, ok := setup.pins[peerID]
+	return pin, ok
+}
+
+// config returns the TLS configuration of either side of a peer connection. Certificates
+// are checked by verifyPeer once the peer's node ID is known, so the handshake itself
+// only requires that one is presented.
+func (s *transportTLS) config() *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{s.cert},
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	}
+}
+
+// verifyPeer checks that a connection's peer certificate proves it is peerID
+func (s *transportTLS) verifyPeer(conn *tls.Conn, peerID string) error {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("%w: none presented", ErrPeerCertificate)
+	}
+	leaf := certs[0]
+	if leaf.Subject.CommonName != peerID {
+		return fmt.Errorf("%w: issued to %q, not %q", ErrPeerCertificate, leaf.Subject.CommonName, peerID)
+	}
+
+	if s.roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         s.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrPeerCertificate, err)
+		}
+		return nil
+	}
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pinned, ok := s.pins[peerID]; ok && !bytes.Equal(pinned[:], fingerprint[:]) {
+		return fmt.Errorf("%w: certificate changed since first contact", ErrPeerCertificate)
+	}
+	s.pins[peerID] = fingerprint
+	return nil
+}
+
+// clientHandshake secures a dialed connection and checks it reached peerID
+func (s *transportTLS) clientHandshake(conn net.Conn, peerID string, timeout time.Duration) (net.Conn, error) {
+	tlsConn := tls.Client(conn, s.config())
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	if err := s.verifyPeer(tlsConn, peerID); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// serverHandshake secures an accepted connection; the peer is verified once its
+// handshake message names it
+func (s *transportTLS) serverHandshake(conn net.Conn, timeout time.Duration) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, s.config())
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,257 @@
+package mesh
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Trust levels of a peer, from its trust score
+const (
+	TrustUntrusted = "untrusted" // Neither used as a proxy nor served by ours
+	TrustLow       = "low"
+	TrustNeutral   = "neutral" // Peers we know nothing about
+	TrustHigh      = "high"
+)
+
+// What a peer did that changes how far we trust it
+const (
+	TrustRelaySucceeded  = "relay_succeeded"  // Carried a request of ours as our proxy
+	TrustRelayFailed     = "relay_failed"     // Failed a request of ours as our proxy
+	TrustHandshakeFailed = "handshake_failed" // Failed to prove itself when we dialed it
+	TrustForgedMessage   = "forged_message"   // Sent a message with a bad signature
+	TrustQuotaExceeded   = "quota_exceeded"   // Used up its data quota on our proxy
+	TrustAbuse           = "abuse"            // Was demoted or banned as a client of our proxy
+)
+
+var trustWeights = map[string]float64{
+	TrustRelaySucceeded:  1,
+	TrustRelayFailed:     -2,
+	TrustHandshakeFailed: -5,
+	TrustForgedMessage:   -15,
+	TrustQuotaExceeded:   -10,
+	TrustAbuse:           -15,
+}
+
+const (
+	// TrustInitialScore is the score of a peer we know nothing about, out of 100
+	TrustInitialScore = 50
+	// Scores below TrustUntrustedScore and TrustLowScore, and from TrustHighScore up,
+	// give the untrusted, low and high levels
+	TrustUntrustedScore = 20
+	TrustLowScore       = 40
+	TrustHighScore      = 70
+	// TrustHalfLife is how quickly a score returns to TrustInitialScore
+	TrustHalfLife = time.Hour
+)
+
+// PeerTrust is how far we trust a peer and the history behind it
+type PeerTrust struct {
+	PeerID string         `json:"peer_id"`
+	Score  float64        `json:"score"`
+	Level  string         `json:"level"`
+	Events map[string]int `json:"events,omitempty"`
+}
+
+type peerTrust struct {
+	PeerTrust
+	updated time.Time
+}
+
+// TrustTracker scores peers by their history: relays they carried or failed for us,
+// handshakes they failed and how they behaved as clients of our proxy. Scores drift
+// back to neutral over time, so old history counts less. A nil tracker trusts everyone.
+type TrustTracker struct {
+	peers    map[string]*peerTrust
+	onChange func(peerID, level, reason string)
+	mu       sync.Mutex
+}
+
+// NewTrustTracker creates a tracker with every peer at neutral trust
+func NewTrustTracker() *TrustTracker {
+	return &TrustTracker{peers: make(map[string]*peerTrust)}
+}
+
+// SetChangeHandler sets a callback for when a peer's trust level changes
+func (t *TrustTracker) SetChangeHandler(handler func(peerID, level, reason string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onChange = handler
+}
+
+// trustLevel returns the level of a score
+func trustLevel(score float64) string {
+	switch {
+	case score < TrustUntrustedScore:
+		return TrustUntrusted
+	case score < TrustLowScore:
+		return TrustLow
+	case score >= TrustHighScore:
+		return TrustHigh
+	}
+	return TrustNeutral
+}
+
+// trustRank orders levels, higher is more trusted
+func trustRank(level string) int {
+	switch level {
+	case TrustUntrusted:
+		return 0
+	case TrustLow:
+		return 1
+	case TrustHigh:
+		return 3
+	}
+	return 2
+}
+
+// peerLocked returns a peer's record with its score decayed to now; t.mu must be held
+func (t *TrustTracker) peerLocked(peerID string, now time.Time) *peerTrust {
+	p, ok := t.peers[peerID]
+	if !ok {
+		p = &peerTrust{
+			PeerTrust: PeerTrust{PeerID: peerID, Score: TrustInitialScore, Level: TrustNeutral, Events: make(map[string]int)},
+			updated:   now,
+		}
+		t.peers[peerID] = p
+		return p
+	}
+	if elapsed := now.Sub(p.updated); elapsed > 0 {
+		p.Score = TrustInitialScore + (p.Score-TrustInitialScore)*math.Pow(0.5, float64(elapsed)/float64(TrustHalfLife))
+		p.updated = now
+	}
+	return p
+}
+
+// relevelLocked recomputes a peer's level, returning it and whether it changed; t.mu must be held
+func (t *TrustTracker) relevelLocked(p *peerTrust) (string, bool) {
+	level := trustLevel(p.Score)
+	if level == p.Level {
+		return level, false
+	}
+	p.Level = level
+	return level, true
+}
+
+func (t *TrustTracker) notify(peerID, level, reason string) {
+	t.mu.Lock()
+	handler := t.onChange
+	t.mu.Unlock()
+	if handler != nil {
+		handler(peerID, level, reason)
+	}
+}
+
+// Record counts something a peer did towards its trust score
+func (t *TrustTracker) Record(peerID, event string, now time.Time) {
+	if t == nil || peerID == "" {
+		return
+	}
+	t.mu.Lock()
+	p := t.peerLocked(peerID, now)
+	p.Score = math.Max(0, math.Min(100, p.Score+trustWeights[event]))
+	p.Events[event]++
+	level, changed := t.relevelLocked(p)
+	t.mu.Unlock()
+
+	if changed {
+		t.notify(peerID, level, event)
+	}
+}
+
+// Level returns a peer's trust level
+func (t *TrustTracker) Level(peerID string, now time.Time) string {
+	if t == nil {
+		return TrustNeutral
+	}
+	t.mu.Lock()
+	if _, ok := t.peers[peerID]; !ok {
+		t.mu.Unlock()
+		return TrustNeutral
+	}
+	level, changed := t.relevelLocked(t.peerLocked(peerID, now))
+	t.mu.Unlock()
+
+	if changed {
+		t.notify(peerID, level, "score decayed")
+	}
+	return level
+}
+
+// Trusted returns whether a peer may be used as a proxy and served by ours
+func (t *TrustTracker) Trusted(peerID string, now time.Time) bool {
+	return t.Level(peerID, now) != TrustUntrusted
+}
+
+// Trust returns a peer's score and the history behind it
+func (t *TrustTracker) Trust(peerID string, now time.Time) PeerTrust {
+	if t == nil {
+		return PeerTrust{PeerID: peerID, Score: TrustInitialScore, Level: TrustNeutral}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.peers[peerID]; !ok {
+		return PeerTrust{PeerID: peerID, Score: TrustInitialScore, Level: TrustNeutral}
+	}
+	return t.peerLocked(peerID, now).snapshot()
+}
+
+// Scores returns every peer with a history, least trusted first
+func (t *TrustTracker) Scores(now time.Time) []PeerTrust {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	scores := make([]PeerTrust, 0, len(t.peers))
+	for peerID := range t.peers {
+		scores = append(scores, t.peerLocked(peerID, now).snapshot())
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Score < scores[j].Score })
+	return scores
+}
+
+// snapshot copies a peer's trust, with the level its decayed score gives
+func (p *peerTrust) snapshot() PeerTrust {
+	trust := p.PeerTrust
+	trust.Level = trustLevel(p.Score)
+	trust.Events = make(map[string]int, len(p.Events))
+	for event, n := range p.Events {
+		trust.Events[event] = n
+	}
+	return trust
+}
+
+// SetTrustTracker makes SelectBestProxy skip untrusted proxies and prefer more trusted ones
+func (pm *ProxyManager) SetTrustTracker(trust *TrustTracker) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.trust = trust
+}
+
+// SetTrustTracker credits and blames our proxies with how they carry our requests
+func (c *InternetClient) SetTrustTracker(trust *TrustTracker) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trust = trust
+}
+
+func (c *InternetClient) trustTracker() *TrustTracker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trust
+}
+
+// handleHandshakeFailure counts a peer we dialed failing to prove itself against its trust
+func (ma *MeshApp) handleHandshakeFailure(peerID string, err error) {
+	ma.Trust.Record(peerID, TrustHandshakeFailed, time.Now())
+}
+
+// handleTrustChange reports peers whose trust level changed
+func (ma *MeshApp) handleTrustChange(peerID, level, reason string) {
+	detail := fmt.Sprintf("%s (%s)", level, reason)
+	ma.Audit.Record(AuditPeerTrust, peerID, detail)
+	ma.emitEvent(&Event{Type: EventTrustChanged, PeerID: peerID, Detail: detail})
+}
@@ -0,0 +1,106 @@
+package mesh
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ActiveTunnel describes an open CONNECT tunnel
+type ActiveTunnel struct {
+	ID            string    `json:"id"`
+	Client        string    `json:"client"` // Peer ID, or address of a local client
+	Host          string    `json:"host"`   // Destination host:port
+	Opened        time.Time `json:"opened"`
+	DurationMs    int64     `json:"duration_ms"`
+	BytesSent     int64     `json:"bytes_sent"`     // From the client to the destination
+	BytesReceived int64     `json:"bytes_received"` // From the destination to the client
+}
+
+// TunnelStats sums up the open tunnels, e.g. for "3 active connections, 42 MB"
+type TunnelStats struct {
+	Active        int            `json:"active"`
+	BytesSent     int64          `json:"bytes_sent"`
+	BytesReceived int64          `json:"bytes_received"`
+	Tunnels       []ActiveTunnel `json:"tunnels"` // Oldest first
+}
+
+// Tunnel counts the traffic of an open tunnel as it flows
+type Tunnel struct {
+	id       string
+	client   string
+	host     string
+	opened   time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// AddSent counts bytes the client sent to the destination
+func (t *Tunnel) AddSent(n int64) {
+	t.sent.Add(n)
+}
+
+// AddReceived counts bytes the destination sent to the client
+func (t *Tunnel) AddReceived(n int64) {
+	t.received.Add(n)
+}
+
+// TunnelTable tracks the tunnels a proxy has open
+type TunnelTable struct {
+	tunnels map[string]*Tunnel
+	next    uint64
+	mu      sync.Mutex
+}
+
+// NewTunnelTable creates an empty table
+func NewTunnelTable() *TunnelTable {
+	return &TunnelTable{tunnels: make(map[string]*Tunnel)}
+}
+
+// Open adds a tunnel from client to host; Close it when the tunnel ends
+func (tt *TunnelTable) Open(client, host string) *Tunnel {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.next++
+	t := &Tunnel{id: strconv.FormatUint(tt.next, 10), client: client, host: host, opened: time.Now()}
+	tt.tunnels[t.id] = t
+	return t
+}
+
+// Close removes a tunnel that ended
+func (tt *TunnelTable) Close(t *Tunnel) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	delete(tt.tunnels, t.id)
+}
+
+// Stats returns the open tunnels and their totals
+func (tt *TunnelTable) Stats(now time.Time) TunnelStats {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	stats := TunnelStats{Tunnels: make([]ActiveTunnel, 0, len(tt.tunnels))}
+	for _, t := range tt.tunnels {
+		tunnel := ActiveTunnel{
+			ID:            t.id,
+			Client:        t.client,
+			Host:          t.host,
+			Opened:        t.opened,
+			DurationMs:    now.Sub(t.opened).Milliseconds(),
+			BytesSent:     t.sent.Load(),
+			BytesReceived: t.received.Load(),
+		}
+		stats.BytesSent += tunnel.BytesSent
+		stats.BytesReceived += tunnel.BytesReceived
+		stats.Tunnels = append(stats.Tunnels, tunnel)
+	}
+	stats.Active = len(stats.Tunnels)
+	sort.Slice(stats.Tunnels, func(i, j int) bool { return stats.Tunnels[i].Opened.Before(stats.Tunnels[j].Opened) })
+	return stats
+}
+
+// ActiveTunnels returns the CONNECT tunnels clients have open through the proxy
+func (p *InternetProxy) ActiveTunnels() TunnelStats {
+	return p.tunnels.Stats(time.Now())
+}
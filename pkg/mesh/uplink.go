@@ -0,0 +1,168 @@
+package mesh
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// UplinkThresholds defines when the node's own upstream is too weak to share
+type UplinkThresholds struct {
+	MaxLatency time.Duration // Average probe latency above which the uplink is degraded
+	MaxLoss    float64       // Fraction of failed probes (0..1) above which the uplink is degraded
+	Window     int           // Number of recent probes taken into account
+}
+
+// DefaultUplinkThresholds returns thresholds suited to typical cellular and Wi-Fi uplinks
+func DefaultUplinkThresholds() UplinkThresholds {
+	return UplinkThresholds{
+		MaxLatency: 800 * time.Millisecond,
+		MaxLoss:    0.3,
+		Window:     10,
+	}
+}
+
+const (
+	UplinkProbeInterval = 10 * time.Second
+	minUplinkSamples    = 3
+)
+
+type uplinkSample struct {
+	latency time.Duration
+	failed  bool
+}
+
+// UplinkMonitor continuously measures the quality of the node's upstream connection.
+// Recovery uses tighter thresholds than degradation so the state doesn't flap.
+type UplinkMonitor struct {
+	thresholds UplinkThresholds
+	probe      func() (time.Duration, error)
+	samples    []uplinkSample
+	degraded   bool
+	mu         sync.Mutex
+}
+
+// NewUplinkMonitor creates a new uplink monitor
+func NewUplinkMonitor(thresholds UplinkThresholds) *UplinkMonitor {
+	if thresholds.Window < minUplinkSamples {
+		thresholds.Window = minUplinkSamples
+	}
+	return &UplinkMonitor{
+		thresholds: thresholds,
+		probe:      probeUplink,
+		samples:    make([]uplinkSample, 0, thresholds.Window),
+	}
+}
+
+// SetWindow changes how many recent probes are kept, dropping the oldest if needed
+func (um *UplinkMonitor) SetWindow(window int) {
+	if window < minUplinkSamples {
+		window = minUplinkSamples
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.thresholds.Window = window
+	if len(um.samples) > window {
+		um.samples = append([]uplinkSample(nil), um.samples[len(um.samples)-window:]...)
+	}
+}
+
+// SetProbe replaces the function used to measure the uplink
+func (um *UplinkMonitor) SetProbe(probe func() (time.Duration, error)) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.probe = probe
+}
+
+// Measure runs one probe and returns whether the degraded state changed
+func (um *UplinkMonitor) Measure() (changed bool, degraded bool) {
+	um.mu.Lock()
+	probe := um.probe
+	um.mu.Unlock()
+
+	latency, err := probe()
+	return um.Record(latency, err)
+}
+
+// Record adds a probe result and returns whether the degraded state changed
+func (um *UplinkMonitor) Record(latency time.Duration, err error) (changed bool, degraded bool) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.samples = append(um.samples, uplinkSample{latency: latency, failed: err != nil})
+	if len(um.samples) > um.thresholds.Window {
+		um.samples = um.samples[len(um.samples)-um.thresholds.Window:]
+	}
+	if len(um.samples) < minUplinkSamples {
+		return false, um.degraded
+	}
+
+	avgLatency, loss := um.statsLocked()
+	wasDegraded := um.degraded
+	if um.degraded {
+		// Recover only once comfortably below the thresholds
+		um.degraded = avgLatency > um.thresholds.MaxLatency*8/10 || loss > um.thresholds.MaxLoss/2
+	} else {
+		um.degraded = avgLatency > um.thresholds.MaxLatency || loss > um.thresholds.MaxLoss
+	}
+	return wasDegraded != um.degraded, um.degraded
+}
+
+// Reset forgets all probes, so measuring starts afresh as not degraded
+func (um *UplinkMonitor) Reset() {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.samples = um.samples[:0]
+	um.degraded = false
+}
+
+// IsDegraded returns whether the uplink is currently considered too weak to share
+func (um *UplinkMonitor) IsDegraded() bool {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	return um.degraded
+}
+
+// Stats returns the average latency of successful probes and the loss ratio
+func (um *UplinkMonitor) Stats() (time.Duration, float64) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	return um.statsLocked()
+}
+
+func (um *UplinkMonitor) statsLocked() (time.Duration, float64) {
+	if len(um.samples) == 0 {
+		return 0, 0
+	}
+	var total time.Duration
+	ok, failed := 0, 0
+	for _, sample := range um.samples {
+		if sample.failed {
+			failed++
+			continue
+		}
+		total += sample.latency
+		ok++
+	}
+	var avg time.Duration
+	if ok > 0 {
+		avg = total / time.Duration(ok)
+	}
+	return avg, float64(failed) / float64(len(um.samples))
+}
+
+// probeUplink measures the time to open a TCP connection to a well-known server
+func probeUplink() (time.Duration, error) {
+	var lastErr error
+	for _, server := range internetProbeServers {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", server, 3*time.Second)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.Close()
+		return time.Since(start), nil
+	}
+	return 0, lastErr
+}
@@ -0,0 +1,257 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The usage log is an opt-in record of what clients used a sharer's connection for: one
+// record per request with its destination and bytes, kept in memory within retention
+// limits for querying and passed on to sinks for keeping elsewhere. Bodies, paths and
+// queries are never recorded; for tunnels only the host is known anyway.
+
+// Default usage log retention
+const (
+	DefaultUsageRecords = 10000
+	DefaultUsageMaxAge  = 7 * 24 * time.Hour
+)
+
+// UsageRecord is one client request through the exit
+type UsageRecord struct {
+	Time          time.Time `json:"time"`
+	Client        string    `json:"client"` // Peer ID, or address of a plain client
+	Method        string    `json:"method"`
+	Host          string    `json:"host"` // Destination host, without port
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Status        int       `json:"status,omitempty"`
+	Refused       string    `json:"refused,omitempty"` // Why the request was refused, see RefusedBlocklist and others
+	DurationMs    int64     `json:"duration_ms"`
+}
+
+// UsageRetention limits the records a usage log keeps in memory; zero fields fall back
+// to the defaults
+type UsageRetention struct {
+	MaxRecords int
+	MaxAge     time.Duration
+}
+
+// UsageSink receives usage records as they are made
+type UsageSink interface {
+	WriteUsage(record *UsageRecord) error
+	Close() error
+}
+
+// UsageQuery selects usage records; zero fields match everything
+type UsageQuery struct {
+	Client string
+	Host   string // Matches the host and its subdomains
+	Since  time.Time
+	Until  time.Time
+	Limit  int // Most recent records returned
+}
+
+// UsageSummary totals one client's usage
+type UsageSummary struct {
+	Client        string   `json:"client"`
+	Requests      int      `json:"requests"`
+	Refused       int      `json:"refused"`
+	BytesSent     int64    `json:"bytes_sent"`
+	BytesReceived int64    `json:"bytes_received"`
+	TopHosts      []string `json:"top_hosts"` // By bytes, most first
+}
+
+// maxSummaryHosts is how many hosts a summary lists per client
+const maxSummaryHosts = 10
+
+// UsageLog keeps recent usage records. A nil UsageLog records nothing.
+type UsageLog struct {
+	retention UsageRetention
+	records   []UsageRecord // Oldest first
+	sinks     []UsageSink
+	errors    uint64
+	mu        sync.Mutex
+}
+
+// NewUsageLog creates a usage log with no sinks
+func NewUsageLog(retention UsageRetention) *UsageLog {
+	if retention.MaxRecords <= 0 {
+		retention.MaxRecords = DefaultUsageRecords
+	}
+	if retention.MaxAge <= 0 {
+		retention.MaxAge = DefaultUsageMaxAge
+	}
+	return &UsageLog{retention: retention}
+}
+
+// AddSink starts delivering records to a sink
+func (l *UsageLog) AddSink(sink UsageSink) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sinks = append(l.sinks, sink)
+}
+
+// Close closes and removes all sinks
+func (l *UsageLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	sinks := l.sinks
+	l.sinks = nil
+	l.mu.Unlock()
+
+	var firstErr error
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Record keeps a record and writes it to every sink
+func (l *UsageLog) Record(record UsageRecord) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.records = append(l.records, record)
+	l.pruneLocked(record.Time)
+	sinks := l.sinks
+	l.mu.Unlock()
+
+	for _, sink := range sinks {
+		if err := sink.WriteUsage(&record); err != nil {
+			atomic.AddUint64(&l.errors, 1)
+		}
+	}
+}
+
+// pruneLocked drops records beyond the retention limits
+func (l *UsageLog) pruneLocked(now time.Time) {
+	drop := max(len(l.records)-l.retention.MaxRecords, 0)
+	cutoff := now.Add(-l.retention.MaxAge)
+	for drop < len(l.records) && l.records[drop].Time.Before(cutoff) {
+		drop++
+	}
+	// Appending copies the kept records to a new array once this one is used up
+	l.records = l.records[drop:]
+}
+
+// Errors returns how many records sinks failed to write
+func (l *UsageLog) Errors() uint64 {
+	return atomic.LoadUint64(&l.errors)
+}
+
+// Query returns the kept records q selects, oldest first
+func (l *UsageLog) Query(q UsageQuery) []UsageRecord {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(time.Now())
+
+	host := normalizeHost(q.Host)
+	var matched []UsageRecord
+	for _, record := range l.records {
+		if q.Client != "" && record.Client != q.Client {
+			continue
+		}
+		if host != "" && record.Host != host && !strings.HasSuffix(record.Host, "."+host) {
+			continue
+		}
+		if (!q.Since.IsZero() && record.Time.Before(q.Since)) || (!q.Until.IsZero() && !record.Time.Before(q.Until)) {
+			continue
+		}
+		matched = append(matched, record)
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[len(matched)-q.Limit:]
+	}
+	return matched
+}
+
+// Summary totals the usage of each client since a time, heaviest users first
+func (l *UsageLog) Summary(since time.Time) []UsageSummary {
+	byClient := make(map[string]*UsageSummary)
+	hostBytes := make(map[string]map[string]int64)
+	for _, record := range l.Query(UsageQuery{Since: since}) {
+		summary := byClient[record.Client]
+		if summary == nil {
+			summary = &UsageSummary{Client: record.Client}
+			byClient[record.Client] = summary
+			hostBytes[record.Client] = make(map[string]int64)
+		}
+		summary.Requests++
+		if record.Refused != "" {
+			summary.Refused++
+		}
+		summary.BytesSent += record.BytesSent
+		summary.BytesReceived += record.BytesReceived
+		hostBytes[record.Client][record.Host] += record.BytesSent + record.BytesReceived
+	}
+
+	summaries := make([]UsageSummary, 0, len(byClient))
+	for client, summary := range byClient {
+		hosts := hostBytes[client]
+		for host := range hosts {
+			summary.TopHosts = append(summary.TopHosts, host)
+		}
+		sort.Slice(summary.TopHosts, func(i, j int) bool {
+			a, b := summary.TopHosts[i], summary.TopHosts[j]
+			return hosts[a] > hosts[b] || (hosts[a] == hosts[b] && a < b)
+		})
+		if len(summary.TopHosts) > maxSummaryHosts {
+			summary.TopHosts = summary.TopHosts[:maxSummaryHosts]
+		}
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		return a.BytesSent+a.BytesReceived > b.BytesSent+b.BytesReceived ||
+			(a.BytesSent+a.BytesReceived == b.BytesSent+b.BytesReceived && a.Client < b.Client)
+	})
+	return summaries
+}
+
+// FileUsageSink appends usage records to a file as JSON lines
+type FileUsageSink struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+// NewFileUsageSink opens (or creates) a usage log readable only by its owner
+func NewFileUsageSink(path string) (*FileUsageSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage log: %w", err)
+	}
+	return &FileUsageSink{file: file}, nil
+}
+
+// WriteUsage appends one record
+func (s *FileUsageSink) WriteUsage(record *UsageRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the usage log file
+func (s *FileUsageSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,435 @@
+package mesh
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Browsers can't open TCP connections, and some networks only let HTTP through, so the
+// transport also carries peer links over WebSocket (RFC 6455). A WebSocket link is a
+// byte stream like a TCP one: every binary message holds one length-prefixed Message
+// frame, and the handshake, TLS or Noise setup and identity proof run over it unchanged,
+// so peers can't tell how the other side is attached. Text frames aren't accepted.
+
+const (
+	// WebSocketPath is where ListenWebSocket serves peer links
+	WebSocketPath = "/mesh"
+	// WebSocketSubprotocol is offered by dialers and confirmed by listeners
+	WebSocketSubprotocol = "intermesh"
+
+	// wsFrameSlack is what a WebSocket message may carry beyond the largest transport
+	// message: the length prefix, and TLS or Noise record overhead
+	wsFrameSlack = 4096
+	// wsAcceptGUID is appended to the client's key to prove the server speaks WebSocket
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// WebSocket opcodes
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// ErrWebSocketProtocol is wrapped by errors for peers that break the WebSocket protocol
+var ErrWebSocketProtocol = errors.New("websocket protocol error")
+
+// wsConn is a WebSocket connection read and written as a byte stream
+type wsConn struct {
+	net.Conn
+	r         *bufio.Reader
+	client    bool // We dialed, so we mask what we send and the peer must not
+	maxFrame  int
+	pending   []byte // Rest of the message being read
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+// Read returns bytes of the binary messages the peer sent, answering pings on the way
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = message
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends p as one binary message
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close tells the peer we are going away, then closes the connection
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsOpClose, []byte{0x03, 0xe8}) // 1000, normal closure
+	})
+	return c.Conn.Close()
+}
+
+// readMessage reads frames until a whole data message arrived
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+		case wsOpPong:
+		case wsOpClose:
+			c.closeOnce.Do(func() { c.writeFrame(wsOpClose, nil) })
+			return nil, io.EOF
+		case wsOpBinary, wsOpContinuation:
+			if started == (opcode == wsOpBinary) {
+				return nil, fmt.Errorf("%w: unexpected frame %d", ErrWebSocketProtocol, opcode)
+			}
+			started = true
+			if len(message)+len(payload) > c.maxFrame {
+				return nil, fmt.Errorf("%w: message over %d bytes", ErrWebSocketProtocol, c.maxFrame)
+			}
+			message = append(message, payload...)
+			if fin {
+				return message, nil
+			}
+		case wsOpText:
+			return nil, fmt.Errorf("%w: text messages aren't supported", ErrWebSocketProtocol)
+		default:
+			return nil, fmt.Errorf("%w: unknown opcode %d", ErrWebSocketProtocol, opcode)
+		}
+	}
+}
+
+// readFrame reads one frame, unmasking its payload
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0f
+	masked := head[1]&0x80 != 0
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("%w: reserved bits set", ErrWebSocketProtocol)
+	}
+	// Clients mask every frame they send and servers none
+	if masked == c.client {
+		return false, 0, nil, fmt.Errorf("%w: wrong masking", ErrWebSocketProtocol)
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsOpClose && (length > 125 || !fin) {
+		return false, 0, nil, fmt.Errorf("%w: bad control frame", ErrWebSocketProtocol)
+	}
+	if length > uint64(c.maxFrame) {
+		return false, 0, nil, fmt.Errorf("%w: frame of %d bytes", ErrWebSocketProtocol, length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame sends one unfragmented frame, masked if we are the client
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// wsAccept is the Sec-WebSocket-Accept answer to a client's key
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether a comma-separated header lists token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptWebSocket upgrades an HTTP request to a WebSocket connection, answering it with
+// an error if it isn't a valid upgrade
+func acceptWebSocket(w http.ResponseWriter, r *http.Request, maxFrame int) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%w: not an upgrade", ErrWebSocketProtocol)
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%w: version %q", ErrWebSocketProtocol, r.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket upgrade unavailable", http.StatusInternalServerError)
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n"
+	if headerHasToken(r.Header, "Sec-WebSocket-Protocol", WebSocketSubprotocol) {
+		response += "Sec-WebSocket-Protocol: " + WebSocketSubprotocol + "\r\n"
+	}
+	if _, err := rw.WriteString(response + "\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{Conn: conn, r: rw.Reader, maxFrame: maxFrame}, nil
+}
+
+// dialWebSocket opens a WebSocket connection to a ws:// or wss:// URL; a URL without a
+// path gets WebSocketPath
+func dialWebSocket(rawURL string, timeout time.Duration, maxFrame int) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	port := "80"
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		port = "443"
+	default:
+		return nil, fmt.Errorf("not a WebSocket URL: %s", rawURL)
+	}
+	if u.Path == "" {
+		u.Path = WebSocketPath
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		secured := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := secured.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = secured
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: http.Header{
+		"Upgrade":                {"websocket"},
+		"Connection":             {"Upgrade"},
+		"Sec-WebSocket-Key":      {key},
+		"Sec-WebSocket-Version":  {"13"},
+		"Sec-WebSocket-Protocol": {WebSocketSubprotocol},
+	}}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: upgrade refused with %s", ErrWebSocketProtocol, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{Conn: conn, r: r, client: true, maxFrame: maxFrame}, nil
+}
+
+// WebSocketHandler serves peer links upgraded from HTTP, for mounting on a server of
+// the host's, e.g. behind a reverse proxy that terminates TLS
+func (t *Transport) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.IsRunning() {
+			http.Error(w, "mesh transport not running", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := acceptWebSocket(w, r, t.messageLimit()+wsFrameSlack)
+		if err != nil {
+			return
+		}
+		// The connection was hijacked, so it is ours to serve from this goroutine
+		t.handleIncomingConnection(conn)
+	})
+}
+
+// ListenWebSocket serves peer links over WebSocket at WebSocketPath on addr, such as
+// ":8080", until the transport stops
+func (t *Transport) ListenWebSocket(addr string) error {
+	if !t.IsRunning() {
+		return errors.New("transport not running")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start WebSocket listener: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, t.WebSocketHandler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: t.timeoutPolicy().PeerHandshake}
+
+	t.mu.Lock()
+	if t.wsServer != nil {
+		t.mu.Unlock()
+		listener.Close()
+		return errors.New("already listening for WebSocket peers")
+	}
+	t.wsServer, t.wsListener = server, listener
+	t.mu.Unlock()
+
+	go server.Serve(listener)
+	return nil
+}
+
+// WebSocketAddr returns the address WebSocket peers are served on, or "" if none
+func (t *Transport) WebSocketAddr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.wsListener == nil {
+		return ""
+	}
+	return t.wsListener.Addr().String()
+}
+
+// stopWebSocket stops serving WebSocket peers; their links close with the transport's
+func (t *Transport) stopWebSocket() {
+	t.mu.Lock()
+	server := t.wsServer
+	t.wsServer, t.wsListener = nil, nil
+	t.mu.Unlock()
+	if server != nil {
+		server.Close()
+	}
+}
+
+// ConnectWebSocket links to a peer served at a ws:// or wss:// URL, e.g. one behind a
+// firewall that only lets HTTP through
+func (t *Transport) ConnectWebSocket(peerID, rawURL string) error {
+	t.connMu.RLock()
+	_, exists := t.connections[peerID]
+	t.connMu.RUnlock()
+	if exists {
+		return nil
+	}
+	conn, err := dialWebSocket(rawURL, t.timeoutPolicy().PeerDial, t.messageLimit()+wsFrameSlack)
+	if err != nil {
+		return fmt.Errorf("failed to connect to peer: %w", err)
+	}
+	return t.connectOver(peerID, conn)
+}
@@ -0,0 +1,332 @@
+package mesh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Members of a personal network can hand each other the credentials of a Wi-Fi network,
+// such as the hotspot a hotspot election picked or a home access point. A share goes
+// only to paired peers we trust that are members of the network it is shared within,
+// sealed with the pairing key; there is no fallback to the transport's encryption, as
+// the passphrase outlives the link. Shares expire, at most MaxWiFiCredentialTTL after
+// they were made, and the sharer can revoke them, which tells everyone it shared with
+// to forget them. Received credentials are kept in memory only, never in the keystore
+// or peer database, and their String omits the passphrase so they can't end up in logs.
+
+const (
+	// DefaultWiFiCredentialTTL is how long a share lasts unless the sharer says otherwise
+	DefaultWiFiCredentialTTL = 24 * time.Hour
+	// MaxWiFiCredentialTTL bounds how long a share lasts, whatever the sharer says
+	MaxWiFiCredentialTTL = 7 * 24 * time.Hour
+
+	wifiCredentialMessageType = "wifi_credential"
+	wifiRevokeMessageType     = "wifi_credential_revoke"
+)
+
+// ErrNotCredentialPeer is wrapped by errors for peers Wi-Fi credentials may not go to
+var ErrNotCredentialPeer = errors.New("peer may not receive wifi credentials")
+
+// WiFiCredential is a Wi-Fi network shared by a member of a personal network
+type WiFiCredential struct {
+	ID         string    `json:"id"`
+	NetworkID  string    `json:"network_id"` // The personal network it is shared within
+	From       string    `json:"from"`       // The node that shared it
+	SSID       string    `json:"ssid"`
+	Passphrase string    `json:"passphrase"`
+	Security   string    `json:"security,omitempty"` // e.g. "wpa2", "wpa3", "open"
+	Expires    time.Time `json:"expires"`
+}
+
+// String describes the credential without its passphrase
+func (c WiFiCredential) String() string {
+	return fmt.Sprintf("wifi credential %s for %q from %s in %s, expires %s",
+		c.ID, c.SSID, c.From, c.NetworkID, c.Expires.Format(time.RFC3339))
+}
+
+// GoString keeps %#v from printing the passphrase
+func (c WiFiCredential) GoString() string {
+	return c.String()
+}
+
+// sharedWiFiCredential is one of ours and the peers it went to
+type sharedWiFiCredential struct {
+	credential WiFiCredential
+	peers      []string
+}
+
+// wifiCredentials holds the credentials we shared and were shared with us
+type wifiCredentials struct {
+	shared   map[string]*sharedWiFiCredential
+	received map[string]WiFiCredential
+	revoked  map[string]time.Time // Revoked credentials, until they would have expired
+	mu       sync.Mutex
+}
+
+func newWiFiCredentials() *wifiCredentials {
+	return &wifiCredentials{
+		shared:   make(map[string]*sharedWiFiCredential),
+		received: make(map[string]WiFiCredential),
+		revoked:  make(map[string]time.Time),
+	}
+}
+
+// pruneLocked forgets expired credentials and revocations; w.mu must be held
+func (w *wifiCredentials) pruneLocked(now time.Time) {
+	for id, shared := range w.shared {
+		if !now.Before(shared.credential.Expires) {
+			delete(w.shared, id)
+		}
+	}
+	for id, credential := range w.received {
+		if !now.Before(credential.Expires) {
+			delete(w.received, id)
+		}
+	}
+	for id, expires := range w.revoked {
+		if !now.Before(expires) {
+			delete(w.revoked, id)
+		}
+	}
+}
+
+// CheckWiFiCredentialPeer returns nil if Wi-Fi credentials may go to or come from a
+// peer: it must be paired, trusted and a member of a personal network we are in, of
+// networkID if given. Otherwise the error wraps ErrNotCredentialPeer.
+func (ma *MeshApp) CheckWiFiCredentialPeer(peerID, networkID string) error {
+	if _, ok := ma.Pairing.key(peerID); !ok {
+		return fmt.Errorf("%w: %s isn't paired", ErrNotCredentialPeer, peerID)
+	}
+	if !ma.Trust.Trusted(peerID, time.Now()) {
+		return fmt.Errorf("%w: %s isn't trusted", ErrNotCredentialPeer, peerID)
+	}
+	if networkID != "" {
+		if network, ok := ma.PersonalNetworkMgr.GetNetwork(networkID); ok && network.includes(ma.Node.ID) && network.includes(peerID) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s isn't a member of %s with us", ErrNotCredentialPeer, peerID, networkID)
+	}
+	if ma.PersonalNetworkMgr.sharedNetwork(ma.Node.ID, peerID) == nil {
+		return fmt.Errorf("%w: %s shares no personal network with us", ErrNotCredentialPeer, peerID)
+	}
+	return nil
+}
+
+// sharedNetwork returns a personal network both nodes are in, owners included
+func (pnm *PersonalNetworkManager) sharedNetwork(a, b string) *PersonalNetwork {
+	pnm.mu.RLock()
+	defer pnm.mu.RUnlock()
+	for _, network := range pnm.Networks {
+		if network.includes(a) && network.includes(b) {
+			return network
+		}
+	}
+	return nil
+}
+
+// ShareWiFiCredential shares a Wi-Fi network with the members of a personal network we
+// are in, or only with peerIDs if given, for ttl (DefaultWiFiCredentialTTL if zero). It
+// returns the share's ID, for RevokeWiFiCredential. Members it can't go to are skipped
+// with an EventWiFiCredentialWithheld; it fails if it went to nobody.
+func (ma *MeshApp) ShareWiFiCredential(networkID, ssid, passphrase, security string, ttl time.Duration, peerIDs ...string) (string, error) {
+	network, ok := ma.PersonalNetworkMgr.GetNetwork(networkID)
+	if !ok || !network.includes(ma.Node.ID) {
+		return "", fmt.Errorf("not a member of network %q", networkID)
+	}
+	if ssid == "" {
+		return "", fmt.Errorf("no SSID to share")
+	}
+	if ttl <= 0 {
+		ttl = DefaultWiFiCredentialTTL
+	}
+	credential := WiFiCredential{
+		ID:         NewID(),
+		NetworkID:  networkID,
+		From:       ma.Node.ID,
+		SSID:       ssid,
+		Passphrase: passphrase,
+		Security:   security,
+		Expires:    time.Now().Add(min(ttl, MaxWiFiCredentialTTL)),
+	}
+	if len(peerIDs) == 0 {
+		for _, member := range network.GetAllMembers() {
+			peerIDs = append(peerIDs, member.NodeID)
+		}
+		if network.Owner != "" && !network.IsMember(network.Owner) {
+			peerIDs = append(peerIDs, network.Owner)
+		}
+	}
+
+	var sent []string
+	for _, peerID := range peerIDs {
+		if peerID == ma.Node.ID || peerID == "" {
+			continue
+		}
+		if err := ma.sendWiFiCredential(&credential, peerID); err != nil {
+			ma.emitEvent(&Event{Type: EventWiFiCredentialWithheld, PeerID: peerID,
+				Detail: fmt.Sprintf("%s: %v", credential.ID, err)})
+			continue
+		}
+		sent = append(sent, peerID)
+	}
+	if len(sent) == 0 {
+		return "", fmt.Errorf("wifi credential reached no member of %s", networkID)
+	}
+
+	w := ma.wifiCreds
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pruneLocked(time.Now())
+	w.shared[credential.ID] = &sharedWiFiCredential{credential: credential, peers: sent}
+	return credential.ID, nil
+}
+
+func (ma *MeshApp) sendWiFiCredential(credential *WiFiCredential, peerID string) error {
+	if err := ma.CheckWiFiCredentialPeer(peerID, credential.NetworkID); err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	sealed, err := ma.SealForPeer(peerID, plaintext)
+	if err != nil {
+		return err
+	}
+	return ma.Transport.SendMessage(peerID, &Message{
+		Type:      wifiCredentialMessageType,
+		Source:    ma.Node.ID,
+		Dest:      peerID,
+		Payload:   sealed,
+		Timestamp: time.Now(),
+	})
+}
+
+// RevokeWiFiCredential withdraws a credential: one we shared is forgotten by everyone
+// it went to, one shared with us is forgotten here
+func (ma *MeshApp) RevokeWiFiCredential(id string) error {
+	w := ma.wifiCreds
+	w.mu.Lock()
+	shared, ours := w.shared[id]
+	received, theirs := w.received[id]
+	delete(w.shared, id)
+	delete(w.received, id)
+	switch {
+	case ours:
+		w.revoked[id] = shared.credential.Expires
+	case theirs:
+		w.revoked[id] = received.Expires
+	}
+	w.mu.Unlock()
+
+	if !ours {
+		if !theirs {
+			return fmt.Errorf("unknown wifi credential %q", id)
+		}
+		return nil
+	}
+	var errs []error
+	for _, peerID := range shared.peers {
+		err := ma.Transport.SendMessage(peerID, &Message{
+			Type:      wifiRevokeMessageType,
+			Source:    ma.Node.ID,
+			Dest:      peerID,
+			Timestamp: time.Now(),
+			Metadata:  map[string]string{"id": id},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", peerID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WiFiCredentials returns the unexpired credentials shared with us, soonest to expire first
+func (ma *MeshApp) WiFiCredentials() []WiFiCredential {
+	w := ma.wifiCreds
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pruneLocked(time.Now())
+	credentials := make([]WiFiCredential, 0, len(w.received))
+	for _, credential := range w.received {
+		credentials = append(credentials, credential)
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].Expires.Before(credentials[j].Expires)
+	})
+	return credentials
+}
+
+// WiFiCredentialFor returns the unexpired credential shared with us for an SSID,
+// the one lasting longest if there are several
+func (ma *MeshApp) WiFiCredentialFor(ssid string) (WiFiCredential, bool) {
+	credentials := ma.WiFiCredentials()
+	for i := len(credentials) - 1; i >= 0; i-- {
+		if strings.EqualFold(credentials[i].SSID, ssid) {
+			return credentials[i], true
+		}
+	}
+	return WiFiCredential{}, false
+}
+
+func (ma *MeshApp) handleWiFiCredential(peerID string, msg *Message) {
+	if msg.Source != peerID {
+		return
+	}
+	from, plaintext, err := ma.OpenFromPeer(msg.Payload)
+	if err != nil || from != peerID {
+		ma.emitEvent(&Event{Type: EventWiFiCredentialWithheld, PeerID: peerID, Detail: "wifi credential couldn't be opened"})
+		return
+	}
+	var credential WiFiCredential
+	if err := json.Unmarshal(plaintext, &credential); err != nil || credential.ID == "" || credential.SSID == "" {
+		return
+	}
+	now := time.Now()
+	credential.From = peerID
+	if err := ma.CheckWiFiCredentialPeer(peerID, credential.NetworkID); err != nil {
+		ma.emitEvent(&Event{Type: EventWiFiCredentialWithheld, PeerID: peerID,
+			Detail: fmt.Sprintf("%s: %v", credential.ID, err)})
+		return
+	}
+	if limit := now.Add(MaxWiFiCredentialTTL); credential.Expires.After(limit) {
+		credential.Expires = limit
+	}
+	if !now.Before(credential.Expires) {
+		return
+	}
+
+	w := ma.wifiCreds
+	w.mu.Lock()
+	w.pruneLocked(now)
+	if _, revoked := w.revoked[credential.ID]; revoked {
+		w.mu.Unlock()
+		return
+	}
+	w.received[credential.ID] = credential
+	w.mu.Unlock()
+	ma.emitEvent(&Event{Type: EventWiFiCredentialReceived, PeerID: peerID, Detail: credential.ID})
+}
+
+func (ma *MeshApp) handleWiFiRevoke(peerID string, msg *Message) {
+	id := msg.Metadata["id"]
+	if msg.Source != peerID || id == "" {
+		return
+	}
+	w := ma.wifiCreds
+	w.mu.Lock()
+	credential, ok := w.received[id]
+	if ok && credential.From == peerID {
+		delete(w.received, id)
+		w.revoked[id] = credential.Expires
+	}
+	w.mu.Unlock()
+	if ok && credential.From == peerID {
+		ma.emitEvent(&Event{Type: EventWiFiCredentialRevoked, PeerID: peerID, Detail: id})
+	}
+}